@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/attemptlog"
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// Custom metadata keys anchoring the attempt log head of a device in Vault
+const (
+	attemptsLogSeqKey  = "attempts_log_seq"
+	attemptsLogHashKey = "attempts_log_hash"
+)
+
+var verifyAttemptsLogCmd = &cobra.Command{
+	Use:   "verify-attempts-log [uuid...]",
+	Short: "Verify the decrypt attempts log against Vault",
+	Long: `Verify the hash chain of the decrypt attempts log and compare it with the chain
+position recorded in each device's Vault metadata.
+
+Without arguments every device stored under this host's Vault path is checked, along with
+those stored under the path_prefix of each [[device]] profile. --profile checks only that
+profile's location, and is needed for UUIDs given as arguments whose keys are stored there.
+Chain positions are only recorded on the configured backend, so profiles with their own
+backend are skipped.
+
+A broken chain means entries were edited or removed; a recorded position beyond the
+end of the log means the log was truncated or deleted. Exits non-zero on any problem.
+
+Recording chain positions in Vault requires kv_version = "2".`,
+	Example: `  vault-dm-crypt verify-attempts-log
+  vault-dm-crypt verify-attempts-log --attempts-log /var/log/vault-dm-crypt/attempts.log 1234-abcd`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		path := attemptsLogPath(cmd)
+		if path == "" {
+			return fmt.Errorf("no attempts log configured; set [security] attempts_log or --attempts-log")
+		}
+
+		locations, err := vaultLocations(cmd)
+		if err != nil {
+			return err
+		}
+		// UUIDs named on the command line are looked up in a single location
+		if len(args) > 0 {
+			locations = locations[:1]
+		}
+
+		var results []attemptsResult
+		for _, location := range locations {
+			if location.Vault.Backend != cfg.Vault.Backend {
+				logger.WithField("profile", profileName(location.Profile)).Warn("Not verifying attempts log for a profile with its own backend: chain positions are only recorded on the configured backend")
+				continue
+			}
+			basePath, err := location.Vault.SecretListPath()
+			if err != nil {
+				return err
+			}
+
+			verifier := &attemptsVerifier{store: vaultClient, basePath: basePath}
+			located, err := verifier.verify(cmd.Context(), path, args)
+			if err != nil {
+				return err
+			}
+			results = append(results, located...)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tSTATUS\tDETAIL")
+		problems := 0
+		for _, r := range results {
+			if r.Status != attemptsOK && r.Status != attemptsNoHead {
+				problems++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.UUID, r.Status, r.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("attempts log verification found %d problem(s)", problems)
+		}
+		return nil
+	},
+}
+
+func init() {
+	verifyAttemptsLogCmd.Flags().String("attempts-log", "", "attempts log to verify (overrides [security] attempts_log)")
+	verifyAttemptsLogCmd.Flags().String("profile", "", "only check devices stored in the Vault location of this [[device]] profile")
+	decryptCmd.Flags().String("attempts-log", "", "record this decrypt attempt in a hash-chained log (overrides [security] attempts_log)")
+	rootCmd.AddCommand(verifyAttemptsLogCmd)
+}
+
+// attemptsLogPath returns the attempts log from the --attempts-log flag or the configuration
+func attemptsLogPath(cmd *cobra.Command) string {
+	if path, _ := cmd.Flags().GetString("attempts-log"); path != "" {
+		return path
+	}
+	return cfg.Security.AttemptsLog
+}
+
+// checkAttemptsLogAppendOnly refuses to go on when [audit] require_append_only is set and the
+// attempts log at path could be edited. A log that does not exist yet passes only when
+// [audit] append_only will make it append-only as it is created.
+func checkAttemptsLogAppendOnly(path string, audit config.AuditConfig) error {
+	if !audit.RequireAppendOnly {
+		return nil
+	}
+	if path == "" {
+		return fmt.Errorf("[audit] require_append_only is set but no attempts log is configured; set [security] attempts_log")
+	}
+
+	appendOnly, err := attemptlog.IsAppendOnly(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && audit.AppendOnly:
+		return nil
+	case errors.Is(err, attemptlog.ErrFlagsUnsupported):
+		return fmt.Errorf("[audit] require_append_only is set but the attempts log %s cannot be made append-only: %w", path, err)
+	case err != nil:
+		return fmt.Errorf("[audit] require_append_only is set but the attempts log could not be checked: %w", err)
+	case !appendOnly:
+		return fmt.Errorf("[audit] require_append_only is set but the attempts log %s is not append-only; "+
+			"run 'chattr +a %s' or set [audit] append_only = true", path, path)
+	}
+	return nil
+}
+
+// protectAttemptsLog sets the append-only attribute on the attempts log when [audit] append_only
+// is set. Filesystems without attribute flags only log a warning, since the hash chain still
+// detects edits.
+func protectAttemptsLog(path string) {
+	if !cfg.Audit.AppendOnly {
+		return
+	}
+
+	err := attemptlog.SetAppendOnly(path)
+	switch {
+	case errors.Is(err, attemptlog.ErrFlagsUnsupported):
+		logger.WithError(err).WithField("attempts_log", path).Warn("Attempts log cannot be made append-only on this filesystem")
+	case err != nil:
+		logger.WithError(err).WithField("attempts_log", path).Warn("Failed to make attempts log append-only")
+	}
+}
+
+// remoteSource returns the client address of the SSH session running the command, if any
+func remoteSource() string {
+	for _, name := range []string{"SSH_CONNECTION", "SSH_CLIENT"} {
+		if fields := strings.Fields(os.Getenv(name)); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// recordDecryptAttempt appends a decrypt attempt to the attempts log and anchors the new chain
+// head in the Vault metadata of the device, whose key is stored where profile says. Failures are
+// logged but never fail the decrypt.
+func recordDecryptAttempt(path, uuid string, profile *config.DeviceConfig, attemptErr error) {
+	if path == "" {
+		return
+	}
+
+	entry := attemptlog.Entry{
+		UUID:   uuid,
+		Result: attemptlog.ResultSuccess,
+		Source: remoteSource(),
+	}
+	if attemptErr != nil {
+		entry.Result = attemptlog.ResultFailure
+		entry.Error = attemptErr.Error()
+	}
+
+	written, err := attemptlog.AppendWithMode(path, entry, cfg.Security.FilePermissions())
+	if err != nil {
+		logger.WithError(err).WithField("attempts_log", path).Error("Failed to record decrypt attempt")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid":   uuid,
+		"result": written.Result,
+		"seq":    written.Seq,
+	}).Debug("Recorded decrypt attempt")
+
+	protectAttemptsLog(path)
+
+	vaultPath, ok := customMetadataPath(uuid, profile)
+	if !ok {
+		logger.Debug("Not anchoring attempts log in Vault: custom metadata requires kv_version = \"2\" on the configured backend")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Vault.Timeout())
+	defer cancel()
+
+	// Attempts on UUIDs with no stored key have no metadata to anchor to; the log still records them
+	err = vaultClient.UpdateCustomMetadata(ctx, vaultPath, map[string]string{
+		attemptsLogSeqKey:  strconv.FormatInt(written.Seq, 10),
+		attemptsLogHashKey: written.Hash,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to anchor attempts log in Vault")
+	}
+}
+
+// Verification statuses reported by verify-attempts-log
+const (
+	attemptsOK        = "ok"
+	attemptsNoHead    = "no-head"
+	attemptsTruncated = "truncated"
+	attemptsMismatch  = "mismatch"
+	attemptsBroken    = "broken-chain"
+	attemptsError     = "error"
+)
+
+// attemptsHeadStore is the subset of the Vault client used by verify-attempts-log
+type attemptsHeadStore interface {
+	ListSecrets(ctx context.Context, path string) ([]string, error)
+	ReadCustomMetadata(ctx context.Context, path string) (map[string]string, error)
+}
+
+// attemptsResult is the verification outcome for one device
+type attemptsResult struct {
+	UUID   string
+	Status string
+	Detail string
+}
+
+// attemptsVerifier checks the attempts log against the chain heads recorded in Vault
+type attemptsVerifier struct {
+	store    attemptsHeadStore
+	basePath string
+}
+
+// verify checks the log at path for the given UUIDs, or every UUID under basePath if none
+func (v *attemptsVerifier) verify(ctx context.Context, path string, uuids []string) ([]attemptsResult, error) {
+	entries, chainErr := attemptlog.Read(path)
+
+	if len(uuids) == 0 {
+		var err error
+		uuids, err = v.store.ListSecrets(ctx, v.basePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Vault entries: %w", err)
+		}
+	}
+
+	results := make([]attemptsResult, 0, len(uuids))
+	for _, uuid := range uuids {
+		results = append(results, v.verifyDevice(ctx, uuid, entries, chainErr))
+	}
+	return results, nil
+}
+
+func (v *attemptsVerifier) verifyDevice(ctx context.Context, uuid string, entries []attemptlog.Entry, chainErr error) attemptsResult {
+	result := attemptsResult{UUID: uuid}
+
+	metadata, err := v.store.ReadCustomMetadata(ctx, fmt.Sprintf("%s/%s", v.basePath, uuid))
+	if err != nil {
+		result.Status = attemptsError
+		result.Detail = err.Error()
+		return result
+	}
+
+	head := attemptlog.Head{Hash: metadata[attemptsLogHashKey]}
+	if seq := metadata[attemptsLogSeqKey]; seq != "" {
+		head.Seq, err = strconv.ParseInt(seq, 10, 64)
+		if err != nil {
+			result.Status = attemptsError
+			result.Detail = fmt.Sprintf("invalid %s in Vault metadata: %q", attemptsLogSeqKey, seq)
+			return result
+		}
+	}
+
+	// Any break in the chain makes the whole log untrustworthy
+	if chainErr != nil {
+		result.Status = attemptsBroken
+		result.Detail = chainErr.Error()
+		return result
+	}
+
+	if err := attemptlog.VerifyHead(entries, head); err != nil {
+		result.Status = attemptsMismatch
+		if errors.Is(err, attemptlog.ErrTruncated) {
+			result.Status = attemptsTruncated
+		}
+		result.Detail = err.Error()
+		return result
+	}
+
+	if head.Seq == 0 {
+		result.Status = attemptsNoHead
+		result.Detail = "no decrypt attempts recorded in Vault"
+		return result
+	}
+
+	result.Status = attemptsOK
+	result.Detail = fmt.Sprintf("last recorded attempt is entry %d", head.Seq)
+	return result
+}
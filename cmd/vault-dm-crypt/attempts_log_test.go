@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/attemptlog"
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+type fakeHeadStore struct {
+	metadata map[string]map[string]string
+}
+
+func (f *fakeHeadStore) ListSecrets(ctx context.Context, path string) ([]string, error) {
+	var uuids []string
+	for key := range f.metadata {
+		uuids = append(uuids, strings.TrimPrefix(key, path+"/"))
+	}
+	return uuids, nil
+}
+
+func (f *fakeHeadStore) ReadCustomMetadata(ctx context.Context, path string) (map[string]string, error) {
+	return f.metadata[path], nil
+}
+
+func (f *fakeHeadStore) anchor(uuid string, entry attemptlog.Entry) {
+	f.metadata["vault-dm-crypt/node-1/"+uuid] = map[string]string{
+		attemptsLogSeqKey:  strconv.FormatInt(entry.Seq, 10),
+		attemptsLogHashKey: entry.Hash,
+	}
+}
+
+func TestAttemptsVerifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+	store := &fakeHeadStore{metadata: map[string]map[string]string{
+		"vault-dm-crypt/node-1/uuid-unused": {},
+	}}
+	verifier := &attemptsVerifier{store: store, basePath: "vault-dm-crypt/node-1"}
+
+	for _, uuid := range []string{"uuid-a", "uuid-b", "uuid-a"} {
+		entry, err := attemptlog.Append(path, attemptlog.Entry{UUID: uuid, Result: attemptlog.ResultFailure})
+		require.NoError(t, err)
+		store.anchor(uuid, entry)
+	}
+
+	statuses := func(results []attemptsResult) map[string]string {
+		byUUID := make(map[string]string)
+		for _, r := range results {
+			byUUID[r.UUID] = r.Status
+		}
+		return byUUID
+	}
+
+	t.Run("intact log", func(t *testing.T) {
+		results, err := verifier.verify(context.Background(), path, nil)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"uuid-a":      attemptsOK,
+			"uuid-b":      attemptsOK,
+			"uuid-unused": attemptsNoHead,
+		}, statuses(results))
+	})
+
+	t.Run("truncated log", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		lines := strings.SplitAfter(string(data), "\n")
+		require.NoError(t, os.WriteFile(path, []byte(lines[0]+lines[1]), 0600))
+
+		results, err := verifier.verify(context.Background(), path, []string{"uuid-a", "uuid-b"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"uuid-a": attemptsTruncated,
+			"uuid-b": attemptsOK,
+		}, statuses(results))
+	})
+
+	t.Run("edited log", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		edited := strings.Replace(string(data), `"uuid":"uuid-a"`, `"uuid":"uuid-c"`, 1)
+		require.NoError(t, os.WriteFile(path, []byte(edited), 0600))
+
+		results, err := verifier.verify(context.Background(), path, []string{"uuid-b"})
+		require.NoError(t, err)
+		assert.Equal(t, attemptsBroken, results[0].Status)
+	})
+}
+
+func TestRemoteSource(t *testing.T) {
+	t.Setenv("SSH_CONNECTION", "")
+	t.Setenv("SSH_CLIENT", "")
+	assert.Empty(t, remoteSource())
+
+	t.Setenv("SSH_CLIENT", "192.0.2.10 51234 22")
+	assert.Equal(t, "192.0.2.10", remoteSource())
+
+	t.Setenv("SSH_CONNECTION", "192.0.2.20 51234 192.0.2.1 22")
+	assert.Equal(t, "192.0.2.20", remoteSource())
+}
+
+func TestCheckAttemptsLogAppendOnly(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "attempts.log")
+	require.NoError(t, os.WriteFile(existing, nil, 0600))
+	missing := filepath.Join(dir, "missing.log")
+
+	t.Run("not required", func(t *testing.T) {
+		assert.NoError(t, checkAttemptsLogAppendOnly("", config.AuditConfig{}))
+		assert.NoError(t, checkAttemptsLogAppendOnly(existing, config.AuditConfig{}))
+	})
+
+	t.Run("required without an attempts log", func(t *testing.T) {
+		err := checkAttemptsLogAppendOnly("", config.AuditConfig{RequireAppendOnly: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no attempts log is configured")
+	})
+
+	t.Run("required and not append-only", func(t *testing.T) {
+		err := checkAttemptsLogAppendOnly(existing, config.AuditConfig{RequireAppendOnly: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "require_append_only")
+	})
+
+	t.Run("missing log created append-only", func(t *testing.T) {
+		assert.NoError(t, checkAttemptsLogAppendOnly(missing, config.AuditConfig{RequireAppendOnly: true, AppendOnly: true}))
+	})
+
+	t.Run("missing log not made append-only", func(t *testing.T) {
+		err := checkAttemptsLogAppendOnly(missing, config.AuditConfig{RequireAppendOnly: true})
+		assert.Error(t, err)
+	})
+}
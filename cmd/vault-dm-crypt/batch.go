@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+
+	"digitalisio/vault-dm-crypt/internal/tracing"
+)
+
+// defaultBatchJobs is how many --from-file entries are processed at once unless --jobs is given.
+// [general] max_concurrent still bounds the operations running on the host as a whole.
+const defaultBatchJobs = 4
+
+// batchEntry is one UUID or device listed in a --from-file list
+type batchEntry struct {
+	Line   int
+	Target string
+}
+
+// batchResult is the outcome of processing one entry
+type batchResult struct {
+	Entry batchEntry
+	Err   error
+}
+
+// parseBatchFile parses a --from-file list: one UUID or device per line, with blank lines and
+// anything after a '#' ignored. An entry listed twice is refused, since both copies would be
+// processed at the same time.
+func parseBatchFile(r io.Reader) ([]batchEntry, error) {
+	var entries []batchEntry
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		target, _, _ := strings.Cut(scanner.Text(), "#")
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if strings.ContainsAny(target, " \t") {
+			return nil, fmt.Errorf("line %d: expected one UUID or device, got %q", line, target)
+		}
+		if first, ok := seen[target]; ok {
+			return nil, fmt.Errorf("line %d: %s is already listed on line %d", line, target, first)
+		}
+		seen[target] = line
+		entries = append(entries, batchEntry{Line: line, Target: target})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readBatchFile reads the --from-file list at path, which must name at least one entry
+func readBatchFile(path string) ([]batchEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open --from-file list: %w", err)
+	}
+	defer file.Close()
+
+	entries, err := parseBatchFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --from-file list %s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("--from-file list %s has no entries", path)
+	}
+	return entries, nil
+}
+
+// runBatch runs op for every entry, at most jobs at a time, and returns the results in the
+// order of the entries. A failed entry does not stop the others.
+func runBatch(entries []batchEntry, jobs int, op func(target string) error) []batchResult {
+	if jobs > len(entries) {
+		jobs = len(entries)
+	}
+
+	results := make([]batchResult, len(entries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = batchResult{Entry: entries[i], Err: op(entries[i].Target)}
+			}
+		}()
+	}
+
+	for i := range entries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// reportBatch prints the outcome of every entry and returns an error if any failed
+func reportBatch(w io.Writer, operation string, results []batchResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+
+	fmt.Fprintf(w, "%s summary: %d succeeded, %d failed\n", operation, len(results)-failed, failed)
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(w, "  FAILED  %s (line %d): %v\n", result.Entry.Target, result.Entry.Line, result.Err)
+		} else {
+			fmt.Fprintf(w, "  OK      %s\n", result.Entry.Target)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%s failed for %d of %d entries", operation, failed, len(results))
+	}
+	return nil
+}
+
+// batchJobs returns the validated --jobs value
+func batchJobs(cmd *cobra.Command) (int, error) {
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 1 {
+		return 0, fmt.Errorf("--jobs must be at least 1")
+	}
+	return jobs, nil
+}
+
+// authenticateBatch logs in to Vault before the workers start, so that they share one token
+// instead of each logging in, which would use up a secret ID limited by secret_id_num_uses
+func authenticateBatch(cmd *cobra.Command) error {
+	ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+	defer cancel()
+
+	return vaultClient.EnsureAuthenticated(ctx)
+}
+
+// runDecryptFromFile opens every device whose UUID is listed in the file at path
+func runDecryptFromFile(cmd *cobra.Command, path string) error {
+	jobs, err := batchJobs(cmd)
+	if err != nil {
+		return err
+	}
+	entries, err := readBatchFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Devices opened with --passphrase, or from a key cached in the keyring, do not need Vault,
+	// so a failed login is left for the entries that do to report
+	if usePassphrase, _ := cmd.Flags().GetBool("passphrase"); !usePassphrase {
+		if err := authenticateBatch(cmd); err != nil {
+			logger.WithError(err).Warn("Failed to authenticate with Vault before opening devices")
+		}
+	}
+
+	results := runBatch(entries, jobs, func(target string) error {
+		uuid, err := parseDeviceUUID(target)
+		if err != nil {
+			return err
+		}
+		ctx, span := tracing.Start(cmd.Context(), "decrypt "+uuid, attribute.String("device.uuid", uuid))
+		err = runDecrypt(ctx, cmd, []string{uuid})
+		tracing.End(span, err)
+		return err
+	})
+	return reportBatch(os.Stdout, "decrypt", results)
+}
+
+// runEncryptFromFile encrypts every device listed in the file at path. Each device would
+// otherwise be confirmed on the terminal, and prompts for several devices at once cannot be
+// answered, so --yes or --force is required.
+func runEncryptFromFile(cmd *cobra.Command, path string) error {
+	yes, _ := cmd.Flags().GetBool("yes")
+	force, _ := cmd.Flags().GetBool("force")
+	if !yes && !force {
+		return fmt.Errorf("encrypt --from-file formats every listed device without asking; confirm with --yes")
+	}
+
+	jobs, err := batchJobs(cmd)
+	if err != nil {
+		return err
+	}
+	entries, err := readBatchFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := authenticateBatch(cmd); err != nil {
+		return fmt.Errorf("failed to authenticate with Vault: %w", err)
+	}
+
+	results := runBatch(entries, jobs, func(target string) error {
+		if !filepath.IsAbs(target) {
+			return fmt.Errorf("%s is not an absolute device path", target)
+		}
+		// Each device gets its own span, so attributes such as its key fingerprint stay apart
+		ctx, span := tracing.Start(cmd.Context(), "encrypt "+target, attribute.String("device.path", target))
+		err := runEncrypt(ctx, cmd, []string{target})
+		tracing.End(span, err)
+		return err
+	})
+	return reportBatch(os.Stdout, "encrypt", results)
+}
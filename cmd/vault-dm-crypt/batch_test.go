@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBatchFile(t *testing.T) {
+	t.Run("entries, comments and blank lines", func(t *testing.T) {
+		list := `# data volumes
+12345678-1234-1234-1234-123456789abc
+
+  /dev/sdc   # second shelf
+	/dev/disk/by-id/wwn-0x5002538e40a1b2c3
+#/dev/sdd
+`
+		entries, err := parseBatchFile(strings.NewReader(list))
+		require.NoError(t, err)
+		assert.Equal(t, []batchEntry{
+			{Line: 2, Target: "12345678-1234-1234-1234-123456789abc"},
+			{Line: 4, Target: "/dev/sdc"},
+			{Line: 5, Target: "/dev/disk/by-id/wwn-0x5002538e40a1b2c3"},
+		}, entries)
+	})
+
+	t.Run("only comments", func(t *testing.T) {
+		entries, err := parseBatchFile(strings.NewReader("# nothing yet\n\n"))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("duplicate entry", func(t *testing.T) {
+		_, err := parseBatchFile(strings.NewReader("/dev/sdb\n/dev/sdc\n/dev/sdb # again\n"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 3: /dev/sdb is already listed on line 1")
+	})
+
+	t.Run("several entries on one line", func(t *testing.T) {
+		_, err := parseBatchFile(strings.NewReader("/dev/sdb /dev/sdc\n"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 1: expected one UUID or device")
+	})
+}
+
+func TestRunBatch(t *testing.T) {
+	entries := []batchEntry{
+		{Line: 1, Target: "12345678-1234-1234-1234-123456789abc"},
+		{Line: 2, Target: "not-a-uuid"},
+		{Line: 3, Target: "87654321-4321-4321-4321-cba987654321"},
+		{Line: 5, Target: "11111111-2222-3333-4444-555555555555"},
+		{Line: 6, Target: "22222222-3333-4444-5555-666666666666"},
+	}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	processed := make(map[string]bool)
+	results := runBatch(entries, 2, func(target string) error {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		processed[target] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if _, err := parseDeviceUUID(target); err != nil {
+			return err
+		}
+		if target == "11111111-2222-3333-4444-555555555555" {
+			return fmt.Errorf("failed to find device with UUID %s", target)
+		}
+		return nil
+	})
+
+	require.Len(t, results, len(entries))
+	for i, result := range results {
+		assert.Equal(t, entries[i], result.Entry, "results keep the order of the list")
+	}
+	assert.NoError(t, results[0].Err)
+	assert.ErrorContains(t, results[1].Err, "invalid UUID")
+	assert.NoError(t, results[2].Err)
+	assert.ErrorContains(t, results[3].Err, "failed to find device")
+	assert.NoError(t, results[4].Err)
+
+	assert.Len(t, processed, len(entries), "a failed entry does not stop the others")
+	assert.LessOrEqual(t, maxInFlight, 2)
+}
+
+func TestReportBatch(t *testing.T) {
+	t.Run("mixed results", func(t *testing.T) {
+		results := []batchResult{
+			{Entry: batchEntry{Line: 1, Target: "/dev/sdb"}},
+			{Entry: batchEntry{Line: 3, Target: "sdc"}, Err: fmt.Errorf("sdc is not an absolute device path")},
+			{Entry: batchEntry{Line: 4, Target: "/dev/sdd"}},
+		}
+
+		var out bytes.Buffer
+		err := reportBatch(&out, "encrypt", results)
+		require.Error(t, err)
+		assert.Equal(t, "encrypt failed for 1 of 3 entries", err.Error())
+		assert.Equal(t, "encrypt summary: 2 succeeded, 1 failed\n"+
+			"  OK      /dev/sdb\n"+
+			"  FAILED  sdc (line 3): sdc is not an absolute device path\n"+
+			"  OK      /dev/sdd\n", out.String())
+	})
+
+	t.Run("all succeeded", func(t *testing.T) {
+		var out bytes.Buffer
+		err := reportBatch(&out, "decrypt", []batchResult{{Entry: batchEntry{Line: 1, Target: "12345678-1234-1234-1234-123456789abc"}}})
+		require.NoError(t, err)
+		assert.Contains(t, out.String(), "decrypt summary: 1 succeeded, 0 failed")
+	})
+}
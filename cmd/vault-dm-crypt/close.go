@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/hooks"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+var closeCmd = &cobra.Command{
+	Use:   "close <uuid|name>",
+	Short: "Close the mapping of a decrypted device",
+	Long: `Close the dm-crypt mapping of a device opened by decrypt.
+
+The argument is either the device UUID or the name of the mapping under /dev/mapper.
+For a device encrypted with encrypt --loop, the loop device holding its disk image is
+detached too once no mapping uses it; its location is read from Vault. Closing a device
+that is not open only detaches its loop device, if any. The [hooks] post_close hook runs
+after the mapping is closed.
+
+Unmount any filesystem on the mapping first.`,
+	Example: `  vault-dm-crypt close 12345678-1234-1234-1234-123456789abc
+  vault-dm-crypt close vaultlocker-12345678123412341234123456789abc`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		profile, err := profileFromFlag(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		uuid, deviceName, err := resolveMapping(ctx, vaultClient, args[0], profile)
+		if err != nil {
+			return err
+		}
+
+		opLock, err := acquireOperationLock(uuid)
+		if err != nil {
+			return err
+		}
+		defer releaseOperationLock(opLock)
+
+		// Only a mapping on a loop device, or one already closed, can leave a loop device behind
+		var backing string
+		open := false
+		mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
+		if _, err := os.Stat(mappedDevice); err == nil {
+			open = true
+			if backing, err = dmcryptManager.GetMappingDevice(deviceName); err != nil {
+				logger.WithError(err).WithField("device_name", deviceName).Warn("Failed to find the underlying device of mapping")
+			}
+			if err := dmcryptManager.CloseDevice(deviceName); err != nil {
+				return fmt.Errorf("failed to close device: %w", err)
+			}
+			fmt.Printf("Device closed: %s\n", deviceName)
+
+			if err := hookRunner.Run(hooks.PostClose, hooks.Event{UUID: uuid, Device: backing, MappedDevice: mappedDevice}); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("Device is not open: %s\n", deviceName)
+		}
+		if open && backing != "" && !strings.HasPrefix(backing, "/dev/loop") {
+			return nil
+		}
+
+		loopFile, err := storedLoopFile(ctx, storeForProfile(profile), uuid, profile)
+		if err != nil {
+			return fmt.Errorf("failed to read the metadata of %s to detach its loop device: %w", uuid, err)
+		}
+		if loopFile == "" {
+			return nil
+		}
+
+		detached, err := detachLoopFile(dmcryptManager, loopFile)
+		if err != nil {
+			return err
+		}
+
+		logger.WithFields(logrus.Fields{
+			"uuid":      uuid,
+			"loop_file": loopFile,
+			"detached":  strings.Join(detached, ", "),
+		}).Info("Loop devices of disk image detached")
+		for _, loopDevice := range detached {
+			fmt.Printf("Loop device detached: %s (%s)\n", loopDevice, loopFile)
+		}
+		return nil
+	},
+}
+
+func init() {
+	closeCmd.Flags().String("profile", "", "read the mapping name and loop file from the Vault location of this [[device]] profile")
+
+	rootCmd.AddCommand(closeCmd)
+}
+
+// storedLoopFile returns the disk image recorded for uuid by encrypt --loop, or "" if the
+// device was not encrypted with --loop or no key is stored for it where profile stores keys
+func storedLoopFile(ctx context.Context, store secretReader, uuid string, profile *config.DeviceConfig) (string, error) {
+	vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuid)
+	if err != nil {
+		return "", err
+	}
+
+	secretData, err := store.ReadSecretVersion(ctx, vaultPath, 0)
+	if stderrors.Is(err, vault.ErrSecretNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := vault.DecodeDeviceSecret(secretData)
+	if err != nil {
+		return "", err
+	}
+	return secret.LoopFile, nil
+}
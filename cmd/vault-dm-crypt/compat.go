@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// compatVaultlocker makes decrypt fall back to the secret layout of the Python vaultlocker
+const compatVaultlocker = "vaultlocker"
+
+// vaultlockerKeyField is the field Python vaultlocker stores the key in
+const vaultlockerKeyField = "dmcrypt_key"
+
+// decryptSecretReader is the subset of the Vault client used to read a device's secret on decrypt
+type decryptSecretReader interface {
+	ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error)
+	ReadSecretKVv1(ctx context.Context, path string) (map[string]interface{}, error)
+}
+
+// validateCompat checks a --compat value
+func validateCompat(compat string) error {
+	switch compat {
+	case "", compatVaultlocker:
+		return nil
+	default:
+		return fmt.Errorf("invalid --compat %q: must be %s", compat, compatVaultlocker)
+	}
+}
+
+// vaultlockerPath returns the path, relative to the backend, at which Python vaultlocker stored
+// the key for uuid
+func vaultlockerPath(uuid string) string {
+	return "vaultlocker/" + uuid
+}
+
+// readDecryptSecret reads the secret for uuid at vaultPath and returns it with the fields the key
+// may be stored in. With compat set to vaultlocker, a secret that is missing or holds no key is
+// looked up again where Python vaultlocker stored it: a KV v1 secret at vaultlocker/<uuid>.
+func readDecryptSecret(ctx context.Context, store decryptSecretReader, uuid, vaultPath string, version int, compat string) (map[string]interface{}, []string, error) {
+	fields := cfg.Vault.KeyFieldNames()
+
+	secretData, err := store.ReadSecretVersion(ctx, vaultPath, version)
+	if compat != compatVaultlocker || version > 0 {
+		return secretData, fields, err
+	}
+	if err == nil && hasAnyField(secretData, fields) {
+		return secretData, fields, nil
+	}
+	if err != nil && !stderrors.Is(err, vault.ErrSecretNotFound) {
+		return nil, nil, err
+	}
+
+	legacyPath := vaultlockerPath(uuid)
+	logger.WithFields(logrus.Fields{
+		"path":        vaultPath,
+		"legacy_path": legacyPath,
+	}).Info("Key not found at native path, trying Python vaultlocker layout")
+
+	legacyData, legacyErr := store.ReadSecretKVv1(ctx, legacyPath)
+	if legacyErr != nil || !hasAnyField(legacyData, []string{vaultlockerKeyField}) {
+		if legacyErr != nil && !stderrors.Is(legacyErr, vault.ErrSecretNotFound) {
+			return nil, nil, legacyErr
+		}
+		// Report the native result; the legacy layout had nothing either
+		return secretData, fields, err
+	}
+
+	return legacyData, []string{vaultlockerKeyField}, nil
+}
+
+// hasAnyField reports whether data holds any of fields
+func hasAnyField(data map[string]interface{}, fields []string) bool {
+	for _, field := range fields {
+		if _, ok := data[field]; ok {
+			return true
+		}
+	}
+	return false
+}
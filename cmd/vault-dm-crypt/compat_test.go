@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	vaulterrors "digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// fakeDecryptStore serves native secrets and legacy KV v1 secrets from separate maps
+type fakeDecryptStore struct {
+	native   map[string]map[string]interface{}
+	legacy   map[string]map[string]interface{}
+	readErr  error
+	kv1Reads []string
+}
+
+func (f *fakeDecryptStore) ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error) {
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	data, ok := f.native[path]
+	if !ok {
+		return nil, vaulterrors.NewVaultReadError(path, vault.ErrSecretNotFound)
+	}
+	return data, nil
+}
+
+func (f *fakeDecryptStore) ReadSecretKVv1(ctx context.Context, path string) (map[string]interface{}, error) {
+	f.kv1Reads = append(f.kv1Reads, path)
+	data, ok := f.legacy[path]
+	if !ok {
+		return nil, vaulterrors.NewVaultReadError(path, vault.ErrSecretNotFound)
+	}
+	return data, nil
+}
+
+func TestReadDecryptSecret(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Vault.KeyField = "escrow_key"
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	nativePath := "vault-dm-crypt/node1/" + uuid
+	legacyKey := map[string]interface{}{"dmcrypt_key": "bGVnYWN5"}
+
+	t.Run("native secret is used", func(t *testing.T) {
+		store := &fakeDecryptStore{native: map[string]map[string]interface{}{nativePath: {"escrow_key": "bmF0aXZl"}}}
+
+		data, fields, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, compatVaultlocker)
+		require.NoError(t, err)
+		assert.Equal(t, "bmF0aXZl", data["escrow_key"])
+		assert.Equal(t, []string{"escrow_key"}, fields)
+		assert.Empty(t, store.kv1Reads)
+	})
+
+	t.Run("missing native secret falls back to vaultlocker layout", func(t *testing.T) {
+		store := &fakeDecryptStore{legacy: map[string]map[string]interface{}{"vaultlocker/" + uuid: legacyKey}}
+
+		data, fields, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, compatVaultlocker)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"vaultlocker/" + uuid}, store.kv1Reads)
+		assert.Equal(t, []string{"dmcrypt_key"}, fields)
+
+		key, err := deviceKeyFromSecret(data, uuid, fields)
+		require.NoError(t, err)
+		assert.Equal(t, "bGVnYWN5", key)
+	})
+
+	t.Run("native secret without key falls back", func(t *testing.T) {
+		store := &fakeDecryptStore{
+			native: map[string]map[string]interface{}{nativePath: {"hostname": "node1"}},
+			legacy: map[string]map[string]interface{}{"vaultlocker/" + uuid: legacyKey},
+		}
+
+		data, fields, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, compatVaultlocker)
+		require.NoError(t, err)
+		assert.Equal(t, legacyKey, data)
+		assert.Equal(t, []string{"dmcrypt_key"}, fields)
+	})
+
+	t.Run("native error is reported when legacy layout has nothing", func(t *testing.T) {
+		store := &fakeDecryptStore{}
+
+		_, _, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, compatVaultlocker)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, vault.ErrSecretNotFound))
+		assert.Contains(t, err.Error(), nativePath)
+	})
+
+	t.Run("no fallback without compat", func(t *testing.T) {
+		store := &fakeDecryptStore{legacy: map[string]map[string]interface{}{"vaultlocker/" + uuid: legacyKey}}
+
+		_, _, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, "")
+		require.Error(t, err)
+		assert.Empty(t, store.kv1Reads)
+	})
+
+	t.Run("no fallback when Vault fails", func(t *testing.T) {
+		store := &fakeDecryptStore{
+			readErr: errors.New("connection refused"),
+			legacy:  map[string]map[string]interface{}{"vaultlocker/" + uuid: legacyKey},
+		}
+
+		_, _, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 0, compatVaultlocker)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+		assert.Empty(t, store.kv1Reads)
+	})
+
+	t.Run("no fallback for a specific version", func(t *testing.T) {
+		store := &fakeDecryptStore{legacy: map[string]map[string]interface{}{"vaultlocker/" + uuid: legacyKey}}
+
+		_, _, err := readDecryptSecret(context.Background(), store, uuid, nativePath, 2, compatVaultlocker)
+		require.Error(t, err)
+		assert.Empty(t, store.kv1Reads)
+	})
+}
+
+func TestValidateCompat(t *testing.T) {
+	assert.NoError(t, validateCompat(""))
+	assert.NoError(t, validateCompat("vaultlocker"))
+	assert.Error(t, validateCompat("luks1"))
+}
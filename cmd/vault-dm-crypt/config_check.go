@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+var configCheckCmd = &cobra.Command{
+	Use:   "config-check",
+	Short: "Validate the configuration file without connecting to Vault",
+	Long: `Load the configuration file and report every problem found, for example in CI before deployment.
+
+In addition to the normal validation, config-check verifies that the Vault URL parses,
+that referenced files such as the CA bundle exist, that the log output directory exists
+and that only one authentication method is configured.
+
+No network or device operations are performed. Exits non-zero if any problem is found.`,
+	Example: `  vault-dm-crypt config-check --config ./config.toml`,
+	Args:    cobra.NoArgs,
+	// Checking the configuration must not depend on it being valid or on Vault access
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if debug {
+			logger.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		checkCfg, err := config.LoadUnvalidated(cfgFile)
+		if err != nil {
+			fmt.Printf("FAIL: %s\n", cfgFile)
+			fmt.Printf("  - %v\n", err)
+			return fmt.Errorf("config check failed")
+		}
+
+		problems := checkCfg.Check()
+		if len(problems) == 0 {
+			fmt.Printf("PASS: %s\n", cfgFile)
+			return nil
+		}
+
+		fmt.Printf("FAIL: %s\n", cfgFile)
+		for _, problem := range problems {
+			fmt.Printf("  - %v\n", problem)
+		}
+		return fmt.Errorf("config check found %d problem(s)", len(problems))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCheckCmd)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// confirmInput and confirmOutput are the terminal encrypt asks for confirmation on
+var (
+	confirmInput  = os.Stdin
+	confirmOutput = os.Stdout
+)
+
+// confirmEncryptTarget asks the operator to confirm the device before it is formatted, by
+// typing its base name. It only asks when attached to a terminal, so automation and piped
+// input (including --key-stdin) are never blocked; skip is set by --yes and --force.
+func confirmEncryptTarget(target *encryptTarget, skip bool) error {
+	if skip || !isTerminal(confirmInput) || !isTerminal(confirmOutput) {
+		return nil
+	}
+
+	desc, err := dmcryptManager.DescribeDevice(target.Device)
+	if err != nil {
+		// The prompt still names the device, so missing details are not fatal
+		logger.WithError(err).Debug("Failed to describe device for confirmation")
+	}
+
+	return promptDeviceConfirmation(confirmInput, confirmOutput, target, desc)
+}
+
+// promptDeviceConfirmation prints what is about to be destroyed and reads the device's base
+// name back from in
+func promptDeviceConfirmation(in io.Reader, out io.Writer, target *encryptTarget, desc dmcrypt.DeviceDescription) error {
+	contents := "no filesystem or partition table detected"
+	if target.Signature != nil {
+		contents = target.Signature.String()
+	}
+
+	fmt.Fprintf(out, "All data on this device will be destroyed:\n")
+	fmt.Fprintf(out, "  Device:   %s\n", target.Device)
+	fmt.Fprintf(out, "  Size:     %s\n", dashIfEmpty(desc.Size))
+	fmt.Fprintf(out, "  Model:    %s\n", dashIfEmpty(desc.Model))
+	fmt.Fprintf(out, "  Serial:   %s\n", dashIfEmpty(desc.Serial))
+	fmt.Fprintf(out, "  Contents: %s\n", contents)
+
+	expected := filepath.Base(target.Device)
+	fmt.Fprintf(out, "Type %q to continue: ", expected)
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("no confirmation given, device %s left untouched", target.Device)
+	}
+
+	if strings.TrimSpace(answer) != expected {
+		return fmt.Errorf("confirmation did not match %q, device %s left untouched", expected, target.Device)
+	}
+	return nil
+}
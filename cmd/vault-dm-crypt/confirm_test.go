@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+func TestPromptDeviceConfirmation(t *testing.T) {
+	target := &encryptTarget{
+		Device:    "/dev/sdd1",
+		Signature: &dmcrypt.DeviceSignature{Kind: "filesystem", Type: "ext4"},
+	}
+	desc := dmcrypt.DeviceDescription{Size: "1.8T", Model: "WDC WD20EFRX", Serial: "WD-123"}
+
+	t.Run("matching name", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, promptDeviceConfirmation(strings.NewReader("sdd1\n"), &out, target, desc))
+
+		assert.Contains(t, out.String(), "Device:   /dev/sdd1")
+		assert.Contains(t, out.String(), "Size:     1.8T")
+		assert.Contains(t, out.String(), "Model:    WDC WD20EFRX")
+		assert.Contains(t, out.String(), "Serial:   WD-123")
+		assert.Contains(t, out.String(), "Contents: an ext4 filesystem")
+		assert.Contains(t, out.String(), `Type "sdd1" to continue`)
+	})
+
+	t.Run("wrong name", func(t *testing.T) {
+		err := promptDeviceConfirmation(strings.NewReader("sdc1\n"), &bytes.Buffer{}, target, desc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "left untouched")
+	})
+
+	t.Run("no answer", func(t *testing.T) {
+		err := promptDeviceConfirmation(strings.NewReader(""), &bytes.Buffer{}, target, dmcrypt.DeviceDescription{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no confirmation given")
+	})
+}
+
+func TestConfirmEncryptTargetDoesNotPrompt(t *testing.T) {
+	originalInput, originalOutput := confirmInput, confirmOutput
+	defer func() { confirmInput, confirmOutput = originalInput, originalOutput }()
+
+	// Nothing is ever written to the pipe, so a read would block forever
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	defer reader.Close()
+	defer writer.Close()
+	confirmInput, confirmOutput = reader, writer
+
+	target := &encryptTarget{Device: "/dev/sdd1"}
+	for name, skip := range map[string]bool{"with --yes": true, "without a terminal": false} {
+		t.Run(name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() { done <- confirmEncryptTarget(target, skip) }()
+
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("confirmEncryptTarget blocked waiting for input")
+			}
+		})
+	}
+}
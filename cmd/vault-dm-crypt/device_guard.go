@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// systemDeviceFinder finds the devices the running system lives on
+type systemDeviceFinder interface {
+	SystemDevices() ([]string, error)
+}
+
+// checkDeviceAllowed refuses to encrypt a device backing /, /boot or /boot/efi, a device matching
+// [safety] device_denylist or, when device_allowlist is set, a device matching none of its
+// entries. requested is the device as given and device the one it resolved to; either may
+// match a list. If the system devices cannot be found the device is refused, since formatting
+// the wrong one cannot be undone.
+func checkDeviceAllowed(finder systemDeviceFinder, safety config.SafetyConfig, requested, device string) error {
+	candidates := []string{device}
+	if requested != device {
+		candidates = append(candidates, requested)
+	}
+
+	systemDevices, err := finder.SystemDevices()
+	if err != nil {
+		return fmt.Errorf("failed to find the devices backing /, /boot and /boot/efi, refusing to encrypt %s: %w", device, err)
+	}
+	if match, ok := firstDeviceMatch(candidates, systemDevices); ok {
+		return fmt.Errorf("refusing to encrypt %s: it holds the root or boot filesystem (%s)", device, match)
+	}
+
+	if match, ok := firstDeviceMatch(candidates, safety.DeviceDenylist); ok {
+		return fmt.Errorf("refusing to encrypt %s: it matches [safety] device_denylist entry %q", device, match)
+	}
+
+	if len(safety.DeviceAllowlist) > 0 {
+		if _, ok := firstDeviceMatch(candidates, safety.DeviceAllowlist); !ok {
+			return fmt.Errorf("refusing to encrypt %s: it matches no [safety] device_allowlist entry", device)
+		}
+	}
+	return nil
+}
+
+// firstDeviceMatch returns the first pattern any of devices matches
+func firstDeviceMatch(devices, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		for _, device := range devices {
+			if dmcrypt.DeviceMatches(device, pattern) {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// fakeSystemDevices returns fixed devices as those backing /, /boot and /boot/efi
+type fakeSystemDevices struct {
+	devices []string
+	err     error
+}
+
+func (f fakeSystemDevices) SystemDevices() ([]string, error) {
+	return f.devices, f.err
+}
+
+func TestCheckDeviceAllowed(t *testing.T) {
+	system := fakeSystemDevices{devices: []string{"/dev/dm-0", "/dev/sda", "/dev/sda1", "/dev/sda2"}}
+
+	tests := []struct {
+		name      string
+		safety    config.SafetyConfig
+		requested string
+		device    string
+		wantErr   string
+	}{
+		{
+			name:      "no lists",
+			requested: "/dev/sdb",
+			device:    "/dev/sdb",
+		},
+		{
+			name:      "root partition",
+			requested: "/dev/sda2",
+			device:    "/dev/sda2",
+			wantErr:   "holds the root or boot filesystem (/dev/sda2)",
+		},
+		{
+			name:      "disk holding the boot partition",
+			requested: "/dev/sda",
+			device:    "/dev/sda",
+			wantErr:   "holds the root or boot filesystem",
+		},
+		{
+			name:      "system device refused even when allowlisted",
+			safety:    config.SafetyConfig{DeviceAllowlist: []string{"/dev/sd*"}},
+			requested: "/dev/sda1",
+			device:    "/dev/sda1",
+			wantErr:   "holds the root or boot filesystem",
+		},
+		{
+			name:      "resolved to the root volume",
+			requested: "/dev/sdb1",
+			device:    "/dev/dm-0",
+			wantErr:   "holds the root or boot filesystem (/dev/dm-0)",
+		},
+		{
+			name:      "denylisted",
+			safety:    config.SafetyConfig{DeviceDenylist: []string{"/dev/nvme*"}},
+			requested: "/dev/nvme0n1",
+			device:    "/dev/nvme0n1",
+			wantErr:   `matches [safety] device_denylist entry "/dev/nvme*"`,
+		},
+		{
+			name:      "denylist wins over allowlist",
+			safety:    config.SafetyConfig{DeviceAllowlist: []string{"/dev/sd*"}, DeviceDenylist: []string{"/dev/sdc"}},
+			requested: "/dev/sdc",
+			device:    "/dev/sdc",
+			wantErr:   "device_denylist",
+		},
+		{
+			name:      "allowlisted",
+			safety:    config.SafetyConfig{DeviceAllowlist: []string{"/dev/sd[b-z]"}},
+			requested: "/dev/sdb",
+			device:    "/dev/sdb",
+		},
+		{
+			name:      "not allowlisted",
+			safety:    config.SafetyConfig{DeviceAllowlist: []string{"/dev/sd[b-z]"}},
+			requested: "/dev/vdb",
+			device:    "/dev/vdb",
+			wantErr:   "matches no [safety] device_allowlist entry",
+		},
+		{
+			name:      "requested path allowlisted",
+			safety:    config.SafetyConfig{DeviceAllowlist: []string{"/dev/sdd"}},
+			requested: "/dev/sdd",
+			device:    "/dev/mapper/mpatha",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeviceAllowed(system, tt.safety, tt.requested, tt.device)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	t.Run("system devices unknown", func(t *testing.T) {
+		err := checkDeviceAllowed(fakeSystemDevices{err: fmt.Errorf("permission denied")}, config.SafetyConfig{}, "/dev/sdb", "/dev/sdb")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "refusing to encrypt /dev/sdb")
+	})
+}
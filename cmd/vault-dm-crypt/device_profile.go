@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// profileSecretStore is the Vault access used by encrypt and decrypt for a device, which may
+// store its key on the backend of its [[device]] profile
+type profileSecretStore interface {
+	keyStore
+	metadataStore
+	decryptSecretReader
+	ListSecretVersions(ctx context.Context, path string) ([]vault.SecretVersion, error)
+}
+
+// backendStore directs key reads and writes to one KV backend instead of the configured one
+type backendStore struct {
+	*vault.Client
+	backend string
+}
+
+func (s backendStore) ReadSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	return s.Client.ReadSecretFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error) {
+	return s.Client.ReadSecretVersionFrom(ctx, s.backend, path, version)
+}
+
+func (s backendStore) WriteSecret(ctx context.Context, path string, data map[string]interface{}) error {
+	return s.Client.WriteSecretTo(ctx, s.backend, path, data)
+}
+
+func (s backendStore) WriteSecretCAS(ctx context.Context, path string, data map[string]interface{}, cas int) error {
+	return s.Client.WriteSecretCASTo(ctx, s.backend, path, data, cas)
+}
+
+func (s backendStore) CurrentSecretVersion(ctx context.Context, path string) (int, error) {
+	return s.Client.CurrentSecretVersionFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) DeleteSecret(ctx context.Context, path string) error {
+	return s.Client.DeleteSecretFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) DestroySecret(ctx context.Context, path string) error {
+	return s.Client.DestroySecretFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) ListSecrets(ctx context.Context, path string) ([]string, error) {
+	return s.Client.ListSecretsFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) ListSecretVersions(ctx context.Context, path string) ([]vault.SecretVersion, error) {
+	return s.Client.ListSecretVersionsFrom(ctx, s.backend, path)
+}
+
+func (s backendStore) ProbeWrite(ctx context.Context, path string) error {
+	return s.Client.ProbeWriteTo(ctx, s.backend, path)
+}
+
+// storeForProfile returns the Vault client, reading and writing on the backend of profile if it sets one
+func storeForProfile(profile *config.DeviceConfig) profileSecretStore {
+	if profile == nil || profile.Backend == "" {
+		return vaultClient
+	}
+	return backendStore{Client: vaultClient, backend: profile.Backend}
+}
+
+// profileDecryptArgs returns the decrypt arguments that make boot-time decrypt look for the key
+// where the profile stored it
+func profileDecryptArgs(profile *config.DeviceConfig) []string {
+	if profile == nil || !profile.ChangesVaultLocation() {
+		return nil
+	}
+	return []string{"--profile", profile.Name}
+}
+
+// profileName returns the name of profile, or an empty string for none
+func profileName(profile *config.DeviceConfig) string {
+	if profile == nil {
+		return ""
+	}
+	return profile.Name
+}
+
+// profileFromFlag returns the [[device]] profile named by the --profile flag of cmd, or nil if
+// it is not given
+func profileFromFlag(cmd *cobra.Command) (*config.DeviceConfig, error) {
+	name, _ := cmd.Flags().GetString("profile")
+	if name == "" {
+		return nil, nil
+	}
+	return cfg.DeviceProfileByName(name)
+}
+
+// vaultLocation is somewhere keys are stored: the [vault] location or that of a [[device]] profile
+type vaultLocation struct {
+	Profile *config.DeviceConfig // nil for the [vault] location
+	Vault   config.VaultConfig
+	Store   profileSecretStore
+}
+
+// vaultLocations returns the Vault locations that enumerating commands walk: that of the profile
+// named by the --profile flag of cmd if given, otherwise the [vault] location followed by that of
+// every [[device]] profile storing keys elsewhere. A location shared by several profiles is
+// returned once, for the first of them.
+func vaultLocations(cmd *cobra.Command) ([]vaultLocation, error) {
+	profile, err := profileFromFlag(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		return []vaultLocation{newVaultLocation(profile)}, nil
+	}
+
+	locations := []vaultLocation{newVaultLocation(nil)}
+	seen := map[string]bool{locations[0].key(): true}
+	for i := range cfg.Devices {
+		if !cfg.Devices[i].ChangesVaultLocation() {
+			continue
+		}
+		location := newVaultLocation(&cfg.Devices[i])
+		if seen[location.key()] {
+			continue
+		}
+		seen[location.key()] = true
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// newVaultLocation returns the location where keys of profile are stored
+func newVaultLocation(profile *config.DeviceConfig) vaultLocation {
+	return vaultLocation{
+		Profile: profile,
+		Vault:   cfg.VaultForProfile(profile),
+		Store:   storeForProfile(profile),
+	}
+}
+
+// key identifies the backend and path the location lists keys under
+func (l vaultLocation) key() string {
+	return l.Vault.Backend + "\x00" + l.Vault.VaultPath + "\x00" + l.Vault.PathTemplate
+}
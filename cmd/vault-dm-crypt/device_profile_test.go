@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+func TestDeviceProfileVaultLocation(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Devices = []config.DeviceConfig{
+		{Name: "cold", Path: "/dev/disk/by-id/ata-*", Backend: "cold-secret", PathPrefix: "cold/node1"},
+		{Name: "fast", Path: "/dev/nvme*"},
+	}
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	t.Run("key is stored under the profile path", func(t *testing.T) {
+		cold := cfg.DeviceProfile("/dev/disk/by-id/ata-disk-1")
+		require.NotNil(t, cold)
+
+		store := newFakeKeyStore()
+		vaultPath, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sda", Profile: cold}, false)
+		require.NoError(t, err)
+		assert.Equal(t, "cold/node1/"+uuid, vaultPath)
+		assert.Equal(t, "cold", store.secrets[vaultPath]["profile"])
+	})
+
+	t.Run("profiles without a Vault location use [vault]", func(t *testing.T) {
+		store := newFakeKeyStore()
+		vaultPath, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/nvme0n1", Profile: cfg.DeviceProfile("/dev/nvme0n1")}, false)
+		require.NoError(t, err)
+		assert.Equal(t, "vault-dm-crypt/node1/"+uuid, vaultPath)
+	})
+
+	t.Run("boot decrypt is given the profile", func(t *testing.T) {
+		originalCfgFile := cfgFile
+		t.Cleanup(func() { cfgFile = originalCfgFile })
+		cfgFile = defaultConfigFile
+
+		cold, err := cfg.DeviceProfileByName("cold")
+		require.NoError(t, err)
+		fast, err := cfg.DeviceProfileByName("fast")
+		require.NoError(t, err)
+
+		assert.Equal(t, "/usr/bin/vault-dm-crypt decrypt --profile cold "+uuid, decryptBootCommand(uuid, cold))
+		assert.Equal(t, "/usr/bin/vault-dm-crypt decrypt "+uuid, decryptBootCommand(uuid, fast))
+		assert.Equal(t, "/usr/bin/vault-dm-crypt decrypt "+uuid, decryptBootCommand(uuid, nil))
+	})
+}
+
+func TestVaultLocations(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Devices = []config.DeviceConfig{
+		{Name: "cold", Path: "/dev/disk/by-id/ata-*", Backend: "cold-secret", PathPrefix: "cold/node1"},
+		{Name: "fast", Path: "/dev/nvme*"},
+		{Name: "archive", Path: "/dev/sd*", PathPrefix: "archive/node1"},
+		{Name: "cold-too", Path: "/dev/vd*", Backend: "cold-secret", PathPrefix: "cold/node1"},
+	}
+
+	newCmd := func() *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("profile", "", "")
+		return cmd
+	}
+
+	t.Run("every location once", func(t *testing.T) {
+		locations, err := vaultLocations(newCmd())
+		require.NoError(t, err)
+
+		var names, backends []string
+		for _, location := range locations {
+			names = append(names, profileName(location.Profile))
+			backends = append(backends, location.Vault.Backend)
+		}
+		assert.Equal(t, []string{"", "cold", "archive"}, names)
+		assert.Equal(t, []string{"secret", "cold-secret", "secret"}, backends)
+		assert.IsType(t, backendStore{}, locations[1].Store)
+	})
+
+	t.Run("only the given profile", func(t *testing.T) {
+		cmd := newCmd()
+		require.NoError(t, cmd.Flags().Set("profile", "archive"))
+
+		locations, err := vaultLocations(cmd)
+		require.NoError(t, err)
+		require.Len(t, locations, 1)
+		path, err := locations[0].Vault.SecretListPath()
+		require.NoError(t, err)
+		assert.Equal(t, "archive/node1", path)
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		cmd := newCmd()
+		require.NoError(t, cmd.Flags().Set("profile", "missing"))
+
+		_, err := vaultLocations(cmd)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// devicePollInterval is how often device discovery is retried while waiting for storage
+const devicePollInterval = 250 * time.Millisecond
+
+// deviceWaiter retries device discovery at boot, when the decrypt unit can start before the
+// storage subsystem has created the device
+type deviceWaiter struct {
+	find     func(uuid string) (string, error)
+	settle   func(timeout time.Duration) error
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// newDeviceWaiter returns a waiter using /dev/disk/by-uuid, blkid and udevadm settle
+func newDeviceWaiter(timeout time.Duration) *deviceWaiter {
+	return &deviceWaiter{
+		find:     findDeviceByUUID,
+		settle:   dmcrypt.NewUdevManager(logger).WaitForSettle,
+		timeout:  timeout,
+		interval: devicePollInterval,
+	}
+}
+
+// wait polls for the device until it is found or the timeout elapses. udev is asked to settle
+// once, after the first miss; a zero timeout tries only once.
+func (w *deviceWaiter) wait(uuid string) (string, error) {
+	devicePath, err := w.find(uuid)
+	if err == nil || w.timeout <= 0 {
+		return devicePath, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(w.timeout)
+	logger.WithFields(logrus.Fields{
+		"uuid":    uuid,
+		"timeout": w.timeout,
+	}).Info("Device not present yet, waiting for it to appear")
+
+	remaining := max(time.Until(deadline), time.Second)
+	if settleErr := w.settle(remaining); settleErr != nil {
+		logger.WithError(settleErr).Debug("udevadm settle failed")
+	}
+
+	for {
+		devicePath, err = w.find(uuid)
+		if err == nil {
+			logger.WithFields(logrus.Fields{
+				"uuid":   uuid,
+				"waited": time.Since(start).Round(time.Millisecond),
+			}).Info("Device appeared")
+			return devicePath, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return "", fmt.Errorf("%w (waited %s)", err, w.timeout)
+		}
+
+		time.Sleep(min(w.interval, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceWaiter(t *testing.T) {
+	newWaiter := func(appearAfter time.Duration, timeout time.Duration) (*deviceWaiter, *int32) {
+		var settles int32
+		start := time.Now()
+		return &deviceWaiter{
+			find: func(uuid string) (string, error) {
+				if time.Since(start) >= appearAfter {
+					return "/dev/sdb1", nil
+				}
+				return "", fmt.Errorf("device with UUID %s not found", uuid)
+			},
+			settle: func(time.Duration) error {
+				atomic.AddInt32(&settles, 1)
+				return nil
+			},
+			timeout:  timeout,
+			interval: 10 * time.Millisecond,
+		}, &settles
+	}
+
+	t.Run("device present immediately", func(t *testing.T) {
+		waiter, settles := newWaiter(0, time.Second)
+		devicePath, err := waiter.wait("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/sdb1", devicePath)
+		assert.Zero(t, atomic.LoadInt32(settles), "udev is only settled after a miss")
+	})
+
+	t.Run("device appears after a delay", func(t *testing.T) {
+		waiter, settles := newWaiter(100*time.Millisecond, 5*time.Second)
+		devicePath, err := waiter.wait("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/sdb1", devicePath)
+		assert.Equal(t, int32(1), atomic.LoadInt32(settles))
+	})
+
+	t.Run("device never appears", func(t *testing.T) {
+		waiter, settles := newWaiter(time.Hour, 100*time.Millisecond)
+		start := time.Now()
+		_, err := waiter.wait("1234-abcd")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "device with UUID 1234-abcd not found")
+		assert.Contains(t, err.Error(), "waited 100ms")
+		assert.Less(t, time.Since(start), 2*time.Second)
+		assert.Equal(t, int32(1), atomic.LoadInt32(settles))
+	})
+
+	t.Run("zero timeout does not wait", func(t *testing.T) {
+		waiter, settles := newWaiter(time.Hour, 0)
+		_, err := waiter.wait("1234-abcd")
+		require.Error(t, err)
+		assert.Zero(t, atomic.LoadInt32(settles))
+	})
+}
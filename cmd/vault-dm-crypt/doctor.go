@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// doctorProbeUUID stands in for a device UUID when checking access to the key path
+const doctorProbeUUID = "00000000-0000-0000-0000-000000000000"
+
+// Capabilities encrypt and decrypt need on a device's key path
+var doctorKeyCapabilities = []string{"create", "read", "update"}
+
+// Outcomes of a doctor check
+const (
+	doctorPass = "PASS"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+// doctorCheck is the outcome of one diagnostic, with a remediation hint on failure
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose common configuration, Vault and system problems",
+	Long: `Run a series of diagnostics and print a remediation hint for each failure:
+
+- Vault authentication with the configured credentials
+- The secrets engine at [vault] backend exists and matches kv_version
+- The token's policies grant create, read and update on the key path
+- cryptsetup, blkid and udevadm are installed and the dm_crypt kernel modules load
+
+Exits non-zero if any check fails.`,
+	Example: `  vault-dm-crypt doctor`,
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		checks := runVaultChecks(ctx)
+		checks = append(checks, runSystemChecks()...)
+
+		failures := 0
+		for _, check := range checks {
+			fmt.Printf("%-4s %s: %s\n", check.Status, check.Name, check.Detail)
+			if check.Status == doctorFail {
+				failures++
+				if check.Hint != "" {
+					fmt.Printf("     hint: %s\n", check.Hint)
+				}
+			}
+		}
+
+		if failures > 0 {
+			return fmt.Errorf("doctor found %d problem(s)", failures)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// runVaultChecks checks authentication, the backend mount and the token's capabilities
+func runVaultChecks(ctx context.Context) []doctorCheck {
+	auth := doctorCheck{Name: "vault authentication"}
+	if err := vaultClient.EnsureAuthenticated(ctx); err != nil {
+		auth.Status = doctorFail
+		auth.Detail = err.Error()
+		if cfg.Vault.VaultToken != "" {
+			auth.Hint = "check that vault_token is valid and not expired"
+		} else {
+			auth.Hint = fmt.Sprintf("check approle and secret_id, and that AppRole is mounted at auth/%s; run refresh-auth --status", cfg.Vault.AppRoleMountPath())
+		}
+
+		// Nothing else can be checked in Vault without a token
+		skipped := []doctorCheck{auth}
+		for _, name := range []string{"vault backend", "vault key path capabilities"} {
+			skipped = append(skipped, doctorCheck{Name: name, Status: doctorSkip, Detail: "not authenticated"})
+		}
+		return skipped
+	}
+	auth.Status = doctorPass
+	auth.Detail = fmt.Sprintf("authenticated with %s", cfg.Vault.URL)
+
+	return []doctorCheck{auth, checkBackendMount(ctx), checkKeyCapabilities(ctx)}
+}
+
+// checkBackendMount checks that the backend is a KV mount of the configured version
+func checkBackendMount(ctx context.Context) doctorCheck {
+	check := doctorCheck{Name: "vault backend"}
+
+	info, err := vaultClient.GetMountInfo(ctx)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = fmt.Sprintf("check that a KV secrets engine is mounted at %q (vault secrets list) and that backend is set to its path", cfg.Vault.Backend)
+		return check
+	}
+
+	return mountCheck(check, info, cfg.Vault.Backend, cfg.Vault.KVVersion)
+}
+
+// mountCheck compares the mount found in Vault with the configured backend and KV version
+func mountCheck(check doctorCheck, info *vault.MountInfo, backend, kvVersion string) doctorCheck {
+	if info.KVVersion == "" {
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s is a %q secrets engine, not KV", backend, info.Type)
+		check.Hint = "set backend to the path of a KV secrets engine"
+		return check
+	}
+
+	if info.KVVersion != kvVersion {
+		check.Status = doctorFail
+		check.Detail = fmt.Sprintf("%s is KV version %s but kv_version is %q", backend, info.KVVersion, kvVersion)
+		check.Hint = fmt.Sprintf("set kv_version = %q in the [vault] section", info.KVVersion)
+		return check
+	}
+
+	check.Status = doctorPass
+	check.Detail = fmt.Sprintf("%s is KV version %s", backend, info.KVVersion)
+	return check
+}
+
+// checkKeyCapabilities checks the token's capabilities on a representative key path
+func checkKeyCapabilities(ctx context.Context) doctorCheck {
+	check := doctorCheck{Name: "vault key path capabilities"}
+
+	vaultPath, err := cfg.Vault.SecretPath(doctorProbeUUID)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "fix vault_path or path_template in the [vault] section"
+		return check
+	}
+	dataPath := vaultClient.SecretDataPath(vaultPath)
+
+	capabilities, err := vaultClient.CapabilitiesSelf(ctx, dataPath)
+	if err != nil {
+		check.Status = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "the token needs update on sys/capabilities-self to run this check (granted by the default policy)"
+		return check
+	}
+
+	return capabilitiesCheck(check, dataPath, capabilities[dataPath])
+}
+
+// capabilitiesCheck reports which key path capabilities the token is missing, with the policy
+// stanza that would grant them
+func capabilitiesCheck(check doctorCheck, dataPath string, have []string) doctorCheck {
+	missing := vault.MissingCapabilities(have, doctorKeyCapabilities)
+	if len(missing) == 0 {
+		check.Status = doctorPass
+		check.Detail = fmt.Sprintf("token can %s %s", strings.Join(doctorKeyCapabilities, ", "), dataPath)
+		return check
+	}
+
+	policyPath := strings.Replace(dataPath, doctorProbeUUID, "*", 1)
+	check.Status = doctorFail
+	check.Detail = fmt.Sprintf("token lacks %s on %s (has: %s)", strings.Join(missing, ", "), dataPath, strings.Join(have, ", "))
+	check.Hint = fmt.Sprintf(`add to the token's policy: path %q { capabilities = ["%s"] }`, policyPath, strings.Join(doctorKeyCapabilities, `", "`))
+	return check
+}
+
+// runSystemChecks checks the local prerequisites for dm-crypt operations
+func runSystemChecks() []doctorCheck {
+	var checks []doctorCheck
+
+	root := doctorCheck{Name: "root privileges", Status: doctorPass, Detail: "running as root"}
+	if err := validator.ValidateRootPrivileges(); err != nil {
+		root.Status = doctorFail
+		root.Detail = err.Error()
+		root.Hint = "encrypt and decrypt must run as root; run doctor with sudo for accurate results"
+	}
+	checks = append(checks, root)
+
+	commands := doctorCheck{Name: "required commands", Status: doctorPass, Detail: "cryptsetup, blkid and udevadm found"}
+	if err := validator.ValidateRequiredCommands(); err != nil {
+		commands.Status = doctorFail
+		commands.Detail = err.Error()
+		commands.Hint = "install cryptsetup and udev (e.g. apt install cryptsetup-bin udev)"
+	}
+	checks = append(checks, commands)
+
+	cryptsetup := doctorCheck{Name: "cryptsetup version"}
+	if major, minor, patch, err := validator.CryptsetupVersion(); err != nil {
+		cryptsetup.Status = doctorFail
+		cryptsetup.Detail = err.Error()
+		cryptsetup.Hint = "install cryptsetup 2.0 or later"
+	} else if major < 2 {
+		cryptsetup.Status = doctorFail
+		cryptsetup.Detail = fmt.Sprintf("cryptsetup %d.%d.%d is too old", major, minor, patch)
+		cryptsetup.Hint = "install cryptsetup 2.0 or later"
+	} else {
+		cryptsetup.Status = doctorPass
+		cryptsetup.Detail = fmt.Sprintf("cryptsetup %d.%d.%d", major, minor, patch)
+	}
+	checks = append(checks, cryptsetup)
+
+	modules := doctorCheck{Name: "kernel modules", Status: doctorPass, Detail: "dm_crypt and dm_mod available"}
+	if err := validator.ValidateKernelModules(); err != nil {
+		modules.Status = doctorFail
+		modules.Detail = err.Error()
+		modules.Hint = "install the kernel modules package for the running kernel (e.g. linux-modules-$(uname -r))"
+	}
+	checks = append(checks, modules)
+
+	return checks
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+func TestCapabilitiesCheck(t *testing.T) {
+	dataPath := "secret/data/vault-dm-crypt/host/" + doctorProbeUUID
+
+	check := capabilitiesCheck(doctorCheck{}, dataPath, []string{"create", "read", "update"})
+	assert.Equal(t, doctorPass, check.Status)
+
+	check = capabilitiesCheck(doctorCheck{}, dataPath, []string{"read"})
+	assert.Equal(t, doctorFail, check.Status)
+	assert.Contains(t, check.Detail, "lacks create, update")
+	assert.Contains(t, check.Hint, `path "secret/data/vault-dm-crypt/host/*"`)
+	assert.Contains(t, check.Hint, `capabilities = ["create", "read", "update"]`)
+
+	check = capabilitiesCheck(doctorCheck{}, dataPath, []string{"deny"})
+	assert.Equal(t, doctorFail, check.Status)
+}
+
+func TestMountCheck(t *testing.T) {
+	check := mountCheck(doctorCheck{}, &vault.MountInfo{Type: "kv", KVVersion: "2"}, "secret", "2")
+	assert.Equal(t, doctorPass, check.Status)
+
+	check = mountCheck(doctorCheck{}, &vault.MountInfo{Type: "kv", KVVersion: "2"}, "secret", "1")
+	assert.Equal(t, doctorFail, check.Status)
+	assert.Equal(t, `set kv_version = "2" in the [vault] section`, check.Hint)
+
+	check = mountCheck(doctorCheck{}, &vault.MountInfo{Type: "transit"}, "secret", "1")
+	assert.Equal(t, doctorFail, check.Status)
+	assert.Contains(t, check.Detail, "not KV")
+}
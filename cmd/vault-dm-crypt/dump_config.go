@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+var dumpConfigCmd = &cobra.Command{
+	Use:   "dump-config",
+	Short: "Print the effective configuration",
+	Long: `Print the configuration in effect after defaults, the configuration file, environment
+variables and command line flags have been applied, as TOML or JSON (--output).
+
+secret_id and vault_token are shown as *** when set, as are the values of [vault.headers]. No network or device operations are
+performed.`,
+	Example: `  vault-dm-crypt dump-config
+  VAULT_ADDR=https://vault.example.com:8200 vault-dm-crypt dump-config --output json`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		output, _ := cmd.Flags().GetString("output")
+		return writeConfigDump(os.Stdout, cfg, output)
+	},
+}
+
+// writeConfigDump writes the redacted configuration to w in the given format
+func writeConfigDump(w io.Writer, c *config.Config, format string) error {
+	dump := c.Redacted()
+
+	switch format {
+	case "toml":
+		encoder := toml.NewEncoder(w)
+		encoder.SetIndentTables(true)
+		return encoder.Encode(dump)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(dump)
+	default:
+		return fmt.Errorf("invalid --output %q: must be toml or json", format)
+	}
+}
+
+func init() {
+	dumpConfigCmd.Flags().String("output", "toml", "output format: toml or json")
+
+	rootCmd.AddCommand(dumpConfigCmd)
+}
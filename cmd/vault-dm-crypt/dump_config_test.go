@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+func TestWriteConfigDump(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+[vault]
+url = "https://file.example.com:8200"
+approle = "role-id"
+secret_id = "s3cret-from-file"
+
+[vault.headers]
+X-Gateway-Token = "gw-s3cret"
+`), 0600))
+
+	t.Setenv("VAULT_ADDR", "https://env.example.com:8200")
+	t.Setenv("VAULT_DM_CRYPT_VAULT_RETRY_MAX", "9")
+
+	loaded, err := config.Load(configPath)
+	require.NoError(t, err)
+
+	t.Run("toml", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, writeConfigDump(&out, loaded, "toml"))
+
+		assert.Contains(t, out.String(), "url = 'https://env.example.com:8200'")
+		assert.Contains(t, out.String(), "retry_max = 9")
+		assert.Contains(t, out.String(), "secret_id = '***'")
+		assert.NotContains(t, out.String(), "s3cret-from-file")
+		assert.Contains(t, out.String(), "x-gateway-token = '***'")
+		assert.NotContains(t, out.String(), "gw-s3cret")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, writeConfigDump(&out, loaded, "json"))
+
+		var dump struct {
+			Vault map[string]interface{} `json:"vault"`
+		}
+		require.NoError(t, json.Unmarshal(out.Bytes(), &dump))
+		assert.Equal(t, "https://env.example.com:8200", dump.Vault["url"])
+		assert.Equal(t, config.RedactedValue, dump.Vault["secret_id"])
+		assert.Equal(t, "", dump.Vault["vault_token"], "unset secrets are not marked as set")
+		assert.Equal(t, map[string]interface{}{"x-gateway-token": config.RedactedValue}, dump.Vault["headers"])
+	})
+
+	t.Run("token is redacted", func(t *testing.T) {
+		withToken := *loaded
+		withToken.Vault.VaultToken = "hvs.token"
+
+		var out bytes.Buffer
+		require.NoError(t, writeConfigDump(&out, &withToken, "json"))
+		assert.NotContains(t, out.String(), "hvs.token")
+	})
+
+	assert.Error(t, writeConfigDump(&bytes.Buffer{}, loaded, "yaml"))
+}
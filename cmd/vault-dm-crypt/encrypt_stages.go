@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/hooks"
+	"digitalisio/vault-dm-crypt/internal/keysplit"
+	"digitalisio/vault-dm-crypt/internal/systemd"
+	"digitalisio/vault-dm-crypt/internal/tpm"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// Encrypt runs in two stages that can also be run separately: storing a key in Vault
+// (--store-only) and formatting a device with a stored key (--format-from-vault).
+
+// keyStore is the subset of the Vault client used to store and fetch device keys
+type keyStore interface {
+	vaultWriteProber
+	secretReader
+	WriteSecret(ctx context.Context, path string, data map[string]interface{}) error
+	WriteSecretCAS(ctx context.Context, path string, data map[string]interface{}, cas int) error
+	CurrentSecretVersion(ctx context.Context, path string) (int, error)
+	WithRetry(ctx context.Context, operation func() error) error
+}
+
+// keyRecord is the metadata stored in Vault alongside a key
+type keyRecord struct {
+	Device     string // Empty for keys provisioned with --store-only
+	StablePath string // /dev/disk/by-id link to Device, if there is one
+	Integrity  string
+	Filesystem string // Filesystem created on the mapping with --mkfs, if any
+	Offset     uint64 // Data offset in 512-byte sectors given with --offset, if any
+	Label      string // LUKS2 label given with --label, if any
+	Subsystem  string // LUKS2 subsystem given with --subsystem, if any
+	LoopFile   string // Disk image encrypted through a loop device with --loop, if any
+	OpenOpts   dmcrypt.OpenOptions
+	Tags       map[string]string
+
+	// Profile is the [[device]] profile that chose where the key is stored, if any
+	Profile *config.DeviceConfig
+}
+
+// secretData builds the Vault secret for a stored key (already split and sealed as configured)
+func (r keyRecord) secretData(storedKey, tpmSealed, splitScheme string) map[string]interface{} {
+	data := map[string]interface{}{
+		cfg.Vault.KeyFieldNames()[0]: storedKey,
+		"created_at":                 time.Now().Format(time.RFC3339),
+		vault.SchemaVersionField:     vault.CurrentSchemaVersion,
+	}
+
+	if r.Device != "" {
+		data["device"] = r.Device
+	}
+	if r.StablePath != "" {
+		data["device_by_id"] = r.StablePath
+	}
+
+	hostname, _ := cfg.General.Hostname()
+	if hostname != "" {
+		data["hostname"] = hostname
+	}
+
+	if r.Integrity != "" {
+		data["integrity"] = r.Integrity
+	}
+
+	if r.Filesystem != "" {
+		data["filesystem"] = r.Filesystem
+	}
+
+	// The header records the offset too; keeping it in Vault allows rebuilding the layout without it
+	if r.Offset > 0 {
+		data["offset"] = r.Offset
+	}
+
+	if r.Label != "" {
+		data["label"] = r.Label
+	}
+	if r.Subsystem != "" {
+		data["subsystem"] = r.Subsystem
+	}
+
+	// Decrypt reattaches the image to a loop device before looking for the UUID
+	if r.LoopFile != "" {
+		data[loopFileField] = r.LoopFile
+	}
+
+	if name := profileName(r.Profile); name != "" {
+		data["profile"] = name
+	}
+
+	if tpmSealed != "" {
+		data["tpm_sealed"] = tpmSealed
+	}
+
+	if splitScheme != "" {
+		data[keySplitField] = splitScheme
+	}
+
+	mergeTags(data, r.Tags)
+
+	// Persist open flags so boot-time decrypt opens the device the same way
+	if r.OpenOpts.NoReadWorkqueue {
+		data["no_read_workqueue"] = true
+	}
+	if r.OpenOpts.NoWriteWorkqueue {
+		data["no_write_workqueue"] = true
+	}
+
+	return data
+}
+
+// storeKey stores key for uuid in Vault with its metadata, first checking that Vault accepts
+// writes at the key path. When createOnly is set an existing key at the path is never replaced.
+// It returns the key path.
+func storeKey(ctx context.Context, store keyStore, uuid, key string, record keyRecord, createOnly bool) (string, error) {
+	vaultConfig := cfg.VaultForProfile(record.Profile)
+	vaultPath, err := vaultConfig.SecretPath(uuid)
+	if err != nil {
+		return "", err
+	}
+
+	// A UUID given by the operator may already have a key escrowed under it
+	if createOnly {
+		if _, err := store.ReadSecretVersion(ctx, vaultPath, 0); err == nil {
+			return "", fmt.Errorf("a key is already stored for %s at %s", uuid, vaultPath)
+		} else if !stderrors.Is(err, vault.ErrSecretNotFound) {
+			return "", fmt.Errorf("failed to check for an existing key: %w", err)
+		}
+	}
+
+	// Confirm the key can be stored before anything irreversible happens
+	if err := probeVaultWritable(ctx, store, vaultPath); err != nil {
+		return "", err
+	}
+
+	// Optionally keep part of the key on this host, so Vault alone cannot unlock the device
+	storedKey, sharePath, err := splitKey(uuid, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to split key: %w", err)
+	}
+	var splitScheme string
+	if sharePath != "" {
+		splitScheme = cfg.Security.KeySplit
+	}
+
+	// Optionally bind the stored key to this host's TPM
+	var tpmSealed string
+	if cfg.Security.TPMSeal {
+		logger.Info("Sealing encryption key to TPM")
+		storedKey, tpmSealed, err = tpm.WrapKey(newTPMSealer(), storedKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to seal key to TPM: %w", err)
+		}
+	}
+
+	// External key providers may expect keys in Vault in their own encoding
+	storedKey, keyEncoding, err := dmcrypt.EncodeStoredKey(storedKey, cfg.LUKS.KeyEncoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	logger.Debug("Storing encryption key in Vault")
+	secretData := record.secretData(storedKey, tpmSealed, splitScheme)
+	secretData[keyEncodingField] = keyEncoding
+	secretData[keyFingerprintField] = keyFingerprint(key)
+	if cfg.Security.MetadataMAC {
+		macKey, err := metadataMACKey(key, cfg.Security.MetadataMACKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute metadata MAC: %w", err)
+		}
+		secretData[metadataMACField] = computeMetadataMAC(macKey, uuid, secretData)
+	}
+	attempt := 0
+	err = store.WithRetry(ctx, func() error {
+		attempt++
+		if !cfg.Vault.UseCAS {
+			return store.WriteSecret(ctx, vaultPath, secretData)
+		}
+
+		// A new UUID must never replace a key already stored under it
+		cas := 0
+		if attempt > 1 {
+			var err error
+			if cas, err = casRetryVersion(ctx, store, vaultPath, secretData); err != nil {
+				return err
+			}
+		}
+		return store.WriteSecretCAS(ctx, vaultPath, secretData, cas)
+	})
+	if err != nil {
+		if sharePath != "" {
+			if removeErr := keysplit.RemoveShare(sharePath); removeErr != nil {
+				logger.WithError(removeErr).Warn("Failed to remove local key share")
+			}
+		}
+		return "", fmt.Errorf("failed to store key in Vault: %w", err)
+	}
+
+	logger.Info("Encryption key stored in Vault successfully")
+	return vaultPath, nil
+}
+
+// casRetryVersion returns the check-and-set version for retrying a create-only write. An earlier
+// attempt may have been stored even though its response was lost, in which case the write is
+// repeated at the current version; a different key found at the path is never replaced.
+func casRetryVersion(ctx context.Context, store keyStore, vaultPath string, secretData map[string]interface{}) (int, error) {
+	version, err := store.CurrentSecretVersion(ctx, vaultPath)
+	if err != nil || version == 0 {
+		return 0, err
+	}
+
+	existing, err := store.ReadSecretVersion(ctx, vaultPath, version)
+	if err != nil {
+		return 0, err
+	}
+	keyField := cfg.Vault.KeyFieldNames()[0]
+	if existing[keyField] != secretData[keyField] {
+		return 0, fmt.Errorf("%w: a different key is already stored at %s (version %d)", vault.ErrCASMismatch, vaultPath, version)
+	}
+	return version, nil
+}
+
+// loadStoredKey fetches a key provisioned with --store-only, in the Vault location of profile if
+// given, and the open options stored with it. Keys already recorded against a device are refused
+// unless force is set, since formatting a second device with the same UUID and key would make
+// both ambiguous at boot.
+func loadStoredKey(ctx context.Context, store keyStore, uuid string, profile *config.DeviceConfig, force bool) (string, keyRecord, error) {
+	vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuid)
+	if err != nil {
+		return "", keyRecord{}, err
+	}
+
+	var secretData map[string]interface{}
+	err = store.WithRetry(ctx, func() error {
+		var err error
+		secretData, err = store.ReadSecretVersion(ctx, vaultPath, 0)
+		return err
+	})
+	if err != nil {
+		return "", keyRecord{}, fmt.Errorf("failed to retrieve key from Vault: %w", err)
+	}
+
+	secret, err := vault.DecodeDeviceSecret(secretData)
+	if err != nil {
+		return "", keyRecord{}, err
+	}
+
+	record := keyRecord{
+		Device:     secret.Device,
+		Integrity:  secret.Integrity,
+		Filesystem: secret.Filesystem,
+		OpenOpts: dmcrypt.OpenOptions{
+			NoReadWorkqueue:  secret.NoReadWorkqueue,
+			NoWriteWorkqueue: secret.NoWriteWorkqueue,
+		},
+	}
+	if record.Device != "" && !force {
+		return "", keyRecord{}, fmt.Errorf("the key for %s is already in use by %s. Use --force to format another device with it", uuid, record.Device)
+	}
+
+	key, err := deviceKeyFromSecret(secretData, uuid, cfg.Vault.KeyFieldNames())
+	if err != nil {
+		return "", keyRecord{}, err
+	}
+
+	if err := checkStoredMetadata(key, uuid, secretData); err != nil {
+		return "", keyRecord{}, err
+	}
+	if err := checkKeyFingerprint(key, uuid, secret); err != nil {
+		return "", keyRecord{}, err
+	}
+	return key, record, nil
+}
+
+// recordFormattedDevice records the device formatted with a key provisioned with --store-only
+// against it, so the key is not used for another device without --force. The metadata MAC is
+// recomputed since the device fields it covers change.
+func recordFormattedDevice(ctx context.Context, store keyStore, uuid, key string, target *encryptTarget) error {
+	vaultPath, err := cfg.VaultForProfile(target.Profile).SecretPath(uuid)
+	if err != nil {
+		return err
+	}
+
+	return store.WithRetry(ctx, func() error {
+		secretData, err := store.ReadSecretVersion(ctx, vaultPath, 0)
+		if err != nil {
+			return err
+		}
+
+		secretData["device"] = target.Device
+		delete(secretData, "device_by_id")
+		if target.StablePath != "" {
+			secretData["device_by_id"] = target.StablePath
+		}
+
+		if _, present := secretData[metadataMACField]; present || cfg.Security.MetadataMAC {
+			macKey, err := metadataMACKey(key, cfg.Security.MetadataMACKey)
+			if err != nil {
+				return fmt.Errorf("failed to compute metadata MAC: %w", err)
+			}
+			secretData[metadataMACField] = computeMetadataMAC(macKey, uuid, secretData)
+		}
+
+		if !cfg.Vault.UseCAS {
+			return store.WriteSecret(ctx, vaultPath, secretData)
+		}
+		version, err := store.CurrentSecretVersion(ctx, vaultPath)
+		if err != nil {
+			return err
+		}
+		return store.WriteSecretCAS(ctx, vaultPath, secretData, version)
+	})
+}
+
+// parseDeviceUUID validates a UUID given on the command line; an empty value generates one
+func parseDeviceUUID(value string) (string, error) {
+	if value == "" {
+		return uuid.NewString(), nil
+	}
+
+	parsed, err := uuid.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid UUID %q: %w", value, err)
+	}
+	return parsed.String(), nil
+}
+
+// encryptTarget is a device checked and ready to be formatted
+type encryptTarget struct {
+	Device     string
+	StablePath string                   // /dev/disk/by-id link to Device, if there is one
+	Signature  *dmcrypt.DeviceSignature // Existing content that formatting will destroy, if any
+	Force      bool                     // Overwrite existing content, as given with --force
+	Filesystem string                   // Filesystem to create on the mapping, if any
+	FormatOpts dmcrypt.FormatOptions
+	SkipWipe   bool // Leave an integrity device unwiped, as set with [luks] integrity_no_wipe
+	OpenOpts   dmcrypt.OpenOptions
+	Profile    *config.DeviceConfig // [[device]] profile matching the device, if any
+
+	// BootPriority orders the boot decrypt service after those of devices with a lower one, if set
+	BootPriority *int
+}
+
+// prepareEncryptTarget validates and resolves a device for formatting and works out its LUKS
+// options, refusing mounted devices or devices holding data unless force is set
+func prepareEncryptTarget(device, deviceResolution string, force bool) (*encryptTarget, error) {
+	// Validate system requirements
+	if err := validator.ValidateSystemRequirements(); err != nil {
+		return nil, fmt.Errorf("system validation failed: %w", err)
+	}
+
+	// Validate device
+	if err := dmcryptManager.ValidateDevice(device); err != nil {
+		return nil, fmt.Errorf("device validation failed: %w", err)
+	}
+
+	// Use the top-level device when the path is an LVM or multipath member
+	requestedDevice := device
+	resolution, err := dmcrypt.ParseDeviceResolution(deviceResolution)
+	if err != nil {
+		return nil, err
+	}
+	device, err = dmcryptManager.ResolveDevice(device, resolution)
+	if err != nil {
+		return nil, fmt.Errorf("device resolution failed: %w", err)
+	}
+
+	if err := checkDeviceAllowed(dmcryptManager, cfg.Safety, requestedDevice, device); err != nil {
+		return nil, err
+	}
+
+	// Check if device is mounted
+	mounted, err := dmcryptManager.IsDeviceMounted(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check device mount status: %w", err)
+	}
+
+	if mounted && !force {
+		return nil, fmt.Errorf("device %s is currently mounted. Use --force to encrypt anyway", device)
+	}
+
+	// Re-encrypting a LUKS device would orphan the key stored for it, so say so explicitly
+	profile := cfg.DeviceProfile(requestedDevice, device)
+	isLUKS, err := checkExistingLUKS(dmcryptManager, device, profile, force)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to overwrite existing filesystems or partition tables
+	signature, err := dmcryptManager.ProbeDevice(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe device for existing data: %w", err)
+	}
+
+	if signature != nil && !isLUKS {
+		if !force {
+			return nil, fmt.Errorf("device %s contains %s. Use --force to encrypt anyway", device, signature)
+		}
+		logger.WithField("device", device).Warnf("Device contains %s, overwriting because --force was given", signature)
+	}
+
+	// Kernel names such as /dev/sdb can change between boots, so a persistent path is recorded too
+	stablePath, err := dmcryptManager.StablePath(device)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to look up a /dev/disk/by-id path for the device")
+	} else if stablePath != "" {
+		logger.WithField("device_by_id", stablePath).Debug("Found stable device path")
+	}
+
+	// Apply any [[device]] profile matching the requested or resolved path
+	luksOpts := cfg.LUKSForDevice(requestedDevice, device)
+	target := &encryptTarget{
+		Profile:    profile,
+		Device:     device,
+		StablePath: stablePath,
+		Signature:  signature,
+		Force:      force,
+		SkipWipe:   luksOpts.IntegrityNoWipe,
+		FormatOpts: dmcrypt.FormatOptions{
+			Integrity:     luksOpts.Integrity,
+			PBKDFParallel: cfg.DMCrypt.PBKDFParallel,
+		},
+		OpenOpts: dmcrypt.OpenOptions{
+			NoReadWorkqueue:  luksOpts.NoReadWorkqueue,
+			NoWriteWorkqueue: luksOpts.NoWriteWorkqueue,
+			Persistent:       luksOpts.PersistentFlags,
+		},
+	}
+
+	if err := target.checkCryptsetupVersion(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// luksDetector is the subset of the LUKS manager used to detect an existing LUKS header
+type luksDetector interface {
+	IsLUKSDevice(devicePath string) (bool, error)
+	GetLUKSUUID(devicePath string) (string, error)
+}
+
+// checkExistingLUKS reports whether device already has a LUKS header, refusing to continue
+// unless force is set. Formatting over it gives the device a new UUID, so the key stored in
+// Vault for the old UUID, where profile stores keys, no longer unlocks anything.
+func checkExistingLUKS(detector luksDetector, device string, profile *config.DeviceConfig, force bool) (bool, error) {
+	isLUKS, err := detector.IsLUKSDevice(device)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for an existing LUKS header: %w", err)
+	}
+	if !isLUKS {
+		return false, nil
+	}
+
+	// The UUID only makes the message more useful, so an unreadable one is not fatal
+	existingUUID, err := detector.GetLUKSUUID(device)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to read UUID of existing LUKS header")
+		existingUUID = "unknown"
+	}
+
+	if !force {
+		return true, fmt.Errorf("device %s is already LUKS-formatted (UUID %s). Use --force to overwrite it", device, existingUUID)
+	}
+
+	fields := logrus.Fields{"device": device, "existing_uuid": existingUUID}
+	if err == nil {
+		if vaultPath, pathErr := cfg.VaultForProfile(profile).SecretPath(existingUUID); pathErr == nil {
+			fields["orphaned_key"] = vaultPath
+		}
+	}
+	logger.WithFields(fields).Warn("Device is already LUKS-formatted, overwriting because --force was given; the key stored for the existing UUID will no longer unlock anything")
+	return true, nil
+}
+
+// checkCryptsetupVersion checks that cryptsetup supports the target's LUKS options
+func (t *encryptTarget) checkCryptsetupVersion() error {
+	// LUKS2 authenticated encryption requires cryptsetup 2.0+
+	if t.FormatOpts.Integrity != "" {
+		if err := validator.RequireCryptsetupVersion(2, 0, "LUKS2 integrity protection"); err != nil {
+			return err
+		}
+	}
+
+	// Workqueue bypass flags, and persisting them in the LUKS2 header, require cryptsetup 2.4+
+	if t.OpenOpts.RequiresPerfFlags() {
+		if err := validator.RequireCryptsetupVersion(2, 4, "no_read_workqueue/no_write_workqueue"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatAndActivate formats the target with key under uuid, opens it and arranges for it to be
+// decrypted on boot. With check set, the device is then reopened with the key read back from
+// Vault before success is reported. It returns the mapped device path.
+func formatAndActivate(parent context.Context, summary *operationSummary, target *encryptTarget, uuid, key string, check *roundTripCheck) (string, error) {
+	// Format device with LUKS
+	logger.Info("Formatting device with LUKS encryption")
+	if err := dmcryptManager.FormatDeviceWithOptions(target.Device, key, uuid, target.FormatOpts); err != nil {
+		return "", fmt.Errorf("%w: %w", errFormatFailed, err)
+	}
+
+	logger.Info("Device formatted with LUKS successfully")
+
+	// Open the LUKS device
+	deviceName, err := cfg.MappingName(uuid)
+	if err != nil {
+		return "", err
+	}
+	summary.Mapping = deviceName
+	logger.WithField("device_name", deviceName).Info("Opening LUKS device")
+
+	if err := dmcryptManager.OpenDeviceWithOptions(target.Device, key, deviceName, target.OpenOpts); err != nil {
+		return "", fmt.Errorf("failed to open LUKS device: %w", err)
+	}
+
+	mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
+	logger.WithField("mapped_device", mappedDevice).Info("LUKS device opened successfully")
+
+	// luksFormat leaves integrity tags uninitialised, so the mapping is wiped before use
+	if target.FormatOpts.Integrity != "" {
+		if target.SkipWipe {
+			logger.WithField("mapped_device", mappedDevice).Warn("Skipping integrity wipe because integrity_no_wipe is set; reads of sectors not yet written will fail")
+		} else {
+			state := &integrityWipeState{
+				Device:       target.Device,
+				Mapping:      deviceName,
+				Filesystem:   target.Filesystem,
+				Force:        target.Force,
+				Profile:      profileName(target.Profile),
+				BootPriority: target.BootPriority,
+			}
+			if err := runIntegrityWipe(dmcryptManager, uuid, state); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return completeEncrypt(parent, target, uuid, key, deviceName, check)
+}
+
+// completeEncrypt finishes encrypting a formatted and opened device once any integrity wipe is
+// done: it creates the filesystem, runs the --verify-after round trip if check is set, records
+// the header checksum and enables boot decryption. It returns the mapped device path. Formatting
+// and the wipe can take far longer than the Vault timeout, so each Vault request here is given
+// its own timeout derived from parent.
+func completeEncrypt(parent context.Context, target *encryptTarget, uuid, key, deviceName string, check *roundTripCheck) (string, error) {
+	mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
+	if target.Filesystem != "" {
+		if err := dmcryptManager.MakeFilesystem(mappedDevice, target.Filesystem, target.Force); err != nil {
+			return "", fmt.Errorf("failed to create filesystem: %w", err)
+		}
+	}
+
+	if check != nil {
+		ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+		err := verifyRoundTrip(ctx, dmcryptManager, check, uuid, key, target.Device, deviceName, target.OpenOpts)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Flags persisted by the open above are part of the header, so it is hashed only now
+	ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	recordHeaderChecksum(ctx, vaultClient, dmcryptManager, uuid, target.Device, target.Profile)
+	cancel()
+
+	enableBootDecrypt(uuid, target.Profile, target.BootPriority)
+
+	logger.WithFields(logrus.Fields{
+		"device":        target.Device,
+		"uuid":          uuid,
+		"mapped_device": mappedDevice,
+	}).Info("Device encryption completed successfully")
+
+	if err := hookRunner.Run(hooks.PostEncrypt, hooks.Event{UUID: uuid, Device: target.Device, MappedDevice: mappedDevice}); err != nil {
+		return "", err
+	}
+
+	return mappedDevice, nil
+}
+
+// errFormatFailed marks an encrypt that failed formatting the device, leaving a stored key that
+// no device uses
+var errFormatFailed = stderrors.New("failed to format device with LUKS")
+
+// keyRemover is the subset of the Vault client used to roll back a stored key
+type keyRemover interface {
+	DeleteSecret(ctx context.Context, path string) error
+}
+
+// rollbackStoredKey removes the key stored at vaultPath for a device that could not be
+// formatted. Only the recoverable delete is used, never a destroy, so on KV v2 a rollback
+// made in error can be reversed with 'vault kv undelete'.
+func rollbackStoredKey(ctx context.Context, store keyRemover, vaultPath string) {
+	if err := store.DeleteSecret(ctx, vaultPath); err != nil {
+		logger.WithError(err).WithField("vault_path", vaultPath).Warn("Failed to remove the key stored for the device that could not be formatted")
+		return
+	}
+	logger.WithField("vault_path", vaultPath).Warn("Removed the key stored for the device that could not be formatted; on KV v2 it can be restored with 'vault kv undelete'")
+}
+
+// enableBootDecrypt enables the systemd service that decrypts uuid on boot, ordered by priority
+// if set; other init systems need manual setup, so instructions are logged instead
+func enableBootDecrypt(uuid string, profile *config.DeviceConfig, priority *int) {
+	if initSystem := systemd.DetectInitSystem(); initSystem != systemd.InitSystemd {
+		logger.WithField("init_system", initSystem).Info("systemd is not running; to decrypt this device on boot, " +
+			systemd.BootInstructions(initSystem, decryptBootCommand(uuid, profile)))
+		if priority != nil {
+			logger.Warn("--boot-priority only orders systemd services; order the boot commands manually")
+		}
+		return
+	}
+
+	logger.Info("Enabling systemd service for automatic decryption on boot")
+	if err := systemdManager.EnableDecryptService(uuid); err != nil {
+		logger.WithError(err).Warn("Failed to enable systemd service - device will need manual decryption on boot")
+		return
+	}
+	logger.Info("Systemd service enabled successfully")
+	writeDecryptServiceOverride(uuid, profile)
+
+	if priority != nil {
+		if err := systemdManager.SetBootPriority(uuid, *priority); err != nil {
+			logger.WithError(err).Warn("Failed to set boot priority - device will be decrypted in no particular order on boot")
+		}
+	}
+}
+
+// checkStableDevicePath refuses a kernel device name such as /dev/sdb when preferStable is set,
+// naming the /dev/disk/by-id path to use instead if there is one
+func checkStableDevicePath(finder stablePathFinder, device string, preferStable bool) error {
+	if !preferStable || !dmcrypt.IsKernelDevicePath(device) {
+		return nil
+	}
+
+	stablePath, err := finder.StablePath(device)
+	if err != nil || stablePath == "" {
+		return fmt.Errorf("%s is a kernel device name, which can change between boots; --prefer-stable-path requires a /dev/disk/by-id path", device)
+	}
+	return fmt.Errorf("%s is a kernel device name, which can change between boots; --prefer-stable-path requires a stable path such as %s", device, stablePath)
+}
+
+// stablePathFinder is the subset of the LUKS manager used to find a device's /dev/disk/by-id path
+type stablePathFinder interface {
+	StablePath(devicePath string) (string, error)
+}
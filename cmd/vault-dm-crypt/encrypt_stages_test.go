@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	vaulterrors "digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// fakeKeyStore records the calls the encrypt stages make to Vault
+type fakeKeyStore struct {
+	secrets   map[string]map[string]interface{}
+	probeErr  error
+	deleteErr error
+	calls     []string
+
+	lostWrites int // Writes that are stored but whose response is lost, failing the call
+	retries    int // Extra attempts WithRetry makes
+}
+
+func newFakeKeyStore() *fakeKeyStore {
+	return &fakeKeyStore{secrets: make(map[string]map[string]interface{})}
+}
+
+func (f *fakeKeyStore) ProbeWrite(ctx context.Context, path string) error {
+	f.calls = append(f.calls, "probe "+path)
+	return f.probeErr
+}
+
+func (f *fakeKeyStore) ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error) {
+	f.calls = append(f.calls, "read "+path)
+	data, ok := f.secrets[path]
+	if !ok {
+		return nil, vaulterrors.NewVaultReadError(path, vault.ErrSecretNotFound)
+	}
+	return data, nil
+}
+
+func (f *fakeKeyStore) WriteSecret(ctx context.Context, path string, data map[string]interface{}) error {
+	f.calls = append(f.calls, "write "+path)
+	f.secrets[path] = data
+	return nil
+}
+
+func (f *fakeKeyStore) WriteSecretCAS(ctx context.Context, path string, data map[string]interface{}, cas int) error {
+	f.calls = append(f.calls, fmt.Sprintf("write-cas=%d %s", cas, path))
+	current, _ := f.CurrentSecretVersion(ctx, path)
+	if cas != current {
+		return vaulterrors.NewVaultWriteError(path, vault.ErrCASMismatch)
+	}
+	f.secrets[path] = data
+	if f.lostWrites > 0 {
+		f.lostWrites--
+		return fmt.Errorf("context deadline exceeded")
+	}
+	return nil
+}
+
+// CurrentSecretVersion reports every stored secret as version 1
+func (f *fakeKeyStore) CurrentSecretVersion(ctx context.Context, path string) (int, error) {
+	if _, ok := f.secrets[path]; ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *fakeKeyStore) DeleteSecret(ctx context.Context, path string) error {
+	f.calls = append(f.calls, "delete "+path)
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	delete(f.secrets, path)
+	return nil
+}
+
+func (f *fakeKeyStore) WithRetry(ctx context.Context, operation func() error) error {
+	err := operation()
+	for attempt := 0; err != nil && attempt < f.retries; attempt++ {
+		err = operation()
+	}
+	return err
+}
+
+func useEncryptTestConfig(t *testing.T) {
+	t.Helper()
+	originalCfg := cfg
+	t.Cleanup(func() { cfg = originalCfg })
+
+	cfg = config.DefaultConfig()
+	cfg.General.NodeName = "node1"
+	cfg.Vault.VaultPath = "vault-dm-crypt/node1"
+}
+
+func TestStoreKey(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+	vaultPath := "vault-dm-crypt/node1/" + uuid
+
+	t.Run("store-only key has no device", func(t *testing.T) {
+		store := newFakeKeyStore()
+		record := keyRecord{
+			Integrity:  "hmac-sha256",
+			Filesystem: "xfs",
+			OpenOpts:   dmcrypt.OpenOptions{NoReadWorkqueue: true},
+			Tags:       map[string]string{"ticket": "OPS-1"},
+		}
+
+		path, err := storeKey(context.Background(), store, uuid, key, record, true)
+		require.NoError(t, err)
+		assert.Equal(t, vaultPath, path)
+		assert.Equal(t, []string{"read " + vaultPath, "probe " + vaultPath, "write " + vaultPath}, store.calls)
+
+		stored := store.secrets[vaultPath]
+		assert.Equal(t, key, stored["dmcrypt_key"])
+		assert.Equal(t, "node1", stored["hostname"])
+		assert.Equal(t, "hmac-sha256", stored["integrity"])
+		assert.Equal(t, "xfs", stored["filesystem"])
+		assert.Equal(t, true, stored["no_read_workqueue"])
+		assert.Equal(t, map[string]interface{}{"ticket": "OPS-1"}, stored["tags"])
+		assert.Equal(t, keyFingerprint(key), stored["key_fingerprint"])
+		assert.Equal(t, "base64", stored["key_encoding"])
+		assert.Equal(t, vault.CurrentSchemaVersion, stored["schema_version"])
+		assert.NotContains(t, stored, "device")
+	})
+
+	t.Run("store-only never replaces an existing key", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.secrets[vaultPath] = map[string]interface{}{"dmcrypt_key": "b2xk"}
+
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{}, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already stored")
+		assert.Equal(t, "b2xk", store.secrets[vaultPath]["dmcrypt_key"])
+	})
+
+	t.Run("key stored hex encoded", func(t *testing.T) {
+		cfg.LUKS.KeyEncoding = "hex"
+		t.Cleanup(func() { cfg.LUKS.KeyEncoding = "base64" })
+
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{}, true)
+		require.NoError(t, err)
+
+		stored := store.secrets[vaultPath]
+		assert.Equal(t, "7365637265742d6b65792d6d6174657269616c", stored["dmcrypt_key"])
+		assert.Equal(t, "hex", stored["key_encoding"])
+		assert.Equal(t, keyFingerprint(key), stored["key_fingerprint"])
+
+		// Decrypt decodes it with the recorded encoding, whatever the current setting
+		cfg.LUKS.KeyEncoding = "base64"
+		got, err := deviceKeyFromSecret(stored, uuid, cfg.Vault.KeyFieldNames())
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+	})
+
+	t.Run("raw keys are stored base64 encoded", func(t *testing.T) {
+		cfg.LUKS.KeyEncoding = "raw"
+		t.Cleanup(func() { cfg.LUKS.KeyEncoding = "base64" })
+
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{}, true)
+		require.NoError(t, err)
+		assert.Equal(t, key, store.secrets[vaultPath]["dmcrypt_key"])
+		assert.Equal(t, "base64", store.secrets[vaultPath]["key_encoding"])
+	})
+
+	t.Run("data offset is recorded", func(t *testing.T) {
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1", Offset: 32768}, false)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(32768), store.secrets[vaultPath]["offset"])
+
+		store = newFakeKeyStore()
+		_, err = storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1"}, false)
+		require.NoError(t, err)
+		assert.NotContains(t, store.secrets[vaultPath], "offset")
+	})
+
+	t.Run("stable device path is recorded", func(t *testing.T) {
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1", StablePath: "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1"}, false)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/sdd1", store.secrets[vaultPath]["device"])
+		assert.Equal(t, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1", store.secrets[vaultPath]["device_by_id"])
+	})
+
+	t.Run("label and subsystem are recorded", func(t *testing.T) {
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1", Label: "db-data", Subsystem: "pool-a"}, false)
+		require.NoError(t, err)
+		assert.Equal(t, "db-data", store.secrets[vaultPath]["label"])
+		assert.Equal(t, "pool-a", store.secrets[vaultPath]["subsystem"])
+	})
+
+	t.Run("loop file is recorded", func(t *testing.T) {
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/loop3", LoopFile: "/var/lib/images/data.img"}, false)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop3", store.secrets[vaultPath]["device"])
+		assert.Equal(t, "/var/lib/images/data.img", store.secrets[vaultPath]["loop_file"])
+	})
+
+	t.Run("failed probe stores nothing", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.probeErr = errors.New("cannot write to readonly storage")
+
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1"}, false)
+		require.Error(t, err)
+		assert.Equal(t, []string{"probe " + vaultPath}, store.calls)
+		assert.Empty(t, store.secrets)
+	})
+
+	t.Run("check-and-set", func(t *testing.T) {
+		cfg.Vault.KVVersion = "2"
+		cfg.Vault.UseCAS = true
+		defer func() { cfg.Vault.UseCAS = false }()
+
+		store := newFakeKeyStore()
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1"}, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"probe " + vaultPath, "write-cas=0 " + vaultPath}, store.calls)
+		assert.Equal(t, "/dev/sdd1", store.secrets[vaultPath]["device"])
+	})
+
+	t.Run("check-and-set retry after a lost response", func(t *testing.T) {
+		cfg.Vault.KVVersion = "2"
+		cfg.Vault.UseCAS = true
+		defer func() { cfg.Vault.UseCAS = false }()
+
+		store := newFakeKeyStore()
+		store.lostWrites = 1
+		store.retries = 2
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1"}, false)
+		require.NoError(t, err)
+
+		// The first write landed, so the retry rewrites the same key at the current version
+		assert.Equal(t, []string{"probe " + vaultPath, "write-cas=0 " + vaultPath, "read " + vaultPath, "write-cas=1 " + vaultPath}, store.calls)
+	})
+
+	t.Run("check-and-set retry never replaces another key", func(t *testing.T) {
+		cfg.Vault.KVVersion = "2"
+		cfg.Vault.UseCAS = true
+		defer func() { cfg.Vault.UseCAS = false }()
+
+		store := newFakeKeyStore()
+		store.retries = 1
+		store.secrets[vaultPath] = map[string]interface{}{"dmcrypt_key": "b3RoZXI="}
+		_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdd1"}, false)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, vault.ErrCASMismatch)
+		assert.Equal(t, "b3RoZXI=", store.secrets[vaultPath]["dmcrypt_key"])
+	})
+}
+
+func TestLoadStoredKey(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+	vaultPath := "vault-dm-crypt/node1/" + uuid
+
+	t.Run("provisioned key", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.secrets[vaultPath] = map[string]interface{}{
+			"dmcrypt_key":        key,
+			"integrity":          "hmac-sha256",
+			"filesystem":         "ext4",
+			"no_write_workqueue": true,
+		}
+
+		got, record, err := loadStoredKey(context.Background(), store, uuid, nil, false)
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+		assert.Equal(t, "hmac-sha256", record.Integrity)
+		assert.Equal(t, "ext4", record.Filesystem)
+		assert.Equal(t, dmcrypt.OpenOptions{NoWriteWorkqueue: true}, record.OpenOpts)
+	})
+
+	t.Run("key already in use", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.secrets[vaultPath] = map[string]interface{}{"dmcrypt_key": key, "device": "/dev/sdb1"}
+
+		_, _, err := loadStoredKey(context.Background(), store, uuid, nil, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already in use by /dev/sdb1")
+
+		got, _, err := loadStoredKey(context.Background(), store, uuid, nil, true)
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+	})
+
+	t.Run("key does not match its fingerprint", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.secrets[vaultPath] = map[string]interface{}{"dmcrypt_key": key, "key_fingerprint": keyFingerprint("b3RoZXI=")}
+
+		_, _, err := loadStoredKey(context.Background(), store, uuid, nil, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not the key the device was formatted with")
+	})
+
+	t.Run("no stored key", func(t *testing.T) {
+		_, _, err := loadStoredKey(context.Background(), newFakeKeyStore(), uuid, nil, false)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, vault.ErrSecretNotFound))
+	})
+}
+
+func TestRecordFormattedDevice(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Security.MetadataMAC = true
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+	vaultPath := "vault-dm-crypt/node1/" + uuid
+
+	for _, useCAS := range []bool{false, true} {
+		t.Run(fmt.Sprintf("use_cas=%t", useCAS), func(t *testing.T) {
+			cfg.Vault.UseCAS = useCAS
+			store := newFakeKeyStore()
+			_, err := storeKey(context.Background(), store, uuid, key, keyRecord{}, true)
+			require.NoError(t, err)
+
+			target := &encryptTarget{Device: "/dev/sdb1", StablePath: "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1"}
+			require.NoError(t, recordFormattedDevice(context.Background(), store, uuid, key, target))
+			assert.Equal(t, "/dev/sdb1", store.secrets[vaultPath]["device"])
+			assert.Equal(t, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1", store.secrets[vaultPath]["device_by_id"])
+
+			// The key is now in use, and its metadata still verifies
+			_, _, err = loadStoredKey(context.Background(), store, uuid, nil, false)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "already in use by /dev/sdb1")
+
+			_, _, err = loadStoredKey(context.Background(), store, uuid, nil, true)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestParseDeviceUUID(t *testing.T) {
+	generated, err := parseDeviceUUID("")
+	require.NoError(t, err)
+	assert.Len(t, generated, 36)
+
+	parsed, err := parseDeviceUUID("12345678-1234-1234-1234-123456789ABC")
+	require.NoError(t, err)
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", parsed)
+
+	_, err = parseDeviceUUID("/dev/sdd1")
+	assert.Error(t, err)
+}
+
+func TestEncryptArgs(t *testing.T) {
+	defer func() { _ = encryptCmd.Flags().Set("store-only", "false") }()
+
+	assert.Error(t, encryptCmd.Args(encryptCmd, nil), "a device is required")
+	assert.NoError(t, encryptCmd.Args(encryptCmd, []string{"/dev/sdd1"}))
+
+	require.NoError(t, encryptCmd.Flags().Set("store-only", "true"))
+	assert.NoError(t, encryptCmd.Args(encryptCmd, nil))
+	assert.NoError(t, encryptCmd.Args(encryptCmd, []string{"12345678-1234-1234-1234-123456789abc"}))
+	assert.Error(t, encryptCmd.Args(encryptCmd, []string{"a", "b"}))
+}
+
+// fakeLUKSDetector reports a fixed LUKS header state
+type fakeLUKSDetector struct {
+	isLUKS bool
+	uuid   string
+}
+
+func (f fakeLUKSDetector) IsLUKSDevice(devicePath string) (bool, error) {
+	return f.isLUKS, nil
+}
+
+func (f fakeLUKSDetector) GetLUKSUUID(devicePath string) (string, error) {
+	if f.uuid == "" {
+		return "", errors.New("no UUID found in LUKS header")
+	}
+	return f.uuid, nil
+}
+
+func TestCheckExistingLUKS(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	const existingUUID = "87654321-4321-4321-4321-cba987654321"
+
+	t.Run("plain device", func(t *testing.T) {
+		isLUKS, err := checkExistingLUKS(fakeLUKSDetector{}, "/dev/sdd1", nil, false)
+		require.NoError(t, err)
+		assert.False(t, isLUKS)
+	})
+
+	t.Run("refuses LUKS device without force", func(t *testing.T) {
+		_, err := checkExistingLUKS(fakeLUKSDetector{isLUKS: true, uuid: existingUUID}, "/dev/sdd1", nil, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already LUKS-formatted (UUID "+existingUUID+")")
+		assert.Contains(t, err.Error(), "--force")
+	})
+
+	t.Run("overwrites LUKS device with force", func(t *testing.T) {
+		isLUKS, err := checkExistingLUKS(fakeLUKSDetector{isLUKS: true, uuid: existingUUID}, "/dev/sdd1", nil, true)
+		require.NoError(t, err)
+		assert.True(t, isLUKS)
+	})
+
+	t.Run("unreadable UUID", func(t *testing.T) {
+		_, err := checkExistingLUKS(fakeLUKSDetector{isLUKS: true}, "/dev/sdd1", nil, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "(UUID unknown)")
+	})
+}
+
+type fakeStablePathFinder map[string]string
+
+func (f fakeStablePathFinder) StablePath(devicePath string) (string, error) {
+	return f[devicePath], nil
+}
+
+func TestCheckStableDevicePath(t *testing.T) {
+	finder := fakeStablePathFinder{"/dev/sdb": "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"}
+
+	assert.NoError(t, checkStableDevicePath(finder, "/dev/sdb", false), "kernel names are allowed by default")
+	assert.NoError(t, checkStableDevicePath(finder, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", true))
+	assert.NoError(t, checkStableDevicePath(finder, "/dev/mapper/mpatha", true))
+
+	err := checkStableDevicePath(finder, "/dev/sdb", true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4")
+
+	err = checkStableDevicePath(finder, "/dev/nvme0n1p1", true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a /dev/disk/by-id path")
+}
+
+func TestRollbackStoredKey(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+
+	t.Run("soft-deletes the stored key", func(t *testing.T) {
+		store := newFakeKeyStore()
+		vaultPath, err := storeKey(context.Background(), store, uuid, "c2VjcmV0LWtleS1tYXRlcmlhbA==", keyRecord{}, false)
+		require.NoError(t, err)
+
+		rollbackStoredKey(context.Background(), store, vaultPath)
+		assert.NotContains(t, store.secrets, vaultPath)
+		assert.Equal(t, "delete "+vaultPath, store.calls[len(store.calls)-1])
+	})
+
+	t.Run("delete failure is not fatal", func(t *testing.T) {
+		store := newFakeKeyStore()
+		store.deleteErr = fmt.Errorf("permission denied")
+
+		assert.NotPanics(t, func() { rollbackStoredKey(context.Background(), store, "vault-dm-crypt/node1/"+uuid) })
+		assert.Equal(t, []string{"delete vault-dm-crypt/node1/" + uuid}, store.calls)
+	})
+
+	t.Run("only format failures roll back", func(t *testing.T) {
+		err := fmt.Errorf("%w: %w", errFormatFailed, fmt.Errorf("device busy"))
+		assert.True(t, errors.Is(err, errFormatFailed))
+		assert.Equal(t, "failed to format device with LUKS: device busy", err.Error())
+
+		assert.False(t, errors.Is(fmt.Errorf("failed to open LUKS device: device busy"), errFormatFailed))
+	})
+}
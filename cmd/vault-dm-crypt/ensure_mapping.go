@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// activationFlagReader reads the activation flags of an open mapping
+type activationFlagReader interface {
+	GetActivationFlags(deviceName string) ([]string, error)
+}
+
+// managedActivationFlags are the activation flags set from the configuration. Others reported
+// by cryptsetup status, such as discards, are not compared.
+var managedActivationFlags = []string{"no_read_workqueue", "no_write_workqueue"}
+
+// activationFlagMismatches describes each configured activation flag the mapping deviceName was
+// opened without, or with when it is no longer configured. An empty result means the mapping
+// already matches the configuration.
+func activationFlagMismatches(reader activationFlagReader, deviceName string, desired dmcrypt.OpenOptions) ([]string, error) {
+	active, err := reader.GetActivationFlags(deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := desired.ActivationFlags()
+	var mismatches []string
+	for _, flag := range managedActivationFlags {
+		isActive := slices.Contains(active, flag)
+		isWanted := slices.Contains(wanted, flag)
+		switch {
+		case isWanted && !isActive:
+			mismatches = append(mismatches, fmt.Sprintf("%s is configured but not active", flag))
+		case isActive && !isWanted:
+			mismatches = append(mismatches, fmt.Sprintf("%s is active but not configured", flag))
+		}
+	}
+	return mismatches, nil
+}
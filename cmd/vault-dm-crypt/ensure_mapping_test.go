@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+type fakeActivationFlagReader struct {
+	flags map[string][]string
+	err   error
+}
+
+func (f *fakeActivationFlagReader) GetActivationFlags(deviceName string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.flags[deviceName], nil
+}
+
+func TestActivationFlagMismatches(t *testing.T) {
+	reader := &fakeActivationFlagReader{flags: map[string][]string{
+		"plain":   nil,
+		"fast":    {"discards", "no_read_workqueue", "no_write_workqueue"},
+		"partial": {"no_read_workqueue"},
+	}}
+
+	tests := []struct {
+		name       string
+		mapping    string
+		desired    dmcrypt.OpenOptions
+		mismatches []string
+	}{
+		{
+			name:    "no flags configured or active",
+			mapping: "plain",
+		},
+		{
+			name:    "all configured flags active",
+			mapping: "fast",
+			desired: dmcrypt.OpenOptions{NoReadWorkqueue: true, NoWriteWorkqueue: true},
+		},
+		{
+			name:       "configured flag missing",
+			mapping:    "partial",
+			desired:    dmcrypt.OpenOptions{NoReadWorkqueue: true, NoWriteWorkqueue: true},
+			mismatches: []string{"no_write_workqueue is configured but not active"},
+		},
+		{
+			name:    "active flags no longer configured",
+			mapping: "fast",
+			mismatches: []string{
+				"no_read_workqueue is active but not configured",
+				"no_write_workqueue is active but not configured",
+			},
+		},
+		{
+			name:       "flags configured on a plain mapping",
+			mapping:    "plain",
+			desired:    dmcrypt.OpenOptions{NoReadWorkqueue: true},
+			mismatches: []string{"no_read_workqueue is configured but not active"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches, err := activationFlagMismatches(reader, tt.mapping, tt.desired)
+			require.NoError(t, err)
+			assert.Equal(t, tt.mismatches, mismatches)
+		})
+	}
+
+	t.Run("status failure", func(t *testing.T) {
+		failing := &fakeActivationFlagReader{err: fmt.Errorf("cryptsetup status failed")}
+		_, err := activationFlagMismatches(failing, "fast", dmcrypt.OpenOptions{})
+		assert.Error(t, err)
+	})
+}
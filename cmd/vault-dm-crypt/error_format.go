@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// errorFormat selects how a failing command reports its error: "text" (default) or "json"
+var errorFormat string
+
+// writeErrorReport writes err to w as a single JSON object for machine consumption
+func writeErrorReport(w io.Writer, err error, operation string) error {
+	data, marshalErr := json.Marshal(errors.NewReport(err, operation))
+	if marshalErr != nil {
+		return marshalErr
+	}
+	_, writeErr := fmt.Fprintln(w, string(data))
+	return writeErr
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&errorFormat, "error-format", "text", "error output format on failure: text or json (written to stderr)")
+
+	// Cobra prints errors and usage as text unless silenced; JSON errors are written by main instead
+	cobra.OnInitialize(func() {
+		if errorFormat == "json" {
+			rootCmd.SilenceErrors = true
+			rootCmd.SilenceUsage = true
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+func TestWriteErrorReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		operation string
+		code      string
+		errType   string
+		reportOp  string
+	}{
+		{
+			name:      "LUKS failure",
+			err:       fmt.Errorf("failed to open LUKS device: %w", errors.NewLUKSFailure("/dev/sdb", "open", fmt.Errorf("cryptsetup failed: exit status 2"))),
+			operation: "decrypt",
+			code:      errors.CodeLUKSFailure,
+			errType:   "LUKSFailure",
+			reportOp:  "luks-open",
+		},
+		{
+			name:      "Vault read error",
+			err:       fmt.Errorf("failed to retrieve key from Vault: %w", errors.Wrap(errors.NewVaultReadError("secret/vault-dm-crypt/host/uuid", fmt.Errorf("permission denied")), "operation failed after 3 retries")),
+			operation: "decrypt",
+			code:      errors.CodeVaultReadError,
+			errType:   "VaultReadError",
+			reportOp:  "decrypt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			require.NoError(t, writeErrorReport(&stderr, tt.err, tt.operation))
+
+			var report map[string]string
+			require.NoError(t, json.Unmarshal(stderr.Bytes(), &report))
+
+			assert.Equal(t, tt.code, report["error_code"])
+			assert.Equal(t, tt.errType, report["error_type"])
+			assert.Equal(t, tt.err.Error(), report["message"])
+			assert.Equal(t, tt.reportOp, report["operation"])
+		})
+	}
+}
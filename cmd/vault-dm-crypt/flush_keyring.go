@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/keyring"
+)
+
+var flushKeyringCmd = &cobra.Command{
+	Use:   "flush-keyring",
+	Short: "Remove cached keys from the kernel keyring",
+	Long: `Remove every key cached by vault-dm-crypt from the kernel keyring.
+
+With [security] use_keyring enabled, decrypt caches each key read from Vault in the
+user keyring for keyring_ttl seconds. Cached keys expire on their own; flush-keyring
+drops them immediately, for example after rotating a key or once boot has completed.
+
+Open devices are not affected.`,
+	Example: `  vault-dm-crypt flush-keyring`,
+	Args:    cobra.NoArgs,
+	// Flushing the keyring needs neither a valid configuration nor Vault access
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if debug {
+			logger.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		removed, err := keyring.New(logger).Flush()
+		for _, description := range removed {
+			logger.WithField("description", description).Debug("Removed key from keyring")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to flush keyring: %w", err)
+		}
+
+		fmt.Printf("Removed %d cached key(s) from the kernel keyring\n", len(removed))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(flushKeyringCmd)
+}
+
+// cachedKeyOptions are the open options stored with the key in Vault, cached alongside the
+// keyring key so a cached decrypt opens the device the same way
+type cachedKeyOptions struct {
+	Integrity        string `json:"integrity,omitempty"`
+	NoReadWorkqueue  bool   `json:"no_read_workqueue,omitempty"`
+	NoWriteWorkqueue bool   `json:"no_write_workqueue,omitempty"`
+	// LoopFile lets a retry reattach a disk image whose first attempt failed, e.g. before its
+	// filesystem was mounted
+	LoopFile string `json:"loop_file,omitempty"`
+}
+
+// keyringOptionsDescription is the keyring description of the options cached for a device
+func keyringOptionsDescription(uuid string) string {
+	return keyring.KeyDescription(uuid) + ":options"
+}
+
+// cacheKeyInKeyring stores the raw key for cryptsetup and the open options for later decrypts
+func cacheKeyInKeyring(kr *keyring.Keyring, uuid, key, integrity, loopFile string, opts dmcrypt.OpenOptions, ttl time.Duration) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	options, err := json.Marshal(cachedKeyOptions{
+		Integrity:        integrity,
+		NoReadWorkqueue:  opts.NoReadWorkqueue,
+		NoWriteWorkqueue: opts.NoWriteWorkqueue,
+		LoopFile:         loopFile,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cached options: %w", err)
+	}
+
+	// Store the options first so a cached key is never found without them
+	if err := kr.Store(keyringOptionsDescription(uuid), options, ttl); err != nil {
+		return err
+	}
+	return kr.Store(keyring.KeyDescription(uuid), keyBytes, ttl)
+}
+
+// loadKeyFromKeyring returns a key cached by an earlier decrypt with its integrity mode and
+// loop file. The boolean is false if the key or its options are not cached.
+func loadKeyFromKeyring(kr *keyring.Keyring, uuid string) (string, string, string, dmcrypt.OpenOptions, bool, error) {
+	var opts dmcrypt.OpenOptions
+
+	keyBytes, found, err := kr.Load(keyring.KeyDescription(uuid))
+	if err != nil || !found {
+		return "", "", "", opts, false, err
+	}
+
+	options, found, err := kr.Load(keyringOptionsDescription(uuid))
+	if err != nil || !found {
+		return "", "", "", opts, false, err
+	}
+
+	var cached cachedKeyOptions
+	if err := json.Unmarshal(options, &cached); err != nil {
+		return "", "", "", opts, false, fmt.Errorf("failed to parse cached options: %w", err)
+	}
+
+	opts.NoReadWorkqueue = cached.NoReadWorkqueue
+	opts.NoWriteWorkqueue = cached.NoWriteWorkqueue
+	return base64.StdEncoding.EncodeToString(keyBytes), cached.Integrity, cached.LoopFile, opts, true, nil
+}
+
+// flushCachedKey removes the key and options cached for a device
+func flushCachedKey(kr *keyring.Keyring, uuid string) error {
+	if err := kr.Remove(keyring.KeyDescription(uuid)); err != nil {
+		return err
+	}
+	return kr.Remove(keyringOptionsDescription(uuid))
+}
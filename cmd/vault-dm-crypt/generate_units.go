@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/systemd"
+)
+
+var generateUnitsCmd = &cobra.Command{
+	Use:   "generate-units [normal-dir [early-dir late-dir]]",
+	Short: "Generate decrypt units for this host's devices, as a systemd generator",
+	Long: `Query Vault for the devices whose keys are stored under this host's path and write a
+vault-dm-crypt-decrypt@<uuid>.service instance for each into the destination directory, pulled
+in by ` + systemd.GeneratorTarget + `. The set of devices decrypted at boot then follows Vault
+without enabling a unit per device. Keys stored under the backend or path_prefix of a [[device]]
+profile are included, and their instances get a drop-in passing --profile to decrypt. With a
+--config other than the default, every instance gets a drop-in passing it to decrypt too.
+
+The command follows the systemd generator interface: systemd runs generators with the normal,
+early and late output directories as arguments and the first one is used unless --dest-dir is
+given. Nothing outside the destination directory is written and systemd is not reloaded. To run
+it as a generator, install an executable wrapper such as
+/etc/systemd/system-generators/vault-dm-crypt-generator containing:
+
+  #!/bin/sh
+  exec /usr/bin/vault-dm-crypt generate-units "$@"
+
+adding --config <path> before generate-units if the configuration is not at the default path.
+
+Generation is skipped in the initrd ($SYSTEMD_IN_INITRD), where the configuration is normally
+not available. Generators run before the network is up, so Vault is only reachable from the
+generator on later daemon-reloads unless it is local; on failure no units are generated and
+devices enabled with systemctl enable are unaffected.`,
+	Example: `  vault-dm-crypt generate-units --dest-dir /tmp/units
+  ls /tmp/units/cryptsetup.target.wants`,
+	Args: cobra.MaximumNArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		destDir, _ := cmd.Flags().GetString("dest-dir")
+		binaryPath, _ := cmd.Flags().GetString("binary-path")
+		if destDir == "" && len(args) > 0 {
+			destDir = args[0]
+		}
+		if destDir == "" {
+			return fmt.Errorf("a destination directory is required: pass --dest-dir or the generator output directories")
+		}
+
+		if os.Getenv("SYSTEMD_IN_INITRD") == "1" {
+			logger.Info("Running in the initrd, not generating decrypt units")
+			return nil
+		}
+
+		locations, err := vaultLocations(cmd)
+		if err != nil {
+			return err
+		}
+		sources := make([]unitSource, 0, len(locations))
+		for _, location := range locations {
+			basePath, err := location.Vault.SecretListPath()
+			if err != nil {
+				return err
+			}
+			sources = append(sources, unitSource{
+				store:       location.Store,
+				basePath:    basePath,
+				decryptArgs: profileDecryptArgs(location.Profile),
+			})
+		}
+
+		// Decrypt at boot must read the same configuration; one read from stdin cannot be given again
+		var configPath string
+		if cfgFile == config.StdinConfigPath {
+			logger.Warn("Configuration was read from stdin - the generated units decrypt with the default configuration")
+		} else if configPath, err = filepath.Abs(cfgFile); err != nil {
+			return fmt.Errorf("failed to resolve config path: %w", err)
+		} else if configPath == defaultConfigFile {
+			configPath = ""
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		written, err := generateUnits(ctx, sources, systemdManager, destDir, configPath, systemd.UnitOptions{
+			BinaryPath:         binaryPath,
+			SecretIDCredential: cfg.Vault.SecretIDCredential,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, path := range written {
+			fmt.Println(path)
+		}
+		return nil
+	},
+}
+
+// deviceUUIDLister is the subset of the Vault client used by generate-units
+type deviceUUIDLister interface {
+	ListSecrets(ctx context.Context, path string) ([]string, error)
+}
+
+// unitSource is a Vault location generate-units lists devices in, with the decrypt arguments
+// that make their units read the key from there
+type unitSource struct {
+	store       deviceUUIDLister
+	basePath    string
+	decryptArgs []string
+}
+
+// unitInstancePattern matches the Vault entries that can name a decrypt unit instance
+var unitInstancePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// generateUnits writes a decrypt unit instance into destDir for every device stored in sources,
+// returning the paths written. Entries that cannot be a device UUID are skipped, and a device
+// stored in more than one source is decrypted from the first. A configPath other than "" is
+// passed to every decrypt.
+func generateUnits(ctx context.Context, sources []unitSource, manager *systemd.Manager, destDir, configPath string, opts systemd.UnitOptions) ([]string, error) {
+	decryptArgs := make(map[string][]string)
+	for _, source := range sources {
+		entries, err := source.store.ListSecrets(ctx, source.basePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list devices in Vault: %w", err)
+		}
+
+		for _, entry := range entries {
+			if !unitInstancePattern.MatchString(entry) {
+				logger.WithField("entry", entry).Warn("Skipping Vault entry that is not a device UUID")
+				continue
+			}
+			if _, seen := decryptArgs[entry]; !seen {
+				decryptArgs[entry] = source.decryptArgs
+			}
+		}
+	}
+
+	uuids := make([]string, 0, len(decryptArgs))
+	for uuid := range decryptArgs {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	written, err := manager.GenerateDecryptUnits(destDir, opts, uuids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate decrypt units: %w", err)
+	}
+
+	for _, uuid := range uuids {
+		if configPath == "" && len(decryptArgs[uuid]) == 0 {
+			continue
+		}
+		path, err := manager.GenerateInstanceOverride(destDir, uuid, configPath, decryptArgs[uuid]...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate decrypt units: %w", err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+func init() {
+	rootCmd.AddCommand(generateUnitsCmd)
+
+	generateUnitsCmd.Flags().String("dest-dir", "", "directory to write the units to (default: the first generator argument)")
+	generateUnitsCmd.Flags().String("profile", "", "only generate units for devices stored in the Vault location of this [[device]] profile")
+	generateUnitsCmd.Flags().String("binary-path", systemd.DefaultBinaryPath, "path to the vault-dm-crypt binary referenced by the units")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/systemd"
+)
+
+// fakeDeviceLister lists a fixed set of entries
+type fakeDeviceLister struct {
+	entries []string
+	err     error
+	path    string
+}
+
+func (f *fakeDeviceLister) ListSecrets(ctx context.Context, path string) ([]string, error) {
+	f.path = path
+	return f.entries, f.err
+}
+
+func TestGenerateUnits(t *testing.T) {
+	quiet := logrus.New()
+	quiet.SetLevel(logrus.FatalLevel)
+	manager := systemd.NewManager(quiet)
+
+	t.Run("one instance per device", func(t *testing.T) {
+		store := &fakeDeviceLister{entries: []string{
+			"6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			"550E8400-E29B-41D4-A716-446655440000",
+			"not a uuid",
+		}}
+		destDir := t.TempDir()
+
+		written, err := generateUnits(context.Background(), []unitSource{{store: store, basePath: "vault-dm-crypt/node1"}}, manager, destDir, "", systemd.UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "vault-dm-crypt/node1", store.path)
+		assert.Len(t, written, 3)
+
+		wants, err := os.ReadDir(filepath.Join(destDir, "cryptsetup.target.wants"))
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range wants {
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{
+			"vault-dm-crypt-decrypt@550e8400-e29b-41d4-a716-446655440000.service",
+			"vault-dm-crypt-decrypt@6ba7b810-9dad-11d1-80b4-00c04fd430c8.service",
+		}, names)
+
+		content, err := os.ReadFile(filepath.Join(destDir, "vault-dm-crypt-decrypt@.service"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "decrypt %i")
+	})
+
+	t.Run("devices stored for a profile", func(t *testing.T) {
+		const shared = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+		const cold = "550e8400-e29b-41d4-a716-446655440000"
+		sources := []unitSource{
+			{store: &fakeDeviceLister{entries: []string{shared}}, basePath: "vault-dm-crypt/node1"},
+			{store: &fakeDeviceLister{entries: []string{shared, cold}}, basePath: "cold/node1", decryptArgs: []string{"--profile", "cold"}},
+		}
+		destDir := t.TempDir()
+
+		written, err := generateUnits(context.Background(), sources, manager, destDir, "", systemd.UnitOptions{})
+		require.NoError(t, err)
+		assert.Len(t, written, 4)
+
+		override, err := os.ReadFile(filepath.Join(destDir, "vault-dm-crypt-decrypt@"+cold+".service.d", "override.conf"))
+		require.NoError(t, err)
+		assert.Contains(t, string(override), "decrypt --profile cold %i")
+
+		// A device found in the [vault] location first is decrypted from there
+		_, err = os.Stat(filepath.Join(destDir, "vault-dm-crypt-decrypt@"+shared+".service.d"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("non-default configuration", func(t *testing.T) {
+		const plain = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+		const cold = "550e8400-e29b-41d4-a716-446655440000"
+		sources := []unitSource{
+			{store: &fakeDeviceLister{entries: []string{plain}}, basePath: "vault-dm-crypt/node1"},
+			{store: &fakeDeviceLister{entries: []string{cold}}, basePath: "cold/node1", decryptArgs: []string{"--profile", "cold"}},
+		}
+		destDir := t.TempDir()
+
+		written, err := generateUnits(context.Background(), sources, manager, destDir, "/etc/vault-dm-crypt/site.toml", systemd.UnitOptions{})
+		require.NoError(t, err)
+		assert.Len(t, written, 5)
+
+		override, err := os.ReadFile(filepath.Join(destDir, "vault-dm-crypt-decrypt@"+plain+".service.d", "override.conf"))
+		require.NoError(t, err)
+		assert.Contains(t, string(override), `--config "/etc/vault-dm-crypt/site.toml" --retry $VAULT_DM_CRYPT_TIMEOUT decrypt %i`)
+
+		override, err = os.ReadFile(filepath.Join(destDir, "vault-dm-crypt-decrypt@"+cold+".service.d", "override.conf"))
+		require.NoError(t, err)
+		assert.Contains(t, string(override), `--config "/etc/vault-dm-crypt/site.toml" --retry $VAULT_DM_CRYPT_TIMEOUT decrypt --profile cold %i`)
+	})
+
+	t.Run("no devices stored", func(t *testing.T) {
+		destDir := t.TempDir()
+		written, err := generateUnits(context.Background(), []unitSource{{store: &fakeDeviceLister{}, basePath: "base"}}, manager, destDir, "", systemd.UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(destDir, "vault-dm-crypt-decrypt@.service")}, written)
+	})
+
+	t.Run("vault unreachable", func(t *testing.T) {
+		destDir := t.TempDir()
+		store := &fakeDeviceLister{err: fmt.Errorf("connection refused")}
+
+		_, err := generateUnits(context.Background(), []unitSource{{store: store, basePath: "base"}}, manager, destDir, "", systemd.UnitOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to list devices in Vault")
+
+		entries, err := os.ReadDir(destDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "nothing is generated when Vault cannot be queried")
+	})
+}
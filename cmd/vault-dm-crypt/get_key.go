@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/tpm"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// keyEncodingField records how the key is encoded in the secret; keys stored without it are base64
+const keyEncodingField = "key_encoding"
+
+var getKeyCmd = &cobra.Command{
+	Use:   "get-key <uuid>",
+	Short: "Print the stored key for a device (break-glass)",
+	Long: `Fetch the encryption key stored in Vault for a device UUID and print it, base64 encoded, to stdout.
+
+This is a deliberate break-glass capability for key escrow and offline recovery tooling.
+It must be confirmed with --i-understand-this-exposes-the-key, and it refuses to print
+to a terminal unless --force is given, to avoid leaking the key into scrollback.
+The key is never logged; log output is redirected to stderr while this command runs.`,
+	Example: `  vault-dm-crypt get-key --i-understand-this-exposes-the-key 12345678-1234-1234-1234-123456789abc > key.b64`,
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		uuid := args[0]
+		confirmed, _ := cmd.Flags().GetBool("i-understand-this-exposes-the-key")
+		force, _ := cmd.Flags().GetBool("force")
+
+		if err := checkKeyExposure(confirmed, force, isTerminal(os.Stdout)); err != nil {
+			return err
+		}
+
+		// Keep stdout for the key alone so it can be redirected safely
+		if cfg.Logging.Output == "stdout" {
+			logger.SetOutput(os.Stderr)
+		}
+
+		profile, err := profileFromFlag(cmd)
+		if err != nil {
+			return err
+		}
+		vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuid)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		store := storeForProfile(profile)
+		var key string
+		err = store.WithRetry(ctx, func() error {
+			var err error
+			key, err = fetchKey(ctx, store, uuid, vaultPath, cfg.Vault.KeyFieldNames())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to retrieve key from Vault: %w", err)
+		}
+		defer dmcryptManager.SecureEraseKey(&key)
+
+		logger.WithField("uuid", uuid).Warn("Encryption key exported to stdout")
+		return writeKey(os.Stdout, key)
+	},
+}
+
+// secretReader is the subset of the Vault client used to fetch a key
+type secretReader interface {
+	ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error)
+}
+
+// fetchKey reads the current key for uuid stored at vaultPath from the first of fields present
+func fetchKey(ctx context.Context, client secretReader, uuid, vaultPath string, fields []string) (string, error) {
+	secretData, err := client.ReadSecretVersion(ctx, vaultPath, 0)
+	if err != nil {
+		return "", err
+	}
+
+	return deviceKeyFromSecret(secretData, uuid, fields)
+}
+
+// keyFromSecret extracts the key from the first of fields present in stored secret data, decoding
+// and unsealing it as secret, the same data decoded, records
+func keyFromSecret(secretData map[string]interface{}, secret *vault.DeviceSecret, fields []string) (string, error) {
+	var field string
+	var storedKey interface{}
+	for _, name := range fields {
+		if value, exists := secretData[name]; exists {
+			field, storedKey = name, value
+			break
+		}
+	}
+	if field == "" {
+		return "", missingKeyFieldError(secretData, fields)
+	}
+
+	key, ok := storedKey.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string", field)
+	}
+	if field != fields[0] {
+		logger.WithField("key_field", field).Info("Using key from fallback key field")
+	}
+
+	// Keys are handled as base64 from here on, whatever [luks] key_encoding they were stored with
+	key, err := dmcrypt.NormalizeStoredKey(key, secret.KeyEncoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", field, err)
+	}
+
+	// Keys sealed with [security] tpm_seal can only be recovered with this host's TPM
+	if secret.TPMSealed != "" {
+		logger.Debug("Unsealing TPM-bound key")
+		unwrapped, err := tpm.UnwrapKey(newTPMSealer(), key, secret.TPMSealed)
+		if err != nil {
+			return "", fmt.Errorf("failed to unwrap TPM-sealed key: %w", err)
+		}
+		return unwrapped, nil
+	}
+
+	return key, nil
+}
+
+// missingKeyFieldError describes a secret without any of fields, e.g. a metadata-only entry or
+// one whose key was stored under a renamed field. Only the names of the fields present are
+// listed, never their values.
+func missingKeyFieldError(secretData map[string]interface{}, fields []string) error {
+	present := make([]string, 0, len(secretData))
+	for name := range secretData {
+		present = append(present, name)
+	}
+	sort.Strings(present)
+
+	found := "the secret has no fields"
+	if len(present) > 0 {
+		found = "fields present: " + strings.Join(present, ", ")
+	}
+	return fmt.Errorf("%s not found in secret (%s); if the key is stored under another field, "+
+		"set [vault] key_field or rerun decrypt with --key-field <field>", strings.Join(fields, ", "), found)
+}
+
+// newTPMSealer returns the sealer for the configured TPM device
+var newTPMSealer = func() tpm.Sealer {
+	return tpm.NewDeviceSealer(cfg.Security.TPMDevice, cfg.Security.TPMPCRs, logger)
+}
+
+// checkKeyExposure enforces the explicit confirmation and terminal guard for get-key
+func checkKeyExposure(confirmed, force, stdoutIsTerminal bool) error {
+	if !confirmed {
+		return fmt.Errorf("get-key prints the raw encryption key; rerun with --i-understand-this-exposes-the-key to confirm")
+	}
+
+	if stdoutIsTerminal && !force {
+		return fmt.Errorf("refusing to print the key to a terminal; redirect stdout to a file or pipe, or use --force")
+	}
+
+	return nil
+}
+
+// writeKey writes the key followed by a newline
+func writeKey(w io.Writer, key string) error {
+	if _, err := fmt.Fprintln(w, key); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a character device such as a TTY
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func init() {
+	getKeyCmd.Flags().Bool("i-understand-this-exposes-the-key", false, "Confirm that the raw key will be printed")
+	getKeyCmd.Flags().Bool("force", false, "Allow printing the key to a terminal")
+	getKeyCmd.Flags().String("profile", "", "Read the key from the Vault location of this [[device]] profile")
+
+	rootCmd.AddCommand(getKeyCmd)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+type fakeSecretReader struct {
+	data map[string]interface{}
+	err  error
+	path string // Path last read
+}
+
+func (f *fakeSecretReader) ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error) {
+	f.path = path
+	return f.data, f.err
+}
+
+func TestCheckKeyExposure(t *testing.T) {
+	tests := []struct {
+		name      string
+		confirmed bool
+		force     bool
+		terminal  bool
+		wantErr   string
+	}{
+		{name: "not confirmed", terminal: false, wantErr: "--i-understand-this-exposes-the-key"},
+		{name: "not confirmed with force", force: true, terminal: true, wantErr: "--i-understand-this-exposes-the-key"},
+		{name: "confirmed to terminal", confirmed: true, terminal: true, wantErr: "refusing to print the key to a terminal"},
+		{name: "confirmed to terminal with force", confirmed: true, force: true, terminal: true},
+		{name: "confirmed to pipe", confirmed: true, terminal: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkKeyExposure(tt.confirmed, tt.force, tt.terminal)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestFetchKeyWritesOnlyToStdout(t *testing.T) {
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	var logs bytes.Buffer
+	originalLogger := logger
+	logger = logrus.New()
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+	defer func() { logger = originalLogger }()
+
+	reader := &fakeSecretReader{data: map[string]interface{}{"dmcrypt_key": key}}
+	got, err := fetchKey(context.Background(), reader, "uuid-1", "vault-dm-crypt/host/uuid-1", []string{"dmcrypt_key"})
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	require.NoError(t, writeKey(&stdout, got))
+
+	assert.Equal(t, key+"\n", stdout.String())
+	assert.NotContains(t, logs.String(), key)
+}
+
+func TestFetchKeyErrors(t *testing.T) {
+	_, err := fetchKey(context.Background(), &fakeSecretReader{data: map[string]interface{}{}}, "uuid-1", "p", []string{"dmcrypt_key"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dmcrypt_key not found")
+
+	_, err = fetchKey(context.Background(), &fakeSecretReader{data: map[string]interface{}{"dmcrypt_key": 1}}, "uuid-1", "p", []string{"dmcrypt_key"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not a string")
+
+	_, err = fetchKey(context.Background(), &fakeSecretReader{err: fmt.Errorf("permission denied")}, "uuid-1", "p", []string{"dmcrypt_key"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+}
+
+func TestKeyFromSecretFields(t *testing.T) {
+	secret := map[string]interface{}{
+		"primary_key": "cHJpbWFyeQ==",
+		"escrow_key":  "ZXNjcm93",
+	}
+
+	t.Run("single field override", func(t *testing.T) {
+		key, err := keyFromSecret(secret, &vault.DeviceSecret{}, []string{"escrow_key"})
+		require.NoError(t, err)
+		assert.Equal(t, "ZXNjcm93", key)
+	})
+
+	t.Run("first present field wins", func(t *testing.T) {
+		key, err := keyFromSecret(secret, &vault.DeviceSecret{}, []string{"primary_key", "escrow_key"})
+		require.NoError(t, err)
+		assert.Equal(t, "cHJpbWFyeQ==", key)
+	})
+
+	t.Run("falls back to later field", func(t *testing.T) {
+		key, err := keyFromSecret(secret, &vault.DeviceSecret{}, []string{"dmcrypt_key", "escrow_key"})
+		require.NoError(t, err)
+		assert.Equal(t, "ZXNjcm93", key)
+	})
+
+	t.Run("no field present", func(t *testing.T) {
+		_, err := keyFromSecret(secret, &vault.DeviceSecret{}, []string{"dmcrypt_key", "backup_key"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "dmcrypt_key, backup_key not found in secret")
+	})
+
+	t.Run("partially written secret lists present fields", func(t *testing.T) {
+		partial := map[string]interface{}{
+			"device":     "/dev/sdb1",
+			"created_at": "2024-01-02T03:04:05Z",
+		}
+		_, err := keyFromSecret(partial, &vault.DeviceSecret{}, []string{"dmcrypt_key"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "dmcrypt_key not found in secret (fields present: created_at, device)")
+		assert.Contains(t, err.Error(), "--key-field")
+		assert.NotContains(t, err.Error(), "/dev/sdb1")
+		assert.NotContains(t, err.Error(), "2024-01-02")
+	})
+
+	t.Run("decoded with the recorded encoding", func(t *testing.T) {
+		key, err := keyFromSecret(map[string]interface{}{"dmcrypt_key": "6b6579"}, &vault.DeviceSecret{KeyEncoding: "hex"}, []string{"dmcrypt_key"})
+		require.NoError(t, err)
+		assert.Equal(t, "a2V5", key)
+	})
+
+	t.Run("empty secret", func(t *testing.T) {
+		_, err := keyFromSecret(map[string]interface{}{}, &vault.DeviceSecret{}, []string{"dmcrypt_key"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "the secret has no fields")
+	})
+}
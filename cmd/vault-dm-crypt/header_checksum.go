@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// headerChecksumKey is the KV v2 custom metadata key under which encrypt records the SHA-256 of
+// the device's LUKS header, so that verify --header can detect later corruption
+const headerChecksumKey = "header_sha256"
+
+// headerHasher is the subset of the LUKS manager used to checksum a LUKS header
+type headerHasher interface {
+	HeaderChecksum(devicePath string) (string, error)
+}
+
+// headerChecksumPath returns the secret path whose custom metadata holds the header checksum of uuid
+func headerChecksumPath(uuid string, profile *config.DeviceConfig) (string, error) {
+	vaultPath, ok := customMetadataPath(uuid, profile)
+	if !ok {
+		return "", fmt.Errorf("header checksums are stored in custom metadata, which requires kv_version = \"2\" on the configured backend")
+	}
+	return vaultPath, nil
+}
+
+// recordHeaderChecksum records the checksum of device's LUKS header for uuid. The device is
+// already encrypted and open, so failures are only logged.
+func recordHeaderChecksum(ctx context.Context, store mappingNameStore, hasher headerHasher, uuid, device string, profile *config.DeviceConfig) {
+	vaultPath, ok := customMetadataPath(uuid, profile)
+	if !ok {
+		logger.Debug("Not recording header checksum: custom metadata requires kv_version = \"2\" on the configured backend")
+		return
+	}
+
+	checksum, err := hasher.HeaderChecksum(device)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to compute LUKS header checksum")
+		return
+	}
+
+	if err := store.UpdateCustomMetadata(ctx, vaultPath, map[string]string{headerChecksumKey: checksum}); err != nil {
+		logger.WithError(err).Warn("Failed to record LUKS header checksum in Vault")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid":          uuid,
+		"header_sha256": checksum,
+	}).Info("Recorded LUKS header checksum in Vault")
+}
+
+// verifyHeaderChecksum compares the checksum of device's LUKS header with the one recorded for
+// uuid, returning an error if none is recorded or they differ
+func verifyHeaderChecksum(ctx context.Context, store mappingNameStore, hasher headerHasher, uuid, device string, profile *config.DeviceConfig) error {
+	vaultPath, err := headerChecksumPath(uuid, profile)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := store.ReadCustomMetadata(ctx, vaultPath)
+	if err != nil {
+		return fmt.Errorf("failed to read recorded header checksum: %w", err)
+	}
+	stored := metadata[headerChecksumKey]
+	if stored == "" {
+		return fmt.Errorf("no header checksum is recorded for %s; record one with 'vault-dm-crypt verify --header --update %s'", uuid, uuid)
+	}
+
+	current, err := hasher.HeaderChecksum(device)
+	if err != nil {
+		return err
+	}
+
+	if current != stored {
+		logger.WithFields(logrus.Fields{
+			"uuid":     uuid,
+			"device":   device,
+			"stored":   stored,
+			"computed": current,
+		}).Error("LUKS header checksum mismatch")
+		return fmt.Errorf("LUKS header of %s does not match the checksum recorded for %s (stored %s, computed %s); the header may be corrupt, or was changed by a keyslot or flag update", device, uuid, stored, current)
+	}
+	return nil
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify (--header | --key) <uuid>",
+	Short: "Check a device's LUKS header or stored key against what encrypt recorded in Vault",
+	Long: `Check a device's LUKS header against the checksum encrypt recorded in Vault, to give early
+warning of header corruption without keeping a full header backup.
+
+The header is dumped with cryptsetup luksHeaderBackup and its SHA-256 compared with the
+header_sha256 custom metadata of the key, which requires kv_version = "2". The command exits
+non-zero when they differ.
+
+Adding or removing keyslots or persisting open flags also changes the header. After such an
+intended change, record the new checksum with --update.
+
+With --key, the fingerprint of the key stored in Vault is recomputed and compared with the
+key_fingerprint recorded when it was stored, confirming that Vault still holds the key the
+device was formatted with. The fingerprint is printed; the key never is.`,
+	Example: `  vault-dm-crypt verify --header 12345678-1234-1234-1234-123456789abc
+  vault-dm-crypt verify --header --update 12345678-1234-1234-1234-123456789abc
+  vault-dm-crypt verify --key 12345678-1234-1234-1234-123456789abc`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		update, _ := cmd.Flags().GetBool("update")
+		checkKey, _ := cmd.Flags().GetBool("key")
+		profileFlag, _ := cmd.Flags().GetString("profile")
+
+		uuid, err := parseDeviceUUID(args[0])
+		if err != nil {
+			return err
+		}
+
+		var profile *config.DeviceConfig
+		if profileFlag != "" {
+			if profile, err = cfg.DeviceProfileByName(profileFlag); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		if checkKey {
+			fingerprint, err := verifyStoredKeyFingerprint(ctx, storeForProfile(profile), uuid, profile)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Key stored for %s matches its recorded fingerprint %s\n", uuid, fingerprint)
+			return nil
+		}
+
+		device, err := findDeviceByUUID(uuid)
+		if err != nil {
+			return err
+		}
+
+		if update {
+			vaultPath, err := headerChecksumPath(uuid, profile)
+			if err != nil {
+				return err
+			}
+			checksum, err := dmcryptManager.HeaderChecksum(device)
+			if err != nil {
+				return err
+			}
+			if err := vaultClient.UpdateCustomMetadata(ctx, vaultPath, map[string]string{headerChecksumKey: checksum}); err != nil {
+				return fmt.Errorf("failed to record header checksum: %w", err)
+			}
+			fmt.Printf("Recorded LUKS header checksum of %s: %s\n", device, checksum)
+			return nil
+		}
+
+		if err := verifyHeaderChecksum(ctx, vaultClient, dmcryptManager, uuid, device, profile); err != nil {
+			return err
+		}
+		fmt.Printf("LUKS header of %s matches the recorded checksum\n", device)
+		return nil
+	},
+}
+
+func init() {
+	verifyCmd.Flags().Bool("header", false, "compare the LUKS header with the checksum recorded in Vault")
+	verifyCmd.Flags().Bool("update", false, "record the current header checksum instead of comparing, after an intended header change")
+	verifyCmd.Flags().Bool("key", false, "compare the fingerprint of the key stored in Vault with the one recorded when it was stored")
+	verifyCmd.Flags().String("profile", "", "read the checksum or key from the Vault location of this [[device]] profile")
+	verifyCmd.MarkFlagsOneRequired("header", "key")
+	verifyCmd.MarkFlagsMutuallyExclusive("header", "key")
+	verifyCmd.MarkFlagsMutuallyExclusive("key", "update")
+
+	rootCmd.AddCommand(verifyCmd)
+}
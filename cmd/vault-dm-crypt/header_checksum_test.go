@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeHeaderHasher struct {
+	checksum string
+}
+
+func (f *fakeHeaderHasher) HeaderChecksum(devicePath string) (string, error) {
+	return f.checksum, nil
+}
+
+func TestHeaderChecksum(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Vault.KVVersion = "2"
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	ctx := context.Background()
+	store := &fakeMappingNameStore{metadata: make(map[string]map[string]string)}
+	hasher := &fakeHeaderHasher{checksum: "aaaa"}
+
+	err := verifyHeaderChecksum(ctx, store, hasher, uuid, "/dev/sdb", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no header checksum is recorded")
+
+	recordHeaderChecksum(ctx, store, hasher, uuid, "/dev/sdb", nil)
+	assert.Equal(t, "aaaa", store.metadata["vault-dm-crypt/node1/"+uuid][headerChecksumKey])
+	require.NoError(t, verifyHeaderChecksum(ctx, store, hasher, uuid, "/dev/sdb", nil))
+
+	hasher.checksum = "bbbb"
+	err = verifyHeaderChecksum(ctx, store, hasher, uuid, "/dev/sdb", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match")
+
+	t.Run("kv v1", func(t *testing.T) {
+		cfg.Vault.KVVersion = "1"
+		t.Cleanup(func() { cfg.Vault.KVVersion = "2" })
+
+		err := verifyHeaderChecksum(ctx, store, hasher, uuid, "/dev/sdb", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "kv_version")
+	})
+}
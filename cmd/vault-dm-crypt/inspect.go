@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <device>",
+	Short: "Show the LUKS header metadata of a device, without Vault or a key",
+	Long: `Read the LUKS header of a device or image file and show its UUID, version, label, cipher,
+keyslots and LUKS2 tokens, including any token left by a Vault integration.
+
+Only the header is read with cryptsetup luksDump: no key is needed, nothing is opened or
+written, and neither a configuration file nor Vault is used, so it can be run on a disk
+pulled from another host.
+
+The UUID is looked up among this host's devices and reported as:
+  this-device   the UUID belongs to the inspected device only
+  conflict      another device on this host has the same UUID, so decrypt would be ambiguous
+  absent        no device on this host has the UUID, e.g. for an image file`,
+	Example: `  vault-dm-crypt inspect /dev/sdb1
+  vault-dm-crypt inspect --output json disk.img`,
+	Args: cobra.ExactArgs(1),
+	// Inspecting a header needs neither a config file nor Vault access
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if debug {
+			logger.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		output, _ := cmd.Flags().GetString("output")
+		if output != "text" && output != "json" {
+			return fmt.Errorf("invalid --output %q: must be text or json", output)
+		}
+
+		report, err := inspectDevice(dmcrypt.NewLUKSManager(logger), args[0], findDeviceByUUID)
+		if err != nil {
+			return err
+		}
+		return writeInspectReport(os.Stdout, report, output)
+	},
+}
+
+// How the inspected UUID relates to this host's devices
+const (
+	inspectLocalThisDevice = "this-device"
+	inspectLocalConflict   = "conflict"
+	inspectLocalAbsent     = "absent"
+)
+
+// headerInspector is the subset of the LUKS manager used by inspect
+type headerInspector interface {
+	InspectHeader(devicePath string) (*dmcrypt.HeaderInfo, error)
+}
+
+// inspectReport is the header of the inspected device and how its UUID matches local devices
+type inspectReport struct {
+	Device string `json:"device"`
+	*dmcrypt.HeaderInfo
+	Local       string `json:"local"`
+	LocalDevice string `json:"local_device,omitempty"` // The other device with the UUID, for conflict
+}
+
+// inspectDevice reads the header of device and cross-references its UUID with findDevice
+func inspectDevice(inspector headerInspector, device string, findDevice func(uuid string) (string, error)) (*inspectReport, error) {
+	header, err := inspector.InspectHeader(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", device, err)
+	}
+
+	report := &inspectReport{Device: device, HeaderInfo: header, Local: inspectLocalAbsent}
+	if header.UUID == "" {
+		return report, nil
+	}
+
+	local, err := findDevice(header.UUID)
+	if err != nil {
+		return report, nil
+	}
+	if dmcrypt.ResolveDevicePath(local) == dmcrypt.ResolveDevicePath(device) {
+		report.Local = inspectLocalThisDevice
+	} else {
+		report.Local = inspectLocalConflict
+		report.LocalDevice = local
+	}
+	return report, nil
+}
+
+// writeInspectReport writes report to w as text or JSON
+func writeInspectReport(w io.Writer, report *inspectReport, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Device:\t%s\n", report.Device)
+	fmt.Fprintf(tw, "UUID:\t%s\n", dashIfEmpty(report.UUID))
+	fmt.Fprintf(tw, "Version:\tLUKS%s\n", report.Version)
+	fmt.Fprintf(tw, "Label:\t%s\n", dashIfEmpty(report.Label))
+	fmt.Fprintf(tw, "Subsystem:\t%s\n", dashIfEmpty(report.Subsystem))
+	fmt.Fprintf(tw, "Cipher:\t%s\n", dashIfEmpty(report.Cipher))
+
+	switch report.Local {
+	case inspectLocalThisDevice:
+		fmt.Fprintf(tw, "Local:\t%s (no other device on this host has this UUID)\n", report.Local)
+	case inspectLocalConflict:
+		fmt.Fprintf(tw, "Local:\t%s (%s on this host has the same UUID)\n", report.Local, report.LocalDevice)
+	default:
+		fmt.Fprintf(tw, "Local:\t%s (no device on this host has this UUID)\n", report.Local)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nKeyslots: %d\n", len(report.Keyslots))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, slot := range report.Keyslots {
+		keyBits := "-"
+		if slot.KeyBits > 0 {
+			keyBits = fmt.Sprintf("%d bits", slot.KeyBits)
+		}
+		fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\n", slot.ID, dashIfEmpty(slot.Type), keyBits, dashIfEmpty(string(slot.Priority)))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nTokens: %d\n", len(report.Tokens))
+	for _, token := range report.Tokens {
+		slots := make([]string, 0, len(token.Keyslots))
+		for _, slot := range token.Keyslots {
+			slots = append(slots, strconv.Itoa(slot))
+		}
+		note := ""
+		if token.IsVault() {
+			note = " (Vault)"
+		}
+		fmt.Fprintf(w, "  %d: %s%s, keyslots %s\n", token.ID, token.Type, note, dashIfEmpty(strings.Join(slots, ",")))
+
+		names := make([]string, 0, len(token.Fields))
+		for name := range token.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "      %s: %v\n", name, token.Fields[name])
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	inspectCmd.Flags().String("output", "text", "output format: text or json")
+
+	rootCmd.AddCommand(inspectCmd)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// fakeHeaderInspector returns a fixed header
+type fakeHeaderInspector struct {
+	header *dmcrypt.HeaderInfo
+	err    error
+}
+
+func (f *fakeHeaderInspector) InspectHeader(devicePath string) (*dmcrypt.HeaderInfo, error) {
+	return f.header, f.err
+}
+
+func newTestHeader() *dmcrypt.HeaderInfo {
+	return &dmcrypt.HeaderInfo{
+		Version: "2",
+		UUID:    "3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15",
+		Label:   "db-data",
+		Cipher:  "aes-xts-plain64",
+		Keyslots: []dmcrypt.KeyslotInfo{
+			{ID: 0, Type: "luks2", KeyBits: 512, Priority: dmcrypt.KeyslotPriorityPrefer},
+			{ID: 1, Type: "luks2", KeyBits: 512, Priority: dmcrypt.KeyslotPriorityNormal},
+		},
+		Tokens: []dmcrypt.TokenInfo{
+			{ID: 0, Type: "vault-dm-crypt", Keyslots: []int{0}, Fields: map[string]interface{}{"vault_path": "vault-dm-crypt/node1/3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15"}},
+		},
+	}
+}
+
+func TestInspectDevice(t *testing.T) {
+	inspector := &fakeHeaderInspector{header: newTestHeader()}
+
+	tests := []struct {
+		name        string
+		findDevice  func(uuid string) (string, error)
+		local       string
+		localDevice string
+	}{
+		{
+			name:       "uuid belongs to the inspected device",
+			findDevice: func(uuid string) (string, error) { return "/dev/sdb1", nil },
+			local:      inspectLocalThisDevice,
+		},
+		{
+			name:        "another local device has the uuid",
+			findDevice:  func(uuid string) (string, error) { return "/dev/sdc1", nil },
+			local:       inspectLocalConflict,
+			localDevice: "/dev/sdc1",
+		},
+		{
+			name:       "uuid not on this host",
+			findDevice: func(uuid string) (string, error) { return "", &deviceNotFoundError{uuid: uuid} },
+			local:      inspectLocalAbsent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := inspectDevice(inspector, "/dev/sdb1", tt.findDevice)
+			require.NoError(t, err)
+			assert.Equal(t, "/dev/sdb1", report.Device)
+			assert.Equal(t, tt.local, report.Local)
+			assert.Equal(t, tt.localDevice, report.LocalDevice)
+		})
+	}
+
+	t.Run("inspect failure", func(t *testing.T) {
+		_, err := inspectDevice(&fakeHeaderInspector{err: fmt.Errorf("device is not LUKS-formatted")}, "/dev/sdd", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to inspect /dev/sdd")
+	})
+}
+
+func TestWriteInspectReport(t *testing.T) {
+	report := &inspectReport{Device: "/dev/sdb1", HeaderInfo: newTestHeader(), Local: inspectLocalConflict, LocalDevice: "/dev/sdc1"}
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeInspectReport(&buf, report, "text"))
+
+		out := buf.String()
+		assert.Contains(t, out, "UUID:       3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15\n")
+		assert.Contains(t, out, "Version:    LUKS2\n")
+		assert.Contains(t, out, "Subsystem:  -\n")
+		assert.Contains(t, out, "Local:      conflict (/dev/sdc1 on this host has the same UUID)\n")
+		assert.Contains(t, out, "Keyslots: 2\n")
+		assert.Contains(t, out, "  0  luks2  512 bits  prefer\n")
+		assert.Contains(t, out, "Tokens: 1\n  0: vault-dm-crypt (Vault), keyslots 0\n")
+		assert.Contains(t, out, "      vault_path: vault-dm-crypt/node1/3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15\n")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeInspectReport(&buf, report, "json"))
+
+		var decoded map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, "/dev/sdb1", decoded["device"])
+		assert.Equal(t, "3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15", decoded["uuid"])
+		assert.Equal(t, "aes-xts-plain64", decoded["cipher"])
+		assert.Equal(t, "conflict", decoded["local"])
+		assert.Equal(t, "/dev/sdc1", decoded["local_device"])
+		assert.Len(t, decoded["keyslots"], 2)
+
+		tokens := decoded["tokens"].([]interface{})
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "vault-dm-crypt", tokens[0].(map[string]interface{})["type"])
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/systemd"
+)
+
+var installSystemdCmd = &cobra.Command{
+	Use:   "install-systemd",
+	Short: "Install the systemd units for automatic decryption",
+	Long: `Install the systemd units shipped with vault-dm-crypt.
+
+By default the units are written to /etc/systemd/system and systemd is reloaded.
+
+With --output-dir the units are rendered into the given directory instead, without
+touching the running system or calling daemon-reload. Combine with --enable to add
+multi-user.target.wants/ links for specific device UUIDs, e.g. when baking
+auto-decrypt units into an image at build time.`,
+	Args: cobra.NoArgs,
+	// Installing units needs neither a config file nor Vault access
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if debug {
+			logger.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		outputDir, _ := cmd.Flags().GetString("output-dir")
+		binaryPath, _ := cmd.Flags().GetString("binary-path")
+		enableUUIDs, _ := cmd.Flags().GetStringSlice("enable")
+		secretIDCredential, _ := cmd.Flags().GetString("secret-id-credential")
+
+		manager := systemd.NewManager(logger)
+		opts := systemd.UnitOptions{
+			BinaryPath:         binaryPath,
+			SecretIDCredential: secretIDCredential,
+		}
+
+		if outputDir != "" {
+			written, err := manager.WriteUnits(outputDir, opts, enableUUIDs)
+			if err != nil {
+				return fmt.Errorf("failed to write systemd units: %w", err)
+			}
+
+			for _, path := range written {
+				fmt.Println(path)
+			}
+			return nil
+		}
+
+		if err := manager.InstallUnits(opts); err != nil {
+			return fmt.Errorf("failed to install systemd units: %w", err)
+		}
+
+		for _, uuid := range enableUUIDs {
+			if err := manager.EnableDecryptService(uuid); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Systemd units installed to %s\n", systemd.UnitDir)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(installSystemdCmd)
+
+	installSystemdCmd.Flags().String("output-dir", "", "render units into this directory instead of installing them on the running system")
+	installSystemdCmd.Flags().String("binary-path", systemd.DefaultBinaryPath, "path to the vault-dm-crypt binary referenced by the units")
+	installSystemdCmd.Flags().StringSlice("enable", nil, "device UUID(s) to enable automatic decryption for")
+	installSystemdCmd.Flags().String("secret-id-credential", "", "emit LoadCredential= for this systemd credential name (see [vault] secret_id_credential)")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// integrityWipeDir holds the progress of integrity wipes, one file per device UUID
+var integrityWipeDir = "/var/lib/vault-dm-crypt/integrity-wipe"
+
+// integrityWipeState is what encrypt --resume-wipe needs to finish an interrupted integrity wipe
+type integrityWipeState struct {
+	Device     string `json:"device"`
+	Mapping    string `json:"mapping"`
+	Filesystem string `json:"filesystem,omitempty"` // Filesystem to create once the wipe completes
+	Force      bool   `json:"force,omitempty"`
+	Profile    string `json:"profile,omitempty"` // [[device]] profile recorded in the boot decrypt service
+	// BootPriority is the encrypt --boot-priority to apply to the boot decrypt service, if any
+	BootPriority *int  `json:"boot_priority,omitempty"`
+	Size         int64 `json:"size"`
+	Done         int64 `json:"done"` // Bytes wiped and synced
+}
+
+// mappingWiper is the subset of the LUKS manager used to wipe a mapping
+type mappingWiper interface {
+	WipeMapping(mappedPath string, from int64, progress dmcrypt.WipeProgressFunc) error
+	GetMappedDevicePath(deviceName string) string
+}
+
+func integrityWipeStatePath(uuid string) string {
+	return filepath.Join(integrityWipeDir, uuid+".json")
+}
+
+// loadIntegrityWipeState reads the wipe progress recorded for uuid
+func loadIntegrityWipeState(uuid string) (*integrityWipeState, error) {
+	data, err := os.ReadFile(integrityWipeStatePath(uuid))
+	if err != nil {
+		if stderrors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no interrupted integrity wipe is recorded for UUID %s", uuid)
+		}
+		return nil, fmt.Errorf("failed to read integrity wipe state: %w", err)
+	}
+
+	var state integrityWipeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse integrity wipe state %s: %w", integrityWipeStatePath(uuid), err)
+	}
+	return &state, nil
+}
+
+// save writes the state file for uuid atomically
+func (s *integrityWipeState) save(uuid string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(integrityWipeDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(integrityWipeDir, ".wipe-*")
+	if err != nil {
+		return fmt.Errorf("failed to write integrity wipe state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write integrity wipe state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write integrity wipe state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), integrityWipeStatePath(uuid)); err != nil {
+		return fmt.Errorf("failed to write integrity wipe state: %w", err)
+	}
+	return nil
+}
+
+// runIntegrityWipe zeroes the mapping recorded in state from state.Done onwards, saving progress
+// after each chunk so that encrypt --resume-wipe can continue after an interruption. The state
+// file is removed once the wipe completes.
+func runIntegrityWipe(wiper mappingWiper, uuid string, state *integrityWipeState) error {
+	if err := state.save(uuid); err != nil {
+		return err
+	}
+
+	progress := func(done, size int64) error {
+		state.Done, state.Size = done, size
+		return state.save(uuid)
+	}
+
+	if err := wiper.WipeMapping(wiper.GetMappedDevicePath(state.Mapping), state.Done, progress); err != nil {
+		logger.WithFields(logrus.Fields{
+			"uuid":  uuid,
+			"done":  state.Done,
+			"size":  state.Size,
+			"state": integrityWipeStatePath(uuid),
+		}).Error("Integrity wipe interrupted")
+		return fmt.Errorf("integrity wipe of %s did not complete: %w. Reopen the device with 'vault-dm-crypt decrypt %s' if it was closed, then continue with 'vault-dm-crypt encrypt --resume-wipe %s'", state.Device, err, uuid, uuid)
+	}
+
+	if err := os.Remove(integrityWipeStatePath(uuid)); err != nil && !stderrors.Is(err, os.ErrNotExist) {
+		logger.WithError(err).Warn("Failed to remove integrity wipe state")
+	}
+	return nil
+}
+
+// runResumeWipe continues an interrupted integrity wipe of an opened device, then finishes the
+// steps of encrypt that follow it, as completeEncrypt does for an uninterrupted encrypt
+func runResumeWipe(parent context.Context, summary *operationSummary, requested string, verifyAfter bool) error {
+	uuidStr, err := parseDeviceUUID(requested)
+	if err != nil {
+		return err
+	}
+	summary.UUID = uuidStr
+
+	opLock, err := acquireOperationLock(uuidStr)
+	if err != nil {
+		return err
+	}
+	defer releaseOperationLock(opLock)
+
+	state, err := loadIntegrityWipeState(uuidStr)
+	if err != nil {
+		return err
+	}
+	summary.Device = state.Device
+	summary.Mapping = state.Mapping
+
+	if _, err := dmcryptManager.GetMappingDevice(state.Mapping); err != nil {
+		return fmt.Errorf("mapping %s is not open, run 'vault-dm-crypt decrypt %s' first: %w", state.Mapping, uuidStr, err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid": uuidStr,
+		"done": state.Done,
+		"size": state.Size,
+	}).Info("Resuming integrity wipe")
+
+	// Later steps need these after the state file is removed
+	target := &encryptTarget{
+		Device:       state.Device,
+		Force:        state.Force,
+		Filesystem:   state.Filesystem,
+		BootPriority: state.BootPriority,
+	}
+	if state.Profile != "" {
+		if target.Profile, err = cfg.DeviceProfileByName(state.Profile); err != nil {
+			return err
+		}
+	}
+
+	// The key generated by the interrupted encrypt is gone, so the round trip reopens the device
+	// with the key and options stored in Vault, as boot-time decrypt will
+	var key string
+	var check *roundTripCheck
+	if verifyAfter {
+		ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+		store := storeForProfile(target.Profile)
+		var record keyRecord
+		key, record, err = loadStoredKey(ctx, store, uuidStr, target.Profile, true)
+		cancel()
+		if err != nil {
+			return err
+		}
+		defer dmcryptManager.SecureEraseKey(&key)
+		recordKeyFingerprint(parent, summary, key)
+
+		vaultPath, err := cfg.VaultForProfile(target.Profile).SecretPath(uuidStr)
+		if err != nil {
+			return err
+		}
+		check = &roundTripCheck{store: store, vaultPath: vaultPath}
+		target.OpenOpts = record.OpenOpts
+		target.OpenOpts.Persistent = cfg.LUKS.PersistentFlags
+	}
+
+	if err := runIntegrityWipe(dmcryptManager, uuidStr, state); err != nil {
+		return err
+	}
+
+	mappedDevice, err := completeEncrypt(parent, target, uuidStr, key, state.Mapping, check)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Integrity wipe completed:\n")
+	fmt.Printf("  UUID: %s\n", uuidStr)
+	fmt.Printf("  Mapped device: %s\n", mappedDevice)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+type fakeWiper struct {
+	size   int64
+	failAt int64 // Fail once this many bytes are wiped, if set
+	from   int64
+}
+
+func (f *fakeWiper) WipeMapping(mappedPath string, from int64, progress dmcrypt.WipeProgressFunc) error {
+	f.from = from
+	for done := from + 1024; ; done += 1024 {
+		done = min(done, f.size)
+		if f.failAt != 0 && done > f.failAt {
+			return errors.New("input/output error")
+		}
+		if err := progress(done, f.size); err != nil {
+			return err
+		}
+		if done == f.size {
+			return nil
+		}
+	}
+}
+
+func (f *fakeWiper) GetMappedDevicePath(deviceName string) string {
+	return "/dev/mapper/" + deviceName
+}
+
+func useIntegrityWipeTestDir(t *testing.T) {
+	t.Helper()
+	original := integrityWipeDir
+	t.Cleanup(func() { integrityWipeDir = original })
+	integrityWipeDir = t.TempDir()
+}
+
+func TestRunIntegrityWipe(t *testing.T) {
+	useEncryptTestConfig(t)
+	useIntegrityWipeTestDir(t)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+
+	t.Run("interrupted wipe can be resumed", func(t *testing.T) {
+		state := &integrityWipeState{Device: "/dev/sdb", Mapping: "data", Filesystem: "ext4"}
+		err := runIntegrityWipe(&fakeWiper{size: 4096, failAt: 2048}, uuid, state)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "encrypt --resume-wipe "+uuid)
+
+		saved, err := loadIntegrityWipeState(uuid)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2048), saved.Done)
+		assert.Equal(t, int64(4096), saved.Size)
+		assert.Equal(t, "ext4", saved.Filesystem)
+
+		wiper := &fakeWiper{size: 4096}
+		require.NoError(t, runIntegrityWipe(wiper, uuid, saved))
+		assert.Equal(t, int64(2048), wiper.from, "the wipe continues where it stopped")
+
+		_, err = os.Stat(integrityWipeStatePath(uuid))
+		assert.True(t, os.IsNotExist(err), "the state file is removed once the wipe completes")
+	})
+
+	t.Run("nothing recorded", func(t *testing.T) {
+		_, err := loadIntegrityWipeState(uuid)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no interrupted integrity wipe")
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// keyAge returns how long ago the key of secret was stored: since rotated_at for a key that
+// was rotated in place, otherwise since created_at. The boolean is false when neither holds a
+// valid timestamp.
+func keyAge(secret *vault.DeviceSecret, now time.Time) (time.Duration, bool) {
+	for _, value := range []string{secret.RotatedAt, secret.CreatedAt} {
+		if value == "" {
+			continue
+		}
+		stored, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			continue
+		}
+		return now.Sub(stored), true
+	}
+	return 0, false
+}
+
+// keyAgeWarning returns a reminder to rotate the key of uuid when it is older than maxAge, or ""
+// when it is not, its age is unknown or maxAge is 0
+func keyAgeWarning(uuid string, secret *vault.DeviceSecret, now time.Time, maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return ""
+	}
+
+	age, ok := keyAge(secret, now)
+	if !ok || age <= maxAge {
+		return ""
+	}
+	return fmt.Sprintf("key for %s is %d days old, consider rotating it", uuid, int(age/(24*time.Hour)))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+func TestKeyAgeWarning(t *testing.T) {
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	maxAge := 90 * 24 * time.Hour
+
+	t.Run("old key warns", func(t *testing.T) {
+		secret := &vault.DeviceSecret{CreatedAt: now.AddDate(0, 0, -104).Format(time.RFC3339)}
+		assert.Equal(t, "key for "+uuid+" is 104 days old, consider rotating it", keyAgeWarning(uuid, secret, now, maxAge))
+	})
+
+	t.Run("fresh key is quiet", func(t *testing.T) {
+		secret := &vault.DeviceSecret{CreatedAt: now.AddDate(0, 0, -10).Format(time.RFC3339)}
+		assert.Empty(t, keyAgeWarning(uuid, secret, now, maxAge))
+	})
+
+	t.Run("rotation resets the age", func(t *testing.T) {
+		secret := &vault.DeviceSecret{
+			CreatedAt: now.AddDate(-1, 0, 0).Format(time.RFC3339),
+			RotatedAt: now.AddDate(0, 0, -5).Format(time.RFC3339),
+		}
+		assert.Empty(t, keyAgeWarning(uuid, secret, now, maxAge))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		secret := &vault.DeviceSecret{CreatedAt: now.AddDate(-2, 0, 0).Format(time.RFC3339)}
+		assert.Empty(t, keyAgeWarning(uuid, secret, now, 0))
+	})
+
+	t.Run("unknown age", func(t *testing.T) {
+		assert.Empty(t, keyAgeWarning(uuid, &vault.DeviceSecret{}, now, maxAge))
+		assert.Empty(t, keyAgeWarning(uuid, &vault.DeviceSecret{CreatedAt: "yesterday"}, now, maxAge))
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// keyFingerprintField records the fingerprint of the device key with it, so that a key can be
+// matched across logs, audit trails and Vault without exposing it
+const keyFingerprintField = "key_fingerprint"
+
+// keyFingerprintBytes is how much of the SHA-256 of a key its fingerprint keeps
+const keyFingerprintBytes = 16
+
+// keyFingerprint returns a non-reversible fingerprint of key: the first 128 bits of its SHA-256,
+// hex encoded with a "sha256:" prefix. The same key always has the same fingerprint.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:keyFingerprintBytes])
+}
+
+// recordKeyFingerprint adds the fingerprint of key to the operation summary and to the trace
+// span in ctx: the command's span, or the device's own span when --from-file handles several
+func recordKeyFingerprint(ctx context.Context, summary *operationSummary, key string) {
+	fingerprint := keyFingerprint(key)
+	summary.KeyFingerprint = fingerprint
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("key.fingerprint", fingerprint))
+}
+
+// checkKeyFingerprint compares the fingerprint of key, read back from Vault, with the one
+// recorded in secret when it was stored. Keys stored before fingerprints were recorded pass.
+func checkKeyFingerprint(key, uuid string, secret *vault.DeviceSecret) error {
+	if secret.KeyFingerprint == "" {
+		return nil
+	}
+
+	if current := keyFingerprint(key); current != secret.KeyFingerprint {
+		return fmt.Errorf("the key stored for %s has fingerprint %s but %s was recorded when it was stored; "+
+			"it is not the key the device was formatted with", uuid, current, secret.KeyFingerprint)
+	}
+	return nil
+}
+
+// verifyStoredKeyFingerprint reads the key stored for uuid, from the location of profile if one
+// is given, and checks it against its recorded fingerprint, which it returns
+func verifyStoredKeyFingerprint(ctx context.Context, store secretReader, uuid string, profile *config.DeviceConfig) (string, error) {
+	vaultConfig := cfg.VaultForProfile(profile)
+	vaultPath, err := vaultConfig.SecretPath(uuid)
+	if err != nil {
+		return "", err
+	}
+
+	secretData, err := store.ReadSecretVersion(ctx, vaultPath, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve key from Vault: %w", err)
+	}
+
+	secret, err := vault.DecodeDeviceSecret(secretData)
+	if err != nil {
+		return "", err
+	}
+	if secret.KeyFingerprint == "" {
+		return "", fmt.Errorf("no key fingerprint is recorded for %s; keys stored by older releases have none", uuid)
+	}
+
+	key, err := deviceKeyFromSecret(secretData, uuid, vaultConfig.KeyFieldNames())
+	if err != nil {
+		return "", err
+	}
+	if err := checkKeyFingerprint(key, uuid, secret); err != nil {
+		return "", err
+	}
+	return secret.KeyFingerprint, nil
+}
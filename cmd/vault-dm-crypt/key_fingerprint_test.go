@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	fingerprint := keyFingerprint(key)
+	assert.Equal(t, fingerprint, keyFingerprint(key), "fingerprint must be deterministic")
+	assert.Equal(t, "sha256:3bded9423d40a742035c6020996cfc80", fingerprint)
+	assert.NotEqual(t, fingerprint, keyFingerprint("b3RoZXIta2V5"))
+	assert.NotContains(t, fingerprint, key)
+}
+
+func TestOperationSummaryKeyFingerprint(t *testing.T) {
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	summary := newOperationSummary("encrypt")
+	summary.UUID = "12345678-1234-1234-1234-123456789abc"
+	recorder := tracetest.NewSpanRecorder()
+	ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "encrypt /dev/sdb")
+	recordKeyFingerprint(ctx, summary, key)
+	span.End()
+
+	require.Len(t, recorder.Ended(), 1)
+	assert.Contains(t, recorder.Ended()[0].Attributes(), attribute.String("key.fingerprint", keyFingerprint(key)),
+		"the fingerprint belongs to the span of the device it was recorded for")
+
+	fields := summary.fields(nil)
+	assert.Equal(t, keyFingerprint(key), fields["key_fingerprint"])
+	for name, value := range fields {
+		assert.NotContains(t, fmt.Sprint(value), key, "field %s exposes the key", name)
+	}
+
+	event := summary.event(fields)
+	assert.Equal(t, keyFingerprint(key), event.KeyFingerprint)
+}
+
+func TestVerifyStoredKeyFingerprint(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	t.Run("matching key", func(t *testing.T) {
+		reader := &fakeSecretReader{data: map[string]interface{}{"dmcrypt_key": key, "key_fingerprint": keyFingerprint(key)}}
+		fingerprint, err := verifyStoredKeyFingerprint(context.Background(), reader, uuid, nil)
+		require.NoError(t, err)
+		assert.Equal(t, keyFingerprint(key), fingerprint)
+	})
+
+	t.Run("replaced key", func(t *testing.T) {
+		reader := &fakeSecretReader{data: map[string]interface{}{"dmcrypt_key": "b3RoZXIta2V5", "key_fingerprint": keyFingerprint(key)}}
+		_, err := verifyStoredKeyFingerprint(context.Background(), reader, uuid, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not the key the device was formatted with")
+		assert.NotContains(t, err.Error(), "b3RoZXIta2V5")
+	})
+
+	t.Run("no recorded fingerprint", func(t *testing.T) {
+		reader := &fakeSecretReader{data: map[string]interface{}{"dmcrypt_key": key}}
+		_, err := verifyStoredKeyFingerprint(context.Background(), reader, uuid, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no key fingerprint is recorded")
+	})
+
+	t.Run("no stored key", func(t *testing.T) {
+		reader := &fakeSecretReader{err: vault.ErrSecretNotFound}
+		_, err := verifyStoredKeyFingerprint(context.Background(), reader, uuid, nil)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, vault.ErrSecretNotFound)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+var keyHistoryCmd = &cobra.Command{
+	Use:   "key-history <uuid>",
+	Short: "List the stored key versions for a device",
+	Long: `List the KV v2 versions of the key stored in Vault for a device UUID.
+
+Each version shows when it was created and whether it has been deleted or destroyed.
+A previous version can be used to recover with 'decrypt --secret-version <n>'.
+
+Requires kv_version = "2".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		uuid := args[0]
+
+		profile, err := profileFromFlag(cmd)
+		if err != nil {
+			return err
+		}
+		vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuid)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		store := storeForProfile(profile)
+		var versions []vault.SecretVersion
+		err = store.WithRetry(ctx, func() error {
+			var err error
+			versions, err = store.ListSecretVersions(ctx, vaultPath)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read key history from Vault: %w", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tCREATED\tSTATUS")
+		for _, v := range versions {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", v.Version, v.CreatedTime.Format(time.RFC3339), versionStatus(v))
+		}
+		return w.Flush()
+	},
+}
+
+// versionStatus summarises the state of a key version
+func versionStatus(v vault.SecretVersion) string {
+	switch {
+	case v.Destroyed:
+		return "destroyed"
+	case !v.DeletionTime.IsZero():
+		return "deleted " + v.DeletionTime.Format(time.RFC3339)
+	case v.Current:
+		return "current"
+	default:
+		return "available"
+	}
+}
+
+func init() {
+	keyHistoryCmd.Flags().String("profile", "", "read the key history from the Vault location of this [[device]] profile")
+
+	rootCmd.AddCommand(keyHistoryCmd)
+}
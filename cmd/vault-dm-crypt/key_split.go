@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"digitalisio/vault-dm-crypt/internal/keysplit"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// keySplitField records in Vault which scheme split the stored key, so that decrypt knows to
+// recombine it with the local share whatever the current configuration says
+const keySplitField = "key_split"
+
+// splitKey splits key with the configured [security] key_split scheme and writes the local share
+// for uuid. It returns the share to store in Vault in place of the key and the path of the local
+// share, or the key unchanged when splitting is disabled.
+func splitKey(uuid, key string) (vaultShare, sharePath string, err error) {
+	if cfg.Security.KeySplit == "" {
+		return key, "", nil
+	}
+
+	vaultShare, localShare, err := keysplit.Split(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	sharePath = keysplit.SharePath(cfg.Security.KeySplitDir, uuid)
+	if err := keysplit.WriteShare(sharePath, localShare); err != nil {
+		return "", "", err
+	}
+
+	logger.WithField("share_path", sharePath).Info("Wrote local key share")
+	return vaultShare, sharePath, nil
+}
+
+// deviceKeyFromSecret extracts the key for uuid from stored secret data, recombining it with
+// the local share if it was stored split. The data is decoded with vault.DecodeDeviceSecret, so
+// secrets stored with older schemas are read the same way as current ones.
+func deviceKeyFromSecret(secretData map[string]interface{}, uuid string, fields []string) (string, error) {
+	secret, err := vault.DecodeDeviceSecret(secretData)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := keyFromSecret(secretData, secret, fields)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := secret.KeySplit
+	switch scheme {
+	case "":
+		return key, nil
+	case keysplit.SchemeXOR:
+	default:
+		return "", fmt.Errorf("unsupported key split scheme %q", scheme)
+	}
+
+	if cfg.Security.KeySplitDir == "" {
+		return "", fmt.Errorf("the key for %s is split but [security] key_split_dir is not set", uuid)
+	}
+
+	sharePath := keysplit.SharePath(cfg.Security.KeySplitDir, uuid)
+	localShare, err := keysplit.ReadShare(sharePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read local key share: %w", err)
+	}
+
+	logger.WithField("share_path", sharePath).Debug("Recombining split key")
+	return keysplit.Combine(key, localShare)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/keysplit"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+func TestSplitKeyRoundTrip(t *testing.T) {
+	originalCfg := cfg
+	defer func() { cfg = originalCfg }()
+
+	cfg = config.DefaultConfig()
+	cfg.Security.KeySplit = keysplit.SchemeXOR
+	cfg.Security.KeySplitDir = t.TempDir()
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	vaultShare, sharePath, err := splitKey(uuid, key)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, vaultShare)
+	assert.Equal(t, keysplit.SharePath(cfg.Security.KeySplitDir, uuid), sharePath)
+
+	secretData := map[string]interface{}{
+		"dmcrypt_key": vaultShare,
+		keySplitField: keysplit.SchemeXOR,
+	}
+
+	t.Run("recombines with local share", func(t *testing.T) {
+		got, err := deviceKeyFromSecret(secretData, uuid, []string{"dmcrypt_key"})
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+	})
+
+	t.Run("missing local share", func(t *testing.T) {
+		require.NoError(t, os.Remove(sharePath))
+
+		_, err := deviceKeyFromSecret(secretData, uuid, []string{"dmcrypt_key"})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, keysplit.ErrMissingShare))
+	})
+
+	t.Run("unsplit keys are returned as stored", func(t *testing.T) {
+		got, err := deviceKeyFromSecret(map[string]interface{}{"dmcrypt_key": key}, uuid, []string{"dmcrypt_key"})
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+	})
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		_, err := deviceKeyFromSecret(map[string]interface{}{"dmcrypt_key": key, keySplitField: "shamir"}, uuid, []string{"dmcrypt_key"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported key split scheme")
+	})
+
+	t.Run("secret from a newer release", func(t *testing.T) {
+		_, err := deviceKeyFromSecret(map[string]interface{}{"dmcrypt_key": key, vault.SchemaVersionField: vault.CurrentSchemaVersion + 1}, uuid, []string{"dmcrypt_key"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "upgrade vault-dm-crypt")
+	})
+}
+
+func TestSplitKeyDisabled(t *testing.T) {
+	originalCfg := cfg
+	defer func() { cfg = originalCfg }()
+	cfg = config.DefaultConfig()
+
+	stored, sharePath, err := splitKey("uuid-1", "a2V5")
+	require.NoError(t, err)
+	assert.Equal(t, "a2V5", stored)
+	assert.Empty(t, sharePath)
+}
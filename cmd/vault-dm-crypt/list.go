@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys stored in Vault for this host",
+	Long: `List every key stored under this host's Vault path with the device, hostname, LUKS2
+label and subsystem, and creation time recorded alongside it.
+
+--sort orders the entries by created_at (oldest first), device or hostname. --since keeps
+only entries created within the given duration and --older-than only those created before
+it, e.g. --older-than 2160h to find keys due for rotation.
+
+Keys stored under the backend or path_prefix of a [[device]] profile are listed too, with the
+name of the profile; --profile lists only the keys stored in that profile's location.
+
+Entries whose created_at is missing or cannot be parsed are flagged, sort after all other
+entries by created_at and are left out when --since or --older-than is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		sortBy, _ := cmd.Flags().GetString("sort")
+		since, _ := cmd.Flags().GetDuration("since")
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+
+		if err := validateListSort(sortBy); err != nil {
+			return err
+		}
+		if since < 0 || olderThan < 0 {
+			return fmt.Errorf("--since and --older-than must not be negative")
+		}
+
+		locations, err := vaultLocations(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		var entries []listEntry
+		for _, location := range locations {
+			basePath, err := location.Vault.SecretListPath()
+			if err != nil {
+				return err
+			}
+
+			located, err := listKeys(ctx, location.Store, basePath)
+			if err != nil {
+				return err
+			}
+			for i := range located {
+				located[i].Profile = profileName(location.Profile)
+			}
+			entries = append(entries, located...)
+		}
+
+		entries = filterListEntries(entries, time.Now(), since, olderThan)
+		sortListEntries(entries, sortBy)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tPROFILE\tDEVICE\tHOSTNAME\tLABEL\tSUBSYSTEM\tTAGS\tCREATED\tNOTE")
+		for _, e := range entries {
+			created := "-"
+			if e.HasCreatedAt {
+				created = e.CreatedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.UUID, dashIfEmpty(e.Profile), dashIfEmpty(e.Device), dashIfEmpty(e.Hostname),
+				dashIfEmpty(e.Label), dashIfEmpty(e.Subsystem), dashIfEmpty(formatTags(e.Tags)), created, e.Note)
+		}
+		return w.Flush()
+	},
+}
+
+// Orderings accepted by list --sort
+const (
+	listSortCreatedAt = "created_at"
+	listSortDevice    = "device"
+	listSortHostname  = "hostname"
+)
+
+// keyLister is the subset of the Vault client used by list
+type keyLister interface {
+	ListSecrets(ctx context.Context, path string) ([]string, error)
+	ReadSecret(ctx context.Context, path string) (map[string]interface{}, error)
+}
+
+// listEntry is the metadata stored with one key
+type listEntry struct {
+	UUID         string
+	Profile      string // [[device]] profile whose Vault location holds the key, if any
+	Device       string
+	Hostname     string
+	Label        string            // LUKS2 label recorded by encrypt --label, if any
+	Subsystem    string            // LUKS2 subsystem recorded by encrypt --subsystem, if any
+	Tags         map[string]string // Tags recorded by encrypt --tag, if any
+	CreatedAt    time.Time
+	HasCreatedAt bool   // False when created_at is missing or unparseable
+	Note         string // Why the entry is flagged, if it is
+}
+
+// listKeys reads the metadata of every key stored under basePath
+func listKeys(ctx context.Context, store keyLister, basePath string) ([]listEntry, error) {
+	uuids, err := store.ListSecrets(ctx, basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in Vault: %w", err)
+	}
+
+	entries := make([]listEntry, 0, len(uuids))
+	for _, uuid := range uuids {
+		entry := listEntry{UUID: uuid}
+
+		secretData, err := store.ReadSecret(ctx, fmt.Sprintf("%s/%s", basePath, uuid))
+		if err != nil {
+			entry.Note = fmt.Sprintf("unreadable: %v", err)
+			entries = append(entries, entry)
+			continue
+		}
+
+		secret, err := vault.DecodeDeviceSecret(secretData)
+		if err != nil {
+			entry.Note = fmt.Sprintf("unreadable: %v", err)
+			entries = append(entries, entry)
+			continue
+		}
+
+		entry.Device = secret.DevicePath()
+		entry.Hostname = secret.Hostname
+		entry.Label = secret.Label
+		entry.Subsystem = secret.Subsystem
+		entry.Tags = secret.Tags
+
+		createdAt := secret.CreatedAt
+		if createdAt == "" {
+			entry.Note = "missing created_at"
+		} else if parsed, err := time.Parse(time.RFC3339, createdAt); err != nil {
+			entry.Note = fmt.Sprintf("unparseable created_at %q", createdAt)
+		} else {
+			entry.CreatedAt = parsed
+			entry.HasCreatedAt = true
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// validateListSort checks a --sort value; empty keeps the order Vault lists the keys in
+func validateListSort(sortBy string) error {
+	switch sortBy {
+	case "", listSortCreatedAt, listSortDevice, listSortHostname:
+		return nil
+	default:
+		return fmt.Errorf("invalid --sort %q: must be %s, %s or %s", sortBy, listSortCreatedAt, listSortDevice, listSortHostname)
+	}
+}
+
+// filterListEntries keeps entries created within since of now and before olderThan ago; a zero
+// duration disables that bound. Entries without a usable created_at cannot satisfy either bound.
+func filterListEntries(entries []listEntry, now time.Time, since, olderThan time.Duration) []listEntry {
+	if since == 0 && olderThan == 0 {
+		return entries
+	}
+
+	filtered := make([]listEntry, 0, len(entries))
+	for _, e := range entries {
+		if !e.HasCreatedAt {
+			continue
+		}
+		age := now.Sub(e.CreatedAt)
+		if since > 0 && age > since {
+			continue
+		}
+		if olderThan > 0 && age <= olderThan {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+// sortListEntries orders entries in place by sortBy, breaking ties by UUID. When sorting by
+// created_at, entries without a usable timestamp go last.
+func sortListEntries(entries []listEntry, sortBy string) {
+	if sortBy == "" {
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch sortBy {
+		case listSortCreatedAt:
+			if a.HasCreatedAt != b.HasCreatedAt {
+				return a.HasCreatedAt
+			}
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		case listSortDevice:
+			if a.Device != b.Device {
+				return a.Device < b.Device
+			}
+		case listSortHostname:
+			if a.Hostname != b.Hostname {
+				return a.Hostname < b.Hostname
+			}
+		}
+		return a.UUID < b.UUID
+	})
+}
+
+func init() {
+	listCmd.Flags().String("sort", "", "Sort entries by created_at, device or hostname")
+	listCmd.Flags().Duration("since", 0, "Only list keys created within this duration, e.g. 24h")
+	listCmd.Flags().String("profile", "", "Only list keys stored in the Vault location of this [[device]] profile")
+	listCmd.Flags().Duration("older-than", 0, "Only list keys created longer ago than this duration, e.g. 2160h")
+
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+var listServicesCmd = &cobra.Command{
+	Use:   "list-services",
+	Short: "List decrypt units and report the ones whose device or key is gone",
+	Long: `List every vault-dm-crypt-decrypt@<uuid>.service unit and check that the device with
+that UUID is present on this host and that its key is still stored in Vault, in the [vault]
+location or that of any [[device]] profile.
+
+Units are reported as:
+  ok         the device exists and its key is stored in Vault
+  orphan     the device or its key no longer exists; the unit will fail on every boot
+  unknown    Vault or the host's devices could not be checked, e.g. because Vault is unreachable
+
+With --prune, orphaned units are disabled. Units reported as unknown are never disabled.
+
+With --prune-grace, a unit is only disabled once it has been reported orphaned for at least
+that long, so a device that is merely slow to appear at boot is not pruned. The time each unit
+was first seen orphaned is kept in ` + orphanStatePath + ` and updated on every run, so a unit
+that is healthy again starts over.`,
+	Example: `  vault-dm-crypt list-services
+  vault-dm-crypt list-services --prune --prune-grace 24h`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		prune, _ := cmd.Flags().GetBool("prune")
+		grace, _ := cmd.Flags().GetDuration("prune-grace")
+		if grace < 0 {
+			return fmt.Errorf("--prune-grace must not be negative")
+		}
+
+		locations, err := vaultLocations(cmd)
+		if err != nil {
+			return err
+		}
+
+		auditor := &serviceAuditor{
+			services:   systemdManager,
+			findDevice: findDeviceByUUID,
+			grace:      grace,
+		}
+		for _, location := range locations {
+			auditor.locations = append(auditor.locations, keyLocation{store: location.Store, secretPath: location.Vault.SecretPath})
+		}
+		// Every run keeps the state up to date, so a unit that is healthy again in a run without
+		// --prune-grace still starts its grace period over when it is next orphaned
+		orphans, err := loadOrphanTracker(orphanStatePath)
+		switch {
+		case err != nil && grace > 0:
+			return err
+		case err != nil:
+			logger.WithError(err).Warn("Failed to load orphaned unit state")
+		default:
+			auditor.orphans = orphans
+		}
+
+		entries, err := auditor.audit(cmd.Context(), prune)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UNIT\tUUID\tSTATUS\tDEVICE\tDETAIL")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Unit, e.UUID, e.Status, dashIfEmpty(e.Device), e.Detail)
+		}
+		return w.Flush()
+	},
+}
+
+// Unit statuses reported by list-services
+const (
+	serviceOK      = "ok"
+	serviceOrphan  = "orphan"
+	serviceUnknown = "unknown"
+)
+
+// decryptServiceManager is the subset of the systemd manager used by list-services
+type decryptServiceManager interface {
+	ListDecryptServices() ([]string, error)
+	DisableDecryptService(uuid string) error
+}
+
+// keyChecker is the subset of the Vault client used by list-services
+type keyChecker interface {
+	ReadSecret(ctx context.Context, path string) (map[string]interface{}, error)
+}
+
+// keyLocation is a Vault location list-services looks for a unit's key in
+type keyLocation struct {
+	store      keyChecker
+	secretPath func(uuid string) (string, error)
+}
+
+// serviceEntry is the audit result for one decrypt unit
+type serviceEntry struct {
+	Unit     string
+	UUID     string
+	Status   string
+	Device   string
+	Disabled bool
+	Detail   string
+}
+
+// serviceAuditor checks decrypt units against the host's devices and the keys stored in Vault
+type serviceAuditor struct {
+	services   decryptServiceManager
+	locations  []keyLocation // Where keys may be stored; a unit's key may be in any of them
+	findDevice func(uuid string) (string, error)
+
+	// grace is how long a unit must have been orphaned before it is pruned, tracked in orphans
+	grace   time.Duration
+	orphans *orphanTracker
+}
+
+// audit checks every decrypt unit and, with prune, disables the orphaned ones
+func (a *serviceAuditor) audit(ctx context.Context, prune bool) ([]serviceEntry, error) {
+	units, err := a.services.ListDecryptServices()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]serviceEntry, 0, len(units))
+	listed := make(map[string]bool, len(units))
+	for _, unit := range units {
+		entry := a.check(ctx, unit)
+		listed[entry.UUID] = true
+
+		if entry.Status == serviceOrphan && a.withinGrace(&entry) {
+			entries = append(entries, entry)
+			continue
+		}
+		if a.orphans != nil && entry.Status == serviceOK {
+			a.orphans.clear(entry.UUID)
+		}
+
+		if prune && entry.Status == serviceOrphan {
+			a.disable(&entry)
+			if entry.Disabled && a.orphans != nil {
+				a.orphans.clear(entry.UUID)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if a.orphans != nil {
+		a.orphans.retain(listed)
+		// Losing the state only restarts the grace period, so it does not fail the audit
+		if err := a.orphans.save(); err != nil {
+			logger.WithError(err).Warn("Failed to save orphaned unit state")
+		}
+	}
+
+	return entries, nil
+}
+
+// withinGrace records that an orphaned unit was seen and reports whether it has been orphaned
+// for less than the grace period, in which case it must not be pruned yet. Units reported as
+// unknown neither start nor reset the grace period.
+func (a *serviceAuditor) withinGrace(entry *serviceEntry) bool {
+	if a.orphans == nil {
+		return false
+	}
+
+	orphanedFor := a.orphans.observe(entry.UUID)
+	if orphanedFor >= a.grace {
+		return false
+	}
+
+	entry.Detail = fmt.Sprintf("%s; orphaned for %s, prunable after %s", entry.Detail, orphanedFor.Round(time.Second), a.grace)
+	return true
+}
+
+// check audits a single decrypt unit
+func (a *serviceAuditor) check(ctx context.Context, unit string) serviceEntry {
+	entry := serviceEntry{Unit: unit, UUID: decryptServiceUUID(unit)}
+
+	var missing []string
+	device, err := a.findDevice(entry.UUID)
+	switch {
+	case isDeviceNotFound(err):
+		missing = append(missing, "no device with this UUID on this host")
+	case err != nil:
+		entry.Status = serviceUnknown
+		entry.Detail = err.Error()
+		return entry
+	default:
+		entry.Device = device
+	}
+
+	found := false
+	for _, location := range a.locations {
+		path, err := location.secretPath(entry.UUID)
+		if err != nil {
+			entry.Status = serviceUnknown
+			entry.Detail = err.Error()
+			return entry
+		}
+
+		_, err = location.store.ReadSecret(ctx, path)
+		if err == nil {
+			found = true
+			break
+		}
+		if !stderrors.Is(err, vault.ErrSecretNotFound) {
+			entry.Status = serviceUnknown
+			entry.Detail = fmt.Sprintf("failed to check Vault: %v", err)
+			return entry
+		}
+	}
+	if !found {
+		missing = append(missing, "no key stored in Vault")
+	}
+
+	if len(missing) > 0 {
+		entry.Status = serviceOrphan
+		entry.Detail = strings.Join(missing, "; ")
+		return entry
+	}
+
+	entry.Status = serviceOK
+	return entry
+}
+
+// disable disables an orphaned unit
+func (a *serviceAuditor) disable(entry *serviceEntry) {
+	if err := a.services.DisableDecryptService(entry.UUID); err != nil {
+		entry.Detail = fmt.Sprintf("%s; disable failed: %v", entry.Detail, err)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"unit": entry.Unit,
+		"uuid": entry.UUID,
+	}).Info("Disabled orphaned decrypt unit")
+
+	entry.Disabled = true
+	entry.Detail = fmt.Sprintf("%s; disabled", entry.Detail)
+}
+
+// decryptServiceUUID extracts the device UUID from a vault-dm-crypt-decrypt@<uuid>.service unit name
+func decryptServiceUUID(unit string) string {
+	uuid := strings.TrimPrefix(unit, "vault-dm-crypt-decrypt@")
+	return strings.TrimSuffix(uuid, ".service")
+}
+
+func init() {
+	listServicesCmd.Flags().Bool("prune", false, "Disable orphaned decrypt units")
+	listServicesCmd.Flags().Duration("prune-grace", 0, "only prune units that have been orphaned for at least this long, e.g. 24h (0 prunes immediately)")
+
+	rootCmd.AddCommand(listServicesCmd)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	vaulterrors "digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+type fakeServiceManager struct {
+	units      []string
+	disabled   []string
+	disableErr error
+}
+
+func (f *fakeServiceManager) ListDecryptServices() ([]string, error) {
+	return f.units, nil
+}
+
+func (f *fakeServiceManager) DisableDecryptService(uuid string) error {
+	if f.disableErr != nil {
+		return f.disableErr
+	}
+	f.disabled = append(f.disabled, uuid)
+	return nil
+}
+
+type fakeKeyChecker struct {
+	secrets map[string]bool
+	errs    map[string]error
+}
+
+func (f *fakeKeyChecker) ReadSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	if err, ok := f.errs[path]; ok {
+		return nil, err
+	}
+	if !f.secrets[path] {
+		return nil, vaulterrors.NewVaultReadError(path, vault.ErrSecretNotFound)
+	}
+	return map[string]interface{}{"dmcrypt_key": "key"}, nil
+}
+
+func newTestServiceAuditor(services *fakeServiceManager) *serviceAuditor {
+	devices := map[string]string{
+		"uuid-ok":        "/dev/sdb1",
+		"uuid-no-secret": "/dev/sdc1",
+		"uuid-vault-err": "/dev/sdd1",
+	}
+
+	return &serviceAuditor{
+		services: services,
+		locations: []keyLocation{{
+			store: &fakeKeyChecker{
+				secrets: map[string]bool{
+					"vault-dm-crypt/node-1/uuid-ok":        true,
+					"vault-dm-crypt/node-1/uuid-no-device": true,
+				},
+				errs: map[string]error{
+					"vault-dm-crypt/node-1/uuid-vault-err": fmt.Errorf("connection refused"),
+				},
+			},
+			secretPath: func(uuid string) (string, error) {
+				return "vault-dm-crypt/node-1/" + uuid, nil
+			},
+		}},
+		findDevice: func(uuid string) (string, error) {
+			if device, ok := devices[uuid]; ok {
+				return device, nil
+			}
+			return "", &deviceNotFoundError{uuid: uuid}
+		},
+	}
+}
+
+func testDecryptUnits() []string {
+	return []string{
+		"vault-dm-crypt-decrypt@uuid-ok.service",
+		"vault-dm-crypt-decrypt@uuid-no-device.service",
+		"vault-dm-crypt-decrypt@uuid-no-secret.service",
+		"vault-dm-crypt-decrypt@uuid-gone.service",
+		"vault-dm-crypt-decrypt@uuid-vault-err.service",
+	}
+}
+
+func TestServiceAuditorAudit(t *testing.T) {
+	services := &fakeServiceManager{units: testDecryptUnits()}
+	auditor := newTestServiceAuditor(services)
+
+	entries, err := auditor.audit(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+
+	byUUID := make(map[string]serviceEntry)
+	for _, e := range entries {
+		byUUID[e.UUID] = e
+	}
+
+	assert.Equal(t, serviceOK, byUUID["uuid-ok"].Status)
+	assert.Equal(t, "/dev/sdb1", byUUID["uuid-ok"].Device)
+
+	assert.Equal(t, serviceOrphan, byUUID["uuid-no-device"].Status)
+	assert.Contains(t, byUUID["uuid-no-device"].Detail, "no device")
+
+	assert.Equal(t, serviceOrphan, byUUID["uuid-no-secret"].Status)
+	assert.Contains(t, byUUID["uuid-no-secret"].Detail, "no key stored in Vault")
+
+	assert.Equal(t, serviceOrphan, byUUID["uuid-gone"].Status)
+	assert.Contains(t, byUUID["uuid-gone"].Detail, "no device")
+	assert.Contains(t, byUUID["uuid-gone"].Detail, "no key stored in Vault")
+
+	assert.Equal(t, serviceUnknown, byUUID["uuid-vault-err"].Status)
+	assert.Contains(t, byUUID["uuid-vault-err"].Detail, "connection refused")
+
+	assert.Empty(t, services.disabled, "nothing is disabled without prune")
+}
+
+func TestServiceAuditorProfileLocation(t *testing.T) {
+	services := &fakeServiceManager{units: testDecryptUnits()}
+	auditor := newTestServiceAuditor(services)
+
+	// The key of uuid-no-secret is stored under a [[device]] profile's path_prefix
+	auditor.locations = append(auditor.locations, keyLocation{
+		store: &fakeKeyChecker{secrets: map[string]bool{"archive/node-1/uuid-no-secret": true}},
+		secretPath: func(uuid string) (string, error) {
+			return "archive/node-1/" + uuid, nil
+		},
+	})
+
+	entries, err := auditor.audit(context.Background(), true)
+	require.NoError(t, err)
+
+	for _, e := range entries {
+		if e.UUID == "uuid-no-secret" {
+			assert.Equal(t, serviceOK, e.Status)
+		}
+	}
+	assert.NotContains(t, services.disabled, "uuid-no-secret")
+}
+
+func TestServiceAuditorPrune(t *testing.T) {
+	t.Run("disables orphans only", func(t *testing.T) {
+		services := &fakeServiceManager{units: testDecryptUnits()}
+		auditor := newTestServiceAuditor(services)
+
+		entries, err := auditor.audit(context.Background(), true)
+		require.NoError(t, err)
+
+		assert.ElementsMatch(t, []string{"uuid-no-device", "uuid-no-secret", "uuid-gone"}, services.disabled)
+		for _, e := range entries {
+			assert.Equal(t, e.Status == serviceOrphan, e.Disabled, e.UUID)
+		}
+	})
+
+	t.Run("reports disable failures", func(t *testing.T) {
+		services := &fakeServiceManager{
+			units:      []string{"vault-dm-crypt-decrypt@uuid-gone.service"},
+			disableErr: fmt.Errorf("unit not loaded"),
+		}
+		auditor := newTestServiceAuditor(services)
+
+		entries, err := auditor.audit(context.Background(), true)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.False(t, entries[0].Disabled)
+		assert.Contains(t, entries[0].Detail, "disable failed: unit not loaded")
+	})
+}
+
+func TestServiceAuditorDeviceLookupFailure(t *testing.T) {
+	services := &fakeServiceManager{units: testDecryptUnits()}
+	auditor := newTestServiceAuditor(services)
+	auditor.findDevice = func(uuid string) (string, error) {
+		return "", fmt.Errorf("failed to search for device with UUID %s: blkid timed out", uuid)
+	}
+
+	entries, err := auditor.audit(context.Background(), true)
+	require.NoError(t, err)
+
+	for _, e := range entries {
+		assert.Equal(t, serviceUnknown, e.Status, e.UUID)
+		assert.False(t, e.Disabled)
+	}
+	assert.Empty(t, services.disabled)
+}
+
+func TestServiceAuditorPruneGrace(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state", "orphaned-units.json")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	run := func(t *testing.T, services *fakeServiceManager) []serviceEntry {
+		t.Helper()
+		orphans, err := loadOrphanTracker(statePath)
+		require.NoError(t, err)
+		orphans.now = func() time.Time { return now }
+
+		auditor := newTestServiceAuditor(services)
+		auditor.grace = time.Hour
+		auditor.orphans = orphans
+
+		entries, err := auditor.audit(context.Background(), true)
+		require.NoError(t, err)
+		return entries
+	}
+
+	services := &fakeServiceManager{units: testDecryptUnits()}
+	entries := run(t, services)
+	assert.Empty(t, services.disabled, "first sighting starts the grace period")
+	for _, e := range entries {
+		if e.Status == serviceOrphan {
+			assert.Contains(t, e.Detail, "prunable after 1h0m0s", e.UUID)
+		}
+	}
+
+	now = now.Add(30 * time.Minute)
+	run(t, services)
+	assert.Empty(t, services.disabled, "still within the grace period")
+
+	// Units removed by other means drop out of the state; the rest are past the grace period
+	services.units = []string{"vault-dm-crypt-decrypt@uuid-no-secret.service", "vault-dm-crypt-decrypt@uuid-gone.service"}
+	now = now.Add(31 * time.Minute)
+	run(t, services)
+	assert.ElementsMatch(t, []string{"uuid-no-secret", "uuid-gone"}, services.disabled)
+
+	orphans, err := loadOrphanTracker(statePath)
+	require.NoError(t, err)
+	assert.Empty(t, orphans.since, "disabled and unlisted units are forgotten")
+}
+
+func TestServiceAuditorGraceResetsWhenHealthy(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "orphaned-units.json")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	services := &fakeServiceManager{units: []string{"vault-dm-crypt-decrypt@uuid-no-device.service"}}
+	healthy := false
+
+	run := func(t *testing.T, grace time.Duration, prune bool) {
+		t.Helper()
+		orphans, err := loadOrphanTracker(statePath)
+		require.NoError(t, err)
+		orphans.now = func() time.Time { return now }
+
+		auditor := newTestServiceAuditor(services)
+		auditor.grace = grace
+		auditor.orphans = orphans
+		findDevice := auditor.findDevice
+		auditor.findDevice = func(uuid string) (string, error) {
+			if healthy {
+				return "/dev/sde1", nil
+			}
+			return findDevice(uuid)
+		}
+
+		_, err = auditor.audit(context.Background(), prune)
+		require.NoError(t, err)
+	}
+
+	run(t, time.Hour, true)
+
+	// A report without --prune-grace sees the device back and forgets when it was orphaned
+	now = now.Add(50 * time.Minute)
+	healthy = true
+	run(t, 0, false)
+
+	now = now.Add(20 * time.Minute)
+	healthy = false
+	run(t, time.Hour, true)
+	assert.Empty(t, services.disabled, "the grace period starts over once the unit was healthy")
+}
+
+func TestOrphanTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orphaned-units.json")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tracker, err := loadOrphanTracker(path)
+	require.NoError(t, err)
+	tracker.now = func() time.Time { return now }
+
+	assert.Zero(t, tracker.observe("uuid-a"))
+	assert.Zero(t, tracker.observe("uuid-b"))
+	require.NoError(t, tracker.save())
+
+	reloaded, err := loadOrphanTracker(path)
+	require.NoError(t, err)
+	reloaded.now = func() time.Time { return now.Add(2 * time.Hour) }
+	assert.Equal(t, 2*time.Hour, reloaded.observe("uuid-a"))
+
+	reloaded.clear("uuid-a")
+	assert.Zero(t, reloaded.observe("uuid-a"), "a cleared unit starts over")
+
+	reloaded.retain(map[string]bool{"uuid-a": true})
+	assert.NotContains(t, reloaded.since, "uuid-b")
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	_, err = loadOrphanTracker(path)
+	assert.Error(t, err)
+}
+
+func TestDecryptServiceUUID(t *testing.T) {
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", decryptServiceUUID("vault-dm-crypt-decrypt@12345678-1234-1234-1234-123456789abc.service"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestListStore() *fakeMetadataStore {
+	return &fakeMetadataStore{secrets: map[string]map[string]interface{}{
+		"base/uuid-new": {"device": "/dev/sdc1", "hostname": "node2", "created_at": "2024-06-01T00:00:00Z", "label": "db-data", "subsystem": "pool-a",
+			"tags": map[string]interface{}{"team": "dba", "env": "prod"}},
+		"base/uuid-old":     {"device": "/dev/sdd1", "hostname": "node1", "created_at": "2023-01-01T00:00:00Z"},
+		"base/uuid-mid":     {"device": "/dev/sdb1", "hostname": "node3", "created_at": "2024-03-01T12:00:00+02:00"},
+		"base/uuid-missing": {"device": "/dev/sda1", "hostname": "node1"},
+		"base/uuid-garbled": {"device": "/dev/sde1", "created_at": "last tuesday"},
+		"base/uuid-gone":    nil,
+	}}
+}
+
+func listUUIDs(entries []listEntry) []string {
+	uuids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		uuids = append(uuids, e.UUID)
+	}
+	return uuids
+}
+
+func TestListKeys(t *testing.T) {
+	entries, err := listKeys(context.Background(), newTestListStore(), "base")
+	require.NoError(t, err)
+	require.Len(t, entries, 6)
+
+	byUUID := make(map[string]listEntry)
+	for _, e := range entries {
+		byUUID[e.UUID] = e
+	}
+
+	assert.True(t, byUUID["uuid-mid"].HasCreatedAt)
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), byUUID["uuid-mid"].CreatedAt.UTC())
+	assert.Empty(t, byUUID["uuid-mid"].Note)
+	assert.Equal(t, "db-data", byUUID["uuid-new"].Label)
+	assert.Equal(t, "pool-a", byUUID["uuid-new"].Subsystem)
+	assert.Empty(t, byUUID["uuid-mid"].Label)
+	assert.Equal(t, map[string]string{"team": "dba", "env": "prod"}, byUUID["uuid-new"].Tags)
+	assert.Equal(t, "env=prod,team=dba", formatTags(byUUID["uuid-new"].Tags))
+	assert.Empty(t, formatTags(byUUID["uuid-mid"].Tags))
+	assert.Equal(t, "missing created_at", byUUID["uuid-missing"].Note)
+	assert.Contains(t, byUUID["uuid-garbled"].Note, "unparseable created_at")
+	assert.Contains(t, byUUID["uuid-gone"].Note, "unreadable")
+}
+
+func TestSortListEntries(t *testing.T) {
+	entries, err := listKeys(context.Background(), newTestListStore(), "base")
+	require.NoError(t, err)
+
+	sortListEntries(entries, listSortCreatedAt)
+	assert.Equal(t, []string{"uuid-old", "uuid-mid", "uuid-new", "uuid-garbled", "uuid-gone", "uuid-missing"}, listUUIDs(entries))
+
+	sortListEntries(entries, listSortDevice)
+	assert.Equal(t, []string{"uuid-gone", "uuid-missing", "uuid-mid", "uuid-new", "uuid-old", "uuid-garbled"}, listUUIDs(entries))
+
+	sortListEntries(entries, listSortHostname)
+	assert.Equal(t, []string{"uuid-garbled", "uuid-gone", "uuid-missing", "uuid-old", "uuid-new", "uuid-mid"}, listUUIDs(entries))
+
+	assert.NoError(t, validateListSort(""))
+	assert.Error(t, validateListSort("size"))
+}
+
+func TestFilterListEntries(t *testing.T) {
+	entries, err := listKeys(context.Background(), newTestListStore(), "base")
+	require.NoError(t, err)
+	sortListEntries(entries, listSortCreatedAt)
+
+	now := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	assert.Len(t, filterListEntries(entries, now, 0, 0), 6, "no filter keeps everything")
+	assert.Equal(t, []string{"uuid-new"}, listUUIDs(filterListEntries(entries, now, 7*day, 0)))
+	assert.Equal(t, []string{"uuid-old", "uuid-mid"}, listUUIDs(filterListEntries(entries, now, 0, 30*day)))
+	assert.Equal(t, []string{"uuid-mid"}, listUUIDs(filterListEntries(entries, now, 365*day, 30*day)))
+}
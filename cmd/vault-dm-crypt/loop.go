@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loopFileField records the disk image a device encrypted with --loop lives in
+const loopFileField = "loop_file"
+
+// loopDeviceManager is the subset of the LUKS manager used to attach disk images to loop devices
+type loopDeviceManager interface {
+	SetupLoopDevice(file string) (string, error)
+	FindLoopDevices(file string) ([]string, error)
+	EnsureLoopDevice(file string) (string, error)
+	DetachLoopDevice(loopDevice string) error
+	GetLUKSUUID(devicePath string) (string, error)
+	FindMappingsForDevice(devicePath string) ([]string, error)
+}
+
+// attachLoopFile attaches the disk image file to a free loop device for encrypt --loop. It
+// returns the absolute path of the file, which is recorded in Vault so decrypt can reattach
+// it, and the loop device to encrypt. A file already attached elsewhere may be in use, so it
+// is refused.
+func attachLoopFile(loops loopDeviceManager, file string) (string, string, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve %s: %w", file, err)
+	}
+
+	attached, err := loops.FindLoopDevices(absFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check loop devices of %s: %w", absFile, err)
+	}
+	if len(attached) > 0 {
+		return "", "", fmt.Errorf("%s is already attached to %s; detach it with 'losetup -d %s' first",
+			absFile, strings.Join(attached, ", "), attached[0])
+	}
+
+	loopDevice, err := loops.SetupLoopDevice(absFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to attach %s to a loop device: %w", absFile, err)
+	}
+	return absFile, loopDevice, nil
+}
+
+// attachLoopFileForUUID returns the loop device holding the disk image of a device encrypted
+// with --loop, attaching the image first if needed, and checks that it is the device with uuid
+func attachLoopFileForUUID(loops loopDeviceManager, file, uuid string) (string, error) {
+	loopDevice, err := loops.EnsureLoopDevice(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to attach %s to a loop device: %w", file, err)
+	}
+
+	found, err := loops.GetLUKSUUID(loopDevice)
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS UUID of %s: %w", loopDevice, err)
+	}
+	if found != uuid {
+		return "", fmt.Errorf("%s (attached to %s) has LUKS UUID %s, not %s", file, loopDevice, found, uuid)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"file":        file,
+		"loop_device": loopDevice,
+	}).Debug("Using loop device of disk image")
+	return loopDevice, nil
+}
+
+// detachLoopFile detaches the loop devices file is attached to once no mapping uses them. It
+// returns the loop devices detached.
+func detachLoopFile(loops loopDeviceManager, file string) ([]string, error) {
+	attached, err := loops.FindLoopDevices(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find loop devices of %s: %w", file, err)
+	}
+
+	detached := make([]string, 0, len(attached))
+	for _, loopDevice := range attached {
+		mappings, err := loops.FindMappingsForDevice(loopDevice)
+		if err != nil {
+			return detached, fmt.Errorf("failed to check mappings of %s: %w", loopDevice, err)
+		}
+		if len(mappings) > 0 {
+			logger.WithFields(logrus.Fields{
+				"loop_device": loopDevice,
+				"mappings":    strings.Join(mappings, ", "),
+			}).Warn("Loop device is still in use, leaving it attached")
+			continue
+		}
+
+		if err := loops.DetachLoopDevice(loopDevice); err != nil {
+			return detached, err
+		}
+		detached = append(detached, loopDevice)
+	}
+	return detached, nil
+}
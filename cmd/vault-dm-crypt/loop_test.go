@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+// fakeLoopDevices stands in for losetup: attached maps each backing file to its loop devices
+type fakeLoopDevices struct {
+	attached map[string][]string
+	uuids    map[string]string
+	mappings map[string][]string
+	next     int
+	detached []string
+}
+
+func newFakeLoopDevices() *fakeLoopDevices {
+	return &fakeLoopDevices{
+		attached: make(map[string][]string),
+		uuids:    make(map[string]string),
+		mappings: make(map[string][]string),
+	}
+}
+
+func (f *fakeLoopDevices) SetupLoopDevice(file string) (string, error) {
+	loopDevice := fmt.Sprintf("/dev/loop%d", f.next)
+	f.next++
+	f.attached[file] = append(f.attached[file], loopDevice)
+	return loopDevice, nil
+}
+
+func (f *fakeLoopDevices) FindLoopDevices(file string) ([]string, error) {
+	return f.attached[file], nil
+}
+
+func (f *fakeLoopDevices) EnsureLoopDevice(file string) (string, error) {
+	if attached := f.attached[file]; len(attached) > 0 {
+		return attached[0], nil
+	}
+	return f.SetupLoopDevice(file)
+}
+
+func (f *fakeLoopDevices) DetachLoopDevice(loopDevice string) error {
+	f.detached = append(f.detached, loopDevice)
+	return nil
+}
+
+func (f *fakeLoopDevices) GetLUKSUUID(devicePath string) (string, error) {
+	return f.uuids[devicePath], nil
+}
+
+func (f *fakeLoopDevices) FindMappingsForDevice(devicePath string) ([]string, error) {
+	return f.mappings[devicePath], nil
+}
+
+func TestAttachLoopFile(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "data.img")
+	require.NoError(t, os.WriteFile(image, make([]byte, 4096), 0600))
+	t.Chdir(dir)
+
+	t.Run("attaches and records the absolute path", func(t *testing.T) {
+		loops := newFakeLoopDevices()
+		file, loopDevice, err := attachLoopFile(loops, "data.img")
+		require.NoError(t, err)
+		assert.Equal(t, image, file)
+		assert.Equal(t, "/dev/loop0", loopDevice)
+	})
+
+	t.Run("refuses a file already attached", func(t *testing.T) {
+		loops := newFakeLoopDevices()
+		loops.attached[image] = []string{"/dev/loop5"}
+
+		_, _, err := attachLoopFile(loops, image)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already attached to /dev/loop5")
+	})
+}
+
+func TestAttachLoopFileForUUID(t *testing.T) {
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	image := filepath.Join(t.TempDir(), "data.img")
+
+	t.Run("reattaches a detached image", func(t *testing.T) {
+		loops := newFakeLoopDevices()
+		loops.uuids["/dev/loop0"] = uuid
+
+		loopDevice, err := attachLoopFileForUUID(loops, image, uuid)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop0", loopDevice)
+		assert.Equal(t, []string{"/dev/loop0"}, loops.attached[image])
+	})
+
+	t.Run("reuses an attached image", func(t *testing.T) {
+		loops := newFakeLoopDevices()
+		loops.attached[image] = []string{"/dev/loop4"}
+		loops.uuids["/dev/loop4"] = uuid
+
+		loopDevice, err := attachLoopFileForUUID(loops, image, uuid)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop4", loopDevice)
+	})
+
+	t.Run("image holding another device", func(t *testing.T) {
+		loops := newFakeLoopDevices()
+		loops.uuids["/dev/loop0"] = "87654321-4321-4321-4321-cba987654321"
+
+		_, err := attachLoopFileForUUID(loops, image, uuid)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not "+uuid)
+	})
+}
+
+func TestDetachLoopFile(t *testing.T) {
+	const image = "/var/lib/images/data.img"
+	loops := newFakeLoopDevices()
+	loops.attached[image] = []string{"/dev/loop0", "/dev/loop1"}
+	loops.mappings["/dev/loop1"] = []string{"other-mapping"}
+
+	detached, err := detachLoopFile(loops, image)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dev/loop0"}, detached)
+	assert.Equal(t, []string{"/dev/loop0"}, loops.detached)
+}
+
+func TestStoredLoopFile(t *testing.T) {
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	ctx := context.Background()
+
+	originalCfg := cfg
+	defer func() { cfg = originalCfg }()
+	cfg = config.DefaultConfig()
+
+	loopFile, err := storedLoopFile(ctx, &fakeSecretReader{data: map[string]interface{}{"loop_file": "/var/lib/images/data.img"}}, uuid, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/images/data.img", loopFile)
+
+	loopFile, err = storedLoopFile(ctx, &fakeSecretReader{data: map[string]interface{}{"device": "/dev/sdb1"}}, uuid, nil)
+	require.NoError(t, err)
+	assert.Empty(t, loopFile)
+
+	loopFile, err = storedLoopFile(ctx, &fakeSecretReader{err: vault.ErrSecretNotFound}, uuid, nil)
+	require.NoError(t, err)
+	assert.Empty(t, loopFile)
+
+	_, err = storedLoopFile(ctx, &fakeSecretReader{err: fmt.Errorf("permission denied")}, uuid, nil)
+	assert.Error(t, err)
+
+	// A device whose profile stores keys elsewhere is looked up there
+	cfg.General.NodeName = "node1"
+	reader := &fakeSecretReader{data: map[string]interface{}{"loop_file": "/var/lib/images/cold.img"}}
+	loopFile, err = storedLoopFile(ctx, reader, uuid, &config.DeviceConfig{Name: "cold", PathPrefix: "archive/node1"})
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/images/cold.img", loopFile)
+	assert.Equal(t, "archive/node1/"+uuid, reader.path)
+}
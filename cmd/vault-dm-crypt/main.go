@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,26 +14,44 @@ import (
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 
 	"digitalisio/vault-dm-crypt/internal/config"
 	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/fileperm"
+	"digitalisio/vault-dm-crypt/internal/hooks"
+	"digitalisio/vault-dm-crypt/internal/keyring"
+	"digitalisio/vault-dm-crypt/internal/lock"
+	"digitalisio/vault-dm-crypt/internal/notify"
 	"digitalisio/vault-dm-crypt/internal/shell"
 	"digitalisio/vault-dm-crypt/internal/systemd"
+	"digitalisio/vault-dm-crypt/internal/tracing"
 	"digitalisio/vault-dm-crypt/internal/vault"
 )
 
+// defaultConfigFile is the configuration used when --config is not given, including at boot
+const defaultConfigFile = "/etc/vault-dm-crypt/config.toml"
+
 var (
 	version        = "dev"
 	cfgFile        string
 	verbose        bool
 	debug          bool
 	retry          int
+	lockTimeout    time.Duration
+	vaultMountPath string
 	logger         *logrus.Logger
 	cfg            *config.Config
 	vaultClient    *vault.Client
 	dmcryptManager *dmcrypt.LUKSManager
 	systemdManager *systemd.Manager
 	validator      *dmcrypt.SystemValidator
+	hookRunner     *hooks.Runner
+	notifier       *notify.Notifier
+
+	// Root span of the running command and the function flushing its trace
+	commandSpan     trace.Span
+	shutdownTracing func(context.Context) error
 )
 
 func init() {
@@ -43,8 +62,13 @@ func init() {
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
-		// Don't print the error again if it's already been printed by Cobra
+	cmd, err := rootCmd.ExecuteC()
+	finishTracing(err)
+	if err != nil {
+		if errorFormat == "json" {
+			_ = writeErrorReport(os.Stderr, err, cmd.Name())
+		}
+		// Otherwise don't print the error again, it's already been printed by Cobra
 		// Just exit with error code
 		os.Exit(1)
 	}
@@ -78,20 +102,36 @@ This tool provides a secure way to manage encrypted volumes by:
 		}
 
 		// Configure logger based on config
-		if err := configureLogger(cfg.Logging); err != nil {
+		if err := configureLogger(cfg.Logging, cfg.Security.FilePermissions()); err != nil {
 			return fmt.Errorf("failed to configure logging: %w", err)
 		}
 
+		if warning := configPermissionsWarning(cfgFile); warning != "" {
+			logger.Warn(warning)
+		}
+
 		// Override retry timeout if specified
 		if retry > 0 {
 			cfg.Vault.RetryMax = retry
 		}
 
+		if vaultMountPath != "" {
+			cfg.Vault.AppRoleMount = vaultMountPath
+		}
+
 		logger.WithFields(logrus.Fields{
 			"vault_url":     cfg.Vault.URL,
 			"vault_backend": cfg.Vault.Backend,
 		}).Debug("Configuration loaded")
 
+		// Spans of Vault requests and cryptsetup calls hang off the command's root span
+		if shutdownTracing, err = tracing.Setup(cmd.Context(), cfg.Tracing); err != nil {
+			return err
+		}
+		ctx, span := tracing.StartCommand(cmd.Context(), cmd.CommandPath())
+		commandSpan = span
+		cmd.SetContext(ctx)
+
 		// Initialize all managers
 		var err2 error
 		vaultClient, err2 = vault.NewClient(&cfg.Vault, logger)
@@ -100,8 +140,15 @@ This tool provides a secure way to manage encrypted volumes by:
 		}
 
 		dmcryptManager = dmcrypt.NewLUKSManager(logger)
+		dmcryptManager.SetOperationTimeout(cfg.DMCrypt.OperationTimeout())
+		dmcryptManager.SetMapperWaitTimeout(cfg.DMCrypt.MapperWaitTimeout())
+		dmcryptManager.SetBusyRetries(cfg.DMCrypt.BusyRetries)
+		dmcryptManager.SetOpenPriority(dmcrypt.ProcessPriority{Nice: cfg.DMCrypt.Nice, IOClass: cfg.DMCrypt.IONiceClass})
+		dmcryptManager.SetKeyFileMaxLifetime(cfg.Security.KeyFileMaxLifetime())
 		systemdManager = systemd.NewManager(logger)
 		validator = dmcrypt.NewSystemValidator(logger)
+		hookRunner = hooks.NewRunner(cfg.Hooks, logger)
+		notifier = notify.NewNotifier(cfg.Notify, logger)
 
 		logger.Debug("All managers initialized successfully")
 
@@ -115,143 +162,408 @@ var encryptCmd = &cobra.Command{
 	Long: `Encrypt a block device using LUKS with a key stored in Vault.
 
 This command will:
-1. Generate a random encryption key
-2. Store the key in Vault at the configured vault_path
-3. Format the device with LUKS encryption
-4. Open the encrypted device
-5. Enable systemd service for auto-mount on boot`,
-	Args: cobra.ExactArgs(1),
+1. Check that Vault accepts writes at the key path (a probe entry is written and removed)
+2. Generate a random encryption key (or read one from stdin with --key-stdin)
+3. Store the key in Vault at the configured vault_path
+4. Format the device with LUKS encryption
+5. Open the encrypted device and, with [luks] integrity set, zero it to initialise the
+   integrity tags (skipped with [luks] integrity_no_wipe)
+6. Optionally create a filesystem on the opened device (--mkfs ext4|xfs)
+7. Close the device and reopen it with the key read back from Vault (--verify-after,
+   on by default with [general] verify_after)
+8. Enable systemd service for auto-mount on boot, ordered after the services of devices
+   with a lower --boot-priority
+
+On a terminal, the device's size, model, serial and existing contents are shown before
+anything is written, and the device's name must be typed to continue. --yes (or --force)
+skips the confirmation.
+
+The stages can be run separately, e.g. to escrow keys before the hardware arrives:
+--store-only [uuid] runs steps 1-3 without a device and prints the UUID, and
+--format-from-vault <uuid> <device> runs steps 4-8 with the key stored for that UUID.
+Both store the key in the [vault] location unless --profile names a [[device]] profile whose
+backend or path_prefix to use instead; give the same --profile to both stages.
+
+The integrity wipe records its progress, so an interrupted wipe can be continued with
+--resume-wipe <uuid> once the device is open again, which also runs steps 6-8.
+
+With --loop, a regular file such as a disk image is attached to a loop device and encrypted
+through it. The file is recorded in Vault, decrypt reattaches it and close detaches it.
+
+--from-file <list> encrypts every device in a file listing one device per line, --jobs at a
+time, and prints the outcome of each. It needs --yes, since the devices cannot be confirmed
+one by one, and fails if any device failed.`,
+	Example: `  vault-dm-crypt encrypt /dev/sdd1
+  vault-dm-crypt encrypt --yes --from-file /etc/vault-dm-crypt/new-disks.txt
+  vault-dm-crypt encrypt --store-only
+  vault-dm-crypt encrypt --loop /var/lib/images/data.img
+  vault-dm-crypt encrypt --format-from-vault 12345678-1234-1234-1234-123456789abc /dev/sdd1
+  vault-dm-crypt encrypt --resume-wipe 12345678-1234-1234-1234-123456789abc`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("from-file") {
+			return cobra.NoArgs(cmd, args)
+		}
+		if storeOnly, _ := cmd.Flags().GetBool("store-only"); storeOnly {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		if cmd.Flags().Changed("resume-wipe") {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Silence usage for runtime errors (not argument errors)
 		cmd.SilenceUsage = true
 
-		device := args[0]
-		force, _ := cmd.Flags().GetBool("force")
+		if fromFile, _ := cmd.Flags().GetString("from-file"); fromFile != "" {
+			return runEncryptFromFile(cmd, fromFile)
+		}
+		return runEncrypt(cmd.Context(), cmd, args)
+	},
+}
 
-		logger.WithFields(logrus.Fields{
-			"device": device,
-			"force":  force,
-		}).Info("Starting device encryption")
+// runEncrypt encrypts the device given in args, or runs the --store-only, --format-from-vault or
+// --resume-wipe stage. parent carries the trace span the operation's spans belong to.
+func runEncrypt(parent context.Context, cmd *cobra.Command, args []string) (err error) {
+	storeOnly, _ := cmd.Flags().GetBool("store-only")
+	formatFromVault, _ := cmd.Flags().GetString("format-from-vault")
+	force, _ := cmd.Flags().GetBool("force")
+	yes, _ := cmd.Flags().GetBool("yes")
+	keyStdin, _ := cmd.Flags().GetBool("key-stdin")
+	deviceResolution, _ := cmd.Flags().GetString("device-resolution")
+	tagValues, _ := cmd.Flags().GetStringArray("tag")
+	filesystem, _ := cmd.Flags().GetString("mkfs")
+	offset, _ := cmd.Flags().GetUint64("offset")
+	label, _ := cmd.Flags().GetString("label")
+	subsystem, _ := cmd.Flags().GetString("subsystem")
+	resumeWipe, _ := cmd.Flags().GetString("resume-wipe")
+	preferStable, _ := cmd.Flags().GetBool("prefer-stable-path")
+	loop, _ := cmd.Flags().GetBool("loop")
+	profile, err := profileFromFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if profile != nil && !storeOnly && formatFromVault == "" {
+		return fmt.Errorf("--profile only applies to --store-only and --format-from-vault; encrypt uses the [[device]] profile matching the device")
+	}
+	var bootPriority *int
+	if cmd.Flags().Changed("boot-priority") {
+		priority, _ := cmd.Flags().GetInt("boot-priority")
+		bootPriority = &priority
+	}
+	verifyAfter := cfg.General.VerifyAfter
+	if cmd.Flags().Changed("verify-after") {
+		verifyAfter, _ = cmd.Flags().GetBool("verify-after")
+	}
 
-		// Validate system requirements
-		if err := validator.ValidateSystemRequirements(); err != nil {
-			return fmt.Errorf("system validation failed: %w", err)
-		}
+	summary := newOperationSummary("encrypt")
+	defer func() { summary.log(err) }()
 
-		// Validate device
-		if err := dmcryptManager.ValidateDevice(device); err != nil {
-			return fmt.Errorf("device validation failed: %w", err)
-		}
+	if resumeWipe != "" {
+		return runResumeWipe(parent, summary, resumeWipe, verifyAfter)
+	}
 
-		// Check if device is mounted
-		mounted, err := dmcryptManager.IsDeviceMounted(device)
-		if err != nil {
-			return fmt.Errorf("failed to check device mount status: %w", err)
+	if filesystem != "" {
+		if err := dmcrypt.ValidateFilesystemType(filesystem); err != nil {
+			return err
 		}
+	}
 
-		if mounted && !force {
-			return fmt.Errorf("device %s is currently mounted. Use --force to encrypt anyway", device)
-		}
+	if err := (dmcrypt.FormatOptions{Label: label, Subsystem: subsystem}).ValidateLabels(); err != nil {
+		return err
+	}
 
-		// Generate encryption key
-		logger.Debug("Generating encryption key")
-		key, err := dmcryptManager.GenerateKey()
-		if err != nil {
-			return fmt.Errorf("failed to generate encryption key: %w", err)
+	// Reject bad tags before anything is written to the device or Vault
+	tags, err := parseTags(tagValues, append(reservedSecretFields, cfg.Vault.KeyFieldNames()...))
+	if err != nil {
+		return err
+	}
+
+	if storeOnly {
+		var requested string
+		if len(args) > 0 {
+			requested = args[0]
 		}
+		return runStoreOnly(parent, summary, requested, keyStdin, filesystem, tags, profile)
+	}
 
-		// Generate UUID for the device
-		uuidStr := uuid.NewString()
-		logger.WithField("uuid", uuidStr).Debug("Generated UUID for device")
+	device := args[0]
+	summary.Device = device
 
-		// Store key in Vault
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.Vault.Timeout())
-		defer cancel()
+	logger.WithFields(logrus.Fields{
+		"device": device,
+		"force":  force,
+	}).Info("Starting device encryption")
 
-		logger.Debug("Storing encryption key in Vault")
-		err = vaultClient.WithRetry(ctx, func() error {
-			secretData := map[string]interface{}{
-				"dmcrypt_key": key,
-				"created_at":  time.Now().Format(time.RFC3339),
-				"device":      device,
-			}
+	if err := checkStableDevicePath(dmcryptManager, device, preferStable); err != nil {
+		return err
+	}
 
-			hostname, _ := os.Hostname()
-			if hostname != "" {
-				secretData["hostname"] = hostname
-			}
+	// The slot is taken before the device lock, in the same order as decrypt, so the two
+	// cannot each hold what the other is waiting for
+	slot, err := acquireConcurrencySlot()
+	if err != nil {
+		return err
+	}
+	defer releaseOperationLock(slot)
+
+	opLock, lockErr := acquireOperationLock(deviceLockTarget(device))
+	if lockErr != nil {
+		return lockErr
+	}
+	defer releaseOperationLock(opLock)
 
-			// Get expanded vault path with placeholders replaced
-			basePath, err := cfg.Vault.ExpandedVaultPath()
+	if formatFromVault != "" {
+		return runFormatFromVault(parent, summary, formatFromVault, device, deviceResolution, filesystem, force, yes, verifyAfter, bootPriority, profile)
+	}
+
+	// A disk image is encrypted through a loop device; block devices are encrypted directly
+	var loopFile string
+	if dmcrypt.IsRegularFile(device) {
+		if !loop {
+			return fmt.Errorf("%s is a regular file, not a block device; use --loop to encrypt it through a loop device", device)
+		}
+		if loopFile, device, err = attachLoopFile(dmcryptManager, device); err != nil {
+			return err
+		}
+		summary.Device = device
+		logger.WithFields(logrus.Fields{
+			"file":        loopFile,
+			"loop_device": device,
+		}).Info("Encrypting disk image through loop device")
+
+		// A failed encrypt leaves no loop device behind
+		loopDevice := device
+		defer func() {
 			if err != nil {
-				return err
+				if detachErr := dmcryptManager.DetachLoopDevice(loopDevice); detachErr != nil {
+					logger.WithError(detachErr).WithField("loop_device", loopDevice).Warn("Failed to detach loop device")
+				}
 			}
-			vaultPath := fmt.Sprintf("%s/%s", basePath, uuidStr)
-			return vaultClient.WriteSecret(ctx, vaultPath, secretData)
-		})
+		}()
+	}
 
-		if err != nil {
-			// Clean up the key from memory
-			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("failed to store key in Vault: %w", err)
-		}
+	target, err := prepareEncryptTarget(device, deviceResolution, force)
+	if err != nil {
+		return err
+	}
+	summary.Device = target.Device
+	target.Filesystem = filesystem
+	target.FormatOpts.Offset = offset
+	target.FormatOpts.Label = label
+	target.FormatOpts.Subsystem = subsystem
+	target.BootPriority = bootPriority
+
+	if err := confirmEncryptTarget(target, yes || force); err != nil {
+		return err
+	}
 
-		logger.Info("Encryption key stored in Vault successfully")
+	// Generate UUID for the device
+	uuidStr := uuid.NewString()
+	logger.WithField("uuid", uuidStr).Debug("Generated UUID for device")
+	summary.UUID = uuidStr
 
-		// Format device with LUKS
-		logger.Info("Formatting device with LUKS encryption")
-		err = dmcryptManager.FormatDevice(device, key, uuidStr)
-		if err != nil {
-			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("failed to format device with LUKS: %w", err)
+	key, err := newEncryptionKey(keyStdin)
+	if err != nil {
+		return err
+	}
+	defer dmcryptManager.SecureEraseKey(&key)
+	recordKeyFingerprint(parent, summary, key)
+
+	record := keyRecord{
+		Device:     target.Device,
+		StablePath: target.StablePath,
+		Integrity:  target.FormatOpts.Integrity,
+		Filesystem: target.Filesystem,
+		Offset:     target.FormatOpts.Offset,
+		Label:      target.FormatOpts.Label,
+		Subsystem:  target.FormatOpts.Subsystem,
+		LoopFile:   loopFile,
+		OpenOpts:   target.OpenOpts,
+		Tags:       tags,
+		Profile:    target.Profile,
+	}
+	// Waiting for the lock, slot and confirmation must not use up the time allowed for Vault requests
+	ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	defer cancel()
+
+	store := storeForProfile(target.Profile)
+	vaultPath, err := storeKey(ctx, store, uuidStr, key, record, false)
+	if err != nil {
+		return err
+	}
+
+	var check *roundTripCheck
+	if verifyAfter {
+		check = &roundTripCheck{store: store, vaultPath: vaultPath}
+	}
+	mappedDevice, err := formatAndActivate(parent, summary, target, uuidStr, key, check)
+	if err != nil {
+		// A key stored for a device that was never formatted protects nothing; after formatting it must stay
+		if stderrors.Is(err, errFormatFailed) {
+			rollbackCtx, rollbackCancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+			rollbackStoredKey(rollbackCtx, store, vaultPath)
+			rollbackCancel()
 		}
+		return err
+	}
 
-		logger.Info("Device formatted with LUKS successfully")
+	fmt.Printf("Device encrypted successfully:\n")
+	fmt.Printf("  UUID: %s\n", uuidStr)
+	fmt.Printf("  Mapped device: %s\n", mappedDevice)
+	fmt.Printf("  Vault path: %s/%s\n", cfg.VaultForProfile(target.Profile).Backend, vaultPath)
 
-		// Open the LUKS device
-		deviceName := dmcryptManager.GenerateDeviceName(uuidStr)
-		logger.WithField("device_name", deviceName).Info("Opening LUKS device")
+	return nil
+}
 
-		err = dmcryptManager.OpenDevice(device, key, deviceName)
-		if err != nil {
-			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("failed to open LUKS device: %w", err)
+// newEncryptionKey reads an externally supplied key from stdin or generates a new one
+func newEncryptionKey(keyStdin bool) (string, error) {
+	if keyStdin {
+		if cfgFile == config.StdinConfigPath {
+			return "", fmt.Errorf("--key-stdin cannot be used with --config -, stdin was already used for the configuration")
 		}
+		return readKeyFromStdin()
+	}
 
-		mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
-		logger.WithField("mapped_device", mappedDevice).Info("LUKS device opened successfully")
+	logger.Debug("Generating encryption key")
+	key, err := dmcryptManager.GenerateKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return key, nil
+}
 
-		// Clean up the key from memory now that it's no longer needed
-		dmcryptManager.SecureEraseKey(&key)
+// runStoreOnly provisions a key in Vault for a device that will be formatted later with
+// --format-from-vault, in the Vault location of profile if given. The device's LUKS options come
+// from the [luks] section.
+func runStoreOnly(parent context.Context, summary *operationSummary, requested string, keyStdin bool, filesystem string, tags map[string]string, profile *config.DeviceConfig) error {
+	uuidStr, err := parseDeviceUUID(requested)
+	if err != nil {
+		return err
+	}
+	summary.UUID = uuidStr
 
-		// Enable systemd service for auto-decrypt on boot
-		logger.Info("Enabling systemd service for automatic decryption on boot")
-		err = systemdManager.EnableDecryptService(uuidStr)
-		if err != nil {
-			logger.WithError(err).Warn("Failed to enable systemd service - device will need manual decryption on boot")
-		} else {
-			logger.Info("Systemd service enabled successfully")
-		}
+	logger.WithField("uuid", uuidStr).Info("Storing a key in Vault without formatting a device")
 
-		logger.WithFields(logrus.Fields{
-			"device":        device,
-			"uuid":          uuidStr,
-			"mapped_device": mappedDevice,
-		}).Info("Device encryption completed successfully")
+	opLock, err := acquireOperationLock(uuidStr)
+	if err != nil {
+		return err
+	}
+	defer releaseOperationLock(opLock)
+
+	ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	defer cancel()
+
+	key, err := newEncryptionKey(keyStdin)
+	if err != nil {
+		return err
+	}
+	defer dmcryptManager.SecureEraseKey(&key)
+	recordKeyFingerprint(parent, summary, key)
+
+	record := keyRecord{
+		Integrity:  cfg.LUKS.Integrity,
+		Filesystem: filesystem,
+		OpenOpts: dmcrypt.OpenOptions{
+			NoReadWorkqueue:  cfg.LUKS.NoReadWorkqueue,
+			NoWriteWorkqueue: cfg.LUKS.NoWriteWorkqueue,
+		},
+		Tags:    tags,
+		Profile: profile,
+	}
+	vaultPath, err := storeKey(ctx, storeForProfile(profile), uuidStr, key, record, true)
+	if err != nil {
+		return err
+	}
+
+	formatArgs := ""
+	if profile != nil {
+		formatArgs = " --profile " + profile.Name
+	}
+	fmt.Printf("Key stored successfully:\n")
+	fmt.Printf("  UUID: %s\n", uuidStr)
+	fmt.Printf("  Vault path: %s/%s\n", cfg.VaultForProfile(profile).Backend, vaultPath)
+	fmt.Printf("Format a device with it using: vault-dm-crypt encrypt%s --format-from-vault %s <device>\n", formatArgs, uuidStr)
+
+	return nil
+}
+
+// runFormatFromVault formats a device with a key stored earlier with --store-only, in the Vault
+// location of profile if given. The integrity and open options stored with the key apply rather
+// than any [[device]] profile matching the device, since boot-time decrypt reads them from Vault.
+func runFormatFromVault(parent context.Context, summary *operationSummary, requested, device, deviceResolution, filesystem string, force, yes, verifyAfter bool, bootPriority *int, profile *config.DeviceConfig) error {
+	uuidStr, err := parseDeviceUUID(requested)
+	if err != nil {
+		return err
+	}
+	summary.UUID = uuidStr
+
+	// Two devices with the same LUKS UUID would make decrypt ambiguous
+	if existing, err := findDeviceByUUID(uuidStr); err == nil {
+		return fmt.Errorf("device %s already has LUKS UUID %s", existing, uuidStr)
+	}
+
+	target, err := prepareEncryptTarget(device, deviceResolution, force)
+	if err != nil {
+		return err
+	}
+	summary.Device = target.Device
+	target.BootPriority = bootPriority
+
+	if err := confirmEncryptTarget(target, yes || force); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	defer cancel()
+
+	store := storeForProfile(profile)
+	key, record, err := loadStoredKey(ctx, store, uuidStr, profile, force)
+	if err != nil {
+		return err
+	}
+	defer dmcryptManager.SecureEraseKey(&key)
+	recordKeyFingerprint(parent, summary, key)
+
+	// The key was stored where --profile says, whatever profile matches the device
+	target.Profile = profile
+	target.FormatOpts.Integrity = record.Integrity
+	target.OpenOpts = record.OpenOpts
+	target.OpenOpts.Persistent = cfg.LUKS.PersistentFlags
+
+	// A filesystem chosen when the key was stored applies unless --mkfs overrides it
+	target.Filesystem = filesystem
+	if target.Filesystem == "" {
+		target.Filesystem = record.Filesystem
+	}
+	if err := target.checkCryptsetupVersion(); err != nil {
+		return err
+	}
 
-		// Get expanded vault path for display
-		basePath, err := cfg.Vault.ExpandedVaultPath()
+	var check *roundTripCheck
+	if verifyAfter {
+		vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuidStr)
 		if err != nil {
 			return err
 		}
+		check = &roundTripCheck{store: store, vaultPath: vaultPath}
+	}
+	mappedDevice, err := formatAndActivate(parent, summary, target, uuidStr, key, check)
+	if err != nil {
+		return err
+	}
 
-		fmt.Printf("Device encrypted successfully:\n")
-		fmt.Printf("  UUID: %s\n", uuidStr)
-		fmt.Printf("  Mapped device: %s\n", mappedDevice)
-		fmt.Printf("  Vault path: %s/%s/%s\n", cfg.Vault.Backend, basePath, uuidStr)
+	recordCtx, recordCancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	defer recordCancel()
+	if err := recordFormattedDevice(recordCtx, store, uuidStr, key, target); err != nil {
+		return fmt.Errorf("device %s was encrypted, but recording it against the key in Vault failed: %w", target.Device, err)
+	}
 
-		return nil
-	},
+	fmt.Printf("Device encrypted successfully:\n")
+	fmt.Printf("  UUID: %s\n", uuidStr)
+	fmt.Printf("  Mapped device: %s\n", mappedDevice)
+
+	return nil
 }
 
 var decryptCmd = &cobra.Command{
@@ -262,121 +574,360 @@ var decryptCmd = &cobra.Command{
 This command will:
 1. Retrieve the encryption key from Vault using the UUID
 2. Open the LUKS device with the key
-3. Create the device mapping`,
-	Args: cobra.ExactArgs(1),
+3. Create the device mapping
+
+When Vault cannot be reached, --passphrase opens the device with a passphrase typed on the
+terminal instead, e.g. one held in a recovery keyslot. Vault is not contacted at all in this
+mode, so the mapping name comes from --name or [dmcrypt] name_template.
+
+A device that is already open is left alone. With --ensure, its activation flags (as shown by
+cryptsetup status) are compared with [luks] no_read_workqueue and no_write_workqueue, and the
+device is closed and reopened with the configured flags if they differ.
+
+--from-file <list> opens every device whose UUID is listed in a file, one per line, --jobs at
+a time, and prints the outcome of each. It fails if any device could not be opened.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("from-file") {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Silence usage for runtime errors (not argument errors)
 		cmd.SilenceUsage = true
 
-		uuid := args[0]
-		customName, _ := cmd.Flags().GetString("name")
+		if cmd.Flags().Changed("key-field") {
+			keyField, _ := cmd.Flags().GetString("key-field")
+			if strings.TrimSpace(keyField) == "" {
+				return fmt.Errorf("--key-field cannot be empty")
+			}
+			// Read only this field, in place of [vault] key_field and key_fields
+			cfg.Vault.KeyFields = []string{keyField}
+		}
 
-		logger.WithFields(logrus.Fields{
-			"uuid":        uuid,
-			"custom_name": customName,
-		}).Info("Starting device decryption")
+		if fromFile, _ := cmd.Flags().GetString("from-file"); fromFile != "" {
+			return runDecryptFromFile(cmd, fromFile)
+		}
+		return runDecrypt(cmd.Context(), cmd, args)
+	},
+}
+
+// runDecrypt opens the device with the UUID given in args. parent carries the trace span the
+// operation's spans belong to.
+func runDecrypt(parent context.Context, cmd *cobra.Command, args []string) (err error) {
+	uuid := args[0]
+
+	summary := newOperationSummary("decrypt")
+	summary.UUID = uuid
+	defer func() { summary.log(err) }()
 
-		// Validate system requirements
-		if err := validator.ValidateSystemRequirements(); err != nil {
-			return fmt.Errorf("system validation failed: %w", err)
+	// encrypt records the profile of a device whose key is stored outside the [vault] location
+	var profile *config.DeviceConfig
+
+	// Every attempt is recorded, including those that fail before reaching Vault
+	attemptsLog := attemptsLogPath(cmd)
+	if err := checkAttemptsLogAppendOnly(attemptsLog, cfg.Audit); err != nil {
+		return err
+	}
+	if attemptsLog != "" {
+		defer func() { recordDecryptAttempt(attemptsLog, uuid, profile, err) }()
+	}
+	customName, _ := cmd.Flags().GetString("name")
+	secretVersion, _ := cmd.Flags().GetInt("secret-version")
+	deviceResolution, _ := cmd.Flags().GetString("device-resolution")
+	forceUnlock, _ := cmd.Flags().GetBool("force-unlock")
+	ensure, _ := cmd.Flags().GetBool("ensure")
+	compat, _ := cmd.Flags().GetString("compat")
+	profileFlag, _ := cmd.Flags().GetString("profile")
+	usePassphrase, _ := cmd.Flags().GetBool("passphrase")
+	waitForApproval, _ := cmd.Flags().GetBool("wait-for-approval")
+	keyField, _ := cmd.Flags().GetString("key-field")
+
+	if err := validateCompat(compat); err != nil {
+		return err
+	}
+	if usePassphrase && (secretVersion != 0 || compat != "" || profileFlag != "" || forceUnlock || waitForApproval || keyField != "") {
+		return fmt.Errorf("--passphrase does not read Vault and cannot be combined with --secret-version, --compat, --profile, --force-unlock, --wait-for-approval or --key-field")
+	}
+	if customName != "" {
+		if err := config.ValidateMappingName(customName); err != nil {
+			return err
 		}
+	}
 
-		// Retrieve key from Vault
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.Vault.Timeout())
-		defer cancel()
+	if profileFlag != "" {
+		if profile, err = cfg.DeviceProfileByName(profileFlag); err != nil {
+			return err
+		}
+	}
 
-		logger.Debug("Retrieving encryption key from Vault")
-		var key string
-		err := vaultClient.WithRetry(ctx, func() error {
-			// Get expanded vault path with placeholders replaced
-			basePath, err := cfg.Vault.ExpandedVaultPath()
-			if err != nil {
-				return err
-			}
-			vaultPath := fmt.Sprintf("%s/%s", basePath, uuid)
-			secretData, err := vaultClient.ReadSecret(ctx, vaultPath)
-			if err != nil {
-				return err
-			}
+	logger.WithFields(logrus.Fields{
+		"uuid":           uuid,
+		"custom_name":    customName,
+		"secret_version": secretVersion,
+	}).Info("Starting device decryption")
 
-			dmcryptKey, exists := secretData["dmcrypt_key"]
-			if !exists {
-				return fmt.Errorf("dmcrypt_key not found in secret")
-			}
+	opLock, lockErr := acquireOperationLock(uuid)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer releaseOperationLock(opLock)
 
-			keyStr, ok := dmcryptKey.(string)
-			if !ok {
-				return fmt.Errorf("dmcrypt_key is not a string")
-			}
+	slot, err := acquireConcurrencySlot()
+	if err != nil {
+		return err
+	}
+	defer releaseOperationLock(slot)
 
-			key = keyStr
-			return nil
-		})
+	// Validate system requirements
+	if err := validator.ValidateSystemRequirements(); err != nil {
+		return fmt.Errorf("system validation failed: %w", err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("failed to retrieve key from Vault: %w", err)
-		}
+	if usePassphrase {
+		return runPassphraseDecrypt(summary, uuid, customName, deviceResolution)
+	}
 
-		logger.Info("Encryption key retrieved from Vault successfully")
+	// Retrieve key from Vault
+	ctx, cancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+	defer cancel()
 
-		// Validate the key format
-		if err := dmcryptManager.ValidateKeyFormat(key); err != nil {
-			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("invalid key format: %w", err)
+	// Approval can take far longer than a Vault request, so it is only bounded by the request's expiry
+	var approvalCtx context.Context
+	if waitForApproval {
+		approvalCtx = parent
+	}
+
+	var key string
+	var integrity string
+	var loopFile string
+	var openOpts dmcrypt.OpenOptions
+
+	// Boot retries can reuse a key cached in the kernel keyring by an earlier attempt
+	var kr *keyring.Keyring
+	cached := false
+	if cfg.Security.UseKeyring {
+		kr = keyring.New(logger)
+		// A specific secret version is always read from Vault
+		if secretVersion == 0 {
+			var err error
+			key, integrity, loopFile, openOpts, cached, err = loadKeyFromKeyring(kr, uuid)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to read cached key from keyring")
+			}
 		}
+	}
+
+	if cached {
+		logger.Info("Using encryption key cached in kernel keyring")
+	} else if err := retrieveDecryptKey(ctx, approvalCtx, uuid, secretVersion, compat, profile, &key, &integrity, &loopFile, &openOpts); err != nil {
+		return err
+	}
+	recordKeyFingerprint(parent, summary, key)
+
+	// Validate the key format
+	if err := dmcryptManager.ValidateKeyFormat(key); err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		return fmt.Errorf("invalid key format: %w", err)
+	}
 
-		// Generate device name
-		var deviceName string
-		if customName != "" {
-			deviceName = customName
+	// Only a valid key of the current version is cached, since later decrypts without
+	// --secret-version reuse whatever is cached under the UUID
+	inKeyring := cached
+	if kr != nil && !cached && secretVersion == 0 {
+		if err := cacheKeyInKeyring(kr, uuid, key, integrity, loopFile, openOpts, cfg.Security.KeyringTTL()); err != nil {
+			logger.WithError(err).Warn("Failed to cache key in kernel keyring")
 		} else {
-			deviceName = dmcryptManager.GenerateDeviceName(uuid)
+			inKeyring = true
 		}
+	}
 
-		logger.WithField("device_name", deviceName).Debug("Using device name")
+	// cryptsetup reads the key by reference; the key file is only a fallback
+	if inKeyring {
+		openOpts.KeyDescription = keyring.KeyDescription(uuid)
+	}
 
-		// Find the device by UUID
-		devicePath, err := findDeviceByUUID(uuid)
+	// Generate device name; a name chosen with --name on an earlier decrypt is reused
+	deviceName := customName
+	if deviceName == "" {
+		deviceName, err = resolveMappingName(ctx, vaultClient, uuid, profile)
 		if err != nil {
 			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("failed to find device with UUID %s: %w", uuid, err)
+			return err
 		}
+	}
 
-		logger.WithField("device_path", devicePath).Debug("Found device")
+	logger.WithField("device_name", deviceName).Debug("Using device name")
+	summary.Mapping = deviceName
 
-		// Check if device is already open
-		mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
-		if _, err := os.Stat(mappedDevice); err == nil {
+	// Find the device by UUID, reattaching the disk image of a device encrypted with --loop
+	// At boot the device may appear a little after this unit starts
+	var devicePath string
+	if loopFile != "" {
+		devicePath, err = attachLoopFileForUUID(dmcryptManager, loopFile, uuid)
+	} else {
+		devicePath, err = newDeviceWaiter(cfg.DMCrypt.DeviceWaitTimeout()).wait(uuid)
+	}
+	if err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		return fmt.Errorf("failed to find device with UUID %s: %w", uuid, err)
+	}
+
+	// /dev/disk/by-uuid may point at an LVM or multipath member rather than the top-level device
+	resolution, err := dmcrypt.ParseDeviceResolution(deviceResolution)
+	if err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		return err
+	}
+	devicePath, err = dmcryptManager.ResolveDevice(devicePath, resolution)
+	if err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		return fmt.Errorf("device resolution failed: %w", err)
+	}
+
+	logger.WithField("device_path", devicePath).Debug("Found device")
+	summary.Device = devicePath
+
+	// Encrypt locks the device it formats, so a decrypt of the same device waits for it
+	deviceLock, err := acquireOperationLock(deviceLockTarget(devicePath))
+	if err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		return err
+	}
+	defer releaseOperationLock(deviceLock)
+
+	// Check if device is already open
+	mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
+	if _, err := os.Stat(mappedDevice); err == nil && ensure {
+		// Converge the open mapping on the configured activation flags
+		desired := cfg.LUKSForDevice(devicePath)
+		desiredOpts := dmcrypt.OpenOptions{
+			NoReadWorkqueue:  desired.NoReadWorkqueue,
+			NoWriteWorkqueue: desired.NoWriteWorkqueue,
+		}
+		mismatches, err := activationFlagMismatches(dmcryptManager, deviceName, desiredOpts)
+		if err != nil {
+			dmcryptManager.SecureEraseKey(&key)
+			return fmt.Errorf("failed to read activation flags of %s: %w", deviceName, err)
+		}
+		if len(mismatches) == 0 {
+			dmcryptManager.SecureEraseKey(&key)
+			logger.WithField("mapped_device", mappedDevice).Info("Device is already decrypted with the configured activation flags")
+			fmt.Printf("Device already decrypted, activation flags match: %s\n", mappedDevice)
+			summary.Result = summaryAlreadyOpen
+			return nil
+		}
+
+		logger.WithFields(logrus.Fields{
+			"mapped_device": mappedDevice,
+			"mismatches":    strings.Join(mismatches, "; "),
+		}).Info("Activation flags differ from the configuration, reopening the device")
+		if err := dmcryptManager.CloseDevice(deviceName); err != nil {
+			dmcryptManager.SecureEraseKey(&key)
+			return fmt.Errorf("failed to close %s to apply its activation flags (%s); unmount it first: %w",
+				deviceName, strings.Join(mismatches, "; "), err)
+		}
+		openOpts.NoReadWorkqueue = desiredOpts.NoReadWorkqueue
+		openOpts.NoWriteWorkqueue = desiredOpts.NoWriteWorkqueue
+	} else if err == nil {
+		if !forceUnlock {
 			dmcryptManager.SecureEraseKey(&key)
 			logger.WithField("mapped_device", mappedDevice).Info("Device is already decrypted")
 			fmt.Printf("Device already decrypted: %s\n", mappedDevice)
+			summary.Result = summaryAlreadyOpen
 			return nil
 		}
 
-		// Open the LUKS device
-		logger.Info("Opening LUKS device")
-		err = dmcryptManager.OpenDevice(devicePath, key, deviceName)
-		if err != nil {
+		// A stale mapping left by a crash is closed and reopened; a working one is left alone
+		healthErr := dmcryptManager.CheckMapping(deviceName)
+		if healthErr == nil {
+			dmcryptManager.SecureEraseKey(&key)
+			logger.WithField("mapped_device", mappedDevice).Info("Existing mapping is healthy, nothing to recover")
+			fmt.Printf("Device already decrypted and healthy: %s\n", mappedDevice)
+			summary.Result = summaryAlreadyOpen
+			return nil
+		}
+
+		logger.WithError(healthErr).WithField("mapped_device", mappedDevice).Warn("Existing mapping is broken, closing it before reopening")
+		if err := dmcryptManager.RemoveMapping(deviceName); err != nil {
 			dmcryptManager.SecureEraseKey(&key)
-			return fmt.Errorf("failed to open LUKS device: %w", err)
+			return fmt.Errorf("failed to remove broken mapping %s: %w", deviceName, err)
 		}
+	}
 
-		// Clean up the key from memory
+	// Refuse to create a second mapping of a device already opened under another name
+	existing, err := dmcryptManager.FindMappingsForDevice(devicePath)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to check for existing mappings of device")
+	} else if len(existing) > 0 {
 		dmcryptManager.SecureEraseKey(&key)
+		return fmt.Errorf("device %s is already open as %s; close that mapping first or decrypt with --name %s",
+			devicePath, strings.Join(existing, ", "), existing[0])
+	}
 
-		logger.WithFields(logrus.Fields{
-			"device_path":   devicePath,
-			"uuid":          uuid,
-			"mapped_device": mappedDevice,
-		}).Info("Device decryption completed successfully")
+	// Devices encrypted with workqueue bypass flags need cryptsetup 2.4+ to open the same way
+	if openOpts.RequiresPerfFlags() {
+		if err := validator.RequireCryptsetupVersion(2, 4, "no_read_workqueue/no_write_workqueue"); err != nil {
+			dmcryptManager.SecureEraseKey(&key)
+			return err
+		}
+	}
+
+	// Open the LUKS device
+	logger.Info("Opening LUKS device")
+	err = dmcryptManager.OpenDeviceWithOptions(devicePath, key, deviceName, openOpts)
+	if err != nil {
+		dmcryptManager.SecureEraseKey(&key)
+		// A stale cached key (e.g. after rotation) must not be reused by the next retry
+		if cached {
+			if flushErr := flushCachedKey(kr, uuid); flushErr != nil {
+				logger.WithError(flushErr).Warn("Failed to remove cached key from keyring")
+			}
+		}
+		return fmt.Errorf("failed to open LUKS device: %w", err)
+	}
 
-		fmt.Printf("Device decrypted successfully:\n")
-		fmt.Printf("  UUID: %s\n", uuid)
-		fmt.Printf("  Device: %s\n", devicePath)
-		fmt.Printf("  Mapped device: %s\n", mappedDevice)
+	// Clean up the key from memory
+	dmcryptManager.SecureEraseKey(&key)
 
-		return nil
-	},
+	// Integrity mappings need no special open flags, but confirm dm-integrity is active
+	if integrity != "" {
+		active, err := dmcryptManager.GetIntegrityStatus(deviceName)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to query integrity status of mapping")
+		} else if active == "" {
+			logger.WithField("integrity", integrity).Warn("Device was formatted with integrity protection but the mapping reports none")
+		} else {
+			logger.WithField("integrity", active).Info("Integrity protection is active")
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"device_path":   devicePath,
+		"uuid":          uuid,
+		"mapped_device": mappedDevice,
+	}).Info("Device decryption completed successfully")
+
+	// Record --name so later decrypts and resize find the mapping under the same name
+	if customName != "" {
+		recordCtx, recordCancel := context.WithTimeout(parent, cfg.Vault.Timeout())
+		recordMappingName(recordCtx, vaultClient, uuid, profile, customName)
+		recordCancel()
+	}
+
+	if err := hookRunner.Run(hooks.PostDecrypt, hooks.Event{UUID: uuid, Device: devicePath, MappedDevice: mappedDevice}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Device decrypted successfully:\n")
+	fmt.Printf("  UUID: %s\n", uuid)
+	fmt.Printf("  Device: %s\n", devicePath)
+	if stablePath, err := dmcryptManager.StablePath(devicePath); err == nil && stablePath != "" {
+		fmt.Printf("  Stable path: %s\n", stablePath)
+	}
+	fmt.Printf("  Mapped device: %s\n", mappedDevice)
+
+	return nil
 }
 
 var refreshAuthCmd = &cobra.Command{
@@ -395,6 +946,8 @@ For Token authentication, this command will:
 3. Note that token renewal may fail if the token is not renewable
 
 Use --status to only view authentication status without making changes.
+Use --status --output json to print the token and secret ID status as JSON for monitoring.
+Use --dry-run to run the expiry checks and report what would be refreshed without changing anything.
 Use --force to refresh credentials regardless of expiry.
 Use --no-update-config to skip updating the configuration file (AppRole only).
 Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
@@ -422,10 +975,32 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 		forceRefresh, _ := cmd.Flags().GetBool("force")
 		noUpdateConfig, _ := cmd.Flags().GetBool("no-update-config")
 		statusOnly, _ := cmd.Flags().GetBool("status")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		output, _ := cmd.Flags().GetString("output")
+		status := newStatusPrinter(os.Stdout, plainOutput)
+
+		switch output {
+		case "text":
+		case "json":
+			if !statusOnly {
+				return fmt.Errorf("--output json is only supported with --status")
+			}
+			// Keep stdout parseable
+			if logger.Out == os.Stdout {
+				logger.SetOutput(os.Stderr)
+			}
+		default:
+			return fmt.Errorf("invalid --output %q: must be text or json", output)
+		}
 
 		// Default behavior: update config unless --no-update-config is specified
 		updateConfig := !noUpdateConfig
 
+		// Refuse before a new secret ID is generated that could not be saved anywhere
+		if updateConfig && !statusOnly && cfgFile == config.StdinConfigPath && cfg.Vault.SecretIDCredential == "" {
+			return fmt.Errorf("configuration was read from stdin, there is no config file to save a new secret ID to\nUse --no-update-config to print the new secret ID instead")
+		}
+
 		// Check authentication method
 		isTokenAuth := cfg.Vault.VaultToken != ""
 
@@ -440,10 +1015,11 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 			"force_refresh":        forceRefresh,
 			"update_config":        updateConfig,
 			"status_only":          statusOnly,
+			"dry_run":              dryRun,
 		}).Info("Checking authentication status")
 
 		// Create context with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.Vault.Timeout())
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
 		defer cancel()
 
 		// First authenticate to get current token info
@@ -451,6 +1027,10 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 			return fmt.Errorf("failed to authenticate: %w", err)
 		}
 
+		if output == "json" {
+			return writeAuthStatusJSON(os.Stdout, collectAuthStatus(ctx, vaultClient, isTokenAuth, thresholdPercentage))
+		}
+
 		// Get token information
 		tokenInfo, err := vaultClient.GetTokenInfo(ctx)
 		if err != nil {
@@ -469,6 +1049,9 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 			}).Info("Current token information")
 
 			fmt.Printf("Token expires at: %s\n", vaultClient.GetTokenExpiry().Format(time.RFC3339))
+			if vaultClient.IsBatchToken() {
+				fmt.Println("Token type: batch token (non-renewable)")
+			}
 		}
 
 		// Handle authentication-specific information
@@ -504,7 +1087,7 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 						if err != nil {
 							logger.WithError(err).Debug("Failed to check secret ID expiry")
 						} else if secretIDExpiring {
-							fmt.Printf("⚠️  Secret ID has less than %.0f%% of its lifetime remaining!\n", thresholdPercentage*100)
+							status.Printf(statusWarn, "Secret ID has less than %.0f%% of its lifetime remaining!", thresholdPercentage*100)
 						}
 					} else {
 						fmt.Printf("Secret ID TTL: %s seconds (no expiration time available)\n", secretIDTTL)
@@ -521,115 +1104,22 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 			return nil
 		}
 
-		// Determine if refresh is needed based on authentication type
-		if isTokenAuth {
-			// Token authentication - handle token refresh
-			var needsTokenRefresh bool
-
-			if forceRefresh {
-				// Force refresh regardless of expiry
-				logger.Info("Force refresh requested for token")
-				needsTokenRefresh = true
-				fmt.Printf("🔄 Force refresh requested, attempting to renew token\n")
-			} else if !statusOnly {
-				// Check if token is expiring by percentage threshold
-				tokenExpiring, err := vaultClient.IsTokenExpiringByPercentage(ctx, thresholdPercentage)
-				if err != nil {
-					logger.WithError(err).Warn("Failed to check token expiry percentage")
-					return fmt.Errorf("failed to check token expiry: %w", err)
-				}
-
-				if tokenExpiring {
-					logger.Info("Token is expiring soon, refreshing automatically")
-					needsTokenRefresh = true
-					fmt.Printf("🔄 Token has less than %.0f%% of its lifetime remaining, refreshing automatically\n", thresholdPercentage*100)
-				} else {
-					logger.Info("Token is not expiring soon, no refresh needed")
-					fmt.Printf("✅ Token has more than %.0f%% of its lifetime remaining, no refresh needed\n", thresholdPercentage*100)
-				}
-			}
-
-			// If we need to refresh token, do it now
-			if needsTokenRefresh {
-				logger.Info("Attempting to renew token")
-				if err := vaultClient.RefreshToken(ctx); err != nil {
-					// Token refresh might fail if non-renewable
-					logger.WithError(err).Warn("Token refresh failed")
-					fmt.Printf("⚠️  Token refresh failed: %v\n", err)
-					fmt.Println("Note: Token may not be renewable. You may need to generate a new token.")
-				} else {
-					logger.Info("Successfully renewed token")
-					fmt.Println("✅ Token renewed successfully")
-
-					// Display new expiry
-					fmt.Printf("New token expiry: %s\n", vaultClient.GetTokenExpiry().Format(time.RFC3339))
-				}
-			}
-		} else {
-			// AppRole authentication - handle secret ID refresh
-			var needsSecretIDRefresh bool
-
-			if forceRefresh {
-				// Force refresh regardless of expiry
-				logger.Info("Force refresh requested")
-				needsSecretIDRefresh = true
-				fmt.Printf("🔄 Force refresh requested, generating new secret ID\n")
-			} else if cfg.Vault.AppRoleName != "" && !statusOnly {
-				// Default behavior: check if secret ID is expiring by percentage
-				secretIDExpiring, err := vaultClient.IsSecretIDExpiringByPercentage(ctx, thresholdPercentage)
-				if err != nil {
-					logger.WithError(err).Warn("Failed to check secret ID expiry")
-					return fmt.Errorf("failed to check secret ID expiry: %w", err)
-				}
-
-				if secretIDExpiring {
-					logger.Info("Secret ID is expiring soon, refreshing automatically")
-					needsSecretIDRefresh = true
-					fmt.Printf("🔄 Secret ID has less than %.0f%% of its lifetime remaining, refreshing automatically\n", thresholdPercentage*100)
-				} else {
-					logger.Info("Secret ID is not expiring soon, no refresh needed")
-					fmt.Printf("✅ Secret ID has more than %.0f%% of its lifetime remaining, no refresh needed\n", thresholdPercentage*100)
-				}
-			}
-
-			// If we need to refresh secret ID, do it now
-			if needsSecretIDRefresh {
-				logger.Info("Generating new secret ID")
-				newSecretID, err := vaultClient.RefreshSecretID(ctx)
-				if err != nil {
-					return fmt.Errorf("failed to refresh secret ID: %w", err)
-				}
-
-				logger.Info("Successfully generated new secret ID")
-
-				if updateConfig {
-					logger.WithField("config_path", cfgFile).Info("Updating config file with new secret ID")
-					if err := config.UpdateSecretID(cfgFile, newSecretID); err != nil {
-						return fmt.Errorf("failed to update config file: %w", err)
-					}
-					logger.Info("Config file updated successfully")
-					fmt.Printf("✅ New secret ID saved to config: %s\n", cfgFile)
-				} else {
-					fmt.Printf("🆔 New secret ID generated:\n%s\n", newSecretID)
-					fmt.Println("\n💡 To save to config file, remove the --no-update-config flag")
-					fmt.Println("   Or manually update your config file:")
-					fmt.Printf("   secret_id = \"%s\"\n", newSecretID)
-				}
-
-				// Update in-memory config and re-authenticate to verify new secret ID works
-				cfg.Vault.SecretID = newSecretID
-				logger.Info("Testing new secret ID by re-authenticating")
-				if err := vaultClient.Authenticate(ctx); err != nil {
-					return fmt.Errorf("failed to authenticate with new secret ID: %w", err)
-				}
-				fmt.Println("✅ New secret ID verified successfully")
-			}
+		if err := refreshCredentials(ctx, vaultClient, status, refreshOptions{
+			threshold:    thresholdPercentage,
+			force:        forceRefresh,
+			updateConfig: updateConfig,
+			tokenAuth:    isTokenAuth,
+			dryRun:       dryRun,
+		}); err != nil {
+			return err
 		}
 
-		if statusOnly {
-			fmt.Println("\n📊 Status check completed.")
+		if dryRun {
+			status.Println()
+			status.Printf(statusDone, "Dry run completed, no changes made.")
 		} else {
-			fmt.Println("\n✅ Authentication management completed successfully.")
+			status.Println()
+			status.Printf(statusOK, "Authentication management completed successfully.")
 		}
 
 		return nil
@@ -638,10 +1128,12 @@ Use --threshold-percentage to override the default 25% threshold (0.0-1.0).`,
 
 func init() {
 	// Global flags
-	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "/etc/vault-dm-crypt/config.toml", "config file path")
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", defaultConfigFile, "config file path, or - to read the config from stdin")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debug output")
 	rootCmd.PersistentFlags().IntVar(&retry, "retry", 30, "retry timeout in seconds for Vault connection")
+	rootCmd.PersistentFlags().StringVar(&vaultMountPath, "vault-mount-path", "", "path the AppRole auth method is mounted at (overrides approle_mount_path)")
+	rootCmd.PersistentFlags().DurationVar(&lockTimeout, "lock-timeout", 0, "wait this long for another operation on the same device to finish (0 fails immediately)")
 
 	// Add subcommands
 	rootCmd.AddCommand(encryptCmd)
@@ -650,19 +1142,164 @@ func init() {
 
 	// Add flags specific to encrypt command
 	encryptCmd.Flags().BoolP("force", "f", false, "force encryption even if device contains data")
+	encryptCmd.Flags().BoolP("yes", "y", false, "do not ask for confirmation before formatting the device")
+	encryptCmd.Flags().Bool("key-stdin", false, "read a 512-byte key from stdin instead of generating one, encoded as set by [luks] key_encoding (base64 by default)")
+	encryptCmd.Flags().StringArray("tag", nil, "store a key=value tag with the key in Vault, e.g. --tag ticket=OPS-123 (repeatable)")
+	encryptCmd.Flags().String("device-resolution", "strict", "how to handle LVM/multipath member devices: strict (refuse) or follow (format the top-level device instead)")
+	encryptCmd.Flags().Bool("store-only", false, "store a new key in Vault under the given or a generated UUID without formatting a device")
+	encryptCmd.Flags().String("format-from-vault", "", "format the device with the key already stored in Vault for this UUID")
+	encryptCmd.Flags().String("profile", "", "with --store-only or --format-from-vault, store the key in the Vault location of this [[device]] profile")
+	encryptCmd.Flags().Bool("verify-after", true, "close the new mapping and reopen it with the key read back from Vault before reporting success (default from [general] verify_after)")
+	encryptCmd.Flags().String("mkfs", "", "create a filesystem of this type (ext4 or xfs) on the opened device and record it in Vault")
+	encryptCmd.Flags().Uint64("offset", 0, "start the encrypted data this many 512-byte sectors into the device (luksFormat --offset); recorded in Vault")
+	encryptCmd.Flags().String("label", "", "LUKS2 header label (luksFormat --label, at most 47 bytes), e.g. the device's role; recorded in Vault")
+	encryptCmd.Flags().String("subsystem", "", "LUKS2 header subsystem (luksFormat --subsystem, at most 47 bytes), e.g. the storage pool; recorded in Vault")
+	encryptCmd.Flags().Int("boot-priority", 0, "order the boot decrypt service after those of devices with a lower priority, e.g. to open a metadata device before data devices")
+	encryptCmd.Flags().Bool("prefer-stable-path", false, "refuse kernel device names such as /dev/sdb, which can change between boots; use a /dev/disk/by-id path")
+	encryptCmd.Flags().String("resume-wipe", "", "continue the interrupted integrity wipe of the opened device with this UUID")
+	encryptCmd.Flags().Bool("loop", false, "when the device is a regular file such as a disk image, attach it to a loop device and encrypt that; the file is recorded in Vault and reattached by decrypt")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "format-from-vault")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "boot-priority")
+	encryptCmd.MarkFlagsMutuallyExclusive("resume-wipe", "store-only")
+	encryptCmd.MarkFlagsMutuallyExclusive("resume-wipe", "format-from-vault")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "offset")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "offset")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "label")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "label")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "subsystem")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "subsystem")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "key-stdin")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "tag")
+	encryptCmd.MarkFlagsMutuallyExclusive("store-only", "loop")
+	encryptCmd.MarkFlagsMutuallyExclusive("format-from-vault", "loop")
+	encryptCmd.MarkFlagsMutuallyExclusive("resume-wipe", "loop")
+	encryptCmd.Flags().String("from-file", "", "encrypt every device listed in this file, one per line ('#' starts a comment); requires --yes or --force")
+	encryptCmd.Flags().Int("jobs", defaultBatchJobs, "with --from-file, how many devices to encrypt at once")
+	encryptCmd.MarkFlagsMutuallyExclusive("from-file", "store-only")
+	encryptCmd.MarkFlagsMutuallyExclusive("from-file", "format-from-vault")
+	encryptCmd.MarkFlagsMutuallyExclusive("from-file", "resume-wipe")
+	encryptCmd.MarkFlagsMutuallyExclusive("from-file", "key-stdin")
 
 	// Add flags specific to decrypt command
-	decryptCmd.Flags().StringP("name", "n", "", "custom name for the device mapping")
+	decryptCmd.Flags().StringP("name", "n", "", "custom name for the device mapping, recorded in Vault and reused by later decrypts")
+	decryptCmd.Flags().String("device-resolution", "follow", "how to handle LVM/multipath member devices: strict (refuse) or follow (use the top-level device)")
+	decryptCmd.Flags().Bool("force-unlock", false, "if the device is already open, check the mapping and close and reopen it when broken")
+	decryptCmd.Flags().String("compat", "", "also look for keys stored by Python vaultlocker (vaultlocker/<uuid> on a KV v1 backend) when the native read finds none")
+	decryptCmd.Flags().String("profile", "", "read the key from the Vault location of this [[device]] profile (recorded by encrypt in the boot decrypt service)")
+	decryptCmd.Flags().Bool("wait-for-approval", false, "when the key is guarded by a Vault Enterprise control group, wait until the request is approved instead of failing")
+	decryptCmd.Flags().Bool("passphrase", false, "prompt for a passphrase on the terminal and open the device with it instead of the key in Vault (last resort when Vault is unreachable)")
+	decryptCmd.Flags().String("key-field", "", "read the key from this secret field instead of [vault] key_field / key_fields")
+	decryptCmd.Flags().Int("secret-version", 0, "read this KV v2 version of the key instead of the latest (see key-history)")
+	decryptCmd.Flags().Bool("ensure", false, "if the device is already open with activation flags that differ from the configuration, close and reopen it with the configured flags")
+	decryptCmd.Flags().String("from-file", "", "open every device whose UUID is listed in this file, one per line ('#' starts a comment)")
+	decryptCmd.Flags().Int("jobs", defaultBatchJobs, "with --from-file, how many devices to open at once")
+	decryptCmd.MarkFlagsMutuallyExclusive("ensure", "force-unlock")
+	decryptCmd.MarkFlagsMutuallyExclusive("ensure", "passphrase")
+	decryptCmd.MarkFlagsMutuallyExclusive("from-file", "name")
+	decryptCmd.MarkFlagsMutuallyExclusive("from-file", "passphrase")
+	decryptCmd.MarkFlagsMutuallyExclusive("from-file", "secret-version")
 
 	// Add flags specific to refresh-auth command
 	refreshAuthCmd.Flags().Float64P("threshold-percentage", "t", 0.25, "percentage of lifetime remaining to trigger refresh (0.0-1.0, default 0.25 = 25%)")
 	refreshAuthCmd.Flags().BoolP("force", "f", false, "force refresh of credentials regardless of expiry")
 	refreshAuthCmd.Flags().Bool("no-update-config", false, "skip updating the config file with new secret ID (AppRole only)")
 	refreshAuthCmd.Flags().Bool("status", false, "only show authentication status, don't perform any operations")
+	refreshAuthCmd.Flags().Bool("dry-run", false, "report what would be refreshed and saved without generating a secret ID, renewing the token or writing the config")
+	refreshAuthCmd.Flags().String("output", "text", "status output format: text or json (json requires --status)")
+	refreshAuthCmd.MarkFlagsMutuallyExclusive("status", "dry-run")
 }
 
-// configureLogger sets up the logger based on configuration
-func configureLogger(logConfig config.LoggingConfig) error {
+// controlGroupPollInterval is how often decrypt --wait-for-approval checks a control group request
+const controlGroupPollInterval = 15 * time.Second
+
+// retrieveDecryptKey reads the key and its open options for a device from Vault, from the
+// location of profile if one is given. When approvalCtx is not nil and the key is held by a
+// control group, it waits on approvalCtx for the request to be approved.
+func retrieveDecryptKey(ctx, approvalCtx context.Context, uuid string, secretVersion int, compat string, profile *config.DeviceConfig, key, integrity, loopFile *string, openOpts *dmcrypt.OpenOptions) error {
+	logger.Debug("Retrieving encryption key from Vault")
+	store := storeForProfile(profile)
+	vaultConfig := cfg.VaultForProfile(profile)
+	var secretData map[string]interface{}
+	var secret *vault.DeviceSecret
+	useSecret := func(fields []string) error {
+		var err error
+		if secret, err = vault.DecodeDeviceSecret(secretData); err != nil {
+			return err
+		}
+		keyStr, err := deviceKeyFromSecret(secretData, uuid, fields)
+		if err != nil {
+			return err
+		}
+
+		*key = keyStr
+		*integrity = secret.Integrity
+		*loopFile = secret.LoopFile
+		openOpts.NoReadWorkqueue = secret.NoReadWorkqueue
+		openOpts.NoWriteWorkqueue = secret.NoWriteWorkqueue
+		return nil
+	}
+	err := vaultClient.WithRetry(ctx, func() error {
+		// Get the key path with placeholders replaced
+		vaultPath, err := vaultConfig.SecretPath(uuid)
+		if err != nil {
+			return err
+		}
+		var fields []string
+		secretData, fields, err = readDecryptSecret(ctx, store, uuid, vaultPath, secretVersion, compat)
+		if err != nil {
+			return err
+		}
+		return useSecret(fields)
+	})
+
+	var cgErr *vault.ControlGroupError
+	if approvalCtx != nil && stderrors.As(err, &cgErr) {
+		logger.WithFields(logrus.Fields{
+			"accessor":  cgErr.Accessor,
+			"approvals": cgErr.Approvals,
+		}).Warn("Key is held by a control group, waiting for approval")
+		if secretData, err = vaultClient.WaitForControlGroup(approvalCtx, cgErr, controlGroupPollInterval); err == nil {
+			err = useSecret(cfg.Vault.KeyFieldNames())
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to retrieve key from Vault: %w", err)
+	}
+
+	// Checked once the read succeeds, since retrying cannot fix tampered metadata
+	if err := checkStoredMetadata(*key, uuid, secretData); err != nil {
+		dmcryptManager.SecureEraseKey(key)
+		return err
+	}
+
+	logger.Info("Encryption key retrieved from Vault successfully")
+
+	// Purely advisory: an old key still opens the device
+	if warning := keyAgeWarning(uuid, secret, time.Now(), cfg.Security.MaxKeyAge()); warning != "" {
+		logger.WithField("max_key_age_days", cfg.Security.MaxKeyAgeDays).Warn(warning)
+	}
+	return nil
+}
+
+// finishTracing ends the command's root span with the command's result and flushes the trace
+func finishTracing(err error) {
+	if commandSpan != nil {
+		tracing.End(commandSpan, err)
+	}
+	if shutdownTracing == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+		logger.WithError(shutdownErr).Warn("Failed to export traces")
+	}
+}
+
+// configureLogger sets up the logger based on configuration. A log file is created with fileMode.
+func configureLogger(logConfig config.LoggingConfig, fileMode os.FileMode) error {
 	// Set log level
 	level, err := logrus.ParseLevel(strings.ToLower(logConfig.Level))
 	if err != nil {
@@ -680,6 +1317,7 @@ func configureLogger(logConfig config.LoggingConfig) error {
 		logger.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp:   true,
 			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+			DisableColors:   plainOutput,
 		})
 	default:
 		return fmt.Errorf("invalid log format: %s", logConfig.Format)
@@ -693,7 +1331,7 @@ func configureLogger(logConfig config.LoggingConfig) error {
 		logger.SetOutput(os.Stderr)
 	default:
 		// Assume it's a file path
-		file, err := os.OpenFile(logConfig.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		file, err := fileperm.OpenFile(logConfig.Output, os.O_WRONLY|os.O_APPEND, fileMode)
 		if err != nil {
 			return fmt.Errorf("failed to open log file %s: %w", logConfig.Output, err)
 		}
@@ -703,13 +1341,71 @@ func configureLogger(logConfig config.LoggingConfig) error {
 	return nil
 }
 
+// configPermissionsWarning warns when the config file at path can be read by every user, as it
+// may hold a Vault token or secret ID. A config read from stdin has no permissions to check.
+func configPermissionsWarning(path string) string {
+	if path == "" || path == config.StdinConfigPath {
+		return ""
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm()&0004 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Config file %s is readable by all users (mode %04o) and may hold Vault credentials; restrict it with chmod 600", path, info.Mode().Perm())
+}
+
+// decryptBootCommand is the command that decrypts a device at boot with the current configuration
+// and the device's profile
+func decryptBootCommand(uuid string, profile *config.DeviceConfig) string {
+	command := systemdManager.InstalledBinaryPath(systemd.UnitDir)
+	// A config read from stdin cannot be given again at boot, so the default is used
+	if configPath, err := filepath.Abs(cfgFile); err == nil && cfgFile != config.StdinConfigPath && configPath != defaultConfigFile {
+		command += " --config " + configPath
+	}
+	command += " decrypt"
+	for _, arg := range profileDecryptArgs(profile) {
+		command += " " + arg
+	}
+	return command + " " + uuid
+}
+
+// writeDecryptServiceOverride points the boot decrypt service of a device encrypted with a
+// non-default configuration at that configuration, so it is decrypted with the same Vault settings.
+// A device whose profile stores its key elsewhere has the profile recorded too.
+func writeDecryptServiceOverride(uuid string, profile *config.DeviceConfig) {
+	if cfgFile == config.StdinConfigPath {
+		logger.Warn("Configuration was read from stdin - device will be decrypted with the default configuration on boot")
+		return
+	}
+
+	configPath, err := filepath.Abs(cfgFile)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to resolve config path for decrypt service override")
+		return
+	}
+
+	decryptArgs := profileDecryptArgs(profile)
+	if configPath == defaultConfigFile {
+		if len(decryptArgs) == 0 {
+			return
+		}
+		configPath = ""
+	}
+
+	if err := systemdManager.WriteInstanceOverride(uuid, configPath, decryptArgs...); err != nil {
+		logger.WithError(err).Warn("Failed to write decrypt service override - device will be decrypted with the default configuration on boot")
+	}
+}
+
 // findDeviceByUUID finds a device path by its UUID
 func findDeviceByUUID(uuid string) (string, error) {
 	logger.WithField("uuid", uuid).Debug("Looking for device by UUID")
 
 	// Try the standard UUID path first
 	uuidPath := fmt.Sprintf("/dev/disk/by-uuid/%s", uuid)
-	if _, err := os.Stat(uuidPath); err == nil {
+	_, statErr := os.Stat(uuidPath)
+	if statErr == nil {
 		// Follow the symlink to get the actual device path
 		realPath, err := os.Readlink(uuidPath)
 		if err == nil {
@@ -741,5 +1437,105 @@ func findDeviceByUUID(uuid string) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("device with UUID %s not found", uuid)
+	// blkid exits 2 when no device has the UUID; anything else means the search itself failed
+	var cmdErr *shell.CommandError
+	if err != nil && !(stderrors.As(err, &cmdErr) && cmdErr.ExitCode == blkidNotFoundExitCode) {
+		return "", fmt.Errorf("failed to search for device with UUID %s: %w", uuid, err)
+	}
+	if statErr != nil && !stderrors.Is(statErr, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to search for device with UUID %s: %w", uuid, statErr)
+	}
+
+	return "", &deviceNotFoundError{uuid: uuid}
+}
+
+// blkidNotFoundExitCode is blkid's exit status when no device matches
+const blkidNotFoundExitCode = 2
+
+// deviceNotFoundError reports that no device on the host has a UUID, as opposed to a search
+// that failed, e.g. on a permission error
+type deviceNotFoundError struct {
+	uuid string
+}
+
+func (e *deviceNotFoundError) Error() string {
+	return fmt.Sprintf("device with UUID %s not found", e.uuid)
+}
+
+// isDeviceNotFound reports whether err is a definite deviceNotFoundError
+func isDeviceNotFound(err error) bool {
+	var notFound *deviceNotFoundError
+	return stderrors.As(err, &notFound)
+}
+
+// acquireOperationLock takes the per-device advisory lock so concurrent invocations
+// cannot operate on the same device or UUID at once
+func acquireOperationLock(target string) (*lock.Lock, error) {
+	logger.WithFields(logrus.Fields{
+		"target":       target,
+		"lock_timeout": lockTimeout,
+	}).Debug("Acquiring operation lock")
+
+	opLock, err := lock.Acquire(lock.DefaultDir, target, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithField("lock_file", opLock.Path()).Debug("Operation lock acquired")
+	return opLock, nil
+}
+
+// deviceLockTarget is the operation lock target for a device, its path with symlinks such as
+// /dev/disk/by-uuid/... resolved, so every command locks a device under the same name
+func deviceLockTarget(device string) string {
+	return dmcrypt.ResolveDevicePath(device)
+}
+
+// releaseOperationLock releases a lock taken by acquireOperationLock or acquireConcurrencySlot
+func releaseOperationLock(opLock *lock.Lock) {
+	if err := opLock.Release(); err != nil {
+		logger.WithError(err).Warn("Failed to release operation lock")
+	}
+}
+
+// acquireConcurrencySlot waits for one of the host-wide [general] max_concurrent slots, so that
+// dozens of decrypt units started together at boot do not all run cryptsetup and query Vault at
+// once. It returns a nil lock when no limit is configured.
+func acquireConcurrencySlot() (*lock.Lock, error) {
+	if cfg.General.MaxConcurrent == 0 {
+		return nil, nil
+	}
+
+	slot, err := lock.AcquireSlot(context.Background(), lock.ConcurrencyDir, cfg.General.MaxConcurrent, func() {
+		logger.WithField("max_concurrent", cfg.General.MaxConcurrent).Info("Waiting for another vault-dm-crypt operation to finish")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithField("lock_file", slot.Path()).Debug("Concurrency slot acquired")
+	return slot, nil
+}
+
+// keyStdinTimeout bounds how long encrypt --key-stdin waits for the key
+const keyStdinTimeout = 30 * time.Second
+
+// readKeyFromStdin reads an externally supplied key from stdin.
+// Terminals are rejected so the key is never echoed or typed interactively.
+func readKeyFromStdin() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect stdin: %w", err)
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("--key-stdin requires the key to be piped in, refusing to read from a terminal")
+	}
+
+	logger.Debug("Reading encryption key from stdin")
+	key, err := dmcryptManager.ReadEncodedKey(os.Stdin, keyStdinTimeout, cfg.LUKS.KeyEncoding)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key from stdin: %w", err)
+	}
+
+	return key, nil
 }
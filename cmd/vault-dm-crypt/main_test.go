@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/lock"
+)
+
+func TestConfigureLoggerFileMode(t *testing.T) {
+	originalOut, originalLevel, originalFormatter := logger.Out, logger.Level, logger.Formatter
+	t.Cleanup(func() {
+		logger.SetOutput(originalOut)
+		logger.SetLevel(originalLevel)
+		logger.SetFormatter(originalFormatter)
+	})
+
+	logConfig := config.LoggingConfig{Level: "info", Format: "text"}
+
+	t.Run("log file created with the configured mode", func(t *testing.T) {
+		for _, mode := range []os.FileMode{0600, 0640} {
+			logConfig.Output = filepath.Join(t.TempDir(), "vault-dm-crypt.log")
+			require.NoError(t, configureLogger(logConfig, mode))
+			logger.Info("written")
+
+			info, err := os.Stat(logConfig.Output)
+			require.NoError(t, err)
+			assert.Equal(t, mode, info.Mode().Perm())
+		}
+	})
+
+	t.Run("world-readable log file is narrowed", func(t *testing.T) {
+		logConfig.Output = filepath.Join(t.TempDir(), "vault-dm-crypt.log")
+		require.NoError(t, os.WriteFile(logConfig.Output, []byte("earlier\n"), 0600))
+		require.NoError(t, os.Chmod(logConfig.Output, 0666))
+
+		require.NoError(t, configureLogger(logConfig, config.DefaultConfig().Security.FilePermissions()))
+
+		info, err := os.Stat(logConfig.Output)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+}
+
+func TestConfigPermissionsWarning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[vault]\n"), 0600))
+
+	assert.Empty(t, configPermissionsWarning(path))
+
+	require.NoError(t, os.Chmod(path, 0640))
+	assert.Empty(t, configPermissionsWarning(path), "group-readable configs are not warned about")
+
+	require.NoError(t, os.Chmod(path, 0644))
+	warning := configPermissionsWarning(path)
+	assert.Contains(t, warning, path)
+	assert.Contains(t, warning, "readable by all users (mode 0644)")
+
+	assert.Empty(t, configPermissionsWarning(config.StdinConfigPath))
+	assert.Empty(t, configPermissionsWarning(filepath.Join(t.TempDir(), "missing.toml")))
+}
+
+func TestDeviceLockTargetExcludesAliases(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "sdd1")
+	require.NoError(t, os.WriteFile(device, nil, 0600))
+	alias := filepath.Join(dir, "by-uuid-link")
+	require.NoError(t, os.Symlink(device, alias))
+
+	resolved, err := filepath.EvalSymlinks(device)
+	require.NoError(t, err)
+	assert.Equal(t, resolved, deviceLockTarget(alias))
+	assert.Equal(t, resolved, deviceLockTarget(device))
+
+	// Encrypt of the path and decrypt of the alias contend for the same lock
+	lockDir := t.TempDir()
+	held, err := lock.Acquire(lockDir, deviceLockTarget(device), 0)
+	require.NoError(t, err)
+	defer held.Release()
+
+	_, err = lock.Acquire(lockDir, deviceLockTarget(alias), 0)
+	assert.ErrorIs(t, err, lock.ErrInProgress)
+}
+
+func TestDeviceResolutionDefaults(t *testing.T) {
+	// Formatting a PV or multipath path would destroy the device built on it, so encrypt must ask
+	assert.Equal(t, string(dmcrypt.ResolutionStrict), encryptCmd.Flags().Lookup("device-resolution").DefValue)
+	assert.Equal(t, string(dmcrypt.ResolutionFollow), decryptCmd.Flags().Lookup("device-resolution").DefValue)
+}
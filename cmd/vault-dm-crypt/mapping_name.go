@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// mappingNameKey is the KV v2 custom metadata key under which decrypt --name records the
+// mapping name, so later commands can find a mapping that does not follow name_template
+const mappingNameKey = "mapping_name"
+
+// mappingNameStore is the subset of the Vault client used to record and look up mapping names
+type mappingNameStore interface {
+	ReadCustomMetadata(ctx context.Context, path string) (map[string]string, error)
+	UpdateCustomMetadata(ctx context.Context, path string, values map[string]string) error
+}
+
+// customMetadataPath returns the secret path whose custom metadata holds what is recorded about
+// uuid, such as its mapping name. Custom metadata is only used with KV v2 on the configured backend.
+func customMetadataPath(uuid string, profile *config.DeviceConfig) (string, bool) {
+	vaultConfig := cfg.VaultForProfile(profile)
+	if vaultConfig.KVVersion != "2" || vaultConfig.Backend != cfg.Vault.Backend {
+		return "", false
+	}
+
+	vaultPath, err := vaultConfig.SecretPath(uuid)
+	if err != nil {
+		return "", false
+	}
+	return vaultPath, true
+}
+
+// storedMappingName returns the mapping name recorded for uuid, or "" if there is none or it
+// cannot be read. A recorded name that is not a valid mapping name is ignored.
+func storedMappingName(ctx context.Context, store mappingNameStore, uuid string, profile *config.DeviceConfig) string {
+	vaultPath, ok := customMetadataPath(uuid, profile)
+	if !ok {
+		return ""
+	}
+
+	metadata, err := store.ReadCustomMetadata(ctx, vaultPath)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to read recorded mapping name")
+		return ""
+	}
+
+	name := metadata[mappingNameKey]
+	if name == "" {
+		return ""
+	}
+	if err := config.ValidateMappingName(name); err != nil {
+		logger.WithError(err).Warn("Ignoring invalid mapping name recorded in Vault")
+		return ""
+	}
+	return name
+}
+
+// recordMappingName records name as the mapping name of uuid unless it already is. The device
+// is open either way, so failures are only logged.
+func recordMappingName(ctx context.Context, store mappingNameStore, uuid string, profile *config.DeviceConfig, name string) {
+	vaultPath, ok := customMetadataPath(uuid, profile)
+	if !ok {
+		logger.Debug("Not recording mapping name: custom metadata requires kv_version = \"2\" on the configured backend")
+		return
+	}
+
+	metadata, err := store.ReadCustomMetadata(ctx, vaultPath)
+	if err == nil && metadata[mappingNameKey] == name {
+		return
+	}
+
+	if err := store.UpdateCustomMetadata(ctx, vaultPath, map[string]string{mappingNameKey: name}); err != nil {
+		logger.WithError(err).Warn("Failed to record mapping name in Vault")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid":        uuid,
+		"device_name": name,
+	}).Info("Recorded mapping name in Vault")
+}
+
+// resolveMappingName returns the mapping name for uuid: the name recorded by decrypt --name if
+// any, otherwise the one derived from name_template
+func resolveMappingName(ctx context.Context, store mappingNameStore, uuid string, profile *config.DeviceConfig) (string, error) {
+	if name := storedMappingName(ctx, store, uuid, profile); name != "" {
+		return name, nil
+	}
+	return cfg.MappingName(uuid)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+type fakeMappingNameStore struct {
+	metadata map[string]map[string]string
+	readErr  error
+	updates  int
+}
+
+func (f *fakeMappingNameStore) ReadCustomMetadata(ctx context.Context, path string) (map[string]string, error) {
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	return f.metadata[path], nil
+}
+
+func (f *fakeMappingNameStore) UpdateCustomMetadata(ctx context.Context, path string, values map[string]string) error {
+	f.updates++
+	if f.metadata[path] == nil {
+		f.metadata[path] = make(map[string]string)
+	}
+	for key, value := range values {
+		f.metadata[path][key] = value
+	}
+	return nil
+}
+
+func TestMappingNameRoundTrip(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Vault.KVVersion = "2"
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	ctx := context.Background()
+	store := &fakeMappingNameStore{metadata: make(map[string]map[string]string)}
+
+	name, err := resolveMappingName(ctx, store, uuid, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "vaultlocker-12345678123412341234123456789abc", name, "nothing recorded uses name_template")
+
+	recordMappingName(ctx, store, uuid, nil, "data")
+	assert.Equal(t, "data", store.metadata["vault-dm-crypt/node1/"+uuid][mappingNameKey])
+
+	name, err = resolveMappingName(ctx, store, uuid, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "data", name)
+
+	recordMappingName(ctx, store, uuid, nil, "data")
+	assert.Equal(t, 1, store.updates, "an unchanged name is not rewritten")
+}
+
+func TestStoredMappingName(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Vault.KVVersion = "2"
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	vaultPath := "vault-dm-crypt/node1/" + uuid
+	ctx := context.Background()
+
+	t.Run("invalid recorded name is ignored", func(t *testing.T) {
+		store := &fakeMappingNameStore{metadata: map[string]map[string]string{
+			vaultPath: {mappingNameKey: "../control"},
+		}}
+		assert.Empty(t, storedMappingName(ctx, store, uuid, nil))
+	})
+
+	t.Run("read failure falls back", func(t *testing.T) {
+		store := &fakeMappingNameStore{readErr: errors.New("permission denied")}
+		assert.Empty(t, storedMappingName(ctx, store, uuid, nil))
+	})
+
+	t.Run("kv v1 records nothing", func(t *testing.T) {
+		cfg.Vault.KVVersion = "1"
+		t.Cleanup(func() { cfg.Vault.KVVersion = "2" })
+
+		store := &fakeMappingNameStore{metadata: map[string]map[string]string{
+			vaultPath: {mappingNameKey: "data"},
+		}}
+		recordMappingName(ctx, store, uuid, nil, "other")
+		assert.Zero(t, store.updates)
+		assert.Empty(t, storedMappingName(ctx, store, uuid, nil))
+	})
+
+	t.Run("profile path prefix", func(t *testing.T) {
+		store := &fakeMappingNameStore{metadata: make(map[string]map[string]string)}
+		profile := &config.DeviceConfig{Name: "fast", PathPrefix: "fast-tier"}
+		recordMappingName(ctx, store, uuid, profile, "scratch")
+		assert.Equal(t, "scratch", store.metadata["fast-tier/"+uuid][mappingNameKey])
+		assert.Equal(t, "scratch", storedMappingName(ctx, store, uuid, profile))
+	})
+}
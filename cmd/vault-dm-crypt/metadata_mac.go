@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metadataMACField holds an HMAC over the metadata stored with a key, so that tampering with
+// it in Vault is detected on decrypt
+const metadataMACField = "metadata_mac"
+
+// errMetadataIntegrity is returned when the stored metadata does not match its MAC
+var errMetadataIntegrity = errors.New("metadata integrity check failed")
+
+// metadataMACFields are the stored fields covered by the MAC: those that decide which device is
+// opened, how it is opened and how the key is recovered
+var metadataMACFields = []string{
+	"device",
+	"device_by_id",
+	"filesystem",
+	"hostname",
+	"integrity",
+	"key_encoding",
+	"key_split",
+	"loop_file",
+	"no_read_workqueue",
+	"no_write_workqueue",
+	"offset",
+	"tpm_sealed",
+}
+
+// metadataMACKey returns the MAC key: [security] metadata_mac_key when set, otherwise a key
+// derived from the device key so that only holders of the device key can forge a MAC
+func metadataMACKey(deviceKey, configuredKey string) ([]byte, error) {
+	if configuredKey != "" {
+		return []byte(configuredKey), nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(deviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	derive := hmac.New(sha256.New, keyBytes)
+	derive.Write([]byte("vault-dm-crypt metadata mac"))
+	return derive.Sum(nil), nil
+}
+
+// computeMetadataMAC returns the hex HMAC-SHA256 of the covered metadata fields of secretData,
+// bound to uuid so an entry cannot be copied to another device's path
+func computeMetadataMAC(macKey []byte, uuid string, secretData map[string]interface{}) string {
+	fields := append([]string(nil), metadataMACFields...)
+	sort.Strings(fields)
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "uuid=%s\n", uuid)
+	for _, field := range fields {
+		if value, ok := secretData[field]; ok {
+			fmt.Fprintf(&message, "%s=%v\n", field, value)
+		}
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(message.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMetadataMAC checks the MAC stored in secretData. Entries stored without a MAC pass, so
+// keys written before [security] metadata_mac was enabled still decrypt.
+func verifyMetadataMAC(macKey []byte, uuid string, secretData map[string]interface{}) error {
+	stored, ok := secretData[metadataMACField].(string)
+	if !ok || stored == "" {
+		if _, present := secretData[metadataMACField]; present {
+			return fmt.Errorf("%w: %s is not a string", errMetadataIntegrity, metadataMACField)
+		}
+		return nil
+	}
+
+	expected := computeMetadataMAC(macKey, uuid, secretData)
+	if !hmac.Equal([]byte(stored), []byte(expected)) {
+		return fmt.Errorf("%w for %s: the stored metadata has been modified", errMetadataIntegrity, uuid)
+	}
+	return nil
+}
+
+// checkStoredMetadata verifies the metadata MAC of a stored key. When [security] metadata_mac is
+// enabled a key without one is refused, since removing the MAC would otherwise bypass the check.
+func checkStoredMetadata(deviceKey, uuid string, secretData map[string]interface{}) error {
+	if _, present := secretData[metadataMACField]; !present {
+		if cfg.Security.MetadataMAC {
+			return fmt.Errorf("%w: the key stored for %s has no %s", errMetadataIntegrity, uuid, metadataMACField)
+		}
+		return nil
+	}
+
+	macKey, err := metadataMACKey(deviceKey, cfg.Security.MetadataMACKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMetadataIntegrity, err)
+	}
+	return verifyMetadataMAC(macKey, uuid, secretData)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataMAC(t *testing.T) {
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	macKey, err := metadataMACKey(key, "")
+	require.NoError(t, err)
+
+	newSecret := func() map[string]interface{} {
+		data := map[string]interface{}{
+			"dmcrypt_key":       key,
+			"device":            "/dev/sdb1",
+			"hostname":          "node1",
+			"no_read_workqueue": true,
+			"created_at":        "2025-01-01T00:00:00Z",
+		}
+		data[metadataMACField] = computeMetadataMAC(macKey, uuid, data)
+		return data
+	}
+
+	t.Run("untouched metadata verifies", func(t *testing.T) {
+		assert.NoError(t, verifyMetadataMAC(macKey, uuid, newSecret()))
+	})
+
+	t.Run("uncovered fields may change", func(t *testing.T) {
+		data := newSecret()
+		data["created_at"] = "2026-01-01T00:00:00Z"
+		data["tags"] = map[string]interface{}{"ticket": "OPS-1"}
+		assert.NoError(t, verifyMetadataMAC(macKey, uuid, data))
+	})
+
+	tampered := map[string]func(map[string]interface{}){
+		"device swapped":    func(d map[string]interface{}) { d["device"] = "/dev/sdc1" },
+		"device removed":    func(d map[string]interface{}) { delete(d, "device") },
+		"flag cleared":      func(d map[string]interface{}) { d["no_read_workqueue"] = false },
+		"integrity added":   func(d map[string]interface{}) { d["integrity"] = "hmac-sha256" },
+		"mac replaced":      func(d map[string]interface{}) { d[metadataMACField] = "00" },
+		"mac not a string":  func(d map[string]interface{}) { d[metadataMACField] = 42 },
+		"hostname modified": func(d map[string]interface{}) { d["hostname"] = "node2" },
+	}
+	for name, tamper := range tampered {
+		t.Run(name, func(t *testing.T) {
+			data := newSecret()
+			tamper(data)
+			err := verifyMetadataMAC(macKey, uuid, data)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, errMetadataIntegrity))
+			assert.Contains(t, err.Error(), "metadata integrity check failed")
+		})
+	}
+
+	t.Run("entry copied to another UUID", func(t *testing.T) {
+		err := verifyMetadataMAC(macKey, "87654321-4321-4321-4321-cba987654321", newSecret())
+		assert.True(t, errors.Is(err, errMetadataIntegrity))
+	})
+
+	t.Run("different key", func(t *testing.T) {
+		otherKey, err := metadataMACKey("b3RoZXIta2V5", "")
+		require.NoError(t, err)
+		assert.True(t, errors.Is(verifyMetadataMAC(otherKey, uuid, newSecret()), errMetadataIntegrity))
+	})
+
+	t.Run("entry without a MAC passes", func(t *testing.T) {
+		data := newSecret()
+		delete(data, metadataMACField)
+		data["device"] = "/dev/sdc1"
+		assert.NoError(t, verifyMetadataMAC(macKey, uuid, data))
+	})
+
+	t.Run("configured key is used instead of the device key", func(t *testing.T) {
+		configured, err := metadataMACKey(key, "separate-secret")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("separate-secret"), configured)
+		assert.NotEqual(t, macKey, configured)
+	})
+}
+
+func TestStoredMetadataMAC(t *testing.T) {
+	useEncryptTestConfig(t)
+	cfg.Security.MetadataMAC = true
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+	vaultPath := "vault-dm-crypt/node1/" + uuid
+
+	store := newFakeKeyStore()
+	_, err := storeKey(context.Background(), store, uuid, key, keyRecord{Integrity: "hmac-sha256"}, true)
+	require.NoError(t, err)
+	require.Contains(t, store.secrets[vaultPath], metadataMACField)
+
+	loaded, record, err := loadStoredKey(context.Background(), store, uuid, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+	assert.Equal(t, "hmac-sha256", record.Integrity)
+
+	// Someone with write access to Vault removes the integrity setting
+	delete(store.secrets[vaultPath], "integrity")
+	_, _, err = loadStoredKey(context.Background(), store, uuid, nil, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metadata integrity check failed")
+
+	// Removing the MAC altogether must not bypass the check either
+	delete(store.secrets[vaultPath], metadataMACField)
+	_, _, err = loadStoredKey(context.Background(), store, uuid, nil, false)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errMetadataIntegrity))
+
+	// Without the option, keys stored without a MAC still load
+	cfg.Security.MetadataMAC = false
+	store.secrets[vaultPath]["integrity"] = "hmac-sha256"
+	_, _, err = loadStoredKey(context.Background(), store, uuid, nil, false)
+	require.NoError(t, err)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// orphanStatePath records since when each decrypt unit has been orphaned, for --prune-grace
+const orphanStatePath = "/var/lib/vault-dm-crypt/orphaned-units.json"
+
+// orphanTracker remembers when each decrypt unit was first seen orphaned, so that a unit whose
+// device is only slow to appear at boot is not pruned on a single observation
+type orphanTracker struct {
+	path  string
+	now   func() time.Time
+	since map[string]time.Time // Keyed by device UUID
+}
+
+// loadOrphanTracker reads the state file at path; a missing file means nothing is orphaned yet
+func loadOrphanTracker(path string) (*orphanTracker, error) {
+	tracker := &orphanTracker{path: path, now: time.Now, since: make(map[string]time.Time)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if stderrors.Is(err, os.ErrNotExist) {
+			return tracker, nil
+		}
+		return nil, fmt.Errorf("failed to read orphaned unit state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &tracker.since); err != nil {
+		return nil, fmt.Errorf("failed to parse orphaned unit state %s: %w", path, err)
+	}
+	return tracker, nil
+}
+
+// observe records that uuid is orphaned now and returns how long it has been orphaned
+func (t *orphanTracker) observe(uuid string) time.Duration {
+	now := t.now()
+	since, ok := t.since[uuid]
+	if !ok {
+		t.since[uuid] = now
+		return 0
+	}
+	return now.Sub(since)
+}
+
+// clear forgets uuid, e.g. because its device or key is back or its unit was disabled
+func (t *orphanTracker) clear(uuid string) {
+	delete(t.since, uuid)
+}
+
+// retain forgets every UUID not in uuids, so units removed by other means do not linger
+func (t *orphanTracker) retain(uuids map[string]bool) {
+	for uuid := range t.since {
+		if !uuids[uuid] {
+			delete(t.since, uuid)
+		}
+	}
+}
+
+// save writes the state file atomically
+func (t *orphanTracker) save() error {
+	data, err := json.MarshalIndent(t.since, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), ".orphaned-units-*")
+	if err != nil {
+		return fmt.Errorf("failed to write orphaned unit state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write orphaned unit state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write orphaned unit state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("failed to write orphaned unit state: %w", err)
+	}
+	return nil
+}
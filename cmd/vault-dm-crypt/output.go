@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// plainOutput replaces emoji in status output with ASCII markers and disables log colours
+var plainOutput bool
+
+// statusKind selects the marker printed before a status line
+type statusKind int
+
+const (
+	statusOK statusKind = iota
+	statusWarn
+	statusRefresh
+	statusNew
+	statusHint
+	statusDone
+)
+
+// statusMarkers are the decorated and plain markers for each kind of status line
+var statusMarkers = map[statusKind]struct{ emoji, plain string }{
+	statusOK:      {"✅", "[OK]"},
+	statusWarn:    {"⚠️ ", "[WARN]"},
+	statusRefresh: {"🔄", "[REFRESH]"},
+	statusNew:     {"🆔", "[NEW]"},
+	statusHint:    {"💡", "[HINT]"},
+	statusDone:    {"📊", "[DONE]"},
+}
+
+// statusPrinter writes human-facing status lines. Emoji are only used on a terminal; piped or
+// redirected output, and --plain, get ASCII markers that survive non-UTF-8 log pipelines.
+type statusPrinter struct {
+	w     io.Writer
+	plain bool
+}
+
+// newStatusPrinter returns a printer for w, using plain markers if plain is set or w is not a terminal
+func newStatusPrinter(w io.Writer, plain bool) *statusPrinter {
+	if file, ok := w.(*os.File); !ok || !isTerminal(file) {
+		plain = true
+	}
+	return &statusPrinter{w: w, plain: plain}
+}
+
+// Printf writes a status line of the given kind
+func (p *statusPrinter) Printf(kind statusKind, format string, args ...interface{}) {
+	marker := statusMarkers[kind].emoji
+	if p.plain {
+		marker = statusMarkers[kind].plain
+	}
+	fmt.Fprintf(p.w, marker+" "+format+"\n", args...)
+}
+
+// Println writes an undecorated line
+func (p *statusPrinter) Println(args ...interface{}) {
+	fmt.Fprintln(p.w, args...)
+}
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&plainOutput, "plain", false, "print ASCII status markers instead of emoji and disable coloured logs (automatic when stdout is not a terminal)")
+
+	// --no-emoji is accepted as another name for --plain
+	rootCmd.SetGlobalNormalizationFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "no-emoji" {
+			name = "plain"
+		}
+		return pflag.NormalizedName(name)
+	})
+}
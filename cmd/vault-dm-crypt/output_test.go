@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// printAllStatuses writes one line of every status kind
+func printAllStatuses(p *statusPrinter) {
+	for kind := range statusMarkers {
+		p.Printf(kind, "token has %d%% of its lifetime remaining", 80)
+	}
+	p.Println()
+}
+
+// assertPlain checks that output is ASCII without escape sequences
+func assertPlain(t *testing.T, output string) {
+	t.Helper()
+	for _, r := range output {
+		require.Less(t, r, rune(0x80), "non-ASCII character %q in %q", r, output)
+		require.NotEqual(t, '\x1b', r, "ANSI escape in %q", output)
+	}
+}
+
+func TestStatusPrinterPipedOutput(t *testing.T) {
+	t.Run("buffer", func(t *testing.T) {
+		var buf bytes.Buffer
+		printAllStatuses(newStatusPrinter(&buf, false))
+
+		assertPlain(t, buf.String())
+		assert.Contains(t, buf.String(), "[OK] token has 80% of its lifetime remaining\n")
+		assert.Contains(t, buf.String(), "[WARN] ")
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+
+		printAllStatuses(newStatusPrinter(w, false))
+		require.NoError(t, w.Close())
+
+		output, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assertPlain(t, string(output))
+		assert.Contains(t, string(output), "[REFRESH] ")
+	})
+}
+
+func TestNoEmojiFlagAlias(t *testing.T) {
+	defer func() { plainOutput = false }()
+
+	require.NoError(t, rootCmd.PersistentFlags().Parse([]string{"--no-emoji"}))
+	assert.True(t, plainOutput)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/hooks"
+)
+
+// passphraseInput and passphraseOutput are the terminal decrypt --passphrase prompts on. The
+// prompt goes to stderr so that stdout only carries the result.
+var (
+	passphraseInput  = os.Stdin
+	passphraseOutput = os.Stderr
+)
+
+// maxPassphraseLength bounds a typed passphrase; cryptsetup's own interactive limit is 512 bytes
+const maxPassphraseLength = 512
+
+// readPassphrase prints prompt and reads one line from the terminal in with echo turned off,
+// restoring the terminal afterwards. It fails when in is not a terminal, so a passphrase is
+// never read from a pipe or file by accident.
+func readPassphrase(in *os.File, out io.Writer, prompt string) ([]byte, error) {
+	fd := int(in.Fd())
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("--passphrase must be run on a terminal: %w", err)
+	}
+
+	noEcho := *saved
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	noEcho.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, fmt.Errorf("failed to turn off terminal echo: %w", err)
+	}
+	defer func() {
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, saved); err != nil {
+			logger.WithError(err).Warn("Failed to restore terminal echo")
+		}
+		// The newline typed by the operator was not echoed
+		fmt.Fprintln(out)
+	}()
+
+	fmt.Fprint(out, prompt)
+	return readPassphraseLine(in)
+}
+
+// readPassphraseLine reads up to the end of the line from r, a byte at a time so that nothing
+// after the line is consumed and no copy of the passphrase is left in a buffer. A trailing
+// carriage return is dropped.
+func readPassphraseLine(r io.Reader) ([]byte, error) {
+	passphrase := make([]byte, 0, maxPassphraseLength)
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if len(passphrase) == maxPassphraseLength {
+				clear(passphrase)
+				return nil, fmt.Errorf("passphrase is longer than %d bytes", maxPassphraseLength)
+			}
+			passphrase = append(passphrase, b[0])
+			continue
+		}
+		if stderrors.Is(err, io.EOF) && len(passphrase) > 0 {
+			break
+		}
+		if err != nil {
+			clear(passphrase)
+			if stderrors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("no passphrase given")
+			}
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+	}
+
+	if n := len(passphrase); n > 0 && passphrase[n-1] == '\r' {
+		passphrase = passphrase[:n-1]
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("no passphrase given")
+	}
+	return passphrase, nil
+}
+
+// runPassphraseDecrypt opens the device with uuid using a passphrase typed on the terminal instead
+// of the key stored in Vault, as a last resort when Vault is unreachable. Vault is never contacted,
+// so the mapping name comes from --name or [dmcrypt] name_template rather than one recorded in Vault.
+func runPassphraseDecrypt(summary *operationSummary, uuid, customName, deviceResolution string) error {
+	deviceName := customName
+	if deviceName == "" {
+		var err error
+		if deviceName, err = cfg.MappingName(uuid); err != nil {
+			return err
+		}
+	}
+	summary.Mapping = deviceName
+
+	devicePath, err := newDeviceWaiter(cfg.DMCrypt.DeviceWaitTimeout()).wait(uuid)
+	if err != nil {
+		return fmt.Errorf("failed to find device with UUID %s: %w", uuid, err)
+	}
+
+	resolution, err := dmcrypt.ParseDeviceResolution(deviceResolution)
+	if err != nil {
+		return err
+	}
+	devicePath, err = dmcryptManager.ResolveDevice(devicePath, resolution)
+	if err != nil {
+		return fmt.Errorf("device resolution failed: %w", err)
+	}
+	summary.Device = devicePath
+
+	mappedDevice := dmcryptManager.GetMappedDevicePath(deviceName)
+	if _, err := os.Stat(mappedDevice); err == nil {
+		logger.WithField("mapped_device", mappedDevice).Info("Device is already decrypted")
+		fmt.Printf("Device already decrypted: %s\n", mappedDevice)
+		summary.Result = summaryAlreadyOpen
+		return nil
+	}
+
+	existing, err := dmcryptManager.FindMappingsForDevice(devicePath)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to check for existing mappings of device")
+	} else if len(existing) > 0 {
+		return fmt.Errorf("device %s is already open as %s; close that mapping first or decrypt with --name %s",
+			devicePath, strings.Join(existing, ", "), existing[0])
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid":        uuid,
+		"device_path": devicePath,
+	}).Warn("Opening device with a passphrase instead of the key stored in Vault")
+
+	passphrase, err := readPassphrase(passphraseInput, passphraseOutput, fmt.Sprintf("Passphrase for %s (%s): ", devicePath, uuid))
+	if err != nil {
+		return err
+	}
+	err = dmcryptManager.OpenDeviceWithPassphrase(devicePath, passphrase, deviceName)
+	clear(passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to open LUKS device with passphrase: %w", err)
+	}
+
+	if err := hookRunner.Run(hooks.PostDecrypt, hooks.Event{UUID: uuid, Device: devicePath, MappedDevice: mappedDevice}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Device decrypted with passphrase:\n")
+	fmt.Printf("  UUID: %s\n", uuid)
+	fmt.Printf("  Device: %s\n", devicePath)
+	fmt.Printf("  Mapped device: %s\n", mappedDevice)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadPassphraseLine(t *testing.T) {
+	passphrase, err := readPassphraseLine(strings.NewReader("recovery phrase\nnext line\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "recovery phrase", string(passphrase))
+
+	passphrase, err = readPassphraseLine(strings.NewReader("typed on windows\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "typed on windows", string(passphrase))
+
+	passphrase, err = readPassphraseLine(strings.NewReader("no newline"))
+	require.NoError(t, err)
+	assert.Equal(t, "no newline", string(passphrase))
+
+	_, err = readPassphraseLine(strings.NewReader("\n"))
+	assert.EqualError(t, err, "no passphrase given")
+
+	_, err = readPassphraseLine(strings.NewReader(""))
+	assert.EqualError(t, err, "no passphrase given")
+
+	_, err = readPassphraseLine(strings.NewReader(strings.Repeat("x", maxPassphraseLength+1) + "\n"))
+	assert.Error(t, err)
+}
+
+// openPTY returns the controller and terminal ends of a new pseudo-terminal
+func openPTY(t *testing.T) (*os.File, *os.File) {
+	controller, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %v", err)
+	}
+	t.Cleanup(func() { controller.Close() })
+
+	fd := int(controller.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("failed to unlock pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Skipf("failed to get pseudo-terminal number: %v", err)
+	}
+	terminal, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("failed to open pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() { terminal.Close() })
+	return controller, terminal
+}
+
+func TestReadPassphraseNoEcho(t *testing.T) {
+	controller, terminal := openPTY(t)
+
+	// echoOn is polled from another goroutine, so it cannot fail the test itself
+	echoOn := func() bool {
+		termios, err := unix.IoctlGetTermios(int(terminal.Fd()), unix.TCGETS)
+		return err == nil && termios.Lflag&unix.ECHO != 0
+	}
+	require.True(t, echoOn())
+
+	type result struct {
+		passphrase []byte
+		err        error
+	}
+	done := make(chan result, 1)
+	var prompt bytes.Buffer
+	go func() {
+		passphrase, err := readPassphrase(terminal, &prompt, "Passphrase: ")
+		done <- result{passphrase, err}
+	}()
+
+	// Only type once echo is off, as the terminal echoes input when it arrives
+	require.Eventually(t, func() bool { return !echoOn() }, 5*time.Second, time.Millisecond)
+	_, err := controller.Write([]byte("recovery secret\n"))
+	require.NoError(t, err)
+
+	res := <-done
+	require.NoError(t, res.err)
+	assert.Equal(t, "recovery secret", string(res.passphrase))
+	assert.Equal(t, "Passphrase: \n", prompt.String())
+	assert.True(t, echoOn(), "echo is restored")
+
+	// With echo back on, the marker is echoed; nothing typed before it may have been
+	_, err = controller.Write([]byte("marker\n"))
+	require.NoError(t, err)
+	var echoed []byte
+	buf := make([]byte, 256)
+	for !bytes.Contains(echoed, []byte("marker")) {
+		n, err := controller.Read(buf)
+		require.NoError(t, err)
+		echoed = append(echoed, buf[:n]...)
+	}
+	assert.NotContains(t, string(echoed), "recovery secret")
+}
+
+func TestReadPassphraseRequiresTerminal(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "passphrase")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = readPassphrase(file, &bytes.Buffer{}, "Passphrase: ")
+	assert.ErrorContains(t, err, "must be run on a terminal")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/systemd"
+)
+
+var printBootCommandCmd = &cobra.Command{
+	Use:   "print-boot-command <uuid>",
+	Short: "Print the command the boot decrypt service runs for a device",
+	Long: `Print the command line the vault-dm-crypt-decrypt@<uuid>.service unit runs, so that a boot
+failure can be reproduced interactively, e.g. with --debug added.
+
+The command is taken from the decrypt unit installed in --unit-dir, or rendered as
+install-systemd would when it is not installed, with the per-device drop-ins written by encrypt
+applied. The instance UUID and the unit's Environment= variables are substituted. A command
+without --config uses the default configuration file.`,
+	Example: `  vault-dm-crypt print-boot-command 12345678-1234-1234-1234-123456789abc`,
+	Args:    cobra.ExactArgs(1),
+	// Resolving the command needs neither a config file nor Vault access
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if debug {
+			logger.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		unitDir, _ := cmd.Flags().GetString("unit-dir")
+		binaryPath, _ := cmd.Flags().GetString("binary-path")
+
+		uuid, err := parseDeviceUUID(args[0])
+		if err != nil {
+			return err
+		}
+
+		commands, err := systemd.NewManager(logger).BootCommand(unitDir, uuid, systemd.UnitOptions{BinaryPath: binaryPath})
+		if err != nil {
+			return fmt.Errorf("failed to resolve boot command: %w", err)
+		}
+
+		for _, command := range commands {
+			fmt.Println(command)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(printBootCommandCmd)
+
+	printBootCommandCmd.Flags().String("unit-dir", systemd.UnitDir, "directory holding the installed units and drop-ins")
+	printBootCommandCmd.Flags().String("binary-path", systemd.DefaultBinaryPath, "vault-dm-crypt path to use when the decrypt unit is not installed")
+}
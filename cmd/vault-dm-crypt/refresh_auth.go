@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// credentialRefresher is the subset of the Vault client refresh-auth uses to renew credentials
+type credentialRefresher interface {
+	Authenticate(ctx context.Context) error
+	GetTokenExpiry() time.Time
+	IsTokenExpiringByPercentage(ctx context.Context, percentage float64) (bool, error)
+	RefreshToken(ctx context.Context) error
+	IsBatchToken() bool
+	IsSecretIDExpiringByPercentage(ctx context.Context, percentage float64) (bool, error)
+	RefreshSecretID(ctx context.Context) (string, error)
+}
+
+// refreshOptions are the refresh-auth settings that decide whether and how credentials are renewed
+type refreshOptions struct {
+	threshold    float64 // Fraction of lifetime remaining below which credentials are renewed
+	force        bool    // Renew regardless of expiry
+	updateConfig bool    // Save a new secret ID to the config file
+	tokenAuth    bool    // Token authentication instead of AppRole
+	dryRun       bool    // Report what would be done without renewing anything
+}
+
+// refreshCredentials renews the token or AppRole secret ID if it is expiring or force is set.
+// With dryRun set, the expiry checks still run but nothing is renewed or written.
+func refreshCredentials(ctx context.Context, client credentialRefresher, status *statusPrinter, opts refreshOptions) error {
+	if opts.tokenAuth {
+		return refreshToken(ctx, client, status, opts)
+	}
+	return refreshSecretID(ctx, client, status, opts)
+}
+
+// refreshToken renews the Vault token when needed. Batch tokens cannot be renewed, so they are
+// only reported.
+func refreshToken(ctx context.Context, client credentialRefresher, status *statusPrinter, opts refreshOptions) error {
+	if client.IsBatchToken() {
+		logger.Info("Token is a batch token, skipping renewal")
+		status.Printf(statusWarn, "Token is a batch token (non-renewable) and cannot be renewed; it expires at %s",
+			client.GetTokenExpiry().Format(time.RFC3339))
+		status.Println("Note: Issue a new token before then.")
+		return nil
+	}
+
+	var needsTokenRefresh bool
+
+	if opts.force {
+		// Force refresh regardless of expiry
+		logger.Info("Force refresh requested for token")
+		needsTokenRefresh = true
+		status.Printf(statusRefresh, "Force refresh requested, attempting to renew token")
+	} else {
+		// Check if token is expiring by percentage threshold
+		tokenExpiring, err := client.IsTokenExpiringByPercentage(ctx, opts.threshold)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to check token expiry percentage")
+			return fmt.Errorf("failed to check token expiry: %w", err)
+		}
+
+		if tokenExpiring {
+			logger.Info("Token is expiring soon, refreshing automatically")
+			needsTokenRefresh = true
+			status.Printf(statusRefresh, "Token has less than %.0f%% of its lifetime remaining, refreshing automatically", opts.threshold*100)
+		} else {
+			logger.Info("Token is not expiring soon, no refresh needed")
+			status.Printf(statusOK, "Token has more than %.0f%% of its lifetime remaining, no refresh needed", opts.threshold*100)
+		}
+	}
+
+	if !needsTokenRefresh {
+		return nil
+	}
+
+	if opts.dryRun {
+		status.Printf(statusHint, "Dry run: would renew the token (expires %s)", client.GetTokenExpiry().Format(time.RFC3339))
+		return nil
+	}
+
+	// If we need to refresh token, do it now
+	logger.Info("Attempting to renew token")
+	if err := client.RefreshToken(ctx); err != nil {
+		// Token refresh might fail if non-renewable
+		logger.WithError(err).Warn("Token refresh failed")
+		status.Printf(statusWarn, "Token refresh failed: %v", err)
+		status.Println("Note: Token may not be renewable. You may need to generate a new token.")
+		return nil
+	}
+
+	logger.Info("Successfully renewed token")
+	status.Printf(statusOK, "Token renewed successfully")
+
+	// Display new expiry
+	status.Println(fmt.Sprintf("New token expiry: %s", client.GetTokenExpiry().Format(time.RFC3339)))
+	return nil
+}
+
+// refreshSecretID generates a new AppRole secret ID when needed and saves it to the config file
+func refreshSecretID(ctx context.Context, client credentialRefresher, status *statusPrinter, opts refreshOptions) error {
+	var needsSecretIDRefresh bool
+
+	if opts.force {
+		// Force refresh regardless of expiry
+		logger.Info("Force refresh requested")
+		needsSecretIDRefresh = true
+		status.Printf(statusRefresh, "Force refresh requested, generating new secret ID")
+	} else if cfg.Vault.AppRoleName != "" {
+		// Default behavior: check if secret ID is expiring by percentage
+		secretIDExpiring, err := client.IsSecretIDExpiringByPercentage(ctx, opts.threshold)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to check secret ID expiry")
+			return fmt.Errorf("failed to check secret ID expiry: %w", err)
+		}
+
+		if secretIDExpiring {
+			logger.Info("Secret ID is expiring soon, refreshing automatically")
+			needsSecretIDRefresh = true
+			status.Printf(statusRefresh, "Secret ID has less than %.0f%% of its lifetime remaining, refreshing automatically", opts.threshold*100)
+		} else {
+			logger.Info("Secret ID is not expiring soon, no refresh needed")
+			status.Printf(statusOK, "Secret ID has more than %.0f%% of its lifetime remaining, no refresh needed", opts.threshold*100)
+		}
+	}
+
+	if !needsSecretIDRefresh {
+		return nil
+	}
+
+	// A secret ID loaded from a systemd credential is provisioned outside this tool and the
+	// credential directory is rebuilt from its source on every start, so a new secret ID could
+	// neither be saved nor safely printed. Each run would leave another valid secret ID behind.
+	if cfg.Vault.SecretIDCredential != "" {
+		status.Printf(statusHint, "secret_id is loaded from systemd credential %q, rotate it by updating the credential source", cfg.Vault.SecretIDCredential)
+		return fmt.Errorf("refusing to rotate secret ID loaded from systemd credential %q", cfg.Vault.SecretIDCredential)
+	}
+
+	if opts.dryRun {
+		switch {
+		case opts.updateConfig:
+			status.Printf(statusHint, "Dry run: would generate a new secret ID and save it to config: %s", cfgFile)
+		default:
+			status.Printf(statusHint, "Dry run: would generate a new secret ID and print it (--no-update-config)")
+		}
+		return nil
+	}
+
+	// If we need to refresh secret ID, do it now
+	logger.Info("Generating new secret ID")
+	newSecretID, err := client.RefreshSecretID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh secret ID: %w", err)
+	}
+
+	logger.Info("Successfully generated new secret ID")
+
+	// Re-authenticate with the new secret ID before it is saved anywhere, so a secret ID that
+	// does not work never replaces one in the config file
+	oldSecretID := cfg.Vault.SecretID
+	cfg.Vault.SecretID = newSecretID
+	logger.Info("Testing new secret ID by re-authenticating")
+	if err := client.Authenticate(ctx); err != nil {
+		cfg.Vault.SecretID = oldSecretID
+		return fmt.Errorf("failed to authenticate with new secret ID, config file left unchanged: %w", err)
+	}
+	status.Printf(statusOK, "New secret ID verified successfully")
+
+	if opts.updateConfig {
+		logger.WithField("config_path", cfgFile).Info("Updating config file with new secret ID")
+		if err := config.UpdateSecretID(cfgFile, newSecretID); err != nil {
+			return fmt.Errorf("failed to update config file: %w", err)
+		}
+		logger.Info("Config file updated successfully")
+		status.Printf(statusOK, "New secret ID saved to config: %s", cfgFile)
+	} else {
+		status.Printf(statusNew, "New secret ID generated:\n%s", newSecretID)
+		status.Println()
+		status.Printf(statusHint, "To save to config file, remove the --no-update-config flag")
+		status.Println("   Or manually update your config file:")
+		status.Println(fmt.Sprintf("   secret_id = \"%s\"", newSecretID))
+	}
+	return nil
+}
+
+// authStatusReader is the subset of the Vault client refresh-auth uses to report credential status
+type authStatusReader interface {
+	GetTokenExpiry() time.Time
+	GetTokenInfo(ctx context.Context) (map[string]interface{}, error)
+	GetCurrentSecretIDInfo(ctx context.Context) (map[string]interface{}, error)
+	IsSecretIDExpiringByPercentage(ctx context.Context, percentage float64) (bool, error)
+}
+
+// authStatus is the credential status printed by refresh-auth --status --output json. Values that
+// are unknown or do not apply, such as the secret ID under token authentication, are null.
+type authStatus struct {
+	TokenExpiry        *string `json:"token_expiry"`
+	TokenTTLSeconds    *int64  `json:"token_ttl_seconds"`
+	Renewable          *bool   `json:"renewable"`
+	SecretIDExpiry     *string `json:"secret_id_expiry"`
+	SecretIDTTLSeconds *int64  `json:"secret_id_ttl_seconds"`
+	SecretIDExpiring   *bool   `json:"secret_id_expiring"`
+}
+
+// collectAuthStatus gathers the status of the current token and, for AppRole authentication
+// with approle_name set, of the secret ID. Lookup failures are logged and leave fields null.
+func collectAuthStatus(ctx context.Context, client authStatusReader, tokenAuth bool, threshold float64) authStatus {
+	var status authStatus
+
+	if expiry := client.GetTokenExpiry(); !expiry.IsZero() {
+		status.TokenExpiry = stringPtr(expiry.Format(time.RFC3339))
+	}
+
+	tokenInfo, err := client.GetTokenInfo(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get token info")
+	} else {
+		status.TokenTTLSeconds = jsonNumberPtr(tokenInfo["ttl"])
+		if renewable, ok := tokenInfo["renewable"].(bool); ok {
+			status.Renewable = &renewable
+		}
+	}
+
+	if tokenAuth || cfg.Vault.AppRoleName == "" {
+		return status
+	}
+
+	secretIDInfo, err := client.GetCurrentSecretIDInfo(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get secret ID info")
+		return status
+	}
+
+	if expiry, _ := secretIDInfo["expiration_time"].(string); expiry != "" {
+		status.SecretIDExpiry = &expiry
+	}
+	status.SecretIDTTLSeconds = jsonNumberPtr(secretIDInfo["secret_id_ttl"])
+
+	expiring, err := client.IsSecretIDExpiringByPercentage(ctx, threshold)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to check secret ID expiry")
+	} else {
+		status.SecretIDExpiring = &expiring
+	}
+	return status
+}
+
+// writeAuthStatusJSON writes status to w as indented JSON
+func writeAuthStatusJSON(w io.Writer, status authStatus) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(status)
+}
+
+// jsonNumberPtr returns a Vault response number as an int64, or nil if it is absent or not an integer
+func jsonNumberPtr(value interface{}) *int64 {
+	number, ok := value.(json.Number)
+	if !ok {
+		return nil
+	}
+	parsed, err := number.Int64()
+	if err != nil {
+		return nil
+	}
+	return &parsed
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRefresher struct {
+	expiring bool
+	batch    bool
+	authErr  error
+	calls    []string
+}
+
+func (f *fakeRefresher) Authenticate(ctx context.Context) error {
+	f.calls = append(f.calls, "authenticate")
+	return f.authErr
+}
+
+func (f *fakeRefresher) GetTokenExpiry() time.Time {
+	return time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (f *fakeRefresher) IsTokenExpiringByPercentage(ctx context.Context, percentage float64) (bool, error) {
+	return f.expiring, nil
+}
+
+func (f *fakeRefresher) RefreshToken(ctx context.Context) error {
+	f.calls = append(f.calls, "refresh-token")
+	return nil
+}
+
+func (f *fakeRefresher) IsBatchToken() bool {
+	return f.batch
+}
+
+func (f *fakeRefresher) IsSecretIDExpiringByPercentage(ctx context.Context, percentage float64) (bool, error) {
+	return f.expiring, nil
+}
+
+func (f *fakeRefresher) RefreshSecretID(ctx context.Context) (string, error) {
+	f.calls = append(f.calls, "refresh-secret-id")
+	return "new-secret-id", nil
+}
+
+// useRefreshTestConfig points cfg and cfgFile at an AppRole config file in a temp dir
+func useRefreshTestConfig(t *testing.T) string {
+	t.Helper()
+	useEncryptTestConfig(t)
+	cfg.Vault.AppRoleName = "vault-dm-crypt"
+	cfg.Vault.SecretID = "old-secret-id"
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[vault]\nsecret_id = \"old-secret-id\"\n"), 0600))
+
+	originalCfgFile := cfgFile
+	t.Cleanup(func() { cfgFile = originalCfgFile })
+	cfgFile = path
+	return path
+}
+
+func TestRefreshCredentialsDryRun(t *testing.T) {
+	path := useRefreshTestConfig(t)
+	original, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	for _, opts := range []refreshOptions{
+		{threshold: 0.25, updateConfig: true, dryRun: true},
+		{threshold: 0.25, force: true, updateConfig: true, dryRun: true},
+		{threshold: 0.25, tokenAuth: true, dryRun: true},
+	} {
+		client := &fakeRefresher{expiring: true}
+		var out bytes.Buffer
+
+		require.NoError(t, refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), opts))
+		assert.Empty(t, client.calls, "dry run must not touch Vault credentials")
+		assert.Contains(t, out.String(), "Dry run: would")
+	}
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, original, after, "dry run must not rewrite the config file")
+	assert.Equal(t, "old-secret-id", cfg.Vault.SecretID)
+}
+
+func TestRefreshCredentialsRefusesSecretIDCredential(t *testing.T) {
+	useRefreshTestConfig(t)
+	cfg.Vault.SecretID = ""
+	cfg.Vault.SecretIDCredential = "vault-secret-id"
+
+	for _, opts := range []refreshOptions{
+		{threshold: 0.25, updateConfig: true},
+		{threshold: 0.25, force: true, updateConfig: true},
+		{threshold: 0.25, force: true, dryRun: true},
+	} {
+		client := &fakeRefresher{expiring: true}
+		var out bytes.Buffer
+
+		err := refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "systemd credential")
+		assert.NotContains(t, client.calls, "refresh-secret-id", "no secret ID may be generated that cannot be saved")
+		assert.NotContains(t, out.String(), "new-secret-id")
+	}
+}
+
+func TestRefreshCredentialsBatchToken(t *testing.T) {
+	useRefreshTestConfig(t)
+
+	for _, force := range []bool{false, true} {
+		client := &fakeRefresher{expiring: true, batch: true}
+		var out bytes.Buffer
+
+		require.NoError(t, refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), refreshOptions{threshold: 0.25, tokenAuth: true, force: force}))
+		assert.Empty(t, client.calls, "batch tokens must not be renewed")
+		assert.Contains(t, out.String(), "batch token (non-renewable)")
+		assert.Contains(t, out.String(), "2025-01-01T12:00:00Z")
+	}
+}
+
+func TestRefreshCredentialsSecretID(t *testing.T) {
+	path := useRefreshTestConfig(t)
+
+	t.Run("not expiring", func(t *testing.T) {
+		client := &fakeRefresher{}
+		var out bytes.Buffer
+		require.NoError(t, refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), refreshOptions{threshold: 0.25, updateConfig: true}))
+		assert.Empty(t, client.calls)
+		assert.Contains(t, out.String(), "no refresh needed")
+	})
+
+	t.Run("expiring", func(t *testing.T) {
+		client := &fakeRefresher{expiring: true}
+		var out bytes.Buffer
+		require.NoError(t, refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), refreshOptions{threshold: 0.25, updateConfig: true}))
+		assert.Equal(t, []string{"refresh-secret-id", "authenticate"}, client.calls)
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "new-secret-id")
+		assert.Equal(t, "new-secret-id", cfg.Vault.SecretID)
+	})
+
+	t.Run("verification fails", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("[vault]\nsecret_id = \"old-secret-id\"\n"), 0600))
+		cfg.Vault.SecretID = "old-secret-id"
+		original, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		client := &fakeRefresher{expiring: true, authErr: errors.New("invalid secret id")}
+		var out bytes.Buffer
+		err = refreshCredentials(context.Background(), client, newStatusPrinter(&out, true), refreshOptions{threshold: 0.25, updateConfig: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "config file left unchanged")
+
+		after, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, original, after)
+		assert.Equal(t, "old-secret-id", cfg.Vault.SecretID)
+		assert.NotContains(t, out.String(), "new-secret-id")
+	})
+}
+
+type fakeStatusReader struct {
+	tokenExpiry  time.Time
+	tokenInfo    map[string]interface{}
+	secretIDInfo map[string]interface{}
+	secretIDErr  error
+	expiring     bool
+}
+
+func (f *fakeStatusReader) GetTokenExpiry() time.Time {
+	return f.tokenExpiry
+}
+
+func (f *fakeStatusReader) GetTokenInfo(ctx context.Context) (map[string]interface{}, error) {
+	return f.tokenInfo, nil
+}
+
+func (f *fakeStatusReader) GetCurrentSecretIDInfo(ctx context.Context) (map[string]interface{}, error) {
+	return f.secretIDInfo, f.secretIDErr
+}
+
+func (f *fakeStatusReader) IsSecretIDExpiringByPercentage(ctx context.Context, percentage float64) (bool, error) {
+	return f.expiring, nil
+}
+
+func TestAuthStatusJSON(t *testing.T) {
+	useEncryptTestConfig(t)
+
+	reader := &fakeStatusReader{
+		tokenExpiry: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+		tokenInfo:   map[string]interface{}{"ttl": json.Number("3600"), "renewable": true},
+		secretIDInfo: map[string]interface{}{
+			"expiration_time": "2025-01-02T00:00:00Z",
+			"secret_id_ttl":   json.Number("86400"),
+		},
+		expiring: true,
+	}
+
+	decode := func(t *testing.T, status authStatus) map[string]interface{} {
+		var out bytes.Buffer
+		require.NoError(t, writeAuthStatusJSON(&out, status))
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(out.Bytes(), &fields))
+		return fields
+	}
+
+	t.Run("approle", func(t *testing.T) {
+		cfg.Vault.AppRoleName = "vault-dm-crypt"
+		t.Cleanup(func() { cfg.Vault.AppRoleName = "" })
+
+		fields := decode(t, collectAuthStatus(context.Background(), reader, false, 0.25))
+		assert.Equal(t, map[string]interface{}{
+			"token_expiry":          "2025-01-01T12:00:00Z",
+			"token_ttl_seconds":     float64(3600),
+			"renewable":             true,
+			"secret_id_expiry":      "2025-01-02T00:00:00Z",
+			"secret_id_ttl_seconds": float64(86400),
+			"secret_id_expiring":    true,
+		}, fields)
+	})
+
+	t.Run("missing fields are null", func(t *testing.T) {
+		for name, tokenAuth := range map[string]bool{"no approle_name": false, "token auth": true} {
+			fields := decode(t, collectAuthStatus(context.Background(), reader, tokenAuth, 0.25))
+			assert.Len(t, fields, 6, name)
+			for _, key := range []string{"secret_id_expiry", "secret_id_ttl_seconds", "secret_id_expiring"} {
+				assert.Contains(t, fields, key, name)
+				assert.Nil(t, fields[key], name)
+			}
+		}
+	})
+
+	t.Run("secret ID lookup failure", func(t *testing.T) {
+		cfg.Vault.AppRoleName = "vault-dm-crypt"
+		t.Cleanup(func() { cfg.Vault.AppRoleName = "" })
+
+		failing := *reader
+		failing.secretIDErr = errors.New("permission denied")
+		fields := decode(t, collectAuthStatus(context.Background(), &failing, false, 0.25))
+		assert.Equal(t, true, fields["renewable"])
+		assert.Nil(t, fields["secret_id_expiring"])
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+	"digitalisio/vault-dm-crypt/internal/vault"
+)
+
+var repairMetadataCmd = &cobra.Command{
+	Use:   "repair-metadata",
+	Short: "Reconcile Vault entries with the devices on this host",
+	Long: `Check every key stored under this host's Vault path against the devices present on the host.
+
+Keys stored under the backend or path_prefix of a [[device]] profile are checked too;
+--profile checks only the keys stored in that profile's location.
+
+Entries are reported as:
+  ok               the device exists and matches the stored device path
+  orphan           no device with the UUID exists on this host
+  unassigned       the key was stored with --store-only and no device has been formatted with it
+  device-mismatch  the device exists but at a different path than the one stored
+  unreadable       the entry could not be read
+  unknown          the devices on this host could not be searched, e.g. blkid failed
+
+With --prune, orphaned entries are deleted from Vault. An entry is only pruned when its
+stored hostname matches this host, so keys belonging to other hosts are never removed, and
+unassigned entries are never pruned. On KV v2 the delete is recoverable with 'vault kv
+undelete'. With --destroy as well, every version and the metadata of the entry are removed
+instead, which cannot be undone.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		prune, _ := cmd.Flags().GetBool("prune")
+		destroy, _ := cmd.Flags().GetBool("destroy")
+		if destroy && !prune {
+			return fmt.Errorf("--destroy requires --prune")
+		}
+
+		locations, err := vaultLocations(cmd)
+		if err != nil {
+			return err
+		}
+
+		hostname, err := cfg.General.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine hostname: %w", err)
+		}
+
+		var entries []metadataEntry
+		for _, location := range locations {
+			basePath, err := location.Vault.SecretListPath()
+			if err != nil {
+				return err
+			}
+
+			reconciler := &metadataReconciler{
+				store:       location.Store,
+				basePath:    basePath,
+				hostname:    hostname,
+				findDevice:  findDeviceByUUID,
+				resolvePath: dmcrypt.ResolveDevicePath,
+				destroy:     destroy,
+			}
+
+			located, err := reconciler.reconcile(cmd.Context(), prune)
+			if err != nil {
+				return err
+			}
+			for i := range located {
+				located[i].Profile = profileName(location.Profile)
+			}
+			entries = append(entries, located...)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tPROFILE\tSTATUS\tSTORED DEVICE\tACTUAL DEVICE\tDETAIL")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.UUID, dashIfEmpty(e.Profile), e.Status, dashIfEmpty(e.StoredDevice), dashIfEmpty(e.ActualDevice), e.Detail)
+		}
+		return w.Flush()
+	},
+}
+
+// Reconciliation statuses reported by repair-metadata
+const (
+	metadataOK             = "ok"
+	metadataOrphan         = "orphan"
+	metadataUnassigned     = "unassigned"
+	metadataDeviceMismatch = "device-mismatch"
+	metadataUnreadable     = "unreadable"
+	metadataUnknown        = "unknown"
+)
+
+// metadataStore is the subset of the Vault client used by repair-metadata
+type metadataStore interface {
+	ListSecrets(ctx context.Context, path string) ([]string, error)
+	ReadSecret(ctx context.Context, path string) (map[string]interface{}, error)
+	DeleteSecret(ctx context.Context, path string) error
+	DestroySecret(ctx context.Context, path string) error
+}
+
+// metadataEntry is the reconciliation result for one stored key
+type metadataEntry struct {
+	UUID         string
+	Profile      string // [[device]] profile whose Vault location holds the key, if any
+	Status       string
+	StoredDevice string
+	ActualDevice string
+	Hostname     string
+	Pruned       bool
+	Detail       string
+}
+
+// metadataReconciler compares stored keys with the devices present on the host
+type metadataReconciler struct {
+	store       metadataStore
+	basePath    string
+	hostname    string
+	findDevice  func(uuid string) (string, error)
+	resolvePath func(path string) string
+	destroy     bool // Prune permanently rather than with a recoverable KV v2 delete
+}
+
+// reconcile checks every entry under basePath and, with prune, deletes orphans owned by this host
+func (r *metadataReconciler) reconcile(ctx context.Context, prune bool) ([]metadataEntry, error) {
+	uuids, err := r.store.ListSecrets(ctx, r.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in Vault: %w", err)
+	}
+
+	entries := make([]metadataEntry, 0, len(uuids))
+	for _, uuid := range uuids {
+		entry := r.check(ctx, uuid)
+
+		if prune && entry.Status == metadataOrphan {
+			r.prune(ctx, &entry)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// check reconciles a single stored key with the host's devices
+func (r *metadataReconciler) check(ctx context.Context, uuid string) metadataEntry {
+	entry := metadataEntry{UUID: uuid}
+
+	secretData, err := r.store.ReadSecret(ctx, fmt.Sprintf("%s/%s", r.basePath, uuid))
+	if err != nil {
+		entry.Status = metadataUnreadable
+		entry.Detail = err.Error()
+		return entry
+	}
+
+	secret, err := vault.DecodeDeviceSecret(secretData)
+	if err != nil {
+		entry.Status = metadataUnreadable
+		entry.Detail = err.Error()
+		return entry
+	}
+
+	entry.StoredDevice = secret.DevicePath()
+	entry.Hostname = secret.Hostname
+
+	// Only a device that is definitely absent makes the entry an orphan, since orphans may be pruned
+	actual, err := r.findDevice(uuid)
+	if isDeviceNotFound(err) && entry.StoredDevice == "" {
+		// A key provisioned with --store-only waits for --format-from-vault, so it is never an orphan
+		entry.Status = metadataUnassigned
+		entry.Detail = "stored with --store-only, no device formatted with it yet"
+		return entry
+	}
+	if isDeviceNotFound(err) {
+		entry.Status = metadataOrphan
+		entry.Detail = "no device with this UUID on this host"
+		return entry
+	}
+	if err != nil {
+		entry.Status = metadataUnknown
+		entry.Detail = err.Error()
+		return entry
+	}
+	entry.ActualDevice = actual
+
+	if entry.StoredDevice != "" && r.resolvePath(entry.StoredDevice) != r.resolvePath(actual) {
+		entry.Status = metadataDeviceMismatch
+		entry.Detail = "stored device path no longer refers to this device"
+		return entry
+	}
+
+	entry.Status = metadataOK
+	return entry
+}
+
+// prune deletes an orphaned entry if it was stored by this host
+func (r *metadataReconciler) prune(ctx context.Context, entry *metadataEntry) {
+	if entry.Hostname == "" || entry.Hostname != r.hostname {
+		entry.Detail = fmt.Sprintf("not pruned: stored hostname %q does not match this host %q", entry.Hostname, r.hostname)
+		return
+	}
+
+	path := fmt.Sprintf("%s/%s", r.basePath, entry.UUID)
+	remove, detail := r.store.DeleteSecret, "pruned"
+	if r.destroy {
+		remove, detail = r.store.DestroySecret, "pruned (destroyed)"
+	}
+	if err := remove(ctx, path); err != nil {
+		entry.Detail = fmt.Sprintf("prune failed: %v", err)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"uuid":          entry.UUID,
+		"stored_device": entry.StoredDevice,
+		"destroyed":     r.destroy,
+	}).Info("Pruned orphaned key from Vault")
+
+	entry.Pruned = true
+	entry.Detail = detail
+}
+
+// dashIfEmpty keeps empty table cells visible
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	repairMetadataCmd.Flags().Bool("prune", false, "Delete orphaned entries stored by this host from Vault")
+	repairMetadataCmd.Flags().String("profile", "", "Only check keys stored in the Vault location of this [[device]] profile")
+	repairMetadataCmd.Flags().Bool("destroy", false, "With --prune, permanently destroy orphaned entries and all their versions instead of a recoverable delete")
+
+	rootCmd.AddCommand(repairMetadataCmd)
+}
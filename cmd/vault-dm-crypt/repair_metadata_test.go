@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMetadataStore struct {
+	secrets   map[string]map[string]interface{}
+	deleted   []string
+	destroyed []string
+}
+
+func (f *fakeMetadataStore) ListSecrets(ctx context.Context, path string) ([]string, error) {
+	var uuids []string
+	for key := range f.secrets {
+		if strings.HasPrefix(key, path+"/") {
+			uuids = append(uuids, strings.TrimPrefix(key, path+"/"))
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+func (f *fakeMetadataStore) ReadSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	data, ok := f.secrets[path]
+	if !ok || data == nil {
+		return nil, fmt.Errorf("secret not found")
+	}
+	return data, nil
+}
+
+func (f *fakeMetadataStore) DeleteSecret(ctx context.Context, path string) error {
+	f.deleted = append(f.deleted, path)
+	return nil
+}
+
+func (f *fakeMetadataStore) DestroySecret(ctx context.Context, path string) error {
+	f.destroyed = append(f.destroyed, path)
+	return nil
+}
+
+func newTestReconciler(store *fakeMetadataStore) *metadataReconciler {
+	devices := map[string]string{
+		"uuid-ok":       "/dev/sdb1",
+		"uuid-mismatch": "/dev/sdc1",
+	}
+	aliases := map[string]string{
+		"/dev/disk/by-id/ata-disk-b-part1": "/dev/sdb1",
+	}
+
+	return &metadataReconciler{
+		store:    store,
+		basePath: "vault-dm-crypt/node-1",
+		hostname: "node-1",
+		findDevice: func(uuid string) (string, error) {
+			if device, ok := devices[uuid]; ok {
+				return device, nil
+			}
+			return "", &deviceNotFoundError{uuid: uuid}
+		},
+		resolvePath: func(path string) string {
+			if resolved, ok := aliases[path]; ok {
+				return resolved
+			}
+			return path
+		},
+	}
+}
+
+func newTestMetadataStore() *fakeMetadataStore {
+	return &fakeMetadataStore{secrets: map[string]map[string]interface{}{
+		"vault-dm-crypt/node-1/uuid-ok":       {"device": "/dev/disk/by-id/ata-disk-b-part1", "hostname": "node-1"},
+		"vault-dm-crypt/node-1/uuid-mismatch": {"device": "/dev/sdd1", "hostname": "node-1"},
+		"vault-dm-crypt/node-1/uuid-orphan":   {"device": "/dev/sde1", "hostname": "node-1"},
+		"vault-dm-crypt/node-1/uuid-foreign":  {"device": "/dev/sdf1", "hostname": "node-2"},
+		"vault-dm-crypt/node-1/uuid-nohost":   {"device": "/dev/sdg1"},
+		"vault-dm-crypt/node-1/uuid-spare":    {"hostname": "node-1"},
+		"vault-dm-crypt/node-1/uuid-broken":   nil,
+	}}
+}
+
+func TestReconcileMetadataReport(t *testing.T) {
+	store := newTestMetadataStore()
+
+	entries, err := newTestReconciler(store).reconcile(context.Background(), false)
+	require.NoError(t, err)
+
+	statuses := make(map[string]string)
+	for _, e := range entries {
+		statuses[e.UUID] = e.Status
+		assert.False(t, e.Pruned)
+	}
+
+	assert.Equal(t, map[string]string{
+		"uuid-ok":       metadataOK,
+		"uuid-mismatch": metadataDeviceMismatch,
+		"uuid-orphan":   metadataOrphan,
+		"uuid-foreign":  metadataOrphan,
+		"uuid-nohost":   metadataOrphan,
+		"uuid-spare":    metadataUnassigned,
+		"uuid-broken":   metadataUnreadable,
+	}, statuses)
+	assert.Empty(t, store.deleted)
+}
+
+func TestReconcileMetadataStablePath(t *testing.T) {
+	// The kernel name recorded at encrypt time now belongs to another disk
+	store := &fakeMetadataStore{secrets: map[string]map[string]interface{}{
+		"vault-dm-crypt/node-1/uuid-ok": {
+			"device":       "/dev/sdc1",
+			"device_by_id": "/dev/disk/by-id/ata-disk-b-part1",
+			"hostname":     "node-1",
+		},
+	}}
+
+	entries, err := newTestReconciler(store).reconcile(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, metadataOK, entries[0].Status)
+	assert.Equal(t, "/dev/disk/by-id/ata-disk-b-part1", entries[0].StoredDevice)
+}
+
+func TestReconcileMetadataPrune(t *testing.T) {
+	store := newTestMetadataStore()
+
+	entries, err := newTestReconciler(store).reconcile(context.Background(), true)
+	require.NoError(t, err)
+
+	// Only the orphan stored by this host is deleted, recoverably by default
+	assert.Equal(t, []string{"vault-dm-crypt/node-1/uuid-orphan"}, store.deleted)
+	assert.Empty(t, store.destroyed)
+
+	for _, e := range entries {
+		switch e.UUID {
+		case "uuid-orphan":
+			assert.True(t, e.Pruned)
+		case "uuid-foreign", "uuid-nohost":
+			assert.False(t, e.Pruned)
+			assert.Contains(t, e.Detail, "not pruned")
+		case "uuid-spare":
+			// Stored by this host but waiting for --format-from-vault
+			assert.False(t, e.Pruned)
+			assert.Equal(t, metadataUnassigned, e.Status)
+		default:
+			assert.False(t, e.Pruned)
+		}
+	}
+}
+
+func TestReconcileMetadataPruneDestroy(t *testing.T) {
+	store := newTestMetadataStore()
+	reconciler := newTestReconciler(store)
+	reconciler.destroy = true
+
+	entries, err := reconciler.reconcile(context.Background(), true)
+	require.NoError(t, err)
+
+	assert.Empty(t, store.deleted)
+	assert.Equal(t, []string{"vault-dm-crypt/node-1/uuid-orphan"}, store.destroyed)
+
+	for _, e := range entries {
+		if e.UUID == "uuid-orphan" {
+			assert.True(t, e.Pruned)
+			assert.Equal(t, "pruned (destroyed)", e.Detail)
+		}
+	}
+}
+
+func TestReconcileMetadataDeviceLookupFailure(t *testing.T) {
+	store := newTestMetadataStore()
+	reconciler := newTestReconciler(store)
+	reconciler.findDevice = func(uuid string) (string, error) {
+		return "", fmt.Errorf("failed to search for device with UUID %s: permission denied", uuid)
+	}
+
+	entries, err := reconciler.reconcile(context.Background(), true)
+	require.NoError(t, err)
+
+	// A failed search proves nothing about the device, so nothing is pruned
+	for _, e := range entries {
+		if e.Status != metadataUnreadable {
+			assert.Equal(t, metadataUnknown, e.Status, e.UUID)
+			assert.Contains(t, e.Detail, "permission denied")
+		}
+		assert.False(t, e.Pruned)
+	}
+	assert.Empty(t, store.deleted)
+}
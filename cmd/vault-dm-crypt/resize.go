@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+var resizeCmd = &cobra.Command{
+	Use:   "resize <uuid|name>",
+	Short: "Grow an open mapping after the underlying device has been enlarged",
+	Long: `Grow an open LUKS mapping to the current size of its underlying device, for example
+after expanding a cloud volume.
+
+The argument is either the device UUID or the name of the mapping under /dev/mapper.
+The key is fetched from Vault because LUKS2 resize authenticates against a keyslot.
+The device must already be open; resize refuses to act on a closed device.
+
+The filesystem on the mapping is not resized; grow it separately afterwards.`,
+	Example: `  vault-dm-crypt resize 12345678-1234-1234-1234-123456789abc
+  vault-dm-crypt resize vaultlocker-12345678123412341234123456789abc`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		profile, err := profileFromFlag(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Vault.Timeout())
+		defer cancel()
+
+		uuid, deviceName, err := resolveOpenMapping(ctx, vaultClient, args[0], profile)
+		if err != nil {
+			return err
+		}
+
+		opLock, err := acquireOperationLock(uuid)
+		if err != nil {
+			return err
+		}
+		defer releaseOperationLock(opLock)
+
+		vaultPath, err := cfg.VaultForProfile(profile).SecretPath(uuid)
+		if err != nil {
+			return err
+		}
+
+		store := storeForProfile(profile)
+		var key string
+		err = store.WithRetry(ctx, func() error {
+			var err error
+			key, err = fetchKey(ctx, store, uuid, vaultPath, cfg.Vault.KeyFieldNames())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to retrieve key from Vault: %w", err)
+		}
+		defer dmcryptManager.SecureEraseKey(&key)
+
+		result, err := dmcryptManager.ResizeDevice(deviceName, key)
+		if err != nil {
+			return fmt.Errorf("failed to resize device: %w", err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"uuid":        uuid,
+			"device_name": deviceName,
+			"before":      result.Before,
+			"after":       result.After,
+		}).Info("Device resize completed")
+
+		if result.After == result.Before {
+			fmt.Printf("Mapping %s is unchanged at %d bytes; has the underlying device been grown?\n", deviceName, result.After)
+			return nil
+		}
+
+		fmt.Printf("Mapping %s resized:\n", deviceName)
+		fmt.Printf("  Before: %d bytes\n", result.Before)
+		fmt.Printf("  After:  %d bytes\n", result.After)
+		return nil
+	},
+}
+
+func init() {
+	resizeCmd.Flags().String("profile", "", "read the key from the Vault location of this [[device]] profile")
+
+	rootCmd.AddCommand(resizeCmd)
+}
+
+// resolveOpenMapping returns the UUID and mapping name for an argument that is either the
+// name of an open mapping or a device UUID, failing if the device is not open. A UUID maps to
+// the name recorded by decrypt --name if there is one, looked up where profile stores its key.
+func resolveOpenMapping(ctx context.Context, store mappingNameStore, arg string, profile *config.DeviceConfig) (string, string, error) {
+	uuid, deviceName, err := resolveMapping(ctx, store, arg, profile)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(dmcryptManager.GetMappedDevicePath(deviceName)); err != nil {
+		return "", "", fmt.Errorf("device %s is not open; open it with 'vault-dm-crypt decrypt %s' before resizing", arg, arg)
+	}
+	return uuid, deviceName, nil
+}
+
+// resolveMapping returns the UUID and mapping name for an argument that is either the name of
+// an open mapping or a device UUID, whether or not the device is open
+func resolveMapping(ctx context.Context, store mappingNameStore, arg string, profile *config.DeviceConfig) (string, string, error) {
+	if _, err := os.Stat(dmcryptManager.GetMappedDevicePath(arg)); err == nil {
+		device, err := dmcryptManager.GetMappingDevice(arg)
+		if err != nil {
+			return "", "", err
+		}
+
+		uuid, err := dmcryptManager.GetLUKSUUID(device)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read LUKS UUID of %s: %w", device, err)
+		}
+		return uuid, arg, nil
+	}
+
+	deviceName, err := resolveMappingName(ctx, store, arg, profile)
+	if err != nil {
+		return "", "", err
+	}
+	return arg, deviceName, nil
+}
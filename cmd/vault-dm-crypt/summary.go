@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/notify"
+)
+
+// Results reported in operation summaries
+const (
+	summarySuccess     = "success"
+	summaryFailure     = "failure"
+	summaryAlreadyOpen = "already-open"
+)
+
+// operationSummary collects the outcome of an encrypt or decrypt so that it can be logged as a
+// single line with stable field names, whatever the log level, for journald and fleet audits
+type operationSummary struct {
+	Operation string
+	UUID      string
+	Device    string
+	Mapping   string
+	// Result overrides the result derived from the command error, e.g. for an already-open device
+	Result string
+	// KeyFingerprint identifies the key used without exposing it, see keyFingerprint
+	KeyFingerprint string
+
+	start time.Time
+}
+
+// newOperationSummary starts timing an operation
+func newOperationSummary(operation string) *operationSummary {
+	return &operationSummary{Operation: operation, start: time.Now()}
+}
+
+// fields returns the summary log fields for the operation ending with err
+func (s *operationSummary) fields(err error) logrus.Fields {
+	result := s.Result
+	if err != nil {
+		result = summaryFailure
+	} else if result == "" {
+		result = summarySuccess
+	}
+
+	fields := logrus.Fields{
+		"summary":     s.Operation,
+		"uuid":        s.UUID,
+		"device":      s.Device,
+		"mapping":     s.Mapping,
+		"duration_ms": time.Since(s.start).Milliseconds(),
+		"result":      result,
+	}
+	if s.KeyFingerprint != "" {
+		fields["key_fingerprint"] = s.KeyFingerprint
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	return fields
+}
+
+// log emits the summary at info level and posts it to the [notify] webhook, if configured
+func (s *operationSummary) log(err error) {
+	fields := s.fields(err)
+	logger.WithFields(fields).Info(s.Operation + " summary")
+
+	if notifier != nil {
+		notifier.Notify(s.event(fields))
+	}
+}
+
+// event converts summary fields to a webhook event
+func (s *operationSummary) event(fields logrus.Fields) notify.Event {
+	event := notify.Event{
+		Operation:      s.Operation,
+		UUID:           s.UUID,
+		Device:         s.Device,
+		KeyFingerprint: s.KeyFingerprint,
+	}
+	event.Result, _ = fields["result"].(string)
+	event.Error, _ = fields["error"].(string)
+
+	if cfg != nil {
+		event.Hostname, _ = cfg.General.Hostname()
+	}
+	return event
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/notify"
+)
+
+func captureSummaryLogs(t *testing.T) *test.Hook {
+	t.Helper()
+	originalLogger := logger
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+	t.Cleanup(func() { logger = originalLogger })
+	return test.NewLocal(logger)
+}
+
+func TestOperationSummaryAfterDecrypt(t *testing.T) {
+	hook := captureSummaryLogs(t)
+
+	summary := newOperationSummary("decrypt")
+	summary.UUID = "1234-abcd"
+	summary.Device = "/dev/sdb1"
+	summary.Mapping = "crypt-1234-abcd"
+	summary.log(nil)
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "decrypt summary", entry.Message)
+	assert.Equal(t, "decrypt", entry.Data["summary"])
+	assert.Equal(t, "1234-abcd", entry.Data["uuid"])
+	assert.Equal(t, "/dev/sdb1", entry.Data["device"])
+	assert.Equal(t, "crypt-1234-abcd", entry.Data["mapping"])
+	assert.Equal(t, summarySuccess, entry.Data["result"])
+	assert.Contains(t, entry.Data, "duration_ms")
+	assert.NotContains(t, entry.Data, "error")
+}
+
+func TestOperationSummaryResult(t *testing.T) {
+	hook := captureSummaryLogs(t)
+
+	summary := newOperationSummary("decrypt")
+	summary.Result = summaryAlreadyOpen
+	summary.log(nil)
+	assert.Equal(t, summaryAlreadyOpen, hook.LastEntry().Data["result"])
+
+	summary.log(fmt.Errorf("failed to open LUKS device"))
+	assert.Equal(t, summaryFailure, hook.LastEntry().Data["result"])
+	assert.Equal(t, "failed to open LUKS device", hook.LastEntry().Data["error"])
+}
+
+func TestOperationSummaryNotifies(t *testing.T) {
+	captureSummaryLogs(t)
+	useEncryptTestConfig(t)
+
+	var posted []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		posted = append(posted, event)
+	}))
+	defer server.Close()
+
+	originalNotifier := notifier
+	notifier = notify.NewNotifier(config.NotifyConfig{WebhookURL: server.URL, TimeoutSecs: 2}, logger)
+	defer func() { notifier = originalNotifier }()
+
+	summary := newOperationSummary("decrypt")
+	summary.UUID = "1234-abcd"
+	summary.Device = "/dev/sdb1"
+	summary.log(fmt.Errorf("failed to open LUKS device"))
+
+	require.Len(t, posted, 1)
+	assert.Equal(t, "decrypt", posted[0]["operation"])
+	assert.Equal(t, "1234-abcd", posted[0]["uuid"])
+	assert.Equal(t, "/dev/sdb1", posted[0]["device"])
+	assert.Equal(t, "node1", posted[0]["hostname"])
+	assert.Equal(t, summaryFailure, posted[0]["result"])
+	assert.Equal(t, "failed to open LUKS device", posted[0]["error"])
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Limits on user-supplied encrypt tags
+const (
+	maxTagKeyLength   = 64
+	maxTagValueLength = 256
+)
+
+// tagKeyPattern restricts tag keys to names that are safe in Vault UIs and CMDB exports
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// reservedSecretFields are the fields encrypt stores alongside the key; tags may not reuse them
+var reservedSecretFields = []string{
+	"created_at",
+	"device",
+	"device_by_id",
+	"filesystem",
+	"hostname",
+	"integrity",
+	"key_encoding",
+	"key_fingerprint",
+	"key_split",
+	"label",
+	"loop_file",
+	"metadata_mac",
+	"no_read_workqueue",
+	"no_write_workqueue",
+	"offset",
+	"profile",
+	"schema_version",
+	"subsystem",
+	"tags",
+	"tpm_sealed",
+}
+
+// parseTags parses repeated --tag key=value flags. Keys may not repeat or name a reserved field.
+func parseTags(values []string, reserved []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	isReserved := make(map[string]bool, len(reserved))
+	for _, field := range reserved {
+		isReserved[field] = true
+	}
+
+	tags := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, found := strings.Cut(value, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tag %q: expected key=value", value)
+		}
+
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("invalid tag %q: key cannot be empty", value)
+		case len(key) > maxTagKeyLength:
+			return nil, fmt.Errorf("invalid tag %q: key is longer than %d characters", key, maxTagKeyLength)
+		case !tagKeyPattern.MatchString(key):
+			return nil, fmt.Errorf("invalid tag %q: key may only contain letters, digits, '_', '.' and '-'", key)
+		case isReserved[key]:
+			return nil, fmt.Errorf("invalid tag %q: %s is a reserved field", key, key)
+		case len(val) > maxTagValueLength:
+			return nil, fmt.Errorf("invalid tag %q: value is longer than %d characters", key, maxTagValueLength)
+		}
+
+		if _, exists := tags[key]; exists {
+			return nil, fmt.Errorf("tag %q given more than once", key)
+		}
+		tags[key] = val
+	}
+
+	return tags, nil
+}
+
+// mergeTags adds tags to secret data under the "tags" field
+func mergeTags(secretData map[string]interface{}, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	merged := make(map[string]interface{}, len(tags))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	secretData["tags"] = merged
+}
+
+// formatTags renders tags as comma-separated key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	reserved := append(reservedSecretFields, "dmcrypt_key")
+
+	tags, err := parseTags([]string{"ticket=OPS-123", "cost_center=4410", "env=prod", "note=a=b"}, reserved)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ticket":      "OPS-123",
+		"cost_center": "4410",
+		"env":         "prod",
+		"note":        "a=b",
+	}, tags)
+
+	tags, err = parseTags(nil, reserved)
+	require.NoError(t, err)
+	assert.Nil(t, tags)
+
+	tests := []struct {
+		tag    string
+		errMsg string
+	}{
+		{"ticket", "expected key=value"},
+		{"=OPS-123", "key cannot be empty"},
+		{"dmcrypt_key=x", "reserved field"},
+		{"hostname=x", "reserved field"},
+		{"tags=x", "reserved field"},
+		{"bad key=x", "may only contain"},
+		{strings.Repeat("k", maxTagKeyLength+1) + "=x", "key is longer than"},
+		{"note=" + strings.Repeat("v", maxTagValueLength+1), "value is longer than"},
+	}
+	for _, tt := range tests {
+		_, err := parseTags([]string{tt.tag}, reserved)
+		require.Error(t, err, tt.tag)
+		assert.Contains(t, err.Error(), tt.errMsg)
+	}
+
+	_, err = parseTags([]string{"env=prod", "env=dev"}, reserved)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "more than once")
+}
+
+func TestMergeTags(t *testing.T) {
+	secretData := map[string]interface{}{"dmcrypt_key": "k", "device": "/dev/sdb"}
+
+	mergeTags(secretData, nil)
+	assert.NotContains(t, secretData, "tags")
+
+	mergeTags(secretData, map[string]string{"env": "prod"})
+	assert.Equal(t, map[string]interface{}{
+		"dmcrypt_key": "k",
+		"device":      "/dev/sdb",
+		"tags":        map[string]interface{}{"env": "prod"},
+	}, secretData)
+}
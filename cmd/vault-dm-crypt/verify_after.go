@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// mappingReopener is the subset of the LUKS manager used to close and reopen a new mapping
+type mappingReopener interface {
+	CloseDevice(deviceName string) error
+	OpenDeviceWithOptions(devicePath, key, deviceName string, opts dmcrypt.OpenOptions) error
+}
+
+// roundTripCheck is where the key of a newly encrypted device was stored, for --verify-after
+type roundTripCheck struct {
+	store     secretReader
+	vaultPath string
+}
+
+// verifyRoundTrip proves that a newly encrypted device can be opened the way boot-time decrypt
+// will open it: the mapping is closed, the key is read back from Vault and the device is reopened
+// with it. On failure the device is left closed, so the error says exactly what state it is in.
+func verifyRoundTrip(ctx context.Context, devices mappingReopener, check *roundTripCheck, uuid, key, devicePath, deviceName string, opts dmcrypt.OpenOptions) error {
+	fields := logrus.Fields{
+		"uuid":        uuid,
+		"device":      devicePath,
+		"device_name": deviceName,
+		"path":        check.vaultPath,
+	}
+	logger.WithFields(fields).Info("Verifying the device reopens with the key stored in Vault")
+
+	if err := devices.CloseDevice(deviceName); err != nil {
+		return fmt.Errorf("verification failed: could not close %s to reopen it: %w", deviceName, err)
+	}
+
+	secretData, err := check.store.ReadSecretVersion(ctx, check.vaultPath, 0)
+	if err != nil {
+		logger.WithFields(fields).WithError(err).Error("VERIFICATION FAILED: the key could not be read back from Vault")
+		return fmt.Errorf("verification failed: the key for %s could not be read back from Vault at %s; the device is formatted but closed: %w", uuid, check.vaultPath, err)
+	}
+
+	storedKey, err := deviceKeyFromSecret(secretData, uuid, cfg.Vault.KeyFieldNames())
+	if err == nil {
+		err = checkStoredMetadata(storedKey, uuid, secretData)
+	}
+	if err != nil {
+		logger.WithFields(fields).WithError(err).Error("VERIFICATION FAILED: the key stored in Vault is unusable")
+		return fmt.Errorf("verification failed: the key stored for %s at %s is unusable; the device is formatted but closed: %w", uuid, check.vaultPath, err)
+	}
+	defer dmcryptManager.SecureEraseKey(&storedKey)
+
+	if subtle.ConstantTimeCompare([]byte(storedKey), []byte(key)) != 1 {
+		logger.WithFields(fields).Error("VERIFICATION FAILED: the key stored in Vault differs from the key the device was formatted with")
+		return fmt.Errorf("verification failed: the key stored for %s at %s does not match the key the device was formatted with; the device is closed and will not decrypt on boot", uuid, check.vaultPath)
+	}
+
+	// Open the way boot-time decrypt does, with the key as read from Vault
+	if err := devices.OpenDeviceWithOptions(devicePath, storedKey, deviceName, opts); err != nil {
+		logger.WithFields(fields).WithError(err).Error("VERIFICATION FAILED: the device could not be reopened with the key stored in Vault")
+		return fmt.Errorf("verification failed: %s could not be reopened with the key stored in Vault; the device is formatted but closed: %w", devicePath, err)
+	}
+
+	logger.WithFields(fields).Info("Verified the device reopens with the key stored in Vault")
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/dmcrypt"
+)
+
+// fakeLUKSDevice opens only with the key it was formatted with, like a real LUKS header
+type fakeLUKSDevice struct {
+	formattedKey string
+	open         bool
+	closeErr     error
+	calls        []string
+}
+
+func (f *fakeLUKSDevice) CloseDevice(deviceName string) error {
+	f.calls = append(f.calls, "close "+deviceName)
+	if f.closeErr != nil {
+		return f.closeErr
+	}
+	f.open = false
+	return nil
+}
+
+func (f *fakeLUKSDevice) OpenDeviceWithOptions(devicePath, key, deviceName string, opts dmcrypt.OpenOptions) error {
+	f.calls = append(f.calls, "open "+devicePath+" "+deviceName)
+	if key != f.formattedKey {
+		return errors.New("No key available with this passphrase")
+	}
+	f.open = true
+	return nil
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	useEncryptTestConfig(t)
+	originalManager := dmcryptManager
+	t.Cleanup(func() { dmcryptManager = originalManager })
+	dmcryptManager = dmcrypt.NewLUKSManager(logger)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+	const key = "c2VjcmV0LWtleS1tYXRlcmlhbA=="
+
+	// Store the key as encrypt does, then format and open the device with it
+	setup := func(t *testing.T) (*fakeKeyStore, *fakeLUKSDevice, *roundTripCheck) {
+		store := newFakeKeyStore()
+		vaultPath, err := storeKey(context.Background(), store, uuid, key, keyRecord{Device: "/dev/sdb1"}, false)
+		require.NoError(t, err)
+		return store, &fakeLUKSDevice{formattedKey: key, open: true}, &roundTripCheck{store: store, vaultPath: vaultPath}
+	}
+
+	t.Run("device reopens with the stored key", func(t *testing.T) {
+		_, device, check := setup(t)
+
+		err := verifyRoundTrip(context.Background(), device, check, uuid, key, "/dev/sdb1", "luks-test", dmcrypt.OpenOptions{})
+		require.NoError(t, err)
+		assert.True(t, device.open)
+		assert.Equal(t, []string{"close luks-test", "open /dev/sdb1 luks-test"}, device.calls)
+	})
+
+	t.Run("key missing from Vault", func(t *testing.T) {
+		store, device, check := setup(t)
+		delete(store.secrets, check.vaultPath)
+
+		err := verifyRoundTrip(context.Background(), device, check, uuid, key, "/dev/sdb1", "luks-test", dmcrypt.OpenOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not be read back from Vault")
+		assert.Contains(t, err.Error(), "formatted but closed")
+		assert.False(t, device.open)
+	})
+
+	t.Run("stored key differs from the formatted key", func(t *testing.T) {
+		store, device, check := setup(t)
+		store.secrets[check.vaultPath]["dmcrypt_key"] = "b3RoZXIta2V5"
+
+		err := verifyRoundTrip(context.Background(), device, check, uuid, key, "/dev/sdb1", "luks-test", dmcrypt.OpenOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match the key the device was formatted with")
+		assert.False(t, device.open)
+		assert.Equal(t, []string{"close luks-test"}, device.calls, "no open is attempted with the wrong key")
+	})
+
+	t.Run("device does not open with the stored key", func(t *testing.T) {
+		_, device, check := setup(t)
+		device.formattedKey = "c29tZXRoaW5nLWVsc2U="
+
+		err := verifyRoundTrip(context.Background(), device, check, uuid, key, "/dev/sdb1", "luks-test", dmcrypt.OpenOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not be reopened with the key stored in Vault")
+		assert.False(t, device.open)
+	})
+
+	t.Run("mapping cannot be closed", func(t *testing.T) {
+		_, device, check := setup(t)
+		device.closeErr = errors.New("device busy")
+
+		err := verifyRoundTrip(context.Background(), device, check, uuid, key, "/dev/sdb1", "luks-test", dmcrypt.OpenOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "device busy")
+		assert.True(t, device.open)
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// vaultWriteProber is the subset of the Vault client used to check that a key can be stored
+type vaultWriteProber interface {
+	ProbeWrite(ctx context.Context, path string) error
+}
+
+// probeVaultWritable confirms that a key can be persisted at vaultPath. Encrypt runs it before
+// generating the key or touching the disk, so that a Vault that is reachable but read-only
+// (e.g. a KV mount under maintenance) aborts the operation rather than leaving a formatted
+// device whose key was never stored.
+func probeVaultWritable(ctx context.Context, prober vaultWriteProber, vaultPath string) error {
+	logger.WithField("path", vaultPath).Debug("Probing that Vault accepts writes")
+
+	if err := prober.ProbeWrite(ctx, vaultPath); err != nil {
+		return fmt.Errorf("vault is not accepting writes at %s, aborting before the device is modified: %w", vaultPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWriteProber struct {
+	err    error
+	probed []string
+}
+
+func (f *fakeWriteProber) ProbeWrite(ctx context.Context, path string) error {
+	f.probed = append(f.probed, path)
+	return f.err
+}
+
+func TestProbeVaultWritable(t *testing.T) {
+	t.Run("writable", func(t *testing.T) {
+		prober := &fakeWriteProber{}
+		require.NoError(t, probeVaultWritable(context.Background(), prober, "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"vault-dm-crypt/host/uuid-1"}, prober.probed)
+	})
+
+	t.Run("read-only mount aborts", func(t *testing.T) {
+		readOnly := errors.New("cannot write to readonly storage")
+		prober := &fakeWriteProber{err: readOnly}
+
+		err := probeVaultWritable(context.Background(), prober, "vault-dm-crypt/host/uuid-1")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, readOnly))
+		assert.Contains(t, err.Error(), "aborting before the device is modified")
+	})
+}
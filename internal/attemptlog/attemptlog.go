@@ -0,0 +1,252 @@
+// Package attemptlog keeps a hash-chained, append-only record of decrypt attempts so that
+// probing of stolen disks is visible and edits to, or truncation of, the record are detectable.
+package attemptlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/fileperm"
+)
+
+// Attempt results
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// ErrChainBroken is returned when an entry does not chain to the one before it
+var ErrChainBroken = errors.New("attempt log hash chain is broken")
+
+// ErrTruncated is returned when entries recorded in an anchored head are missing from the log
+var ErrTruncated = errors.New("attempt log has been truncated")
+
+// ErrHeadMismatch is returned when the entry at an anchored head has a different hash
+var ErrHeadMismatch = errors.New("attempt log does not match recorded head")
+
+// Entry is one decrypt attempt. Hash covers every other field, including PrevHash,
+// which is the Hash of the previous entry (empty for the first).
+type Entry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	UUID     string    `json:"uuid"`
+	Result   string    `json:"result"`
+	Source   string    `json:"source,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// Head identifies a position in the chain; storing it outside the log (e.g. in Vault)
+// anchors everything up to that point
+type Head struct {
+	Seq  int64
+	Hash string
+}
+
+// Head returns the chain position of the entry
+func (e Entry) Head() Head {
+	return Head{Seq: e.Seq, Hash: e.Hash}
+}
+
+// computeHash returns the hash of the entry with its Hash field cleared
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode attempt log entry")
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Append chains entry onto the log at path, creating it with mode 0600 if needed, and returns
+// the entry as written. Seq, PrevHash and Hash are assigned here; Time defaults to now.
+func Append(path string, entry Entry) (Entry, error) {
+	return AppendWithMode(path, entry, fileperm.DefaultMode)
+}
+
+// AppendWithMode is Append creating the log with mode instead, and narrowing the permissions
+// of an existing log to it
+func AppendWithMode(path string, entry Entry, mode os.FileMode) (Entry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to create attempt log directory: %s", filepath.Dir(path)))
+	}
+
+	file, err := fileperm.OpenFile(path, os.O_RDWR|os.O_APPEND, mode)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to open attempt log: %s", path))
+	}
+	defer file.Close()
+
+	// Concurrent decrypts must not both chain onto the same previous entry
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to lock attempt log: %s", path))
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	last, err := lastEntry(file)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to read attempt log: %s", path))
+	}
+
+	if last != nil {
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+	} else {
+		entry.Seq = 1
+		entry.PrevHash = ""
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+
+	entry.Hash, err = entry.computeHash()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, "failed to encode attempt log entry")
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to write attempt log: %s", path))
+	}
+
+	if err := file.Sync(); err != nil {
+		return Entry{}, errors.Wrap(err, fmt.Sprintf("failed to sync attempt log: %s", path))
+	}
+
+	return entry, nil
+}
+
+// lastEntry returns the final entry in the log, or nil if it is empty
+func lastEntry(file *os.File) (*Entry, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid last entry: %w", err)
+	}
+	return &entry, nil
+}
+
+// Read loads the log at path and verifies its hash chain. A missing log reads as empty.
+func Read(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open attempt log: %s", path))
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// Parse reads log entries from r and verifies that each one chains to the previous
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("%w: line %d is not a valid entry: %v", ErrChainBroken, line, err)
+		}
+
+		if err := verifyLink(entries, entry); err != nil {
+			return entries, fmt.Errorf("%w: line %d: %v", ErrChainBroken, line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return entries, errors.Wrap(err, "failed to read attempt log")
+	}
+
+	return entries, nil
+}
+
+// verifyLink checks entry against its own hash and the entry before it
+func verifyLink(previous []Entry, entry Entry) error {
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash {
+		return fmt.Errorf("entry %d has been modified", entry.Seq)
+	}
+
+	if len(previous) == 0 {
+		if entry.Seq != 1 || entry.PrevHash != "" {
+			return fmt.Errorf("first entry is %d, earlier entries are missing", entry.Seq)
+		}
+		return nil
+	}
+
+	prev := previous[len(previous)-1]
+	if entry.Seq != prev.Seq+1 {
+		return fmt.Errorf("entry %d follows entry %d", entry.Seq, prev.Seq)
+	}
+	if entry.PrevHash != prev.Hash {
+		return fmt.Errorf("entry %d does not chain to entry %d", entry.Seq, prev.Seq)
+	}
+	return nil
+}
+
+// VerifyHead checks that verified entries still contain the anchored head. A head beyond the
+// end of the log means entries were removed; a hash mismatch means the log was rewritten.
+func VerifyHead(entries []Entry, head Head) error {
+	if head.Seq <= 0 {
+		return nil
+	}
+
+	if len(entries) == 0 || head.Seq > entries[len(entries)-1].Seq {
+		return fmt.Errorf("%w: recorded head is entry %d but the log has %d entries", ErrTruncated, head.Seq, len(entries))
+	}
+
+	entry := entries[head.Seq-entries[0].Seq]
+	if entry.Hash != head.Hash {
+		return fmt.Errorf("%w: entry %d", ErrHeadMismatch, head.Seq)
+	}
+
+	return nil
+}
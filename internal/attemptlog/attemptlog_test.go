@@ -0,0 +1,181 @@
+package attemptlog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendAttempts(t *testing.T, path string, results ...string) []Entry {
+	t.Helper()
+	var written []Entry
+	for i, result := range results {
+		entry, err := Append(path, Entry{
+			Time:   time.Date(2026, 1, 2, 3, 4, i, 0, time.UTC),
+			UUID:   "1234-abcd",
+			Result: result,
+			Source: "10.0.0.5",
+		})
+		require.NoError(t, err)
+		written = append(written, entry)
+	}
+	return written
+}
+
+func TestAppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+
+	written := appendAttempts(t, path, ResultFailure, ResultFailure, ResultSuccess)
+	assert.Equal(t, int64(1), written[0].Seq)
+	assert.Empty(t, written[0].PrevHash)
+	assert.Equal(t, written[0].Hash, written[1].PrevHash)
+	assert.Equal(t, written[1].Hash, written[2].PrevHash)
+
+	entries, err := Read(path)
+	require.NoError(t, err)
+	assert.Equal(t, written, entries)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestReadMissingLog(t *testing.T) {
+	entries, err := Read(filepath.Join(t.TempDir(), "missing.log"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestReadDetectsModifiedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+	appendAttempts(t, path, ResultFailure, ResultFailure, ResultSuccess)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+	lines[1] = strings.Replace(lines[1], `"result":"failure"`, `"result":"success"`, 1)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+
+	entries, err := Read(path)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrChainBroken))
+	assert.Contains(t, err.Error(), "entry 2 has been modified")
+	assert.Len(t, entries, 1, "entries before the break are returned")
+}
+
+func TestReadDetectsRemovedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+	appendAttempts(t, path, ResultFailure, ResultFailure, ResultSuccess)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+
+	t.Run("middle entry", func(t *testing.T) {
+		without := append([]string{lines[0]}, lines[2:]...)
+		require.NoError(t, os.WriteFile(path, []byte(strings.Join(without, "\n")), 0600))
+
+		_, err := Read(path)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrChainBroken))
+		assert.Contains(t, err.Error(), "entry 3 follows entry 1")
+	})
+
+	t.Run("leading entry", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines[1:], "\n")), 0600))
+
+		_, err := Read(path)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrChainBroken))
+		assert.Contains(t, err.Error(), "earlier entries are missing")
+	})
+}
+
+func TestVerifyHeadDetectsTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+	written := appendAttempts(t, path, ResultFailure, ResultFailure, ResultSuccess)
+	head := written[2].Head()
+
+	entries, err := Read(path)
+	require.NoError(t, err)
+	require.NoError(t, VerifyHead(entries, head))
+
+	// Dropping trailing entries leaves a valid chain, but not one reaching the recorded head
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+	require.NoError(t, os.WriteFile(path, []byte(lines[0]+lines[1]), 0600))
+
+	entries, err = Read(path)
+	require.NoError(t, err)
+	err = VerifyHead(entries, head)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrTruncated))
+
+	// Deleting the whole log is truncation too
+	require.NoError(t, os.Remove(path))
+	entries, err = Read(path)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(VerifyHead(entries, head), ErrTruncated))
+}
+
+func TestVerifyHeadDetectsRewrittenLog(t *testing.T) {
+	dir := t.TempDir()
+	original := appendAttempts(t, filepath.Join(dir, "original.log"), ResultFailure, ResultSuccess)
+
+	// A freshly built chain of the same length does not match the recorded head
+	rewritten := filepath.Join(dir, "rewritten.log")
+	_, err := Append(rewritten, Entry{UUID: "1234-abcd", Result: ResultSuccess})
+	require.NoError(t, err)
+	_, err = Append(rewritten, Entry{UUID: "1234-abcd", Result: ResultSuccess})
+	require.NoError(t, err)
+
+	entries, err := Read(rewritten)
+	require.NoError(t, err)
+	err = VerifyHead(entries, original[1].Head())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrHeadMismatch))
+
+	assert.NoError(t, VerifyHead(entries, Head{}), "no recorded head is nothing to verify")
+}
+
+func TestAppendFileMode(t *testing.T) {
+	t.Run("created 0600 by default", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "attempts.log")
+		appendAttempts(t, path, ResultSuccess)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("created with the configured mode", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "attempts.log")
+		_, err := AppendWithMode(path, Entry{UUID: "1234-abcd", Result: ResultSuccess}, 0640)
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	})
+
+	t.Run("existing log is narrowed and still chains", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "attempts.log")
+		appendAttempts(t, path, ResultFailure)
+		require.NoError(t, os.Chmod(path, 0644))
+
+		entry, err := AppendWithMode(path, Entry{UUID: "1234-abcd", Result: ResultSuccess}, 0600)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), entry.Seq)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+}
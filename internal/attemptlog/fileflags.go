@@ -0,0 +1,83 @@
+package attemptlog
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// fsAppendFL is the append-only inode attribute flag from linux/fs.h, as shown by lsattr and
+// set by chattr +a
+const fsAppendFL = 0x00000020
+
+// ErrFlagsUnsupported is returned when the filesystem holding the log has no inode attribute
+// flags (FS_IOC_GETFLAGS), e.g. tmpfs or some network filesystems. ext4 and xfs support them.
+var ErrFlagsUnsupported = errors.New("filesystem does not support append-only files")
+
+// IsAppendOnly reports whether the append-only attribute is set on the file at path
+func IsAppendOnly(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to open attempt log: %s", path))
+	}
+	defer file.Close()
+
+	flags, err := getFlags(file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read attributes of %s: %w", path, err)
+	}
+	return flags&fsAppendFL != 0, nil
+}
+
+// SetAppendOnly sets the append-only attribute on the file at path, so that it can only be
+// opened for appending, even by root, until the attribute is cleared with chattr -a. Setting it
+// needs CAP_LINUX_IMMUTABLE; a file that is already append-only is left as it is.
+func SetAppendOnly(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to open attempt log: %s", path))
+	}
+	defer file.Close()
+
+	flags, err := getFlags(file)
+	if err != nil {
+		return fmt.Errorf("failed to read attributes of %s: %w", path, err)
+	}
+	if flags&fsAppendFL != 0 {
+		return nil
+	}
+
+	if err := setFlags(file, flags|fsAppendFL); err != nil {
+		return fmt.Errorf("failed to make %s append-only: %w", path, err)
+	}
+	return nil
+}
+
+// getFlags reads the inode attribute flags of file
+func getFlags(file *os.File) (uint32, error) {
+	flags, err := unix.IoctlGetUint32(int(file.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return 0, flagsError(err)
+	}
+	return flags, nil
+}
+
+// setFlags replaces the inode attribute flags of file
+func setFlags(file *os.File, flags uint32) error {
+	if err := unix.IoctlSetPointerInt(int(file.Fd()), unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		return flagsError(err)
+	}
+	return nil
+}
+
+// flagsError reports the errors filesystems without attribute flags return as ErrFlagsUnsupported
+func flagsError(err error) error {
+	switch err {
+	case unix.ENOTTY, unix.EOPNOTSUPP, unix.ENOSYS:
+		return fmt.Errorf("%w: %v", ErrFlagsUnsupported, err)
+	}
+	return err
+}
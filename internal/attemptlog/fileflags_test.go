@@ -0,0 +1,72 @@
+package attemptlog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// clearAppendOnly removes the append-only attribute so the test directory can be cleaned up
+func clearAppendOnly(t *testing.T, path string) {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	flags, err := getFlags(file)
+	require.NoError(t, err)
+	require.NoError(t, setFlags(file, flags&^fsAppendFL))
+}
+
+func TestSetAppendOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.log")
+	appendAttempts(t, path, ResultFailure)
+
+	appendOnly, err := IsAppendOnly(path)
+	if errors.Is(err, ErrFlagsUnsupported) {
+		t.Skipf("filesystem of %s does not support attribute flags", path)
+	}
+	require.NoError(t, err)
+	assert.False(t, appendOnly)
+
+	// Setting the attribute needs CAP_LINUX_IMMUTABLE, and not every filesystem can store it
+	err = SetAppendOnly(path)
+	if errors.Is(err, ErrFlagsUnsupported) || errors.Is(err, unix.EPERM) {
+		t.Skipf("cannot set the append-only attribute here: %v", err)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { clearAppendOnly(t, path) })
+
+	appendOnly, err = IsAppendOnly(path)
+	require.NoError(t, err)
+	assert.True(t, appendOnly)
+
+	// Setting it again leaves it as it is
+	require.NoError(t, SetAppendOnly(path))
+
+	// The log can still be appended to, but not rewritten or removed
+	appendAttempts(t, path, ResultSuccess)
+	entries, err := Read(path)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.Error(t, os.Remove(path))
+}
+
+func TestIsAppendOnlyMissingLog(t *testing.T) {
+	_, err := IsAppendOnly(filepath.Join(t.TempDir(), "missing.log"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFlagsError(t *testing.T) {
+	assert.ErrorIs(t, flagsError(unix.ENOTTY), ErrFlagsUnsupported)
+	assert.ErrorIs(t, flagsError(unix.EOPNOTSUPP), ErrFlagsUnsupported)
+	assert.Equal(t, unix.EPERM, flagsError(unix.EPERM))
+}
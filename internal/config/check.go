@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// Check validates the configuration without any network or device access and returns
+// every problem found, rather than stopping at the first one like Validate
+func (c *Config) Check() []error {
+	var problems []error
+	seen := make(map[string]bool)
+	add := func(err error) {
+		if err != nil && !seen[err.Error()] {
+			seen[err.Error()] = true
+			problems = append(problems, err)
+		}
+	}
+
+	add(c.checkURL())
+	add(c.checkAuthMethod())
+	add(c.checkFiles())
+	add(c.checkLogOutput())
+
+	add(c.Validate())
+
+	return problems
+}
+
+// checkURL verifies that the Vault URL is an absolute http(s) URL
+func (c *Config) checkURL() error {
+	u, err := url.Parse(c.Vault.URL)
+	if err != nil {
+		return errors.NewConfigError("vault.url", fmt.Sprintf("invalid URL %q: %v", c.Vault.URL, err), err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.NewConfigError("vault.url", fmt.Sprintf("URL must use http or https: %q", c.Vault.URL), nil)
+	}
+
+	if u.Host == "" {
+		return errors.NewConfigError("vault.url", fmt.Sprintf("URL has no host: %q", c.Vault.URL), nil)
+	}
+
+	return nil
+}
+
+// checkAuthMethod verifies that exactly one authentication method is configured
+func (c *Config) checkAuthMethod() error {
+	hasToken := c.Vault.VaultToken != ""
+	hasSecretID := c.Vault.SecretID != "" || c.Vault.SecretIDCredential != ""
+
+	if hasToken && (c.Vault.AppRole != "" || hasSecretID) {
+		return errors.NewConfigError("vault", "vault_token and approle/secret_id are mutually exclusive - use either token authentication or approle authentication, not both", nil)
+	}
+
+	if c.Vault.SecretID != "" && c.Vault.SecretIDCredential != "" {
+		return errors.NewConfigError("vault.secret_id_credential", "secret_id and secret_id_credential are mutually exclusive", nil)
+	}
+
+	return nil
+}
+
+// checkFiles verifies that files referenced by the configuration exist
+func (c *Config) checkFiles() error {
+	if err := c.Vault.validateCAPath(); err != nil {
+		return err
+	}
+
+	if c.Vault.CABundle == "" {
+		return nil
+	}
+
+	info, err := os.Stat(c.Vault.CABundle)
+	if err != nil {
+		return errors.NewConfigError("vault.ca_bundle", fmt.Sprintf("CA bundle file not found: %s", c.Vault.CABundle), err)
+	}
+
+	if info.IsDir() {
+		return errors.NewConfigError("vault.ca_bundle", fmt.Sprintf("CA bundle is a directory, not a file: %s", c.Vault.CABundle), nil)
+	}
+
+	return nil
+}
+
+// checkLogOutput verifies that the directory for a log file exists
+func (c *Config) checkLogOutput() error {
+	if c.Logging.Output == "stdout" || c.Logging.Output == "stderr" {
+		return nil
+	}
+
+	dir := filepath.Dir(c.Logging.Output)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return errors.NewConfigError("logging.output", fmt.Sprintf("log output directory does not exist: %s", dir), err)
+	}
+
+	return nil
+}
@@ -2,9 +2,17 @@ package config
 
 import (
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/spf13/viper"
@@ -14,8 +22,40 @@ import (
 
 // Config represents the complete configuration structure
 type Config struct {
-	Vault   VaultConfig   `mapstructure:"vault"`
-	Logging LoggingConfig `mapstructure:"logging"`
+	General  GeneralConfig  `mapstructure:"general"`
+	Vault    VaultConfig    `mapstructure:"vault"`
+	DMCrypt  DMCryptConfig  `mapstructure:"dmcrypt"`
+	LUKS     LUKSConfig     `mapstructure:"luks"`
+	Devices  []DeviceConfig `mapstructure:"device"`
+	Hooks    HooksConfig    `mapstructure:"hooks"`
+	Notify   NotifyConfig   `mapstructure:"notify"`
+	Tracing  TracingConfig  `mapstructure:"tracing"`
+	Security SecurityConfig `mapstructure:"security"`
+	Safety   SafetyConfig   `mapstructure:"safety"`
+	Audit    AuditConfig    `mapstructure:"audit"`
+	Logging  LoggingConfig  `mapstructure:"logging"`
+}
+
+// GeneralConfig contains host-wide settings
+type GeneralConfig struct {
+	NodeName      string `mapstructure:"node_name"`      // Optional: overrides os.Hostname() for the stored hostname metadata
+	MaxConcurrent int    `mapstructure:"max_concurrent"` // Maximum encrypt/decrypt invocations running at once on the host (0 = unlimited)
+	VerifyAfter   bool   `mapstructure:"verify_after"`   // Reopen a newly encrypted device with the key read back from Vault before reporting success
+}
+
+// Hostname returns the node name used for stored metadata and host filtering.
+// The configured node_name wins; otherwise os.Hostname() is used.
+func (g GeneralConfig) Hostname() (string, error) {
+	if g.NodeName != "" {
+		return g.NodeName, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get hostname")
+	}
+
+	return hostname, nil
 }
 
 // VaultConfig contains Vault-specific configuration
@@ -26,14 +66,57 @@ type VaultConfig struct {
 	VaultPath      string `mapstructure:"vault_path"`   // Base path for storing keys (supports %h for hostname, default: "vault-dm-crypt/%h")
 	AppRole        string `mapstructure:"approle"`      // The role_id (UUID)
 	AppRoleName    string `mapstructure:"approle_name"` // Optional: The role name for generating new secret IDs
-	SecretID       string `mapstructure:"secret_id"`
-	VaultToken     string `mapstructure:"vault_token"` // Alternative to AppRole: Vault token for authentication
+	SecretID       string `mapstructure:"secret_id" redact:"true"`
+	VaultToken     string `mapstructure:"vault_token" redact:"true"` // Alternative to AppRole: Vault token for authentication
 	CABundle       string `mapstructure:"ca_bundle"`
+	CAPath         string `mapstructure:"ca_path"` // Optional: directory of PEM CA certificates; alternative to ca_bundle
 	TimeoutSecs    int    `mapstructure:"timeout"`
 	RetryMax       int    `mapstructure:"retry_max"`
 	RetryDelaySecs int    `mapstructure:"retry_delay"`
+
+	// Optional: Go template for the key path, e.g. "vaultlocker/{{.Hostname}}/{{.UUID}}"; overrides vault_path
+	PathTemplate string `mapstructure:"path_template"`
+
+	// Optional: KV backend to read from when a secret is not found on backend, e.g. during a migration.
+	// Writes always go to backend.
+	FallbackBackend string `mapstructure:"fallback_backend"`
+
+	// Secret field holding the key (default: "dmcrypt_key")
+	KeyField string `mapstructure:"key_field"`
+	// Optional: fields tried in order on decrypt, e.g. a primary and an escrow key; overrides key_field.
+	// Encrypt writes the first.
+	KeyFields []string `mapstructure:"key_fields"`
+
+	// KV v2 only: write new keys with check-and-set so an existing key is never overwritten
+	UseCAS bool `mapstructure:"use_cas"`
+
+	// Path the AppRole auth method is mounted at (default: "approle")
+	AppRoleMount string `mapstructure:"approle_mount_path"`
+
+	// Optional: name of a systemd credential ($CREDENTIALS_DIRECTORY/<name>) holding the secret_id
+	SecretIDCredential string `mapstructure:"secret_id_credential"`
+
+	// [general] node_name, copied here on load so %h and {{.Hostname}} follow it
+	nodeName string
+
+	// Optional: client-side limit on Vault requests per second (0 = unlimited)
+	MaxRequestsPerSecond float64 `mapstructure:"max_requests_per_second"`
+
+	// Collapse retry warnings whose error is unchanged from the previous attempt
+	RetryLogDedup bool `mapstructure:"retry_log_dedup"`
+
+	// Treat tokens and secret IDs as expired this many seconds early, to tolerate clock skew
+	// between this host and Vault (0 = DefaultExpiryBufferSecs)
+	ExpiryBufferSecs int `mapstructure:"expiry_buffer"`
+
+	// Optional: HTTP headers sent with every Vault request, e.g. a token for an API gateway in
+	// front of Vault. Their values often carry credentials, so dump-config redacts them all.
+	Headers map[string]string `mapstructure:"headers" redact:"values"`
 }
 
+// DefaultExpiryBufferSecs is the expiry buffer used when expiry_buffer is not set
+const DefaultExpiryBufferSecs = 30
+
 func (v VaultConfig) Timeout() time.Duration {
 	return time.Duration(v.TimeoutSecs) * time.Second
 }
@@ -42,6 +125,52 @@ func (v VaultConfig) RetryDelay() time.Duration {
 	return time.Duration(v.RetryDelaySecs) * time.Second
 }
 
+// ExpiryBuffer returns how long before their expiry tokens and secret IDs are treated as expired
+func (v VaultConfig) ExpiryBuffer() time.Duration {
+	if v.ExpiryBufferSecs <= 0 {
+		return DefaultExpiryBufferSecs * time.Second
+	}
+	return time.Duration(v.ExpiryBufferSecs) * time.Second
+}
+
+// AppRoleMountPath returns the AppRole auth mount without surrounding slashes, defaulting to "approle"
+func (v VaultConfig) AppRoleMountPath() string {
+	if mount := strings.Trim(v.AppRoleMount, "/"); mount != "" {
+		return mount
+	}
+	return "approle"
+}
+
+// LoginSecretID returns the AppRole secret ID to log in with. With secret_id_credential set it
+// is read from the systemd credential, which only exists inside the unit, so it is read when a
+// login needs it rather than when the configuration is loaded.
+func (v VaultConfig) LoginSecretID() (string, error) {
+	if v.SecretID != "" || v.SecretIDCredential == "" {
+		return v.SecretID, nil
+	}
+
+	secretID, err := ReadCredential(v.SecretIDCredential)
+	if err != nil {
+		return "", errors.NewConfigError("vault.secret_id_credential", fmt.Sprintf("failed to read secret_id credential: %v", err), err)
+	}
+	return secretID, nil
+}
+
+// DefaultKeyField is the secret field holding the key, as used by vaultlocker
+const DefaultKeyField = "dmcrypt_key"
+
+// KeyFieldNames returns the secret fields to read the key from, in order. The first is the
+// field encrypt writes.
+func (v VaultConfig) KeyFieldNames() []string {
+	if len(v.KeyFields) > 0 {
+		return v.KeyFields
+	}
+	if v.KeyField != "" {
+		return []string{v.KeyField}
+	}
+	return []string{DefaultKeyField}
+}
+
 // ExpandedVaultPath returns the vault path with placeholders expanded
 // Supports %h for short hostname
 func (v VaultConfig) ExpandedVaultPath() (string, error) {
@@ -49,19 +178,518 @@ func (v VaultConfig) ExpandedVaultPath() (string, error) {
 
 	// Replace %h with short hostname
 	if strings.Contains(path, "%h") {
-		hostname, err := os.Hostname()
+		shortHostname, err := v.shortHostname()
 		if err != nil {
-			return "", errors.Wrap(err, "failed to get hostname for vault path expansion")
+			return "", err
 		}
-
-		// Use only the short hostname (before first dot)
-		shortHostname := strings.Split(hostname, ".")[0]
 		path = strings.ReplaceAll(path, "%h", shortHostname)
 	}
 
 	return path, nil
 }
 
+// shortHostname returns the node name, as used for stored metadata and mapping names, up to the first dot
+func (v VaultConfig) shortHostname() (string, error) {
+	hostname, err := GeneralConfig{NodeName: v.nodeName}.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get hostname for vault path expansion")
+	}
+	return strings.Split(hostname, ".")[0], nil
+}
+
+// PathTemplateData holds the variables available to path_template
+type PathTemplateData struct {
+	Hostname string // Short node name, as for %h in vault_path
+	UUID     string // LUKS UUID of the device
+}
+
+// pathTemplateListUUID stands in for the UUID when deriving the listing path from path_template
+const pathTemplateListUUID = "__uuid__"
+
+// parsePathTemplate compiles path_template, failing on references to unknown keys
+func (v VaultConfig) parsePathTemplate() (*template.Template, error) {
+	return template.New("path_template").Option("missingkey=error").Parse(v.PathTemplate)
+}
+
+// renderPathTemplate evaluates path_template for data
+func (v VaultConfig) renderPathTemplate(data PathTemplateData) (string, error) {
+	tmpl, err := v.parsePathTemplate()
+	if err != nil {
+		return "", errors.NewConfigError("vault.path_template", fmt.Sprintf("invalid path_template: %v", err), err)
+	}
+
+	var path strings.Builder
+	if err := tmpl.Execute(&path, data); err != nil {
+		return "", errors.NewConfigError("vault.path_template", fmt.Sprintf("invalid path_template: %v", err), err)
+	}
+
+	return strings.Trim(path.String(), "/"), nil
+}
+
+// validateHeaders checks that headers holds valid HTTP header names and values and does not
+// override the Vault token
+func (v VaultConfig) validateHeaders() error {
+	for name, value := range v.Headers {
+		if name == "" || strings.ContainsFunc(name, isInvalidHeaderNameRune) {
+			return errors.NewConfigError("vault.headers", fmt.Sprintf("%q is not a valid HTTP header name", name), nil)
+		}
+		if http.CanonicalHeaderKey(name) == "X-Vault-Token" {
+			return errors.NewConfigError("vault.headers", "headers cannot set X-Vault-Token; use vault_token instead", nil)
+		}
+		if strings.ContainsFunc(value, func(r rune) bool { return (r < ' ' && r != '\t') || r == 0x7f }) {
+			return errors.NewConfigError("vault.headers", fmt.Sprintf("the value of header %q contains control characters", name), nil)
+		}
+	}
+	return nil
+}
+
+// isInvalidHeaderNameRune reports whether r may not appear in an HTTP header name (RFC 9110 token)
+func isInvalidHeaderNameRune(r rune) bool {
+	return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
+
+// validateCAPath checks that ca_path, if set, is a directory and is not combined with ca_bundle
+func (v VaultConfig) validateCAPath() error {
+	if v.CAPath == "" {
+		return nil
+	}
+
+	if v.CABundle != "" {
+		return errors.NewConfigError("vault.ca_path", "ca_bundle and ca_path are mutually exclusive", nil)
+	}
+
+	info, err := os.Stat(v.CAPath)
+	if err != nil {
+		return errors.NewConfigError("vault.ca_path", fmt.Sprintf("CA directory not found: %s", v.CAPath), err)
+	}
+	if !info.IsDir() {
+		return errors.NewConfigError("vault.ca_path", fmt.Sprintf("CA path is not a directory: %s", v.CAPath), nil)
+	}
+	return nil
+}
+
+// validatePathTemplate checks that path_template compiles, references only known variables
+// and includes the UUID, so that every device gets its own path
+func (v VaultConfig) validatePathTemplate() error {
+	first, err := v.renderPathTemplate(PathTemplateData{Hostname: "host", UUID: "uuid-1"})
+	if err != nil {
+		return err
+	}
+
+	second, err := v.renderPathTemplate(PathTemplateData{Hostname: "host", UUID: "uuid-2"})
+	if err != nil {
+		return err
+	}
+
+	if first == second {
+		return errors.NewConfigError("vault.path_template", "path_template must include {{.UUID}}", nil)
+	}
+	return nil
+}
+
+// SecretPath returns the path, relative to the backend, of the key stored for a device UUID.
+// With path_template set the template is evaluated; otherwise the UUID is appended to vault_path.
+func (v VaultConfig) SecretPath(uuid string) (string, error) {
+	if v.PathTemplate == "" {
+		basePath, err := v.ExpandedVaultPath()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s/%s", basePath, uuid), nil
+	}
+
+	hostname, err := v.shortHostname()
+	if err != nil {
+		return "", err
+	}
+
+	return v.renderPathTemplate(PathTemplateData{Hostname: hostname, UUID: uuid})
+}
+
+// SecretListPath returns the path whose entries are the UUIDs of stored keys, so that
+// SecretListPath()/<uuid> equals SecretPath(uuid). A path_template must end in {{.UUID}}
+// for its keys to be listable.
+func (v VaultConfig) SecretListPath() (string, error) {
+	if v.PathTemplate == "" {
+		return v.ExpandedVaultPath()
+	}
+
+	path, err := v.SecretPath(pathTemplateListUUID)
+	if err != nil {
+		return "", err
+	}
+
+	listPath, found := strings.CutSuffix(path, "/"+pathTemplateListUUID)
+	if !found || strings.Contains(listPath, pathTemplateListUUID) {
+		return "", errors.NewConfigError("vault.path_template", "path_template must end with /{{.UUID}} to list stored keys", nil)
+	}
+	return listPath, nil
+}
+
+// DMCryptConfig contains settings for dm-crypt/cryptsetup operations
+type DMCryptConfig struct {
+	OperationTimeoutSecs  int `mapstructure:"operation_timeout"`   // Maximum runtime of a single cryptsetup operation before it is killed
+	MapperWaitTimeoutSecs int `mapstructure:"mapper_wait_timeout"` // How long to wait for /dev/mapper nodes to appear after opening
+	DeviceWaitTimeoutSecs int `mapstructure:"device_wait_timeout"` // How long decrypt waits for the device to appear (0 = no wait)
+	BusyRetries           int `mapstructure:"busy_retries"`        // Retries of luksOpen/luksClose when the device is busy (0 = no retry)
+
+	// Go template for the mapping name under /dev/mapper, e.g. "luks-{{.UUID}}"
+	NameTemplate string `mapstructure:"name_template"`
+
+	// Priority of cryptsetup luksOpen, so the argon2 PBKDF does not starve other boot services
+	Nice        int    `mapstructure:"nice"`         // Niceness increment (0-19, 0 = unchanged)
+	IONiceClass string `mapstructure:"ionice_class"` // ionice class: "", "best-effort" or "idle"
+
+	// Maximum argon2 threads for keyslots created by encrypt (0 = cryptsetup default)
+	PBKDFParallel int `mapstructure:"pbkdf_parallel"`
+}
+
+func (d DMCryptConfig) OperationTimeout() time.Duration {
+	return time.Duration(d.OperationTimeoutSecs) * time.Second
+}
+
+func (d DMCryptConfig) MapperWaitTimeout() time.Duration {
+	return time.Duration(d.MapperWaitTimeoutSecs) * time.Second
+}
+
+func (d DMCryptConfig) DeviceWaitTimeout() time.Duration {
+	return time.Duration(d.DeviceWaitTimeoutSecs) * time.Second
+}
+
+// DefaultNameTemplate names mappings like vaultlocker, which later tooling expects
+const DefaultNameTemplate = "vaultlocker-{{.UUIDNoDash}}"
+
+// maxMappingNameLength is the longest name device-mapper accepts (DM_NAME_LEN - 1)
+const maxMappingNameLength = 127
+
+// NameTemplateData holds the variables available to name_template
+type NameTemplateData struct {
+	UUID       string // LUKS UUID of the device
+	UUIDNoDash string // Lowercase UUID without hyphens
+	Hostname   string // Node name, as stored in the key metadata
+}
+
+// renderNameTemplate evaluates name_template for data and checks that the result is a usable
+// device-mapper name. An empty name_template uses DefaultNameTemplate.
+func (d DMCryptConfig) renderNameTemplate(data NameTemplateData) (string, error) {
+	text := d.NameTemplate
+	if text == "" {
+		text = DefaultNameTemplate
+	}
+
+	tmpl, err := template.New("name_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.NewConfigError("dmcrypt.name_template", fmt.Sprintf("invalid name_template: %v", err), err)
+	}
+
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", errors.NewConfigError("dmcrypt.name_template", fmt.Sprintf("invalid name_template: %v", err), err)
+	}
+
+	mapping := name.String()
+	if err := checkMappingName("dmcrypt.name_template", mapping); err != nil {
+		return "", err
+	}
+	return mapping, nil
+}
+
+// ValidateMappingName checks that name is usable as a /dev/mapper name, e.g. one given with
+// decrypt --name or recorded in Vault
+func ValidateMappingName(name string) error {
+	return checkMappingName("name", name)
+}
+
+// checkMappingName checks a mapping name, reporting problems against field
+func checkMappingName(field, mapping string) error {
+	switch {
+	case mapping == "" || mapping == "." || mapping == "..":
+		return errors.NewConfigError(field, fmt.Sprintf("invalid mapping name %q", mapping), nil)
+	case strings.ContainsAny(mapping, "/ \t\n"):
+		return errors.NewConfigError(field, fmt.Sprintf("mapping name %q must not contain slashes or whitespace", mapping), nil)
+	case len(mapping) > maxMappingNameLength:
+		return errors.NewConfigError(field, fmt.Sprintf("mapping name %q is longer than %d characters", mapping, maxMappingNameLength), nil)
+	}
+	return nil
+}
+
+// validateNameTemplate checks that name_template renders a valid name that includes the UUID,
+// so that every device gets its own mapping
+func (d DMCryptConfig) validateNameTemplate() error {
+	first, err := d.renderNameTemplate(newNameTemplateData("12345678-1234-1234-1234-123456789abc", "host"))
+	if err != nil {
+		return err
+	}
+
+	second, err := d.renderNameTemplate(newNameTemplateData("87654321-4321-4321-4321-cba987654321", "host"))
+	if err != nil {
+		return err
+	}
+
+	if first == second {
+		return errors.NewConfigError("dmcrypt.name_template", "name_template must include {{.UUID}} or {{.UUIDNoDash}}", nil)
+	}
+	return nil
+}
+
+// newNameTemplateData derives the name_template variables for a device
+func newNameTemplateData(uuid, hostname string) NameTemplateData {
+	return NameTemplateData{
+		UUID:       uuid,
+		UUIDNoDash: strings.ReplaceAll(strings.ToLower(uuid), "-", ""),
+		Hostname:   hostname,
+	}
+}
+
+// MappingName returns the /dev/mapper name for a device UUID. Encrypt and decrypt both derive
+// the name from the current configuration; nothing about it is stored in the LUKS header.
+func (c *Config) MappingName(uuid string) (string, error) {
+	hostname, err := c.General.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	return c.DMCrypt.renderNameTemplate(newNameTemplateData(uuid, hostname))
+}
+
+// LUKSConfig contains LUKS formatting options
+type LUKSConfig struct {
+	Integrity        string `mapstructure:"integrity"`          // Optional: dm-integrity algorithm for authenticated encryption (e.g. "hmac-sha256")
+	NoReadWorkqueue  bool   `mapstructure:"no_read_workqueue"`  // Bypass dm-crypt's read workqueue (cryptsetup 2.4+)
+	NoWriteWorkqueue bool   `mapstructure:"no_write_workqueue"` // Bypass dm-crypt's write workqueue (cryptsetup 2.4+)
+	PersistentFlags  bool   `mapstructure:"persistent_flags"`   // Record activation flags in the LUKS2 header so every open uses them
+	IntegrityNoWipe  bool   `mapstructure:"integrity_no_wipe"`  // Skip zeroing an integrity device after formatting; unwritten sectors fail to read
+	KeyEncoding      string `mapstructure:"key_encoding"`       // Encoding of --key-stdin input and of new keys stored in Vault: base64, hex or raw
+}
+
+// ValidKeyEncodings lists the accepted [luks] key_encoding values; an empty value means base64
+var ValidKeyEncodings = []string{"base64", "hex", "raw"}
+
+// DeviceConfig overrides [luks] settings, and optionally where keys are stored in Vault, for
+// devices matching a path or glob
+type DeviceConfig struct {
+	Name             string `mapstructure:"name"`               // Profile name, recorded for boot-time decrypt; required with backend or path_prefix
+	Path             string `mapstructure:"path"`               // Device path or filepath.Match glob (e.g. "/dev/disk/by-id/nvme-*")
+	Integrity        string `mapstructure:"integrity"`          // Overrides luks.integrity; "none" disables it, empty inherits
+	NoReadWorkqueue  *bool  `mapstructure:"no_read_workqueue"`  // Overrides luks.no_read_workqueue when set
+	NoWriteWorkqueue *bool  `mapstructure:"no_write_workqueue"` // Overrides luks.no_write_workqueue when set
+
+	// Optional: store keys for matching devices on another KV backend and/or under another path
+	Backend    string `mapstructure:"backend"`     // Overrides vault.backend
+	PathPrefix string `mapstructure:"path_prefix"` // Overrides vault.vault_path (supports %h) and path_template
+}
+
+// profileNamePattern restricts profile names to what can be passed safely on a systemd ExecStart line
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ChangesVaultLocation reports whether the profile stores keys somewhere other than [vault] says
+func (d DeviceConfig) ChangesVaultLocation() bool {
+	return d.Backend != "" || d.PathPrefix != ""
+}
+
+// IntegrityNone disables a globally configured integrity algorithm for a device profile
+const IntegrityNone = "none"
+
+// Matches reports whether any of the given paths matches the profile
+func (d DeviceConfig) Matches(paths ...string) bool {
+	for _, path := range paths {
+		if matched, err := filepath.Match(d.Path, path); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceProfile returns the first [[device]] profile matching any of the given paths, or nil.
+// Profiles are checked in file order, so the first match wins.
+func (c *Config) DeviceProfile(paths ...string) *DeviceConfig {
+	for i := range c.Devices {
+		if c.Devices[i].Matches(paths...) {
+			return &c.Devices[i]
+		}
+	}
+	return nil
+}
+
+// DeviceProfileByName returns the [[device]] profile with the given name
+func (c *Config) DeviceProfileByName(name string) (*DeviceConfig, error) {
+	for i := range c.Devices {
+		if c.Devices[i].Name == name {
+			return &c.Devices[i], nil
+		}
+	}
+	return nil, errors.NewConfigError("device", fmt.Sprintf("no [[device]] profile named %q", name), nil)
+}
+
+// VaultForProfile returns the [vault] settings with the Vault location of profile applied.
+// A nil profile returns the [vault] settings unchanged.
+func (c *Config) VaultForProfile(profile *DeviceConfig) VaultConfig {
+	vaultConfig := c.Vault
+	vaultConfig.nodeName = c.General.NodeName
+	if profile == nil {
+		return vaultConfig
+	}
+
+	if profile.Backend != "" {
+		vaultConfig.Backend = profile.Backend
+	}
+	if profile.PathPrefix != "" {
+		vaultConfig.VaultPath = profile.PathPrefix
+		vaultConfig.PathTemplate = ""
+	}
+	return vaultConfig
+}
+
+// LUKSForDevice merges the first [[device]] profile matching any of the given paths
+// over the global [luks] settings. Profiles are checked in file order, so the first match wins.
+func (c *Config) LUKSForDevice(paths ...string) LUKSConfig {
+	luks := c.LUKS
+
+	if device := c.DeviceProfile(paths...); device != nil {
+		switch device.Integrity {
+		case "":
+		case IntegrityNone:
+			luks.Integrity = ""
+		default:
+			luks.Integrity = device.Integrity
+		}
+		if device.NoReadWorkqueue != nil {
+			luks.NoReadWorkqueue = *device.NoReadWorkqueue
+		}
+		if device.NoWriteWorkqueue != nil {
+			luks.NoWriteWorkqueue = *device.NoWriteWorkqueue
+		}
+	}
+
+	return luks
+}
+
+// HooksConfig contains commands run after device operations
+type HooksConfig struct {
+	PostDecrypt string `mapstructure:"post_decrypt"` // Executable run after a device is decrypted
+	PostEncrypt string `mapstructure:"post_encrypt"` // Executable run after a device is encrypted
+	PostClose   string `mapstructure:"post_close"`   // Executable run after a device is closed
+	Fatal       bool   `mapstructure:"hooks_fatal"`  // Whether a failing hook fails the operation
+	TimeoutSecs int    `mapstructure:"timeout"`      // Maximum runtime of a hook
+}
+
+func (h HooksConfig) Timeout() time.Duration {
+	return time.Duration(h.TimeoutSecs) * time.Second
+}
+
+// NotifyConfig contains settings for posting operation results to a webhook
+type NotifyConfig struct {
+	WebhookURL  string `mapstructure:"webhook_url" redact:"true"` // Optional: URL encrypt and decrypt results are POSTed to as JSON
+	TimeoutSecs int    `mapstructure:"timeout"`                   // Maximum time for each delivery attempt
+	Retries     int    `mapstructure:"retries"`                   // Extra attempts after a failed delivery
+}
+
+func (n NotifyConfig) Timeout() time.Duration {
+	return time.Duration(n.TimeoutSecs) * time.Second
+}
+
+// TracingConfig contains settings for exporting OpenTelemetry traces of each command
+type TracingConfig struct {
+	OTLPEndpoint string `mapstructure:"otlp_endpoint"` // Optional: OTLP/HTTP collector URL, e.g. "http://127.0.0.1:4318"; unset disables tracing
+	ServiceName  string `mapstructure:"service_name"`  // service.name reported with the spans
+}
+
+// SecurityConfig contains settings limiting the exposure of key material
+type SecurityConfig struct {
+	KeyFileMaxLifetimeSecs int `mapstructure:"key_file_max_lifetime"` // Age after which a temporary key file is force-erased
+
+	// Optional: bind keys to this host's TPM so the Vault entry alone cannot unlock the device
+	TPMSeal   bool   `mapstructure:"tpm_seal"`
+	TPMDevice string `mapstructure:"tpm_device"`
+	TPMPCRs   []int  `mapstructure:"tpm_pcrs"`
+
+	// Optional: cache keys in the kernel keyring so boot retries skip Vault and cryptsetup reads the key by reference
+	UseKeyring     bool `mapstructure:"use_keyring"`
+	KeyringTTLSecs int  `mapstructure:"keyring_ttl"`
+
+	// Optional: hash-chained log of every decrypt attempt, anchored in Vault metadata
+	AttemptsLog string `mapstructure:"attempts_log"`
+
+	// Optional: split new keys into a Vault share and a local share so that neither alone unlocks a device
+	KeySplit    string `mapstructure:"key_split"`
+	KeySplitDir string `mapstructure:"key_split_dir"`
+
+	// Optional: store an HMAC over the metadata of new keys so tampering in Vault is detected on decrypt.
+	// The MAC is keyed by metadata_mac_key, or by a key derived from the device key when it is empty.
+	MetadataMAC    bool   `mapstructure:"metadata_mac"`
+	MetadataMACKey string `mapstructure:"metadata_mac_key" redact:"true"`
+
+	// Optional: age in days after which decrypt warns that a device's key is due for rotation (0 = never)
+	MaxKeyAgeDays int `mapstructure:"max_key_age"`
+
+	// Octal permissions of the log file and attempts log when they are created; existing files are narrowed to them
+	FileMode string `mapstructure:"file_mode"`
+}
+
+func (s SecurityConfig) KeyFileMaxLifetime() time.Duration {
+	return time.Duration(s.KeyFileMaxLifetimeSecs) * time.Second
+}
+
+func (s SecurityConfig) KeyringTTL() time.Duration {
+	return time.Duration(s.KeyringTTLSecs) * time.Second
+}
+
+// MaxKeyAge returns the key age after which decrypt reminds operators to rotate, or 0 for none
+func (s SecurityConfig) MaxKeyAge() time.Duration {
+	return time.Duration(s.MaxKeyAgeDays) * 24 * time.Hour
+}
+
+// defaultFileMode is the file_mode used when none is configured
+const defaultFileMode os.FileMode = 0600
+
+// FilePermissions returns file_mode, or 0600 when it is empty or invalid
+func (s SecurityConfig) FilePermissions() os.FileMode {
+	mode, err := parseFileMode(s.FileMode)
+	if err != nil {
+		return defaultFileMode
+	}
+	return mode
+}
+
+// parseFileMode parses an octal file_mode such as "0640"; an empty value is the default
+func parseFileMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return defaultFileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid octal permissions: %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SafetyConfig limits which devices encrypt may format. Entries are device paths or shell globs
+// such as /dev/sd[b-z] or /dev/disk/by-id/wwn-*. The devices backing /, /boot and /boot/efi are always refused.
+type SafetyConfig struct {
+	DeviceAllowlist []string `mapstructure:"device_allowlist"` // Optional: only devices matching an entry may be encrypted
+	DeviceDenylist  []string `mapstructure:"device_denylist"`  // Optional: devices matching an entry are never encrypted
+}
+
+// validatePatterns checks the device patterns of a [safety] list
+func (s SafetyConfig) validatePatterns(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			return errors.NewConfigError(field, fmt.Sprintf("device pattern must be an absolute path: %q", pattern), nil)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.NewConfigError(field, fmt.Sprintf("invalid device pattern %q", pattern), err)
+		}
+	}
+	return nil
+}
+
+// AuditConfig protects the decrypt attempts log ([security] attempts_log) against edits
+type AuditConfig struct {
+	AppendOnly        bool `mapstructure:"append_only"`         // Optional: set the append-only attribute on the attempts log after writing it
+	RequireAppendOnly bool `mapstructure:"require_append_only"` // Optional: refuse to decrypt unless the attempts log is append-only
+}
+
 // LoggingConfig contains logging configuration
 type LoggingConfig struct {
 	Level  string `mapstructure:"level"`
@@ -72,14 +700,49 @@ type LoggingConfig struct {
 // DefaultConfig returns a configuration with default values
 func DefaultConfig() *Config {
 	return &Config{
+		General: GeneralConfig{
+			VerifyAfter: true, // Catch a device that cannot be reopened before reporting success
+		},
 		Vault: VaultConfig{
 			URL:            "http://127.0.0.1:8200",
 			Backend:        "secret",
 			KVVersion:      "1",                 // Default to v1 for vaultlocker compatibility
 			VaultPath:      "vault-dm-crypt/%h", // Default path with hostname placeholder
+			AppRoleMount:   "approle",
+			KeyField:       DefaultKeyField,
 			TimeoutSecs:    30,
 			RetryMax:       3,
 			RetryDelaySecs: 5,
+			RetryLogDedup:  true,
+
+			ExpiryBufferSecs: DefaultExpiryBufferSecs,
+		},
+		LUKS: LUKSConfig{
+			KeyEncoding: "base64",
+		},
+		DMCrypt: DMCryptConfig{
+			OperationTimeoutSecs:  300, // Generous enough for luksFormat with a high iter-time
+			MapperWaitTimeoutSecs: 5,
+			DeviceWaitTimeoutSecs: 30, // Covers storage that appears late in boot
+			BusyRetries:           3,
+			NameTemplate:          DefaultNameTemplate,
+		},
+		Hooks: HooksConfig{
+			TimeoutSecs: 60,
+		},
+		Notify: NotifyConfig{
+			TimeoutSecs: 5,
+			Retries:     2,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "vault-dm-crypt",
+		},
+		Security: SecurityConfig{
+			KeyFileMaxLifetimeSecs: 60,
+			TPMDevice:              "/dev/tpmrm0",
+			TPMPCRs:                []int{7},
+			KeyringTTLSecs:         300,
+			FileMode:               "0600",
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
@@ -89,8 +752,31 @@ func DefaultConfig() *Config {
 	}
 }
 
+// StdinConfigPath is the config path that reads the configuration from stdin, so generated
+// configs holding secrets never have to be written to disk
+const StdinConfigPath = "-"
+
+// stdin is where a StdinConfigPath configuration is read from
+var stdin io.Reader = os.Stdin
+
 // Load reads configuration from file and environment variables
 func Load(configPath string) (*Config, error) {
+	config, err := LoadUnvalidated(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate configuration
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// LoadUnvalidated reads configuration from file and environment variables without
+// reading credentials or validating it, for offline checks such as config-check
+func LoadUnvalidated(configPath string) (*Config, error) {
 	config := DefaultConfig()
 
 	// Set up viper
@@ -98,16 +784,19 @@ func Load(configPath string) (*Config, error) {
 	v.SetConfigType("toml")
 
 	// Handle config file path
-	if configPath != "" {
-		// Use explicit config path
-		v.SetConfigFile(configPath)
-	} else {
+	switch configPath {
+	case StdinConfigPath:
+		// Read from stdin below; there is no file to locate
+	case "":
 		// Search for config in standard locations
 		v.SetConfigName("config")
 		v.AddConfigPath("/etc/vault-dm-crypt")
 		v.AddConfigPath("/etc/vaultlocker") // Compatibility with Python vaultlocker
 		v.AddConfigPath("./configs")
 		v.AddConfigPath(".")
+	default:
+		// Use explicit config path
+		v.SetConfigFile(configPath)
 	}
 
 	// Set up environment variable binding
@@ -121,8 +810,12 @@ func Load(configPath string) (*Config, error) {
 	// Set defaults from DefaultConfig
 	setDefaults(v, config)
 
-	// Read the config file (if it exists)
-	if err := v.ReadInConfig(); err != nil {
+	// Read the config from stdin or the config file (if it exists)
+	if configPath == StdinConfigPath {
+		if err := v.ReadConfig(stdin); err != nil {
+			return nil, errors.NewConfigError("", fmt.Sprintf("failed to read config from stdin: %v", err), nil)
+		}
+	} else if err := v.ReadInConfig(); err != nil {
 		// If config file is explicitly specified, fail on read error
 		if configPath != "" {
 			return nil, errors.NewConfigError("", fmt.Sprintf("failed to read config file %s: %v", configPath, err), nil)
@@ -134,11 +827,7 @@ func Load(configPath string) (*Config, error) {
 	if err := v.Unmarshal(config); err != nil {
 		return nil, errors.NewConfigError("", "failed to unmarshal config", err)
 	}
-
-	// Validate configuration
-	if err := config.Validate(); err != nil {
-		return nil, err
-	}
+	config.Vault.nodeName = config.General.NodeName
 
 	return config, nil
 }
@@ -148,15 +837,19 @@ func bindEnvironmentVariables(v *viper.Viper) {
 	// Vault environment variables (compatible with Vault CLI)
 	_ = v.BindEnv("vault.url", "VAULT_ADDR")
 	_ = v.BindEnv("vault.ca_bundle", "VAULT_CACERT")
+	_ = v.BindEnv("vault.ca_path", "VAULT_CAPATH")
 	_ = v.BindEnv("vault.vault_token", "VAULT_TOKEN", "VAULT_DM_CRYPT_VAULT_TOKEN")
 	_ = v.BindEnv("vault.approle", "VAULT_APPROLE", "VAULT_DM_CRYPT_VAULT_APPROLE")
 	_ = v.BindEnv("vault.secret_id", "VAULT_SECRET_ID", "VAULT_DM_CRYPT_VAULT_SECRET_ID")
 
 	// Custom environment variables
+	_ = v.BindEnv("general.node_name", "VAULT_DM_CRYPT_NODE_NAME")
 	_ = v.BindEnv("vault.backend", "VAULT_DM_CRYPT_VAULT_BACKEND")
+	_ = v.BindEnv("vault.fallback_backend", "VAULT_DM_CRYPT_VAULT_FALLBACK_BACKEND")
 	_ = v.BindEnv("vault.timeout", "VAULT_DM_CRYPT_VAULT_TIMEOUT")
 	_ = v.BindEnv("vault.retry_max", "VAULT_DM_CRYPT_VAULT_RETRY_MAX")
 	_ = v.BindEnv("vault.retry_delay", "VAULT_DM_CRYPT_VAULT_RETRY_DELAY")
+	_ = v.BindEnv("vault.approle_mount_path", "VAULT_DM_CRYPT_VAULT_APPROLE_MOUNT_PATH")
 
 	// Logging environment variables
 	_ = v.BindEnv("logging.level", "VAULT_DM_CRYPT_LOG_LEVEL")
@@ -166,20 +859,123 @@ func bindEnvironmentVariables(v *viper.Viper) {
 
 // setDefaults sets default values in viper
 func setDefaults(v *viper.Viper, config *Config) {
+	v.SetDefault("general.node_name", config.General.NodeName)
+	v.SetDefault("general.max_concurrent", config.General.MaxConcurrent)
+	v.SetDefault("general.verify_after", config.General.VerifyAfter)
 	v.SetDefault("vault.url", config.Vault.URL)
 	v.SetDefault("vault.backend", config.Vault.Backend)
+	v.SetDefault("vault.fallback_backend", config.Vault.FallbackBackend)
 	v.SetDefault("vault.kv_version", config.Vault.KVVersion)
 	v.SetDefault("vault.vault_path", config.Vault.VaultPath)
+	v.SetDefault("vault.path_template", config.Vault.PathTemplate)
+	v.SetDefault("vault.approle_mount_path", config.Vault.AppRoleMount)
+	v.SetDefault("vault.key_field", config.Vault.KeyField)
+	v.SetDefault("vault.key_fields", config.Vault.KeyFields)
 	v.SetDefault("vault.timeout", config.Vault.TimeoutSecs)
 	v.SetDefault("vault.retry_max", config.Vault.RetryMax)
 	v.SetDefault("vault.retry_delay", config.Vault.RetryDelaySecs)
+	v.SetDefault("vault.retry_log_dedup", config.Vault.RetryLogDedup)
+	v.SetDefault("vault.expiry_buffer", config.Vault.ExpiryBufferSecs)
+	v.SetDefault("vault.use_cas", config.Vault.UseCAS)
+	v.SetDefault("vault.max_requests_per_second", config.Vault.MaxRequestsPerSecond)
+	v.SetDefault("vault.headers", config.Vault.Headers)
+	v.SetDefault("dmcrypt.operation_timeout", config.DMCrypt.OperationTimeoutSecs)
+	v.SetDefault("dmcrypt.mapper_wait_timeout", config.DMCrypt.MapperWaitTimeoutSecs)
+	v.SetDefault("dmcrypt.device_wait_timeout", config.DMCrypt.DeviceWaitTimeoutSecs)
+	v.SetDefault("dmcrypt.busy_retries", config.DMCrypt.BusyRetries)
+	v.SetDefault("dmcrypt.name_template", config.DMCrypt.NameTemplate)
+	v.SetDefault("dmcrypt.nice", config.DMCrypt.Nice)
+	v.SetDefault("dmcrypt.ionice_class", config.DMCrypt.IONiceClass)
+	v.SetDefault("dmcrypt.pbkdf_parallel", config.DMCrypt.PBKDFParallel)
+	v.SetDefault("luks.integrity", config.LUKS.Integrity)
+	v.SetDefault("luks.no_read_workqueue", config.LUKS.NoReadWorkqueue)
+	v.SetDefault("luks.no_write_workqueue", config.LUKS.NoWriteWorkqueue)
+	v.SetDefault("luks.persistent_flags", config.LUKS.PersistentFlags)
+	v.SetDefault("luks.integrity_no_wipe", config.LUKS.IntegrityNoWipe)
+	v.SetDefault("luks.key_encoding", config.LUKS.KeyEncoding)
+	v.SetDefault("hooks.post_decrypt", config.Hooks.PostDecrypt)
+	v.SetDefault("hooks.post_encrypt", config.Hooks.PostEncrypt)
+	v.SetDefault("hooks.post_close", config.Hooks.PostClose)
+	v.SetDefault("hooks.hooks_fatal", config.Hooks.Fatal)
+	v.SetDefault("hooks.timeout", config.Hooks.TimeoutSecs)
+	v.SetDefault("notify.webhook_url", config.Notify.WebhookURL)
+	v.SetDefault("notify.timeout", config.Notify.TimeoutSecs)
+	v.SetDefault("notify.retries", config.Notify.Retries)
+	v.SetDefault("tracing.otlp_endpoint", config.Tracing.OTLPEndpoint)
+	v.SetDefault("tracing.service_name", config.Tracing.ServiceName)
+	v.SetDefault("security.key_file_max_lifetime", config.Security.KeyFileMaxLifetimeSecs)
+	v.SetDefault("security.tpm_seal", config.Security.TPMSeal)
+	v.SetDefault("security.tpm_device", config.Security.TPMDevice)
+	v.SetDefault("security.tpm_pcrs", config.Security.TPMPCRs)
+	v.SetDefault("security.use_keyring", config.Security.UseKeyring)
+	v.SetDefault("security.keyring_ttl", config.Security.KeyringTTLSecs)
+	v.SetDefault("security.max_key_age", config.Security.MaxKeyAgeDays)
+	v.SetDefault("security.attempts_log", config.Security.AttemptsLog)
+	v.SetDefault("security.key_split", config.Security.KeySplit)
+	v.SetDefault("security.key_split_dir", config.Security.KeySplitDir)
+	v.SetDefault("security.metadata_mac", config.Security.MetadataMAC)
+	v.SetDefault("security.metadata_mac_key", config.Security.MetadataMACKey)
+	v.SetDefault("security.file_mode", config.Security.FileMode)
+	v.SetDefault("safety.device_allowlist", config.Safety.DeviceAllowlist)
+	v.SetDefault("safety.device_denylist", config.Safety.DeviceDenylist)
+	v.SetDefault("audit.append_only", config.Audit.AppendOnly)
+	v.SetDefault("audit.require_append_only", config.Audit.RequireAppendOnly)
 	v.SetDefault("logging.level", config.Logging.Level)
 	v.SetDefault("logging.format", config.Logging.Format)
 	v.SetDefault("logging.output", config.Logging.Output)
 }
 
-// UpdateSecretID updates only the secret_id line in the config file, preserving all other content and formatting
+// ReadCredential reads a systemd credential passed with LoadCredential=/ImportCredential=
+// from $CREDENTIALS_DIRECTORY/<name>
+func ReadCredential(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", errors.New("CREDENTIALS_DIRECTORY is not set (is the unit configured with LoadCredential=?)")
+	}
+
+	if name == "" || strings.ContainsRune(name, '/') || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid credential name: %q", name)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to read credential %s", name))
+	}
+
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("credential %s is empty", name)
+	}
+
+	return value, nil
+}
+
+// UpdateSecretID updates only the secret_id line in the config file, preserving all other content and formatting.
+// Concurrent updates, e.g. from the refresh timer and a manual refresh-auth, are serialised with a lock file
+// beside the config file, and the file is read under the lock so an update is never made to stale content.
 func UpdateSecretID(configPath string, newSecretID string) error {
+	return updateSecretID(configPath, newSecretID, nil)
+}
+
+// updateSecretID is UpdateSecretID, calling afterRead, if set, between reading and replacing the config file
+func updateSecretID(configPath string, newSecretID string, afterRead func()) error {
+	if configPath == StdinConfigPath {
+		return errors.New("configuration was read from stdin, there is no config file to update with the new secret ID")
+	}
+
+	// The config file itself is replaced by rename, so a lock on it would not be held by the next reader
+	lockPath := filepath.Join(filepath.Dir(configPath), "."+filepath.Base(configPath)+".lock")
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to open config lock file: %s", lockPath))
+	}
+	defer lockFile.Close()
+
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to lock config file: %s", lockPath))
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
 	// Read the entire file as text to preserve formatting
 	content, err := os.ReadFile(configPath)
 	if err != nil {
@@ -238,6 +1034,9 @@ func UpdateSecretID(configPath string, newSecretID string) error {
 	if !secretIDFound {
 		return errors.New("secret_id not found in [vault] section of config file")
 	}
+	if afterRead != nil {
+		afterRead()
+	}
 
 	// Join lines back together
 	newContent := strings.Join(lines, "\n")
@@ -289,11 +1088,34 @@ func (c *Config) Validate() error {
 		return errors.NewConfigError("vault.backend", "backend cannot be empty", nil)
 	}
 
+	seenKeyFields := make(map[string]bool)
+	for _, field := range c.Vault.KeyFields {
+		if strings.TrimSpace(field) == "" {
+			return errors.NewConfigError("vault.key_fields", "key_fields cannot contain an empty field name", nil)
+		}
+		if seenKeyFields[field] {
+			return errors.NewConfigError("vault.key_fields", fmt.Sprintf("key_fields lists %q more than once", field), nil)
+		}
+		seenKeyFields[field] = true
+	}
+
+	if err := c.Vault.validateHeaders(); err != nil {
+		return err
+	}
+
+	if c.Vault.FallbackBackend != "" && strings.Trim(c.Vault.FallbackBackend, "/") == strings.Trim(c.Vault.Backend, "/") {
+		return errors.NewConfigError("vault.fallback_backend", "fallback_backend must differ from backend", nil)
+	}
+
 	// Validate KV version
 	if c.Vault.KVVersion != "1" && c.Vault.KVVersion != "2" {
 		return errors.NewConfigError("vault.kv_version", fmt.Sprintf("kv_version must be '1' or '2', got '%s'", c.Vault.KVVersion), nil)
 	}
 
+	if c.Vault.UseCAS && c.Vault.KVVersion != "2" {
+		return errors.NewConfigError("vault.use_cas", "use_cas requires kv_version = \"2\"", nil)
+	}
+
 	// Validate vault path
 	if c.Vault.VaultPath == "" {
 		return errors.NewConfigError("vault.vault_path", "vault_path cannot be empty", nil)
@@ -304,9 +1126,15 @@ func (c *Config) Validate() error {
 		return errors.NewConfigError("vault.vault_path", "failed to expand vault_path", err)
 	}
 
+	if c.Vault.PathTemplate != "" {
+		if err := c.Vault.validatePathTemplate(); err != nil {
+			return err
+		}
+	}
+
 	// Check authentication method: either token or approle, but not both
 	hasToken := c.Vault.VaultToken != ""
-	hasAppRole := c.Vault.AppRole != "" || c.Vault.SecretID != ""
+	hasAppRole := c.Vault.AppRole != "" || c.Vault.SecretID != "" || c.Vault.SecretIDCredential != ""
 
 	if hasToken && hasAppRole {
 		return errors.NewConfigError("vault", "vault_token and approle/secret_id are mutually exclusive - use either token authentication or approle authentication, not both", nil)
@@ -325,7 +1153,7 @@ func (c *Config) Validate() error {
 			return errors.NewConfigError("vault.approle", "AppRole ID is required for approle authentication", nil)
 		}
 
-		if c.Vault.SecretID == "" {
+		if c.Vault.SecretID == "" && c.Vault.SecretIDCredential == "" {
 			return errors.NewConfigError("vault.secret_id", "Secret ID is required for approle authentication", nil)
 		}
 	}
@@ -336,6 +1164,9 @@ func (c *Config) Validate() error {
 			return errors.NewConfigError("vault.ca_bundle", fmt.Sprintf("CA bundle file not found: %s", c.Vault.CABundle), err)
 		}
 	}
+	if err := c.Vault.validateCAPath(); err != nil {
+		return err
+	}
 
 	// Validate timeouts and retry settings
 	if c.Vault.TimeoutSecs <= 0 {
@@ -350,6 +1181,187 @@ func (c *Config) Validate() error {
 		return errors.NewConfigError("vault.retry_delay", "retry_delay cannot be negative", nil)
 	}
 
+	if c.General.MaxConcurrent < 0 {
+		return errors.NewConfigError("general.max_concurrent", "max_concurrent cannot be negative", nil)
+	}
+
+	if c.Vault.ExpiryBufferSecs < 0 {
+		return errors.NewConfigError("vault.expiry_buffer", "expiry_buffer cannot be negative", nil)
+	}
+
+	if c.Vault.MaxRequestsPerSecond < 0 {
+		return errors.NewConfigError("vault.max_requests_per_second", "max_requests_per_second cannot be negative", nil)
+	}
+
+	// Validate dm-crypt configuration
+	if c.DMCrypt.OperationTimeoutSecs < 0 {
+		return errors.NewConfigError("dmcrypt.operation_timeout", "operation_timeout cannot be negative", nil)
+	}
+
+	if c.DMCrypt.MapperWaitTimeoutSecs < 0 {
+		return errors.NewConfigError("dmcrypt.mapper_wait_timeout", "mapper_wait_timeout cannot be negative", nil)
+	}
+
+	if c.DMCrypt.DeviceWaitTimeoutSecs < 0 {
+		return errors.NewConfigError("dmcrypt.device_wait_timeout", "device_wait_timeout cannot be negative", nil)
+	}
+
+	if c.DMCrypt.BusyRetries < 0 {
+		return errors.NewConfigError("dmcrypt.busy_retries", "busy_retries cannot be negative", nil)
+	}
+
+	if err := c.DMCrypt.validateNameTemplate(); err != nil {
+		return err
+	}
+
+	if c.DMCrypt.Nice < 0 || c.DMCrypt.Nice > 19 {
+		return errors.NewConfigError("dmcrypt.nice", "nice must be between 0 and 19", nil)
+	}
+
+	switch c.DMCrypt.IONiceClass {
+	case "", "best-effort", "idle":
+	default:
+		return errors.NewConfigError("dmcrypt.ionice_class", fmt.Sprintf("invalid ionice_class %q: must be best-effort or idle", c.DMCrypt.IONiceClass), nil)
+	}
+
+	if c.DMCrypt.PBKDFParallel < 0 {
+		return errors.NewConfigError("dmcrypt.pbkdf_parallel", "pbkdf_parallel cannot be negative", nil)
+	}
+
+	// Validate LUKS configuration
+	validIntegrity := map[string]bool{"": true, "hmac-sha256": true, "hmac-sha512": true}
+	if !validIntegrity[c.LUKS.Integrity] {
+		return errors.NewConfigError("luks.integrity", fmt.Sprintf("unsupported integrity algorithm: %s (supported: hmac-sha256, hmac-sha512)", c.LUKS.Integrity), nil)
+	}
+	if c.LUKS.KeyEncoding != "" && !slices.Contains(ValidKeyEncodings, c.LUKS.KeyEncoding) {
+		return errors.NewConfigError("luks.key_encoding", fmt.Sprintf("unsupported key encoding: %s (supported: %s)", c.LUKS.KeyEncoding, strings.Join(ValidKeyEncodings, ", ")), nil)
+	}
+
+	// Validate per-device profiles
+	profileNames := make(map[string]bool)
+	for i, device := range c.Devices {
+		field := fmt.Sprintf("device[%d]", i)
+		if device.Path == "" {
+			return errors.NewConfigError(field+".path", "device profile requires a path", nil)
+		}
+		if _, err := filepath.Match(device.Path, ""); err != nil {
+			return errors.NewConfigError(field+".path", fmt.Sprintf("invalid device path pattern %q: %v", device.Path, err), err)
+		}
+		if device.Integrity != IntegrityNone && !validIntegrity[device.Integrity] {
+			return errors.NewConfigError(field+".integrity", fmt.Sprintf("unsupported integrity algorithm: %s (supported: hmac-sha256, hmac-sha512, none)", device.Integrity), nil)
+		}
+		if device.Name != "" {
+			if !profileNamePattern.MatchString(device.Name) {
+				return errors.NewConfigError(field+".name", fmt.Sprintf("invalid profile name %q: use letters, digits, '.', '_' and '-'", device.Name), nil)
+			}
+			if profileNames[device.Name] {
+				return errors.NewConfigError(field+".name", fmt.Sprintf("duplicate profile name %q", device.Name), nil)
+			}
+			profileNames[device.Name] = true
+		}
+		// Boot-time decrypt only knows the UUID, so it finds the key through the recorded profile name
+		if device.ChangesVaultLocation() && device.Name == "" {
+			return errors.NewConfigError(field+".name", "device profile with backend or path_prefix requires a name", nil)
+		}
+	}
+
+	// Validate hooks configuration
+	hooks := []struct{ field, path string }{
+		{"hooks.post_decrypt", c.Hooks.PostDecrypt},
+		{"hooks.post_encrypt", c.Hooks.PostEncrypt},
+		{"hooks.post_close", c.Hooks.PostClose},
+	}
+	for _, hook := range hooks {
+		if hook.path != "" && !filepath.IsAbs(hook.path) {
+			return errors.NewConfigError(hook.field, fmt.Sprintf("hook must be an absolute path: %s", hook.path), nil)
+		}
+	}
+
+	if c.Hooks.TimeoutSecs < 0 {
+		return errors.NewConfigError("hooks.timeout", "timeout cannot be negative", nil)
+	}
+
+	// Validate webhook notification settings
+	if c.Notify.WebhookURL != "" {
+		parsed, err := url.Parse(c.Notify.WebhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.NewConfigError("notify.webhook_url", "webhook_url must be an http or https URL", nil)
+		}
+	}
+
+	if c.Notify.TimeoutSecs < 0 {
+		return errors.NewConfigError("notify.timeout", "timeout cannot be negative", nil)
+	}
+
+	if c.Notify.Retries < 0 {
+		return errors.NewConfigError("notify.retries", "retries cannot be negative", nil)
+	}
+
+	// Validate tracing settings
+	if c.Tracing.OTLPEndpoint != "" {
+		parsed, err := url.Parse(c.Tracing.OTLPEndpoint)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.NewConfigError("tracing.otlp_endpoint", "otlp_endpoint must be an http or https URL", nil)
+		}
+	}
+
+	// Validate security configuration
+	if c.Security.KeyFileMaxLifetimeSecs < 0 {
+		return errors.NewConfigError("security.key_file_max_lifetime", "key_file_max_lifetime cannot be negative", nil)
+	}
+
+	if c.Security.KeyringTTLSecs < 0 {
+		return errors.NewConfigError("security.keyring_ttl", "keyring_ttl cannot be negative", nil)
+	}
+
+	if c.Security.MaxKeyAgeDays < 0 {
+		return errors.NewConfigError("security.max_key_age", "max_key_age cannot be negative", nil)
+	}
+
+	fileMode, err := parseFileMode(c.Security.FileMode)
+	if err != nil {
+		return errors.NewConfigError("security.file_mode", fmt.Sprintf("file_mode must be octal permissions such as \"0600\": %q", c.Security.FileMode), err)
+	}
+	if fileMode&0600 != 0600 {
+		return errors.NewConfigError("security.file_mode", fmt.Sprintf("file_mode %04o must let the owner read and write", fileMode), nil)
+	}
+	if fileMode&0002 != 0 {
+		return errors.NewConfigError("security.file_mode", fmt.Sprintf("file_mode %04o must not be world-writable", fileMode), nil)
+	}
+
+	if c.Security.AttemptsLog != "" && !filepath.IsAbs(c.Security.AttemptsLog) {
+		return errors.NewConfigError("security.attempts_log", fmt.Sprintf("attempts_log must be an absolute path: %s", c.Security.AttemptsLog), nil)
+	}
+
+	switch c.Security.KeySplit {
+	case "":
+	case "xor":
+		if !filepath.IsAbs(c.Security.KeySplitDir) {
+			return errors.NewConfigError("security.key_split_dir", fmt.Sprintf("key_split_dir must be an absolute path when key_split is set: %q", c.Security.KeySplitDir), nil)
+		}
+	default:
+		return errors.NewConfigError("security.key_split", fmt.Sprintf("unsupported key_split scheme: %s (supported: xor)", c.Security.KeySplit), nil)
+	}
+
+	if c.Security.TPMSeal {
+		if len(c.Security.TPMPCRs) == 0 {
+			return errors.NewConfigError("security.tpm_pcrs", "at least one PCR is required when tpm_seal is enabled", nil)
+		}
+		for _, pcr := range c.Security.TPMPCRs {
+			if pcr < 0 || pcr > 23 {
+				return errors.NewConfigError("security.tpm_pcrs", fmt.Sprintf("invalid PCR index: %d (must be 0-23)", pcr), nil)
+			}
+		}
+	}
+
+	// Validate device safety lists
+	if err := c.Safety.validatePatterns("safety.device_allowlist", c.Safety.DeviceAllowlist); err != nil {
+		return err
+	}
+	if err := c.Safety.validatePatterns("safety.device_denylist", c.Safety.DeviceDenylist); err != nil {
+		return err
+	}
+
 	// Validate logging configuration
 	validLevels := map[string]bool{
 		"debug": true, "info": true, "warn": true, "error": true, "fatal": true, "panic": true,
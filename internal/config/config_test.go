@@ -1,8 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +22,7 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal(t, 30*time.Second, config.Vault.Timeout())
 	assert.Equal(t, 3, config.Vault.RetryMax)
 	assert.Equal(t, 5*time.Second, config.Vault.RetryDelay())
+	assert.Equal(t, 30*time.Second, config.Vault.ExpiryBuffer())
 	assert.Equal(t, "info", config.Logging.Level)
 	assert.Equal(t, "text", config.Logging.Format)
 	assert.Equal(t, "stdout", config.Logging.Output)
@@ -313,6 +318,221 @@ func TestConfigValidation(t *testing.T) {
 	}
 }
 
+func TestConfigLUKSIntegrityValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+
+	config.LUKS.Integrity = "hmac-sha256"
+	assert.NoError(t, config.Validate())
+
+	config.LUKS.Integrity = "crc32"
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "luks.integrity")
+}
+
+func TestConfigSecurityFileMode(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, os.FileMode(0600), config.Security.FilePermissions())
+
+	config.Security.FileMode = "0640"
+	require.NoError(t, config.Validate())
+	assert.Equal(t, os.FileMode(0640), config.Security.FilePermissions())
+
+	config.Security.FileMode = ""
+	require.NoError(t, config.Validate())
+	assert.Equal(t, os.FileMode(0600), config.Security.FilePermissions())
+
+	for _, invalid := range []string{"rw-------", "0800", "01777", "0400", "0606"} {
+		config.Security.FileMode = invalid
+		err := config.Validate()
+		assert.Error(t, err, invalid)
+		assert.Contains(t, err.Error(), "security.file_mode", invalid)
+	}
+}
+
+func TestConfigLUKSKeyEncodingValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, "base64", config.LUKS.KeyEncoding)
+
+	for _, encoding := range []string{"", "base64", "hex", "raw"} {
+		config.LUKS.KeyEncoding = encoding
+		assert.NoError(t, config.Validate(), encoding)
+	}
+
+	config.LUKS.KeyEncoding = "base32"
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "luks.key_encoding")
+}
+
+func TestLUKSForDevice(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	config.LUKS.Integrity = "hmac-sha256"
+	config.Devices = []DeviceConfig{
+		{Path: "/dev/disk/by-id/nvme-scratch*", Integrity: IntegrityNone},
+		{Path: "/dev/disk/by-id/nvme-*", Integrity: "hmac-sha512"},
+		{Path: "/dev/sdb"},
+	}
+	require.NoError(t, config.Validate())
+
+	tests := []struct {
+		name      string
+		paths     []string
+		integrity string
+	}{
+		{"no profile uses global", []string{"/dev/sdc"}, "hmac-sha256"},
+		{"first match wins", []string{"/dev/disk/by-id/nvme-scratch-1"}, ""},
+		{"later glob match", []string{"/dev/disk/by-id/nvme-data-1"}, "hmac-sha512"},
+		{"empty override inherits", []string{"/dev/sdb"}, "hmac-sha256"},
+		{"resolved path matches", []string{"/dev/mapper/vg-data", "/dev/sdb"}, "hmac-sha256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.integrity, config.LUKSForDevice(tt.paths...).Integrity)
+		})
+	}
+
+	// The global settings are not modified by merging
+	assert.Equal(t, "hmac-sha256", config.LUKS.Integrity)
+}
+
+func TestDeviceConfigValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+
+	config.Devices = []DeviceConfig{{Path: "/dev/sd[a"}}
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device[0].path")
+
+	config.Devices = []DeviceConfig{{Integrity: "hmac-sha256"}}
+	err = config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device profile requires a path")
+
+	config.Devices = []DeviceConfig{{Path: "/dev/sdb"}, {Path: "/dev/sdc", Integrity: "crc32"}}
+	err = config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device[1].integrity")
+}
+
+func TestVaultForProfile(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	config.Vault.PathTemplate = "keys/{{.Hostname}}/{{.UUID}}"
+	config.Devices = []DeviceConfig{
+		{Name: "cold", Path: "/dev/disk/by-id/ata-*", Backend: "cold-secret", PathPrefix: "cold/%h"},
+		{Name: "fast", Path: "/dev/nvme*"},
+	}
+	require.NoError(t, config.Validate())
+
+	assert.Nil(t, config.DeviceProfile("/dev/sdz"))
+	cold := config.DeviceProfile("/dev/disk/by-id/ata-disk-1", "/dev/sda")
+	require.NotNil(t, cold)
+	assert.Equal(t, "cold", cold.Name)
+	assert.True(t, cold.ChangesVaultLocation())
+
+	vaultConfig := config.VaultForProfile(cold)
+	assert.Equal(t, "cold-secret", vaultConfig.Backend)
+	assert.Equal(t, "cold/%h", vaultConfig.VaultPath)
+	assert.Empty(t, vaultConfig.PathTemplate)
+
+	fast, err := config.DeviceProfileByName("fast")
+	require.NoError(t, err)
+	assert.False(t, fast.ChangesVaultLocation())
+	assert.Equal(t, config.Vault, config.VaultForProfile(fast))
+	assert.Equal(t, config.Vault, config.VaultForProfile(nil))
+
+	_, err = config.DeviceProfileByName("archive")
+	assert.Error(t, err)
+
+	// The global settings are not modified
+	assert.Equal(t, "secret", config.Vault.Backend)
+}
+
+func TestDeviceProfileNameValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []DeviceConfig
+		errMsg  string
+	}{
+		{"backend needs a name", []DeviceConfig{{Path: "/dev/sdb", Backend: "cold-secret"}}, "requires a name"},
+		{"path prefix needs a name", []DeviceConfig{{Path: "/dev/sdb", PathPrefix: "cold"}}, "requires a name"},
+		{"invalid name", []DeviceConfig{{Name: "cold tier", Path: "/dev/sdb"}}, "invalid profile name"},
+		{"duplicate name", []DeviceConfig{{Name: "cold", Path: "/dev/sdb"}, {Name: "cold", Path: "/dev/sdc"}}, "duplicate profile name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Devices = tt.devices
+
+			err := config.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestLoadDeviceProfiles(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	configContent := `
+[vault]
+vault_token = "test-token"
+
+[luks]
+integrity = "hmac-sha256"
+integrity_no_wipe = true
+
+[[device]]
+path = "/dev/disk/by-id/nvme-scratch*"
+integrity = "none"
+
+[[device]]
+path = "/dev/sd*"
+
+[[device]]
+path = "/dev/nvme*"
+no_read_workqueue = true
+no_write_workqueue = true
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0600))
+
+	config, err := Load(configPath)
+	require.NoError(t, err)
+	require.Len(t, config.Devices, 3)
+	assert.Equal(t, "/dev/disk/by-id/nvme-scratch*", config.Devices[0].Path)
+	assert.Equal(t, "", config.LUKSForDevice("/dev/disk/by-id/nvme-scratch-0").Integrity)
+	assert.Equal(t, "hmac-sha256", config.LUKSForDevice("/dev/sdb").Integrity)
+
+	// Workqueue flags default to off and are only overridden where set
+	assert.False(t, config.LUKSForDevice("/dev/sdb").NoReadWorkqueue)
+	nvme := config.LUKSForDevice("/dev/nvme0n1")
+	assert.True(t, nvme.NoReadWorkqueue)
+	assert.True(t, nvme.NoWriteWorkqueue)
+	assert.Equal(t, "hmac-sha256", nvme.Integrity)
+	assert.True(t, nvme.IntegrityNoWipe)
+	assert.False(t, DefaultConfig().LUKS.IntegrityNoWipe, "the wipe runs by default")
+}
+
+func TestVaultConfigExpiryBuffer(t *testing.T) {
+	assert.Equal(t, 30*time.Second, VaultConfig{}.ExpiryBuffer(), "unset uses the default")
+	assert.Equal(t, 2*time.Minute, VaultConfig{ExpiryBufferSecs: 120}.ExpiryBuffer())
+
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	config.Vault.ExpiryBufferSecs = -1
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expiry_buffer")
+}
+
 func TestLoadConfigFromFile(t *testing.T) {
 	// Create a temporary config file
 	tmpDir := t.TempDir()
@@ -327,6 +547,10 @@ secret_id = "test-secret-id"
 timeout = 60
 retry_max = 5
 retry_delay = 10
+expiry_buffer = 90
+
+[vault.headers]
+X-Gateway-Token = "gw-123"
 
 [logging]
 level = "debug"
@@ -349,11 +573,121 @@ output = "stderr"
 	assert.Equal(t, 60*time.Second, config.Vault.Timeout())
 	assert.Equal(t, 5, config.Vault.RetryMax)
 	assert.Equal(t, 10*time.Second, config.Vault.RetryDelay())
+	assert.Equal(t, 90*time.Second, config.Vault.ExpiryBuffer())
+	// Header names are case-insensitive; the loader lower-cases keys
+	assert.Equal(t, map[string]string{"x-gateway-token": "gw-123"}, config.Vault.Headers)
 	assert.Equal(t, "debug", config.Logging.Level)
 	assert.Equal(t, "json", config.Logging.Format)
 	assert.Equal(t, "stderr", config.Logging.Output)
 }
 
+func TestLoadConfigFromStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	originalStdin := stdin
+	stdin = r
+	defer func() {
+		stdin = originalStdin
+		_ = r.Close()
+	}()
+
+	go func() {
+		_, _ = w.Write([]byte(`
+[vault]
+url = "https://vault.example.com:8200"
+backend = "kv"
+approle = "test-approle"
+secret_id = "piped-secret-id"
+retry_max = 7
+`))
+		_ = w.Close()
+	}()
+
+	config, err := Load(StdinConfigPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://vault.example.com:8200", config.Vault.URL)
+	assert.Equal(t, "kv", config.Vault.Backend)
+	assert.Equal(t, "piped-secret-id", config.Vault.SecretID)
+	assert.Equal(t, 7, config.Vault.RetryMax)
+	assert.Equal(t, 30*time.Second, config.Vault.Timeout(), "defaults still apply")
+}
+
+func TestUpdateSecretIDRefusesStdinConfig(t *testing.T) {
+	err := UpdateSecretID(StdinConfigPath, "new-secret-id")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "read from stdin")
+}
+
+func TestUpdateSecretIDConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	original := `# Managed by refresh-auth
+[vault]
+url = "https://vault.example.com:8200"
+approle = "test-approle"
+secret_id = "initial-secret-id"
+
+[logging]
+level = "debug"
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(original), 0600))
+
+	// Record how many updates are between reading and replacing the file at once
+	var inFlight, maxInFlight atomic.Int32
+	afterRead := func() {
+		n := inFlight.Add(1)
+		for {
+			seen := maxInFlight.Load()
+			if n <= seen || maxInFlight.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		inFlight.Add(-1)
+	}
+
+	// Two writers, e.g. the refresh timer and a manual refresh-auth, updating at the same time
+	const updates = 25
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*updates)
+	for _, writer := range []string{"timer", "manual"} {
+		wg.Add(1)
+		go func(writer string) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				errs <- updateSecretID(configPath, fmt.Sprintf("%s-secret-id-%d", writer, i), afterRead)
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), maxInFlight.Load(), "updates must not overlap")
+
+	content, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	final := string(content)
+	assert.True(t,
+		final == strings.Replace(original, "initial-secret-id", fmt.Sprintf("timer-secret-id-%d", updates-1), 1) ||
+			final == strings.Replace(original, "initial-secret-id", fmt.Sprintf("manual-secret-id-%d", updates-1), 1),
+		"config file should hold one writer's last secret ID and be otherwise unchanged, got:\n%s", final)
+
+	loaded, err := Load(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, "debug", loaded.Logging.Level)
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), ".config-"), "leftover temp file %s", entry.Name())
+	}
+}
+
 func TestLoadConfigWithEnvironmentVariables(t *testing.T) {
 	// Set environment variables
 	_ = os.Setenv("VAULT_ADDR", "http://env-vault:8200")
@@ -382,6 +716,506 @@ func TestLoadConfigWithEnvironmentVariables(t *testing.T) {
 	assert.Equal(t, "warn", config.Logging.Level)
 }
 
+func TestDMCryptOperationTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, 300*time.Second, config.DMCrypt.OperationTimeout())
+	assert.NoError(t, config.Validate())
+
+	config.DMCrypt.OperationTimeoutSecs = -1
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "dmcrypt.operation_timeout")
+}
+
+func TestDMCryptBusyRetries(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, 3, config.DMCrypt.BusyRetries)
+
+	config.DMCrypt.BusyRetries = 0
+	assert.NoError(t, config.Validate(), "zero disables retries")
+
+	config.DMCrypt.BusyRetries = -1
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "dmcrypt.busy_retries")
+}
+
+func TestHooksConfigValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, 60*time.Second, config.Hooks.Timeout())
+
+	config.Hooks.PostDecrypt = "/usr/local/sbin/activate-volumes"
+	assert.NoError(t, config.Validate())
+
+	config.Hooks.PostDecrypt = "activate-volumes"
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hooks.post_decrypt")
+}
+
+func TestSecurityConfigValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, 60*time.Second, config.Security.KeyFileMaxLifetime())
+	assert.NoError(t, config.Validate())
+
+	config.Security.KeyFileMaxLifetimeSecs = -1
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "security.key_file_max_lifetime")
+}
+
+func TestSecurityConfigMaxKeyAge(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Zero(t, config.Security.MaxKeyAge())
+
+	config.Security.MaxKeyAgeDays = 90
+	assert.Equal(t, 90*24*time.Hour, config.Security.MaxKeyAge())
+	assert.NoError(t, config.Validate())
+
+	config.Security.MaxKeyAgeDays = -1
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security.max_key_age")
+}
+
+func TestSecurityConfigKeyringValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.False(t, config.Security.UseKeyring)
+	assert.Equal(t, 5*time.Minute, config.Security.KeyringTTL())
+
+	config.Security.UseKeyring = true
+	assert.NoError(t, config.Validate())
+
+	config.Security.KeyringTTLSecs = -1
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security.keyring_ttl")
+}
+
+func TestSecurityConfigAttemptsLogValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Empty(t, config.Security.AttemptsLog)
+
+	config.Security.AttemptsLog = "/var/log/vault-dm-crypt/attempts.log"
+	assert.NoError(t, config.Validate())
+
+	config.Security.AttemptsLog = "attempts.log"
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security.attempts_log")
+}
+
+func TestSecurityConfigTPMValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Vault.VaultToken = "test-token"
+	assert.Equal(t, []int{7}, config.Security.TPMPCRs)
+
+	config.Security.TPMSeal = true
+	assert.NoError(t, config.Validate())
+
+	config.Security.TPMPCRs = []int{7, 24}
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid PCR index: 24")
+
+	config.Security.TPMPCRs = nil
+	err = config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security.tpm_pcrs")
+}
+
+func TestSecretPath(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	shortHost := strings.Split(hostname, ".")[0]
+
+	t.Run("flat default", func(t *testing.T) {
+		vault := VaultConfig{VaultPath: "vaultlocker"}
+
+		path, err := vault.SecretPath("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, "vaultlocker/1234-abcd", path)
+
+		listPath, err := vault.SecretListPath()
+		require.NoError(t, err)
+		assert.Equal(t, "vaultlocker", listPath)
+	})
+
+	t.Run("template with hostname", func(t *testing.T) {
+		vault := VaultConfig{VaultPath: "ignored", PathTemplate: "vaultlocker/{{.Hostname}}/{{.UUID}}"}
+
+		path, err := vault.SecretPath("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, "vaultlocker/"+shortHost+"/1234-abcd", path)
+
+		// decrypt evaluates the same template and arrives at the path encrypt wrote to
+		again, err := vault.SecretPath("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, path, again)
+
+		listPath, err := vault.SecretListPath()
+		require.NoError(t, err)
+		assert.Equal(t, listPath+"/1234-abcd", path)
+	})
+
+	t.Run("template not ending in UUID cannot be listed", func(t *testing.T) {
+		vault := VaultConfig{PathTemplate: "keys/{{.UUID}}/{{.Hostname}}"}
+
+		path, err := vault.SecretPath("1234-abcd")
+		require.NoError(t, err)
+		assert.Equal(t, "keys/1234-abcd/"+shortHost, path)
+
+		_, err = vault.SecretListPath()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "must end with /{{.UUID}}")
+	})
+}
+
+func TestSecretPathFollowsNodeName(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	configContent := `
+[general]
+node_name = "storage-node-01"
+
+[vault]
+url = "https://vault.example.com:8200"
+vault_token = "test-token"
+vault_path = "vault-dm-crypt/%h"
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0600))
+
+	config, err := Load(configPath)
+	require.NoError(t, err)
+
+	// Keys are stored under the same node name the mapping names and metadata use
+	path, err := config.Vault.SecretPath("1234-abcd")
+	require.NoError(t, err)
+	assert.Equal(t, "vault-dm-crypt/storage-node-01/1234-abcd", path)
+
+	listPath, err := config.Vault.SecretListPath()
+	require.NoError(t, err)
+	assert.Equal(t, "vault-dm-crypt/storage-node-01", listPath)
+
+	config.Vault.PathTemplate = "keys/{{.Hostname}}/{{.UUID}}"
+	path, err = config.VaultForProfile(nil).SecretPath("1234-abcd")
+	require.NoError(t, err)
+	assert.Equal(t, "keys/storage-node-01/1234-abcd", path)
+}
+
+func TestPathTemplateValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		errMsg   string
+	}{
+		{"valid", "vaultlocker/{{.Hostname}}/{{.UUID}}", ""},
+		{"does not compile", "vaultlocker/{{.Hostname}/{{.UUID}}", "invalid path_template"},
+		{"unknown variable", "vaultlocker/{{.Rack}}/{{.UUID}}", "invalid path_template"},
+		{"missing uuid", "vaultlocker/{{.Hostname}}", "must include {{.UUID}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Vault.PathTemplate = tt.template
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "vault.path_template")
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestMappingName(t *testing.T) {
+	uuid := "12345678-ABCD-1234-1234-123456789abc"
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"default", DefaultNameTemplate, "vaultlocker-12345678abcd12341234123456789abc"},
+		{"unset", "", "vaultlocker-12345678abcd12341234123456789abc"},
+		{"luks uuid", "luks-{{.UUID}}", "luks-12345678-ABCD-1234-1234-123456789abc"},
+		{"hostname", "{{.Hostname}}-{{.UUIDNoDash}}", "node1-12345678abcd12341234123456789abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.General.NodeName = "node1"
+			config.DMCrypt.NameTemplate = tt.template
+
+			name, err := config.MappingName(uuid)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, name)
+		})
+	}
+
+	t.Run("round trip through config file", func(t *testing.T) {
+		// Encrypt and the boot-time decrypt load the same file and must agree on the name
+		configPath := filepath.Join(t.TempDir(), "config.toml")
+		content := "[vault]\nurl = \"https://vault.example.com:8200\"\nvault_token = \"test-token\"\n\n[dmcrypt]\nname_template = \"luks-{{.UUID}}\"\n"
+		require.NoError(t, os.WriteFile(configPath, []byte(content), 0644))
+
+		encryptConfig, err := Load(configPath)
+		require.NoError(t, err)
+		decryptConfig, err := Load(configPath)
+		require.NoError(t, err)
+
+		encryptName, err := encryptConfig.MappingName(uuid)
+		require.NoError(t, err)
+		decryptName, err := decryptConfig.MappingName(uuid)
+		require.NoError(t, err)
+		assert.Equal(t, "luks-"+uuid, encryptName)
+		assert.Equal(t, encryptName, decryptName)
+	})
+}
+
+func TestKeySplitValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		dir    string
+		errMsg string
+	}{
+		{"disabled", "", "", ""},
+		{"xor", "xor", "/var/lib/vault-dm-crypt/shares", ""},
+		{"missing dir", "xor", "", "security.key_split_dir"},
+		{"relative dir", "xor", "shares", "security.key_split_dir"},
+		{"unknown scheme", "shamir", "/var/lib/vault-dm-crypt/shares", "unsupported key_split scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Security.KeySplit = tt.scheme
+			config.Security.KeySplitDir = tt.dir
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestNameTemplateValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		errMsg   string
+	}{
+		{"valid", "luks-{{.UUID}}", ""},
+		{"does not compile", "luks-{{.UUID}", "invalid name_template"},
+		{"unknown variable", "luks-{{.Rack}}-{{.UUID}}", "invalid name_template"},
+		{"missing uuid", "luks-{{.Hostname}}", "must include {{.UUID}}"},
+		{"slash", "luks/{{.UUID}}", "must not contain slashes"},
+		{"renders empty", "{{if false}}{{.UUID}}{{end}}", "invalid mapping name"},
+		{"too long", strings.Repeat("x", 100) + "-{{.UUID}}", "longer than 127"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.DMCrypt.NameTemplate = tt.template
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "dmcrypt.name_template")
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestValidateMappingName(t *testing.T) {
+	assert.NoError(t, ValidateMappingName("data"))
+	assert.NoError(t, ValidateMappingName("vaultlocker-12345678123412341234123456789abc"))
+
+	for _, name := range []string{"", "..", "a/b", "a b", strings.Repeat("x", 128)} {
+		err := ValidateMappingName(name)
+		require.Error(t, err, name)
+		assert.Contains(t, err.Error(), "name")
+	}
+}
+
+func TestOpenPriorityValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*DMCryptConfig)
+		errMsg string
+	}{
+		{"defaults", func(d *DMCryptConfig) {}, ""},
+		{"lowered priority", func(d *DMCryptConfig) { d.Nice = 10; d.IONiceClass = "idle"; d.PBKDFParallel = 2 }, ""},
+		{"negative nice", func(d *DMCryptConfig) { d.Nice = -5 }, "dmcrypt.nice"},
+		{"nice too high", func(d *DMCryptConfig) { d.Nice = 20 }, "dmcrypt.nice"},
+		{"realtime io class", func(d *DMCryptConfig) { d.IONiceClass = "realtime" }, "dmcrypt.ionice_class"},
+		{"negative pbkdf_parallel", func(d *DMCryptConfig) { d.PBKDFParallel = -1 }, "dmcrypt.pbkdf_parallel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			tt.modify(&config.DMCrypt)
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestKeyFieldNames(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	load := func(t *testing.T, vaultSection string) *Config {
+		t.Helper()
+		configPath := filepath.Join(tmpDir, "config.toml")
+		content := "[vault]\nurl = \"https://vault.example.com:8200\"\nvault_token = \"test-token\"\n" + vaultSection
+		require.NoError(t, os.WriteFile(configPath, []byte(content), 0644))
+		config, err := Load(configPath)
+		require.NoError(t, err)
+		return config
+	}
+
+	t.Run("default", func(t *testing.T) {
+		assert.Equal(t, []string{"dmcrypt_key"}, load(t, "").Vault.KeyFieldNames())
+	})
+
+	t.Run("single field override", func(t *testing.T) {
+		assert.Equal(t, []string{"primary_key"}, load(t, `key_field = "primary_key"`).Vault.KeyFieldNames())
+	})
+
+	t.Run("fallback list", func(t *testing.T) {
+		config := load(t, `key_field = "primary_key"`+"\n"+`key_fields = ["dmcrypt_key", "escrow_key"]`)
+		assert.Equal(t, []string{"dmcrypt_key", "escrow_key"}, config.Vault.KeyFieldNames())
+	})
+
+	t.Run("invalid lists", func(t *testing.T) {
+		for _, fields := range [][]string{{"dmcrypt_key", ""}, {"dmcrypt_key", "dmcrypt_key"}} {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Vault.KeyFields = fields
+			err := config.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "vault.key_fields")
+		}
+	})
+}
+
+func TestGeneralConfigHostname(t *testing.T) {
+	t.Run("node_name override wins", func(t *testing.T) {
+		general := GeneralConfig{NodeName: "storage-node-01"}
+		hostname, err := general.Hostname()
+		require.NoError(t, err)
+		assert.Equal(t, "storage-node-01", hostname)
+	})
+
+	t.Run("falls back to os hostname", func(t *testing.T) {
+		expected, err := os.Hostname()
+		require.NoError(t, err)
+
+		hostname, err := GeneralConfig{}.Hostname()
+		require.NoError(t, err)
+		assert.Equal(t, expected, hostname)
+	})
+
+	t.Run("node_name from environment", func(t *testing.T) {
+		t.Setenv("VAULT_DM_CRYPT_NODE_NAME", "env-node")
+		t.Setenv("VAULT_TOKEN", "test-token")
+
+		config, err := Load("")
+		require.NoError(t, err)
+
+		hostname, err := config.General.Hostname()
+		require.NoError(t, err)
+		assert.Equal(t, "env-node", hostname)
+	})
+}
+
+func TestLoadSecretIDFromCredential(t *testing.T) {
+	credentialsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(credentialsDir, "vault-secret-id"), []byte("credential-secret\n"), 0400))
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	configContent := `
+[vault]
+url = "https://vault.example.com:8200"
+approle = "test-approle"
+secret_id_credential = "vault-secret-id"
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0644))
+
+	t.Run("reads secret_id from credentials directory at login", func(t *testing.T) {
+		t.Setenv("CREDENTIALS_DIRECTORY", credentialsDir)
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+		assert.Empty(t, config.Vault.SecretID)
+
+		secretID, err := config.Vault.LoginSecretID()
+		require.NoError(t, err)
+		assert.Equal(t, "credential-secret", secretID)
+	})
+
+	t.Run("loads without credentials directory", func(t *testing.T) {
+		t.Setenv("CREDENTIALS_DIRECTORY", "")
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+
+		_, err = config.Vault.LoginSecretID()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "CREDENTIALS_DIRECTORY is not set")
+	})
+
+	t.Run("missing credential file", func(t *testing.T) {
+		t.Setenv("CREDENTIALS_DIRECTORY", t.TempDir())
+
+		config, err := Load(configPath)
+		require.NoError(t, err)
+
+		_, err = config.Vault.LoginSecretID()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "vault.secret_id_credential")
+	})
+
+	t.Run("rejects path traversal", func(t *testing.T) {
+		t.Setenv("CREDENTIALS_DIRECTORY", credentialsDir)
+
+		_, err := ReadCredential("../vault-secret-id")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid credential name")
+	})
+}
+
 func TestLoadFromPythonConfig(t *testing.T) {
 	// Create a temporary Python-style config file
 	tmpDir := t.TempDir()
@@ -459,3 +1293,198 @@ func TestConfigWithValidCABundle(t *testing.T) {
 	err = config.Validate()
 	assert.NoError(t, err)
 }
+
+func TestConfigWithCAPath(t *testing.T) {
+	caDir := t.TempDir()
+	caFile := filepath.Join(caDir, "intermediate.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("fake-ca-cert"), 0644))
+
+	tests := []struct {
+		name   string
+		modify func(*VaultConfig)
+		errMsg string
+	}{
+		{"directory", func(v *VaultConfig) { v.CAPath = caDir }, ""},
+		{"missing directory", func(v *VaultConfig) { v.CAPath = filepath.Join(caDir, "missing") }, "CA directory not found"},
+		{"file instead of directory", func(v *VaultConfig) { v.CAPath = caFile }, "not a directory"},
+		{"both ca_bundle and ca_path", func(v *VaultConfig) {
+			v.CABundle = caFile
+			v.CAPath = caDir
+		}, "mutually exclusive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			tt.modify(&config.Vault)
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "vault.ca_path")
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestVaultHeadersValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		errMsg  string
+	}{
+		{"gateway and trace headers", map[string]string{"X-Gateway-Token": "gw-123", "traceparent": "00-abc-def-01"}, ""},
+		{"empty name", map[string]string{"": "value"}, "not a valid HTTP header name"},
+		{"name with space", map[string]string{"X Gateway": "value"}, "not a valid HTTP header name"},
+		{"name with colon", map[string]string{"X-Gateway:": "value"}, "not a valid HTTP header name"},
+		{"vault token", map[string]string{"x-vault-token": "hvs.abc"}, "use vault_token instead"},
+		{"value with newline", map[string]string{"X-Gateway-Token": "gw\r\nX-Injected: 1"}, "control characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Vault.Headers = tt.headers
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "vault.headers")
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestSafetyListsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		safety SafetyConfig
+		errMsg string
+	}{
+		{"paths and globs", SafetyConfig{DeviceAllowlist: []string{"/dev/sd[b-z]", "/dev/disk/by-id/wwn-*"}, DeviceDenylist: []string{"/dev/nvme0n1"}}, ""},
+		{"relative allowlist entry", SafetyConfig{DeviceAllowlist: []string{"sdb"}}, "safety.device_allowlist"},
+		{"empty denylist entry", SafetyConfig{DeviceDenylist: []string{""}}, "safety.device_denylist"},
+		{"bad glob", SafetyConfig{DeviceDenylist: []string{"/dev/sd["}}, "invalid device pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Vault.VaultToken = "test-token"
+			config.Safety = tt.safety
+
+			err := config.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	validConfig := func() *Config {
+		config := DefaultConfig()
+		config.Vault.VaultToken = "test-token"
+		return config
+	}
+
+	t.Run("valid config has no problems", func(t *testing.T) {
+		assert.Empty(t, validConfig().Check())
+	})
+
+	t.Run("secret_id_credential satisfies approle without reading it", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Vault.AppRole = "role-id"
+		config.Vault.SecretIDCredential = "vault-secret-id"
+		assert.Empty(t, config.Check())
+	})
+
+	tests := []struct {
+		name     string
+		modify   func(*Config)
+		problems []string
+	}{
+		{
+			name:     "unparseable URL",
+			modify:   func(c *Config) { c.Vault.URL = "http://[::1" },
+			problems: []string{"vault.url"},
+		},
+		{
+			name:     "URL without scheme",
+			modify:   func(c *Config) { c.Vault.URL = "vault.example.com:8200" },
+			problems: []string{"http or https"},
+		},
+		{
+			name: "token and approle both set",
+			modify: func(c *Config) {
+				c.Vault.AppRole = "role-id"
+				c.Vault.SecretID = "secret-id"
+			},
+			problems: []string{"mutually exclusive"},
+		},
+		{
+			name: "secret_id and secret_id_credential both set",
+			modify: func(c *Config) {
+				c.Vault.VaultToken = ""
+				c.Vault.AppRole = "role-id"
+				c.Vault.SecretID = "secret-id"
+				c.Vault.SecretIDCredential = "vault-secret-id"
+			},
+			problems: []string{"vault.secret_id_credential"},
+		},
+		{
+			name:     "missing CA bundle",
+			modify:   func(c *Config) { c.Vault.CABundle = "/nonexistent/ca.pem" },
+			problems: []string{"CA bundle file not found"},
+		},
+		{
+			name:     "CA bundle is a directory",
+			modify:   func(c *Config) { c.Vault.CABundle = os.TempDir() },
+			problems: []string{"CA bundle is a directory"},
+		},
+		{
+			name:     "CA path is a file",
+			modify:   func(c *Config) { c.Vault.CAPath = os.Args[0] },
+			problems: []string{"vault.ca_path"},
+		},
+		{
+			name: "several problems are all reported",
+			modify: func(c *Config) {
+				c.Vault.URL = "ftp://vault.example.com"
+				c.Vault.CABundle = "/nonexistent/ca.pem"
+				c.Logging.Output = "/nonexistent/dir/vault-dm-crypt.log"
+			},
+			problems: []string{"vault.url", "vault.ca_bundle", "logging.output"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.modify(config)
+
+			problems := config.Check()
+			require.NotEmpty(t, problems)
+
+			var messages []string
+			for _, problem := range problems {
+				messages = append(messages, problem.Error())
+			}
+			joined := strings.Join(messages, "\n")
+			for _, expected := range tt.problems {
+				assert.Contains(t, joined, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"reflect"
+)
+
+// RedactedValue replaces the value of sensitive settings in dumped configuration
+const RedactedValue = "***"
+
+// Redacted returns the configuration as nested maps keyed by the configuration file's setting
+// names, ready to be encoded as TOML or JSON. Fields tagged redact:"true" are replaced with
+// RedactedValue when set, and maps tagged redact:"values" keep their keys but have every value
+// replaced, so the result is safe to paste into a support ticket.
+func (c *Config) Redacted() map[string]interface{} {
+	return structToMap(reflect.ValueOf(*c))
+}
+
+// structToMap converts a config struct to a map keyed by mapstructure tags. Unset optional
+// (pointer) fields are left out.
+func structToMap(v reflect.Value) map[string]interface{} {
+	result := make(map[string]interface{})
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		value := v.Field(i)
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+
+		if field.Tag.Get("redact") == "true" && !value.IsZero() {
+			result[name] = RedactedValue
+			continue
+		}
+		if field.Tag.Get("redact") == "values" && value.Kind() == reflect.Map {
+			redacted := make(map[string]interface{}, value.Len())
+			for _, key := range value.MapKeys() {
+				redacted[key.String()] = RedactedValue
+			}
+			result[name] = redacted
+			continue
+		}
+
+		result[name] = plainValue(value)
+	}
+
+	return result
+}
+
+// plainValue converts nested structs and slices of structs to maps
+func plainValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		return structToMap(v)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return v.Interface()
+		}
+		items := make([]map[string]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, structToMap(v.Index(i)))
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
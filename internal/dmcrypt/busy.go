@@ -0,0 +1,78 @@
+package dmcrypt
+
+import (
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/shell"
+)
+
+// DefaultBusyRetries is how many times luksOpen and luksClose are retried when cryptsetup
+// reports the device busy
+const DefaultBusyRetries = 3
+
+// DefaultBusyRetryDelay is the pause before each retry, after udev has settled
+const DefaultBusyRetryDelay = 500 * time.Millisecond
+
+// busySettleTimeout bounds the udevadm settle run between attempts
+const busySettleTimeout = 10 * time.Second
+
+// busyMessages are the cryptsetup stderr fragments for a device that is transiently busy, e.g.
+// while udev is still probing it or a previous close has not fully released it. "Cannot use
+// device ... which is in use" is left out: it means the device is already mapped or mounted,
+// which retrying does not change.
+var busyMessages = []string{
+	"is busy",
+	"is still in use",
+	"device or resource busy",
+}
+
+// isBusyError reports whether err is cryptsetup failing because the device is busy or in use.
+// Genuine failures such as a wrong passphrase are not busy errors.
+func isBusyError(err error) bool {
+	message := err.Error()
+	var cmdErr *shell.CommandError
+	if stderrors.As(err, &cmdErr) {
+		message = cmdErr.CommandStderr()
+	}
+
+	message = strings.ToLower(message)
+	for _, fragment := range busyMessages {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBusyRetries sets how many times luksOpen and luksClose are retried on a busy device; zero disables retries
+func (lm *LUKSManager) SetBusyRetries(retries int) {
+	lm.busyRetries = max(retries, 0)
+}
+
+// runCryptsetupBusyRetry is runCryptsetupWithPriority for luksOpen and luksClose, retrying up to
+// busyRetries times when the device is busy. udev is settled before each retry, since it is
+// usually udev probing the device that holds it open.
+func (lm *LUKSManager) runCryptsetupBusyRetry(priority ProcessPriority, args ...string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		output, err := lm.runCryptsetupWithPriority(priority, lm.operationTimeout, args...)
+		if err == nil || attempt > lm.busyRetries || !isBusyError(err) {
+			return output, err
+		}
+
+		lm.logger.WithError(err).WithFields(logrus.Fields{
+			"action":  args[0],
+			"attempt": attempt,
+			"retries": lm.busyRetries,
+		}).Warn("cryptsetup reported the device busy, retrying once udev has settled")
+
+		if _, err := lm.executor.ExecuteWithTimeout(busySettleTimeout+time.Second, "udevadm", "settle", fmt.Sprintf("--timeout=%d", int(busySettleTimeout.Seconds()))); err != nil {
+			lm.logger.WithError(err).Debug("udevadm settle failed")
+		}
+		time.Sleep(lm.busyRetryDelay)
+	}
+}
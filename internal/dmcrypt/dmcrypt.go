@@ -1,12 +1,15 @@
 package dmcrypt
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -45,6 +48,66 @@ func (m *Manager) GenerateKey() (string, error) {
 	return key, nil
 }
 
+// maxKeyInputSize bounds how much is read when a key is supplied externally
+const maxKeyInputSize = 4096
+
+// ReadKey reads a base64 encoded key from r, failing if nothing arrives within timeout.
+// The key is validated with ValidateKeyFormat and the read buffer is zeroed before returning.
+func (m *Manager) ReadKey(r io.Reader, timeout time.Duration) (string, error) {
+	return m.ReadEncodedKey(r, timeout, KeyEncodingBase64)
+}
+
+// ReadEncodedKey reads a key in encoding (base64, hex or raw bytes) from r like ReadKey and
+// returns it base64 encoded
+func (m *Manager) ReadEncodedKey(r io.Reader, timeout time.Duration, encoding string) (string, error) {
+	m.logger.WithField("key_encoding", encoding).Debug("Reading externally supplied encryption key")
+
+	type readResult struct {
+		data []byte
+		err  error
+	}
+
+	resultCh := make(chan readResult, 1)
+	go func() {
+		data, err := io.ReadAll(io.LimitReader(r, maxKeyInputSize+1))
+		resultCh <- readResult{data: data, err: err}
+	}()
+
+	var result readResult
+	select {
+	case result = <-resultCh:
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out after %s waiting for key on input", timeout)
+	}
+	defer clear(result.data)
+
+	if result.err != nil {
+		return "", errors.Wrap(result.err, "failed to read key")
+	}
+
+	if len(result.data) > maxKeyInputSize {
+		return "", fmt.Errorf("key input exceeds %d bytes", maxKeyInputSize)
+	}
+
+	if len(bytes.TrimSpace(result.data)) == 0 {
+		return "", errors.New("no key provided on input")
+	}
+
+	keyBytes, err := DecodeKeyMaterial(result.data, encoding)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid key")
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	clear(keyBytes)
+	if err := m.ValidateKeyFormat(key); err != nil {
+		m.SecureEraseKey(&key)
+		return "", errors.Wrap(err, "invalid key")
+	}
+
+	m.logger.Debug("Externally supplied encryption key validated")
+	return key, nil
+}
+
 // ValidateDevice checks if a device exists and performs basic validation
 func (m *Manager) ValidateDevice(devicePath string) error {
 	m.logger.WithField("device", devicePath).Debug("Validating device")
@@ -1,10 +1,13 @@
 package dmcrypt
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	stderrors "errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +15,10 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/shell"
 )
 
 // MockCommandExecutor implements CommandExecutor for testing
@@ -20,6 +27,8 @@ type MockCommandExecutor struct {
 	outputs           map[string]string
 	errors            map[string]error
 	availableCommands map[string]bool
+	hangingCommands   map[string]bool
+	sequences         map[string][]string
 	commandValidation error
 }
 
@@ -29,6 +38,8 @@ func NewMockCommandExecutor() *MockCommandExecutor {
 		outputs:           make(map[string]string),
 		errors:            make(map[string]error),
 		availableCommands: make(map[string]bool),
+		hangingCommands:   make(map[string]bool),
+		sequences:         make(map[string][]string),
 	}
 }
 
@@ -40,6 +51,13 @@ func (m *MockCommandExecutor) Execute(command string, args ...string) (string, e
 		return "", err
 	}
 
+	if outputs := m.sequences[key]; len(outputs) > 0 {
+		if len(outputs) > 1 {
+			m.sequences[key] = outputs[1:]
+		}
+		return outputs[0], nil
+	}
+
 	if output, exists := m.outputs[key]; exists {
 		return output, nil
 	}
@@ -52,6 +70,13 @@ func (m *MockCommandExecutor) ExecuteWithTimeout(timeout time.Duration, command
 }
 
 func (m *MockCommandExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	key := command + " " + strings.Join(args, " ")
+	if m.hangingCommands[key] {
+		m.commands = append(m.commands, key)
+		<-ctx.Done()
+		return "", fmt.Errorf("command timed out: %s", key)
+	}
+
 	return m.Execute(command, args...)
 }
 
@@ -85,10 +110,20 @@ func (m *MockCommandExecutor) SetOutput(command string, output string) {
 	m.outputs[command] = output
 }
 
+// SetOutputSequence returns each output in turn on successive calls, repeating the last
+func (m *MockCommandExecutor) SetOutputSequence(command string, outputs ...string) {
+	m.sequences[command] = outputs
+}
+
 func (m *MockCommandExecutor) SetError(command string, err error) {
 	m.errors[command] = err
 }
 
+// SetHang makes a command block until its context is cancelled
+func (m *MockCommandExecutor) SetHang(command string) {
+	m.hangingCommands[command] = true
+}
+
 func (m *MockCommandExecutor) SetCommandAvailable(command string, available bool) {
 	m.availableCommands[command] = available
 }
@@ -190,6 +225,58 @@ func TestValidateKeyFormat(t *testing.T) {
 	})
 }
 
+func TestReadKey(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+
+	writeToPipe := func(t *testing.T, data string) *os.File {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+
+		go func() {
+			_, _ = w.WriteString(data)
+			_ = w.Close()
+		}()
+
+		return r
+	}
+
+	t.Run("valid key via pipe", func(t *testing.T) {
+		expected, err := manager.GenerateKey()
+		require.NoError(t, err)
+
+		key, err := manager.ReadKey(writeToPipe(t, expected+"\n"), time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, expected, key)
+	})
+
+	t.Run("invalid key via pipe", func(t *testing.T) {
+		_, err := manager.ReadKey(writeToPipe(t, "not-a-key\n"), time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid key")
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		_, err := manager.ReadKey(writeToPipe(t, "\n"), time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no key provided")
+	})
+
+	t.Run("times out waiting for input", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer func() { _ = w.Close() }()
+		defer func() { _ = r.Close() }()
+
+		_, err = manager.ReadKey(r, 50*time.Millisecond)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "timed out")
+	})
+}
+
 func TestGenerateDeviceName(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel)
@@ -860,3 +947,1714 @@ func TestLUKSManagerFormatDevicePartial(t *testing.T) {
 		assert.Contains(t, err.Error(), "LUKS validate failed")
 	})
 }
+
+func TestBuildFormatArgs(t *testing.T) {
+	t.Run("default options", func(t *testing.T) {
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{})
+		assert.NotContains(t, args, "--integrity")
+		assert.Equal(t, "luksFormat", args[0])
+		assert.Equal(t, "/dev/test", args[len(args)-1])
+	})
+
+	t.Run("integrity enabled", func(t *testing.T) {
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{Integrity: "hmac-sha256"})
+		joined := strings.Join(args, " ")
+		assert.Contains(t, joined, "--integrity hmac-sha256 --integrity-no-wipe")
+		assert.Contains(t, joined, "--type luks2")
+		assert.Equal(t, "/dev/test", args[len(args)-1])
+	})
+
+	t.Run("no wipe without integrity", func(t *testing.T) {
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{})
+		assert.NotContains(t, args, "--integrity-no-wipe")
+	})
+
+	t.Run("pbkdf parallelism capped", func(t *testing.T) {
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{PBKDFParallel: 2})
+		assert.Contains(t, strings.Join(args, " "), "--pbkdf-parallel 2")
+	})
+
+	t.Run("data offset", func(t *testing.T) {
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{Offset: 32768})
+		assert.Contains(t, strings.Join(args, " "), "--offset 32768")
+		assert.NotContains(t, buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{}), "--offset")
+	})
+
+	t.Run("label and subsystem", func(t *testing.T) {
+		joined := strings.Join(buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{Label: "db data", Subsystem: "pool-a"}), " ")
+		assert.Contains(t, joined, "--label db data --subsystem pool-a")
+
+		args := buildFormatArgs("/dev/test", "test-uuid", "/tmp/key", FormatOptions{})
+		assert.NotContains(t, args, "--label")
+		assert.NotContains(t, args, "--subsystem")
+	})
+}
+
+func TestFormatOptionsValidateLabels(t *testing.T) {
+	assert.NoError(t, FormatOptions{}.ValidateLabels())
+	assert.NoError(t, FormatOptions{Label: strings.Repeat("l", MaxLabelLength), Subsystem: strings.Repeat("s", MaxLabelLength)}.ValidateLabels())
+
+	err := FormatOptions{Label: strings.Repeat("l", MaxLabelLength+1)}.ValidateLabels()
+	assert.ErrorContains(t, err, "LUKS2 label")
+	assert.ErrorContains(t, err, "the limit is 47")
+
+	assert.ErrorContains(t, FormatOptions{Subsystem: strings.Repeat("s", MaxLabelLength+1)}.ValidateLabels(), "LUKS2 subsystem")
+	assert.ErrorContains(t, FormatOptions{Label: "role\nadmin"}.ValidateLabels(), "control character")
+}
+
+func TestLUKSManagerWipeMapping(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	luksManager := NewLUKSManager(logger)
+	luksManager.wipeChunkSize = 1024
+
+	newMapping := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), "mapping")
+		require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{0xff}, 3000), 0600))
+		return path
+	}
+
+	t.Run("wipes to the end", func(t *testing.T) {
+		path := newMapping(t)
+		var reported []int64
+		err := luksManager.WipeMapping(path, 0, func(done, size int64) error {
+			assert.Equal(t, int64(3000), size)
+			reported = append(reported, done)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1024, 2048, 3000}, reported)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, make([]byte, 3000), data)
+	})
+
+	t.Run("resumes from an offset", func(t *testing.T) {
+		path := newMapping(t)
+		require.NoError(t, luksManager.WipeMapping(path, 2048, nil))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{0xff}, 2048), data[:2048], "the already wiped part is not rewritten")
+		assert.Equal(t, make([]byte, 952), data[2048:])
+	})
+
+	t.Run("progress error stops the wipe", func(t *testing.T) {
+		path := newMapping(t)
+		err := luksManager.WipeMapping(path, 0, func(done, size int64) error {
+			return fmt.Errorf("disk full")
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "disk full")
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, byte(0xff), data[1024], "nothing past the first chunk is written")
+	})
+
+	t.Run("resume position past the end", func(t *testing.T) {
+		err := luksManager.WipeMapping(newMapping(t), 4000, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "outside")
+	})
+}
+
+// headerBackupExecutor writes header to the file named by luksHeaderBackup's --header-backup-file
+type headerBackupExecutor struct {
+	*MockCommandExecutor
+	header []byte
+}
+
+func (e *headerBackupExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	if len(args) == 4 && args[0] == "luksHeaderBackup" {
+		if err := os.WriteFile(args[3], e.header, 0600); err != nil {
+			return "", err
+		}
+	}
+	return e.MockCommandExecutor.ExecuteWithContext(ctx, command, args...)
+}
+
+func TestLUKSManagerHeaderChecksum(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	executor := &headerBackupExecutor{MockCommandExecutor: NewMockCommandExecutor(), header: []byte("LUKS\xba\xbe header")}
+	luksManager := NewLUKSManager(logger)
+	luksManager.executor = executor
+
+	original, err := luksManager.HeaderChecksum("/dev/test")
+	require.NoError(t, err)
+	assert.Len(t, original, 64)
+
+	again, err := luksManager.HeaderChecksum("/dev/test")
+	require.NoError(t, err)
+	assert.Equal(t, original, again)
+
+	executor.header = []byte("LUKS\xba\xbe headeR")
+	modified, err := luksManager.HeaderChecksum("/dev/test")
+	require.NoError(t, err)
+	assert.NotEqual(t, original, modified, "a modified header must produce a different checksum")
+
+	t.Run("no backup written", func(t *testing.T) {
+		luksManager.executor = NewMockCommandExecutor()
+		_, err := luksManager.HeaderChecksum("/dev/test")
+		require.Error(t, err)
+	})
+}
+
+func TestLUKSManagerFormatDeviceOptions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	key, err := luksManager.GenerateKey()
+	require.NoError(t, err)
+
+	const uuid = "12345678-1234-1234-1234-123456789abc"
+
+	t.Run("aligned offset is passed to luksFormat", func(t *testing.T) {
+		mockExecutor := NewMockCommandExecutor()
+		mockExecutor.SetOutput("blockdev --getss /dev/null", "4096\n")
+		mockExecutor.SetOutput("cryptsetup luksUUID /dev/null", uuid)
+		luksManager.executor = mockExecutor
+
+		require.NoError(t, luksManager.FormatDeviceWithOptions("/dev/null", key, uuid, FormatOptions{Offset: 2048}))
+
+		var format string
+		for _, command := range mockExecutor.GetExecutedCommands() {
+			if strings.HasPrefix(command, "cryptsetup luksFormat") {
+				format = command
+			}
+		}
+		assert.Contains(t, format, "--offset 2048")
+	})
+
+	t.Run("label and subsystem are passed to luksFormat", func(t *testing.T) {
+		mockExecutor := NewMockCommandExecutor()
+		mockExecutor.SetOutput("cryptsetup luksUUID /dev/null", uuid)
+		luksManager.executor = mockExecutor
+
+		require.NoError(t, luksManager.FormatDeviceWithOptions("/dev/null", key, uuid, FormatOptions{Label: "db-data", Subsystem: "pool-a"}))
+
+		var format string
+		for _, command := range mockExecutor.GetExecutedCommands() {
+			if strings.HasPrefix(command, "cryptsetup luksFormat") {
+				format = command
+			}
+		}
+		assert.Contains(t, format, "--label db-data --subsystem pool-a")
+	})
+
+	t.Run("overlong subsystem is refused before formatting", func(t *testing.T) {
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+
+		err := luksManager.FormatDeviceWithOptions("/dev/null", key, uuid, FormatOptions{Subsystem: strings.Repeat("p", 48)})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "LUKS2 subsystem")
+		for _, command := range mockExecutor.GetExecutedCommands() {
+			assert.NotContains(t, command, "luksFormat")
+		}
+	})
+
+	t.Run("offset not a multiple of the logical sector size", func(t *testing.T) {
+		mockExecutor := NewMockCommandExecutor()
+		mockExecutor.SetOutput("blockdev --getss /dev/null", "4096\n")
+		luksManager.executor = mockExecutor
+
+		err := luksManager.FormatDeviceWithOptions("/dev/null", key, uuid, FormatOptions{Offset: 2049})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not a multiple of the device's 4096-byte logical sector size")
+		for _, command := range mockExecutor.GetExecutedCommands() {
+			assert.NotContains(t, command, "luksFormat", "a misaligned offset must be refused before formatting")
+		}
+	})
+}
+
+func TestBuildOpenArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     OpenOptions
+		expected string
+	}{
+		{"default options", OpenOptions{}, "luksOpen --key-file /tmp/key /dev/test test-name"},
+		{"no read workqueue", OpenOptions{NoReadWorkqueue: true}, "luksOpen --key-file /tmp/key --perf-no_read_workqueue /dev/test test-name"},
+		{"no write workqueue", OpenOptions{NoWriteWorkqueue: true}, "luksOpen --key-file /tmp/key --perf-no_write_workqueue /dev/test test-name"},
+		{"both workqueues", OpenOptions{NoReadWorkqueue: true, NoWriteWorkqueue: true}, "luksOpen --key-file /tmp/key --perf-no_read_workqueue --perf-no_write_workqueue /dev/test test-name"},
+		{"keyring key", OpenOptions{KeyDescription: "vault-dm-crypt:1234"}, "luksOpen --key-description vault-dm-crypt:1234 /dev/test test-name"},
+		{"persistent flags", OpenOptions{NoReadWorkqueue: true, Persistent: true}, "luksOpen --key-file /tmp/key --perf-no_read_workqueue --persistent /dev/test test-name"},
+		{"persistent without flags", OpenOptions{Persistent: true}, "luksOpen --key-file /tmp/key /dev/test test-name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildOpenArgs("/dev/test", "test-name", "/tmp/key", tt.opts)
+			assert.Equal(t, tt.expected, strings.Join(args, " "))
+			assert.Equal(t, tt.opts.NoReadWorkqueue || tt.opts.NoWriteWorkqueue, tt.opts.RequiresPerfFlags())
+		})
+	}
+}
+
+func TestProcessPriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority ProcessPriority
+		expected string
+	}{
+		{"unchanged", ProcessPriority{}, "cryptsetup luksOpen /dev/test"},
+		{"nice only", ProcessPriority{Nice: 10}, "nice -n 10 cryptsetup luksOpen /dev/test"},
+		{"ionice only", ProcessPriority{IOClass: IOClassIdle}, "ionice -c 3 cryptsetup luksOpen /dev/test"},
+		{"nice and ionice", ProcessPriority{Nice: 19, IOClass: IOClassBestEffort}, "nice -n 19 ionice -c 2 cryptsetup luksOpen /dev/test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.priority.Validate())
+			command, args := tt.priority.wrap("cryptsetup", "luksOpen", "/dev/test")
+			assert.Equal(t, tt.expected, strings.Join(append([]string{command}, args...), " "))
+		})
+	}
+
+	assert.Error(t, ProcessPriority{Nice: -5}.Validate())
+	assert.Error(t, ProcessPriority{Nice: 20}.Validate())
+	assert.Error(t, ProcessPriority{IOClass: "realtime"}.Validate())
+}
+
+func TestLUKSManagerOpenPriority(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	key, err := NewManager(logger).GenerateKey()
+	require.NoError(t, err)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+	luksManager.statPath = func(string) (os.FileInfo, error) { return nil, nil }
+	luksManager.SetOpenPriority(ProcessPriority{Nice: 10, IOClass: IOClassIdle})
+
+	err = luksManager.OpenDeviceWithOptions("/dev/null", key, "priority-test", OpenOptions{KeyDescription: "vault-dm-crypt:1234"})
+	require.NoError(t, err)
+	assert.Contains(t, mockExecutor.GetExecutedCommands(),
+		"nice -n 10 ionice -c 3 cryptsetup luksOpen --key-description vault-dm-crypt:1234 /dev/null priority-test")
+
+	// Other cryptsetup commands are not deprioritised
+	_, err = luksManager.runCryptsetup(time.Second, "status", "priority-test")
+	require.NoError(t, err)
+	assert.Contains(t, mockExecutor.GetExecutedCommands(), "cryptsetup status priority-test")
+}
+
+func TestLUKSManagerOperationTimeout(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	assert.Equal(t, DefaultOperationTimeout, luksManager.operationTimeout)
+
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	t.Run("hung cryptsetup is killed with a clear error", func(t *testing.T) {
+		mockExecutor.SetHang("cryptsetup luksClose stuck")
+		luksManager.SetOperationTimeout(50 * time.Millisecond)
+
+		start := time.Now()
+		_, err := luksManager.runCryptsetup(luksManager.operationTimeout, "luksClose", "stuck")
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Contains(t, err.Error(), "cryptsetup luksClose did not complete within 50ms")
+		assert.Contains(t, err.Error(), "operation_timeout")
+	})
+
+	t.Run("completed command is unaffected", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup status ok", "active")
+
+		output, err := luksManager.runCryptsetup(time.Second, "status", "ok")
+		require.NoError(t, err)
+		assert.Equal(t, "active", output)
+	})
+
+	t.Run("zero restores default", func(t *testing.T) {
+		luksManager.SetOperationTimeout(0)
+		assert.Equal(t, DefaultOperationTimeout, luksManager.operationTimeout)
+	})
+}
+
+func TestLUKSManagerGetActivationFlags(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	t.Run("flags reported", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup status fast", `/dev/mapper/fast is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  device:  /dev/nvme0n1p3
+  flags:   discards no_read_workqueue no_write_workqueue`)
+
+		flags, err := luksManager.GetActivationFlags("fast")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"discards", "no_read_workqueue", "no_write_workqueue"}, flags)
+	})
+
+	t.Run("no flags", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup status plain", `/dev/mapper/plain is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64`)
+
+		flags, err := luksManager.GetActivationFlags("plain")
+		assert.NoError(t, err)
+		assert.Empty(t, flags)
+	})
+
+	t.Run("status failure", func(t *testing.T) {
+		mockExecutor.SetError("cryptsetup status missing", fmt.Errorf("exit code 4"))
+
+		_, err := luksManager.GetActivationFlags("missing")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "LUKS status failed")
+	})
+}
+
+func TestLUKSManagerGetIntegrityStatus(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	t.Run("integrity active", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup status with-integrity", `/dev/mapper/with-integrity is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 768 bits
+  integrity: hmac(sha256)
+  integrity keysize: 256 bits
+  device:  /dev/mapper/with-integrity_dif`)
+
+		integrity, err := luksManager.GetIntegrityStatus("with-integrity")
+		assert.NoError(t, err)
+		assert.Equal(t, "hmac(sha256)", integrity)
+	})
+
+	t.Run("no integrity", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup status plain", `/dev/mapper/plain is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64`)
+
+		integrity, err := luksManager.GetIntegrityStatus("plain")
+		assert.NoError(t, err)
+		assert.Empty(t, integrity)
+	})
+
+	t.Run("status failure", func(t *testing.T) {
+		mockExecutor.SetError("cryptsetup status missing", fmt.Errorf("exit code 4"))
+
+		_, err := luksManager.GetIntegrityStatus("missing")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "LUKS status failed")
+	})
+}
+
+func TestParseCryptsetupVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		major   int
+		minor   int
+		patch   int
+		wantErr bool
+	}{
+		{output: "cryptsetup 2.4.3\n", major: 2, minor: 4, patch: 3},
+		{output: "cryptsetup 2.7.0 flags: UDEV BLKID KEYRING", major: 2, minor: 7, patch: 0},
+		{output: "cryptsetup 2.0.0-rc1", major: 2, minor: 0, patch: 0},
+		{output: "cryptsetup 1.7", major: 1, minor: 7, patch: 0},
+		{output: "garbage", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			major, minor, patch, err := parseCryptsetupVersion(tt.output)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.major, major)
+			assert.Equal(t, tt.minor, minor)
+			assert.Equal(t, tt.patch, patch)
+		})
+	}
+}
+
+func TestRequireCryptsetupVersion(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	validator := NewSystemValidator(logger)
+	mockExecutor := NewMockCommandExecutor()
+	validator.executor = mockExecutor
+
+	mockExecutor.SetOutput("cryptsetup --version", "cryptsetup 2.3.7")
+
+	assert.NoError(t, validator.RequireCryptsetupVersion(2, 0, "LUKS2 integrity protection"))
+
+	err := validator.RequireCryptsetupVersion(2, 4, "performance flags")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "performance flags requires cryptsetup 2.4 or newer (found 2.3.7)")
+}
+
+func TestLUKSManagerProbeDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	device := "/dev/test"
+	blkidCmd := "blkid -p -o export " + device
+	lsblkCmd := "lsblk -dnP -o FSTYPE,PTTYPE " + device
+
+	newManager := func() (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		return luksManager, mockExecutor
+	}
+
+	t.Run("ext4 filesystem", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput(blkidCmd, "DEVNAME=/dev/test\nUUID=1234\nBLOCK_SIZE=4096\nTYPE=ext4\nUSAGE=filesystem\n")
+
+		sig, err := luksManager.ProbeDevice(device)
+		require.NoError(t, err)
+		require.NotNil(t, sig)
+		assert.Equal(t, "filesystem", sig.Kind)
+		assert.Equal(t, "an ext4 filesystem", sig.String())
+	})
+
+	t.Run("partition table", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput(blkidCmd, "DEVNAME=/dev/test\nPTUUID=abcd\nPTTYPE=gpt\n")
+
+		sig, err := luksManager.ProbeDevice(device)
+		require.NoError(t, err)
+		require.NotNil(t, sig)
+		assert.Equal(t, "a gpt partition table", sig.String())
+	})
+
+	t.Run("LUKS header", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput(blkidCmd, "DEVNAME=/dev/test\nVERSION=2\nTYPE=crypto_LUKS\nUSAGE=crypto\n")
+
+		sig, err := luksManager.ProbeDevice(device)
+		require.NoError(t, err)
+		require.NotNil(t, sig)
+		assert.Equal(t, "a LUKS header", sig.String())
+	})
+
+	t.Run("empty device falls back to lsblk", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetError(blkidCmd, fmt.Errorf("command failed with exit code 2: blkid"))
+		mockExecutor.SetOutput(lsblkCmd, `FSTYPE="" PTTYPE=""`)
+
+		sig, err := luksManager.ProbeDevice(device)
+		require.NoError(t, err)
+		assert.Nil(t, sig)
+		assert.Contains(t, mockExecutor.GetExecutedCommands(), lsblkCmd)
+	})
+
+	t.Run("lsblk detects filesystem", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetError(blkidCmd, fmt.Errorf("command failed with exit code 2: blkid"))
+		mockExecutor.SetOutput(lsblkCmd, `FSTYPE="btrfs" PTTYPE=""`)
+
+		sig, err := luksManager.ProbeDevice(device)
+		require.NoError(t, err)
+		require.NotNil(t, sig)
+		assert.Equal(t, "a btrfs filesystem", sig.String())
+	})
+
+	t.Run("probe failure", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetError(blkidCmd, fmt.Errorf("command failed with exit code 2: blkid"))
+		mockExecutor.SetError(lsblkCmd, fmt.Errorf("command failed with exit code 32: lsblk"))
+
+		_, err := luksManager.ProbeDevice(device)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "probe")
+	})
+}
+
+func TestLUKSManagerFindMappingsForDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	mockExecutor.SetOutput("dmsetup ls --target crypt", "custom-name\t(253:0)\nvaultlocker-other\t(253:1)\n")
+	mockExecutor.SetOutput("cryptsetup status custom-name", `/dev/mapper/custom-name is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  device:  /dev/test-backing
+  offset:  32768 sectors`)
+	mockExecutor.SetOutput("cryptsetup status vaultlocker-other", `/dev/mapper/vaultlocker-other is active.
+  type:    LUKS2
+  device:  /dev/other-backing`)
+
+	t.Run("device with existing mapping", func(t *testing.T) {
+		mappings, err := luksManager.FindMappingsForDevice("/dev/test-backing")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"custom-name"}, mappings)
+	})
+
+	t.Run("device without mapping", func(t *testing.T) {
+		mappings, err := luksManager.FindMappingsForDevice("/dev/unmapped")
+		require.NoError(t, err)
+		assert.Empty(t, mappings)
+	})
+
+	t.Run("no crypt devices", func(t *testing.T) {
+		mockExecutor.SetOutput("dmsetup ls --target crypt", "No devices found\n")
+
+		mappings, err := luksManager.FindMappingsForDevice("/dev/test-backing")
+		require.NoError(t, err)
+		assert.Empty(t, mappings)
+	})
+
+	t.Run("dmsetup failure", func(t *testing.T) {
+		mockExecutor.SetError("dmsetup ls --target crypt", fmt.Errorf("dmsetup not available"))
+
+		_, err := luksManager.FindMappingsForDevice("/dev/test-backing")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "find-mappings")
+	})
+}
+
+func TestLUKSManagerVerifyFormattedUUID(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	requested := "12345678-1234-1234-1234-123456789abc"
+
+	t.Run("matching UUID", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup luksUUID /dev/test", strings.ToUpper(requested)+"\n")
+		assert.NoError(t, luksManager.verifyFormattedUUID("/dev/test", requested))
+	})
+
+	t.Run("mismatched UUID", func(t *testing.T) {
+		mockExecutor.SetOutput("cryptsetup luksUUID /dev/test", "87654321-4321-4321-4321-cba987654321\n")
+
+		err := luksManager.verifyFormattedUUID("/dev/test", requested)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "LUKS format failed on device /dev/test")
+		assert.Contains(t, err.Error(), "does not match requested UUID "+requested)
+	})
+
+	t.Run("luksUUID failure", func(t *testing.T) {
+		mockExecutor.SetError("cryptsetup luksUUID /dev/test", fmt.Errorf("not a LUKS device"))
+
+		err := luksManager.verifyFormattedUUID("/dev/test", requested)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to verify UUID after format")
+	})
+}
+
+func TestLUKSManagerKeyFileWatchdog(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	luksManager.SetKeyFileMaxLifetime(200 * time.Millisecond)
+
+	t.Run("leaked key file is reaped", func(t *testing.T) {
+		keyFile, err := luksManager.createTemporaryKeyFile([]byte("testkey"))
+		require.NoError(t, err)
+		_, err = os.Stat(keyFile)
+		require.NoError(t, err)
+
+		// Never call cleanupKeyFile, simulating a hung cryptsetup
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(keyFile)
+			return os.IsNotExist(err)
+		}, 2*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("cleaned key file is no longer tracked", func(t *testing.T) {
+		keyFile, err := luksManager.createTemporaryKeyFile([]byte("testkey"))
+		require.NoError(t, err)
+
+		luksManager.cleanupKeyFile(keyFile)
+
+		_, err = os.Stat(keyFile)
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, 0, luksManager.keyFiles.reap())
+	})
+}
+
+func TestLUKSManagerWaitForMappedDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	// fakeNode simulates udev creating the mapper node some time after cryptsetup returns
+	fakeNode := func(appearAfter time.Duration) func(string) (os.FileInfo, error) {
+		created := time.Now().Add(appearAfter)
+		return func(path string) (os.FileInfo, error) {
+			if time.Now().Before(created) {
+				return nil, os.ErrNotExist
+			}
+			return nil, nil
+		}
+	}
+
+	countSettles := func(commands []string) int {
+		count := 0
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd, "udevadm settle") {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("node appears after a delay", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		luksManager.SetMapperWaitTimeout(2 * time.Second)
+		luksManager.statPath = fakeNode(300 * time.Millisecond)
+
+		assert.NoError(t, luksManager.waitForMappedDevice("/dev/mapper/crypt-test"))
+		assert.Equal(t, 0, countSettles(mockExecutor.GetExecutedCommands()))
+	})
+
+	t.Run("slow node triggers a single udev settle", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		luksManager.SetMapperWaitTimeout(2 * time.Second)
+		luksManager.statPath = fakeNode(1500 * time.Millisecond)
+
+		assert.NoError(t, luksManager.waitForMappedDevice("/dev/mapper/crypt-test"))
+		assert.Equal(t, 1, countSettles(mockExecutor.GetExecutedCommands()))
+	})
+
+	t.Run("node never appears", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		luksManager.SetMapperWaitTimeout(400 * time.Millisecond)
+		luksManager.statPath = func(string) (os.FileInfo, error) { return nil, os.ErrNotExist }
+
+		err := luksManager.waitForMappedDevice("/dev/mapper/crypt-test")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "mapped device not created: /dev/mapper/crypt-test")
+		assert.Equal(t, 1, countSettles(mockExecutor.GetExecutedCommands()))
+	})
+}
+
+func TestLUKSManagerResolveDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	// sdb is an LVM physical volume backing vg0-data; dm-9 is only claimed by our own crypt mapping;
+	// sdd and sde are both used by two logical volumes
+	mockExecutor.SetOutput("dmsetup deps -o devname", `vg0-data: 1 dependencies	: (sdb)
+vaultlocker-abc: 1 dependencies	: (dm-9)
+vg1-a: 1 dependencies	: (sdd)
+vg1-b: 1 dependencies	: (sdd)
+`)
+	mockExecutor.SetOutput("dmsetup ls --target crypt", "vaultlocker-abc\t(253:9)\n")
+
+	t.Run("follow resolves LVM-backed device", func(t *testing.T) {
+		resolved, err := luksManager.ResolveDevice("/dev/sdb", ResolutionFollow)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/mapper/vg0-data", resolved)
+	})
+
+	t.Run("strict refuses LVM-backed device", func(t *testing.T) {
+		_, err := luksManager.ResolveDevice("/dev/sdb", ResolutionStrict)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "in use by device-mapper device vg0-data")
+	})
+
+	t.Run("plain device is unchanged", func(t *testing.T) {
+		resolved, err := luksManager.ResolveDevice("/dev/sdc", ResolutionStrict)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/sdc", resolved)
+	})
+
+	t.Run("crypt mappings are not followed", func(t *testing.T) {
+		resolved, err := luksManager.ResolveDevice("/dev/dm-9", ResolutionFollow)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/dm-9", resolved)
+	})
+
+	t.Run("ambiguous holders", func(t *testing.T) {
+		_, err := luksManager.ResolveDevice("/dev/sdd", ResolutionFollow)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "multiple device-mapper devices (vg1-a, vg1-b)")
+	})
+
+	t.Run("no device-mapper devices", func(t *testing.T) {
+		mockExecutor.SetOutput("dmsetup deps -o devname", "No devices found\n")
+
+		resolved, err := luksManager.ResolveDevice("/dev/sdb", ResolutionFollow)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/sdb", resolved)
+	})
+}
+
+func TestParseDeviceResolution(t *testing.T) {
+	mode, err := ParseDeviceResolution("strict")
+	require.NoError(t, err)
+	assert.Equal(t, ResolutionStrict, mode)
+
+	mode, err = ParseDeviceResolution("follow")
+	require.NoError(t, err)
+	assert.Equal(t, ResolutionFollow, mode)
+
+	_, err = ParseDeviceResolution("auto")
+	assert.Error(t, err)
+}
+
+func TestLUKSManagerResizeDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	key, err := manager.GenerateKey()
+	require.NoError(t, err)
+
+	newManager := func(open bool) (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		luksManager.statPath = func(string) (os.FileInfo, error) {
+			if open {
+				return nil, nil
+			}
+			return nil, os.ErrNotExist
+		}
+		return luksManager, mockExecutor
+	}
+
+	t.Run("grows mapping and reports sizes", func(t *testing.T) {
+		luksManager, mockExecutor := newManager(true)
+		mockExecutor.SetOutputSequence("cryptsetup status data",
+			"/dev/mapper/data is active.\n  type:    LUKS2\n  size:    2097152 sectors\n",
+			"/dev/mapper/data is active.\n  type:    LUKS2\n  size:    4194304 sectors\n",
+		)
+
+		result, err := luksManager.ResizeDevice("data", key)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1<<30), result.Before)
+		assert.Equal(t, int64(2<<30), result.After)
+
+		commands := mockExecutor.GetExecutedCommands()
+		require.Len(t, commands, 3)
+		assert.True(t, strings.HasPrefix(commands[1], "cryptsetup resize --key-file "))
+		assert.True(t, strings.HasSuffix(commands[1], " data"))
+	})
+
+	t.Run("refuses closed device", func(t *testing.T) {
+		luksManager, mockExecutor := newManager(false)
+
+		_, err := luksManager.ResizeDevice("data", key)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "device data is not open")
+		assert.Empty(t, mockExecutor.GetExecutedCommands())
+	})
+
+	t.Run("cryptsetup failure", func(t *testing.T) {
+		luksManager, mockExecutor := newManager(true)
+		mockExecutor.SetOutput("cryptsetup status data", "  size:    2097152 sectors\n")
+		luksManager.executor = &failingResizeExecutor{MockCommandExecutor: mockExecutor}
+
+		_, err := luksManager.ResizeDevice("data", key)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "No key available with this passphrase")
+	})
+}
+
+// failingResizeExecutor fails cryptsetup resize, whose key file argument varies per call
+type failingResizeExecutor struct {
+	*MockCommandExecutor
+}
+
+func (f *failingResizeExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "cryptsetup" && len(args) > 0 && args[0] == "resize" {
+		return "", fmt.Errorf("No key available with this passphrase")
+	}
+	return f.MockCommandExecutor.ExecuteWithContext(ctx, command, args...)
+}
+
+func TestLUKSManagerCheckMapping(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	const healthyStatus = `/dev/mapper/data is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  device:  /dev/sdb1
+  sector size:  512
+  offset:  32768 sectors
+  size:    2097152 sectors
+  mode:    read/write
+`
+
+	tests := []struct {
+		name      string
+		status    string
+		statusErr error
+		present   bool
+		readErr   error
+		errMsg    string
+	}{
+		{name: "healthy mapping", status: healthyStatus, present: true},
+		{name: "status fails", statusErr: fmt.Errorf("exit status 4"), errMsg: "cryptsetup status failed"},
+		{name: "inactive mapping", status: "/dev/mapper/data is inactive.\n", present: true, errMsg: "mapping is not active"},
+		{name: "underlying device gone", status: strings.Replace(healthyStatus, "/dev/sdb1", "(null)", 1), present: true, errMsg: "no underlying device"},
+		{name: "underlying device missing", status: healthyStatus, present: false, errMsg: "underlying device /dev/sdb1 is missing"},
+		{name: "read test fails", status: healthyStatus, present: true, readErr: fmt.Errorf("input/output error"), errMsg: "read test failed: input/output error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			luksManager := NewLUKSManager(logger)
+			mockExecutor := NewMockCommandExecutor()
+			luksManager.executor = mockExecutor
+			if tt.statusErr != nil {
+				mockExecutor.SetError("cryptsetup status data", tt.statusErr)
+			} else {
+				mockExecutor.SetOutput("cryptsetup status data", tt.status)
+			}
+			luksManager.statPath = func(string) (os.FileInfo, error) {
+				if tt.present {
+					return nil, nil
+				}
+				return nil, os.ErrNotExist
+			}
+			var readPath string
+			luksManager.readMapping = func(path string) error {
+				readPath = path
+				return tt.readErr
+			}
+
+			err := luksManager.CheckMapping("data")
+			if tt.errMsg == "" {
+				require.NoError(t, err)
+				assert.Equal(t, "/dev/mapper/data", readPath)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestLUKSManagerRemoveMapping(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	t.Run("luksClose succeeds", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+
+		require.NoError(t, luksManager.RemoveMapping("data"))
+		assert.Equal(t, []string{"cryptsetup luksClose data"}, mockExecutor.GetExecutedCommands())
+	})
+
+	t.Run("falls back to dmsetup remove", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		mockExecutor.SetError("cryptsetup luksClose data", fmt.Errorf("Device data is still in use"))
+		luksManager.executor = mockExecutor
+
+		require.NoError(t, luksManager.RemoveMapping("data"))
+		assert.Equal(t, []string{"cryptsetup luksClose data", "dmsetup remove --force data"}, mockExecutor.GetExecutedCommands())
+	})
+
+	t.Run("surfaces stderr of failed command", func(t *testing.T) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		mockExecutor.SetError("cryptsetup luksClose data", fmt.Errorf("Device data is still in use"))
+		mockExecutor.SetError("dmsetup remove --force data", &shell.CommandError{
+			Command:  "dmsetup",
+			Args:     []string{"remove", "--force", "data"},
+			ExitCode: 1,
+			Stdout:   "distinct stdout",
+			Stderr:   "device-mapper: remove ioctl on data failed: Device or resource busy\n",
+		})
+		luksManager.executor = mockExecutor
+
+		err := luksManager.RemoveMapping("data")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Device or resource busy")
+		assert.NotContains(t, err.Error(), "distinct stdout")
+
+		var luksErr *errors.LUKSFailure
+		require.True(t, stderrors.As(err, &luksErr))
+		assert.Equal(t, "device-mapper: remove ioctl on data failed: Device or resource busy", luksErr.Stderr)
+	})
+}
+
+// testKeyExecutor answers cryptsetup open commands, whose key file argument varies per call
+type testKeyExecutor struct {
+	*MockCommandExecutor
+	respond func(args []string) (string, error)
+}
+
+func (e *testKeyExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "cryptsetup" && len(args) > 0 && (args[0] == "open" || args[0] == "luksOpen") {
+		e.commands = append(e.commands, command+" "+args[0]+" "+args[len(args)-1])
+		return e.respond(args)
+	}
+	return e.MockCommandExecutor.ExecuteWithContext(ctx, command, args...)
+}
+
+func TestLUKSManagerTestKey(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	key, err := NewManager(logger).GenerateKey()
+	require.NoError(t, err)
+
+	fallbackName := fmt.Sprintf("vault-dm-crypt-test-%d", os.Getpid())
+
+	newManager := func(respond func(args []string) (string, error)) (*LUKSManager, *testKeyExecutor) {
+		luksManager := NewLUKSManager(logger)
+		executor := &testKeyExecutor{MockCommandExecutor: NewMockCommandExecutor(), respond: respond}
+		luksManager.executor = executor
+		return luksManager, executor
+	}
+
+	t.Run("native test-passphrase", func(t *testing.T) {
+		luksManager, executor := newManager(func(args []string) (string, error) {
+			assert.Contains(t, args, "--test-passphrase")
+			return "Key slot 1 unlocked.\nCommand successful.\n", nil
+		})
+
+		slot, err := luksManager.TestKey("/dev/null", key)
+		require.NoError(t, err)
+		assert.Equal(t, 1, slot)
+		assert.Equal(t, []string{"cryptsetup open /dev/null"}, executor.GetExecutedCommands())
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		luksManager, _ := newManager(func(args []string) (string, error) {
+			return "", &shell.CommandError{Command: "cryptsetup", ExitCode: 2, Stderr: "No key available with this passphrase."}
+		})
+
+		slot, err := luksManager.TestKey("/dev/null", key)
+		require.Error(t, err)
+		assert.Equal(t, UnknownKeySlot, slot)
+		assert.Contains(t, err.Error(), "key does not unlock any keyslot")
+	})
+
+	t.Run("falls back to temporary mapping", func(t *testing.T) {
+		luksManager, executor := newManager(func(args []string) (string, error) {
+			if args[0] == "open" {
+				return "", &shell.CommandError{Command: "cryptsetup", ExitCode: 1, Stderr: "cryptsetup: --test-passphrase: unknown option"}
+			}
+			assert.Contains(t, args, "--readonly")
+			return "Key slot 0 unlocked.\nCommand successful.\n", nil
+		})
+
+		slot, err := luksManager.TestKey("/dev/null", key)
+		require.NoError(t, err)
+		assert.Equal(t, 0, slot)
+		assert.Equal(t, []string{
+			"cryptsetup open /dev/null",
+			"cryptsetup luksOpen " + fallbackName,
+			"cryptsetup luksClose " + fallbackName,
+		}, executor.GetExecutedCommands())
+	})
+
+	t.Run("fallback reports a mapping left open", func(t *testing.T) {
+		luksManager, executor := newManager(func(args []string) (string, error) {
+			if args[0] == "open" {
+				return "", fmt.Errorf("unrecognized option '--test-passphrase'")
+			}
+			return "Key slot 0 unlocked.\n", nil
+		})
+		executor.SetError("cryptsetup luksClose "+fallbackName, fmt.Errorf("device busy"))
+
+		_, err := luksManager.TestKey("/dev/null", key)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not be closed")
+	})
+
+	t.Run("slot not reported", func(t *testing.T) {
+		luksManager, _ := newManager(func(args []string) (string, error) {
+			return "Command successful.\n", nil
+		})
+
+		slot, err := luksManager.TestKey("/dev/null", key)
+		require.NoError(t, err)
+		assert.Equal(t, UnknownKeySlot, slot)
+	})
+}
+
+func TestLUKSManagerHeaderVersion(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	mockExecutor.SetOutput("cryptsetup luksDump /dev/luks2", "LUKS header information\nVersion:       \t2\nEpoch:          3\n")
+	mockExecutor.SetOutput("cryptsetup luksDump /dev/luks1", "LUKS header information for /dev/luks1\n\nVersion:       \t1\nCipher name:   \taes\n")
+	mockExecutor.SetError("cryptsetup isLuks /dev/plain", fmt.Errorf("exit code 1"))
+
+	assert.Equal(t, "2", luksManager.headerVersion("/dev/luks2"))
+	assert.Equal(t, "1", luksManager.headerVersion("/dev/luks1"))
+	assert.Equal(t, "unknown", luksManager.headerVersion("/dev/plain"))
+}
+
+func TestLUKSManagerDescribeDevice(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	mockExecutor.SetOutput("lsblk -dnP -o SIZE,MODEL,SERIAL /dev/nvme0n1", `SIZE="931.5G" MODEL="Samsung SSD 970 EVO Plus 1TB" SERIAL="S4EWNX0R123456"`+"\n")
+	mockExecutor.SetOutput("lsblk -dnP -o SIZE,MODEL,SERIAL /dev/vdb", `SIZE="20G" MODEL="" SERIAL=""`)
+	mockExecutor.SetError("lsblk -dnP -o SIZE,MODEL,SERIAL /dev/missing", fmt.Errorf("not a block device"))
+
+	desc, err := luksManager.DescribeDevice("/dev/nvme0n1")
+	require.NoError(t, err)
+	assert.Equal(t, DeviceDescription{Size: "931.5G", Model: "Samsung SSD 970 EVO Plus 1TB", Serial: "S4EWNX0R123456"}, desc)
+
+	desc, err = luksManager.DescribeDevice("/dev/vdb")
+	require.NoError(t, err)
+	assert.Equal(t, DeviceDescription{Size: "20G"}, desc)
+
+	_, err = luksManager.DescribeDevice("/dev/missing")
+	assert.Error(t, err)
+}
+
+func TestBuildMkfsArgs(t *testing.T) {
+	command, args := buildMkfsArgs("/dev/mapper/data", "ext4", false)
+	assert.Equal(t, "mkfs.ext4 /dev/mapper/data", command+" "+strings.Join(args, " "))
+
+	command, args = buildMkfsArgs("/dev/mapper/data", "ext4", true)
+	assert.Equal(t, "mkfs.ext4 -F /dev/mapper/data", command+" "+strings.Join(args, " "))
+
+	command, args = buildMkfsArgs("/dev/mapper/data", "xfs", true)
+	assert.Equal(t, "mkfs.xfs -f /dev/mapper/data", command+" "+strings.Join(args, " "))
+}
+
+func TestLUKSManagerMakeFilesystem(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	mapped := "/dev/mapper/data"
+	blkidCmd := "blkid -p -o export " + mapped
+	lsblkCmd := "lsblk -dnP -o FSTYPE,PTTYPE " + mapped
+
+	newManager := func(existing string) (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		if existing == "" {
+			mockExecutor.SetError(blkidCmd, fmt.Errorf("command failed with exit code 2: blkid"))
+			mockExecutor.SetOutput(lsblkCmd, `FSTYPE="" PTTYPE=""`)
+		} else {
+			mockExecutor.SetOutput(blkidCmd, "TYPE="+existing+"\nUSAGE=filesystem\n")
+		}
+		return luksManager, mockExecutor
+	}
+
+	t.Run("empty mapping", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("")
+
+		require.NoError(t, luksManager.MakeFilesystem(mapped, "xfs", false))
+		assert.Contains(t, mockExecutor.GetExecutedCommands(), "mkfs.xfs "+mapped)
+	})
+
+	t.Run("existing filesystem blocks mkfs", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("ext4")
+
+		err := luksManager.MakeFilesystem(mapped, "ext4", false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already contains an ext4 filesystem")
+		for _, command := range mockExecutor.GetExecutedCommands() {
+			assert.False(t, strings.HasPrefix(command, "mkfs"), "mkfs must not run: %s", command)
+		}
+	})
+
+	t.Run("existing filesystem with force", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("ext4")
+
+		require.NoError(t, luksManager.MakeFilesystem(mapped, "ext4", true))
+		assert.Contains(t, mockExecutor.GetExecutedCommands(), "mkfs.ext4 -F "+mapped)
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("")
+
+		err := luksManager.MakeFilesystem(mapped, "btrfs", false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported filesystem")
+		assert.Empty(t, mockExecutor.GetExecutedCommands())
+	})
+
+	t.Run("heartbeat while running and timeout", func(t *testing.T) {
+		var logs bytes.Buffer
+		heartbeatLogger := logrus.New()
+		heartbeatLogger.SetOutput(&logs)
+
+		luksManager := NewLUKSManager(heartbeatLogger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		luksManager.heartbeatInterval = 20 * time.Millisecond
+		luksManager.SetOperationTimeout(150 * time.Millisecond)
+		mockExecutor.SetHang("mkfs.ext4 " + mapped)
+
+		_, err := luksManager.runWithHeartbeat(luksManager.operationTimeout, "mkfs.ext4", mapped)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did not complete within 150ms")
+		assert.Contains(t, logs.String(), "Still running")
+	})
+}
+
+func TestLUKSManagerSetKeyslotPriority(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	newManager := func(version string) (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		mockExecutor.SetOutput("cryptsetup luksDump /dev/null", "LUKS header information\nVersion:       \t"+version+"\n")
+		return luksManager, mockExecutor
+	}
+
+	t.Run("runs cryptsetup config", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("2")
+
+		require.NoError(t, luksManager.SetKeyslotPriority("/dev/null", 1, KeyslotPriorityNormal))
+		require.NoError(t, luksManager.SetKeyslotPriority("/dev/null", 0, KeyslotPriorityPrefer))
+		assert.Contains(t, mockExecutor.commands, "cryptsetup config --key-slot 1 --priority normal /dev/null")
+		assert.Contains(t, mockExecutor.commands, "cryptsetup config --key-slot 0 --priority prefer /dev/null")
+	})
+
+	t.Run("cryptsetup failure", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("2")
+		mockExecutor.SetError("cryptsetup config --key-slot 3 --priority ignore /dev/null", fmt.Errorf("Keyslot 3 is not active."))
+
+		err := luksManager.SetKeyslotPriority("/dev/null", 3, KeyslotPriorityIgnore)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to set priority of keyslot 3")
+	})
+
+	t.Run("LUKS1 is refused", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("1")
+
+		err := luksManager.SetKeyslotPriority("/dev/null", 0, KeyslotPriorityPrefer)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "require a LUKS2 header")
+		for _, command := range mockExecutor.commands {
+			assert.NotContains(t, command, "cryptsetup config")
+		}
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		luksManager, mockExecutor := newManager("2")
+
+		assert.Error(t, luksManager.SetKeyslotPriority("/dev/null", 0, "highest"))
+		assert.Error(t, luksManager.SetKeyslotPriority("/dev/null", -1, KeyslotPriorityNormal))
+		assert.Empty(t, mockExecutor.commands)
+	})
+}
+
+func TestLUKSManagerKeyslotPriorities(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	luksManager := NewLUKSManager(logger)
+	mockExecutor := NewMockCommandExecutor()
+	luksManager.executor = mockExecutor
+
+	mockExecutor.SetOutput("cryptsetup luksDump /dev/sdb1", `LUKS header information
+Version:       	2
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	cipher: aes-xts-plain64
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+	Priority:   prefer
+	Cipher:     aes-xts-plain64
+  1: luks2
+	Key:        512 bits
+	Cipher:     aes-xts-plain64
+  2: luks2
+	Key:        512 bits
+	Priority:   ignore
+Tokens:
+Digests:
+  0: pbkdf2
+`)
+
+	priorities, err := luksManager.KeyslotPriorities("/dev/sdb1")
+	require.NoError(t, err)
+	assert.Equal(t, map[int]KeyslotPriority{
+		0: KeyslotPriorityPrefer,
+		1: KeyslotPriorityNormal,
+		2: KeyslotPriorityIgnore,
+	}, priorities)
+}
+
+func TestLUKSManagerStablePath(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	luksManager := NewLUKSManager(logger)
+
+	// A faked /dev with disks and a /dev/disk/by-id pointing at them
+	dev := t.TempDir()
+	luksManager.byIDDir = filepath.Join(dev, "disk", "by-id")
+	require.NoError(t, os.MkdirAll(luksManager.byIDDir, 0755))
+	for _, name := range []string{"sdb", "sdb1", "sdc"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dev, name), nil, 0600))
+	}
+	for link, target := range map[string]string{
+		"ata-SAMSUNG_MZ7LH960_S45NNA0M1234":       "../../sdb",
+		"wwn-0x5002538e40a1b2c3":                  "../../sdb",
+		"wwn-0x5002538e40a1b2c3-part1":            "../../sdb1",
+		"ata-SAMSUNG_MZ7LH960_S45NNA0M1234-part1": "../../sdb1",
+		"scsi-SATA_ST4000NM0035_ZC11ABCD":         "../../sdc",
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(luksManager.byIDDir, link)))
+	}
+
+	tests := []struct {
+		device string
+		want   string
+	}{
+		{"sdb", "wwn-0x5002538e40a1b2c3"},
+		{"sdb1", "wwn-0x5002538e40a1b2c3-part1"},
+		{"sdc", "scsi-SATA_ST4000NM0035_ZC11ABCD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.device, func(t *testing.T) {
+			path, err := luksManager.StablePath(filepath.Join(dev, tt.device))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(luksManager.byIDDir, tt.want), path)
+		})
+	}
+
+	t.Run("device given by its by-id path", func(t *testing.T) {
+		path, err := luksManager.StablePath(filepath.Join(luksManager.byIDDir, "ata-SAMSUNG_MZ7LH960_S45NNA0M1234"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(luksManager.byIDDir, "wwn-0x5002538e40a1b2c3"), path)
+	})
+
+	t.Run("no link", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dev, "loop0"), nil, 0600))
+		path, err := luksManager.StablePath(filepath.Join(dev, "loop0"))
+		require.NoError(t, err)
+		assert.Empty(t, path)
+	})
+}
+
+func TestIsKernelDevicePath(t *testing.T) {
+	for _, path := range []string{"/dev/sdb", "/dev/sdb1", "/dev/sdaa", "/dev/vdc2", "/dev/xvdf", "/dev/nvme0n1", "/dev/nvme1n1p3", "/dev/mmcblk0p1"} {
+		assert.True(t, IsKernelDevicePath(path), path)
+	}
+	for _, path := range []string{"/dev/disk/by-id/wwn-0x5002538e40a1b2c3", "/dev/disk/by-uuid/1234", "/dev/mapper/mpatha", "/dev/vg0/data", "/dev/md0", "/dev/loop0"} {
+		assert.False(t, IsKernelDevicePath(path), path)
+	}
+}
+
+// busyExecutor fails cryptsetup luksOpen and luksClose with failure until it has been called busyFor times
+type busyExecutor struct {
+	*MockCommandExecutor
+	busyFor int
+	failure error
+	calls   int
+}
+
+func (e *busyExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "cryptsetup" && (args[0] == "luksOpen" || args[0] == "luksClose") {
+		e.commands = append(e.commands, command+" "+args[0])
+		e.calls++
+		if e.calls <= e.busyFor {
+			return "", e.failure
+		}
+		return "", nil
+	}
+	return e.MockCommandExecutor.ExecuteWithContext(ctx, command, args...)
+}
+
+func TestLUKSManagerBusyRetry(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	key, err := NewManager(logger).GenerateKey()
+	require.NoError(t, err)
+
+	busy := &shell.CommandError{Command: "cryptsetup", ExitCode: 5, Stderr: "Device sdb is busy."}
+
+	newManager := func(busyFor int, failure error) (*LUKSManager, *busyExecutor) {
+		luksManager := NewLUKSManager(logger)
+		executor := &busyExecutor{MockCommandExecutor: NewMockCommandExecutor(), busyFor: busyFor, failure: failure}
+		luksManager.executor = executor
+		luksManager.busyRetryDelay = time.Millisecond
+		return luksManager, executor
+	}
+
+	t.Run("open succeeds after busy", func(t *testing.T) {
+		luksManager, executor := newManager(2, busy)
+		require.NoError(t, luksManager.openWithKeyFile("/dev/null", key, "test-device", OpenOptions{}))
+		assert.Equal(t, []string{
+			"cryptsetup luksOpen",
+			"udevadm settle --timeout=10",
+			"cryptsetup luksOpen",
+			"udevadm settle --timeout=10",
+			"cryptsetup luksOpen",
+		}, executor.GetExecutedCommands())
+	})
+
+	t.Run("wrong passphrase is not retried", func(t *testing.T) {
+		wrongKey := &shell.CommandError{Command: "cryptsetup", ExitCode: 2, Stderr: "No key available with this passphrase."}
+		luksManager, executor := newManager(1, wrongKey)
+		err := luksManager.openWithKeyFile("/dev/null", key, "test-device", OpenOptions{})
+		require.Error(t, err)
+		assert.Equal(t, []string{"cryptsetup luksOpen"}, executor.GetExecutedCommands())
+	})
+
+	t.Run("gives up after busy_retries", func(t *testing.T) {
+		luksManager, executor := newManager(10, busy)
+		luksManager.SetBusyRetries(1)
+		err := luksManager.openWithKeyFile("/dev/null", key, "test-device", OpenOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is busy")
+		assert.Equal(t, 2, executor.calls)
+	})
+
+}
+
+func TestIsBusyError(t *testing.T) {
+	for _, stderr := range []string{
+		"Device sdb is busy.",
+		"Device vaultlocker-1234 is still in use.",
+		"device-mapper: remove ioctl on vaultlocker-1234 failed: Device or resource busy",
+	} {
+		assert.True(t, isBusyError(&shell.CommandError{Command: "cryptsetup", ExitCode: 5, Stderr: stderr}), stderr)
+	}
+	for _, stderr := range []string{
+		"No key available with this passphrase.",
+		"Device /dev/sdb is not a valid LUKS device.",
+		"Cannot use device /dev/sdb which is in use (already mapped or mounted).",
+	} {
+		assert.False(t, isBusyError(&shell.CommandError{Command: "cryptsetup", ExitCode: 1, Stderr: stderr}), stderr)
+	}
+}
+
+// keyFileCaptureExecutor records the contents of the key file passed to cryptsetup luksOpen
+type keyFileCaptureExecutor struct {
+	*MockCommandExecutor
+	args    []string
+	keyFile []byte
+}
+
+func (e *keyFileCaptureExecutor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "cryptsetup" && len(args) > 0 && args[0] == "luksOpen" {
+		e.args = args
+		for i, arg := range args[:len(args)-1] {
+			if arg == "--key-file" {
+				e.keyFile, _ = os.ReadFile(args[i+1])
+			}
+		}
+	}
+	return e.MockCommandExecutor.ExecuteWithContext(ctx, command, args...)
+}
+
+func TestLUKSManagerOpenDeviceWithPassphrase(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	newManager := func() (*LUKSManager, *keyFileCaptureExecutor) {
+		luksManager := NewLUKSManager(logger)
+		executor := &keyFileCaptureExecutor{MockCommandExecutor: NewMockCommandExecutor()}
+		luksManager.executor = executor
+		luksManager.statPath = func(string) (os.FileInfo, error) { return nil, nil }
+		return luksManager, executor
+	}
+
+	t.Run("passphrase is passed unchanged", func(t *testing.T) {
+		luksManager, executor := newManager()
+
+		// A valid base64 string must not be decoded as a key would be
+		passphrase := []byte("correct horse battery staple==")
+		require.NoError(t, luksManager.OpenDeviceWithPassphrase("/dev/null", passphrase, "recovery-test"))
+
+		require.Len(t, executor.args, 5)
+		assert.Equal(t, []string{"luksOpen", "--key-file"}, executor.args[:2])
+		assert.Equal(t, []string{"/dev/null", "recovery-test"}, executor.args[3:])
+		assert.Equal(t, passphrase, executor.keyFile)
+
+		_, err := os.Stat(executor.args[2])
+		assert.True(t, os.IsNotExist(err), "passphrase file is removed after the open")
+	})
+
+	t.Run("empty passphrase is rejected", func(t *testing.T) {
+		luksManager, executor := newManager()
+		assert.Error(t, luksManager.OpenDeviceWithPassphrase("/dev/null", nil, "recovery-test"))
+		assert.Empty(t, executor.GetExecutedCommands())
+	})
+}
+
+func TestLUKSManagerLoopDevices(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	newManager := func() (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		return luksManager, mockExecutor
+	}
+
+	image := filepath.Join(t.TempDir(), "data.img")
+	require.NoError(t, os.WriteFile(image, make([]byte, 4096), 0600))
+
+	t.Run("regular file detection", func(t *testing.T) {
+		assert.True(t, IsRegularFile(image))
+		assert.False(t, IsRegularFile(filepath.Dir(image)))
+		assert.False(t, IsRegularFile("/dev/null"))
+		assert.False(t, IsRegularFile(image+".missing"))
+	})
+
+	t.Run("setup attaches the file", func(t *testing.T) {
+		luksManager, executor := newManager()
+		executor.SetOutput("losetup -f --show "+image, "/dev/loop3\n")
+
+		loopDevice, err := luksManager.SetupLoopDevice(image)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop3", loopDevice)
+	})
+
+	t.Run("setup rejects unexpected output", func(t *testing.T) {
+		luksManager, executor := newManager()
+		executor.SetOutput("losetup -f --show "+image, "")
+
+		_, err := luksManager.SetupLoopDevice(image)
+		assert.Error(t, err)
+	})
+
+	t.Run("find parses losetup -j", func(t *testing.T) {
+		luksManager, executor := newManager()
+		executor.SetOutput("losetup -j "+image, "/dev/loop3: [2049]:131 ("+image+")\n/dev/loop7: [2049]:131 ("+image+")\n")
+
+		loopDevices, err := luksManager.FindLoopDevices(image)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/loop3", "/dev/loop7"}, loopDevices)
+	})
+
+	t.Run("ensure reuses an attached loop device", func(t *testing.T) {
+		luksManager, executor := newManager()
+		executor.SetOutput("losetup -j "+image, "/dev/loop3: [2049]:131 ("+image+")\n")
+
+		loopDevice, err := luksManager.EnsureLoopDevice(image)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop3", loopDevice)
+		assert.Equal(t, []string{"losetup -j " + image}, executor.GetExecutedCommands())
+	})
+
+	t.Run("ensure attaches a detached file", func(t *testing.T) {
+		luksManager, executor := newManager()
+		executor.SetOutput("losetup -j "+image, "")
+		executor.SetOutput("losetup -f --show "+image, "/dev/loop0\n")
+
+		loopDevice, err := luksManager.EnsureLoopDevice(image)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/loop0", loopDevice)
+	})
+
+	t.Run("ensure requires the backing file", func(t *testing.T) {
+		luksManager, executor := newManager()
+
+		_, err := luksManager.EnsureLoopDevice(image + ".missing")
+		assert.Error(t, err)
+		assert.Empty(t, executor.GetExecutedCommands())
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		luksManager, executor := newManager()
+
+		require.NoError(t, luksManager.DetachLoopDevice("/dev/loop3"))
+		assert.Equal(t, []string{"losetup -d /dev/loop3"}, executor.GetExecutedCommands())
+
+		executor.SetError("losetup -d /dev/loop4", fmt.Errorf("device busy"))
+		assert.Error(t, luksManager.DetachLoopDevice("/dev/loop4"))
+	})
+}
+
+func TestLUKSManagerSystemDevices(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	luksManager := NewLUKSManager(logger)
+
+	// A faked sysfs: partitions and device-mapper devices, each with its device number
+	dir := t.TempDir()
+	luksManager.sysBlockDir = filepath.Join(dir, "class", "block")
+	luksManager.sysDevBlockDir = filepath.Join(dir, "dev", "block")
+	luksManager.sysBtrfsDir = filepath.Join(dir, "fs", "btrfs")
+	devices := filepath.Join(dir, "devices")
+	require.NoError(t, os.MkdirAll(luksManager.sysBlockDir, 0755))
+	require.NoError(t, os.MkdirAll(luksManager.sysDevBlockDir, 0755))
+	for name, device := range map[string]struct {
+		path         string
+		major, minor uint32
+	}{
+		"sda1": {"sda/sda1", 8, 1},
+		"sda2": {"sda/sda2", 8, 2},
+		"sdb1": {"sdb/sdb1", 8, 17},
+		"sdc1": {"sdc/sdc1", 8, 33},
+		"sdd1": {"sdd/sdd1", 8, 49},
+		"sde1": {"sde/sde1", 8, 65},
+		"sdf1": {"sdf/sdf1", 8, 81},
+		"sdh1": {"sdh/sdh1", 8, 113},
+		"dm-0": {"dm-0", 253, 0},
+	} {
+		path := filepath.Join(devices, device.path)
+		require.NoError(t, os.MkdirAll(path, 0755))
+		if strings.Contains(device.path, "/") {
+			require.NoError(t, os.WriteFile(filepath.Join(path, "partition"), []byte("1\n"), 0600))
+		}
+		require.NoError(t, os.Symlink(path, filepath.Join(luksManager.sysBlockDir, name)))
+		require.NoError(t, os.Symlink(path, filepath.Join(luksManager.sysDevBlockDir, fmt.Sprintf("%d:%d", device.major, device.minor))))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(devices, "dm-0", "slaves"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(devices, "sdb", "sdb1"), filepath.Join(devices, "dm-0", "slaves", "sdb1")))
+
+	setup := func(t *testing.T, mounts string, numbers map[string]uint64) {
+		t.Helper()
+		luksManager.mountsPath = filepath.Join(t.TempDir(), "mounts")
+		require.NoError(t, os.WriteFile(luksManager.mountsPath, []byte(mounts), 0600))
+		luksManager.deviceNumber = func(path string) (uint64, error) {
+			if number, ok := numbers[path]; ok {
+				return number, nil
+			}
+			return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+	}
+
+	t.Run("root found through its device number", func(t *testing.T) {
+		// Root is an LVM volume on sdb1 shown as /dev/root, /boot and the ESP are on sda, and /data must be ignored
+		setup(t, "/dev/root / ext4 rw,relatime 0 0\n"+
+			"proc /proc proc rw 0 0\n"+
+			"/dev/sda2 /boot ext4 rw,relatime 0 0\n"+
+			"/dev/sda1 /boot/efi vfat rw 0 0\n"+
+			"/dev/sdc1 /data xfs rw 0 0\n"+
+			"tmpfs /run tmpfs rw 0 0\n",
+			map[string]uint64{"/": unix.Mkdev(253, 0), "/boot": unix.Mkdev(8, 2), "/boot/efi": unix.Mkdev(8, 1)})
+
+		found, err := luksManager.SystemDevices()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/dm-0", "/dev/root", "/dev/sda", "/dev/sda1", "/dev/sda2", "/dev/sdb", "/dev/sdb1"}, found)
+	})
+
+	t.Run("btrfs on several devices", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(filepath.Join(luksManager.sysBtrfsDir, "4f1c", "devices"), 0755))
+		for _, member := range []string{"sdd1", "sde1"} {
+			require.NoError(t, os.Symlink(filepath.Join(devices, member[:3], member), filepath.Join(luksManager.sysBtrfsDir, "4f1c", "devices", member)))
+		}
+		setup(t, "/dev/sdd1 / btrfs rw,subvol=/@ 0 0\n", map[string]uint64{"/": unix.Mkdev(0, 30), "/boot": unix.Mkdev(0, 30)})
+
+		found, err := luksManager.SystemDevices()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/sdd", "/dev/sdd1", "/dev/sde", "/dev/sde1"}, found)
+	})
+
+	t.Run("zfs pool", func(t *testing.T) {
+		executor := NewMockCommandExecutor()
+		executor.SetOutput("blkid -t TYPE=zfs_member -o export",
+			"DEVNAME=/dev/sdf1\nLABEL=rpool\nTYPE=zfs_member\n\nDEVNAME=/dev/sdg1\nLABEL=tank\nTYPE=zfs_member\n")
+		luksManager.executor = executor
+		setup(t, "rpool/ROOT/debian / zfs rw,xattr 0 0\n", map[string]uint64{"/": unix.Mkdev(0, 40)})
+
+		found, err := luksManager.SystemDevices()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/sdf", "/dev/sdf1"}, found)
+	})
+
+	t.Run("overlay root", func(t *testing.T) {
+		setup(t, "/dev/sdh1 /media/root-ro ext4 ro 0 0\n"+
+			"tmpfs /media/root-rw tmpfs rw 0 0\n"+
+			"overlay / overlay rw,lowerdir=/media/root-ro,upperdir=/media/root-rw/overlay,workdir=/media/root-rw/work 0 0\n",
+			map[string]uint64{"/": unix.Mkdev(0, 50), "/media/root-ro": unix.Mkdev(8, 113), "/media/root-rw/overlay": unix.Mkdev(0, 51)})
+
+		found, err := luksManager.SystemDevices()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/dev/sdh", "/dev/sdh1"}, found)
+	})
+
+	t.Run("mount point that cannot be checked", func(t *testing.T) {
+		setup(t, "/dev/sda2 / ext4 rw 0 0\n", nil)
+		luksManager.deviceNumber = func(path string) (uint64, error) {
+			return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrPermission}
+		}
+		_, err := luksManager.SystemDevices()
+		assert.Error(t, err)
+	})
+
+	t.Run("unreadable mounts", func(t *testing.T) {
+		luksManager.mountsPath = filepath.Join(dir, "missing")
+		_, err := luksManager.SystemDevices()
+		assert.Error(t, err)
+	})
+}
+
+func TestDeviceMatches(t *testing.T) {
+	// A faked /dev/disk/by-id link pointing at a disk
+	dev := t.TempDir()
+	disk := filepath.Join(dev, "sdb")
+	require.NoError(t, os.WriteFile(disk, nil, 0600))
+	link := filepath.Join(dev, "wwn-0x5002538e40a1b2c3")
+	require.NoError(t, os.Symlink("sdb", link))
+
+	tests := []struct {
+		name    string
+		device  string
+		pattern string
+		want    bool
+	}{
+		{"exact path", "/dev/sdb", "/dev/sdb", true},
+		{"different path", "/dev/sdc", "/dev/sdb", false},
+		{"glob", "/dev/sdc", "/dev/sd[b-z]", true},
+		{"glob excluding device", "/dev/sda", "/dev/sd[b-z]", false},
+		{"partition does not match its disk", "/dev/sdb1", "/dev/sdb", false},
+		{"link given, kernel name listed", link, disk, true},
+		{"kernel name given, link listed", disk, link, true},
+		{"kernel name given, link glob listed", disk, filepath.Join(dev, "wwn-*"), true},
+		{"bad pattern", "/dev/sdb", "/dev/sd[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DeviceMatches(tt.device, tt.pattern))
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package dmcrypt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// HeaderChecksum returns the hex SHA-256 of the LUKS header of devicePath, as written by
+// cryptsetup luksHeaderBackup. The backup covers the keyslot area as well as the metadata, so
+// the checksum also changes when keyslots are added or removed or flags are persisted.
+func (lm *LUKSManager) HeaderChecksum(devicePath string) (string, error) {
+	lm.logger.WithField("device", devicePath).Debug("Computing LUKS header checksum")
+
+	// luksHeaderBackup refuses to overwrite a file, so it writes into a private directory. The
+	// backup holds the encrypted keyslots and is removed as soon as it is hashed.
+	dir, err := os.MkdirTemp("", "vault-dm-crypt-header-*")
+	if err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "header checksum", err)
+	}
+	defer os.RemoveAll(dir)
+
+	backupPath := filepath.Join(dir, "header")
+	if _, err := lm.runCryptsetup(lm.operationTimeout, "luksHeaderBackup", devicePath, "--header-backup-file", backupPath); err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "luksHeaderBackup", err)
+	}
+
+	file, err := os.Open(backupPath)
+	if err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "header checksum", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "header checksum", fmt.Errorf("failed to read header backup: %w", err))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
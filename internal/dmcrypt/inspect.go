@@ -0,0 +1,231 @@
+package dmcrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// HeaderInfo is the metadata of a LUKS header that can be read without a key
+type HeaderInfo struct {
+	Version   string        `json:"version"`
+	UUID      string        `json:"uuid"`
+	Label     string        `json:"label,omitempty"`
+	Subsystem string        `json:"subsystem,omitempty"`
+	Cipher    string        `json:"cipher,omitempty"`
+	Keyslots  []KeyslotInfo `json:"keyslots"`
+	Tokens    []TokenInfo   `json:"tokens"`
+}
+
+// KeyslotInfo describes an active keyslot
+type KeyslotInfo struct {
+	ID       int             `json:"id"`
+	Type     string          `json:"type,omitempty"`
+	KeyBits  int             `json:"key_bits,omitempty"`
+	Priority KeyslotPriority `json:"priority,omitempty"` // LUKS2 only
+}
+
+// TokenInfo is a LUKS2 token, with any fields besides its type and keyslots in Fields
+type TokenInfo struct {
+	ID       int                    `json:"id"`
+	Type     string                 `json:"type"`
+	Keyslots []int                  `json:"keyslots"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+// IsVault reports whether the token was written by a Vault integration, going by its type
+func (t TokenInfo) IsVault() bool {
+	return strings.Contains(strings.ToLower(t.Type), "vault")
+}
+
+// luks1KeySlots is the fixed number of keyslots in a LUKS1 header
+const luks1KeySlots = 8
+
+// InspectHeader reads the header of devicePath with luksDump, and for LUKS2 headers also
+// its JSON metadata, for the keyslots and tokens. Only the header is read: no key is needed
+// and nothing is opened or written.
+func (lm *LUKSManager) InspectHeader(devicePath string) (*HeaderInfo, error) {
+	lm.logger.WithField("device", devicePath).Debug("Inspecting LUKS header")
+
+	isLuks, err := lm.IsLUKSDevice(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	if !isLuks {
+		return nil, errors.NewLUKSFailure(devicePath, "inspect", fmt.Errorf("device is not LUKS-formatted"))
+	}
+
+	output, err := lm.executor.Execute("cryptsetup", "luksDump", devicePath)
+	if err != nil {
+		return nil, errors.NewLUKSFailure(devicePath, "luksDump", err)
+	}
+	info := parseLUKSDump(output)
+
+	header := &HeaderInfo{
+		Version:   info["Version"],
+		UUID:      info["UUID"],
+		Label:     headerField(info["Label"]),
+		Subsystem: headerField(info["Subsystem"]),
+		Tokens:    []TokenInfo{},
+	}
+
+	if header.Version == "1" {
+		header.Cipher = luks1Cipher(info)
+		header.Keyslots = luks1Keyslots(info)
+		return header, nil
+	}
+
+	metadata, err := lm.executor.Execute("cryptsetup", "luksDump", "--dump-json-metadata", devicePath)
+	if err != nil {
+		// --dump-json-metadata needs cryptsetup 2.4+; the text dump has no token details
+		lm.logger.WithError(err).WithField("device", devicePath).Debug("Failed to dump LUKS2 JSON metadata, using luksDump output")
+		header.Cipher = info["cipher"]
+		header.Keyslots = luks2TextKeyslots(output)
+		return header, nil
+	}
+
+	if err := parseLUKS2Metadata(metadata, header); err != nil {
+		return nil, errors.NewLUKSFailure(devicePath, "luksDump", err)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":   devicePath,
+		"keyslots": len(header.Keyslots),
+		"tokens":   len(header.Tokens),
+	}).Debug("Inspected LUKS header")
+
+	return header, nil
+}
+
+// headerField returns a luksDump value, or an empty string for placeholders such as "(no label)"
+func headerField(value string) string {
+	if strings.HasPrefix(value, "(no ") {
+		return ""
+	}
+	return value
+}
+
+// luks1Cipher joins the cipher name and mode of a LUKS1 header, e.g. aes-xts-plain64
+func luks1Cipher(info map[string]string) string {
+	if info["Cipher name"] == "" {
+		return ""
+	}
+	return info["Cipher name"] + "-" + info["Cipher mode"]
+}
+
+// luks1Keyslots lists the enabled keyslots of a LUKS1 header
+func luks1Keyslots(info map[string]string) []KeyslotInfo {
+	keyBits, _ := strconv.Atoi(info["MK bits"])
+
+	keyslots := []KeyslotInfo{}
+	for slot := 0; slot < luks1KeySlots; slot++ {
+		if info[fmt.Sprintf("Key Slot %d", slot)] == "ENABLED" {
+			keyslots = append(keyslots, KeyslotInfo{ID: slot, Type: "luks1", KeyBits: keyBits})
+		}
+	}
+	return keyslots
+}
+
+// luks2TextKeyslots lists the keyslots of LUKS2 luksDump output, with their priorities
+func luks2TextKeyslots(output string) []KeyslotInfo {
+	priorities := parseKeyslotPriorities(output)
+
+	keyslots := make([]KeyslotInfo, 0, len(priorities))
+	for slot, priority := range priorities {
+		keyslots = append(keyslots, KeyslotInfo{ID: slot, Type: "luks2", Priority: priority})
+	}
+	sort.Slice(keyslots, func(i, j int) bool { return keyslots[i].ID < keyslots[j].ID })
+	return keyslots
+}
+
+// luks2Metadata is the part of the LUKS2 JSON metadata that inspect reports
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type     string `json:"type"`
+		KeySize  int    `json:"key_size"` // Bytes
+		Priority *int   `json:"priority"` // 0 ignore, 1 normal (the default), 2 prefer
+	} `json:"keyslots"`
+	Tokens   map[string]map[string]interface{} `json:"tokens"`
+	Segments map[string]struct {
+		Encryption string `json:"encryption"`
+	} `json:"segments"`
+}
+
+// parseLUKS2Metadata fills the cipher, keyslots and tokens of header from the output of
+// luksDump --dump-json-metadata
+func parseLUKS2Metadata(output string, header *HeaderInfo) error {
+	var metadata luks2Metadata
+	if err := json.Unmarshal([]byte(output), &metadata); err != nil {
+		return fmt.Errorf("invalid LUKS2 JSON metadata: %w", err)
+	}
+
+	if segment, ok := metadata.Segments["0"]; ok {
+		header.Cipher = segment.Encryption
+	}
+
+	header.Keyslots = []KeyslotInfo{}
+	for id, keyslot := range metadata.Keyslots {
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid keyslot id %q in LUKS2 metadata", id)
+		}
+
+		priority := KeyslotPriorityNormal
+		if keyslot.Priority != nil {
+			switch *keyslot.Priority {
+			case 0:
+				priority = KeyslotPriorityIgnore
+			case 2:
+				priority = KeyslotPriorityPrefer
+			}
+		}
+
+		header.Keyslots = append(header.Keyslots, KeyslotInfo{
+			ID:       slot,
+			Type:     keyslot.Type,
+			KeyBits:  keyslot.KeySize * 8,
+			Priority: priority,
+		})
+	}
+	sort.Slice(header.Keyslots, func(i, j int) bool { return header.Keyslots[i].ID < header.Keyslots[j].ID })
+
+	header.Tokens = []TokenInfo{}
+	for id, fields := range metadata.Tokens {
+		tokenID, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid token id %q in LUKS2 metadata", id)
+		}
+
+		token := TokenInfo{ID: tokenID, Keyslots: []int{}, Fields: make(map[string]interface{})}
+		for name, value := range fields {
+			switch name {
+			case "type":
+				token.Type, _ = value.(string)
+			case "keyslots":
+				// Keyslots are listed as strings, e.g. ["0", "1"]
+				slots, _ := value.([]interface{})
+				for _, s := range slots {
+					if slot, err := strconv.Atoi(fmt.Sprint(s)); err == nil {
+						token.Keyslots = append(token.Keyslots, slot)
+					}
+				}
+			default:
+				token.Fields[name] = value
+			}
+		}
+		if len(token.Fields) == 0 {
+			token.Fields = nil
+		}
+
+		header.Tokens = append(header.Tokens, token)
+	}
+	sort.Slice(header.Tokens, func(i, j int) bool { return header.Tokens[i].ID < header.Tokens[j].ID })
+
+	return nil
+}
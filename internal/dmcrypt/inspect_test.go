@@ -0,0 +1,195 @@
+package dmcrypt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// luks2DumpFixture is cryptsetup 2.6 luksDump output for a LUKS2 device with two keyslots
+// and a Vault token
+const luks2DumpFixture = `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15
+Label:         	db-data
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: (whole device)
+	cipher: aes-xts-plain64
+	sector: 4096 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+	Priority:   prefer
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      argon2id
+  1: luks2
+	Key:        512 bits
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      argon2id
+Tokens:
+  0: vault-dm-crypt
+	Keyslot:    0
+Digests:
+  0: pbkdf2
+	Hash:       sha256
+`
+
+// luks2MetadataFixture is luksDump --dump-json-metadata output for the same device
+const luks2MetadataFixture = `{
+  "keyslots": {
+    "0": {"type": "luks2", "key_size": 64, "priority": 2, "area": {"type": "raw", "encryption": "aes-xts-plain64"}},
+    "1": {"type": "luks2", "key_size": 64, "area": {"type": "raw", "encryption": "aes-xts-plain64"}}
+  },
+  "tokens": {
+    "0": {"type": "vault-dm-crypt", "keyslots": ["0"], "vault_path": "vault-dm-crypt/node1/3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15", "vault_addr": "https://vault.example.com:8200"}
+  },
+  "segments": {
+    "0": {"type": "crypt", "offset": "16777216", "size": "dynamic", "iv_tweak": "0", "encryption": "aes-xts-plain64", "sector_size": 4096}
+  },
+  "digests": {
+    "0": {"type": "pbkdf2", "keyslots": ["0", "1"], "segments": ["0"], "hash": "sha256"}
+  },
+  "config": {"json_size": "12288", "keyslots_size": "16744448"}
+}`
+
+// luks1DumpFixture is luksDump output for a LUKS1 device with keyslots 0 and 3 in use
+const luks1DumpFixture = `LUKS header information for /dev/sdc1
+
+Version:       	1
+Cipher name:   	aes
+Cipher mode:   	cbc-essiv:sha256
+Hash spec:     	sha256
+Payload offset:	4096
+MK bits:       	256
+MK digest:     	8d 1e 5f 44 0a 9b 2c 71 e0 33 4f 58 a6 17 d2 c9 01 be 7a 4c
+UUID:          	0b5e7c2d-1a4f-4e8b-b3d6-92f0c1a8e4b7
+
+Key Slot 0: ENABLED
+	Iterations:         	1000000
+	Salt:               	3a 11 9c 04 5d e2 7f 80 b4 22 61 0e 9d 3c 47 a5
+	Key material offset:	8
+	AF stripes:            	4000
+Key Slot 1: DISABLED
+Key Slot 2: DISABLED
+Key Slot 3: ENABLED
+	Iterations:         	1000000
+Key Slot 4: DISABLED
+Key Slot 5: DISABLED
+Key Slot 6: DISABLED
+Key Slot 7: DISABLED
+`
+
+func TestLUKSManagerInspectHeader(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	newManager := func() (*LUKSManager, *MockCommandExecutor) {
+		luksManager := NewLUKSManager(logger)
+		mockExecutor := NewMockCommandExecutor()
+		luksManager.executor = mockExecutor
+		return luksManager, mockExecutor
+	}
+
+	t.Run("luks2 with a Vault token", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput("cryptsetup luksDump /dev/sdb1", luks2DumpFixture)
+		mockExecutor.SetOutput("cryptsetup luksDump --dump-json-metadata /dev/sdb1", luks2MetadataFixture)
+
+		header, err := luksManager.InspectHeader("/dev/sdb1")
+		require.NoError(t, err)
+
+		assert.Equal(t, "2", header.Version)
+		assert.Equal(t, "3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15", header.UUID)
+		assert.Equal(t, "db-data", header.Label)
+		assert.Empty(t, header.Subsystem)
+		assert.Equal(t, "aes-xts-plain64", header.Cipher)
+		assert.Equal(t, []KeyslotInfo{
+			{ID: 0, Type: "luks2", KeyBits: 512, Priority: KeyslotPriorityPrefer},
+			{ID: 1, Type: "luks2", KeyBits: 512, Priority: KeyslotPriorityNormal},
+		}, header.Keyslots)
+
+		require.Len(t, header.Tokens, 1)
+		token := header.Tokens[0]
+		assert.Equal(t, 0, token.ID)
+		assert.Equal(t, "vault-dm-crypt", token.Type)
+		assert.True(t, token.IsVault())
+		assert.Equal(t, []int{0}, token.Keyslots)
+		assert.Equal(t, map[string]interface{}{
+			"vault_path": "vault-dm-crypt/node1/3f9c2a10-5b7e-4d2a-9a61-0c8e2f4b7d15",
+			"vault_addr": "https://vault.example.com:8200",
+		}, token.Fields)
+
+		// Only the header is read
+		assert.Equal(t, []string{
+			"cryptsetup isLuks /dev/sdb1",
+			"cryptsetup luksDump /dev/sdb1",
+			"cryptsetup luksDump --dump-json-metadata /dev/sdb1",
+		}, mockExecutor.GetExecutedCommands())
+	})
+
+	t.Run("luks2 without json metadata support", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput("cryptsetup luksDump /dev/sdb1", luks2DumpFixture)
+		mockExecutor.SetError("cryptsetup luksDump --dump-json-metadata /dev/sdb1", errors.New("unknown option"))
+
+		header, err := luksManager.InspectHeader("/dev/sdb1")
+		require.NoError(t, err)
+		assert.Equal(t, "aes-xts-plain64", header.Cipher)
+		assert.Equal(t, []KeyslotInfo{
+			{ID: 0, Type: "luks2", Priority: KeyslotPriorityPrefer},
+			{ID: 1, Type: "luks2", Priority: KeyslotPriorityNormal},
+		}, header.Keyslots)
+		assert.Empty(t, header.Tokens)
+	})
+
+	t.Run("luks1", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput("cryptsetup luksDump /dev/sdc1", luks1DumpFixture)
+
+		header, err := luksManager.InspectHeader("/dev/sdc1")
+		require.NoError(t, err)
+		assert.Equal(t, "1", header.Version)
+		assert.Equal(t, "0b5e7c2d-1a4f-4e8b-b3d6-92f0c1a8e4b7", header.UUID)
+		assert.Equal(t, "aes-cbc-essiv:sha256", header.Cipher)
+		assert.Equal(t, []KeyslotInfo{
+			{ID: 0, Type: "luks1", KeyBits: 256},
+			{ID: 3, Type: "luks1", KeyBits: 256},
+		}, header.Keyslots)
+		assert.Empty(t, header.Tokens)
+
+		assert.NotContains(t, mockExecutor.GetExecutedCommands(), "cryptsetup luksDump --dump-json-metadata /dev/sdc1")
+	})
+
+	t.Run("not a luks device", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetError("cryptsetup isLuks /dev/sdd", errors.New("exit status 1"))
+
+		_, err := luksManager.InspectHeader("/dev/sdd")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not LUKS-formatted")
+	})
+
+	t.Run("corrupt json metadata", func(t *testing.T) {
+		luksManager, mockExecutor := newManager()
+		mockExecutor.SetOutput("cryptsetup luksDump /dev/sdb1", luks2DumpFixture)
+		mockExecutor.SetOutput("cryptsetup luksDump --dump-json-metadata /dev/sdb1", "{\"keyslots\": ")
+
+		_, err := luksManager.InspectHeader("/dev/sdb1")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid LUKS2 JSON metadata")
+	})
+}
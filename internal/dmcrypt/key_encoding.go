@@ -0,0 +1,75 @@
+package dmcrypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Encodings of key material. Keys are passed around as standard base64 internally; the other
+// encodings are only used for keys supplied by external providers and for stored keys.
+const (
+	KeyEncodingBase64 = "base64"
+	KeyEncodingHex    = "hex"
+	KeyEncodingRaw    = "raw" // The key bytes themselves; only for keys read from input
+)
+
+// DecodeKeyMaterial returns the bytes of key material in encoding. Surrounding whitespace is
+// ignored for the text encodings; raw material is used exactly as given.
+func DecodeKeyMaterial(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case KeyEncodingBase64, "":
+		keyBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("key is not valid base64: %w", err)
+		}
+		return keyBytes, nil
+	case KeyEncodingHex:
+		keyBytes, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("key is not valid hex: %w", err)
+		}
+		return keyBytes, nil
+	case KeyEncodingRaw:
+		return append([]byte(nil), data...), nil
+	default:
+		return nil, fmt.Errorf("unsupported key encoding %q", encoding)
+	}
+}
+
+// EncodeStoredKey re-encodes a base64 key for storage with encoding. Raw bytes cannot be held
+// in a Vault secret, which is JSON, so raw keys are stored as base64. It returns the stored key
+// and the encoding it was stored with.
+func EncodeStoredKey(key, encoding string) (string, string, error) {
+	switch encoding {
+	case KeyEncodingBase64, KeyEncodingRaw, "":
+		return key, KeyEncodingBase64, nil
+	case KeyEncodingHex:
+		keyBytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", "", fmt.Errorf("key is not valid base64: %w", err)
+		}
+		defer clear(keyBytes)
+		return hex.EncodeToString(keyBytes), KeyEncodingHex, nil
+	default:
+		return "", "", fmt.Errorf("unsupported key encoding %q", encoding)
+	}
+}
+
+// NormalizeStoredKey converts a key stored with encoding back to base64
+func NormalizeStoredKey(stored, encoding string) (string, error) {
+	switch encoding {
+	case KeyEncodingBase64, "":
+		return stored, nil
+	case KeyEncodingHex:
+		keyBytes, err := DecodeKeyMaterial([]byte(stored), KeyEncodingHex)
+		if err != nil {
+			return "", err
+		}
+		defer clear(keyBytes)
+		return base64.StdEncoding.EncodeToString(keyBytes), nil
+	default:
+		return "", fmt.Errorf("unsupported stored key encoding %q", encoding)
+	}
+}
@@ -0,0 +1,136 @@
+package dmcrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeKeyMaterial(t *testing.T) {
+	keyBytes := bytes.Repeat([]byte{0x00, 0x7f, 0xff, ' '}, 4)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding string
+		wantErr  string
+	}{
+		{name: "base64", data: []byte(base64.StdEncoding.EncodeToString(keyBytes) + "\n"), encoding: KeyEncodingBase64},
+		{name: "empty encoding is base64", data: []byte(base64.StdEncoding.EncodeToString(keyBytes)), encoding: ""},
+		{name: "hex", data: []byte(" " + hex.EncodeToString(keyBytes) + "\n"), encoding: KeyEncodingHex},
+		{name: "raw keeps whitespace bytes", data: keyBytes, encoding: KeyEncodingRaw},
+		{name: "invalid base64", data: []byte("not base64!"), encoding: KeyEncodingBase64, wantErr: "not valid base64"},
+		{name: "invalid hex", data: []byte("0xzz"), encoding: KeyEncodingHex, wantErr: "not valid hex"},
+		{name: "unknown encoding", data: keyBytes, encoding: "base32", wantErr: "unsupported key encoding"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeKeyMaterial(tt.data, tt.encoding)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, keyBytes, decoded)
+		})
+	}
+}
+
+func TestStoredKeyEncoding(t *testing.T) {
+	keyBytes := bytes.Repeat([]byte{0xab, 0x01}, 256)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	t.Run("hex round trip", func(t *testing.T) {
+		stored, encoding, err := EncodeStoredKey(key, KeyEncodingHex)
+		require.NoError(t, err)
+		assert.Equal(t, KeyEncodingHex, encoding)
+		assert.Equal(t, hex.EncodeToString(keyBytes), stored)
+
+		normalized, err := NormalizeStoredKey(stored, encoding)
+		require.NoError(t, err)
+		assert.Equal(t, key, normalized)
+	})
+
+	t.Run("base64 and raw are stored as base64", func(t *testing.T) {
+		for _, configured := range []string{KeyEncodingBase64, KeyEncodingRaw, ""} {
+			stored, encoding, err := EncodeStoredKey(key, configured)
+			require.NoError(t, err)
+			assert.Equal(t, KeyEncodingBase64, encoding)
+			assert.Equal(t, key, stored)
+		}
+	})
+
+	t.Run("keys stored without an encoding are base64", func(t *testing.T) {
+		normalized, err := NormalizeStoredKey(key, "")
+		require.NoError(t, err)
+		assert.Equal(t, key, normalized)
+	})
+
+	t.Run("invalid stored key", func(t *testing.T) {
+		_, err := NormalizeStoredKey("xyz", KeyEncodingHex)
+		assert.Error(t, err)
+
+		_, err = NormalizeStoredKey(key, KeyEncodingRaw)
+		assert.ErrorContains(t, err, "unsupported stored key encoding")
+	})
+}
+
+func TestManagerReadEncodedKey(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	manager := NewManager(logger)
+
+	keyBytes := bytes.Repeat([]byte{0x5a, 0xa5, 0x00, 0x0a}, 128)
+	expected := base64.StdEncoding.EncodeToString(keyBytes)
+
+	input := func(t *testing.T, data []byte) *os.File {
+		t.Helper()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+		go func() {
+			_, _ = w.Write(data)
+			_ = w.Close()
+		}()
+		return r
+	}
+
+	t.Run("each encoding yields the base64 key", func(t *testing.T) {
+		for encoding, data := range map[string][]byte{
+			KeyEncodingBase64: []byte(expected + "\n"),
+			KeyEncodingHex:    []byte(hex.EncodeToString(keyBytes) + "\n"),
+			KeyEncodingRaw:    keyBytes,
+		} {
+			key, err := manager.ReadEncodedKey(input(t, data), time.Second, encoding)
+			require.NoError(t, err, encoding)
+			assert.Equal(t, expected, key, encoding)
+		}
+	})
+
+	t.Run("wrong length", func(t *testing.T) {
+		for encoding, data := range map[string][]byte{
+			KeyEncodingBase64: []byte(base64.StdEncoding.EncodeToString(keyBytes[:256])),
+			KeyEncodingHex:    []byte(hex.EncodeToString(keyBytes[:511])),
+			KeyEncodingRaw:    append(keyBytes, 0x01),
+		} {
+			_, err := manager.ReadEncodedKey(input(t, data), time.Second, encoding)
+			require.Error(t, err, encoding)
+			assert.Contains(t, err.Error(), "expected 512 bytes", encoding)
+		}
+	})
+
+	t.Run("base64 given where hex is expected", func(t *testing.T) {
+		_, err := manager.ReadEncodedKey(input(t, []byte(expected)), time.Second, KeyEncodingHex)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not valid hex")
+	})
+}
@@ -0,0 +1,141 @@
+package dmcrypt
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultKeyFileMaxLifetime is how long a temporary key file may exist before the watchdog erases it
+const DefaultKeyFileMaxLifetime = 60 * time.Second
+
+// keyFileRegistry tracks temporary key files so a watchdog can erase any that outlive
+// their maximum lifetime, e.g. when a hung cryptsetup prevents normal cleanup
+type keyFileRegistry struct {
+	mu          sync.Mutex
+	files       map[string]time.Time
+	maxLifetime time.Duration
+	watching    bool
+	logger      *logrus.Logger
+}
+
+func newKeyFileRegistry(logger *logrus.Logger) *keyFileRegistry {
+	return &keyFileRegistry{
+		files:       make(map[string]time.Time),
+		maxLifetime: DefaultKeyFileMaxLifetime,
+		logger:      logger,
+	}
+}
+
+// setMaxLifetime changes the lifetime applied by the watchdog; zero restores the default
+func (r *keyFileRegistry) setMaxLifetime(lifetime time.Duration) {
+	if lifetime <= 0 {
+		lifetime = DefaultKeyFileMaxLifetime
+	}
+
+	r.mu.Lock()
+	r.maxLifetime = lifetime
+	r.mu.Unlock()
+}
+
+// register records a new key file and starts the watchdog if it is not running
+func (r *keyFileRegistry) register(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files[path] = time.Now()
+	if !r.watching {
+		r.watching = true
+		go r.watch()
+	}
+}
+
+// unregister forgets a key file that has been cleaned up normally
+func (r *keyFileRegistry) unregister(path string) {
+	r.mu.Lock()
+	delete(r.files, path)
+	r.mu.Unlock()
+}
+
+// watch periodically reaps expired key files, exiting once none are tracked
+func (r *keyFileRegistry) watch() {
+	for {
+		r.mu.Lock()
+		interval := min(r.maxLifetime/4, time.Second)
+		r.mu.Unlock()
+
+		time.Sleep(interval)
+
+		if remaining := r.reap(); remaining == 0 {
+			r.mu.Lock()
+			// Re-check under the lock so a concurrent register does not go unwatched
+			if len(r.files) == 0 {
+				r.watching = false
+				r.mu.Unlock()
+				return
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// reap erases key files older than the maximum lifetime and returns how many remain tracked
+func (r *keyFileRegistry) reap() int {
+	r.mu.Lock()
+	var expired []string
+	for path, created := range r.files {
+		if time.Since(created) > r.maxLifetime {
+			expired = append(expired, path)
+			delete(r.files, path)
+		}
+	}
+	remaining := len(r.files)
+	maxLifetime := r.maxLifetime
+	r.mu.Unlock()
+
+	for _, path := range expired {
+		r.logger.WithFields(logrus.Fields{
+			"key_file":     path,
+			"max_lifetime": maxLifetime,
+		}).Error("Temporary key file exceeded its maximum lifetime, force-erasing it")
+		eraseKeyFile(r.logger, path)
+	}
+
+	return remaining
+}
+
+// eraseKeyFile overwrites a key file with random data and removes it
+func eraseKeyFile(logger *logrus.Logger, keyFile string) {
+	// First, try to overwrite the file with random data
+	if file, err := os.OpenFile(keyFile, os.O_WRONLY, 0); err == nil {
+		// Get file size
+		if stat, err := file.Stat(); err == nil {
+			size := stat.Size()
+
+			// Overwrite with random data
+			if size > 0 {
+				randomData := make([]byte, size)
+				if _, err := io.ReadFull(rand.Reader, randomData); err == nil {
+					_, _ = file.WriteAt(randomData, 0)
+					_ = file.Sync()
+				}
+			}
+		}
+		_ = file.Close()
+	}
+
+	// Remove the file
+	if err := os.Remove(keyFile); err != nil {
+		if os.IsNotExist(err) {
+			logger.WithField("key_file", keyFile).Debug("Temporary key file already removed")
+			return
+		}
+		logger.WithError(err).WithField("key_file", keyFile).Warn("Failed to remove temporary key file")
+	} else {
+		logger.WithField("key_file", keyFile).Debug("Temporary key file removed")
+	}
+}
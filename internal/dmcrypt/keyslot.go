@@ -0,0 +1,192 @@
+package dmcrypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// UnknownKeySlot is returned by TestKey when the key unlocked the device but cryptsetup did
+// not report which keyslot matched
+const UnknownKeySlot = -1
+
+// keySlotUnlockedPattern matches cryptsetup's verbose "Key slot 0 unlocked." message
+var keySlotUnlockedPattern = regexp.MustCompile(`Key slot (\d+) unlocked`)
+
+// TestKey checks that key unlocks a keyslot of a LUKS device without creating a mapping and
+// returns the slot that matched. Older cryptsetup releases do not support --test-passphrase
+// for LUKS1, in which case the device is briefly opened read-only and closed again.
+func (lm *LUKSManager) TestKey(devicePath, key string) (int, error) {
+	lm.logger.WithField("device", devicePath).Debug("Testing key against LUKS keyslots")
+
+	if err := lm.ValidateDevice(devicePath); err != nil {
+		return UnknownKeySlot, err
+	}
+
+	if err := lm.ValidateKeyFormat(key); err != nil {
+		return UnknownKeySlot, errors.NewLUKSFailure(devicePath, "test-key", err)
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return UnknownKeySlot, errors.NewLUKSFailure(devicePath, "test-key", fmt.Errorf("failed to decode key: %w", err))
+	}
+
+	keyFile, err := lm.createTemporaryKeyFile(keyBytes)
+	if err != nil {
+		return UnknownKeySlot, errors.NewLUKSFailure(devicePath, "test-key", err)
+	}
+	defer lm.cleanupKeyFile(keyFile)
+
+	output, err := lm.runCryptsetup(lm.operationTimeout, "open", "--test-passphrase", "--verbose", "--key-file", keyFile, devicePath)
+	if err != nil && isUnsupportedOption(err) {
+		lm.logger.WithField("device", devicePath).Debug("cryptsetup does not support --test-passphrase, testing key with a temporary mapping")
+		output, err = lm.testKeyWithMapping(devicePath, keyFile)
+	}
+	if err != nil {
+		return UnknownKeySlot, errors.NewLUKSFailure(devicePath, "test-key", fmt.Errorf("key does not unlock any keyslot: %w", err))
+	}
+
+	slot := parseUnlockedKeySlot(output)
+	lm.logger.WithFields(logrus.Fields{
+		"device":   devicePath,
+		"key_slot": slot,
+	}).Debug("Key unlocks device")
+
+	return slot, nil
+}
+
+// testKeyWithMapping opens the device read-only under a temporary name and closes it again,
+// returning the verbose output of the open
+func (lm *LUKSManager) testKeyWithMapping(devicePath, keyFile string) (string, error) {
+	deviceName := fmt.Sprintf("vault-dm-crypt-test-%d", os.Getpid())
+
+	output, err := lm.runCryptsetup(lm.operationTimeout, "luksOpen", "--readonly", "--verbose", "--key-file", keyFile, devicePath, deviceName)
+	if err != nil {
+		return output, err
+	}
+
+	if _, err := lm.runCryptsetup(lm.operationTimeout, "luksClose", deviceName); err != nil {
+		return output, fmt.Errorf("key unlocked the device but the temporary mapping %s could not be closed: %w", deviceName, err)
+	}
+
+	return output, nil
+}
+
+// isUnsupportedOption reports whether cryptsetup rejected a command line option it does not know
+func isUnsupportedOption(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "unknown option") || strings.Contains(message, "unrecognized option")
+}
+
+// parseUnlockedKeySlot returns the keyslot reported in verbose cryptsetup output, or
+// UnknownKeySlot if none is reported
+func parseUnlockedKeySlot(output string) int {
+	match := keySlotUnlockedPattern.FindStringSubmatch(output)
+	if match == nil {
+		return UnknownKeySlot
+	}
+
+	slot, err := strconv.Atoi(match[1])
+	if err != nil {
+		return UnknownKeySlot
+	}
+	return slot
+}
+
+// KeyslotPriority is the LUKS2 priority of a keyslot: cryptsetup tries prefer slots before
+// normal ones, and only uses ignore slots when the slot is given explicitly
+type KeyslotPriority string
+
+// Keyslot priorities accepted by cryptsetup config --priority
+const (
+	KeyslotPriorityPrefer KeyslotPriority = "prefer"
+	KeyslotPriorityNormal KeyslotPriority = "normal"
+	KeyslotPriorityIgnore KeyslotPriority = "ignore"
+)
+
+// keyslotHeaderPattern matches the start of a keyslot in LUKS2 luksDump output, e.g. "  0: luks2"
+var keyslotHeaderPattern = regexp.MustCompile(`^\s+(\d+): luks2`)
+
+// SetKeyslotPriority sets the priority of a keyslot in the LUKS2 header of devicePath.
+// LUKS1 headers have no keyslot priorities.
+func (lm *LUKSManager) SetKeyslotPriority(devicePath string, slot int, priority KeyslotPriority) error {
+	switch priority {
+	case KeyslotPriorityPrefer, KeyslotPriorityNormal, KeyslotPriorityIgnore:
+	default:
+		return errors.NewLUKSFailure(devicePath, "config", fmt.Errorf("invalid keyslot priority %q (must be prefer, normal or ignore)", priority))
+	}
+	if slot < 0 {
+		return errors.NewLUKSFailure(devicePath, "config", fmt.Errorf("invalid keyslot %d", slot))
+	}
+
+	if err := lm.ValidateDevice(devicePath); err != nil {
+		return err
+	}
+
+	if version := lm.headerVersion(devicePath); version != "2" {
+		return errors.NewLUKSFailure(devicePath, "config", fmt.Errorf("keyslot priorities require a LUKS2 header (header version: %s)", version))
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":   devicePath,
+		"key_slot": slot,
+		"priority": priority,
+	}).Info("Setting keyslot priority")
+
+	if _, err := lm.runCryptsetup(lm.operationTimeout, "config", "--key-slot", strconv.Itoa(slot), "--priority", string(priority), devicePath); err != nil {
+		return errors.NewLUKSFailure(devicePath, "config", fmt.Errorf("failed to set priority of keyslot %d: %w", slot, err))
+	}
+
+	return nil
+}
+
+// KeyslotPriorities returns the priority of every active keyslot of a LUKS2 device.
+// luksDump only prints a priority for slots that are not normal.
+func (lm *LUKSManager) KeyslotPriorities(devicePath string) (map[int]KeyslotPriority, error) {
+	output, err := lm.executor.Execute("cryptsetup", "luksDump", devicePath)
+	if err != nil {
+		return nil, errors.NewLUKSFailure(devicePath, "info", fmt.Errorf("failed to read keyslots: %w", err))
+	}
+
+	return parseKeyslotPriorities(output), nil
+}
+
+// parseKeyslotPriorities reads keyslot priorities from the Keyslots section of LUKS2 luksDump output
+func parseKeyslotPriorities(output string) map[int]KeyslotPriority {
+	priorities := make(map[int]KeyslotPriority)
+	inKeyslots := false
+	current := -1
+
+	for _, line := range strings.Split(output, "\n") {
+		// Sections start at the beginning of a line, e.g. "Keyslots:" and "Tokens:"
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			inKeyslots = strings.HasPrefix(line, "Keyslots:")
+			current = -1
+			continue
+		}
+		if !inKeyslots {
+			continue
+		}
+
+		if match := keyslotHeaderPattern.FindStringSubmatch(line); match != nil {
+			current, _ = strconv.Atoi(match[1])
+			priorities[current] = KeyslotPriorityNormal
+			continue
+		}
+
+		field := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if current >= 0 && len(field) == 2 && field[0] == "Priority" {
+			priorities[current] = KeyslotPriority(strings.TrimSpace(field[1]))
+		}
+	}
+
+	return priorities
+}
@@ -0,0 +1,88 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// IsRegularFile reports whether path is a regular file, such as a disk image, rather than a
+// block device. Symlinks are followed.
+func IsRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// SetupLoopDevice attaches file to the first free loop device and returns the loop device's path
+func (lm *LUKSManager) SetupLoopDevice(file string) (string, error) {
+	lm.logger.WithField("file", file).Info("Attaching file to a loop device")
+
+	output, err := lm.executor.Execute("losetup", "-f", "--show", file)
+	if err != nil {
+		return "", errors.NewLUKSFailure(file, "losetup", err)
+	}
+
+	loopDevice := strings.TrimSpace(output)
+	if !strings.HasPrefix(loopDevice, "/dev/loop") {
+		return "", errors.NewLUKSFailure(file, "losetup", fmt.Errorf("unexpected losetup output %q", loopDevice))
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"file":        file,
+		"loop_device": loopDevice,
+	}).Info("File attached to loop device")
+	return loopDevice, nil
+}
+
+// FindLoopDevices returns the loop devices file is attached to
+func (lm *LUKSManager) FindLoopDevices(file string) ([]string, error) {
+	output, err := lm.executor.Execute("losetup", "-j", file)
+	if err != nil {
+		return nil, errors.NewLUKSFailure(file, "losetup", err)
+	}
+
+	// Lines look like "/dev/loop0: [2049]:131 (/var/lib/images/data.img)"
+	loopDevices := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		loopDevice, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && strings.HasPrefix(loopDevice, "/dev/loop") {
+			loopDevices = append(loopDevices, loopDevice)
+		}
+	}
+	return loopDevices, nil
+}
+
+// EnsureLoopDevice returns the loop device file is attached to, attaching it first if it is not
+func (lm *LUKSManager) EnsureLoopDevice(file string) (string, error) {
+	if !IsRegularFile(file) {
+		return "", errors.NewLUKSFailure(file, "losetup", fmt.Errorf("backing file does not exist or is not a regular file"))
+	}
+
+	loopDevices, err := lm.FindLoopDevices(file)
+	if err != nil {
+		return "", err
+	}
+	if len(loopDevices) > 0 {
+		lm.logger.WithFields(logrus.Fields{
+			"file":        file,
+			"loop_device": loopDevices[0],
+		}).Debug("File is already attached to a loop device")
+		return loopDevices[0], nil
+	}
+
+	return lm.SetupLoopDevice(file)
+}
+
+// DetachLoopDevice detaches a loop device from its backing file
+func (lm *LUKSManager) DetachLoopDevice(loopDevice string) error {
+	lm.logger.WithField("loop_device", loopDevice).Info("Detaching loop device")
+
+	if _, err := lm.executor.Execute("losetup", "-d", loopDevice); err != nil {
+		return errors.NewLUKSFailure(loopDevice, "losetup", err)
+	}
+	return nil
+}
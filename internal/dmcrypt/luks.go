@@ -1,38 +1,206 @@
 package dmcrypt
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/tracing"
 )
 
 // LUKSManager handles LUKS-specific operations
 type LUKSManager struct {
 	*Manager
-	executor CommandExecutor
+	executor         CommandExecutor
+	operationTimeout time.Duration
+	keyFiles         *keyFileRegistry
+
+	// mapperWaitTimeout bounds the wait for udev to create /dev/mapper nodes after luksOpen
+	mapperWaitTimeout time.Duration
+	statPath          func(path string) (os.FileInfo, error)
+
+	// readMapping performs the read test of CheckMapping
+	readMapping func(path string) error
+
+	// heartbeatInterval is how often long-running commands such as mkfs log progress
+	heartbeatInterval time.Duration
+
+	// openPriority is applied to luksOpen, whose PBKDF can pin every CPU at boot
+	openPriority ProcessPriority
+
+	// wipeChunkSize is how much WipeMapping writes between progress reports
+	wipeChunkSize int64
+
+	// byIDDir is searched by StablePath for persistent links to a device
+	byIDDir string
+
+	// mountsPath, the sysfs directories and deviceNumber are used by SystemDevices to find the
+	// devices backing the system's mount points
+	mountsPath     string
+	sysBlockDir    string
+	sysDevBlockDir string
+	sysBtrfsDir    string
+	deviceNumber   func(path string) (uint64, error)
+
+	// busyRetries and busyRetryDelay control retries of luksOpen and luksClose on a busy device
+	busyRetries    int
+	busyRetryDelay time.Duration
 }
 
+// DefaultOperationTimeout bounds a single cryptsetup format/open/close. It is generous
+// enough for luksFormat with a high iter-time on slow hardware.
+const DefaultOperationTimeout = 300 * time.Second
+
+// DefaultMapperWaitTimeout is how long to wait for a mapped device node to appear after luksOpen
+const DefaultMapperWaitTimeout = 5 * time.Second
+
+// mapperPollInterval is how often the mapped device node is checked while waiting
+const mapperPollInterval = 100 * time.Millisecond
+
 // NewLUKSManager creates a new LUKS manager
 func NewLUKSManager(logger *logrus.Logger) *LUKSManager {
 	manager := NewManager(logger)
 	return &LUKSManager{
-		Manager:  manager,
-		executor: NewCommandExecutor(logger),
+		Manager:          manager,
+		executor:         NewCommandExecutor(logger),
+		operationTimeout: DefaultOperationTimeout,
+		keyFiles:         newKeyFileRegistry(manager.logger),
+
+		mapperWaitTimeout: DefaultMapperWaitTimeout,
+		statPath:          os.Stat,
+		readMapping:       readFirstBlock,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		wipeChunkSize:     DefaultWipeChunkSize,
+		byIDDir:           DiskByIDDir,
+		mountsPath:        MountsPath,
+		sysBlockDir:       SysBlockDir,
+		sysDevBlockDir:    SysDevBlockDir,
+		sysBtrfsDir:       SysBtrfsDir,
+		deviceNumber:      statDeviceNumber,
+		busyRetries:       DefaultBusyRetries,
+		busyRetryDelay:    DefaultBusyRetryDelay,
+	}
+}
+
+// SetMapperWaitTimeout sets how long OpenDevice waits for the mapped device node; zero restores the default
+func (lm *LUKSManager) SetMapperWaitTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultMapperWaitTimeout
+	}
+	lm.mapperWaitTimeout = timeout
+}
+
+// SetKeyFileMaxLifetime sets how long a temporary key file may exist before it is force-erased; zero restores the default
+func (lm *LUKSManager) SetKeyFileMaxLifetime(lifetime time.Duration) {
+	lm.keyFiles.setMaxLifetime(lifetime)
+}
+
+// SetOperationTimeout sets the maximum runtime of a cryptsetup operation; zero restores the default
+func (lm *LUKSManager) SetOperationTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultOperationTimeout
+	}
+	lm.operationTimeout = timeout
+}
+
+// SetOpenPriority sets the CPU and I/O priority luksOpen runs under; the zero value runs it unchanged
+func (lm *LUKSManager) SetOpenPriority(priority ProcessPriority) {
+	lm.openPriority = priority
+}
+
+// runCryptsetup runs cryptsetup with the given timeout, killing it and returning a clear
+// error if it does not complete in time
+func (lm *LUKSManager) runCryptsetup(timeout time.Duration, args ...string) (string, error) {
+	return lm.runCryptsetupWithPriority(ProcessPriority{}, timeout, args...)
+}
+
+// runCryptsetupWithPriority is runCryptsetup with cryptsetup run under priority
+func (lm *LUKSManager) runCryptsetupWithPriority(priority ProcessPriority, timeout time.Duration, args ...string) (_ string, err error) {
+	if timeout <= 0 {
+		timeout = DefaultOperationTimeout
+	}
+
+	// Only the action is recorded: the arguments include key file paths
+	spanCtx, span := tracing.Start(tracing.CommandContext(), "cryptsetup "+args[0], attribute.String("cryptsetup.action", args[0]))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(spanCtx, timeout)
+	defer cancel()
+
+	command, commandArgs := priority.wrap("cryptsetup", args...)
+	output, err := lm.executor.ExecuteWithContext(ctx, command, commandArgs...)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("cryptsetup %s did not complete within %s and was killed (see [dmcrypt] operation_timeout)", args[0], timeout)
+	}
+
+	return output, err
+}
+
+// FormatOptions holds optional luksFormat parameters
+type FormatOptions struct {
+	// Integrity enables LUKS2 authenticated encryption (dm-integrity), e.g. "hmac-sha256"
+	Integrity string
+
+	// PBKDFParallel caps the argon2 threads of the keyslot. LUKS2 stores this in the keyslot,
+	// so it bounds the CPUs every later luksOpen uses. Zero leaves the cryptsetup default.
+	PBKDFParallel int
+
+	// Offset is the start of the encrypted data in 512-byte sectors (luksFormat --offset), for
+	// layouts that must keep data at a fixed position. Zero leaves the cryptsetup default.
+	Offset uint64
+
+	// Label and Subsystem are free-form LUKS2 header fields (luksFormat --label and --subsystem),
+	// shown by blkid and lsblk
+	Label     string
+	Subsystem string
+}
+
+// offsetSectorSize is the unit of luksFormat --offset
+const offsetSectorSize = 512
+
+// MaxLabelLength is the longest LUKS2 label or subsystem; the header field holds 48 bytes
+// including the terminating NUL
+const MaxLabelLength = 47
+
+// ValidateLabels checks that Label and Subsystem fit in the LUKS2 header
+func (o FormatOptions) ValidateLabels() error {
+	for _, field := range []struct{ name, value string }{
+		{"label", o.Label},
+		{"subsystem", o.Subsystem},
+	} {
+		if len(field.value) > MaxLabelLength {
+			return fmt.Errorf("LUKS2 %s %q is %d bytes, the limit is %d", field.name, field.value, len(field.value), MaxLabelLength)
+		}
+		for _, r := range field.value {
+			if r < 0x20 || r == 0x7f {
+				return fmt.Errorf("LUKS2 %s %q contains a control character", field.name, field.value)
+			}
+		}
 	}
+	return nil
 }
 
 // FormatDevice formats a device with LUKS encryption using the provided key and UUID
 func (lm *LUKSManager) FormatDevice(devicePath, key, uuid string) error {
+	return lm.FormatDeviceWithOptions(devicePath, key, uuid, FormatOptions{})
+}
+
+// FormatDeviceWithOptions formats a device with LUKS encryption using the provided key, UUID and options
+func (lm *LUKSManager) FormatDeviceWithOptions(devicePath, key, uuid string, opts FormatOptions) error {
 	lm.logger.WithFields(logrus.Fields{
-		"device": devicePath,
-		"uuid":   uuid,
+		"device":    devicePath,
+		"uuid":      uuid,
+		"integrity": opts.Integrity,
 	}).Info("Formatting device with LUKS")
 
 	// Validate inputs
@@ -54,6 +222,16 @@ func (lm *LUKSManager) FormatDevice(devicePath, key, uuid string) error {
 		return errors.NewLUKSFailure(devicePath, "format", fmt.Errorf("device is currently mounted"))
 	}
 
+	if err := opts.ValidateLabels(); err != nil {
+		return errors.NewLUKSFailure(devicePath, "format", err)
+	}
+
+	if opts.Offset > 0 {
+		if err := lm.checkDataOffset(devicePath, opts.Offset); err != nil {
+			return errors.NewLUKSFailure(devicePath, "format", err)
+		}
+	}
+
 	// Decode the key
 	keyBytes, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
@@ -68,6 +246,36 @@ func (lm *LUKSManager) FormatDevice(devicePath, key, uuid string) error {
 	defer lm.cleanupKeyFile(keyFile)
 
 	// Prepare cryptsetup command
+	args := buildFormatArgs(devicePath, uuid, keyFile, opts)
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":    devicePath,
+		"uuid":      uuid,
+		"cipher":    "aes-xts-plain64",
+		"integrity": opts.Integrity,
+	}).Debug("Executing cryptsetup luksFormat")
+
+	// Execute cryptsetup
+	_, err = lm.runCryptsetup(lm.operationTimeout, args...)
+	if err != nil {
+		return errors.NewLUKSFailure(devicePath, "format", fmt.Errorf("cryptsetup failed: %w", err))
+	}
+
+	// Confirm the header carries the UUID the Vault secret is stored under
+	if err := lm.verifyFormattedUUID(devicePath, uuid); err != nil {
+		return err
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device": devicePath,
+		"uuid":   uuid,
+	}).Info("Device successfully formatted with LUKS")
+
+	return nil
+}
+
+// buildFormatArgs constructs the cryptsetup luksFormat arguments
+func buildFormatArgs(devicePath, uuid, keyFile string, opts FormatOptions) []string {
 	args := []string{
 		"luksFormat",
 		"--type", "luks2", // Use LUKS2 format
@@ -75,37 +283,231 @@ func (lm *LUKSManager) FormatDevice(devicePath, key, uuid string) error {
 		"--key-size", "512", // 512-bit key
 		"--hash", "sha256",
 		"--iter-time", "2000", // 2 seconds iteration time
+	}
+
+	// cryptsetup's own integrity wipe cannot be resumed; the mapping is wiped with WipeMapping
+	// after it is opened instead, unless integrity_no_wipe skips it
+	if opts.Integrity != "" {
+		args = append(args, "--integrity", opts.Integrity, "--integrity-no-wipe")
+	}
+
+	if opts.PBKDFParallel > 0 {
+		args = append(args, "--pbkdf-parallel", strconv.Itoa(opts.PBKDFParallel))
+	}
+
+	if opts.Offset > 0 {
+		args = append(args, "--offset", strconv.FormatUint(opts.Offset, 10))
+	}
+
+	if opts.Label != "" {
+		args = append(args, "--label", opts.Label)
+	}
+
+	if opts.Subsystem != "" {
+		args = append(args, "--subsystem", opts.Subsystem)
+	}
+
+	args = append(args,
 		"--uuid", uuid,
 		"--key-file", keyFile,
 		"--batch-mode", // Don't ask for confirmation
 		devicePath,
+	)
+
+	return args
+}
+
+// checkDataOffset checks that a data offset in 512-byte sectors falls on a logical sector
+// boundary of the device, which cryptsetup would otherwise reject or misalign on 4K drives
+func (lm *LUKSManager) checkDataOffset(devicePath string, offset uint64) error {
+	output, err := lm.executor.Execute("blockdev", "--getss", devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to read logical sector size: %w", err)
 	}
 
-	lm.logger.WithFields(logrus.Fields{
-		"device": devicePath,
-		"uuid":   uuid,
-		"cipher": "aes-xts-plain64",
-	}).Debug("Executing cryptsetup luksFormat")
+	sectorSize, err := strconv.ParseUint(strings.TrimSpace(output), 10, 64)
+	if err != nil || sectorSize == 0 {
+		return fmt.Errorf("unexpected logical sector size %q", strings.TrimSpace(output))
+	}
 
-	// Execute cryptsetup
-	output, err := lm.executor.Execute("cryptsetup", args...)
+	if (offset*offsetSectorSize)%sectorSize != 0 {
+		return fmt.Errorf("offset of %d sectors (%d bytes) is not a multiple of the device's %d-byte logical sector size",
+			offset, offset*offsetSectorSize, sectorSize)
+	}
+	return nil
+}
+
+// GetLUKSUUID reads the UUID from a device's LUKS header
+func (lm *LUKSManager) GetLUKSUUID(devicePath string) (string, error) {
+	output, err := lm.executor.Execute("cryptsetup", "luksUUID", devicePath)
+	if err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "get-uuid", err)
+	}
+
+	uuid := strings.TrimSpace(output)
+	if uuid == "" {
+		return "", errors.NewLUKSFailure(devicePath, "get-uuid", fmt.Errorf("no UUID found in LUKS header"))
+	}
+
+	return uuid, nil
+}
+
+// verifyFormattedUUID checks that the freshly written LUKS header has the requested UUID
+func (lm *LUKSManager) verifyFormattedUUID(devicePath, uuid string) error {
+	actual, err := lm.GetLUKSUUID(devicePath)
 	if err != nil {
-		return errors.NewLUKSFailure(devicePath, "format", fmt.Errorf("cryptsetup failed: %w (output: %s)", err, output))
+		return errors.NewLUKSFailure(devicePath, "format", fmt.Errorf("failed to verify UUID after format: %w", err))
+	}
+
+	if !strings.EqualFold(actual, uuid) {
+		return errors.NewLUKSFailure(devicePath, "format", fmt.Errorf("LUKS header UUID %s does not match requested UUID %s", actual, uuid))
 	}
 
 	lm.logger.WithFields(logrus.Fields{
 		"device": devicePath,
-		"uuid":   uuid,
-	}).Info("Device successfully formatted with LUKS")
+		"uuid":   actual,
+	}).Debug("Verified LUKS header UUID after format")
 
 	return nil
 }
 
+// GetIntegrityStatus reports the integrity algorithm of an active mapping, or an empty string if none
+func (lm *LUKSManager) GetIntegrityStatus(deviceName string) (string, error) {
+	output, err := lm.executor.Execute("cryptsetup", "status", deviceName)
+	if err != nil {
+		return "", errors.NewLUKSFailure(lm.GetMappedDevicePath(deviceName), "status", err)
+	}
+
+	return parseStatusField(output, "integrity"), nil
+}
+
+// GetActivationFlags returns the activation flags of an active mapping as cryptsetup status
+// reports them, e.g. discards or no_read_workqueue
+func (lm *LUKSManager) GetActivationFlags(deviceName string) ([]string, error) {
+	output, err := lm.executor.Execute("cryptsetup", "status", deviceName)
+	if err != nil {
+		return nil, errors.NewLUKSFailure(lm.GetMappedDevicePath(deviceName), "status", err)
+	}
+
+	return strings.Fields(parseStatusField(output, "flags")), nil
+}
+
+// GetMappingDevice returns the underlying device of an active mapping
+func (lm *LUKSManager) GetMappingDevice(deviceName string) (string, error) {
+	output, err := lm.executor.Execute("cryptsetup", "status", deviceName)
+	if err != nil {
+		return "", errors.NewLUKSFailure(lm.GetMappedDevicePath(deviceName), "status", err)
+	}
+
+	device := parseStatusField(output, "device")
+	if device == "" {
+		return "", errors.NewLUKSFailure(lm.GetMappedDevicePath(deviceName), "status", fmt.Errorf("underlying device not found in status of %s", deviceName))
+	}
+	return device, nil
+}
+
+// FindMappingsForDevice returns the names of active dm-crypt mappings backed by devicePath
+func (lm *LUKSManager) FindMappingsForDevice(devicePath string) ([]string, error) {
+	lm.logger.WithField("device", devicePath).Debug("Looking for active mappings of device")
+
+	output, err := lm.executor.Execute("dmsetup", "ls", "--target", "crypt")
+	if err != nil {
+		return nil, errors.NewLUKSFailure(devicePath, "find-mappings", err)
+	}
+
+	target := ResolveDevicePath(devicePath)
+	mappings := make([]string, 0)
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// Lines look like "name\t(253:0)"; "No devices found" has no major:minor field
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "(") {
+			continue
+		}
+		name := fields[0]
+
+		status, err := lm.executor.Execute("cryptsetup", "status", name)
+		if err != nil {
+			lm.logger.WithError(err).WithField("device_name", name).Debug("Failed to get mapping status, skipping")
+			continue
+		}
+
+		backing := parseStatusField(status, "device")
+		if backing != "" && ResolveDevicePath(backing) == target {
+			mappings = append(mappings, name)
+		}
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":   devicePath,
+		"mappings": mappings,
+	}).Debug("Found active mappings for device")
+
+	return mappings, nil
+}
+
+// parseStatusField returns the value of a "key: value" line from cryptsetup status output
+func parseStatusField(output, field string) string {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && strings.TrimSpace(key) == field {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// ResolveDevicePath follows symlinks such as /dev/disk/by-uuid/... so paths can be compared
+func ResolveDevicePath(devicePath string) string {
+	if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+		return resolved
+	}
+	return devicePath
+}
+
+// OpenOptions holds optional luksOpen parameters
+type OpenOptions struct {
+	// NoReadWorkqueue bypasses dm-crypt's read workqueue (cryptsetup 2.4+)
+	NoReadWorkqueue bool
+	// NoWriteWorkqueue bypasses dm-crypt's write workqueue (cryptsetup 2.4+)
+	NoWriteWorkqueue bool
+	// KeyDescription names a kernel keyring key holding the passphrase; when set cryptsetup is
+	// asked to read it from the keyring, falling back to a key file if that fails
+	KeyDescription string
+	// Persistent records the activation flags in the LUKS2 header, so that opens which do not
+	// pass them (such as boot-time decrypt) still use them. Ignored for LUKS1 headers.
+	Persistent bool
+}
+
+// ActivationFlags returns the flags cryptsetup status reports for a mapping opened with these options
+func (o OpenOptions) ActivationFlags() []string {
+	var flags []string
+	if o.NoReadWorkqueue {
+		flags = append(flags, "no_read_workqueue")
+	}
+	if o.NoWriteWorkqueue {
+		flags = append(flags, "no_write_workqueue")
+	}
+	return flags
+}
+
+// RequiresPerfFlags reports whether the options need cryptsetup 2.4+ performance flags
+func (o OpenOptions) RequiresPerfFlags() bool {
+	return o.NoReadWorkqueue || o.NoWriteWorkqueue
+}
+
 // OpenDevice opens a LUKS-encrypted device using the provided key
 func (lm *LUKSManager) OpenDevice(devicePath, key, deviceName string) error {
+	return lm.OpenDeviceWithOptions(devicePath, key, deviceName, OpenOptions{})
+}
+
+// OpenDeviceWithOptions opens a LUKS-encrypted device using the provided key and options
+func (lm *LUKSManager) OpenDeviceWithOptions(devicePath, key, deviceName string, opts OpenOptions) error {
 	lm.logger.WithFields(logrus.Fields{
-		"device":      devicePath,
-		"device_name": deviceName,
+		"device":             devicePath,
+		"device_name":        deviceName,
+		"no_read_workqueue":  opts.NoReadWorkqueue,
+		"no_write_workqueue": opts.NoWriteWorkqueue,
 	}).Info("Opening LUKS device")
 
 	// Validate inputs
@@ -124,12 +526,71 @@ func (lm *LUKSManager) OpenDevice(devicePath, key, deviceName string) error {
 		return nil
 	}
 
+	// Only LUKS2 headers can store activation flags
+	if opts.Persistent && opts.RequiresPerfFlags() {
+		if version := lm.headerVersion(devicePath); version != "2" {
+			lm.logger.WithFields(logrus.Fields{
+				"device":      devicePath,
+				"luks_header": version,
+			}).Warn("Activation flags can only be persisted in a LUKS2 header, applying them to this open only")
+			opts.Persistent = false
+		}
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":        devicePath,
+		"device_name":   deviceName,
+		"mapped_device": mappedPath,
+	}).Debug("Executing cryptsetup luksOpen")
+
+	opened := false
+	if opts.KeyDescription != "" {
+		// The key never touches the filesystem when cryptsetup can read it from the keyring
+		output, err := lm.runCryptsetupBusyRetry(lm.openPriority, buildOpenArgs(devicePath, deviceName, "", opts)...)
+		if err == nil {
+			opened = true
+		} else {
+			lm.logger.WithError(err).WithFields(logrus.Fields{
+				"key_description": opts.KeyDescription,
+				"output":          output,
+			}).Warn("Opening with keyring key failed, falling back to a key file")
+		}
+	}
+
+	if !opened {
+		opts.KeyDescription = ""
+		if err := lm.openWithKeyFile(devicePath, key, deviceName, opts); err != nil {
+			return err
+		}
+	}
+
+	// Verify the mapped device was created, allowing udev time to create the node
+	if err := lm.waitForMappedDevice(mappedPath); err != nil {
+		return errors.NewLUKSFailure(devicePath, "open", err)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":        devicePath,
+		"device_name":   deviceName,
+		"mapped_device": mappedPath,
+	}).Info("LUKS device opened successfully")
+
+	return nil
+}
+
+// openWithKeyFile runs luksOpen with the key passed through a temporary key file
+func (lm *LUKSManager) openWithKeyFile(devicePath, key, deviceName string, opts OpenOptions) error {
 	// Decode the key
 	keyBytes, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
 		return errors.NewLUKSFailure(devicePath, "open", fmt.Errorf("failed to decode key: %w", err))
 	}
 
+	return lm.openWithKeyBytes(devicePath, keyBytes, deviceName, opts)
+}
+
+// openWithKeyBytes runs luksOpen with keyBytes, used as they are, passed through a temporary key file
+func (lm *LUKSManager) openWithKeyBytes(devicePath string, keyBytes []byte, deviceName string, opts OpenOptions) error {
 	// Create a temporary file for the key
 	keyFile, err := lm.createTemporaryKeyFile(keyBytes)
 	if err != nil {
@@ -137,38 +598,72 @@ func (lm *LUKSManager) OpenDevice(devicePath, key, deviceName string) error {
 	}
 	defer lm.cleanupKeyFile(keyFile)
 
-	// Prepare cryptsetup command
-	args := []string{
-		"luksOpen",
-		"--key-file", keyFile,
-		devicePath,
-		deviceName,
+	// Execute cryptsetup
+	_, err = lm.runCryptsetupBusyRetry(lm.openPriority, buildOpenArgs(devicePath, deviceName, keyFile, opts)...)
+	if err != nil {
+		return errors.NewLUKSFailure(devicePath, "open", fmt.Errorf("cryptsetup failed: %w", err))
 	}
 
-	lm.logger.WithFields(logrus.Fields{
-		"device":        devicePath,
-		"device_name":   deviceName,
-		"mapped_device": mappedPath,
-	}).Debug("Executing cryptsetup luksOpen")
+	return nil
+}
 
-	// Execute cryptsetup
-	output, err := lm.executor.Execute("cryptsetup", args...)
-	if err != nil {
-		return errors.NewLUKSFailure(devicePath, "open", fmt.Errorf("cryptsetup failed: %w (output: %s)", err, output))
+// waitForMappedDevice polls for the mapped device node, which udev may create some time after
+// cryptsetup returns. If the node is slow to appear, udevadm settle is run once.
+func (lm *LUKSManager) waitForMappedDevice(mappedPath string) error {
+	start := time.Now()
+	deadline := start.Add(lm.mapperWaitTimeout)
+	settleAfter := min(time.Second, lm.mapperWaitTimeout/2)
+	settled := false
+
+	for {
+		if _, err := lm.statPath(mappedPath); err == nil {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("mapped device not created: %s (waited %s)", mappedPath, lm.mapperWaitTimeout)
+		}
+
+		if !settled && time.Since(start) >= settleAfter {
+			settled = true
+			remaining := max(time.Until(deadline), time.Second)
+			lm.logger.WithField("mapped_device", mappedPath).Debug("Mapped device not present yet, waiting for udev to settle")
+			if _, err := lm.executor.ExecuteWithTimeout(remaining+time.Second, "udevadm", "settle", fmt.Sprintf("--timeout=%d", int(remaining.Seconds()))); err != nil {
+				lm.logger.WithError(err).Debug("udevadm settle failed")
+			}
+			continue
+		}
+
+		time.Sleep(mapperPollInterval)
 	}
+}
 
-	// Verify the mapped device was created
-	if _, err := os.Stat(mappedPath); err != nil {
-		return errors.NewLUKSFailure(devicePath, "open", fmt.Errorf("mapped device not created: %s", mappedPath))
+// buildOpenArgs constructs the cryptsetup luksOpen arguments. A key description in opts
+// takes precedence over the key file.
+func buildOpenArgs(devicePath, deviceName, keyFile string, opts OpenOptions) []string {
+	args := []string{"luksOpen"}
+
+	if opts.KeyDescription != "" {
+		args = append(args, "--key-description", opts.KeyDescription)
+	} else {
+		args = append(args, "--key-file", keyFile)
 	}
 
-	lm.logger.WithFields(logrus.Fields{
-		"device":        devicePath,
-		"device_name":   deviceName,
-		"mapped_device": mappedPath,
-	}).Info("LUKS device opened successfully")
+	if opts.NoReadWorkqueue {
+		args = append(args, "--perf-no_read_workqueue")
+	}
 
-	return nil
+	if opts.NoWriteWorkqueue {
+		args = append(args, "--perf-no_write_workqueue")
+	}
+
+	if opts.Persistent && opts.RequiresPerfFlags() {
+		args = append(args, "--persistent")
+	}
+
+	args = append(args, devicePath, deviceName)
+
+	return args
 }
 
 // CloseDevice closes a LUKS-encrypted device
@@ -191,15 +686,156 @@ func (lm *LUKSManager) CloseDevice(deviceName string) error {
 	}).Debug("Executing cryptsetup luksClose")
 
 	// Execute cryptsetup
-	output, err := lm.executor.Execute("cryptsetup", args...)
+	_, err := lm.runCryptsetupBusyRetry(ProcessPriority{}, args...)
 	if err != nil {
-		return errors.NewLUKSFailure(mappedPath, "close", fmt.Errorf("cryptsetup failed: %w (output: %s)", err, output))
+		return errors.NewLUKSFailure(mappedPath, "close", fmt.Errorf("cryptsetup failed: %w", err))
 	}
 
 	lm.logger.WithField("device_name", deviceName).Info("LUKS device closed successfully")
 	return nil
 }
 
+// CheckMapping verifies that an existing mapping is functional: cryptsetup reports it active,
+// its underlying device is present and its first block can be read. It returns nil for a
+// healthy mapping and an error describing the problem otherwise.
+func (lm *LUKSManager) CheckMapping(deviceName string) error {
+	lm.logger.WithField("device_name", deviceName).Debug("Checking existing mapping")
+
+	output, err := lm.executor.Execute("cryptsetup", "status", deviceName)
+	if err != nil {
+		return fmt.Errorf("cryptsetup status failed: %w", err)
+	}
+
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	if !strings.Contains(firstLine, " is active") {
+		return fmt.Errorf("mapping is not active: %s", firstLine)
+	}
+
+	device := parseStatusField(output, "device")
+	if device == "" || device == "(null)" {
+		return fmt.Errorf("mapping has no underlying device")
+	}
+	if _, err := lm.statPath(device); err != nil {
+		return fmt.Errorf("underlying device %s is missing", device)
+	}
+
+	if err := lm.readMapping(lm.GetMappedDevicePath(deviceName)); err != nil {
+		return fmt.Errorf("read test failed: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveMapping tears down a mapping that may be broken, falling back to a forced
+// dmsetup remove when luksClose cannot close it
+func (lm *LUKSManager) RemoveMapping(deviceName string) error {
+	mappedPath := lm.GetMappedDevicePath(deviceName)
+	lm.logger.WithField("device_name", deviceName).Info("Removing mapping")
+
+	output, err := lm.runCryptsetup(lm.operationTimeout, "luksClose", deviceName)
+	if err == nil {
+		return nil
+	}
+
+	lm.logger.WithError(err).WithField("output", output).Warn("luksClose failed, forcing removal with dmsetup")
+
+	if _, err := lm.executor.ExecuteWithTimeout(lm.operationTimeout, "dmsetup", "remove", "--force", deviceName); err != nil {
+		return errors.NewLUKSFailure(mappedPath, "remove", fmt.Errorf("dmsetup remove failed: %w", err))
+	}
+
+	return nil
+}
+
+// readFirstBlock reads the first 4 KiB of path
+func readFirstBlock(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.ReadFull(file, make([]byte, 4096))
+	return err
+}
+
+// ResizeResult reports the size of a mapping before and after a resize, in bytes
+type ResizeResult struct {
+	Before int64
+	After  int64
+}
+
+// ResizeDevice grows an open mapping to the current size of its underlying device. The key
+// is passed to cryptsetup because LUKS2 resize authenticates against a keyslot.
+func (lm *LUKSManager) ResizeDevice(deviceName, key string) (ResizeResult, error) {
+	lm.logger.WithField("device_name", deviceName).Info("Resizing LUKS device")
+
+	mappedPath := lm.GetMappedDevicePath(deviceName)
+	if _, err := lm.statPath(mappedPath); err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", fmt.Errorf("device %s is not open", deviceName))
+	}
+
+	if err := lm.ValidateKeyFormat(key); err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", err)
+	}
+
+	before, err := lm.mappingSize(deviceName)
+	if err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", err)
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", fmt.Errorf("failed to decode key: %w", err))
+	}
+
+	keyFile, err := lm.createTemporaryKeyFile(keyBytes)
+	if err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", err)
+	}
+	defer lm.cleanupKeyFile(keyFile)
+
+	lm.logger.WithField("device_name", deviceName).Debug("Executing cryptsetup resize")
+
+	_, err = lm.runCryptsetup(lm.operationTimeout, "resize", "--key-file", keyFile, deviceName)
+	if err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", fmt.Errorf("cryptsetup failed: %w", err))
+	}
+
+	after, err := lm.mappingSize(deviceName)
+	if err != nil {
+		return ResizeResult{}, errors.NewLUKSFailure(mappedPath, "resize", err)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device_name": deviceName,
+		"before":      before,
+		"after":       after,
+	}).Info("LUKS device resized successfully")
+
+	return ResizeResult{Before: before, After: after}, nil
+}
+
+// mappingSize returns the size in bytes of an active mapping from cryptsetup status
+func (lm *LUKSManager) mappingSize(deviceName string) (int64, error) {
+	output, err := lm.executor.Execute("cryptsetup", "status", deviceName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get status of %s: %w", deviceName, err)
+	}
+
+	// cryptsetup reports "size:  2097152 sectors" in 512-byte sectors
+	fields := strings.Fields(parseStatusField(output, "size"))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("size not found in status of %s", deviceName)
+	}
+
+	sectors, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size in status of %s: %q", deviceName, fields[0])
+	}
+
+	return sectors * 512, nil
+}
+
 // IsLUKSDevice checks if a device is LUKS-formatted
 func (lm *LUKSManager) IsLUKSDevice(devicePath string) (bool, error) {
 	lm.logger.WithField("device", devicePath).Debug("Checking if device is LUKS-formatted")
@@ -240,7 +876,19 @@ func (lm *LUKSManager) GetLUKSInfo(devicePath string) (map[string]string, error)
 		return nil, errors.NewLUKSFailure(devicePath, "info", fmt.Errorf("failed to get LUKS info: %w", err))
 	}
 
-	// Parse the output
+	info := parseLUKSDump(output)
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":    devicePath,
+		"info_keys": len(info),
+	}).Debug("Retrieved LUKS device information")
+
+	return info, nil
+}
+
+// parseLUKSDump reads the "key: value" lines of luksDump output. Keys repeated in several
+// sections, such as a LUKS2 keyslot's Cipher, keep the last value.
+func parseLUKSDump(output string) map[string]string {
 	info := make(map[string]string)
 	lines := strings.Split(output, "\n")
 
@@ -261,12 +909,22 @@ func (lm *LUKSManager) GetLUKSInfo(devicePath string) (map[string]string, error)
 		}
 	}
 
-	lm.logger.WithFields(logrus.Fields{
-		"device":    devicePath,
-		"info_keys": len(info),
-	}).Debug("Retrieved LUKS device information")
+	return info
+}
 
-	return info, nil
+// headerVersion returns the LUKS header version of a device ("1" or "2"), or "unknown" if
+// it cannot be read
+func (lm *LUKSManager) headerVersion(devicePath string) string {
+	info, err := lm.GetLUKSInfo(devicePath)
+	if err != nil {
+		lm.logger.WithError(err).WithField("device", devicePath).Debug("Failed to read LUKS header version")
+		return "unknown"
+	}
+
+	if version := info["Version"]; version != "" {
+		return version
+	}
+	return "unknown"
 }
 
 // createTemporaryKeyFile creates a temporary file containing the key
@@ -297,6 +955,8 @@ func (lm *LUKSManager) createTemporaryKeyFile(keyBytes []byte) (string, error) {
 		return "", fmt.Errorf("failed to close key file: %w", err)
 	}
 
+	lm.keyFiles.register(tmpFile.Name())
+
 	lm.logger.WithField("key_file", tmpFile.Name()).Debug("Created temporary key file")
 	return tmpFile.Name(), nil
 }
@@ -305,28 +965,6 @@ func (lm *LUKSManager) createTemporaryKeyFile(keyBytes []byte) (string, error) {
 func (lm *LUKSManager) cleanupKeyFile(keyFile string) {
 	lm.logger.WithField("key_file", keyFile).Debug("Cleaning up temporary key file")
 
-	// First, try to overwrite the file with random data
-	if file, err := os.OpenFile(keyFile, os.O_WRONLY, 0); err == nil {
-		// Get file size
-		if stat, err := file.Stat(); err == nil {
-			size := stat.Size()
-
-			// Overwrite with random data
-			if size > 0 {
-				randomData := make([]byte, size)
-				if _, err := io.ReadFull(rand.Reader, randomData); err == nil {
-					_, _ = file.WriteAt(randomData, 0)
-					_ = file.Sync()
-				}
-			}
-		}
-		_ = file.Close()
-	}
-
-	// Remove the file
-	if err := os.Remove(keyFile); err != nil {
-		lm.logger.WithError(err).WithField("key_file", keyFile).Warn("Failed to remove temporary key file")
-	} else {
-		lm.logger.WithField("key_file", keyFile).Debug("Temporary key file removed")
-	}
+	lm.keyFiles.unregister(keyFile)
+	eraseKeyFile(lm.logger, keyFile)
 }
@@ -0,0 +1,122 @@
+package dmcrypt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// SupportedFilesystems are the filesystem types MakeFilesystem can create
+var SupportedFilesystems = []string{"ext4", "xfs"}
+
+// DefaultHeartbeatInterval is how often a long-running command logs that it is still running
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// ValidateFilesystemType checks that fsType is one MakeFilesystem supports
+func ValidateFilesystemType(fsType string) error {
+	for _, supported := range SupportedFilesystems {
+		if fsType == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported filesystem %q (supported: ext4, xfs)", fsType)
+}
+
+// MakeFilesystem creates a filesystem of fsType on an opened mapping. A mapping that already
+// contains a filesystem or other signature is refused unless force is set.
+func (lm *LUKSManager) MakeFilesystem(mappedPath, fsType string, force bool) error {
+	if err := ValidateFilesystemType(fsType); err != nil {
+		return errors.NewLUKSFailure(mappedPath, "mkfs", err)
+	}
+
+	signature, err := lm.ProbeDevice(mappedPath)
+	if err != nil {
+		return errors.NewLUKSFailure(mappedPath, "mkfs", err)
+	}
+	if signature != nil {
+		if !force {
+			return errors.NewLUKSFailure(mappedPath, "mkfs", fmt.Errorf("mapping already contains %s. Use --force to overwrite it", signature))
+		}
+		lm.logger.WithField("mapped_device", mappedPath).Warnf("Mapping contains %s, overwriting because --force was given", signature)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"mapped_device": mappedPath,
+		"filesystem":    fsType,
+	}).Info("Creating filesystem")
+
+	command, args := buildMkfsArgs(mappedPath, fsType, signature != nil)
+	if _, err := lm.runWithHeartbeat(lm.operationTimeout, command, args...); err != nil {
+		return errors.NewLUKSFailure(mappedPath, "mkfs", err)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"mapped_device": mappedPath,
+		"filesystem":    fsType,
+	}).Info("Filesystem created successfully")
+
+	return nil
+}
+
+// buildMkfsArgs constructs the mkfs command for fsType. overwrite adds the flag each mkfs needs
+// to replace an existing signature without prompting.
+func buildMkfsArgs(mappedPath, fsType string, overwrite bool) (string, []string) {
+	var args []string
+	if overwrite {
+		switch fsType {
+		case "ext4":
+			args = append(args, "-F")
+		case "xfs":
+			args = append(args, "-f")
+		}
+	}
+
+	return "mkfs." + fsType, append(args, mappedPath)
+}
+
+// runWithHeartbeat runs a command that may take minutes, logging periodically while it runs so
+// an operator watching the log can tell it has not hung, and killing it after timeout
+func (lm *LUKSManager) runWithHeartbeat(timeout time.Duration, command string, args ...string) (string, error) {
+	if timeout <= 0 {
+		timeout = DefaultOperationTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	start := time.Now()
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lm.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				lm.logger.WithFields(logrus.Fields{
+					"command": command,
+					"elapsed": time.Since(start).Round(time.Second).String(),
+				}).Info("Still running")
+			}
+		}
+	}()
+
+	output, err := lm.executor.ExecuteWithContext(ctx, command, args...)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("%s did not complete within %s and was killed (see [dmcrypt] operation_timeout)", command, timeout)
+	}
+
+	return output, err
+}
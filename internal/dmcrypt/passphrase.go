@@ -0,0 +1,51 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// OpenDeviceWithPassphrase opens a LUKS device with a passphrase typed by an operator, such as
+// one held in a recovery keyslot. Unlike OpenDevice the passphrase is not a base64 key: its bytes
+// are passed to cryptsetup unchanged, which tries it against every keyslot. The caller remains
+// responsible for erasing passphrase.
+func (lm *LUKSManager) OpenDeviceWithPassphrase(devicePath string, passphrase []byte, deviceName string) error {
+	lm.logger.WithFields(logrus.Fields{
+		"device":      devicePath,
+		"device_name": deviceName,
+	}).Info("Opening LUKS device with a passphrase")
+
+	if err := lm.ValidateDevice(devicePath); err != nil {
+		return err
+	}
+
+	if len(passphrase) == 0 {
+		return errors.NewLUKSFailure(devicePath, "open", fmt.Errorf("passphrase cannot be empty"))
+	}
+
+	mappedPath := lm.GetMappedDevicePath(deviceName)
+	if _, err := os.Stat(mappedPath); err == nil {
+		lm.logger.WithField("mapped_device", mappedPath).Info("Device is already open")
+		return nil
+	}
+
+	if err := lm.openWithKeyBytes(devicePath, passphrase, deviceName, OpenOptions{}); err != nil {
+		return err
+	}
+
+	if err := lm.waitForMappedDevice(mappedPath); err != nil {
+		return errors.NewLUKSFailure(devicePath, "open", err)
+	}
+
+	lm.logger.WithFields(logrus.Fields{
+		"device":        devicePath,
+		"device_name":   deviceName,
+		"mapped_device": mappedPath,
+	}).Info("LUKS device opened successfully with a passphrase")
+
+	return nil
+}
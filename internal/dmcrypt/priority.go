@@ -0,0 +1,77 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// IO scheduling classes accepted by ProcessPriority.IOClass
+const (
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// ProcessPriority lowers the CPU and I/O priority of a command so that, at boot, the argon2
+// PBKDF of luksOpen does not starve other services. The zero value runs commands unchanged.
+type ProcessPriority struct {
+	// Nice is the niceness increment passed to nice (0-19)
+	Nice int
+
+	// IOClass is the ionice scheduling class: "", best-effort or idle
+	IOClass string
+}
+
+// IsZero reports whether p leaves priority unchanged
+func (p ProcessPriority) IsZero() bool {
+	return p.Nice == 0 && p.IOClass == ""
+}
+
+// Validate checks that p can be applied
+func (p ProcessPriority) Validate() error {
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19, got %d", p.Nice)
+	}
+	if _, err := ioniceClass(p.IOClass); err != nil {
+		return err
+	}
+	return nil
+}
+
+// wrap returns the command and arguments that run command under p, prefixing ionice and
+// nice as needed
+func (p ProcessPriority) wrap(command string, args ...string) (string, []string) {
+	if p.IsZero() {
+		return command, args
+	}
+
+	var prefix []string
+	if p.Nice > 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(p.Nice))
+	}
+	if class, err := ioniceClass(p.IOClass); err == nil && class != "" {
+		prefix = append(prefix, "ionice", "-c", class)
+	}
+	if len(prefix) == 0 {
+		return command, args
+	}
+
+	wrapped := make([]string, 0, len(prefix)+len(args))
+	wrapped = append(wrapped, prefix[1:]...)
+	wrapped = append(wrapped, command)
+	wrapped = append(wrapped, args...)
+	return prefix[0], wrapped
+}
+
+// ioniceClass maps an IOClass name to the numeric class ionice expects
+func ioniceClass(name string) (string, error) {
+	switch name {
+	case "":
+		return "", nil
+	case IOClassBestEffort:
+		return "2", nil
+	case IOClassIdle:
+		return "3", nil
+	default:
+		return "", fmt.Errorf("invalid I/O class %q: must be %s or %s", name, IOClassBestEffort, IOClassIdle)
+	}
+}
@@ -0,0 +1,158 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DeviceSignature describes existing content detected on a block device
+type DeviceSignature struct {
+	Kind string // "filesystem", "partition table", "LUKS header" or "signature"
+	Type string // Type reported by blkid/lsblk, e.g. "ext4", "gpt", "crypto_LUKS"
+}
+
+// String describes the signature for error messages, e.g. "an ext4 filesystem"
+func (s DeviceSignature) String() string {
+	desc := s.Kind
+	if s.Type != "" && s.Kind != "LUKS header" {
+		desc = s.Type + " " + s.Kind
+	}
+
+	article := "a"
+	if strings.ContainsRune("aeiouAEIOU", rune(desc[0])) {
+		article = "an"
+	}
+
+	return article + " " + desc
+}
+
+// ProbeDevice reports any filesystem, partition table or LUKS signature on a device.
+// It returns nil when the device appears to be empty.
+func (lm *LUKSManager) ProbeDevice(devicePath string) (*DeviceSignature, error) {
+	lm.logger.WithField("device", devicePath).Debug("Probing device for existing signatures")
+
+	// blkid exits non-zero when it finds nothing, so fall back to lsblk to tell
+	// an empty device apart from a probe failure
+	output, err := lm.executor.Execute("blkid", "-p", "-o", "export", devicePath)
+	if err == nil {
+		if sig := parseBlkidExport(output); sig != nil {
+			lm.logSignature(devicePath, sig)
+			return sig, nil
+		}
+	}
+
+	output, err = lm.executor.Execute("lsblk", "-dnP", "-o", "FSTYPE,PTTYPE", devicePath)
+	if err != nil {
+		return nil, errors.NewLUKSFailure(devicePath, "probe", err)
+	}
+
+	sig := parseLsblkPairs(output)
+	if sig != nil {
+		lm.logSignature(devicePath, sig)
+	}
+
+	return sig, nil
+}
+
+func (lm *LUKSManager) logSignature(devicePath string, sig *DeviceSignature) {
+	lm.logger.WithFields(logrus.Fields{
+		"device": devicePath,
+		"kind":   sig.Kind,
+		"type":   sig.Type,
+	}).Debug("Detected existing signature on device")
+}
+
+// parseBlkidExport parses `blkid -p -o export` output
+func parseBlkidExport(output string) *DeviceSignature {
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if found {
+			values[key] = value
+		}
+	}
+
+	if values["PTTYPE"] != "" {
+		return &DeviceSignature{Kind: "partition table", Type: values["PTTYPE"]}
+	}
+
+	return signatureFromType(values["TYPE"], values["USAGE"])
+}
+
+// parseLsblkPairs parses `lsblk -dnP -o FSTYPE,PTTYPE` output, e.g. FSTYPE="ext4" PTTYPE=""
+func parseLsblkPairs(output string) *DeviceSignature {
+	values := make(map[string]string)
+	for _, field := range strings.Fields(output) {
+		key, value, found := strings.Cut(field, "=")
+		if found {
+			values[key] = strings.Trim(value, `"`)
+		}
+	}
+
+	if values["PTTYPE"] != "" {
+		return &DeviceSignature{Kind: "partition table", Type: values["PTTYPE"]}
+	}
+
+	return signatureFromType(values["FSTYPE"], "")
+}
+
+// DeviceDescription identifies a block device to an operator
+type DeviceDescription struct {
+	Size   string // Human-readable size reported by lsblk, e.g. "931.5G"
+	Model  string
+	Serial string
+}
+
+// DescribeDevice reports the size, model and serial number of a device. Fields lsblk does not
+// know, such as the model of a virtual disk, are left empty.
+func (lm *LUKSManager) DescribeDevice(devicePath string) (DeviceDescription, error) {
+	output, err := lm.executor.Execute("lsblk", "-dnP", "-o", "SIZE,MODEL,SERIAL", devicePath)
+	if err != nil {
+		return DeviceDescription{}, errors.NewLUKSFailure(devicePath, "describe", err)
+	}
+
+	values := parseLsblkValues(output)
+	return DeviceDescription{
+		Size:   values["SIZE"],
+		Model:  values["MODEL"],
+		Serial: values["SERIAL"],
+	}, nil
+}
+
+// parseLsblkValues parses a line of `lsblk -P` output, e.g. SIZE="1.8T" MODEL="Samsung SSD 970",
+// whose quoted values may contain spaces
+func parseLsblkValues(output string) map[string]string {
+	values := make(map[string]string)
+	rest := strings.TrimSpace(output)
+	for rest != "" {
+		key, after, found := strings.Cut(rest, `="`)
+		if !found {
+			break
+		}
+		value, remaining, found := strings.Cut(after, `"`)
+		if !found {
+			break
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		rest = strings.TrimSpace(remaining)
+	}
+	return values
+}
+
+// signatureFromType classifies a blkid/lsblk TYPE value
+func signatureFromType(fsType, usage string) *DeviceSignature {
+	switch {
+	case fsType == "":
+		return nil
+	case fsType == "crypto_LUKS":
+		return &DeviceSignature{Kind: "LUKS header", Type: fsType}
+	case usage == "filesystem" || usage == "":
+		return &DeviceSignature{Kind: "filesystem", Type: fsType}
+	default:
+		return &DeviceSignature{Kind: fmt.Sprintf("%s signature", usage), Type: fsType}
+	}
+}
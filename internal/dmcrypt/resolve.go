@@ -0,0 +1,119 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DeviceResolution controls how device paths behind LVM or multipath are handled
+type DeviceResolution string
+
+const (
+	// ResolutionStrict uses the given device as-is and refuses devices claimed by another device-mapper layer
+	ResolutionStrict DeviceResolution = "strict"
+	// ResolutionFollow follows LVM/multipath layers up to the top-level device-mapper device
+	ResolutionFollow DeviceResolution = "follow"
+)
+
+// maxResolveDepth bounds how many device-mapper layers are followed
+const maxResolveDepth = 8
+
+// ParseDeviceResolution validates a --device-resolution value
+func ParseDeviceResolution(value string) (DeviceResolution, error) {
+	switch DeviceResolution(value) {
+	case ResolutionStrict, ResolutionFollow:
+		return DeviceResolution(value), nil
+	default:
+		return "", fmt.Errorf("invalid device resolution %q (expected strict or follow)", value)
+	}
+}
+
+// ResolveDevice returns the device that should be used for devicePath. When the device is a
+// member of an LVM or multipath device-mapper device (e.g. /dev/disk/by-uuid points at a
+// multipath path rather than /dev/mapper/mpatha), follow mode walks up to the top-level
+// device while strict mode returns an error. dm-crypt mappings are never followed.
+func (lm *LUKSManager) ResolveDevice(devicePath string, mode DeviceResolution) (string, error) {
+	holdersByDep, err := lm.deviceMapperHolders()
+	if err != nil {
+		return "", errors.NewLUKSFailure(devicePath, "resolve", err)
+	}
+
+	current := devicePath
+	for depth := 0; depth < maxResolveDepth; depth++ {
+		holders := holdersByDep[kernelDeviceName(current)]
+		if len(holders) == 0 {
+			if current != devicePath {
+				lm.logger.WithFields(logrus.Fields{
+					"device":          devicePath,
+					"resolved_device": current,
+				}).Info("Resolved device through device-mapper layers")
+			}
+			return current, nil
+		}
+
+		if mode == ResolutionStrict {
+			return "", errors.NewLUKSFailure(devicePath, "resolve", fmt.Errorf(
+				"device is in use by device-mapper device %s; use that device or --device-resolution follow", strings.Join(holders, ", ")))
+		}
+
+		if len(holders) > 1 {
+			return "", errors.NewLUKSFailure(devicePath, "resolve", fmt.Errorf(
+				"device is in use by multiple device-mapper devices (%s), cannot choose one", strings.Join(holders, ", ")))
+		}
+
+		current = "/dev/mapper/" + holders[0]
+	}
+
+	return "", errors.NewLUKSFailure(devicePath, "resolve", fmt.Errorf("too many device-mapper layers"))
+}
+
+// deviceMapperHolders maps a kernel device name (e.g. "sdb", "dm-3") to the names of the
+// non-crypt device-mapper devices built on top of it
+func (lm *LUKSManager) deviceMapperHolders() (map[string][]string, error) {
+	output, err := lm.executor.Execute("dmsetup", "deps", "-o", "devname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device-mapper dependencies: %w", err)
+	}
+
+	cryptOutput, err := lm.executor.Execute("dmsetup", "ls", "--target", "crypt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dm-crypt mappings: %w", err)
+	}
+
+	cryptNames := make(map[string]bool)
+	for _, line := range strings.Split(cryptOutput, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && strings.HasPrefix(fields[1], "(") {
+			cryptNames[fields[0]] = true
+		}
+	}
+
+	holders := make(map[string][]string)
+	for _, line := range strings.Split(output, "\n") {
+		// Lines look like "mpatha: 2 dependencies	: (sdc) (sdb)"
+		name, rest, found := strings.Cut(line, ":")
+		if !found || cryptNames[strings.TrimSpace(name)] {
+			continue
+		}
+		name = strings.TrimSpace(name)
+
+		for _, field := range strings.Fields(rest) {
+			if strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")") {
+				dep := strings.Trim(field, "()")
+				holders[dep] = append(holders[dep], name)
+			}
+		}
+	}
+
+	return holders, nil
+}
+
+// kernelDeviceName returns the kernel name of a device path, following symlinks such as
+// /dev/disk/by-uuid/... or /dev/mapper/... to /dev/sdb or /dev/dm-3
+func kernelDeviceName(devicePath string) string {
+	return filepath.Base(ResolveDevicePath(devicePath))
+}
@@ -0,0 +1,70 @@
+package dmcrypt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DiskByIDDir holds the persistent links udev creates for each disk and partition
+const DiskByIDDir = "/dev/disk/by-id"
+
+// kernelDevicePattern matches kernel device names, which can change between boots as disks are
+// probed in a different order
+var kernelDevicePattern = regexp.MustCompile(`^/dev/(sd[a-z]+|vd[a-z]+|xvd[a-z]+|hd[a-z]+|nvme\d+n\d+|mmcblk\d+)(p?\d+)?$`)
+
+// IsKernelDevicePath reports whether path is a kernel device name such as /dev/sdb or
+// /dev/nvme0n1p1 rather than a persistent path
+func IsKernelDevicePath(path string) bool {
+	return kernelDevicePattern.MatchString(filepath.Clean(path))
+}
+
+// StablePath returns a /dev/disk/by-id link to devicePath, or "" if there is none. WWN links
+// are preferred since they identify the disk itself rather than how it is attached, then NVMe
+// EUI links, then the first other link by name.
+func (lm *LUKSManager) StablePath(devicePath string) (string, error) {
+	target := ResolveDevicePath(devicePath)
+
+	entries, err := os.ReadDir(lm.byIDDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read %s: %w", lm.byIDDir, err)
+	}
+
+	var links []string
+	for _, entry := range entries {
+		link := filepath.Join(lm.byIDDir, entry.Name())
+		if ResolveDevicePath(link) == target {
+			links = append(links, link)
+		}
+	}
+	if len(links) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if byIDLinkRank(links[i]) != byIDLinkRank(links[j]) {
+			return byIDLinkRank(links[i]) < byIDLinkRank(links[j])
+		}
+		return links[i] < links[j]
+	})
+	return links[0], nil
+}
+
+// byIDLinkRank orders by-id links by how reliably they identify a disk, lowest first
+func byIDLinkRank(link string) int {
+	name := filepath.Base(link)
+	switch {
+	case strings.HasPrefix(name, "wwn-"):
+		return 0
+	case strings.HasPrefix(name, "nvme-eui."):
+		return 1
+	default:
+		return 2
+	}
+}
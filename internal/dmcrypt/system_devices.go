@@ -0,0 +1,294 @@
+package dmcrypt
+
+import (
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountsPath lists the filesystems mounted in the current mount namespace
+const MountsPath = "/proc/self/mounts"
+
+// SysBlockDir has an entry for every block device, with its device-mapper members under slaves/
+const SysBlockDir = "/sys/class/block"
+
+// SysDevBlockDir links each block device number, as MAJOR:MINOR, to its /sys/class/block entry
+const SysDevBlockDir = "/sys/dev/block"
+
+// SysBtrfsDir has an entry for every mounted btrfs filesystem, with its member devices under devices/
+const SysBtrfsDir = "/sys/fs/btrfs"
+
+// systemMountPoints are the mount points whose devices must never be encrypted
+var systemMountPoints = []string{"/", "/boot", "/boot/efi"}
+
+// mountEntry is one line of MountsPath
+type mountEntry struct {
+	source  string
+	target  string
+	fsType  string
+	options []string
+}
+
+// SystemDevices returns the block devices backing /, /boot and /boot/efi: the devices holding
+// the filesystems mounted there, the device-mapper members below them (e.g. the physical volumes
+// of an LVM root) and the disks holding any of those partitions.
+//
+// Each mount point's device is found from the st_dev of the mount point through /sys/dev/block,
+// so a root shown as /dev/root in the mount table is still found. Filesystems without a block
+// device of their own are followed to the devices they are built on: the members of a btrfs
+// filesystem, the vdevs of a ZFS pool and the directories an overlay is made of.
+func (lm *LUKSManager) SystemDevices() ([]string, error) {
+	mountsData, err := os.ReadFile(lm.mountsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", lm.mountsPath, err)
+	}
+
+	var mounts []mountEntry
+	for _, line := range strings.Split(string(mountsData), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			source:  fields[0],
+			target:  fields[1],
+			fsType:  fields[2],
+			options: strings.Split(fields[3], ","),
+		})
+	}
+
+	found := make(map[string]bool)
+	for _, mountPoint := range systemMountPoints {
+		if err := lm.addMountDevices(mountPoint, mounts, found, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	devices := make([]string, 0, len(found))
+	for device := range found {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// addMountDevices adds the devices backing the filesystem path is on to found. A path that does
+// not exist, such as /boot/efi on a BIOS system, has no devices.
+func (lm *LUKSManager) addMountDevices(path string, mounts []mountEntry, found map[string]bool, depth int) error {
+	if depth > maxResolveDepth {
+		return nil
+	}
+
+	dev, err := lm.deviceNumber(path)
+	if stderrors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find the device of %s: %w", path, err)
+	}
+
+	mount, mounted := mountContaining(mounts, path)
+	if mounted && strings.HasPrefix(mount.source, "/dev/") {
+		found[mount.source] = true
+	}
+
+	// A filesystem on a block device has that device's number as st_dev
+	if name, ok := lm.blockDeviceName(dev); ok {
+		lm.addBackingDevices(name, found, 0)
+		return nil
+	}
+	if !mounted {
+		return nil
+	}
+
+	switch mount.fsType {
+	case "btrfs":
+		// btrfs reports an anonymous st_dev, and may span several devices
+		members := lm.btrfsMembers(kernelDeviceName(mount.source))
+		if len(members) == 0 && strings.HasPrefix(mount.source, "/dev/") {
+			members = []string{kernelDeviceName(mount.source)}
+		}
+		for _, member := range members {
+			lm.addBackingDevices(member, found, 0)
+		}
+	case "zfs":
+		pool, _, _ := strings.Cut(mount.source, "/")
+		vdevs, err := lm.zfsPoolDevices(pool)
+		if err != nil {
+			return err
+		}
+		for _, vdev := range vdevs {
+			found[vdev] = true
+			lm.addBackingDevices(kernelDeviceName(vdev), found, 0)
+		}
+	case "overlay":
+		for _, option := range mount.options {
+			key, value, _ := strings.Cut(option, "=")
+			if key != "lowerdir" && key != "upperdir" {
+				continue
+			}
+			for _, dir := range strings.Split(value, ":") {
+				if dir == "" {
+					continue
+				}
+				if err := lm.addMountDevices(dir, mounts, found, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		if strings.HasPrefix(mount.source, "/dev/") {
+			found[ResolveDevicePath(mount.source)] = true
+			lm.addBackingDevices(kernelDeviceName(mount.source), found, 0)
+		}
+	}
+	return nil
+}
+
+// mountContaining returns the mount path is on: the one with the longest target containing it,
+// and the latest of those, since a later mount hides an earlier one at the same target
+func mountContaining(mounts []mountEntry, path string) (mountEntry, bool) {
+	var best mountEntry
+	found := false
+	for _, mount := range mounts {
+		if !pathWithin(path, mount.target) {
+			continue
+		}
+		if !found || len(mount.target) >= len(best.target) {
+			best, found = mount, true
+		}
+	}
+	return best, found
+}
+
+// pathWithin reports whether path is dir or below it
+func pathWithin(path, dir string) bool {
+	if dir == "/" || path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// statDeviceNumber returns st_dev of path, the number of the device its filesystem is on
+func statDeviceNumber(path string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return st.Dev, nil
+}
+
+// blockDeviceName returns the kernel name of the block device numbered dev, if there is one.
+// Filesystems such as btrfs, ZFS and overlay report an anonymous device number instead.
+func (lm *LUKSManager) blockDeviceName(dev uint64) (string, bool) {
+	link := filepath.Join(lm.sysDevBlockDir, fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)))
+	resolved, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", false
+	}
+	return filepath.Base(resolved), true
+}
+
+// btrfsMembers returns the kernel names of the devices of the btrfs filesystem that device is
+// one of, or nil if no mounted btrfs filesystem has it
+func (lm *LUKSManager) btrfsMembers(device string) []string {
+	filesystems, err := os.ReadDir(lm.sysBtrfsDir)
+	if err != nil {
+		return nil
+	}
+	for _, filesystem := range filesystems {
+		entries, err := os.ReadDir(filepath.Join(lm.sysBtrfsDir, filesystem.Name(), "devices"))
+		if err != nil {
+			continue
+		}
+		members := make([]string, 0, len(entries))
+		isMember := false
+		for _, entry := range entries {
+			members = append(members, entry.Name())
+			isMember = isMember || entry.Name() == device
+		}
+		if isMember {
+			return members
+		}
+	}
+	return nil
+}
+
+// zfsPoolDevices returns the devices blkid reports as members of the ZFS pool
+func (lm *LUKSManager) zfsPoolDevices(pool string) ([]string, error) {
+	// blkid exits non-zero when no device matches
+	output, err := lm.executor.Execute("blkid", "-t", "TYPE=zfs_member", "-o", "export")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the devices of ZFS pool %s: %w", pool, err)
+	}
+
+	var devices []string
+	var device string
+	for _, line := range strings.Split(output+"\n", "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "DEVNAME":
+			device = value
+		case "LABEL":
+			if value == pool && device != "" {
+				devices = append(devices, device)
+			}
+		case "":
+			device = ""
+		}
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no devices found for ZFS pool %s", pool)
+	}
+	return devices, nil
+}
+
+// addBackingDevices adds /dev/name to found along with the devices it is built on: its
+// device-mapper members, listed under slaves/, and, for a partition, the disk it is on
+func (lm *LUKSManager) addBackingDevices(name string, found map[string]bool, depth int) {
+	if depth > maxResolveDepth {
+		return
+	}
+	found["/dev/"+name] = true
+
+	entry := filepath.Join(lm.sysBlockDir, name)
+	if _, err := os.Stat(filepath.Join(entry, "partition")); err == nil {
+		// /sys/class/block/sda2 links to .../block/sda/sda2
+		if resolved, err := filepath.EvalSymlinks(entry); err == nil {
+			found["/dev/"+filepath.Base(filepath.Dir(resolved))] = true
+		}
+	}
+
+	members, err := os.ReadDir(filepath.Join(entry, "slaves"))
+	if err != nil {
+		return
+	}
+	for _, member := range members {
+		lm.addBackingDevices(member.Name(), found, depth+1)
+	}
+}
+
+// DeviceMatches reports whether devicePath matches pattern, a device path or shell glob such
+// as /dev/sd[b-z] or /dev/disk/by-id/wwn-*. Symlinks are followed on both sides, so
+// /dev/disk/by-id links match the kernel device they point at and vice versa.
+func DeviceMatches(devicePath, pattern string) bool {
+	resolved := ResolveDevicePath(devicePath)
+	for _, candidate := range []string{devicePath, resolved} {
+		if matched, _ := filepath.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+
+	matches, _ := filepath.Glob(pattern)
+	for _, match := range matches {
+		if ResolveDevicePath(match) == resolved {
+			return true
+		}
+	}
+	return false
+}
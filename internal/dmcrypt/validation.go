@@ -2,6 +2,8 @@ package dmcrypt
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
@@ -45,6 +47,21 @@ func (sv *SystemValidator) ValidateSystemRequirements() error {
 	return nil
 }
 
+// ValidateRootPrivileges checks that the process is running as root
+func (sv *SystemValidator) ValidateRootPrivileges() error {
+	return sv.validateRootPrivileges()
+}
+
+// ValidateRequiredCommands checks that the commands used for dm-crypt operations are installed
+func (sv *SystemValidator) ValidateRequiredCommands() error {
+	return sv.validateRequiredCommands()
+}
+
+// ValidateKernelModules checks that the device mapper kernel modules are available
+func (sv *SystemValidator) ValidateKernelModules() error {
+	return sv.validateKernelModules()
+}
+
 // validateRootPrivileges checks if the process is running as root
 func (sv *SystemValidator) validateRootPrivileges() error {
 	manager := NewManager(sv.logger)
@@ -131,6 +148,66 @@ func (sv *SystemValidator) ValidateCryptsetupVersion() error {
 	return nil
 }
 
+// CryptsetupVersion returns the installed cryptsetup version as major, minor and patch numbers
+func (sv *SystemValidator) CryptsetupVersion() (int, int, int, error) {
+	output, err := sv.executor.Execute("cryptsetup", "--version")
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "failed to get cryptsetup version")
+	}
+
+	return parseCryptsetupVersion(output)
+}
+
+// RequireCryptsetupVersion returns an error if the installed cryptsetup is older than major.minor
+func (sv *SystemValidator) RequireCryptsetupVersion(major, minor int, feature string) error {
+	gotMajor, gotMinor, gotPatch, err := sv.CryptsetupVersion()
+	if err != nil {
+		return err
+	}
+
+	if gotMajor < major || (gotMajor == major && gotMinor < minor) {
+		return errors.New(fmt.Sprintf("%s requires cryptsetup %d.%d or newer (found %d.%d.%d)",
+			feature, major, minor, gotMajor, gotMinor, gotPatch))
+	}
+
+	sv.logger.WithFields(logrus.Fields{
+		"feature": feature,
+		"version": fmt.Sprintf("%d.%d.%d", gotMajor, gotMinor, gotPatch),
+	}).Debug("Cryptsetup version supports feature")
+	return nil
+}
+
+// parseCryptsetupVersion extracts the version from output such as "cryptsetup 2.4.3"
+func parseCryptsetupVersion(output string) (int, int, int, error) {
+	for _, field := range strings.Fields(output) {
+		parts := strings.SplitN(field, ".", 3)
+		if len(parts) < 2 {
+			continue
+		}
+
+		numbers := make([]int, 3)
+		valid := true
+		for i, part := range parts {
+			// Strip any suffix such as "-rc1" or "+git"
+			if end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+				part = part[:end]
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				valid = false
+				break
+			}
+			numbers[i] = n
+		}
+
+		if valid {
+			return numbers[0], numbers[1], numbers[2], nil
+		}
+	}
+
+	return 0, 0, 0, errors.New(fmt.Sprintf("unable to parse cryptsetup version from %q", strings.TrimSpace(output)))
+}
+
 // ValidateDeviceMapperSupport checks if device mapper is properly supported
 func (sv *SystemValidator) ValidateDeviceMapperSupport() error {
 	sv.logger.Debug("Validating device mapper support")
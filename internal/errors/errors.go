@@ -1,6 +1,7 @@
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 )
 
@@ -119,6 +120,8 @@ type LUKSFailure struct {
 	Device string
 	Op     string
 	Cause  error
+	// Stderr of the failed command in Cause, if any; this is where cryptsetup explains why
+	Stderr string
 }
 
 // Error implements the error interface
@@ -133,7 +136,19 @@ func (e *LUKSFailure) Unwrap() error {
 
 // NewLUKSFailure creates a new LUKSFailure error
 func NewLUKSFailure(device, operation string, cause error) *LUKSFailure {
-	return &LUKSFailure{Device: device, Op: operation, Cause: cause}
+	failure := &LUKSFailure{Device: device, Op: operation, Cause: cause}
+
+	var cmdErr commandError
+	if cause != nil && stderrors.As(cause, &cmdErr) {
+		failure.Stderr = cmdErr.CommandStderr()
+	}
+	return failure
+}
+
+// commandError is implemented by errors from external commands that captured stderr
+type commandError interface {
+	error
+	CommandStderr() string
 }
 
 // ConfigError represents configuration-related errors
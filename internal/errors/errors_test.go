@@ -81,3 +81,30 @@ func TestConfigError(t *testing.T) {
 		assert.Equal(t, baseErr, err.Unwrap())
 	})
 }
+
+func TestNewReport(t *testing.T) {
+	t.Run("most specific typed error wins", func(t *testing.T) {
+		readErr := NewVaultReadError("secret/data/host/uuid", errors.New("permission denied"))
+		err := Wrap(readErr, "operation failed after 3 retries")
+
+		report := NewReport(err, "decrypt")
+		assert.Equal(t, CodeVaultReadError, report.ErrorCode)
+		assert.Equal(t, "VaultReadError", report.ErrorType)
+		assert.Equal(t, "decrypt", report.Operation)
+		assert.Equal(t, err.Error(), report.Message)
+	})
+
+	t.Run("LUKS failure records its operation", func(t *testing.T) {
+		err := NewLUKSFailure("/dev/sdb", "open", errors.New("no key available"))
+
+		report := NewReport(err, "decrypt")
+		assert.Equal(t, CodeLUKSFailure, report.ErrorCode)
+		assert.Equal(t, "luks-open", report.Operation)
+	})
+
+	t.Run("untyped error", func(t *testing.T) {
+		report := NewReport(errors.New("boom"), "encrypt")
+		assert.Equal(t, CodeUnknownError, report.ErrorCode)
+		assert.Equal(t, "error", report.ErrorType)
+	})
+}
@@ -0,0 +1,67 @@
+package errors
+
+import (
+	stderrors "errors"
+)
+
+// Error codes reported for machine consumption
+const (
+	CodeLUKSFailure      = "LUKS_FAILURE"
+	CodeVaultReadError   = "VAULT_READ_ERROR"
+	CodeVaultWriteError  = "VAULT_WRITE_ERROR"
+	CodeVaultDeleteError = "VAULT_DELETE_ERROR"
+	CodeVaultKeyMismatch = "VAULT_KEY_MISMATCH"
+	CodeConfigError      = "CONFIG_ERROR"
+	CodeGeneralError     = "GENERAL_ERROR"
+	CodeUnknownError     = "UNKNOWN_ERROR"
+)
+
+// Report is a machine-readable description of an error
+type Report struct {
+	ErrorCode string `json:"error_code"`
+	ErrorType string `json:"error_type"`
+	Message   string `json:"message"`
+	Operation string `json:"operation"`
+	Stderr    string `json:"stderr,omitempty"` // Output of the failed command, for LUKS failures
+}
+
+// NewReport classifies err by the most specific typed error in its chain. The operation
+// is taken from the typed error where it records one (e.g. the LUKS operation), otherwise
+// the supplied operation is used.
+func NewReport(err error, operation string) Report {
+	report := Report{
+		ErrorCode: CodeUnknownError,
+		ErrorType: "error",
+		Message:   err.Error(),
+		Operation: operation,
+	}
+
+	var luksErr *LUKSFailure
+	var readErr *VaultReadError
+	var writeErr *VaultWriteError
+	var deleteErr *VaultDeleteError
+	var mismatchErr *VaultKeyMismatch
+	var configErr *ConfigError
+	var generalErr *VaultlockerError
+
+	switch {
+	case stderrors.As(err, &luksErr):
+		report.ErrorCode, report.ErrorType = CodeLUKSFailure, "LUKSFailure"
+		report.Operation = "luks-" + luksErr.Op
+		report.Stderr = luksErr.Stderr
+	case stderrors.As(err, &readErr):
+		report.ErrorCode, report.ErrorType = CodeVaultReadError, "VaultReadError"
+	case stderrors.As(err, &writeErr):
+		report.ErrorCode, report.ErrorType = CodeVaultWriteError, "VaultWriteError"
+	case stderrors.As(err, &deleteErr):
+		report.ErrorCode, report.ErrorType = CodeVaultDeleteError, "VaultDeleteError"
+	case stderrors.As(err, &mismatchErr):
+		report.ErrorCode, report.ErrorType = CodeVaultKeyMismatch, "VaultKeyMismatch"
+	case stderrors.As(err, &configErr):
+		report.ErrorCode, report.ErrorType = CodeConfigError, "ConfigError"
+	case stderrors.As(err, &generalErr):
+		report.ErrorCode, report.ErrorType = CodeGeneralError, "VaultlockerError"
+	}
+
+	return report
+}
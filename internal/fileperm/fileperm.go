@@ -0,0 +1,59 @@
+// Package fileperm opens the files vault-dm-crypt creates with the permissions of
+// [security] file_mode
+package fileperm
+
+import (
+	"fmt"
+	"os"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DefaultMode is the mode of created files unless [security] file_mode says otherwise
+const DefaultMode os.FileMode = 0600
+
+// OpenFile opens path with flag, creating it if needed. A file it creates gets exactly mode,
+// whatever the umask; an existing file loses any permission bits mode does not allow.
+func OpenFile(path string, flag int, mode os.FileMode) (*os.File, error) {
+	file, err := os.OpenFile(path, flag|os.O_CREATE|os.O_EXCL, mode)
+	if err == nil {
+		if err := file.Chmod(mode); err != nil {
+			_ = file.Close()
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to set the permissions of %s to %04o", path, mode))
+		}
+		return file, nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+
+	file, err = os.OpenFile(path, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := Restrict(file, mode); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Restrict clears the permission bits of file that mode does not allow. A file whose
+// permissions are already within mode is left untouched, so files that cannot be changed,
+// such as append-only ones, only fail when they are too permissive.
+func Restrict(file *os.File, mode os.FileMode) error {
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to stat %s", file.Name()))
+	}
+
+	perm := info.Mode().Perm()
+	if perm&^mode == 0 {
+		return nil
+	}
+
+	if err := file.Chmod(perm & mode); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to restrict the permissions of %s to %04o", file.Name(), perm&mode))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package fileperm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func filePerm(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Mode().Perm()
+}
+
+func TestOpenFile(t *testing.T) {
+	t.Run("created with the configured mode", func(t *testing.T) {
+		for _, mode := range []os.FileMode{0600, 0640, 0644} {
+			path := filepath.Join(t.TempDir(), "out.log")
+
+			file, err := OpenFile(path, os.O_WRONLY|os.O_APPEND, mode)
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+			assert.Equal(t, mode, filePerm(t, path))
+		}
+	})
+
+	t.Run("created mode ignores the umask", func(t *testing.T) {
+		old := syscall.Umask(0077)
+		t.Cleanup(func() { syscall.Umask(old) })
+
+		path := filepath.Join(t.TempDir(), "out.log")
+		file, err := OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		assert.Equal(t, os.FileMode(0640), filePerm(t, path))
+	})
+
+	t.Run("existing file is tightened and kept", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "out.log")
+		require.NoError(t, os.WriteFile(path, []byte("line 1\n"), 0644))
+		require.NoError(t, os.Chmod(path, 0666))
+
+		file, err := OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = file.WriteString("line 2\n")
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		assert.Equal(t, os.FileMode(0600), filePerm(t, path))
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "line 1\nline 2\n", string(content))
+	})
+
+	t.Run("existing narrower file is not widened", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "out.log")
+		require.NoError(t, os.WriteFile(path, nil, 0600))
+
+		file, err := OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		assert.Equal(t, os.FileMode(0600), filePerm(t, path))
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		_, err := OpenFile(filepath.Join(t.TempDir(), "missing", "out.log"), os.O_WRONLY, 0600)
+		assert.Error(t, err)
+	})
+}
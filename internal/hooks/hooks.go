@@ -0,0 +1,111 @@
+// Package hooks runs user-configured commands after device operations
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/shell"
+)
+
+// Hook names, also exported to the hook as VAULT_DM_CRYPT_HOOK
+const (
+	PostDecrypt = "post_decrypt"
+	PostEncrypt = "post_encrypt"
+	PostClose   = "post_close"
+)
+
+// defaultTimeout applies when no hook timeout is configured
+const defaultTimeout = 60 * time.Second
+
+// Executor runs a command with extra environment variables
+type Executor interface {
+	ExecuteWithEnv(ctx context.Context, env []string, command string, args ...string) (string, error)
+}
+
+// Event describes the operation a hook is run for. It never carries key material.
+type Event struct {
+	UUID         string
+	Device       string
+	MappedDevice string
+}
+
+// Runner runs the configured hooks
+type Runner struct {
+	config   config.HooksConfig
+	executor Executor
+	logger   *logrus.Logger
+}
+
+// NewRunner creates a hook runner for the given configuration
+func NewRunner(cfg config.HooksConfig, logger *logrus.Logger) *Runner {
+	return &Runner{
+		config:   cfg,
+		executor: shell.NewExecutor(logger),
+		logger:   logger,
+	}
+}
+
+// Run executes the named hook, if configured. The hook receives the UUID and mapped
+// device as arguments and VAULT_DM_CRYPT_* environment variables. A failing hook
+// returns an error only when hooks_fatal is set; otherwise it is logged.
+func (r *Runner) Run(name string, event Event) error {
+	command := r.command(name)
+	if command == "" {
+		return nil
+	}
+
+	timeout := r.config.Timeout()
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	env := []string{
+		"VAULT_DM_CRYPT_HOOK=" + name,
+		"VAULT_DM_CRYPT_UUID=" + event.UUID,
+		"VAULT_DM_CRYPT_DEVICE=" + event.Device,
+		"VAULT_DM_CRYPT_MAPPED_DEVICE=" + event.MappedDevice,
+	}
+
+	fields := logrus.Fields{
+		"hook":    name,
+		"command": command,
+		"uuid":    event.UUID,
+	}
+	r.logger.WithFields(fields).Info("Running hook")
+
+	if _, err := r.executor.ExecuteWithEnv(ctx, env, command, event.UUID, event.MappedDevice); err != nil {
+		hookErr := errors.Wrap(err, fmt.Sprintf("%s hook %s failed", name, command))
+		if r.config.Fatal {
+			return hookErr
+		}
+
+		r.logger.WithFields(fields).WithError(err).Warn("Hook failed (hooks_fatal is not set, continuing)")
+		return nil
+	}
+
+	r.logger.WithFields(fields).Info("Hook completed successfully")
+	return nil
+}
+
+// command returns the configured executable for a hook name
+func (r *Runner) command(name string) string {
+	switch name {
+	case PostDecrypt:
+		return r.config.PostDecrypt
+	case PostEncrypt:
+		return r.config.PostEncrypt
+	case PostClose:
+		return r.config.PostClose
+	default:
+		return ""
+	}
+}
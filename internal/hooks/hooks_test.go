@@ -0,0 +1,91 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755))
+	return path
+}
+
+func TestRunPassesEventToHook(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	outFile := filepath.Join(t.TempDir(), "hook.out")
+	script := writeScript(t, `echo "args=$1 $2" > "`+outFile+`"
+echo "hook=$VAULT_DM_CRYPT_HOOK" >> "`+outFile+`"
+echo "uuid=$VAULT_DM_CRYPT_UUID" >> "`+outFile+`"
+echo "device=$VAULT_DM_CRYPT_DEVICE" >> "`+outFile+`"
+echo "mapped=$VAULT_DM_CRYPT_MAPPED_DEVICE" >> "`+outFile+`"
+`)
+
+	runner := NewRunner(config.HooksConfig{PostDecrypt: script, TimeoutSecs: 10}, logger)
+	err := runner.Run(PostDecrypt, Event{
+		UUID:         "1234-uuid",
+		Device:       "/dev/sdb",
+		MappedDevice: "/dev/mapper/vaultlocker-1234uuid",
+	})
+	require.NoError(t, err)
+
+	output, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	assert.Equal(t, []string{
+		"args=1234-uuid /dev/mapper/vaultlocker-1234uuid",
+		"hook=post_decrypt",
+		"uuid=1234-uuid",
+		"device=/dev/sdb",
+		"mapped=/dev/mapper/vaultlocker-1234uuid",
+	}, lines)
+}
+
+func TestRunFailingHook(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	script := writeScript(t, "exit 3\n")
+	event := Event{UUID: "1234-uuid", MappedDevice: "/dev/mapper/test"}
+
+	t.Run("non-fatal failure is logged only", func(t *testing.T) {
+		runner := NewRunner(config.HooksConfig{PostEncrypt: script}, logger)
+		assert.NoError(t, runner.Run(PostEncrypt, event))
+	})
+
+	t.Run("fatal failure is returned", func(t *testing.T) {
+		runner := NewRunner(config.HooksConfig{PostEncrypt: script, Fatal: true}, logger)
+		err := runner.Run(PostEncrypt, event)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "post_encrypt hook")
+		assert.Contains(t, err.Error(), "exit code 3")
+	})
+
+	t.Run("hook is killed after timeout", func(t *testing.T) {
+		slow := writeScript(t, "exec sleep 5\n")
+		runner := NewRunner(config.HooksConfig{PostClose: slow, Fatal: true, TimeoutSecs: 1}, logger)
+		err := runner.Run(PostClose, event)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "timed out")
+	})
+}
+
+func TestRunUnconfiguredHook(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	runner := NewRunner(config.HooksConfig{Fatal: true}, logger)
+	assert.NoError(t, runner.Run(PostDecrypt, Event{UUID: "1234-uuid"}))
+}
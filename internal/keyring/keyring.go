@@ -0,0 +1,171 @@
+// Package keyring caches device keys in the Linux kernel keyring so boot retries can open a
+// device without another Vault read, and cryptsetup can take the key by reference.
+package keyring
+
+import (
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DescriptionPrefix prefixes the description of every key added by vault-dm-crypt
+const DescriptionPrefix = "vault-dm-crypt:"
+
+// DefaultTTL is how long a cached key stays in the keyring before the kernel expires it
+const DefaultTTL = 5 * time.Minute
+
+// keyType is the kernel key type used for cached keys; cryptsetup reads "user" keys
+const keyType = "user"
+
+// KeyDescription returns the keyring description under which the key for a device UUID is cached
+func KeyDescription(uuid string) string {
+	return DescriptionPrefix + uuid
+}
+
+// syscalls is the subset of keyctl(2)/add_key(2) used by Keyring, replaceable in tests
+type syscalls interface {
+	addKey(keyType, description string, payload []byte, ringID int) (int, error)
+	search(ringID int, keyType, description string) (int, error)
+	read(keyID int) ([]byte, error)
+	describe(keyID int) (string, error)
+	setTimeout(keyID int, seconds uint) error
+	unlink(keyID, ringID int) error
+	list(ringID int) ([]int, error)
+}
+
+// Keyring stores keys in one of the calling process's kernel keyrings
+type Keyring struct {
+	sys    syscalls
+	ringID int
+	logger *logrus.Logger
+}
+
+// New returns a Keyring backed by the user keyring, which outlives the process so that a
+// later retry (or cryptsetup itself) can find the key
+func New(logger *logrus.Logger) *Keyring {
+	return &Keyring{
+		sys:    unixSyscalls{},
+		ringID: unix.KEY_SPEC_USER_KEYRING,
+		logger: logger,
+	}
+}
+
+// Store adds a key under description, replacing any existing key, and sets it to expire after ttl.
+// A zero ttl leaves the key without an expiry.
+func (k *Keyring) Store(description string, payload []byte, ttl time.Duration) error {
+	id, err := k.sys.addKey(keyType, description, payload, k.ringID)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to add key %s to keyring", description))
+	}
+
+	if ttl > 0 {
+		if err := k.sys.setTimeout(id, uint(ttl.Round(time.Second).Seconds())); err != nil {
+			// A key without an expiry would outlive its intended lifetime; don't leave it behind
+			if unlinkErr := k.sys.unlink(id, k.ringID); unlinkErr != nil {
+				k.logger.WithError(unlinkErr).WithField("description", description).Warn("Failed to remove key from keyring")
+			}
+			return errors.Wrap(err, fmt.Sprintf("failed to set timeout on key %s", description))
+		}
+	}
+
+	k.logger.WithFields(logrus.Fields{
+		"description": description,
+		"ttl":         ttl,
+	}).Debug("Stored key in kernel keyring")
+
+	return nil
+}
+
+// Load returns the key stored under description. The boolean is false if no such key
+// exists or it has expired.
+func (k *Keyring) Load(description string) ([]byte, bool, error) {
+	id, err := k.sys.search(k.ringID, keyType, description)
+	if err != nil {
+		if isMissing(err) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, fmt.Sprintf("failed to search keyring for %s", description))
+	}
+
+	payload, err := k.sys.read(id)
+	if err != nil {
+		if isMissing(err) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, fmt.Sprintf("failed to read key %s from keyring", description))
+	}
+
+	return payload, true, nil
+}
+
+// Remove unlinks the key stored under description. Removing a missing key is not an error.
+func (k *Keyring) Remove(description string) error {
+	id, err := k.sys.search(k.ringID, keyType, description)
+	if err != nil {
+		if isMissing(err) {
+			return nil
+		}
+		return errors.Wrap(err, fmt.Sprintf("failed to search keyring for %s", description))
+	}
+
+	if err := k.sys.unlink(id, k.ringID); err != nil && !isMissing(err) {
+		return errors.Wrap(err, fmt.Sprintf("failed to remove key %s from keyring", description))
+	}
+
+	return nil
+}
+
+// Flush removes every key added by vault-dm-crypt and returns the descriptions removed
+func (k *Keyring) Flush() ([]string, error) {
+	ids, err := k.sys.list(k.ringID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list keyring")
+	}
+
+	var removed []string
+	for _, id := range ids {
+		info, err := k.sys.describe(id)
+		if err != nil {
+			// Keys can expire between listing and describing them
+			if isMissing(err) {
+				continue
+			}
+			return removed, errors.Wrap(err, fmt.Sprintf("failed to describe key %d", id))
+		}
+
+		typ, description := parseDescription(info)
+		if typ != keyType || !strings.HasPrefix(description, DescriptionPrefix) {
+			continue
+		}
+
+		if err := k.sys.unlink(id, k.ringID); err != nil && !isMissing(err) {
+			return removed, errors.Wrap(err, fmt.Sprintf("failed to remove key %s from keyring", description))
+		}
+		removed = append(removed, description)
+	}
+
+	k.logger.WithField("count", len(removed)).Debug("Flushed keys from kernel keyring")
+
+	return removed, nil
+}
+
+// parseDescription splits a KEYCTL_DESCRIBE result ("type;uid;gid;perm;description")
+// into the key type and description
+func parseDescription(info string) (string, string) {
+	parts := strings.SplitN(info, ";", 5)
+	if len(parts) != 5 {
+		return "", ""
+	}
+	return parts[0], parts[4]
+}
+
+// isMissing reports whether err means the key does not exist, has expired or was revoked
+func isMissing(err error) bool {
+	return stderrors.Is(err, unix.ENOKEY) || stderrors.Is(err, unix.EKEYEXPIRED) || stderrors.Is(err, unix.EKEYREVOKED)
+}
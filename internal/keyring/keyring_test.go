@@ -0,0 +1,190 @@
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+type mockKey struct {
+	keyType     string
+	description string
+	payload     []byte
+	timeout     uint
+}
+
+// mockSyscalls simulates a single kernel keyring
+type mockSyscalls struct {
+	nextID     int
+	keys       map[int]*mockKey
+	timeoutErr error
+}
+
+func newMockSyscalls() *mockSyscalls {
+	return &mockSyscalls{nextID: 100, keys: make(map[int]*mockKey)}
+}
+
+func (m *mockSyscalls) find(keyType, description string) (int, bool) {
+	for id, key := range m.keys {
+		if key.keyType == keyType && key.description == description {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (m *mockSyscalls) addKey(keyType, description string, payload []byte, ringID int) (int, error) {
+	// add_key updates an existing key of the same type and description in place
+	if id, ok := m.find(keyType, description); ok {
+		m.keys[id].payload = bytes.Clone(payload)
+		return id, nil
+	}
+	m.nextID++
+	m.keys[m.nextID] = &mockKey{keyType: keyType, description: description, payload: bytes.Clone(payload)}
+	return m.nextID, nil
+}
+
+func (m *mockSyscalls) search(ringID int, keyType, description string) (int, error) {
+	if id, ok := m.find(keyType, description); ok {
+		return id, nil
+	}
+	return 0, unix.ENOKEY
+}
+
+func (m *mockSyscalls) read(keyID int) ([]byte, error) {
+	key, ok := m.keys[keyID]
+	if !ok {
+		return nil, unix.ENOKEY
+	}
+	return bytes.Clone(key.payload), nil
+}
+
+func (m *mockSyscalls) describe(keyID int) (string, error) {
+	key, ok := m.keys[keyID]
+	if !ok {
+		return "", unix.ENOKEY
+	}
+	return fmt.Sprintf("%s;0;0;3f010000;%s", key.keyType, key.description), nil
+}
+
+func (m *mockSyscalls) setTimeout(keyID int, seconds uint) error {
+	if m.timeoutErr != nil {
+		return m.timeoutErr
+	}
+	m.keys[keyID].timeout = seconds
+	return nil
+}
+
+func (m *mockSyscalls) unlink(keyID, ringID int) error {
+	if _, ok := m.keys[keyID]; !ok {
+		return unix.ENOKEY
+	}
+	delete(m.keys, keyID)
+	return nil
+}
+
+func (m *mockSyscalls) list(ringID int) ([]int, error) {
+	ids := make([]int, 0, len(m.keys))
+	for id := range m.keys {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func newTestKeyring() (*Keyring, *mockSyscalls) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sys := newMockSyscalls()
+	return &Keyring{sys: sys, ringID: unix.KEY_SPEC_USER_KEYRING, logger: logger}, sys
+}
+
+func TestKeyDescription(t *testing.T) {
+	assert.Equal(t, "vault-dm-crypt:1234-abcd", KeyDescription("1234-abcd"))
+}
+
+func TestKeyringStoreLoad(t *testing.T) {
+	kr, sys := newTestKeyring()
+	desc := KeyDescription("uuid-1")
+
+	require.NoError(t, kr.Store(desc, []byte("secret"), 90*time.Second))
+
+	payload, found, err := kr.Load(desc)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("secret"), payload)
+
+	id, _ := sys.find("user", desc)
+	assert.Equal(t, uint(90), sys.keys[id].timeout)
+
+	// Storing again replaces the payload
+	require.NoError(t, kr.Store(desc, []byte("rotated"), 0))
+	payload, _, err = kr.Load(desc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("rotated"), payload)
+	assert.Len(t, sys.keys, 1)
+}
+
+func TestKeyringLoadMissing(t *testing.T) {
+	kr, _ := newTestKeyring()
+
+	payload, found, err := kr.Load(KeyDescription("missing"))
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Nil(t, payload)
+}
+
+func TestKeyringStoreTimeoutFailure(t *testing.T) {
+	kr, sys := newTestKeyring()
+	sys.timeoutErr = unix.EACCES
+
+	err := kr.Store(KeyDescription("uuid-1"), []byte("secret"), time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to set timeout")
+	assert.Empty(t, sys.keys, "key without an expiry must not be left in the keyring")
+}
+
+func TestKeyringRemove(t *testing.T) {
+	kr, sys := newTestKeyring()
+	desc := KeyDescription("uuid-1")
+
+	require.NoError(t, kr.Store(desc, []byte("secret"), time.Minute))
+	require.NoError(t, kr.Remove(desc))
+	assert.Empty(t, sys.keys)
+
+	// Removing a key that is already gone succeeds
+	require.NoError(t, kr.Remove(desc))
+}
+
+func TestKeyringFlush(t *testing.T) {
+	kr, sys := newTestKeyring()
+
+	require.NoError(t, kr.Store(KeyDescription("uuid-1"), []byte("one"), time.Minute))
+	require.NoError(t, kr.Store(KeyDescription("uuid-2"), []byte("two"), time.Minute))
+	_, _ = sys.addKey("user", "other-tool:key", []byte("keep"), 0)
+	_, _ = sys.addKey("logon", DescriptionPrefix+"logon", []byte("keep"), 0)
+
+	removed, err := kr.Flush()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{KeyDescription("uuid-1"), KeyDescription("uuid-2")}, removed)
+	assert.Len(t, sys.keys, 2)
+
+	_, found := sys.find("user", "other-tool:key")
+	assert.True(t, found)
+}
+
+func TestParseDescription(t *testing.T) {
+	typ, desc := parseDescription("user;0;0;3f010000;vault-dm-crypt:a;b")
+	assert.Equal(t, "user", typ)
+	assert.Equal(t, "vault-dm-crypt:a;b", desc)
+
+	typ, desc = parseDescription("garbage")
+	assert.Empty(t, typ)
+	assert.Empty(t, desc)
+}
@@ -0,0 +1,63 @@
+package keyring
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixSyscalls calls the kernel key management facility directly
+type unixSyscalls struct{}
+
+func (unixSyscalls) addKey(keyType, description string, payload []byte, ringID int) (int, error) {
+	return unix.AddKey(keyType, description, payload, ringID)
+}
+
+func (unixSyscalls) search(ringID int, keyType, description string) (int, error) {
+	return unix.KeyctlSearch(ringID, keyType, description, 0)
+}
+
+func (unixSyscalls) read(keyID int) ([]byte, error) {
+	// The first call reports the payload size, the second reads it
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyID, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyID, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:min(n, size)], nil
+}
+
+func (unixSyscalls) describe(keyID int) (string, error) {
+	return unix.KeyctlString(unix.KEYCTL_DESCRIBE, keyID)
+}
+
+func (unixSyscalls) setTimeout(keyID int, seconds uint) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, keyID, int(seconds), 0, 0)
+	return err
+}
+
+func (unixSyscalls) unlink(keyID, ringID int) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, keyID, ringID, 0, 0)
+	return err
+}
+
+func (s unixSyscalls) list(ringID int) ([]int, error) {
+	// Reading a keyring returns the IDs of the keys linked to it as 32-bit integers
+	data, err := s.read(ringID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(data)/4)
+	for i := 0; i+4 <= len(data); i += 4 {
+		ids = append(ids, int(int32(binary.NativeEndian.Uint32(data[i:i+4]))))
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,139 @@
+// Package keysplit splits a key into two shares that are each useless on their own, so that
+// part of it can be kept in Vault and part on the host: neither a Vault compromise nor a copy
+// of the local share is enough to unlock a device.
+package keysplit
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// SchemeXOR is a 2-of-2 split: one share is random and the other is the key XORed with it
+const SchemeXOR = "xor"
+
+// ShareFileMode restricts local share files to root
+const ShareFileMode = 0600
+
+// ErrMissingShare is returned when a share needed to recover a key is absent
+var ErrMissingShare = errors.New("key share is missing")
+
+// ErrShareMismatch is returned when two shares cannot belong to the same key
+var ErrShareMismatch = errors.New("key shares do not match")
+
+// Split splits a base64 encoded key into two base64 encoded shares with the XOR scheme
+func Split(key string) (vaultShare, localShare string, err error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to decode key")
+	}
+	defer clear(keyBytes)
+
+	if len(keyBytes) == 0 {
+		return "", "", errors.New("cannot split an empty key")
+	}
+
+	pad := make([]byte, len(keyBytes))
+	if _, err := io.ReadFull(rand.Reader, pad); err != nil {
+		return "", "", errors.Wrap(err, "failed to generate key share")
+	}
+	defer clear(pad)
+
+	masked := make([]byte, len(keyBytes))
+	defer clear(masked)
+	subtle.XORBytes(masked, keyBytes, pad)
+
+	return base64.StdEncoding.EncodeToString(pad), base64.StdEncoding.EncodeToString(masked), nil
+}
+
+// Combine recovers the base64 encoded key from the shares returned by Split
+func Combine(vaultShare, localShare string) (string, error) {
+	if vaultShare == "" || localShare == "" {
+		return "", ErrMissingShare
+	}
+
+	pad, err := base64.StdEncoding.DecodeString(vaultShare)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode Vault key share")
+	}
+	defer clear(pad)
+
+	masked, err := base64.StdEncoding.DecodeString(localShare)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode local key share")
+	}
+	defer clear(masked)
+
+	if len(pad) != len(masked) {
+		return "", fmt.Errorf("%w: Vault share is %d bytes, local share is %d bytes", ErrShareMismatch, len(pad), len(masked))
+	}
+
+	key := make([]byte, len(pad))
+	defer clear(key)
+	subtle.XORBytes(key, pad, masked)
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// SharePath returns the path of the local share for a device UUID under dir
+func SharePath(dir, uuid string) string {
+	return filepath.Join(dir, uuid+".share")
+}
+
+// WriteShare stores a local share at path with mode 0600. An existing share is never
+// replaced, since the key it belongs to may still be in use.
+func WriteShare(path, share string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, ShareFileMode)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to create key share %s", path))
+	}
+
+	if _, err := file.WriteString(share + "\n"); err != nil {
+		file.Close()
+		os.Remove(path)
+		return errors.Wrap(err, fmt.Sprintf("failed to write key share %s", path))
+	}
+
+	// The share must be on disk before the key it completes is used to format a device
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return errors.Wrap(err, fmt.Sprintf("failed to sync key share %s", path))
+	}
+
+	return file.Close()
+}
+
+// ReadShare reads a local share written by WriteShare
+func ReadShare(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s does not exist", ErrMissingShare, path)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to read key share %s", path))
+	}
+
+	share := string(data)
+	if len(share) > 0 && share[len(share)-1] == '\n' {
+		share = share[:len(share)-1]
+	}
+	if share == "" {
+		return "", fmt.Errorf("%w: %s is empty", ErrMissingShare, path)
+	}
+	return share, nil
+}
+
+// RemoveShare deletes a local share, e.g. after the device it belonged to failed to format
+func RemoveShare(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, fmt.Sprintf("failed to remove key share %s", path))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package keysplit
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 512)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestSplitAndCombine(t *testing.T) {
+	key := randomKey(t)
+
+	vaultShare, localShare, err := Split(key)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, vaultShare)
+	assert.NotEqual(t, key, localShare)
+	assert.NotEqual(t, vaultShare, localShare)
+
+	combined, err := Combine(vaultShare, localShare)
+	require.NoError(t, err)
+	assert.Equal(t, key, combined)
+
+	// Every split uses a fresh random share
+	otherVault, otherLocal, err := Split(key)
+	require.NoError(t, err)
+	assert.NotEqual(t, vaultShare, otherVault)
+	assert.NotEqual(t, localShare, otherLocal)
+
+	// Shares from different splits do not recover the key
+	mixed, err := Combine(vaultShare, otherLocal)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, mixed)
+}
+
+func TestSplitRejectsInvalidKey(t *testing.T) {
+	_, _, err := Split("not base64!")
+	assert.Error(t, err)
+
+	_, _, err = Split("")
+	assert.Error(t, err)
+}
+
+func TestCombineErrors(t *testing.T) {
+	vaultShare, localShare, err := Split(randomKey(t))
+	require.NoError(t, err)
+
+	_, err = Combine(vaultShare, "")
+	assert.True(t, errors.Is(err, ErrMissingShare))
+
+	_, err = Combine("", localShare)
+	assert.True(t, errors.Is(err, ErrMissingShare))
+
+	_, err = Combine(vaultShare, base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.True(t, errors.Is(err, ErrShareMismatch))
+
+	_, err = Combine(vaultShare, "not base64!")
+	assert.Error(t, err)
+}
+
+func TestShareFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := SharePath(dir, "1234-abcd")
+	assert.Equal(t, filepath.Join(dir, "1234-abcd.share"), path)
+
+	t.Run("missing share", func(t *testing.T) {
+		_, err := ReadShare(path)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrMissingShare))
+	})
+
+	t.Run("write and read", func(t *testing.T) {
+		require.NoError(t, WriteShare(path, "c2hhcmU="))
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(ShareFileMode), info.Mode().Perm())
+
+		share, err := ReadShare(path)
+		require.NoError(t, err)
+		assert.Equal(t, "c2hhcmU=", share)
+	})
+
+	t.Run("never overwrites", func(t *testing.T) {
+		assert.Error(t, WriteShare(path, "b3RoZXI="))
+
+		share, err := ReadShare(path)
+		require.NoError(t, err)
+		assert.Equal(t, "c2hhcmU=", share)
+	})
+
+	t.Run("empty share", func(t *testing.T) {
+		empty := SharePath(dir, "empty")
+		require.NoError(t, os.WriteFile(empty, nil, ShareFileMode))
+
+		_, err := ReadShare(empty)
+		assert.True(t, errors.Is(err, ErrMissingShare))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, RemoveShare(path))
+		require.NoError(t, RemoveShare(path))
+
+		_, err := ReadShare(path)
+		assert.True(t, errors.Is(err, ErrMissingShare))
+	})
+}
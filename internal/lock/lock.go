@@ -0,0 +1,114 @@
+// Package lock provides file-based advisory locks that serialise operations on the same device
+// and limit how many operations run at once on the host
+package lock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DefaultDir is the directory lock files are created in
+const DefaultDir = "/run/vault-dm-crypt"
+
+// pollInterval is how often a waiting Acquire retries the lock
+const pollInterval = 100 * time.Millisecond
+
+// ErrInProgress is returned when another process holds the lock
+var ErrInProgress = errors.New("operation already in progress")
+
+// Lock is an exclusive flock held on a lock file
+type Lock struct {
+	file *os.File
+	path string
+}
+
+// Acquire takes an exclusive lock for target (a device path or UUID) in dir.
+// With a zero timeout it fails fast if the lock is held; otherwise it waits up to timeout.
+func Acquire(dir, target string, timeout time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create lock directory: %s", dir))
+	}
+
+	path := filepath.Join(dir, FileName(target))
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err := tryLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			return l, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			if timeout > 0 {
+				return nil, fmt.Errorf("%w on %s (timed out after %s waiting for lock)", ErrInProgress, target, timeout)
+			}
+			return nil, fmt.Errorf("%w on %s", ErrInProgress, target)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// tryLock takes an exclusive lock on path without waiting. It returns a nil Lock if another
+// process holds it.
+func tryLock(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open lock file: %s", path))
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return &Lock{file: file, path: path}, nil
+	}
+
+	_ = file.Close()
+	if err == syscall.EWOULDBLOCK {
+		return nil, nil
+	}
+	return nil, errors.Wrap(err, fmt.Sprintf("failed to lock %s", path))
+}
+
+// Release unlocks and closes the lock file. It is safe to call on a nil Lock.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	unlockErr := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	closeErr := l.file.Close()
+	l.file = nil
+
+	if unlockErr != nil {
+		return errors.Wrap(unlockErr, fmt.Sprintf("failed to unlock %s", l.path))
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, fmt.Sprintf("failed to close lock file %s", l.path))
+	}
+
+	return nil
+}
+
+// Path returns the lock file path
+func (l *Lock) Path() string {
+	return l.path
+}
+
+// FileName returns the lock file name for a device path or UUID, e.g. "/dev/sdb" -> "dev-sdb.lock"
+func FileName(target string) string {
+	name := strings.Trim(target, "/")
+	name = strings.ReplaceAll(name, "/", "-")
+	if name == "" {
+		name = "root"
+	}
+
+	return name + ".lock"
+}
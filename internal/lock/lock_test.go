@@ -0,0 +1,72 @@
+package lock
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileName(t *testing.T) {
+	assert.Equal(t, "dev-sdb.lock", FileName("/dev/sdb"))
+	assert.Equal(t, "dev-mapper-data.lock", FileName("/dev/mapper/data"))
+	assert.Equal(t, "550e8400-e29b-41d4-a716-446655440000.lock", FileName("550e8400-e29b-41d4-a716-446655440000"))
+}
+
+func TestAcquireFailsFast(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir, "/dev/sdb", 0)
+	require.NoError(t, err)
+	defer func() { _ = first.Release() }()
+
+	start := time.Now()
+	_, err = Acquire(dir, "/dev/sdb", 0)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInProgress))
+	assert.Contains(t, err.Error(), "operation already in progress on /dev/sdb")
+	assert.Less(t, time.Since(start), time.Second)
+
+	// A different target is not blocked
+	other, err := Acquire(dir, "/dev/sdc", 0)
+	require.NoError(t, err)
+	assert.NoError(t, other.Release())
+}
+
+func TestAcquireWaitsForTimeout(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir, "uuid-1", 0)
+	require.NoError(t, err)
+	defer func() { _ = first.Release() }()
+
+	start := time.Now()
+	_, err = Acquire(dir, "uuid-1", 300*time.Millisecond)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInProgress))
+	assert.Contains(t, err.Error(), "timed out")
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestAcquireSucceedsAfterRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir, "uuid-1", 0)
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = first.Release()
+	}()
+
+	second, err := Acquire(dir, "uuid-1", 5*time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, second.Release())
+
+	// Releasing twice or releasing nil is harmless
+	assert.NoError(t, second.Release())
+	var nilLock *Lock
+	assert.NoError(t, nilLock.Release())
+}
@@ -0,0 +1,51 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// ConcurrencyDir is the directory holding the slots of the host-wide concurrency limit
+const ConcurrencyDir = DefaultDir + "/concurrency"
+
+// AcquireSlot takes one of slots lock files in dir, so that at most slots processes on the host
+// hold one at a time. It waits until a slot is free or ctx is done; onWait, if not nil, is called
+// once when all slots are busy. Release the returned Lock to free the slot.
+func AcquireSlot(ctx context.Context, dir string, slots int, onWait func()) (*Lock, error) {
+	if slots < 1 {
+		return nil, fmt.Errorf("invalid number of slots: %d", slots)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create lock directory: %s", dir))
+	}
+
+	waiting := false
+	for {
+		for i := 0; i < slots; i++ {
+			l, err := tryLock(filepath.Join(dir, fmt.Sprintf("slot-%d.lock", i)))
+			if err != nil {
+				return nil, err
+			}
+			if l != nil {
+				return l, nil
+			}
+		}
+
+		if !waiting && onWait != nil {
+			onWait()
+		}
+		waiting = true
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("all %d concurrency slots are busy: %w", slots, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
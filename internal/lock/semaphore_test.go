@@ -0,0 +1,76 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireSlotBlocksWhenFull(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	first, err := AcquireSlot(ctx, dir, 2, nil)
+	require.NoError(t, err)
+	second, err := AcquireSlot(ctx, dir, 2, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Path(), second.Path())
+
+	waited := make(chan struct{})
+	acquired := make(chan *Lock)
+	go func() {
+		third, err := AcquireSlot(ctx, dir, 2, func() { close(waited) })
+		assert.NoError(t, err)
+		acquired <- third
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("third acquirer did not wait for a slot")
+	}
+
+	select {
+	case <-acquired:
+		t.Fatal("third acquirer got a slot while both were held")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	require.NoError(t, second.Release())
+
+	select {
+	case third := <-acquired:
+		require.NotNil(t, third)
+		assert.Equal(t, second.Path(), third.Path())
+		assert.NoError(t, third.Release())
+	case <-time.After(5 * time.Second):
+		t.Fatal("third acquirer did not get the released slot")
+	}
+
+	assert.NoError(t, first.Release())
+}
+
+func TestAcquireSlotContextDone(t *testing.T) {
+	dir := t.TempDir()
+
+	held, err := AcquireSlot(context.Background(), dir, 1, nil)
+	require.NoError(t, err)
+	defer func() { _ = held.Release() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = AcquireSlot(ctx, dir, 1, nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "all 1 concurrency slots are busy")
+}
+
+func TestAcquireSlotInvalid(t *testing.T) {
+	_, err := AcquireSlot(context.Background(), t.TempDir(), 0, nil)
+	assert.Error(t, err)
+}
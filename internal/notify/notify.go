@@ -0,0 +1,119 @@
+// Package notify posts the results of device operations to a webhook
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// defaultTimeout applies when no notify timeout is configured
+const defaultTimeout = 5 * time.Second
+
+// defaultRetryDelay is the pause between delivery attempts
+const defaultRetryDelay = time.Second
+
+// Event is the JSON body posted for an operation. It never carries key material.
+type Event struct {
+	Operation string    `json:"operation"`
+	UUID      string    `json:"uuid,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// KeyFingerprint identifies the key used by the operation without exposing it
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+// Notifier posts events to the configured webhook
+type Notifier struct {
+	config     config.NotifyConfig
+	client     *http.Client
+	logger     *logrus.Logger
+	retryDelay time.Duration
+}
+
+// NewNotifier creates a notifier for the given configuration
+func NewNotifier(cfg config.NotifyConfig, logger *logrus.Logger) *Notifier {
+	timeout := cfg.Timeout()
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Notifier{
+		config:     cfg,
+		client:     &http.Client{Timeout: timeout},
+		logger:     logger,
+		retryDelay: defaultRetryDelay,
+	}
+}
+
+// Notify posts event to the webhook, if one is configured, retrying failed deliveries. Delivery
+// failures are logged and never fail the operation. It is safe to call on a nil Notifier.
+func (n *Notifier) Notify(event Event) {
+	if n == nil || n.config.WebhookURL == "" {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	fields := logrus.Fields{
+		"operation": event.Operation,
+		"uuid":      event.UUID,
+		"result":    event.Result,
+	}
+
+	var err error
+	for attempt := 0; attempt <= n.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(n.retryDelay)
+		}
+
+		if err = n.post(event); err == nil {
+			n.logger.WithFields(fields).Debug("Webhook notification delivered")
+			return
+		}
+		n.logger.WithFields(fields).WithError(err).WithField("attempt", attempt).Debug("Webhook notification failed")
+	}
+
+	n.logger.WithFields(fields).WithError(err).Warn("Failed to deliver webhook notification")
+}
+
+// post makes one delivery attempt
+func (n *Notifier) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// webhookRecorder is a webhook that records the bodies posted to it, failing the first fail requests
+type webhookRecorder struct {
+	mu     sync.Mutex
+	bodies [][]byte
+	fail   int
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bodies = append(w.bodies, body)
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(w.bodies) <= w.fail {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func newTestNotifier(url string, retries int) (*Notifier, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	n := NewNotifier(config.NotifyConfig{WebhookURL: url, TimeoutSecs: 2, Retries: retries}, logger)
+	n.retryDelay = time.Millisecond
+	return n, hook
+}
+
+func TestNotifyPostsEvent(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	n, _ := newTestNotifier(server.URL, 2)
+	n.Notify(Event{
+		Operation: "decrypt",
+		UUID:      "12345678-1234-1234-1234-123456789abc",
+		Device:    "/dev/sdb1",
+		Hostname:  "node1",
+		Result:    "failure",
+		Error:     "failed to retrieve key from Vault: connection refused",
+		Timestamp: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+	})
+
+	require.Len(t, recorder.bodies, 1)
+
+	var posted map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.bodies[0], &posted))
+	assert.Equal(t, map[string]interface{}{
+		"operation": "decrypt",
+		"uuid":      "12345678-1234-1234-1234-123456789abc",
+		"device":    "/dev/sdb1",
+		"hostname":  "node1",
+		"result":    "failure",
+		"error":     "failed to retrieve key from Vault: connection refused",
+		"timestamp": "2025-01-01T12:00:00Z",
+	}, posted)
+}
+
+func TestNotifyRetries(t *testing.T) {
+	t.Run("delivered after failures", func(t *testing.T) {
+		recorder := &webhookRecorder{fail: 2}
+		server := httptest.NewServer(recorder)
+		defer server.Close()
+
+		n, hook := newTestNotifier(server.URL, 2)
+		n.Notify(Event{Operation: "encrypt", Result: "success"})
+
+		assert.Len(t, recorder.bodies, 3)
+		for _, entry := range hook.AllEntries() {
+			assert.NotEqual(t, logrus.WarnLevel, entry.Level)
+		}
+	})
+
+	t.Run("gives up softly", func(t *testing.T) {
+		recorder := &webhookRecorder{fail: 10}
+		server := httptest.NewServer(recorder)
+		defer server.Close()
+
+		n, hook := newTestNotifier(server.URL, 1)
+		n.Notify(Event{Operation: "encrypt", Result: "success"})
+
+		assert.Len(t, recorder.bodies, 2)
+		require.NotNil(t, hook.LastEntry())
+		assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+		assert.Equal(t, "Failed to deliver webhook notification", hook.LastEntry().Message)
+	})
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	n, hook := newTestNotifier("", 2)
+	n.Notify(Event{Operation: "decrypt", Result: "success"})
+	assert.Empty(t, hook.AllEntries())
+
+	var nilNotifier *Notifier
+	nilNotifier.Notify(Event{Operation: "decrypt", Result: "success"})
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -12,6 +14,26 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// CommandError is returned when a command exits non-zero. Stdout and Stderr are kept apart
+// because tools such as cryptsetup explain failures on stderr only.
+type CommandError struct {
+	Command  string
+	Args     []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// Error implements the error interface
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command failed with exit code %d: %s (stderr: %s)", e.ExitCode, e.Command, e.Stderr)
+}
+
+// CommandStderr returns the trimmed stderr of the failed command
+func (e *CommandError) CommandStderr() string {
+	return strings.TrimSpace(e.Stderr)
+}
+
 // Executor handles command execution with proper logging and error handling
 type Executor struct {
 	logger *logrus.Logger
@@ -40,6 +62,12 @@ func (e *Executor) ExecuteWithTimeout(timeout time.Duration, command string, arg
 
 // ExecuteWithContext runs a command with a given context
 func (e *Executor) ExecuteWithContext(ctx context.Context, command string, args ...string) (string, error) {
+	return e.ExecuteWithEnv(ctx, nil, command, args...)
+}
+
+// ExecuteWithEnv runs a command with a given context and extra environment variables
+// ("KEY=value") added to the current process environment
+func (e *Executor) ExecuteWithEnv(ctx context.Context, env []string, command string, args ...string) (string, error) {
 	e.logger.WithFields(logrus.Fields{
 		"command": command,
 		"args":    args,
@@ -47,16 +75,22 @@ func (e *Executor) ExecuteWithContext(ctx context.Context, command string, args
 
 	// Create the command
 	cmd := exec.CommandContext(ctx, command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
-	// Capture stdout and stderr
+	// Capture stdout and stderr separately; stderr is also streamed to the debug log as it is
+	// written, so progress and warnings from long operations are visible before they finish
 	var stdout, stderr bytes.Buffer
+	stream := &lineLogger{logger: e.logger, command: command}
 	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Stderr = io.MultiWriter(&stderr, stream)
 
 	// Execute the command
 	startTime := time.Now()
 	err := cmd.Run()
 	duration := time.Since(startTime)
+	stream.flush()
 
 	// Get output
 	stdoutStr := stdout.String()
@@ -82,7 +116,13 @@ func (e *Executor) ExecuteWithContext(ctx context.Context, command string, args
 		var exitError *exec.ExitError
 		if errors.As(err, &exitError) {
 			e.logger.WithFields(logFields).WithField("exit_code", exitError.ExitCode()).Error("Command failed")
-			return "", fmt.Errorf("command failed with exit code %d: %s (stderr: %s)", exitError.ExitCode(), command, stderrStr)
+			return "", &CommandError{
+				Command:  command,
+				Args:     args,
+				ExitCode: exitError.ExitCode(),
+				Stdout:   stdoutStr,
+				Stderr:   stderrStr,
+			}
 		}
 
 		e.logger.WithFields(logFields).WithError(err).Error("Command execution failed")
@@ -93,6 +133,40 @@ func (e *Executor) ExecuteWithContext(ctx context.Context, command string, args
 	return stdoutStr, nil
 }
 
+// lineLogger logs each complete line written to it at debug level
+type lineLogger struct {
+	logger  *logrus.Logger
+	command string
+	partial []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any trailing output without a newline
+func (l *lineLogger) flush() {
+	if len(l.partial) > 0 {
+		l.log(l.partial)
+		l.partial = nil
+	}
+}
+
+func (l *lineLogger) log(line []byte) {
+	if text := strings.TrimSpace(string(line)); text != "" {
+		l.logger.WithField("command", l.command).Debug("stderr: " + text)
+	}
+}
+
 // ExecuteQuiet runs a command without detailed logging (for sensitive operations)
 func (e *Executor) ExecuteQuiet(command string, args ...string) (string, error) {
 	e.logger.WithField("command", command).Debug("Executing command (quiet mode)")
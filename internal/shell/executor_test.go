@@ -2,11 +2,15 @@ package shell
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewExecutor(t *testing.T) {
@@ -56,6 +60,33 @@ func TestExecute(t *testing.T) {
 	})
 }
 
+func TestExecuteCommandError(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	executor := NewExecutor(logger)
+
+	_, err := executor.Execute("sh", "-c", "echo distinct stdout; echo first warning >&2; printf 'no key available' >&2; exit 3")
+	require.Error(t, err)
+
+	var cmdErr *CommandError
+	require.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "sh", cmdErr.Command)
+	assert.Equal(t, 3, cmdErr.ExitCode)
+	assert.Equal(t, "distinct stdout\n", cmdErr.Stdout)
+	assert.Equal(t, "first warning\nno key available", cmdErr.CommandStderr())
+	assert.Contains(t, err.Error(), "exit code 3")
+	assert.NotContains(t, err.Error(), "distinct stdout")
+
+	// Each stderr line is streamed to the debug log, including a trailing partial line
+	var streamed []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.DebugLevel && entry.Data["command"] == "sh" && strings.HasPrefix(entry.Message, "stderr: ") {
+			streamed = append(streamed, entry.Message)
+		}
+	}
+	assert.Equal(t, []string{"stderr: first warning", "stderr: no key available"}, streamed)
+}
+
 func TestExecuteWithTimeout(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel)
@@ -108,6 +139,24 @@ func TestExecuteWithContext(t *testing.T) {
 	})
 }
 
+func TestExecuteWithEnv(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	executor := NewExecutor(logger)
+
+	t.Run("extra variables are visible", func(t *testing.T) {
+		output, err := executor.ExecuteWithEnv(context.Background(), []string{"SHELL_TEST_VAR=hello"}, "sh", "-c", "echo $SHELL_TEST_VAR")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", output)
+	})
+
+	t.Run("process environment is inherited", func(t *testing.T) {
+		output, err := executor.ExecuteWithEnv(context.Background(), []string{"SHELL_TEST_VAR=hello"}, "sh", "-c", "echo $PATH")
+		assert.NoError(t, err)
+		assert.NotEqual(t, "\n", output)
+	})
+}
+
 func TestExecuteQuiet(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel)
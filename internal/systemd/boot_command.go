@@ -0,0 +1,165 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// decryptTemplateName is the template unit of the per-device decrypt services
+const decryptTemplateName = "vault-dm-crypt-decrypt@.service"
+
+// BootCommand returns the command lines the decrypt service of uuid runs at boot. They are
+// resolved the way systemd resolves them: from the template unit installed in dir, or rendered
+// from opts as install-systemd would when none is installed, with the instance's drop-ins
+// applied in name order and the %i specifier and Environment= variables substituted.
+func (sm *Manager) BootCommand(dir, uuid string, opts UnitOptions) ([]string, error) {
+	templatePath := filepath.Join(dir, decryptTemplateName)
+	unit, err := os.ReadFile(templatePath)
+	if os.IsNotExist(err) {
+		sm.logger.WithField("path", templatePath).Debug("Decrypt unit not installed, rendering it")
+		units, renderErr := RenderUnits(opts)
+		if renderErr != nil {
+			return nil, renderErr
+		}
+		unit, err = units[decryptTemplateName], nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read unit file: %s", templatePath))
+	}
+
+	dropIns, err := filepath.Glob(filepath.Join(dir, sm.CreateDecryptServiceName(uuid)+".d", "*.conf"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list drop-ins")
+	}
+	sort.Strings(dropIns)
+
+	var execStart []string
+	env := make(map[string]string)
+	applyServiceSettings(unit, &execStart, env)
+	for _, path := range dropIns {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to read drop-in: %s", path))
+		}
+		applyServiceSettings(data, &execStart, env)
+	}
+
+	if len(execStart) == 0 {
+		return nil, errors.New(fmt.Sprintf("no ExecStart is configured for %s", sm.CreateDecryptServiceName(uuid)))
+	}
+
+	commands := make([]string, 0, len(execStart))
+	for _, command := range execStart {
+		commands = append(commands, expandEnvironment(expandSpecifiers(command, uuid), env))
+	}
+	return commands, nil
+}
+
+// InstalledBinaryPath returns the vault-dm-crypt binary the decrypt template unit installed in
+// dir runs, so drop-ins written later run the same binary as install-systemd --binary-path set
+// up. DefaultBinaryPath is returned when no template unit is installed or it cannot be read.
+func (sm *Manager) InstalledBinaryPath(dir string) string {
+	unit, err := os.ReadFile(filepath.Join(dir, decryptTemplateName))
+	if err != nil {
+		return DefaultBinaryPath
+	}
+
+	var execStart []string
+	applyServiceSettings(unit, &execStart, make(map[string]string))
+	if len(execStart) == 0 {
+		return DefaultBinaryPath
+	}
+
+	// Skip the special executable prefixes systemd allows, such as "-" to ignore failure
+	fields := strings.Fields(strings.TrimLeft(execStart[0], "-@:+!"))
+	if len(fields) == 0 {
+		return DefaultBinaryPath
+	}
+	return fields[0]
+}
+
+// applyServiceSettings applies the ExecStart= and Environment= lines of the [Service] section of
+// a unit or drop-in. As in systemd, an empty assignment clears the values set so far.
+func applyServiceSettings(data []byte, execStart *[]string, env map[string]string) {
+	var section string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if section != "[Service]" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "ExecStart":
+			if value == "" {
+				*execStart = nil
+				continue
+			}
+			*execStart = append(*execStart, value)
+		case "Environment":
+			if value == "" {
+				clear(env)
+				continue
+			}
+			for _, assignment := range strings.Fields(value) {
+				name, val, ok := strings.Cut(strings.Trim(assignment, `"`), "=")
+				if ok {
+					env[name] = val
+				}
+			}
+		}
+	}
+}
+
+// expandSpecifiers substitutes the instance name for %i and %I and a literal percent sign for %%.
+// Other specifiers are left as they are.
+func expandSpecifiers(command, instance string) string {
+	var buf strings.Builder
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' || i+1 == len(command) {
+			buf.WriteByte(command[i])
+			continue
+		}
+
+		switch command[i+1] {
+		case 'i', 'I':
+			buf.WriteString(instance)
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteString(command[i : i+2])
+		}
+		i++
+	}
+	return buf.String()
+}
+
+// expandEnvironment substitutes $NAME and ${NAME} for the variables set with Environment=
+func expandEnvironment(command string, env map[string]string) string {
+	return os.Expand(command, func(name string) string {
+		if value, ok := env[name]; ok {
+			return value
+		}
+		return "$" + name
+	})
+}
@@ -0,0 +1,107 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootCommand(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	manager.executor = NewMockExecutor()
+
+	uuid := "550e8400-e29b-41d4-a716-446655440000"
+
+	// execStart returns the ExecStart lines of a unit or drop-in with the instance and timeout substituted
+	execStart := func(content []byte) []string {
+		var commands []string
+		for _, match := range regexp.MustCompile(`(?m)^ExecStart=(.+)$`).FindAllStringSubmatch(string(content), -1) {
+			command := strings.ReplaceAll(match[1], "%i", uuid)
+			command = strings.ReplaceAll(command, "%%", "%")
+			commands = append(commands, strings.ReplaceAll(command, "$VAULT_DM_CRYPT_TIMEOUT", "10000"))
+		}
+		return commands
+	}
+
+	t.Run("unit not installed", func(t *testing.T) {
+		opts := UnitOptions{BinaryPath: "/opt/vault-dm-crypt/bin/vault-dm-crypt"}
+		units, err := RenderUnits(opts)
+		require.NoError(t, err)
+
+		commands, err := manager.BootCommand(t.TempDir(), uuid, opts)
+		require.NoError(t, err)
+		assert.Equal(t, execStart(units["vault-dm-crypt-decrypt@.service"]), commands)
+		assert.Equal(t, []string{"/opt/vault-dm-crypt/bin/vault-dm-crypt --retry 10000 decrypt " + uuid}, commands)
+	})
+
+	t.Run("installed unit wins over rendering", func(t *testing.T) {
+		unitDir := t.TempDir()
+		_, err := manager.writeUnits(unitDir, UnitOptions{BinaryPath: "/usr/local/bin/vault-dm-crypt"})
+		require.NoError(t, err)
+
+		commands, err := manager.BootCommand(unitDir, uuid, UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/local/bin/vault-dm-crypt --retry 10000 decrypt " + uuid}, commands)
+	})
+
+	t.Run("instance override keeps a custom binary path", func(t *testing.T) {
+		unitDir := t.TempDir()
+		_, err := manager.writeUnits(unitDir, UnitOptions{BinaryPath: "/opt/vault-dm-crypt/bin/vault-dm-crypt"})
+		require.NoError(t, err)
+		assert.Equal(t, "/opt/vault-dm-crypt/bin/vault-dm-crypt", manager.InstalledBinaryPath(unitDir))
+
+		_, err = manager.writeInstanceOverride(unitDir, uuid, "/etc/vault-dm-crypt/tier-2.toml")
+		require.NoError(t, err)
+
+		commands, err := manager.BootCommand(unitDir, uuid, UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{`/opt/vault-dm-crypt/bin/vault-dm-crypt --config "/etc/vault-dm-crypt/tier-2.toml" --retry 10000 decrypt ` + uuid}, commands)
+	})
+
+	t.Run("binary path without an installed unit", func(t *testing.T) {
+		assert.Equal(t, DefaultBinaryPath, manager.InstalledBinaryPath(t.TempDir()))
+	})
+
+	t.Run("instance override", func(t *testing.T) {
+		unitDir := t.TempDir()
+		_, err := manager.writeUnits(unitDir, UnitOptions{})
+		require.NoError(t, err)
+		path, err := manager.writeInstanceOverride(unitDir, uuid, "/etc/vault-dm-crypt/100%.toml", "--profile", "cold")
+		require.NoError(t, err)
+		_, err = manager.setBootPriority(unitDir, uuid, 10)
+		require.NoError(t, err)
+
+		override, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		commands, err := manager.BootCommand(unitDir, uuid, UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, execStart(override), commands)
+		assert.Equal(t, []string{`/usr/bin/vault-dm-crypt --config "/etc/vault-dm-crypt/100%.toml" --retry 10000 decrypt --profile cold ` + uuid}, commands)
+
+		// Other instances are unaffected by the drop-in
+		other := "123e4567-e89b-12d3-a456-426614174000"
+		commands, err = manager.BootCommand(unitDir, other, UnitOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/bin/vault-dm-crypt --retry 10000 decrypt " + other}, commands)
+	})
+
+	t.Run("drop-in clears ExecStart", func(t *testing.T) {
+		unitDir := t.TempDir()
+		dropInDir := filepath.Join(unitDir, manager.CreateDecryptServiceName(uuid)+".d")
+		require.NoError(t, os.MkdirAll(dropInDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "disable.conf"), []byte("[Service]\nExecStart=\n"), 0644))
+
+		_, err := manager.BootCommand(unitDir, uuid, UnitOptions{})
+		assert.Error(t, err)
+	})
+}
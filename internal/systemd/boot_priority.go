@@ -0,0 +1,137 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// priorityOverrideName is the drop-in holding a decrypt service instance's boot priority
+const priorityOverrideName = "priority.conf"
+
+// priorityKey records the priority in the drop-in; systemd ignores [Unit] keys starting with X-
+const priorityKey = "X-VaultDMCryptBootPriority"
+
+// PriorityOverridePath returns the drop-in path holding the boot priority of uuid's decrypt service in dir
+func (sm *Manager) PriorityOverridePath(dir, uuid string) string {
+	return filepath.Join(dir, sm.CreateDecryptServiceName(uuid)+".d", priorityOverrideName)
+}
+
+// RenderPriorityOverride renders a drop-in giving a decrypt service instance priority and
+// ordering it after the instances in after, which have lower priorities
+func RenderPriorityOverride(priority int, after []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Written by vault-dm-crypt encrypt --boot-priority: lower priorities are decrypted first\n")
+	buf.WriteString("[Unit]\n")
+	fmt.Fprintf(&buf, "%s=%d\n", priorityKey, priority)
+	for _, service := range after {
+		fmt.Fprintf(&buf, "After=%s\n", service)
+	}
+	return buf.Bytes()
+}
+
+// SetBootPriority gives the decrypt service of uuid a boot priority and reorders every decrypt
+// service instance with one, so that instances with lower priorities are decrypted first, and
+// reloads the daemon. Instances without a priority are not ordered.
+func (sm *Manager) SetBootPriority(uuid string, priority int) error {
+	if _, err := sm.setBootPriority(UnitDir, uuid, priority); err != nil {
+		return err
+	}
+
+	return sm.ReloadDaemon()
+}
+
+// setBootPriority records priority for uuid under dir and rewrites the priority drop-in of every
+// prioritised instance, returning the paths written. Ordering is one-sided, each instance only
+// lists the ones it comes after, so rewriting them all keeps a changed priority from leaving a cycle.
+func (sm *Manager) setBootPriority(dir, uuid string, priority int) ([]string, error) {
+	priorities, err := sm.readBootPriorities(dir)
+	if err != nil {
+		return nil, err
+	}
+	priorities[sm.CreateDecryptServiceName(uuid)] = priority
+
+	services := make([]string, 0, len(priorities))
+	for service := range priorities {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	written := make([]string, 0, len(services))
+	for _, service := range services {
+		var after []string
+		for _, other := range services {
+			if priorities[other] < priorities[service] {
+				after = append(after, other)
+			}
+		}
+
+		path := filepath.Join(dir, service+".d", priorityOverrideName)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to create drop-in directory: %s", filepath.Dir(path)))
+		}
+		if err := os.WriteFile(path, RenderPriorityOverride(priorities[service], after), 0644); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to write drop-in: %s", path))
+		}
+		written = append(written, path)
+	}
+
+	sm.logger.WithFields(logrus.Fields{
+		"uuid":     uuid,
+		"priority": priority,
+		"services": len(services),
+	}).Info("Wrote decrypt service boot priority")
+
+	return written, nil
+}
+
+// readBootPriorities returns the boot priority recorded for each decrypt service instance under dir
+func (sm *Manager) readBootPriorities(dir string) (map[string]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "vault-dm-crypt-decrypt@*.service.d", priorityOverrideName))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list boot priority drop-ins")
+	}
+
+	priorities := make(map[string]int, len(paths))
+	for _, path := range paths {
+		priority, ok, err := readPriorityOverride(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			priorities[strings.TrimSuffix(filepath.Base(filepath.Dir(path)), ".d")] = priority
+		}
+	}
+	return priorities, nil
+}
+
+// readPriorityOverride reads the priority recorded in a drop-in written by RenderPriorityOverride
+func readPriorityOverride(path string) (int, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, errors.Wrap(err, fmt.Sprintf("failed to read drop-in: %s", path))
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(strings.TrimSpace(scanner.Text()), priorityKey+"=")
+		if !found {
+			continue
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false, errors.New(fmt.Sprintf("invalid boot priority in %s: %q", path, value))
+		}
+		return priority, true, nil
+	}
+	return 0, false, nil
+}
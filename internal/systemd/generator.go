@@ -0,0 +1,54 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// GeneratorTarget is the target generated decrypt units are pulled in by
+const GeneratorTarget = "cryptsetup.target"
+
+// GenerateDecryptUnits writes the decrypt template unit into destDir, a systemd generator
+// output directory, with a cryptsetup.target.wants/ link instantiating it for each UUID.
+// Nothing outside destDir is touched and the daemon is not reloaded, as systemd loads
+// generator output itself.
+func (sm *Manager) GenerateDecryptUnits(destDir string, opts UnitOptions, uuids []string) ([]string, error) {
+	units, err := RenderUnits(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create unit directory: %s", destDir))
+	}
+
+	path := filepath.Join(destDir, decryptTemplateName)
+	if err := os.WriteFile(path, units[decryptTemplateName], 0644); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to write unit file: %s", path))
+	}
+
+	links, err := sm.linkDecryptInstances(destDir, GeneratorTarget, uuids)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.logger.WithFields(logrus.Fields{
+		"dest_dir": destDir,
+		"devices":  len(uuids),
+	}).Debug("Generated decrypt units")
+
+	return append([]string{path}, links...), nil
+}
+
+// GenerateInstanceOverride writes a drop-in into destDir, a systemd generator output directory,
+// making the generated decrypt service of uuid use configPath, if given, and pass decryptArgs to
+// decrypt. The template written by GenerateDecryptUnits must already be in destDir, since the
+// drop-in keeps the binary it runs.
+func (sm *Manager) GenerateInstanceOverride(destDir, uuid, configPath string, decryptArgs ...string) (string, error) {
+	return sm.writeInstanceOverride(destDir, uuid, configPath, decryptArgs...)
+}
@@ -0,0 +1,90 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateDecryptUnits(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	mockExecutor := NewMockExecutor()
+	manager.executor = mockExecutor
+
+	destDir := filepath.Join(t.TempDir(), "generator")
+	uuids := []string{"550E8400-E29B-41D4-A716-446655440000", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"}
+
+	written, err := manager.GenerateDecryptUnits(destDir, UnitOptions{BinaryPath: "/usr/local/bin/vault-dm-crypt"}, uuids)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(destDir, "vault-dm-crypt-decrypt@.service"),
+		filepath.Join(destDir, "cryptsetup.target.wants", "vault-dm-crypt-decrypt@550e8400-e29b-41d4-a716-446655440000.service"),
+		filepath.Join(destDir, "cryptsetup.target.wants", "vault-dm-crypt-decrypt@6ba7b810-9dad-11d1-80b4-00c04fd430c8.service"),
+	}, written)
+
+	content, err := os.ReadFile(written[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "ExecStart=/usr/local/bin/vault-dm-crypt ")
+	assert.Contains(t, string(content), "Before=cryptsetup.target")
+
+	for _, link := range written[1:] {
+		target, err := os.Readlink(link)
+		require.NoError(t, err)
+		assert.Equal(t, "../vault-dm-crypt-decrypt@.service", target)
+	}
+
+	// Only the decrypt template is generated
+	entries, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Generators must not touch the running system
+	assert.Empty(t, mockExecutor.GetExecutedCommands())
+
+	// Regenerating is idempotent
+	_, err = manager.GenerateDecryptUnits(destDir, UnitOptions{}, uuids)
+	assert.NoError(t, err)
+}
+
+func TestGenerateDecryptUnitsWithoutDevices(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	destDir := t.TempDir()
+	written, err := NewManager(logger).GenerateDecryptUnits(destDir, UnitOptions{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(destDir, "vault-dm-crypt-decrypt@.service")}, written)
+
+	_, err = os.Stat(filepath.Join(destDir, "cryptsetup.target.wants"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGenerateInstanceOverride(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	mockExecutor := NewMockExecutor()
+	manager.executor = mockExecutor
+
+	const uuid = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	destDir := t.TempDir()
+	_, err := manager.GenerateDecryptUnits(destDir, UnitOptions{BinaryPath: "/usr/local/bin/vault-dm-crypt"}, []string{uuid})
+	require.NoError(t, err)
+
+	path, err := manager.GenerateInstanceOverride(destDir, uuid, "", "--profile", "cold")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(destDir, "vault-dm-crypt-decrypt@"+uuid+".service.d", "override.conf"), path)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "ExecStart=/usr/local/bin/vault-dm-crypt --retry $VAULT_DM_CRYPT_TIMEOUT decrypt --profile cold %i")
+	assert.Empty(t, mockExecutor.GetExecutedCommands())
+}
@@ -0,0 +1,66 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Init systems recognised by DetectInitSystem
+const (
+	InitSystemd = "systemd"
+	InitOpenRC  = "openrc"
+	InitRunit   = "runit"
+	InitSysV    = "sysvinit"
+	InitUnknown = "unknown"
+)
+
+// DetectInitSystem identifies the init system of the running host
+func DetectInitSystem() string {
+	return detectInitSystem("/")
+}
+
+// detectInitSystem identifies the init system of the host whose filesystem is at root.
+// /run/systemd/system is the check sd_booted(3) uses; otherwise PID 1's name decides.
+func detectInitSystem(root string) string {
+	if info, err := os.Stat(filepath.Join(root, "run/systemd/system")); err == nil && info.IsDir() {
+		return InitSystemd
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "proc/1/comm"))
+	if err != nil {
+		return InitUnknown
+	}
+
+	switch comm := strings.TrimSpace(string(data)); {
+	case comm == "systemd":
+		return InitSystemd
+	case comm == "openrc-init":
+		return InitOpenRC
+	case comm == "runit" || comm == "runit-init":
+		return InitRunit
+	case comm == "init":
+		// OpenRC is commonly started by sysvinit's init
+		if _, err := os.Stat(filepath.Join(root, "run/openrc")); err == nil {
+			return InitOpenRC
+		}
+		return InitSysV
+	default:
+		return InitUnknown
+	}
+}
+
+// BootInstructions explains how to run command at boot on a host without systemd
+func BootInstructions(initSystem, command string) string {
+	switch initSystem {
+	case InitOpenRC:
+		return fmt.Sprintf("add %q to /etc/local.d/vault-dm-crypt.start, make it executable and run 'rc-update add local default'", command)
+	case InitRunit:
+		return fmt.Sprintf("add %q to /etc/rc.local, or a core service under /etc/runit/core-services/", command)
+	case InitSysV:
+		return fmt.Sprintf("add %q to /etc/rc.local, after networking is up", command)
+	default:
+		return fmt.Sprintf("add %q to your boot scripts, after networking is up", command)
+	}
+}
@@ -0,0 +1,59 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectInitSystem(t *testing.T) {
+	tests := []struct {
+		name       string
+		systemdDir bool
+		openrcDir  bool
+		comm       string
+		want       string
+	}{
+		{name: "systemd runtime directory", systemdDir: true, comm: "systemd", want: InitSystemd},
+		{name: "systemd directory without comm", systemdDir: true, want: InitSystemd},
+		{name: "systemd comm without directory", comm: "systemd", want: InitSystemd},
+		{name: "openrc-init", comm: "openrc-init", want: InitOpenRC},
+		{name: "openrc under sysvinit", comm: "init", openrcDir: true, want: InitOpenRC},
+		{name: "runit", comm: "runit", want: InitRunit},
+		{name: "sysvinit", comm: "init", want: InitSysV},
+		{name: "container entrypoint", comm: "bash", want: InitUnknown},
+		{name: "no proc", want: InitUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.systemdDir {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "run/systemd/system"), 0755))
+			}
+			if tt.openrcDir {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "run/openrc"), 0755))
+			}
+			if tt.comm != "" {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "proc/1"), 0755))
+				require.NoError(t, os.WriteFile(filepath.Join(root, "proc/1/comm"), []byte(tt.comm+"\n"), 0644))
+			}
+
+			assert.Equal(t, tt.want, detectInitSystem(root))
+		})
+	}
+}
+
+func TestBootInstructions(t *testing.T) {
+	command := "/usr/bin/vault-dm-crypt decrypt 1234-abcd"
+
+	assert.Contains(t, BootInstructions(InitOpenRC, command), "/etc/local.d/")
+	assert.Contains(t, BootInstructions(InitSysV, command), "/etc/rc.local")
+	assert.Contains(t, BootInstructions(InitUnknown, command), "your boot scripts")
+	for _, initSystem := range []string{InitOpenRC, InitRunit, InitSysV, InitUnknown} {
+		assert.Contains(t, BootInstructions(initSystem, command), command)
+	}
+}
@@ -0,0 +1,230 @@
+package systemd
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// UnitDir is the directory live unit files are installed into
+const UnitDir = "/etc/systemd/system"
+
+// DefaultBinaryPath is the vault-dm-crypt path referenced by the rendered units
+const DefaultBinaryPath = "/usr/bin/vault-dm-crypt"
+
+//go:embed units/*.tmpl
+var unitTemplates embed.FS
+
+// DefaultCredentialDir is where LoadCredential= sources credentials from on the host
+const DefaultCredentialDir = "/etc/vault-dm-crypt/credentials"
+
+// UnitOptions controls how the embedded unit templates are rendered
+type UnitOptions struct {
+	BinaryPath string
+
+	// SecretIDCredential, when set, adds a LoadCredential= line passing
+	// CredentialDir/<name> to the service as the AppRole secret ID
+	SecretIDCredential string
+	CredentialDir      string
+}
+
+// RenderUnits renders all embedded unit templates, keyed by unit file name
+func RenderUnits(opts UnitOptions) (map[string][]byte, error) {
+	if opts.BinaryPath == "" {
+		opts.BinaryPath = DefaultBinaryPath
+	}
+	if opts.CredentialDir == "" {
+		opts.CredentialDir = DefaultCredentialDir
+	}
+
+	entries, err := unitTemplates.ReadDir("units")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read embedded unit templates")
+	}
+
+	units := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		tmpl, err := template.ParseFS(unitTemplates, "units/"+entry.Name())
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to parse unit template %s", entry.Name()))
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, opts); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to render unit template %s", entry.Name()))
+		}
+
+		units[strings.TrimSuffix(entry.Name(), ".tmpl")] = buf.Bytes()
+	}
+
+	return units, nil
+}
+
+// InstallUnits renders the unit files into the live systemd directory and reloads the daemon
+func (sm *Manager) InstallUnits(opts UnitOptions) error {
+	if _, err := sm.writeUnits(UnitDir, opts); err != nil {
+		return err
+	}
+
+	return sm.ReloadDaemon()
+}
+
+// WriteUnits renders the unit files into outputDir without touching the running system.
+// For each UUID in enableUUIDs a multi-user.target.wants/ symlink is created, mirroring systemctl enable.
+func (sm *Manager) WriteUnits(outputDir string, opts UnitOptions, enableUUIDs []string) ([]string, error) {
+	written, err := sm.writeUnits(outputDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := sm.linkDecryptInstances(outputDir, "multi-user.target", enableUUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(written, links...), nil
+}
+
+// linkDecryptInstances creates a <target>.wants/ symlink in dir to the decrypt template unit
+// for each UUID, returning the links created
+func (sm *Manager) linkDecryptInstances(dir, target string, uuids []string) ([]string, error) {
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+
+	wantsDir := filepath.Join(dir, target+".wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create directory: %s", wantsDir))
+	}
+
+	links := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		linkPath := filepath.Join(wantsDir, sm.CreateDecryptServiceName(uuid))
+		linkTarget := filepath.Join("..", decryptTemplateName)
+
+		if err := os.Remove(linkPath); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to replace existing link: %s", linkPath))
+		}
+		if err := os.Symlink(linkTarget, linkPath); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to create enable link: %s", linkPath))
+		}
+
+		links = append(links, linkPath)
+	}
+
+	return links, nil
+}
+
+// writeUnits renders the unit files into dir, returning the paths written
+func (sm *Manager) writeUnits(dir string, opts UnitOptions) ([]string, error) {
+	units, err := RenderUnits(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create unit directory: %s", dir))
+	}
+
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	written := make([]string, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, units[name], 0644); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to write unit file: %s", path))
+		}
+
+		sm.logger.WithFields(logrus.Fields{
+			"unit": name,
+			"path": path,
+		}).Debug("Wrote systemd unit file")
+
+		written = append(written, path)
+	}
+
+	return written, nil
+}
+
+// instanceOverrideName is the drop-in file written for a single decrypt service instance
+const instanceOverrideName = "override.conf"
+
+// InstanceOverridePath returns the drop-in path overriding the decrypt service of uuid in dir
+func (sm *Manager) InstanceOverridePath(dir, uuid string) string {
+	return filepath.Join(dir, sm.CreateDecryptServiceName(uuid)+".d", instanceOverrideName)
+}
+
+// RenderInstanceOverride renders a drop-in making a decrypt service instance use configPath,
+// if given, and pass decryptArgs to decrypt
+func RenderInstanceOverride(binaryPath, configPath string, decryptArgs ...string) []byte {
+	if binaryPath == "" {
+		binaryPath = DefaultBinaryPath
+	}
+
+	// systemd expands % specifiers in ExecStart, so literal percent signs must be doubled
+	var globalArgs string
+	if configPath != "" {
+		globalArgs = fmt.Sprintf(" --config %q", strings.ReplaceAll(configPath, "%", "%%"))
+	}
+	var extraArgs string
+	for _, arg := range decryptArgs {
+		extraArgs += " " + strings.ReplaceAll(arg, "%", "%%")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Written by vault-dm-crypt encrypt: decrypt this device with its own configuration\n")
+	buf.WriteString("[Service]\n")
+	buf.WriteString("ExecStart=\n")
+	fmt.Fprintf(&buf, "ExecStart=%s%s --retry $VAULT_DM_CRYPT_TIMEOUT decrypt%s %%i\n", binaryPath, globalArgs, extraArgs)
+	return buf.Bytes()
+}
+
+// WriteInstanceOverride writes a drop-in for the decrypt service of uuid so that it is decrypted
+// with configPath instead of the default configuration and with decryptArgs, and reloads the
+// daemon. An empty configPath keeps the default configuration.
+func (sm *Manager) WriteInstanceOverride(uuid, configPath string, decryptArgs ...string) error {
+	if _, err := sm.writeInstanceOverride(UnitDir, uuid, configPath, decryptArgs...); err != nil {
+		return err
+	}
+
+	return sm.ReloadDaemon()
+}
+
+// writeInstanceOverride writes the drop-in for uuid under dir, returning its path
+func (sm *Manager) writeInstanceOverride(dir, uuid, configPath string, decryptArgs ...string) (string, error) {
+	if configPath != "" && !filepath.IsAbs(configPath) {
+		return "", errors.New(fmt.Sprintf("config path must be absolute: %s", configPath))
+	}
+
+	path := sm.InstanceOverridePath(dir, uuid)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to create drop-in directory: %s", filepath.Dir(path)))
+	}
+
+	// The override replaces ExecStart, so it must keep the binary the installed unit runs
+	if err := os.WriteFile(path, RenderInstanceOverride(sm.InstalledBinaryPath(dir), configPath, decryptArgs...), 0644); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to write drop-in: %s", path))
+	}
+
+	sm.logger.WithFields(logrus.Fields{
+		"uuid":        uuid,
+		"config_path": configPath,
+		"args":        decryptArgs,
+		"path":        path,
+	}).Info("Wrote decrypt service override")
+
+	return path, nil
+}
@@ -0,0 +1,177 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderUnitsMatchesPackagedUnits(t *testing.T) {
+	units, err := RenderUnits(UnitOptions{})
+	require.NoError(t, err)
+	require.Len(t, units, 3)
+
+	// The embedded templates must stay in sync with the units shipped in configs/systemd
+	for name, content := range units {
+		packaged, err := os.ReadFile(filepath.Join("..", "..", "configs", "systemd", name))
+		require.NoError(t, err, name)
+		assert.Equal(t, string(packaged), string(content), name)
+	}
+}
+
+func TestRenderUnitsCustomBinaryPath(t *testing.T) {
+	units, err := RenderUnits(UnitOptions{BinaryPath: "/opt/vault-dm-crypt/bin/vault-dm-crypt"})
+	require.NoError(t, err)
+
+	assert.Contains(t, string(units["vault-dm-crypt-decrypt@.service"]), "ExecStart=/opt/vault-dm-crypt/bin/vault-dm-crypt --retry")
+	assert.Contains(t, string(units["vault-dm-crypt-refresh.service"]), "ExecStart=/opt/vault-dm-crypt/bin/vault-dm-crypt refresh-auth")
+}
+
+func TestRenderUnitsSecretIDCredential(t *testing.T) {
+	units, err := RenderUnits(UnitOptions{SecretIDCredential: "vault-secret-id"})
+	require.NoError(t, err)
+
+	expected := "Type=oneshot\nLoadCredential=vault-secret-id:/etc/vault-dm-crypt/credentials/vault-secret-id\n"
+	assert.Contains(t, string(units["vault-dm-crypt-decrypt@.service"]), expected)
+	assert.Contains(t, string(units["vault-dm-crypt-refresh.service"]), expected)
+	assert.NotContains(t, string(units["vault-dm-crypt-refresh.timer"]), "LoadCredential")
+}
+
+func TestWriteUnitsToStagingDir(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	mockExecutor := NewMockExecutor()
+	manager.executor = mockExecutor
+
+	stagingDir := filepath.Join(t.TempDir(), "etc", "systemd", "system")
+	uuid := "550E8400-E29B-41D4-A716-446655440000"
+
+	written, err := manager.WriteUnits(stagingDir, UnitOptions{}, []string{uuid})
+	require.NoError(t, err)
+	assert.Len(t, written, 4)
+
+	for _, name := range []string{"vault-dm-crypt-decrypt@.service", "vault-dm-crypt-refresh.service", "vault-dm-crypt-refresh.timer"} {
+		info, err := os.Stat(filepath.Join(stagingDir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+
+	linkPath := filepath.Join(stagingDir, "multi-user.target.wants", "vault-dm-crypt-decrypt@550e8400-e29b-41d4-a716-446655440000.service")
+	target, err := os.Readlink(linkPath)
+	require.NoError(t, err)
+	assert.Equal(t, "../vault-dm-crypt-decrypt@.service", target)
+
+	// The link must resolve to the rendered template unit
+	_, err = os.Stat(linkPath)
+	assert.NoError(t, err)
+
+	// Staging mode must not touch the running system
+	assert.Empty(t, mockExecutor.GetExecutedCommands())
+
+	// Writing again is idempotent
+	_, err = manager.WriteUnits(stagingDir, UnitOptions{}, []string{uuid})
+	assert.NoError(t, err)
+}
+
+func TestWriteInstanceOverride(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	mockExecutor := NewMockExecutor()
+	manager.executor = mockExecutor
+
+	unitDir := t.TempDir()
+	uuid := "550E8400-E29B-41D4-A716-446655440000"
+
+	path, err := manager.writeInstanceOverride(unitDir, uuid, "/etc/vault-dm-crypt/tier-2.toml")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(unitDir, "vault-dm-crypt-decrypt@550e8400-e29b-41d4-a716-446655440000.service.d", "override.conf"), path)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `# Written by vault-dm-crypt encrypt: decrypt this device with its own configuration
+[Service]
+ExecStart=
+ExecStart=/usr/bin/vault-dm-crypt --config "/etc/vault-dm-crypt/tier-2.toml" --retry $VAULT_DM_CRYPT_TIMEOUT decrypt %i
+`, string(content))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	_, err = manager.writeInstanceOverride(unitDir, uuid, "tier-2.toml")
+	assert.Error(t, err, "relative config paths are rejected")
+
+	assert.Contains(t, string(RenderInstanceOverride("", "/etc/vault-dm-crypt/100%.toml")), `--config "/etc/vault-dm-crypt/100%%.toml"`)
+
+	// A device profile storing keys elsewhere is recorded for boot-time decrypt
+	path, err = manager.writeInstanceOverride(unitDir, uuid, "", "--profile", "cold")
+	require.NoError(t, err)
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "ExecStart=/usr/bin/vault-dm-crypt --retry $VAULT_DM_CRYPT_TIMEOUT decrypt --profile cold %i\n")
+}
+
+func TestSetBootPriority(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	manager := NewManager(logger)
+	manager.executor = NewMockExecutor()
+
+	unitDir := t.TempDir()
+	const (
+		metadata = "11111111-1111-1111-1111-111111111111"
+		data     = "22222222-2222-2222-2222-222222222222"
+		scratch  = "33333333-3333-3333-3333-333333333333"
+	)
+
+	readDropIn := func(uuid string) string {
+		content, err := os.ReadFile(manager.PriorityOverridePath(unitDir, uuid))
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	_, err := manager.setBootPriority(unitDir, data, 20)
+	require.NoError(t, err)
+	_, err = manager.setBootPriority(unitDir, metadata, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, `# Written by vault-dm-crypt encrypt --boot-priority: lower priorities are decrypted first
+[Unit]
+X-VaultDMCryptBootPriority=20
+After=vault-dm-crypt-decrypt@11111111-1111-1111-1111-111111111111.service
+`, readDropIn(data))
+	assert.NotContains(t, readDropIn(metadata), "After=")
+
+	// Moving an instance ahead rewrites the others, so no stale ordering is left behind
+	written, err := manager.setBootPriority(unitDir, data, 5)
+	require.NoError(t, err)
+	assert.Len(t, written, 2)
+	assert.NotContains(t, readDropIn(data), "After=")
+	assert.Contains(t, readDropIn(metadata), "After=vault-dm-crypt-decrypt@"+data+".service")
+
+	// Equal priorities are not ordered against each other
+	_, err = manager.setBootPriority(unitDir, scratch, 10)
+	require.NoError(t, err)
+	assert.NotContains(t, readDropIn(scratch), metadata)
+	assert.Contains(t, readDropIn(scratch), "After=vault-dm-crypt-decrypt@"+data+".service")
+
+	// The config override of an instance is left alone
+	_, err = manager.writeInstanceOverride(unitDir, data, "/etc/vault-dm-crypt/tier-2.toml")
+	require.NoError(t, err)
+	priorities, err := manager.readBootPriorities(unitDir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"vault-dm-crypt-decrypt@" + metadata + ".service": 10,
+		"vault-dm-crypt-decrypt@" + data + ".service":     5,
+		"vault-dm-crypt-decrypt@" + scratch + ".service":  10,
+	}, priorities)
+}
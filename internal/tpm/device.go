@@ -0,0 +1,210 @@
+package tpm
+
+import (
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DeviceSealer seals data to PCR state using a TPM 2.0 device
+type DeviceSealer struct {
+	device string
+	pcrs   []int
+	logger *logrus.Logger
+	open   func(path string) (transport.TPMCloser, error)
+}
+
+// NewDeviceSealer creates a sealer for the TPM at device, binding sealed data to the given PCRs
+func NewDeviceSealer(device string, pcrs []int, logger *logrus.Logger) *DeviceSealer {
+	if device == "" {
+		device = DefaultDevice
+	}
+	if len(pcrs) == 0 {
+		pcrs = DefaultPCRs
+	}
+
+	return &DeviceSealer{
+		device: device,
+		pcrs:   pcrs,
+		logger: logger,
+		open:   linuxtpm.Open,
+	}
+}
+
+// Seal creates a sealed object under the storage root key, usable only while the PCRs match their current values
+func (s *DeviceSealer) Seal(data []byte) (*SealedBlob, error) {
+	s.logger.WithFields(logrus.Fields{
+		"device": s.device,
+		"pcrs":   s.pcrs,
+	}).Debug("Sealing data to TPM")
+
+	tpm, err := s.open(s.device)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open TPM %s", s.device))
+	}
+	defer tpm.Close()
+
+	srk, err := createSRK(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	policy, err := s.pcrPolicyDigest(tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := tpm2.Create{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: data}),
+			},
+		},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:    true,
+				FixedParent: true,
+				NoDA:        true,
+			},
+			AuthPolicy: tpm2.TPM2BDigest{Buffer: policy},
+		}),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, errors.Wrap(err, "TPM2_Create failed")
+	}
+
+	return &SealedBlob{
+		Public:  tpm2.Marshal(created.OutPublic),
+		Private: tpm2.Marshal(created.OutPrivate),
+		PCRs:    s.pcrs,
+	}, nil
+}
+
+// Unseal loads a sealed object and unseals it, which fails if the PCRs have changed
+func (s *DeviceSealer) Unseal(blob *SealedBlob) ([]byte, error) {
+	s.logger.WithFields(logrus.Fields{
+		"device": s.device,
+		"pcrs":   blob.PCRs,
+	}).Debug("Unsealing data from TPM")
+
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](blob.Public)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sealed public area")
+	}
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](blob.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sealed private area")
+	}
+
+	tpm, err := s.open(s.device)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open TPM %s", s.device))
+	}
+	defer tpm.Close()
+
+	srk, err := createSRK(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	loaded, err := tpm2.Load{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InPublic:     *public,
+		InPrivate:    *private,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, errors.Wrap(err, "TPM2_Load failed (sealed on a different TPM?)")
+	}
+	defer flush(tpm, loaded.ObjectHandle)
+
+	session, closeSession, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start TPM policy session")
+	}
+	defer func() { _ = closeSession() }()
+
+	if _, err := (tpm2.PolicyPCR{
+		PolicySession: session.Handle(),
+		Pcrs:          pcrSelection(blob.PCRs),
+	}).Execute(tpm); err != nil {
+		return nil, errors.Wrap(err, "TPM2_PolicyPCR failed")
+	}
+
+	unsealed, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{
+			Handle: loaded.ObjectHandle,
+			Name:   loaded.Name,
+			Auth:   session,
+		},
+	}.Execute(tpm)
+	if err != nil {
+		return nil, errors.Wrap(err, "TPM2_Unseal failed (PCR state changed?)")
+	}
+
+	return unsealed.OutData.Buffer, nil
+}
+
+// pcrPolicyDigest computes the policy digest for the current values of the sealer's PCRs
+func (s *DeviceSealer) pcrPolicyDigest(tpm transport.TPM) ([]byte, error) {
+	session, closeSession, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, tpm2.Trial())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start TPM trial session")
+	}
+	defer func() { _ = closeSession() }()
+
+	if _, err := (tpm2.PolicyPCR{
+		PolicySession: session.Handle(),
+		Pcrs:          pcrSelection(s.pcrs),
+	}).Execute(tpm); err != nil {
+		return nil, errors.Wrap(err, "TPM2_PolicyPCR failed")
+	}
+
+	digest, err := tpm2.PolicyGetDigest{PolicySession: session.Handle()}.Execute(tpm)
+	if err != nil {
+		return nil, errors.Wrap(err, "TPM2_PolicyGetDigest failed")
+	}
+
+	return digest.PolicyDigest.Buffer, nil
+}
+
+// createSRK creates the well-known ECC storage root key, which is identical on every call for a given TPM
+func createSRK(tpm transport.TPM) (*tpm2.CreatePrimaryResponse, error) {
+	srk, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create TPM storage root key")
+	}
+	return srk, nil
+}
+
+func flush(tpm transport.TPM, handle tpm2.TPMHandle) {
+	_, _ = tpm2.FlushContext{FlushHandle: handle}.Execute(tpm)
+}
+
+func pcrSelection(pcrs []int) tpm2.TPMLPCRSelection {
+	indexes := make([]uint, len(pcrs))
+	for i, pcr := range pcrs {
+		indexes[i] = uint(pcr)
+	}
+
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{
+				Hash:      tpm2.TPMAlgSHA256,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(indexes...),
+			},
+		},
+	}
+}
@@ -0,0 +1,154 @@
+// Package tpm binds encryption keys to a host's TPM so a key read from Vault is
+// useless without the TPM (and PCR state) it was sealed on.
+package tpm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// DefaultDevice is the kernel TPM resource manager device
+const DefaultDevice = "/dev/tpmrm0"
+
+// DefaultPCRs are the PCRs a key is sealed to by default (7: Secure Boot state)
+var DefaultPCRs = []int{7}
+
+// dataKeySize is the size of the AES-256 key sealed in the TPM
+const dataKeySize = 32
+
+// SealedBlob is a TPM object holding sealed data, loadable only by the TPM that created it
+type SealedBlob struct {
+	Public  []byte `json:"public"`
+	Private []byte `json:"private"`
+	PCRs    []int  `json:"pcrs"`
+}
+
+// Sealer seals data to the TPM and unseals it again
+type Sealer interface {
+	Seal(data []byte) (*SealedBlob, error)
+	Unseal(blob *SealedBlob) ([]byte, error)
+}
+
+// Encode serialises a sealed blob for storage alongside the key in Vault
+func (b *SealedBlob) Encode() (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode sealed blob")
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeSealedBlob parses a sealed blob produced by Encode
+func DecodeSealedBlob(encoded string) (*SealedBlob, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode sealed blob")
+	}
+
+	var blob SealedBlob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, errors.Wrap(err, "failed to parse sealed blob")
+	}
+
+	if len(blob.Public) == 0 || len(blob.Private) == 0 {
+		return nil, errors.New("sealed blob is incomplete")
+	}
+
+	return &blob, nil
+}
+
+// WrapKey encrypts key with a fresh AES-256-GCM data key sealed to the TPM.
+// It returns the wrapped key and the encoded sealed blob, both to be stored in Vault.
+func WrapKey(sealer Sealer, key string) (wrapped string, sealed string, err error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", "", errors.Wrap(err, "failed to generate TPM data key")
+	}
+	defer clear(dataKey)
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", errors.Wrap(err, "failed to generate nonce")
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(key), nil)
+
+	blob, err := sealer.Seal(dataKey)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to seal data key to TPM")
+	}
+
+	sealed, err = blob.Encode()
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ciphertext), sealed, nil
+}
+
+// UnwrapKey unseals the data key from the TPM and decrypts a key produced by WrapKey
+func UnwrapKey(sealer Sealer, wrapped, sealed string) (string, error) {
+	blob, err := DecodeSealedBlob(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode wrapped key")
+	}
+
+	dataKey, err := sealer.Unseal(blob)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to unseal data key from TPM")
+	}
+	defer clear(dataKey)
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("wrapped key is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt wrapped key (was it sealed on a different TPM?)")
+	}
+	defer clear(plaintext)
+
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("invalid TPM data key size: %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM")
+	}
+
+	return gcm, nil
+}
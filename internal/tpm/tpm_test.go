@@ -0,0 +1,131 @@
+package tpm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSealer stands in for a TPM: sealed blobs are only unsealable by the same instance
+// and only while its simulated PCR state is unchanged
+type mockSealer struct {
+	id       byte
+	pcrState byte
+	sealed   map[string][]byte
+	sealErr  error
+}
+
+func newMockSealer(id byte) *mockSealer {
+	return &mockSealer{id: id, sealed: make(map[string][]byte)}
+}
+
+func (m *mockSealer) Seal(data []byte) (*SealedBlob, error) {
+	if m.sealErr != nil {
+		return nil, m.sealErr
+	}
+
+	handle := fmt.Sprintf("%d-%d", m.id, len(m.sealed))
+	m.sealed[handle] = bytes.Clone(data)
+	return &SealedBlob{
+		Public:  []byte(handle),
+		Private: []byte{m.id, m.pcrState},
+		PCRs:    DefaultPCRs,
+	}, nil
+}
+
+func (m *mockSealer) Unseal(blob *SealedBlob) ([]byte, error) {
+	if blob.Private[0] != m.id {
+		return nil, fmt.Errorf("TPM2_Load failed")
+	}
+	if blob.Private[1] != m.pcrState {
+		return nil, fmt.Errorf("TPM2_Unseal failed: PCR mismatch")
+	}
+	return bytes.Clone(m.sealed[string(blob.Public)]), nil
+}
+
+const testKey = "dGVzdC1rZXktbWF0ZXJpYWwtdGhhdC1pcy1sb25nLWVub3VnaA=="
+
+func TestWrapUnwrapKey(t *testing.T) {
+	sealer := newMockSealer(1)
+
+	wrapped, sealed, err := WrapKey(sealer, testKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, testKey, wrapped)
+	assert.NotContains(t, wrapped, testKey)
+	assert.NotEmpty(t, sealed)
+
+	key, err := UnwrapKey(sealer, wrapped, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+}
+
+func TestUnwrapKeyFailures(t *testing.T) {
+	sealer := newMockSealer(1)
+	wrapped, sealed, err := WrapKey(sealer, testKey)
+	require.NoError(t, err)
+
+	t.Run("different TPM", func(t *testing.T) {
+		_, err := UnwrapKey(newMockSealer(2), wrapped, sealed)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to unseal data key from TPM")
+	})
+
+	t.Run("PCR state changed", func(t *testing.T) {
+		changed := newMockSealer(1)
+		changed.sealed = sealer.sealed
+		changed.pcrState = 1
+
+		_, err := UnwrapKey(changed, wrapped, sealed)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "PCR mismatch")
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		otherWrapped, _, err := WrapKey(sealer, testKey)
+		require.NoError(t, err)
+
+		_, err = UnwrapKey(sealer, otherWrapped, sealed)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to decrypt wrapped key")
+	})
+
+	t.Run("invalid sealed blob", func(t *testing.T) {
+		_, err := UnwrapKey(sealer, wrapped, "not-base64!")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to decode sealed blob")
+	})
+}
+
+func TestWrapKeySealFailure(t *testing.T) {
+	sealer := newMockSealer(1)
+	sealer.sealErr = fmt.Errorf("no TPM")
+
+	_, _, err := WrapKey(sealer, testKey)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to seal data key to TPM")
+}
+
+func TestSealedBlobEncoding(t *testing.T) {
+	blob := &SealedBlob{Public: []byte{1, 2}, Private: []byte{3, 4}, PCRs: []int{0, 7}}
+
+	encoded, err := blob.Encode()
+	require.NoError(t, err)
+
+	decoded, err := DecodeSealedBlob(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, blob, decoded)
+
+	incomplete, err := (&SealedBlob{Public: []byte{1}}).Encode()
+	require.NoError(t, err)
+	_, err = DecodeSealedBlob(incomplete)
+	assert.Error(t, err)
+}
+
+func TestNewDeviceSealerDefaults(t *testing.T) {
+	sealer := NewDeviceSealer("", nil, nil)
+	assert.Equal(t, DefaultDevice, sealer.device)
+	assert.Equal(t, DefaultPCRs, sealer.pcrs)
+}
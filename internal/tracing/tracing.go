@@ -0,0 +1,93 @@
+// Package tracing exports OpenTelemetry traces of a command: a root span per command with child
+// spans for Vault requests and cryptsetup calls. Spans carry paths, devices and durations, never
+// key material. Without an OTLP endpoint no tracer provider is installed, so spans are no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// tracerName identifies the spans created by this tool
+const tracerName = "digitalisio/vault-dm-crypt"
+
+// commandCtx holds the context of the running command's root span, for layers such as dmcrypt
+// that are not given a context
+var (
+	commandMu  sync.Mutex
+	commandCtx context.Context
+)
+
+// Setup installs a tracer provider exporting to the configured OTLP endpoint and returns a
+// function flushing and stopping it. Without an endpoint nothing is installed.
+func Setup(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	return install(sdktrace.NewBatchSpanProcessor(exporter), cfg.ServiceName), nil
+}
+
+// install sets a tracer provider with the given span processor as the global one
+func install(processor sdktrace.SpanProcessor, serviceName string) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// StartCommand starts the root span of a command and remembers its context for CommandContext
+func StartCommand(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, span := Start(ctx, name)
+
+	commandMu.Lock()
+	commandCtx = ctx
+	commandMu.Unlock()
+
+	return ctx, span
+}
+
+// CommandContext returns the context of the running command's root span, or an empty context
+// when no command span has been started
+func CommandContext() context.Context {
+	commandMu.Lock()
+	defer commandMu.Unlock()
+
+	if commandCtx == nil {
+		return context.Background()
+	}
+	return commandCtx
+}
+
+// Start starts a span as a child of any span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, as the span's status and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
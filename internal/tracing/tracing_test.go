@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// useInMemoryExporter installs a tracer provider recording spans in memory for the test
+func useInMemoryExporter(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	resetCommandContext(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	install(sdktrace.NewSimpleSpanProcessor(exporter), "vault-dm-crypt-test")
+	return exporter
+}
+
+// resetCommandContext forgets the command span started by the test
+func resetCommandContext(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		commandMu.Lock()
+		commandCtx = nil
+		commandMu.Unlock()
+	})
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	resetCommandContext(t)
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := Setup(context.Background(), config.TracingConfig{})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, previous, otel.GetTracerProvider(), "no tracer provider is installed")
+
+	// Spans are no-ops
+	_, span := StartCommand(context.Background(), "vault-dm-crypt decrypt")
+	assert.False(t, span.IsRecording())
+	End(span, nil)
+}
+
+func TestSpanTree(t *testing.T) {
+	exporter := useInMemoryExporter(t)
+
+	ctx, root := StartCommand(context.Background(), "vault-dm-crypt decrypt")
+
+	_, auth := Start(ctx, "vault.authenticate")
+	End(auth, nil)
+
+	_, read := Start(ctx, "vault.read", attribute.String("vault.path", "vault-dm-crypt/node1/uuid"))
+	End(read, errors.New("permission denied"))
+
+	// Layers without a context parent their spans on the command
+	_, open := Start(CommandContext(), "cryptsetup luksOpen")
+	End(open, nil)
+
+	End(root, nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 4)
+
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+
+	command := byName["vault-dm-crypt decrypt"]
+	assert.False(t, command.Parent.IsValid(), "the command span is the root")
+	for _, name := range []string{"vault.authenticate", "vault.read", "cryptsetup luksOpen"} {
+		child, ok := byName[name]
+		require.True(t, ok, name)
+		assert.Equal(t, command.SpanContext.SpanID(), child.Parent.SpanID(), name)
+		assert.Equal(t, command.SpanContext.TraceID(), child.SpanContext.TraceID(), name)
+	}
+
+	assert.Equal(t, codes.Error, byName["vault.read"].Status.Code)
+	assert.Equal(t, "permission denied", byName["vault.read"].Status.Description)
+	assert.Equal(t, codes.Unset, byName["vault.authenticate"].Status.Code)
+	assert.False(t, byName["vault.read"].EndTime.Before(byName["vault.read"].StartTime))
+}
+
+func TestCommandContextWithoutCommand(t *testing.T) {
+	assert.Equal(t, context.Background(), CommandContext())
+}
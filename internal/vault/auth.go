@@ -3,11 +3,14 @@ package vault
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
 
+	"digitalisio/vault-dm-crypt/internal/config"
 	"digitalisio/vault-dm-crypt/internal/errors"
 )
 
@@ -19,9 +22,14 @@ type AuthMethod interface {
 
 // AppRoleAuth implements AppRole authentication
 type AppRoleAuth struct {
-	RoleID   string
-	SecretID string
-	logger   *logrus.Logger
+	RoleID    string
+	SecretID  string
+	RoleName  string // Optional: used to diagnose role_id mismatches on login failure
+	MountPath string // Optional: auth mount path, "approle" if empty
+	// Optional: looked up on each login instead of SecretID, so a secret ID read from a systemd
+	// credential or replaced by refresh-auth is the one used
+	SecretIDSource func() (string, error)
+	logger         *logrus.Logger
 }
 
 // NewAppRoleAuth creates a new AppRole authentication method
@@ -39,7 +47,15 @@ func (a *AppRoleAuth) Authenticate(ctx context.Context, client *api.Client) (*ap
 		return nil, errors.New("AppRole ID cannot be empty")
 	}
 
-	if a.SecretID == "" {
+	secretID := a.SecretID
+	if a.SecretIDSource != nil {
+		var err error
+		if secretID, err = a.SecretIDSource(); err != nil {
+			return nil, err
+		}
+	}
+
+	if secretID == "" {
 		return nil, errors.New("Secret ID cannot be empty")
 	}
 
@@ -47,12 +63,15 @@ func (a *AppRoleAuth) Authenticate(ctx context.Context, client *api.Client) (*ap
 
 	data := map[string]interface{}{
 		"role_id":   a.RoleID,
-		"secret_id": a.SecretID,
+		"secret_id": secretID,
 	}
 
 	// Perform authentication
-	resp, err := client.Logical().WriteWithContext(ctx, "auth/approle/login", data)
+	resp, err := client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.mountPath()), data)
 	if err != nil {
+		if mismatchErr := a.checkRoleIDMismatch(ctx, client); mismatchErr != nil {
+			return nil, errors.Wrap(err, mismatchErr.Error())
+		}
 		return nil, errors.Wrap(err, "AppRole login failed")
 	}
 
@@ -79,6 +98,46 @@ func (a *AppRoleAuth) GetName() string {
 	return "approle"
 }
 
+// mountPath returns the path the AppRole auth method is mounted at
+func (a *AppRoleAuth) mountPath() string {
+	if mount := strings.Trim(a.MountPath, "/"); mount != "" {
+		return mount
+	}
+	return "approle"
+}
+
+// checkRoleIDMismatch compares the configured role_id against the server's current
+// role_id for RoleName. It returns an error only when a mismatch is positively detected;
+// lookup failures (e.g. no permission without a token) are logged and ignored.
+func (a *AppRoleAuth) checkRoleIDMismatch(ctx context.Context, client *api.Client) error {
+	if a.RoleName == "" {
+		return nil
+	}
+
+	path := fmt.Sprintf("auth/%s/role/%s/role-id", a.mountPath(), a.RoleName)
+	resp, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		a.logger.WithError(err).Debug("Unable to look up server role_id for mismatch diagnosis")
+		return nil
+	}
+
+	if resp == nil || resp.Data == nil {
+		return nil
+	}
+
+	serverRoleID, ok := resp.Data["role_id"].(string)
+	if !ok || serverRoleID == "" {
+		return nil
+	}
+
+	if serverRoleID != a.RoleID {
+		a.logger.WithField("role_name", a.RoleName).Error("Configured role_id does not match server role_id")
+		return fmt.Errorf("configured role_id does not match server role_id for role %s", a.RoleName)
+	}
+
+	return nil
+}
+
 // TokenAuth implements Token authentication
 type TokenAuth struct {
 	Token  string
@@ -163,6 +222,24 @@ func (t *TokenAuth) GetName() string {
 	return "token"
 }
 
+// Prefixes of batch tokens: "hvb." since Vault 1.10, "b." before
+var batchTokenPrefixes = []string{"hvb.", "b."}
+
+// isBatchToken reports whether resp carries a batch token. Batch tokens are not persisted by
+// Vault: they cannot be renewed and have no accessor, so they are only valid for the lease
+// duration they were issued with.
+func isBatchToken(resp *api.Secret) bool {
+	if tokenType, _ := resp.Data["type"].(string); tokenType == "batch" {
+		return true
+	}
+	for _, prefix := range batchTokenPrefixes {
+		if strings.HasPrefix(resp.Auth.ClientToken, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // TokenManager handles token lifecycle
 type TokenManager struct {
 	client    *api.Client
@@ -170,19 +247,30 @@ type TokenManager struct {
 	logger    *logrus.Logger
 	token     string
 	renewable bool
+	batch     bool
 	ttl       time.Duration
+	issuedAt  time.Time
 	expiresAt time.Time
+
+	// expiryBuffer is how long before expiresAt the token is treated as expired
+	expiryBuffer time.Duration
 }
 
 // NewTokenManager creates a new token manager
 func NewTokenManager(client *api.Client, auth AuthMethod, logger *logrus.Logger) *TokenManager {
 	return &TokenManager{
-		client: client,
-		auth:   auth,
-		logger: logger,
+		client:       client,
+		auth:         auth,
+		logger:       logger,
+		expiryBuffer: config.DefaultExpiryBufferSecs * time.Second,
 	}
 }
 
+// SetExpiryBuffer sets how long before its expiry the token is treated as expired
+func (tm *TokenManager) SetExpiryBuffer(buffer time.Duration) {
+	tm.expiryBuffer = buffer
+}
+
 // Authenticate performs initial authentication and sets up token management
 func (tm *TokenManager) Authenticate(ctx context.Context) error {
 	tm.logger.WithField("auth_method", tm.auth.GetName()).Debug("Starting authentication")
@@ -202,11 +290,14 @@ func (tm *TokenManager) setTokenFromResponse(resp *api.Secret) error {
 	}
 
 	tm.token = resp.Auth.ClientToken
-	tm.renewable = resp.Auth.Renewable
+	tm.batch = isBatchToken(resp)
+	tm.renewable = resp.Auth.Renewable && !tm.batch
 	tm.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+	tm.issuedAt = time.Now()
 
+	tm.expiresAt = time.Time{}
 	if tm.ttl > 0 {
-		tm.expiresAt = time.Now().Add(tm.ttl)
+		tm.expiresAt = tm.issuedAt.Add(tm.ttl)
 	}
 
 	// Set token on client
@@ -214,6 +305,7 @@ func (tm *TokenManager) setTokenFromResponse(resp *api.Secret) error {
 
 	tm.logger.WithFields(logrus.Fields{
 		"renewable":   tm.renewable,
+		"batch":       tm.batch,
 		"ttl_seconds": tm.ttl.Seconds(),
 		"expires_at":  tm.expiresAt.Format(time.RFC3339),
 	}).Info("Token set successfully")
@@ -227,24 +319,31 @@ func (tm *TokenManager) IsValid() bool {
 		return false
 	}
 
-	// Check expiration with 30-second buffer
-	if !tm.expiresAt.IsZero() {
-		bufferTime := time.Now().Add(30 * time.Second)
-		if bufferTime.After(tm.expiresAt) {
-			tm.logger.Debug("Token is near expiration")
-			return false
-		}
+	if expiresWithinBuffer(time.Now(), tm.expiresAt, tm.expiryBuffer) {
+		tm.logger.Debug("Token is near expiration")
+		return false
 	}
 
 	return true
 }
 
+// expiresWithinBuffer reports whether expiresAt falls within buffer of now. A zero expiresAt
+// means the expiry is unknown and never counts as expiring.
+func expiresWithinBuffer(now, expiresAt time.Time, buffer time.Duration) bool {
+	return !expiresAt.IsZero() && now.Add(buffer).After(expiresAt)
+}
+
 // Renew attempts to renew the current token
 func (tm *TokenManager) Renew(ctx context.Context) error {
 	if tm.token == "" {
 		return errors.New("no token to renew")
 	}
 
+	if tm.batch {
+		tm.logger.Debug("Batch tokens cannot be renewed, will re-authenticate")
+		return tm.Authenticate(ctx)
+	}
+
 	if !tm.renewable {
 		tm.logger.Debug("Token is not renewable, will re-authenticate")
 		return tm.Authenticate(ctx)
@@ -300,7 +399,9 @@ func (tm *TokenManager) EnsureValid(ctx context.Context) error {
 func (tm *TokenManager) Clear() {
 	tm.token = ""
 	tm.renewable = false
+	tm.batch = false
 	tm.ttl = 0
+	tm.issuedAt = time.Time{}
 	tm.expiresAt = time.Time{}
 
 	if tm.client != nil {
@@ -320,6 +421,16 @@ func (tm *TokenManager) GetTTL() time.Duration {
 	return tm.ttl
 }
 
+// IsBatch reports whether the current token is a batch token
+func (tm *TokenManager) IsBatch() bool {
+	return tm.batch
+}
+
+// GetIssuedAt returns when the current token was obtained
+func (tm *TokenManager) GetIssuedAt() time.Time {
+	return tm.issuedAt
+}
+
 // GetExpiresAt returns when the token expires
 func (tm *TokenManager) GetExpiresAt() time.Time {
 	return tm.expiresAt
@@ -2,6 +2,11 @@ package vault
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -215,6 +220,40 @@ func TestTokenManager_SetTokenFromResponse(t *testing.T) {
 		assert.False(t, tm.expiresAt.IsZero())
 	})
 
+	t.Run("batch token", func(t *testing.T) {
+		resp := &api.Secret{
+			Auth: &api.SecretAuth{
+				ClientToken:   "hvb.AAAAAQJbatchtoken",
+				LeaseDuration: 1800,
+			},
+		}
+
+		require.NoError(t, tm.setTokenFromResponse(resp))
+		assert.True(t, tm.IsBatch())
+		assert.False(t, tm.renewable)
+		assert.Equal(t, tm.GetIssuedAt().Add(1800*time.Second), tm.GetExpiresAt())
+	})
+
+	t.Run("batch token reported by lookup", func(t *testing.T) {
+		resp := &api.Secret{
+			Auth: &api.SecretAuth{ClientToken: "legacy-token", LeaseDuration: 600},
+			Data: map[string]interface{}{"type": "batch"},
+		}
+
+		require.NoError(t, tm.setTokenFromResponse(resp))
+		assert.True(t, tm.IsBatch())
+	})
+
+	t.Run("service token", func(t *testing.T) {
+		resp := &api.Secret{
+			Auth: &api.SecretAuth{ClientToken: "hvs.CAESservicetoken", Accessor: "accessor", Renewable: true, LeaseDuration: 3600},
+		}
+
+		require.NoError(t, tm.setTokenFromResponse(resp))
+		assert.False(t, tm.IsBatch())
+		assert.True(t, tm.renewable)
+	})
+
 	t.Run("nil auth in response", func(t *testing.T) {
 		resp := &api.Secret{
 			Auth: nil,
@@ -375,3 +414,251 @@ func TestClientTokenRefresh(t *testing.T) {
 		assert.Contains(t, err.Error(), "secret ID expiry check not applicable for token authentication")
 	})
 }
+
+// newTestVaultServer starts an httptest server that answers Vault API requests using handler
+func newTestVaultServer(t *testing.T, handler http.HandlerFunc) *api.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = server.URL
+	vaultConfig.MaxRetries = 0
+
+	client, err := api.NewClient(vaultConfig)
+	require.NoError(t, err)
+	client.ClearToken()
+
+	return client
+}
+
+func TestAppRoleAuth_RoleIDMismatch(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+		case "/v1/auth/approle/role/vault-dm-crypt/role-id":
+			_, _ = w.Write([]byte(`{"data":{"role_id":"server-role-id"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	t.Run("mismatched role_id is reported", func(t *testing.T) {
+		client := newTestVaultServer(t, handler)
+		auth := NewAppRoleAuth("stale-role-id", "secret-id", logger)
+		auth.RoleName = "vault-dm-crypt"
+
+		resp, err := auth.Authenticate(context.Background(), client)
+		assert.Error(t, err)
+		assert.Nil(t, resp)
+		assert.Contains(t, err.Error(), "configured role_id does not match server role_id for role vault-dm-crypt")
+	})
+
+	t.Run("matching role_id falls back to generic error", func(t *testing.T) {
+		client := newTestVaultServer(t, handler)
+		auth := NewAppRoleAuth("server-role-id", "secret-id", logger)
+		auth.RoleName = "vault-dm-crypt"
+
+		_, err := auth.Authenticate(context.Background(), client)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "AppRole login failed")
+		assert.NotContains(t, err.Error(), "does not match")
+	})
+
+	t.Run("no role name skips the check", func(t *testing.T) {
+		client := newTestVaultServer(t, handler)
+		auth := NewAppRoleAuth("stale-role-id", "secret-id", logger)
+
+		_, err := auth.Authenticate(context.Background(), client)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "AppRole login failed")
+	})
+}
+
+func TestAppRoleCustomMountPath(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/v1/auth/approle-prod/login":
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"test-token","lease_duration":3600,"renewable":true}}`))
+		case "/v1/auth/approle-prod/role/vault-dm-crypt/secret-id":
+			_, _ = w.Write([]byte(`{"data":{"secret_id":"new-secret-id","secret_id_accessor":"accessor"}}`))
+		case "/v1/auth/approle-prod/role/vault-dm-crypt/secret-id/lookup":
+			_, _ = w.Write([]byte(`{"data":{"secret_id_ttl":3600}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &config.VaultConfig{
+		URL:          server.URL,
+		Backend:      "secret",
+		AppRole:      "role-id",
+		SecretID:     "secret-id",
+		AppRoleName:  "vault-dm-crypt",
+		AppRoleMount: "/approle-prod/",
+		TimeoutSecs:  5,
+	}
+	assert.Equal(t, "approle-prod", cfg.AppRoleMountPath())
+
+	client, err := NewClient(cfg, logger)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, client.Authenticate(ctx))
+
+	secretID, err := client.RefreshSecretID(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "new-secret-id", secretID)
+
+	info, err := client.GetSecretIDInfo(ctx, secretID)
+	require.NoError(t, err)
+	assert.NotNil(t, info["secret_id_ttl"])
+
+	assert.Equal(t, []string{
+		"PUT /v1/auth/approle-prod/login",
+		"PUT /v1/auth/approle-prod/role/vault-dm-crypt/secret-id",
+		"PUT /v1/auth/approle-prod/role/vault-dm-crypt/secret-id/lookup",
+	}, requested)
+}
+
+func TestAppRoleSecretIDFromCredentialAtLogin(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	var loginSecretID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		loginSecretID = body["secret_id"]
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"test-token","lease_duration":3600,"renewable":true}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &config.VaultConfig{
+		URL:                server.URL,
+		Backend:            "secret",
+		AppRole:            "role-id",
+		SecretIDCredential: "vault-secret-id",
+		TimeoutSecs:        5,
+	}
+
+	// The client is created without the credential, as in a manual run outside the unit
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	client, err := NewClient(cfg, logger)
+	require.NoError(t, err)
+	err = client.Authenticate(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CREDENTIALS_DIRECTORY is not set")
+
+	credentialsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(credentialsDir, "vault-secret-id"), []byte("credential-secret\n"), 0400))
+	t.Setenv("CREDENTIALS_DIRECTORY", credentialsDir)
+	require.NoError(t, client.Authenticate(context.Background()))
+	assert.Equal(t, "credential-secret", loginSecretID)
+}
+
+func TestAppRoleDefaultMountPath(t *testing.T) {
+	assert.Equal(t, "approle", config.VaultConfig{}.AppRoleMountPath())
+	assert.Equal(t, "approle", (&AppRoleAuth{}).mountPath())
+	assert.Equal(t, "approle-prod", (&AppRoleAuth{MountPath: "approle-prod"}).mountPath())
+}
+
+func TestAppRoleBatchToken(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			// Batch tokens have no accessor and are never renewable
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"hvb.AAAAAQJbatchtoken","accessor":"","lease_duration":1200,"renewable":false,"token_type":"batch"}}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(&config.VaultConfig{
+		URL:         server.URL,
+		Backend:     "secret",
+		AppRole:     "role-id",
+		SecretID:    "secret-id",
+		TimeoutSecs: 5,
+	}, logger)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, client.Authenticate(ctx))
+	assert.True(t, client.IsBatchToken())
+
+	// Token info comes from the login, without a lookup-self request
+	info, err := client.GetTokenInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "batch", info["type"])
+	assert.Equal(t, false, info["renewable"])
+	assert.Equal(t, json.Number("1200"), info["creation_ttl"])
+
+	// Half of the lifetime is left, measured from the login
+	expiring, err := client.IsTokenExpiringByPercentage(ctx, 0.25)
+	require.NoError(t, err)
+	assert.False(t, expiring)
+
+	// Renewal logs in again instead of calling renew-self
+	require.NoError(t, client.renewToken(ctx))
+
+	assert.Equal(t, []string{
+		"PUT /v1/auth/approle/login",
+		"PUT /v1/auth/approle/login",
+	}, requested)
+}
+
+func TestBatchTokenInfo(t *testing.T) {
+	issued := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	info := batchTokenInfo(issued, 30*time.Minute, issued.Add(10*time.Minute))
+	assert.Equal(t, map[string]interface{}{
+		"type":          "batch",
+		"renewable":     false,
+		"creation_time": "2026-03-01T10:00:00Z",
+		"creation_ttl":  json.Number("1800"),
+		"ttl":           json.Number("1200"),
+		"expire_time":   "2026-03-01T10:30:00Z",
+	}, info)
+
+	expired := batchTokenInfo(issued, 30*time.Minute, issued.Add(time.Hour))
+	assert.Equal(t, json.Number("0"), expired["ttl"])
+}
+
+func TestRefreshTokenRefusesBatchToken(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	client, err := NewClient(&config.VaultConfig{URL: "http://localhost:8200", Backend: "secret", VaultToken: "hvb.AAAAAQJbatchtoken"}, logger)
+	require.NoError(t, err)
+	require.NoError(t, client.tokenManager.setTokenFromResponse(&api.Secret{
+		Auth: &api.SecretAuth{ClientToken: "hvb.AAAAAQJbatchtoken", LeaseDuration: 600},
+	}))
+
+	err = client.RefreshToken(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "batch tokens cannot be renewed")
+}
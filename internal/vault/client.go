@@ -3,25 +3,52 @@ package vault
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 
 	"digitalisio/vault-dm-crypt/internal/config"
 	"digitalisio/vault-dm-crypt/internal/errors"
+	"digitalisio/vault-dm-crypt/internal/tracing"
 )
 
+// ErrCASMismatch is the cause of a VaultWriteError when a check-and-set write finds a different version
+var ErrCASMismatch = errors.New("check-and-set version mismatch")
+
+// ErrSecretNotFound is the cause of a VaultReadError when nothing is stored at the path
+var ErrSecretNotFound = errors.New("secret not found")
+
 // Client wraps the Vault API client with additional functionality
 type Client struct {
 	client       *api.Client
 	config       *config.VaultConfig
 	logger       *logrus.Logger
-	token        string
-	tokenExp     time.Time
 	authMethod   AuthMethod
 	tokenManager *TokenManager
+	limiter      *rate.Limiter // nil when max_requests_per_second is unset
+
+	// authMu serializes authentication and renewal between callers and the token renewer
+	authMu sync.Mutex
+
+	// tokenMu guards token and tokenExp, which batch workers read while another logs in
+	tokenMu  sync.RWMutex
+	token    string
+	tokenExp time.Time
+
+	// Background token renewer state
+	renewerMu     sync.Mutex
+	renewerCancel context.CancelFunc
+	renewerDone   chan struct{}
+	after         func(time.Duration) <-chan time.Time
 }
 
 // NewClient creates a new Vault client with the provided configuration
@@ -39,10 +66,11 @@ func NewClient(cfg *config.VaultConfig, logger *logrus.Logger) (*Client, error)
 	vaultConfig.Address = cfg.URL
 	vaultConfig.Timeout = cfg.Timeout()
 
-	// Configure TLS if CA bundle is specified
-	if cfg.CABundle != "" {
+	// Configure TLS if a CA bundle or CA directory is specified
+	if cfg.CABundle != "" || cfg.CAPath != "" {
 		tlsConfig := &api.TLSConfig{
 			CACert: cfg.CABundle,
+			CAPath: cfg.CAPath,
 		}
 		if err := vaultConfig.ConfigureTLS(tlsConfig); err != nil {
 			return nil, errors.Wrap(err, "failed to configure TLS")
@@ -55,6 +83,17 @@ func NewClient(cfg *config.VaultConfig, logger *logrus.Logger) (*Client, error)
 		return nil, errors.Wrap(err, "failed to create Vault client")
 	}
 
+	// Proxies in front of Vault may require headers of their own on every request. They are
+	// added to any the client already sends, such as a namespace from VAULT_NAMESPACE.
+	if len(cfg.Headers) > 0 {
+		headers := client.Headers()
+		for name, value := range cfg.Headers {
+			headers.Set(name, value)
+		}
+		client.SetHeaders(headers)
+		logger.WithField("headers", len(cfg.Headers)).Debug("Sending custom headers with Vault requests")
+	}
+
 	// Determine authentication method
 	var authMethod AuthMethod
 	if cfg.VaultToken != "" {
@@ -63,12 +102,17 @@ func NewClient(cfg *config.VaultConfig, logger *logrus.Logger) (*Client, error)
 		logger.Debug("Using token authentication")
 	} else {
 		// Use AppRole authentication
-		authMethod = NewAppRoleAuth(cfg.AppRole, cfg.SecretID, logger)
+		appRoleAuth := NewAppRoleAuth(cfg.AppRole, cfg.SecretID, logger)
+		appRoleAuth.RoleName = cfg.AppRoleName
+		appRoleAuth.MountPath = cfg.AppRoleMountPath()
+		appRoleAuth.SecretIDSource = func() (string, error) { return cfg.LoginSecretID() }
+		authMethod = appRoleAuth
 		logger.Debug("Using AppRole authentication")
 	}
 
 	// Create token manager with the chosen auth method
 	tokenManager := NewTokenManager(client, authMethod, logger)
+	tokenManager.SetExpiryBuffer(cfg.ExpiryBuffer())
 
 	return &Client{
 		client:       client,
@@ -76,49 +120,148 @@ func NewClient(cfg *config.VaultConfig, logger *logrus.Logger) (*Client, error)
 		logger:       logger,
 		authMethod:   authMethod,
 		tokenManager: tokenManager,
+		limiter:      newRateLimiter(cfg.MaxRequestsPerSecond),
+		after:        time.After,
 	}, nil
 }
 
 // Authenticate performs authentication using the configured method
-func (c *Client) Authenticate(ctx context.Context) error {
+func (c *Client) Authenticate(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "vault.authenticate")
+	defer func() { tracing.End(span, err) }()
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	return c.authenticateLocked(ctx)
+}
+
+// authenticateLocked logs in and caches the new token; the caller must hold authMu
+func (c *Client) authenticateLocked(ctx context.Context) error {
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return err
+	}
+
 	// Use token manager for authentication
 	if err := c.tokenManager.Authenticate(ctx); err != nil {
 		return err
 	}
 
 	// Update local token and expiration info
-	c.token = c.tokenManager.GetToken()
-	c.tokenExp = c.tokenManager.GetExpiresAt()
+	c.setToken(c.tokenManager.GetToken(), c.tokenManager.GetExpiresAt())
 
 	return nil
 }
 
+// setToken replaces the cached token and its expiry
+func (c *Client) setToken(token string, exp time.Time) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	c.token = token
+	c.tokenExp = exp
+}
+
+// tokenState returns the cached token and its expiry
+func (c *Client) tokenState() (string, time.Time) {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+
+	return c.token, c.tokenExp
+}
+
 // IsTokenValid checks if the current token is valid and not expired
 func (c *Client) IsTokenValid() bool {
-	if c.token == "" {
+	token, exp := c.tokenState()
+	if token == "" {
 		return false
 	}
 
-	// Check if token is expired (with 30 second buffer)
-	if !c.tokenExp.IsZero() && time.Now().Add(30*time.Second).After(c.tokenExp) {
+	// Treat the token as expired expiry_buffer early to allow for clock skew
+	if expiresWithinBuffer(time.Now(), exp, c.config.ExpiryBuffer()) {
 		return false
 	}
 
 	return true
 }
 
-// EnsureAuthenticated ensures the client has a valid token, re-authenticating if necessary
-func (c *Client) EnsureAuthenticated(ctx context.Context) error {
+// EnsureAuthenticated ensures the client has a valid token, re-authenticating if necessary.
+// Concurrent callers that find the token expired log in once between them.
+func (c *Client) EnsureAuthenticated(ctx context.Context) (err error) {
 	if c.IsTokenValid() {
 		return nil
 	}
 
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	// Another caller may have logged in while this one waited for the lock
+	if c.IsTokenValid() {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "vault.authenticate")
+	defer func() { tracing.End(span, err) }()
+
 	c.logger.Debug("Token invalid or expired, re-authenticating")
-	return c.Authenticate(ctx)
+	return c.authenticateLocked(ctx)
+}
+
+// reauthenticate logs in again after Vault denied a request made with denied, unless another
+// caller has already replaced that token with a valid one
+func (c *Client) reauthenticate(ctx context.Context, denied string) (err error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if token, _ := c.tokenState(); token != denied && c.IsTokenValid() {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "vault.authenticate")
+	defer func() { tracing.End(span, err) }()
+
+	return c.authenticateLocked(ctx)
 }
 
 // WriteSecret stores a secret at the specified path
 func (c *Client) WriteSecret(ctx context.Context, path string, data map[string]interface{}) error {
+	return c.writeSecret(ctx, c.config.Backend, path, data, nil)
+}
+
+// WriteSecretTo stores a secret at path on the given KV backend instead of the configured one
+func (c *Client) WriteSecretTo(ctx context.Context, backend, path string, data map[string]interface{}) error {
+	return c.writeSecret(ctx, c.backendOrDefault(backend), path, data, nil)
+}
+
+// WriteSecretCAS stores a KV v2 secret only if its current version is cas, so concurrent
+// writers cannot overwrite each other. A cas of 0 only creates a secret that does not exist yet.
+func (c *Client) WriteSecretCAS(ctx context.Context, path string, data map[string]interface{}, cas int) error {
+	return c.WriteSecretCASTo(ctx, c.config.Backend, path, data, cas)
+}
+
+// WriteSecretCASTo is WriteSecretCAS on the given KV backend instead of the configured one
+func (c *Client) WriteSecretCASTo(ctx context.Context, backend, path string, data map[string]interface{}, cas int) error {
+	if c.config.KVVersion != "2" {
+		return errors.New("check-and-set writes require kv_version = \"2\"")
+	}
+	if cas < 0 {
+		return fmt.Errorf("invalid check-and-set version: %d", cas)
+	}
+	return c.writeSecret(ctx, c.backendOrDefault(backend), path, data, &cas)
+}
+
+// backendOrDefault returns backend, or the configured backend when it is empty
+func (c *Client) backendOrDefault(backend string) string {
+	if backend == "" {
+		return c.config.Backend
+	}
+	return backend
+}
+
+func (c *Client) writeSecret(ctx context.Context, backend, path string, data map[string]interface{}, cas *int) (err error) {
+	ctx, span := tracing.Start(ctx, "vault.write", attribute.String("vault.backend", backend), attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
 	if err := c.EnsureAuthenticated(ctx); err != nil {
 		return err
 	}
@@ -128,23 +271,29 @@ func (c *Client) WriteSecret(ctx context.Context, path string, data map[string]i
 
 	if c.config.KVVersion == "2" {
 		// KV v2: wrap data and use /data/ path
-		secretData = map[string]interface{}{
-			"data": data,
-		}
-		fullPath = fmt.Sprintf("%s/data/%s", c.config.Backend, path)
+		secretData = kvV2WritePayload(data, cas)
+		fullPath = fmt.Sprintf("%s/data/%s", backend, path)
 	} else {
 		// KV v1: write data directly
 		secretData = data
-		fullPath = fmt.Sprintf("%s/%s", c.config.Backend, path)
+		fullPath = fmt.Sprintf("%s/%s", backend, path)
 	}
 
 	c.logger.WithFields(logrus.Fields{
 		"path":       fullPath,
 		"kv_version": c.config.KVVersion,
+		"cas":        cas != nil,
 	}).Debug("Writing secret to Vault")
 
-	_, err := c.client.Logical().WriteWithContext(ctx, fullPath, secretData)
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return err
+	}
+
+	_, err = c.client.Logical().WriteWithContext(ctx, fullPath, secretData)
 	if err != nil {
+		if cas != nil && isCASMismatch(err) {
+			return errors.NewVaultWriteError(fullPath, fmt.Errorf("%w: expected version %d", ErrCASMismatch, *cas))
+		}
 		return errors.NewVaultWriteError(fullPath, err)
 	}
 
@@ -152,42 +301,177 @@ func (c *Client) WriteSecret(ctx context.Context, path string, data map[string]i
 	return nil
 }
 
+// kvV2WritePayload wraps secret data for a KV v2 write, adding the check-and-set option if given
+func kvV2WritePayload(data map[string]interface{}, cas *int) map[string]interface{} {
+	payload := map[string]interface{}{
+		"data": data,
+	}
+	if cas != nil {
+		payload["options"] = map[string]interface{}{
+			"cas": *cas,
+		}
+	}
+	return payload
+}
+
+// isPermissionDenied reports whether Vault rejected a request with 403, which is how it
+// responds to an expired or revoked token
+func isPermissionDenied(err error) bool {
+	var respErr *api.ResponseError
+	return stderrors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
+
+// isCASMismatch reports whether Vault rejected a write because the check-and-set version did not match
+func isCASMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if !stderrors.As(err, &respErr) || respErr.StatusCode != 400 {
+		return false
+	}
+	for _, msg := range respErr.Errors {
+		if strings.Contains(msg, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadSecret retrieves a secret from the specified path
 func (c *Client) ReadSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	return c.ReadSecretVersion(ctx, path, 0)
+}
+
+// ReadSecretFrom retrieves a secret from the given KV backend instead of the configured one
+func (c *Client) ReadSecretFrom(ctx context.Context, backend, path string) (map[string]interface{}, error) {
+	return c.ReadSecretVersionFrom(ctx, backend, path, 0)
+}
+
+// ReadSecretVersion retrieves a specific KV v2 version of a secret; version 0 reads the latest
+func (c *Client) ReadSecretVersion(ctx context.Context, path string, version int) (map[string]interface{}, error) {
+	return c.ReadSecretVersionFrom(ctx, c.config.Backend, path, version)
+}
+
+// ReadSecretVersionFrom is ReadSecretVersion on the given KV backend. The fallback backend is only
+// tried for reads from the configured backend.
+func (c *Client) ReadSecretVersionFrom(ctx context.Context, backend, path string, version int) (map[string]interface{}, error) {
+	backend = c.backendOrDefault(backend)
+	if version < 0 {
+		return nil, fmt.Errorf("invalid secret version: %d", version)
+	}
+
+	if version > 0 && c.config.KVVersion != "2" {
+		return nil, errors.New("reading a specific secret version requires kv_version = \"2\"")
+	}
+
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	data, err := c.readSecretFrom(ctx, backend, path, c.config.KVVersion, version)
+	if err == nil || backend != c.config.Backend || c.config.FallbackBackend == "" || !stderrors.Is(err, ErrSecretNotFound) {
+		return data, err
+	}
+
+	// During a KV migration the key may not have been copied to the primary backend yet
+	c.logger.WithFields(logrus.Fields{
+		"path":             path,
+		"backend":          c.config.Backend,
+		"fallback_backend": c.config.FallbackBackend,
+	}).Info("Secret not found on primary backend, trying fallback backend")
+
+	data, fallbackErr := c.readSecretFrom(ctx, c.config.FallbackBackend, path, c.config.KVVersion, version)
+	if fallbackErr != nil {
+		if stderrors.Is(fallbackErr, ErrSecretNotFound) {
+			// Report the primary path; the key belongs there once migration is complete
+			return nil, err
+		}
+		return nil, fallbackErr
+	}
+	return data, nil
+}
+
+// ReadSecretKVv1 reads a secret from the configured backend without the KV v2 data wrapping,
+// whatever kv_version says, for secrets written by tools that only spoke KV v1
+func (c *Client) ReadSecretKVv1(ctx context.Context, path string) (map[string]interface{}, error) {
 	if err := c.EnsureAuthenticated(ctx); err != nil {
 		return nil, err
 	}
 
+	return c.readSecretFrom(ctx, c.config.Backend, path, "1", 0)
+}
+
+// readSecretFrom reads a secret version from the given KV backend
+func (c *Client) readSecretFrom(ctx context.Context, backend, path, kvVersion string, version int) (_ map[string]interface{}, err error) {
+	ctx, span := tracing.Start(ctx, "vault.read", attribute.String("vault.backend", backend), attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
 	var fullPath string
-	if c.config.KVVersion == "2" {
+	if kvVersion == "2" {
 		// KV v2: use /data/ path
-		fullPath = fmt.Sprintf("%s/data/%s", c.config.Backend, path)
+		fullPath = fmt.Sprintf("%s/data/%s", backend, path)
 	} else {
 		// KV v1: direct path
-		fullPath = fmt.Sprintf("%s/%s", c.config.Backend, path)
+		fullPath = fmt.Sprintf("%s/%s", backend, path)
 	}
 
 	c.logger.WithFields(logrus.Fields{
 		"path":       fullPath,
-		"kv_version": c.config.KVVersion,
+		"kv_version": kvVersion,
+		"version":    version,
 	}).Debug("Reading secret from Vault")
 
-	resp, err := c.client.Logical().ReadWithContext(ctx, fullPath)
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	var resp *api.Secret
+	if version > 0 {
+		resp, err = c.client.Logical().ReadWithDataWithContext(ctx, fullPath, map[string][]string{
+			"version": {strconv.Itoa(version)},
+		})
+	} else {
+		resp, err = c.client.Logical().ReadWithContext(ctx, fullPath)
+	}
 	if err != nil {
 		return nil, errors.NewVaultReadError(fullPath, err)
 	}
 
 	if resp == nil {
-		return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("secret not found"))
+		return nil, errors.NewVaultReadError(fullPath, ErrSecretNotFound)
 	}
 
-	if resp.Data == nil {
+	// No wrapping is requested, so a wrapped response means a control group holds the secret
+	if resp.WrapInfo != nil && resp.Data == nil {
+		cgErr := newControlGroupError(fullPath, kvVersion, resp.WrapInfo)
+		if status, err := c.CheckControlGroup(ctx, cgErr.Accessor); err != nil {
+			c.logger.WithError(err).Debug("Failed to check control group request")
+		} else {
+			cgErr.Approvals = status.Approvals
+		}
+		return nil, errors.NewVaultReadError(fullPath, cgErr)
+	}
+
+	data, err := secretData(fullPath, kvVersion, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.WithField("path", fullPath).Debug("Successfully read secret from Vault")
+	return data, nil
+}
+
+// secretData extracts the secret from a read of fullPath
+func secretData(fullPath, kvVersion string, resp *api.Secret) (map[string]interface{}, error) {
+	if resp == nil || resp.Data == nil {
 		return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("no data in secret"))
 	}
 
 	var data map[string]interface{}
-	if c.config.KVVersion == "2" {
-		// KV v2: data is nested under "data" field
+	if kvVersion == "2" {
+		// KV v2: data is nested under "data" field, which is null for deleted or destroyed versions
+		if resp.Data["data"] == nil {
+			return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("secret version has been deleted or destroyed"))
+		}
+
 		var ok bool
 		data, ok = resp.Data["data"].(map[string]interface{})
 		if !ok {
@@ -197,22 +481,187 @@ func (c *Client) ReadSecret(ctx context.Context, path string) (map[string]interf
 		// KV v1: data is directly in resp.Data
 		data = resp.Data
 	}
-
-	c.logger.WithField("path", fullPath).Debug("Successfully read secret from Vault")
 	return data, nil
 }
 
+// ListSecrets returns the entries stored directly under path, without sub-folders
+func (c *Client) ListSecrets(ctx context.Context, path string) ([]string, error) {
+	return c.ListSecretsFrom(ctx, c.config.Backend, path)
+}
+
+// ListSecretsFrom is ListSecrets on the given KV backend instead of the configured one
+func (c *Client) ListSecretsFrom(ctx context.Context, backend, path string) (_ []string, err error) {
+	backend = c.backendOrDefault(backend)
+	ctx, span := tracing.Start(ctx, "vault.list", attribute.String("vault.backend", backend), attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	var fullPath string
+	if c.config.KVVersion == "2" {
+		// KV v2: list via the /metadata/ path
+		fullPath = fmt.Sprintf("%s/metadata/%s", backend, path)
+	} else {
+		fullPath = fmt.Sprintf("%s/%s", backend, path)
+	}
+
+	c.logger.WithField("path", fullPath).Debug("Listing secrets in Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().ListWithContext(ctx, fullPath)
+	if err != nil {
+		return nil, errors.NewVaultReadError(fullPath, err)
+	}
+
+	// Vault returns no response when nothing is stored under the path
+	if resp == nil || resp.Data == nil {
+		return nil, nil
+	}
+
+	keys, ok := resp.Data["keys"].([]interface{})
+	if !ok {
+		return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("invalid keys in list response"))
+	}
+
+	var entries []string
+	for _, key := range keys {
+		name, ok := key.(string)
+		if !ok || strings.HasSuffix(name, "/") {
+			continue
+		}
+		entries = append(entries, name)
+	}
+
+	return entries, nil
+}
+
+// DeleteSecret deletes the secret at path. On KV v2 this deletes the latest version,
+// which remains recoverable with 'vault kv undelete'.
+func (c *Client) DeleteSecret(ctx context.Context, path string) error {
+	return c.DeleteSecretFrom(ctx, c.config.Backend, path)
+}
+
+// DeleteSecretFrom is DeleteSecret on the given KV backend instead of the configured one
+func (c *Client) DeleteSecretFrom(ctx context.Context, backend, path string) (err error) {
+	backend = c.backendOrDefault(backend)
+	ctx, span := tracing.Start(ctx, "vault.delete", attribute.String("vault.backend", backend), attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	return c.deleteSecret(ctx, c.deletePath(backend, path), "Successfully deleted secret from Vault")
+}
+
+// DestroySecret permanently removes the secret at path. On KV v2 every version and the
+// metadata are deleted, which 'vault kv undelete' cannot reverse; on KV v1, which keeps no
+// versions, it is the same as DeleteSecret.
+func (c *Client) DestroySecret(ctx context.Context, path string) error {
+	return c.DestroySecretFrom(ctx, c.config.Backend, path)
+}
+
+// DestroySecretFrom is DestroySecret on the given KV backend instead of the configured one
+func (c *Client) DestroySecretFrom(ctx context.Context, backend, path string) (err error) {
+	backend = c.backendOrDefault(backend)
+	ctx, span := tracing.Start(ctx, "vault.destroy", attribute.String("vault.backend", backend), attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	return c.deleteSecret(ctx, c.destroyPath(backend, path), "Successfully destroyed secret in Vault")
+}
+
+// deletePath returns the path whose deletion soft-deletes the latest version of a KV v2 secret
+func (c *Client) deletePath(backend, path string) string {
+	if c.config.KVVersion == "2" {
+		return fmt.Sprintf("%s/data/%s", backend, path)
+	}
+	return fmt.Sprintf("%s/%s", backend, path)
+}
+
+// destroyPath returns the path whose deletion removes a KV v2 secret with all its versions
+func (c *Client) destroyPath(backend, path string) string {
+	if c.config.KVVersion == "2" {
+		return fmt.Sprintf("%s/metadata/%s", backend, path)
+	}
+	return fmt.Sprintf("%s/%s", backend, path)
+}
+
+// deleteSecret issues a delete of fullPath, logging done on success
+func (c *Client) deleteSecret(ctx context.Context, fullPath, done string) error {
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return err
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"path":       fullPath,
+		"kv_version": c.config.KVVersion,
+	}).Debug("Deleting secret from Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return err
+	}
+
+	if _, err := c.client.Logical().DeleteWithContext(ctx, fullPath); err != nil {
+		return errors.NewVaultDeleteError(fullPath, err)
+	}
+
+	c.logger.WithField("path", fullPath).Info(done)
+	return nil
+}
+
+// ProbeWrite confirms that a secret can be stored at path by writing a marker there and removing
+// it again. Unlike a capabilities check it catches mounts that are reachable but read-only, e.g.
+// during maintenance. With KV v2 the metadata is deleted too, leaving the path as it was.
+func (c *Client) ProbeWrite(ctx context.Context, path string) error {
+	return c.ProbeWriteTo(ctx, c.config.Backend, path)
+}
+
+// ProbeWriteTo is ProbeWrite on the given KV backend instead of the configured one
+func (c *Client) ProbeWriteTo(ctx context.Context, backend, path string) error {
+	backend = c.backendOrDefault(backend)
+	probe := map[string]interface{}{
+		"write_probe": time.Now().Format(time.RFC3339),
+	}
+	if err := c.writeSecret(ctx, backend, path, probe, nil); err != nil {
+		return err
+	}
+
+	fullPath := c.destroyPath(backend, path)
+	c.logger.WithField("path", fullPath).Debug("Removing Vault write probe")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return err
+	}
+
+	if _, err := c.client.Logical().DeleteWithContext(ctx, fullPath); err != nil {
+		return errors.NewVaultDeleteError(fullPath, err)
+	}
+	return nil
+}
+
 // WithRetry executes a function with retry logic
 func (c *Client) WithRetry(ctx context.Context, operation func() error) error {
 	var lastErr error
+	var loggedErr string
+	reauthenticated := false
+	retryNow := false
 
 	for attempt := 0; attempt <= c.config.RetryMax; attempt++ {
-		if attempt > 0 {
-			c.logger.WithFields(logrus.Fields{
+		if attempt > 0 && !retryNow {
+			fields := logrus.Fields{
 				"attempt":     attempt,
 				"max_retries": c.config.RetryMax,
 				"delay":       c.config.RetryDelay(),
-			}).Warn("Retrying Vault operation")
+			}
+
+			// During a long outage every attempt fails the same way; only log the error when it changes
+			if c.config.RetryLogDedup && lastErr.Error() == loggedErr {
+				c.logger.WithFields(fields).Warnf("Retrying Vault operation (attempt %d/%d, last error unchanged)", attempt, c.config.RetryMax)
+			} else {
+				loggedErr = lastErr.Error()
+				c.logger.WithFields(fields).WithError(lastErr).Warn("Retrying Vault operation")
+			}
 
 			// Wait before retry
 			select {
@@ -222,12 +671,34 @@ func (c *Client) WithRetry(ctx context.Context, operation func() error) error {
 			}
 		}
 
+		retryNow = false
+
+		token, _ := c.tokenState()
 		lastErr = operation()
 		if lastErr == nil {
 			return nil
 		}
 
 		c.logger.WithError(lastErr).WithField("attempt", attempt).Debug("Vault operation failed")
+
+		// Every read of a control group path opens another request for approvers to act on
+		if IsControlGroupError(lastErr) {
+			return lastErr
+		}
+
+		// A token can expire between the authentication check and the request, e.g. during a
+		// long decrypt --from-file or control group wait. Log in again once and retry straight away
+		// without using up an attempt.
+		if !reauthenticated && isPermissionDenied(lastErr) {
+			reauthenticated = true
+			c.logger.WithError(lastErr).Warn("Vault denied the request, re-authenticating before retrying")
+			if err := c.reauthenticate(ctx, token); err != nil {
+				c.logger.WithError(err).Warn("Re-authentication failed")
+				continue
+			}
+			retryNow = true
+			attempt--
+		}
 	}
 
 	return errors.Wrap(lastErr, fmt.Sprintf("operation failed after %d retries", c.config.RetryMax))
@@ -235,24 +706,27 @@ func (c *Client) WithRetry(ctx context.Context, operation func() error) error {
 
 // GetTokenExpiry returns the token expiration time
 func (c *Client) GetTokenExpiry() time.Time {
-	return c.tokenExp
+	_, exp := c.tokenState()
+	return exp
 }
 
 // IsTokenExpiringWithin checks if the token will expire within the given duration
 func (c *Client) IsTokenExpiringWithin(threshold time.Duration) bool {
-	if c.tokenExp.IsZero() {
+	_, exp := c.tokenState()
+	if exp.IsZero() {
 		// If no expiry is set, consider it as expiring
 		return true
 	}
 
 	expiryThreshold := time.Now().Add(threshold)
-	return c.tokenExp.Before(expiryThreshold)
+	return exp.Before(expiryThreshold)
 }
 
 // IsTokenExpiringByPercentage checks if the token has less than the given percentage of its lifetime remaining
 // percentage should be between 0.0 and 1.0 (e.g., 0.25 for 25%)
 func (c *Client) IsTokenExpiringByPercentage(ctx context.Context, percentage float64) (bool, error) {
-	if c.tokenExp.IsZero() {
+	_, tokenExp := c.tokenState()
+	if tokenExp.IsZero() {
 		// If no expiry is set, consider it as expiring
 		return true, nil
 	}
@@ -268,19 +742,19 @@ func (c *Client) IsTokenExpiringByPercentage(ctx context.Context, percentage flo
 	if !ok || creationTimeStr == "" {
 		// If we can't get creation time, fall back to simple time-based check
 		c.logger.Debug("No creation time available, using simple expiry check")
-		return c.IsTokenExpiringWithin(time.Until(c.tokenExp) * time.Duration(percentage)), nil
+		return c.IsTokenExpiringWithin(time.Until(tokenExp) * time.Duration(percentage)), nil
 	}
 
 	// Parse creation time
 	creationTime, err := time.Parse(time.RFC3339, creationTimeStr)
 	if err != nil {
 		c.logger.WithError(err).Debug("Failed to parse creation time, using simple expiry check")
-		return c.IsTokenExpiringWithin(time.Until(c.tokenExp) * time.Duration(percentage)), nil
+		return c.IsTokenExpiringWithin(time.Until(tokenExp) * time.Duration(percentage)), nil
 	}
 
 	// Calculate total lifetime and remaining lifetime
-	totalLifetime := c.tokenExp.Sub(creationTime)
-	remainingLifetime := time.Until(c.tokenExp)
+	totalLifetime := tokenExp.Sub(creationTime)
+	remainingLifetime := time.Until(tokenExp)
 
 	// Calculate percentage remaining
 	percentageRemaining := float64(remainingLifetime) / float64(totalLifetime)
@@ -315,7 +789,11 @@ func (c *Client) RefreshSecretID(ctx context.Context) (string, error) {
 	}
 
 	// Generate a new secret ID for the AppRole using the role name
-	path := fmt.Sprintf("auth/approle/role/%s/secret-id", c.config.AppRoleName)
+	path := fmt.Sprintf("auth/%s/role/%s/secret-id", c.config.AppRoleMountPath(), c.config.AppRoleName)
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return "", err
+	}
 
 	resp, err := c.client.Logical().WriteWithContext(ctx, path, nil)
 	if err != nil {
@@ -349,27 +827,38 @@ func (c *Client) RefreshToken(ctx context.Context) error {
 		return errors.New("token refresh only applicable for token authentication")
 	}
 
+	if c.tokenManager.IsBatch() {
+		return errors.New("batch tokens cannot be renewed; issue a new token before this one expires")
+	}
+
 	c.logger.Debug("Attempting to refresh Vault token")
 
 	// Use the token manager to renew the token
-	if err := c.tokenManager.Renew(ctx); err != nil {
+	if err := c.renewToken(ctx); err != nil {
 		return errors.Wrap(err, "failed to refresh token")
 	}
 
-	// Update local token info
-	c.token = c.tokenManager.GetToken()
-	c.tokenExp = c.tokenManager.GetExpiresAt()
-
 	c.logger.Info("Successfully refreshed Vault token")
 	return nil
 }
 
-// GetTokenInfo retrieves information about the current token
+// IsBatchToken reports whether the current token is a batch token
+func (c *Client) IsBatchToken() bool {
+	return c.tokenManager.IsBatch()
+}
+
+// GetTokenInfo retrieves information about the current token. Batch tokens are not looked up:
+// their information is built from the lease duration they were issued with, the only reliable
+// source of their validity.
 func (c *Client) GetTokenInfo(ctx context.Context) (map[string]interface{}, error) {
 	if err := c.EnsureAuthenticated(ctx); err != nil {
 		return nil, err
 	}
 
+	if c.tokenManager.IsBatch() {
+		return batchTokenInfo(c.tokenManager.GetIssuedAt(), c.tokenManager.GetTTL(), time.Now()), nil
+	}
+
 	resp, err := c.client.Auth().Token().LookupSelfWithContext(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to lookup token info")
@@ -382,6 +871,23 @@ func (c *Client) GetTokenInfo(ctx context.Context) (map[string]interface{}, erro
 	return resp.Data, nil
 }
 
+// batchTokenInfo describes a batch token issued at issuedAt with the given lease duration, in
+// the layout of a token lookup response
+func batchTokenInfo(issuedAt time.Time, lease time.Duration, now time.Time) map[string]interface{} {
+	remaining := max(issuedAt.Add(lease).Sub(now), 0)
+	info := map[string]interface{}{
+		"type":          "batch",
+		"renewable":     false,
+		"creation_time": issuedAt.UTC().Format(time.RFC3339),
+		"creation_ttl":  json.Number(strconv.FormatInt(int64(lease.Seconds()), 10)),
+		"ttl":           json.Number(strconv.FormatInt(int64(remaining.Seconds()), 10)),
+	}
+	if lease > 0 {
+		info["expire_time"] = issuedAt.Add(lease).UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
 // GetSecretIDInfo retrieves information about a specific secret ID, including its TTL
 func (c *Client) GetSecretIDInfo(ctx context.Context, secretID string) (map[string]interface{}, error) {
 	// Check if using token authentication
@@ -398,11 +904,15 @@ func (c *Client) GetSecretIDInfo(ctx context.Context, secretID string) (map[stri
 	}
 
 	// Look up the secret ID information
-	path := fmt.Sprintf("auth/approle/role/%s/secret-id/lookup", c.config.AppRoleName)
+	path := fmt.Sprintf("auth/%s/role/%s/secret-id/lookup", c.config.AppRoleMountPath(), c.config.AppRoleName)
 	data := map[string]interface{}{
 		"secret_id": secretID,
 	}
 
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.client.Logical().WriteWithContext(ctx, path, data)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("failed to lookup secret ID info (role name: %s)", c.config.AppRoleName))
@@ -417,7 +927,11 @@ func (c *Client) GetSecretIDInfo(ctx context.Context, secretID string) (map[stri
 
 // GetCurrentSecretIDInfo retrieves information about the currently configured secret ID
 func (c *Client) GetCurrentSecretIDInfo(ctx context.Context) (map[string]interface{}, error) {
-	return c.GetSecretIDInfo(ctx, c.config.SecretID)
+	secretID, err := c.config.LoginSecretID()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetSecretIDInfo(ctx, secretID)
 }
 
 // IsSecretIDExpiringWithin checks if the secret ID will expire within the given duration
@@ -458,9 +972,8 @@ func (c *Client) IsSecretIDExpiringWithin(ctx context.Context, threshold time.Du
 		return false, errors.Wrap(err, "failed to parse secret ID expiration time")
 	}
 
-	// Check if expiration is within threshold
-	expiryThreshold := time.Now().Add(threshold)
-	isExpiring := expirationTime.Before(expiryThreshold)
+	// Check if expiration is within threshold, widened by expiry_buffer to allow for clock skew
+	isExpiring := expiresWithinBuffer(time.Now(), expirationTime, threshold+c.config.ExpiryBuffer())
 
 	c.logger.WithFields(logrus.Fields{
 		"expiration_time":   expirationTime.Format(time.RFC3339),
@@ -529,7 +1042,7 @@ func (c *Client) IsSecretIDExpiringByPercentage(ctx context.Context, percentage
 
 	// Calculate total lifetime and remaining lifetime
 	totalLifetime := expirationTime.Sub(creationTime)
-	remainingLifetime := time.Until(expirationTime)
+	remainingLifetime := time.Until(expirationTime) - c.config.ExpiryBuffer()
 
 	// Calculate percentage remaining
 	percentageRemaining := float64(remainingLifetime) / float64(totalLifetime)
@@ -546,9 +1059,10 @@ func (c *Client) IsSecretIDExpiringByPercentage(ctx context.Context, percentage
 
 // Close performs any necessary cleanup
 func (c *Client) Close() error {
+	c.StopTokenRenewer()
+
 	// Clear sensitive data
-	c.token = ""
-	c.tokenExp = time.Time{}
+	c.setToken("", time.Time{})
 
 	if c.client != nil {
 		c.client.SetToken("")
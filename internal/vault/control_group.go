@@ -0,0 +1,138 @@
+package vault
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// ControlGroupError is the cause of a VaultReadError when the path is guarded by a Vault
+// Enterprise control group: instead of the secret, Vault returns a wrapping token that can only
+// be unwrapped once enough approvers have authorized the request.
+type ControlGroupError struct {
+	Path     string
+	Accessor string
+	// Approvals is how many approvers had authorized the request when it was last checked. Vault
+	// does not report how many the control group requires; that is set in the policy.
+	Approvals int
+	// Expires is when the request and its wrapping token expire
+	Expires time.Time
+
+	token     string // Wrapping token to unwrap once approved; never included in messages
+	kvVersion string
+}
+
+// Error implements the error interface
+func (e *ControlGroupError) Error() string {
+	return fmt.Sprintf("reading %s requires control group approval (accessor %s, %d approval(s) so far, request expires %s); "+
+		"an approver can authorize it with 'vault write sys/control-group/authorize accessor=%s', then retry or use decrypt --wait-for-approval",
+		e.Path, e.Accessor, e.Approvals, e.Expires.Format(time.RFC3339), e.Accessor)
+}
+
+// IsControlGroupError reports whether err is a read waiting for control group approval
+func IsControlGroupError(err error) bool {
+	var cgErr *ControlGroupError
+	return stderrors.As(err, &cgErr)
+}
+
+// ControlGroupStatus is the state of a control group request
+type ControlGroupStatus struct {
+	Approved  bool
+	Approvals int
+}
+
+// newControlGroupError builds the error for a read of fullPath that Vault answered with wrap info
+func newControlGroupError(fullPath, kvVersion string, wrapInfo *api.SecretWrapInfo) *ControlGroupError {
+	return &ControlGroupError{
+		Path:      fullPath,
+		Accessor:  wrapInfo.Accessor,
+		Expires:   wrapInfo.CreationTime.Add(time.Duration(wrapInfo.TTL) * time.Second),
+		token:     wrapInfo.Token,
+		kvVersion: kvVersion,
+	}
+}
+
+// CheckControlGroup returns the state of the control group request with accessor
+func (c *Client) CheckControlGroup(ctx context.Context, accessor string) (*ControlGroupStatus, error) {
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().WriteWithContext(ctx, "sys/control-group/request", map[string]interface{}{
+		"accessor": accessor,
+	})
+	if err != nil {
+		return nil, errors.NewVaultReadError("sys/control-group/request", err)
+	}
+	if resp == nil || resp.Data == nil {
+		return nil, errors.NewVaultReadError("sys/control-group/request", fmt.Errorf("no data in control group status"))
+	}
+
+	status := &ControlGroupStatus{}
+	status.Approved, _ = resp.Data["approved"].(bool)
+	if authorizations, ok := resp.Data["authorizations"].([]interface{}); ok {
+		status.Approvals = len(authorizations)
+	}
+	return status, nil
+}
+
+// WaitForControlGroup polls the control group request of cgErr every interval until it is
+// approved, then unwraps and returns the secret. Failed checks are retried at the next poll, since
+// approval may take hours. It gives up when ctx is done or the request expires.
+func (c *Client) WaitForControlGroup(ctx context.Context, cgErr *ControlGroupError, interval time.Duration) (map[string]interface{}, error) {
+	if !time.Now().Before(cgErr.Expires) {
+		return nil, fmt.Errorf("control group request %s expired before it was approved", cgErr.Accessor)
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, cgErr.Expires)
+	defer cancel()
+
+	for {
+		status, err := c.CheckControlGroup(ctx, cgErr.Accessor)
+		if err != nil {
+			c.logger.WithError(err).WithField("accessor", cgErr.Accessor).Warn("Failed to check control group request")
+		} else {
+			cgErr.Approvals = status.Approvals
+			if status.Approved {
+				break
+			}
+
+			c.logger.WithFields(logrus.Fields{
+				"path":      cgErr.Path,
+				"accessor":  cgErr.Accessor,
+				"approvals": status.Approvals,
+				"expires":   cgErr.Expires.Format(time.RFC3339),
+			}).Info("Waiting for control group approval")
+		}
+
+		select {
+		case <-ctx.Done():
+			if stderrors.Is(ctx.Err(), context.DeadlineExceeded) && !time.Now().Before(cgErr.Expires) {
+				return nil, fmt.Errorf("control group request %s expired before it was approved", cgErr.Accessor)
+			}
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"path":      cgErr.Path,
+		"accessor":  cgErr.Accessor,
+		"approvals": cgErr.Approvals,
+	}).Info("Control group request approved, unwrapping secret")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Logical().UnwrapWithContext(ctx, cgErr.token)
+	if err != nil {
+		return nil, errors.NewVaultReadError(cgErr.Path, fmt.Errorf("failed to unwrap approved control group request: %w", err))
+	}
+	return secretData(cgErr.Path, cgErr.kvVersion, resp)
+}
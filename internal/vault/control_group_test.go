@@ -0,0 +1,125 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+// newControlGroupServer serves a KV v2 key guarded by a control group that is approved after
+// approveAfter status checks
+func newControlGroupServer(t *testing.T, approveAfter int, created time.Time) (*Client, *int) {
+	t.Helper()
+
+	checks := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/vault-dm-crypt/host/guarded":
+			// A control group answers the read with a wrapping token instead of the secret
+			fmt.Fprintf(w, `{"wrap_info": {"token": "hvs.wrapping", "accessor": "cg-accessor", "ttl": 3600, "creation_time": %q, "creation_path": "secret/data/vault-dm-crypt/host/guarded"}}`,
+				created.Format(time.RFC3339Nano))
+		case "/v1/sys/control-group/request":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "cg-accessor", body["accessor"])
+
+			checks++
+			approved := checks > approveAfter
+			fmt.Fprintf(w, `{"data": {"approved": %t, "request_path": "secret/data/vault-dm-crypt/host/guarded", "authorizations": [{"entity_id": "e1", "entity_name": "approver"}]}}`, approved)
+		case "/v1/sys/wrapping/unwrap":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "hvs.wrapping", body["token"])
+			assert.Equal(t, "test-token", r.Header.Get("X-Vault-Token"), "unwrapped with the requester's token")
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "guarded-key"}, "metadata": {"version": 1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	apiClient := newTestVaultServer(t, handler)
+	apiClient.SetToken("test-token")
+
+	return &Client{
+		client: apiClient,
+		config: &config.VaultConfig{Backend: "secret", KVVersion: "2"},
+		logger: logger,
+		token:  "test-token",
+	}, &checks
+}
+
+func TestReadSecretControlGroup(t *testing.T) {
+	client, checks := newControlGroupServer(t, 100, time.Now())
+
+	_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/guarded")
+	require.Error(t, err)
+	assert.True(t, IsControlGroupError(err))
+	assert.NotContains(t, err.Error(), "no data in secret")
+	assert.Contains(t, err.Error(), "accessor cg-accessor")
+	assert.Contains(t, err.Error(), "1 approval(s) so far")
+	assert.NotContains(t, err.Error(), "hvs.wrapping", "the wrapping token is never shown")
+	assert.Equal(t, 1, *checks)
+
+	t.Run("not retried", func(t *testing.T) {
+		client.config.RetryMax = 3
+		reads := 0
+		err := client.WithRetry(context.Background(), func() error {
+			reads++
+			_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/guarded")
+			return err
+		})
+		assert.True(t, IsControlGroupError(err))
+		assert.Equal(t, 1, reads, "each read would open another request")
+	})
+}
+
+func TestWaitForControlGroup(t *testing.T) {
+	t.Run("approved", func(t *testing.T) {
+		client, checks := newControlGroupServer(t, 3, time.Now())
+
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/guarded")
+		var cgErr *ControlGroupError
+		require.ErrorAs(t, err, &cgErr)
+
+		data, err := client.WaitForControlGroup(context.Background(), cgErr, time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, "guarded-key", data["dmcrypt_key"])
+		assert.Equal(t, 4, *checks)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		client, _ := newControlGroupServer(t, 100, time.Now().Add(-time.Hour))
+
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/guarded")
+		var cgErr *ControlGroupError
+		require.ErrorAs(t, err, &cgErr)
+
+		_, err = client.WaitForControlGroup(context.Background(), cgErr, time.Millisecond)
+		assert.EqualError(t, err, "control group request cg-accessor expired before it was approved")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		client, _ := newControlGroupServer(t, 100, time.Now())
+
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/guarded")
+		var cgErr *ControlGroupError
+		require.ErrorAs(t, err, &cgErr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = client.WaitForControlGroup(ctx, cgErr, time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,245 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// SchemaVersionField records the layout a device secret was stored with
+const SchemaVersionField = "schema_version"
+
+// CurrentSchemaVersion is the layout of device secrets stored by this release. Secrets without a
+// schema_version were stored before it was introduced and are version 0.
+const CurrentSchemaVersion = 1
+
+// DeviceSecret is the metadata stored with a device key, normalized to the current schema
+// whatever schema it was stored with. The key itself is read separately since the fields it may
+// be stored under are configurable.
+type DeviceSecret struct {
+	// SchemaVersion is the schema the secret was stored with, before migration
+	SchemaVersion int
+
+	CreatedAt  string // RFC 3339, as stored; empty if unknown
+	RotatedAt  string // RFC 3339, set when the key was rotated in place
+	Device     string
+	DeviceByID string // /dev/disk/by-id link to Device, if there is one
+	Hostname   string
+	Integrity  string
+	Filesystem string
+	Offset     uint64 // Data offset in 512-byte sectors, 0 for the default
+	Label      string
+	Subsystem  string
+	LoopFile   string // Disk image encrypted through a loop device, if any
+	Profile    string // [[device]] profile that chose the key's location, if any
+
+	NoReadWorkqueue  bool
+	NoWriteWorkqueue bool
+
+	TPMSealed      string // TPM-sealed wrapping of the stored key, if any
+	KeySplit       string // Scheme the key was split with, if any
+	KeyEncoding    string // Encoding of the stored key; empty for base64
+	MetadataMAC    string
+	KeyFingerprint string
+
+	Tags map[string]string
+}
+
+// DevicePath returns the device path stored with the key, preferring the /dev/disk/by-id path,
+// which keeps referring to the same disk when kernel names change between boots
+func (s *DeviceSecret) DevicePath() string {
+	if s.DeviceByID != "" {
+		return s.DeviceByID
+	}
+	return s.Device
+}
+
+// schemaMigrations[n] rewrites the data of a version n secret into the layout of version n+1
+var schemaMigrations = []func(data map[string]interface{}){
+	migrateSchemaV0,
+}
+
+// stringFields maps the stored names of the string fields of s to the fields
+func (s *DeviceSecret) stringFields() map[string]*string {
+	return map[string]*string{
+		"created_at":      &s.CreatedAt,
+		"rotated_at":      &s.RotatedAt,
+		"device":          &s.Device,
+		"device_by_id":    &s.DeviceByID,
+		"hostname":        &s.Hostname,
+		"integrity":       &s.Integrity,
+		"filesystem":      &s.Filesystem,
+		"label":           &s.Label,
+		"subsystem":       &s.Subsystem,
+		"loop_file":       &s.LoopFile,
+		"profile":         &s.Profile,
+		"tpm_sealed":      &s.TPMSealed,
+		"key_split":       &s.KeySplit,
+		"key_encoding":    &s.KeyEncoding,
+		"metadata_mac":    &s.MetadataMAC,
+		"key_fingerprint": &s.KeyFingerprint,
+	}
+}
+
+// boolFields maps the stored names of the boolean fields of s to the fields
+func (s *DeviceSecret) boolFields() map[string]*bool {
+	return map[string]*bool{
+		"no_read_workqueue":  &s.NoReadWorkqueue,
+		"no_write_workqueue": &s.NoWriteWorkqueue,
+	}
+}
+
+// DecodeDeviceSecret migrates secret data read from Vault to the current schema and decodes it.
+// data itself is not modified. Secrets stored by a newer release are refused, since fields
+// this release does not know could change how the device must be opened.
+func DecodeDeviceSecret(data map[string]interface{}) (*DeviceSecret, error) {
+	version := 0
+	if raw, ok := data[SchemaVersionField]; ok {
+		value, ok := uintValue(raw)
+		if !ok || value > math.MaxInt32 {
+			return nil, fmt.Errorf("invalid %s %v in stored secret", SchemaVersionField, raw)
+		}
+		version = int(value)
+	}
+	if version > CurrentSchemaVersion {
+		return nil, fmt.Errorf("stored secret has %s %d, but this release only understands up to %d; upgrade vault-dm-crypt",
+			SchemaVersionField, version, CurrentSchemaVersion)
+	}
+
+	migrated := make(map[string]interface{}, len(data))
+	for field, value := range data {
+		migrated[field] = value
+	}
+	for v := version; v < CurrentSchemaVersion; v++ {
+		schemaMigrations[v](migrated)
+	}
+
+	secret := &DeviceSecret{SchemaVersion: version}
+	for field, target := range secret.stringFields() {
+		if raw, ok := migrated[field]; ok {
+			value, ok := raw.(string)
+			if !ok {
+				return nil, invalidFieldError(field, "a string", raw)
+			}
+			*target = value
+		}
+	}
+
+	for field, target := range secret.boolFields() {
+		if raw, ok := migrated[field]; ok {
+			value, ok := raw.(bool)
+			if !ok {
+				return nil, invalidFieldError(field, "a boolean", raw)
+			}
+			*target = value
+		}
+	}
+
+	if raw, ok := migrated["offset"]; ok {
+		value, ok := uintValue(raw)
+		if !ok {
+			return nil, invalidFieldError("offset", "a non-negative integer", raw)
+		}
+		secret.Offset = value
+	}
+
+	if raw, ok := migrated["tags"]; ok {
+		tags, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, invalidFieldError("tags", "an object", raw)
+		}
+		secret.Tags = make(map[string]string, len(tags))
+		for key, rawValue := range tags {
+			value, ok := rawValue.(string)
+			if !ok {
+				return nil, invalidFieldError("tags."+key, "a string", rawValue)
+			}
+			secret.Tags[key] = value
+		}
+	}
+
+	return secret, nil
+}
+
+// migrateSchemaV0 normalizes secrets stored before schema versions. Their fields were written by
+// several releases and sometimes by hand with 'vault kv put', which stores every value as a
+// string, so values are converted where their meaning is clear. Values that cannot be
+// interpreted are dropped, as earlier releases ignored them too.
+func migrateSchemaV0(data map[string]interface{}) {
+	var fields DeviceSecret
+	for field := range fields.stringFields() {
+		if raw, ok := data[field]; ok {
+			if _, ok := raw.(string); !ok {
+				delete(data, field)
+			}
+		}
+	}
+
+	for field := range fields.boolFields() {
+		switch raw := data[field].(type) {
+		case nil, bool:
+		case string:
+			if value, err := strconv.ParseBool(raw); err == nil {
+				data[field] = value
+			} else {
+				delete(data, field)
+			}
+		default:
+			delete(data, field)
+		}
+	}
+
+	if raw, ok := data["offset"]; ok {
+		if value, ok := uintValue(raw); ok {
+			data["offset"] = value
+		} else {
+			delete(data, "offset")
+		}
+	}
+
+	if raw, ok := data["tags"]; ok {
+		if tags, ok := raw.(map[string]interface{}); ok {
+			normalized := make(map[string]interface{}, len(tags))
+			for key, value := range tags {
+				normalized[key] = fmt.Sprint(value)
+			}
+			data["tags"] = normalized
+		} else {
+			delete(data, "tags")
+		}
+	}
+
+	data[SchemaVersionField] = 1
+}
+
+// uintValue converts a number decoded from Vault's JSON (json.Number), a Go integer written by
+// this program, or a decimal string to a uint64
+func uintValue(raw interface{}) (uint64, bool) {
+	switch value := raw.(type) {
+	case json.Number:
+		parsed, err := strconv.ParseUint(value.String(), 10, 64)
+		return parsed, err == nil
+	case string:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		return parsed, err == nil
+	case float64:
+		if value < 0 || value != math.Trunc(value) || value > math.MaxUint64 {
+			return 0, false
+		}
+		return uint64(value), true
+	case int:
+		return uint64(value), value >= 0
+	case int64:
+		return uint64(value), value >= 0
+	case uint64:
+		return value, true
+	default:
+		return 0, false
+	}
+}
+
+// invalidFieldError reports a field of a current-schema secret holding the wrong type
+func invalidFieldError(field, expected string, raw interface{}) error {
+	return fmt.Errorf("invalid %s in stored secret: expected %s, got %T", field, expected, raw)
+}
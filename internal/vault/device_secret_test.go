@@ -0,0 +1,155 @@
+package vault
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDeviceSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want *DeviceSecret
+	}{
+		{
+			// Python vaultlocker stored nothing but the key
+			name: "vaultlocker key only",
+			data: map[string]interface{}{"dmcrypt_key": "a2V5"},
+			want: &DeviceSecret{},
+		},
+		{
+			name: "early native entry",
+			data: map[string]interface{}{
+				"dmcrypt_key": "a2V5",
+				"created_at":  "2024-01-02T03:04:05Z",
+				"hostname":    "node1",
+				"device":      "/dev/sdb1",
+			},
+			want: &DeviceSecret{CreatedAt: "2024-01-02T03:04:05Z", Hostname: "node1", Device: "/dev/sdb1"},
+		},
+		{
+			name: "unversioned entry with open flags, offset and tags",
+			data: map[string]interface{}{
+				"dmcrypt_key":       "a2V5",
+				"device":            "/dev/sdb",
+				"device_by_id":      "/dev/disk/by-id/wwn-0x5002538e40a1b2c3",
+				"integrity":         "hmac-sha256",
+				"offset":            json.Number("32768"),
+				"no_read_workqueue": true,
+				"tags":              map[string]interface{}{"ticket": "OPS-1"},
+			},
+			want: &DeviceSecret{
+				Device:          "/dev/sdb",
+				DeviceByID:      "/dev/disk/by-id/wwn-0x5002538e40a1b2c3",
+				Integrity:       "hmac-sha256",
+				Offset:          32768,
+				NoReadWorkqueue: true,
+				Tags:            map[string]string{"ticket": "OPS-1"},
+			},
+		},
+		{
+			// 'vault kv put' stores every value as a string
+			name: "unversioned entry edited by hand",
+			data: map[string]interface{}{
+				"dmcrypt_key":        "a2V5",
+				"no_read_workqueue":  "true",
+				"no_write_workqueue": "maybe",
+				"offset":             "2048",
+				"hostname":           json.Number("42"),
+				"tags":               map[string]interface{}{"rack": json.Number("7")},
+			},
+			want: &DeviceSecret{
+				NoReadWorkqueue: true,
+				Offset:          2048,
+				Tags:            map[string]string{"rack": "7"},
+			},
+		},
+		{
+			name: "current schema",
+			data: map[string]interface{}{
+				"dmcrypt_key":        "c2VhbGVk",
+				"schema_version":     json.Number("1"),
+				"created_at":         "2025-06-01T12:00:00Z",
+				"device":             "/dev/loop0",
+				"loop_file":          "/var/lib/images/data.img",
+				"profile":            "fast",
+				"filesystem":         "xfs",
+				"label":              "data",
+				"subsystem":          "backup",
+				"no_write_workqueue": true,
+				"tpm_sealed":         "dHBt",
+				"key_split":          "xor",
+				"metadata_mac":       "abcd",
+				"key_fingerprint":    "sha256:3bded9423d40a742035c6020996cfc80",
+			},
+			want: &DeviceSecret{
+				SchemaVersion:    1,
+				CreatedAt:        "2025-06-01T12:00:00Z",
+				Device:           "/dev/loop0",
+				LoopFile:         "/var/lib/images/data.img",
+				Profile:          "fast",
+				Filesystem:       "xfs",
+				Label:            "data",
+				Subsystem:        "backup",
+				NoWriteWorkqueue: true,
+				TPMSealed:        "dHBt",
+				KeySplit:         "xor",
+				MetadataMAC:      "abcd",
+				KeyFingerprint:   "sha256:3bded9423d40a742035c6020996cfc80",
+			},
+		},
+		{
+			// As written by encrypt before the round trip through Vault's JSON
+			name: "current schema as written",
+			data: map[string]interface{}{"dmcrypt_key": "a2V5", "schema_version": CurrentSchemaVersion, "offset": uint64(4096)},
+			want: &DeviceSecret{SchemaVersion: CurrentSchemaVersion, Offset: 4096},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := DecodeDeviceSecret(tt.data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, secret)
+		})
+	}
+}
+
+func TestDecodeDeviceSecretLeavesDataUnchanged(t *testing.T) {
+	data := map[string]interface{}{"dmcrypt_key": "a2V5", "offset": "2048", "no_read_workqueue": "yes"}
+
+	_, err := DecodeDeviceSecret(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"dmcrypt_key": "a2V5", "offset": "2048", "no_read_workqueue": "yes"}, data)
+}
+
+func TestDecodeDeviceSecretErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		wantErr string
+	}{
+		{"newer schema", map[string]interface{}{"schema_version": json.Number("2")}, "upgrade vault-dm-crypt"},
+		{"invalid schema version", map[string]interface{}{"schema_version": "one"}, "invalid schema_version"},
+		{"negative schema version", map[string]interface{}{"schema_version": json.Number("-1")}, "invalid schema_version"},
+		{"current schema with wrong type", map[string]interface{}{"schema_version": 1, "no_read_workqueue": "true"}, "invalid no_read_workqueue"},
+		{"current schema with bad offset", map[string]interface{}{"schema_version": 1, "offset": json.Number("-8")}, "invalid offset"},
+		{"current schema with bad tags", map[string]interface{}{"schema_version": 1, "tags": "ticket=OPS-1"}, "invalid tags"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeDeviceSecret(tt.data)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestDeviceSecretDevicePath(t *testing.T) {
+	assert.Equal(t, "/dev/sdb", (&DeviceSecret{Device: "/dev/sdb"}).DevicePath())
+	assert.Equal(t, "/dev/disk/by-id/wwn-1", (&DeviceSecret{Device: "/dev/sdb", DeviceByID: "/dev/disk/by-id/wwn-1"}).DevicePath())
+}
@@ -0,0 +1,151 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// MountInfo describes the secrets engine mounted at a backend path
+type MountInfo struct {
+	Type      string
+	KVVersion string // "1" or "2" for KV mounts, empty otherwise
+}
+
+// SecretDataPath returns the API path of a secret's data for the configured KV version
+func (c *Client) SecretDataPath(path string) string {
+	if c.config.KVVersion == "2" {
+		return fmt.Sprintf("%s/data/%s", c.config.Backend, path)
+	}
+	return fmt.Sprintf("%s/%s", c.config.Backend, path)
+}
+
+// CapabilitiesSelf returns the current token's capabilities on each of the given API paths
+func (c *Client) CapabilitiesSelf(ctx context.Context, paths ...string) (map[string][]string, error) {
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	c.logger.WithField("paths", paths).Debug("Querying token capabilities")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().WriteWithContext(ctx, "sys/capabilities-self", map[string]interface{}{
+		"paths": paths,
+	})
+	if err != nil {
+		return nil, errors.NewVaultReadError("sys/capabilities-self", err)
+	}
+	if resp == nil {
+		return nil, errors.NewVaultReadError("sys/capabilities-self", fmt.Errorf("empty response"))
+	}
+
+	return parseCapabilities(resp.Data, paths)
+}
+
+// parseCapabilities extracts per-path capabilities from a sys/capabilities-self response. Vault
+// keys the result by path; with a single path older servers only return "capabilities".
+func parseCapabilities(data map[string]interface{}, paths []string) (map[string][]string, error) {
+	result := make(map[string][]string, len(paths))
+	for _, path := range paths {
+		raw, ok := data[path]
+		if !ok && len(paths) == 1 {
+			raw, ok = data["capabilities"]
+		}
+		if !ok {
+			return nil, fmt.Errorf("no capabilities returned for %s", path)
+		}
+
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid capabilities format for %s", path)
+		}
+
+		capabilities := make([]string, 0, len(list))
+		for _, item := range list {
+			capability, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid capabilities format for %s", path)
+			}
+			capabilities = append(capabilities, capability)
+		}
+		result[path] = capabilities
+	}
+	return result, nil
+}
+
+// MissingCapabilities returns the capabilities in required that have does not grant
+func MissingCapabilities(have, required []string) []string {
+	granted := make(map[string]bool, len(have))
+	for _, capability := range have {
+		switch capability {
+		case "root":
+			return nil
+		case "deny":
+			return required
+		}
+		granted[capability] = true
+	}
+
+	var missing []string
+	for _, capability := range required {
+		if !granted[capability] {
+			missing = append(missing, capability)
+		}
+	}
+	return missing
+}
+
+// GetMountInfo returns the type and KV version of the secrets engine mounted at the configured
+// backend. It uses the same preflight endpoint as the vault CLI, which any token with access to
+// the mount may read.
+func (c *Client) GetMountInfo(ctx context.Context) (*MountInfo, error) {
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	fullPath := "sys/internal/ui/mounts/" + strings.Trim(c.config.Backend, "/")
+	c.logger.WithFields(logrus.Fields{
+		"backend": c.config.Backend,
+		"path":    fullPath,
+	}).Debug("Reading mount information from Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().ReadWithContext(ctx, fullPath)
+	if err != nil {
+		return nil, errors.NewVaultReadError(fullPath, err)
+	}
+	if resp == nil || resp.Data == nil {
+		return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("no mount found at %s", c.config.Backend))
+	}
+
+	return parseMountInfo(resp.Data), nil
+}
+
+// parseMountInfo extracts the engine type and KV version from mount data
+func parseMountInfo(data map[string]interface{}) *MountInfo {
+	info := &MountInfo{}
+	info.Type, _ = data["type"].(string)
+
+	// "generic" is the name of KV v1 on old Vault versions
+	if info.Type != "kv" && info.Type != "generic" {
+		return info
+	}
+
+	info.KVVersion = "1"
+	if options, ok := data["options"].(map[string]interface{}); ok {
+		if version, ok := options["version"].(string); ok && version != "" {
+			info.KVVersion = version
+		}
+	}
+	return info
+}
@@ -0,0 +1,134 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   map[string]interface{}
+		paths  []string
+		want   map[string][]string
+		errMsg string
+	}{
+		{
+			name: "keyed by path",
+			data: map[string]interface{}{
+				"capabilities":          []interface{}{"read"},
+				"secret/data/host/uuid": []interface{}{"read"},
+				"secret/metadata/host":  []interface{}{"list"},
+			},
+			paths: []string{"secret/data/host/uuid", "secret/metadata/host"},
+			want: map[string][]string{
+				"secret/data/host/uuid": {"read"},
+				"secret/metadata/host":  {"list"},
+			},
+		},
+		{
+			name:  "single path from older servers",
+			data:  map[string]interface{}{"capabilities": []interface{}{"create", "read", "update"}},
+			paths: []string{"secret/data/host/uuid"},
+			want:  map[string][]string{"secret/data/host/uuid": {"create", "read", "update"}},
+		},
+		{
+			name:   "path missing",
+			data:   map[string]interface{}{"secret/data/other": []interface{}{"read"}},
+			paths:  []string{"secret/data/host/uuid", "secret/data/other"},
+			errMsg: "no capabilities returned for secret/data/host/uuid",
+		},
+		{
+			name:   "invalid format",
+			data:   map[string]interface{}{"secret/data/host/uuid": "read"},
+			paths:  []string{"secret/data/host/uuid"},
+			errMsg: "invalid capabilities format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCapabilities(tt.data, tt.paths)
+			if tt.errMsg != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMissingCapabilities(t *testing.T) {
+	required := []string{"create", "read", "update"}
+
+	assert.Empty(t, MissingCapabilities([]string{"create", "read", "update", "delete"}, required))
+	assert.Equal(t, []string{"create", "update"}, MissingCapabilities([]string{"read", "list"}, required))
+	assert.Empty(t, MissingCapabilities([]string{"root"}, required))
+	assert.Equal(t, required, MissingCapabilities([]string{"deny"}, required))
+	assert.Equal(t, required, MissingCapabilities(nil, required))
+}
+
+func TestCapabilitiesSelf(t *testing.T) {
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/capabilities-self" || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body struct {
+			Paths []string `json:"paths"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, []string{"secret/data/vault-dm-crypt/host/uuid-1"}, body.Paths)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data": {"capabilities": ["read"], "secret/data/vault-dm-crypt/host/uuid-1": ["read"]}}`))
+	})
+
+	dataPath := client.SecretDataPath("vault-dm-crypt/host/uuid-1")
+	capabilities, err := client.CapabilitiesSelf(context.Background(), dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"read"}, capabilities[dataPath])
+}
+
+func TestGetMountInfo(t *testing.T) {
+	responses := map[string]string{
+		"/v1/sys/internal/ui/mounts/secret": `{"data": {"type": "kv", "path": "secret/", "options": {"version": "2"}}}`,
+		"/v1/sys/internal/ui/mounts/kv1":    `{"data": {"type": "kv", "path": "kv1/", "options": null}}`,
+		"/v1/sys/internal/ui/mounts/pki":    `{"data": {"type": "pki", "path": "pki/"}}`,
+	}
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	})
+
+	info, err := client.GetMountInfo(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &MountInfo{Type: "kv", KVVersion: "2"}, info)
+
+	client.config.Backend = "kv1"
+	info, err = client.GetMountInfo(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &MountInfo{Type: "kv", KVVersion: "1"}, info)
+
+	client.config.Backend = "pki"
+	info, err = client.GetMountInfo(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &MountInfo{Type: "pki"}, info)
+
+	client.config.Backend = "missing"
+	_, err = client.GetMountInfo(context.Background())
+	require.Error(t, err)
+}
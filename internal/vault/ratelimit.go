@@ -0,0 +1,47 @@
+package vault
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// newRateLimiter returns a limiter for the configured request rate, or nil when unlimited
+func newRateLimiter(requestsPerSecond float64) *rate.Limiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+
+	// A burst of one keeps the aggregate rate bounded even when many callers start at once
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+}
+
+// waitForRateLimit blocks until the client-side rate limiter admits another Vault request.
+// The limiter is shared by every caller of the Client, so concurrent workers are bounded together.
+func (c *Client) waitForRateLimit(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+
+	reservation := c.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay <= 0 {
+		return nil
+	}
+
+	c.logger.WithField("delay", delay).Debug("Delaying Vault request to respect max_requests_per_second")
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return errors.Wrap(ctx.Err(), "cancelled while waiting for Vault rate limit")
+	}
+}
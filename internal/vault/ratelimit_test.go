@@ -0,0 +1,70 @@
+package vault
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterSpreadsRequests(t *testing.T) {
+	var mu sync.Mutex
+	var requestTimes []time.Time
+
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestTimes = append(requestTimes, time.Now())
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "key"}}}`))
+	})
+	client.limiter = newRateLimiter(20)
+
+	// Several workers sharing one client, as when unlocking many devices at once
+	const requests = 6
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/uuid-1")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	require.Len(t, requestTimes, requests)
+
+	// 20 req/s with a burst of one: the first request is immediate, each further one waits 50ms
+	assert.GreaterOrEqual(t, elapsed, 230*time.Millisecond)
+}
+
+func TestRateLimiterHonoursContext(t *testing.T) {
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "key"}}}`))
+	})
+	client.limiter = newRateLimiter(0.1)
+
+	// Consume the only token so the next request has to wait ten seconds
+	require.NoError(t, client.waitForRateLimit(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.ReadSecret(ctx, "vault-dm-crypt/host/uuid-1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "waiting for Vault rate limit")
+}
+
+func TestNewRateLimiterUnlimited(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0))
+	assert.NotNil(t, newRateLimiter(5))
+}
@@ -0,0 +1,116 @@
+package vault
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// minRenewInterval is the shortest delay between renewal attempts, used after a
+// failed renewal and as a floor for very short token TTLs
+const minRenewInterval = 5 * time.Second
+
+// StartTokenRenewer launches a background goroutine that renews the token at 2/3 of its TTL.
+// The renewer stops when ctx is cancelled or StopTokenRenewer is called.
+func (c *Client) StartTokenRenewer(ctx context.Context) error {
+	c.renewerMu.Lock()
+	defer c.renewerMu.Unlock()
+
+	if c.renewerCancel != nil {
+		return errors.New("token renewer already running")
+	}
+
+	renewCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.renewerCancel = cancel
+	c.renewerDone = done
+
+	go c.runTokenRenewer(renewCtx, done)
+
+	c.logger.Debug("Token renewer started")
+	return nil
+}
+
+// StopTokenRenewer stops the background token renewer and waits for it to exit
+func (c *Client) StopTokenRenewer() {
+	c.renewerMu.Lock()
+	cancel, done := c.renewerCancel, c.renewerDone
+	c.renewerCancel = nil
+	c.renewerDone = nil
+	c.renewerMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+
+	c.logger.Debug("Token renewer stopped")
+}
+
+// runTokenRenewer is the renewal loop run by StartTokenRenewer
+func (c *Client) runTokenRenewer(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	interval := c.renewalInterval()
+	for {
+		if interval <= 0 {
+			c.logger.Debug("Token has no TTL, nothing to renew")
+			return
+		}
+
+		c.logger.WithField("renew_in", interval).Debug("Scheduled token renewal")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.after(interval):
+		}
+
+		if err := c.renewToken(ctx); err != nil {
+			c.logger.WithError(err).Warn("Background token renewal failed")
+			interval = minRenewInterval
+			continue
+		}
+
+		interval = c.renewalInterval()
+	}
+}
+
+// renewalInterval returns the delay until the next renewal: 2/3 of the current token TTL
+func (c *Client) renewalInterval() time.Duration {
+	ttl := c.tokenManager.GetTTL()
+	if ttl <= 0 {
+		return 0
+	}
+
+	interval := ttl * 2 / 3
+	if interval < minRenewInterval {
+		interval = minRenewInterval
+	}
+
+	return interval
+}
+
+// renewToken renews (or re-authenticates) via the token manager and updates the cached token state
+func (c *Client) renewToken(ctx context.Context) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if err := c.tokenManager.Renew(ctx); err != nil {
+		return err
+	}
+
+	exp := c.tokenManager.GetExpiresAt()
+	c.setToken(c.tokenManager.GetToken(), exp)
+
+	c.logger.WithFields(logrus.Fields{
+		"expires_at": exp.Format(time.RFC3339),
+	}).Debug("Token renewed in background")
+
+	return nil
+}
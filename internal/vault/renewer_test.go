@@ -0,0 +1,131 @@
+package vault
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock records the durations the renewer waits for and lets the test fire them
+type fakeClock struct {
+	scheduled chan time.Duration
+	fire      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		scheduled: make(chan time.Duration, 10),
+		fire:      make(chan time.Time),
+	}
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.scheduled <- d
+	return f.fire
+}
+
+func (f *fakeClock) nextScheduled(t *testing.T) time.Duration {
+	t.Helper()
+
+	select {
+	case d := <-f.scheduled:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for renewal to be scheduled")
+		return 0
+	}
+}
+
+func TestClientTokenRenewer(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	var renewals atomic.Int32
+	apiClient := newTestVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/renew-self" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		renewals.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"auth": {"client_token": "test-token", "lease_duration": 90, "renewable": true}}`))
+	})
+	apiClient.SetToken("test-token")
+
+	tm := NewTokenManager(apiClient, &MockAuthMethod{name: "mock"}, logger)
+	tm.token = "test-token"
+	tm.renewable = true
+	tm.ttl = 3600 * time.Second
+	tm.expiresAt = time.Now().Add(tm.ttl)
+
+	clock := newFakeClock()
+	client := &Client{
+		client:       apiClient,
+		logger:       logger,
+		token:        "test-token",
+		tokenManager: tm,
+		after:        clock.After,
+	}
+
+	ctx := context.Background()
+	require.NoError(t, client.StartTokenRenewer(ctx))
+	defer client.StopTokenRenewer()
+
+	t.Run("schedules renewal at two thirds of TTL", func(t *testing.T) {
+		assert.Equal(t, 2400*time.Second, clock.nextScheduled(t))
+	})
+
+	t.Run("double start is rejected", func(t *testing.T) {
+		err := client.StartTokenRenewer(ctx)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "already running")
+	})
+
+	t.Run("renews and reschedules from new TTL", func(t *testing.T) {
+		clock.fire <- time.Now()
+
+		assert.Equal(t, 60*time.Second, clock.nextScheduled(t))
+		assert.Equal(t, int32(1), renewals.Load())
+		assert.Equal(t, 90*time.Second, tm.GetTTL())
+	})
+
+	t.Run("stop allows restart", func(t *testing.T) {
+		client.StopTokenRenewer()
+		client.StopTokenRenewer()
+
+		require.NoError(t, client.StartTokenRenewer(ctx))
+		assert.Equal(t, 60*time.Second, clock.nextScheduled(t))
+	})
+}
+
+func TestClientTokenRenewerStopsOnContextCancel(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	tm := NewTokenManager(nil, &MockAuthMethod{name: "mock"}, logger)
+	tm.token = "test-token"
+	tm.ttl = 30 * time.Second
+
+	clock := newFakeClock()
+	client := &Client{logger: logger, tokenManager: tm, after: clock.After}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, client.StartTokenRenewer(ctx))
+	assert.Equal(t, 20*time.Second, clock.nextScheduled(t))
+
+	cancel()
+
+	select {
+	case <-client.renewerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewer did not exit after context cancellation")
+	}
+
+	client.StopTokenRenewer()
+}
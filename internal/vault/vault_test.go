@@ -1,7 +1,14 @@
 package vault
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,8 +16,14 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"digitalisio/vault-dm-crypt/internal/config"
+	"digitalisio/vault-dm-crypt/internal/tracing"
 )
 
 func TestNewClient(t *testing.T) {
@@ -36,6 +49,35 @@ func TestNewClient(t *testing.T) {
 		assert.NotNil(t, client.client)
 	})
 
+	t.Run("custom headers", func(t *testing.T) {
+		var received http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Clone()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"data":{"dmcrypt_key":"a2V5"}}`))
+		}))
+		defer server.Close()
+
+		cfg := &config.VaultConfig{
+			URL:         server.URL,
+			Backend:     "secret",
+			VaultToken:  "test-token",
+			TimeoutSecs: 30,
+			Headers:     map[string]string{"x-gateway-token": "gw-123", "traceparent": "00-abc-def-01"},
+		}
+
+		client, err := NewClient(cfg, logger)
+		require.NoError(t, err)
+		assert.Equal(t, "gw-123", client.client.Headers().Get("X-Gateway-Token"))
+
+		client.client.SetToken("test-token")
+		_, err = client.client.Logical().ReadWithContext(context.Background(), "secret/test")
+		require.NoError(t, err)
+		assert.Equal(t, "gw-123", received.Get("X-Gateway-Token"))
+		assert.Equal(t, "00-abc-def-01", received.Get("Traceparent"))
+		assert.Equal(t, "test-token", received.Get("X-Vault-Token"))
+	})
+
 	t.Run("nil configuration", func(t *testing.T) {
 		client, err := NewClient(nil, logger)
 		assert.Error(t, err)
@@ -102,6 +144,60 @@ func TestClientIsTokenValid(t *testing.T) {
 	})
 }
 
+func TestExpiresWithinBuffer(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		buffer    time.Duration
+		want      bool
+	}{
+		{"unknown expiry", time.Time{}, 30 * time.Second, false},
+		{"outside buffer", now.Add(31 * time.Second), 30 * time.Second, false},
+		{"exactly at buffer", now.Add(30 * time.Second), 30 * time.Second, false},
+		{"inside buffer", now.Add(29 * time.Second), 30 * time.Second, true},
+		{"already expired", now.Add(-time.Second), 30 * time.Second, true},
+		{"larger buffer", now.Add(90 * time.Second), 2 * time.Minute, true},
+		{"zero buffer not yet expired", now.Add(time.Second), 0, false},
+		{"zero buffer expired", now.Add(-time.Second), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, expiresWithinBuffer(now, tt.expiresAt, tt.buffer))
+		})
+	}
+}
+
+func TestClientIsTokenValidExpiryBuffer(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	cfg := &config.VaultConfig{
+		URL:              "http://localhost:8200",
+		Backend:          "secret",
+		ExpiryBufferSecs: 120,
+	}
+
+	client, err := NewClient(cfg, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, client.tokenManager.expiryBuffer)
+
+	client.token = "test-token"
+
+	client.tokenExp = time.Now().Add(90 * time.Second)
+	assert.False(t, client.IsTokenValid(), "token inside the configured buffer")
+
+	client.tokenExp = time.Now().Add(3 * time.Minute)
+	assert.True(t, client.IsTokenValid(), "token outside the configured buffer")
+
+	tm := client.tokenManager
+	tm.token = "test-token"
+	tm.expiresAt = time.Now().Add(90 * time.Second)
+	assert.False(t, tm.IsValid(), "token manager uses the same buffer")
+}
+
 func TestWithRetry(t *testing.T) {
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel) // Suppress retry logs for tests
@@ -176,6 +272,174 @@ func TestWithRetry(t *testing.T) {
 	})
 }
 
+func TestWithRetryLogDedup(t *testing.T) {
+	newRetryClient := func(dedup bool) (*Client, *bytes.Buffer) {
+		var logs bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&logs)
+		logger.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+		logger.SetLevel(logrus.WarnLevel)
+
+		cfg := &config.VaultConfig{
+			URL:           "http://localhost:8200",
+			Backend:       "secret",
+			RetryMax:      5,
+			RetryLogDedup: dedup,
+		}
+		client, err := NewClient(cfg, logger)
+		require.NoError(t, err)
+		return client, &logs
+	}
+
+	failures := []string{"connection refused", "connection refused", "connection refused", "server error", "server error", "server error"}
+	operation := func() func() error {
+		call := 0
+		return func() error {
+			err := errors.New(failures[call])
+			call++
+			return err
+		}
+	}
+
+	t.Run("identical errors are collapsed", func(t *testing.T) {
+		client, logs := newRetryClient(true)
+
+		err := client.WithRetry(context.Background(), operation())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "server error", "retry semantics are unchanged")
+
+		lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+		require.Len(t, lines, 5, "one warning per retry")
+		assert.Contains(t, lines[0], `error="connection refused"`)
+		assert.Contains(t, lines[1], "attempt 2/5, last error unchanged")
+		assert.NotContains(t, lines[1], "connection refused")
+		assert.Contains(t, lines[2], "attempt 3/5, last error unchanged")
+		assert.Contains(t, lines[3], `error="server error"`, "a changed error is logged in full")
+		assert.Contains(t, lines[4], "attempt 5/5, last error unchanged")
+		assert.Equal(t, 1, strings.Count(logs.String(), "connection refused"))
+	})
+
+	t.Run("deduplication disabled", func(t *testing.T) {
+		client, logs := newRetryClient(false)
+
+		require.Error(t, client.WithRetry(context.Background(), operation()))
+		assert.Equal(t, 3, strings.Count(logs.String(), "connection refused"))
+		assert.NotContains(t, logs.String(), "last error unchanged")
+	})
+}
+
+func TestWithRetryReauthenticates(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	newClient := func(t *testing.T, retryMax int) (*Client, *MockAuthMethod) {
+		client, err := NewClient(&config.VaultConfig{
+			URL:      "http://localhost:8200",
+			Backend:  "secret",
+			RetryMax: retryMax,
+		}, logger)
+		require.NoError(t, err)
+
+		mockAuth := &MockAuthMethod{name: "mock", responseToken: "fresh-token"}
+		client.tokenManager = NewTokenManager(client.client, mockAuth, logger)
+		return client, mockAuth
+	}
+	tokenExpired := &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"permission denied"}}
+
+	t.Run("token expired during operation", func(t *testing.T) {
+		// No retries are configured, so success depends on the re-authenticated attempt
+		client, mockAuth := newClient(t, 0)
+
+		calls := 0
+		err := client.WithRetry(context.Background(), func() error {
+			calls++
+			if calls == 1 {
+				return tokenExpired
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, 1, mockAuth.calls)
+		assert.Equal(t, "fresh-token", client.token)
+	})
+
+	t.Run("re-authenticates only once", func(t *testing.T) {
+		client, mockAuth := newClient(t, 1)
+
+		calls := 0
+		err := client.WithRetry(context.Background(), func() error {
+			calls++
+			return tokenExpired
+		})
+		require.Error(t, err)
+		assert.Equal(t, 3, calls, "initial try, re-authenticated try and one retry")
+		assert.Equal(t, 1, mockAuth.calls)
+	})
+
+	t.Run("other errors do not re-authenticate", func(t *testing.T) {
+		client, mockAuth := newClient(t, 0)
+
+		err := client.WithRetry(context.Background(), func() error {
+			return &api.ResponseError{StatusCode: http.StatusInternalServerError}
+		})
+		require.Error(t, err)
+		assert.Zero(t, mockAuth.calls)
+	})
+
+	t.Run("concurrent denials re-authenticate once", func(t *testing.T) {
+		client, mockAuth := newClient(t, 0)
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := client.WithRetry(context.Background(), func() error {
+					if token, _ := client.tokenState(); token != "fresh-token" {
+						return tokenExpired
+					}
+					return nil
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 1, mockAuth.calls)
+	})
+}
+
+func TestEnsureAuthenticatedConcurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	client, err := NewClient(&config.VaultConfig{
+		URL:     "http://localhost:8200",
+		Backend: "secret",
+	}, logger)
+	require.NoError(t, err)
+
+	mockAuth := &MockAuthMethod{name: "mock", responseToken: "fresh-token"}
+	client.tokenManager = NewTokenManager(client.client, mockAuth, logger)
+
+	// Batch workers share the client; only the first to find the token missing should log in
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.EnsureAuthenticated(context.Background()))
+			assert.True(t, client.IsTokenValid())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, mockAuth.calls)
+	token, _ := client.tokenState()
+	assert.Equal(t, "fresh-token", token)
+}
+
 func TestClose(t *testing.T) {
 	logger := logrus.New()
 	cfg := &config.VaultConfig{
@@ -302,9 +566,11 @@ type MockAuthMethod struct {
 	name          string
 	shouldFail    bool
 	responseToken string
+	calls         int
 }
 
 func (m *MockAuthMethod) Authenticate(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	m.calls++
 	if m.shouldFail {
 		return nil, assert.AnError
 	}
@@ -793,3 +1059,449 @@ func TestTokenManagerEnsureValid(t *testing.T) {
 		}
 	})
 }
+
+func TestListSecrets(t *testing.T) {
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/secret/metadata/vault-dm-crypt/host" && r.URL.Query().Get("list") == "true":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"data": {"keys": ["uuid-1", "uuid-2", "nested/"]}}`))
+		case r.URL.Path == "/v1/cold/metadata/vault-dm-crypt/host" && r.URL.Query().Get("list") == "true":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"data": {"keys": ["uuid-3"]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	entries, err := client.ListSecrets(context.Background(), "vault-dm-crypt/host")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uuid-1", "uuid-2"}, entries)
+
+	entries, err = client.ListSecrets(context.Background(), "vault-dm-crypt/other")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	entries, err = client.ListSecretsFrom(context.Background(), "cold", "vault-dm-crypt/host")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uuid-3"}, entries)
+}
+
+func TestDeleteSecret(t *testing.T) {
+	var deleted []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	t.Run("kv v2 soft-deletes the data path", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+
+		require.NoError(t, client.DeleteSecret(context.Background(), "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/secret/data/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+
+	t.Run("kv v1 deletes the secret path", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+		client.config.KVVersion = "1"
+
+		require.NoError(t, client.DeleteSecret(context.Background(), "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/secret/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+
+	t.Run("kv v2 soft-deletes on another backend", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+
+		require.NoError(t, client.DeleteSecretFrom(context.Background(), "cold", "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/cold/data/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+}
+
+func TestDestroySecret(t *testing.T) {
+	var deleted []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	t.Run("kv v2 deletes the metadata path", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+
+		require.NoError(t, client.DestroySecret(context.Background(), "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/secret/metadata/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+
+	t.Run("kv v1 deletes the secret path", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+		client.config.KVVersion = "1"
+
+		require.NoError(t, client.DestroySecret(context.Background(), "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/secret/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+
+	t.Run("kv v2 deletes the metadata path on another backend", func(t *testing.T) {
+		deleted = nil
+		client := newKVv2TestClient(t, handler)
+
+		require.NoError(t, client.DestroySecretFrom(context.Background(), "cold", "vault-dm-crypt/host/uuid-1"))
+		assert.Equal(t, []string{"/v1/cold/metadata/vault-dm-crypt/host/uuid-1"}, deleted)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+
+		err := client.DestroySecret(context.Background(), "vault-dm-crypt/host/uuid-1")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "secret/metadata/vault-dm-crypt/host/uuid-1")
+	})
+}
+
+func TestDeleteAndDestroyPaths(t *testing.T) {
+	client := &Client{config: &config.VaultConfig{Backend: "secret", KVVersion: "2"}}
+	assert.Equal(t, "secret/data/vault-dm-crypt/host/uuid-1", client.deletePath("secret", "vault-dm-crypt/host/uuid-1"))
+	assert.Equal(t, "secret/metadata/vault-dm-crypt/host/uuid-1", client.destroyPath("secret", "vault-dm-crypt/host/uuid-1"))
+
+	client.config.KVVersion = "1"
+	assert.Equal(t, "secret/vault-dm-crypt/host/uuid-1", client.deletePath("secret", "vault-dm-crypt/host/uuid-1"))
+	assert.Equal(t, "secret/vault-dm-crypt/host/uuid-1", client.destroyPath("secret", "vault-dm-crypt/host/uuid-1"))
+}
+
+func TestReadSecretFallbackBackend(t *testing.T) {
+	var requested []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/vault-dm-crypt/host/migrated":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "primary-key"}}}`))
+		case "/v1/legacy/data/vault-dm-crypt/host/migrated", "/v1/legacy/data/vault-dm-crypt/host/pending":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "legacy-key"}}}`))
+		case "/v1/legacy/data/vault-dm-crypt/host/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errors": ["internal error"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	newClient := func(t *testing.T) *Client {
+		requested = nil
+		client := newKVv2TestClient(t, handler)
+		client.config.FallbackBackend = "legacy"
+		return client
+	}
+
+	t.Run("found on primary", func(t *testing.T) {
+		client := newClient(t)
+		data, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/migrated")
+		require.NoError(t, err)
+		assert.Equal(t, "primary-key", data["dmcrypt_key"])
+		assert.Equal(t, []string{"/v1/secret/data/vault-dm-crypt/host/migrated"}, requested)
+	})
+
+	t.Run("not found on primary, found on fallback", func(t *testing.T) {
+		client := newClient(t)
+		data, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/pending")
+		require.NoError(t, err)
+		assert.Equal(t, "legacy-key", data["dmcrypt_key"])
+		assert.Equal(t, []string{
+			"/v1/secret/data/vault-dm-crypt/host/pending",
+			"/v1/legacy/data/vault-dm-crypt/host/pending",
+		}, requested)
+	})
+
+	t.Run("not found on either", func(t *testing.T) {
+		client := newClient(t)
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/missing")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrSecretNotFound))
+		assert.Contains(t, err.Error(), "secret/data/vault-dm-crypt/host/missing")
+	})
+
+	t.Run("fallback error is reported", func(t *testing.T) {
+		client := newClient(t)
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/broken")
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrSecretNotFound))
+		assert.Contains(t, err.Error(), "legacy/data/vault-dm-crypt/host/broken")
+	})
+
+	t.Run("no fallback configured", func(t *testing.T) {
+		client := newClient(t)
+		client.config.FallbackBackend = ""
+		_, err := client.ReadSecret(context.Background(), "vault-dm-crypt/host/pending")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrSecretNotFound))
+		assert.Len(t, requested, 1)
+	})
+
+	t.Run("writes use the primary backend", func(t *testing.T) {
+		client := newClient(t)
+		require.NoError(t, client.WriteSecret(context.Background(), "vault-dm-crypt/host/new", map[string]interface{}{"dmcrypt_key": "k"}))
+		assert.Equal(t, []string{"/v1/secret/data/vault-dm-crypt/host/new"}, requested)
+	})
+}
+
+func TestKVv2WritePayload(t *testing.T) {
+	data := map[string]interface{}{"dmcrypt_key": "k"}
+
+	assert.Equal(t, map[string]interface{}{"data": data}, kvV2WritePayload(data, nil))
+
+	createOnly := 0
+	assert.Equal(t, map[string]interface{}{
+		"data":    data,
+		"options": map[string]interface{}{"cas": 0},
+	}, kvV2WritePayload(data, &createOnly))
+
+	update := 3
+	assert.Equal(t, map[string]interface{}{
+		"data":    data,
+		"options": map[string]interface{}{"cas": 3},
+	}, kvV2WritePayload(data, &update))
+}
+
+func TestWriteSecretCAS(t *testing.T) {
+	var bodies []map[string]interface{}
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/vault-dm-crypt/host/existing":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors": ["check-and-set parameter did not match the current version"]}`))
+		case "/v1/secret/metadata/vault-dm-crypt/host/existing":
+			_, _ = w.Write([]byte(`{"data": {"current_version": 3, "versions": {"2": {}, "3": {}}}}`))
+		case "/v1/secret/data/vault-dm-crypt/host/new":
+			_, _ = w.Write([]byte(`{"data": {"version": 1}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	data := map[string]interface{}{"dmcrypt_key": "k"}
+
+	t.Run("create only", func(t *testing.T) {
+		bodies = nil
+		require.NoError(t, client.WriteSecretCAS(context.Background(), "vault-dm-crypt/host/new", data, 0))
+		require.Len(t, bodies, 1)
+		assert.Equal(t, map[string]interface{}{"cas": float64(0)}, bodies[0]["options"])
+	})
+
+	t.Run("existing secret is not overwritten", func(t *testing.T) {
+		err := client.WriteSecretCAS(context.Background(), "vault-dm-crypt/host/existing", data, 0)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrCASMismatch))
+	})
+
+	t.Run("update at the current version", func(t *testing.T) {
+		version, err := client.CurrentSecretVersion(context.Background(), "vault-dm-crypt/host/existing")
+		require.NoError(t, err)
+		assert.Equal(t, 3, version)
+
+		version, err = client.CurrentSecretVersion(context.Background(), "vault-dm-crypt/host/new-device")
+		require.NoError(t, err)
+		assert.Zero(t, version, "a secret that was never written is at version 0")
+	})
+
+	t.Run("plain writes carry no options", func(t *testing.T) {
+		bodies = nil
+		require.NoError(t, client.WriteSecret(context.Background(), "vault-dm-crypt/host/new", data))
+		require.Len(t, bodies, 1)
+		assert.NotContains(t, bodies[0], "options")
+	})
+
+	t.Run("requires kv v2", func(t *testing.T) {
+		client.config.KVVersion = "1"
+		defer func() { client.config.KVVersion = "2" }()
+		err := client.WriteSecretCAS(context.Background(), "vault-dm-crypt/host/new", data, 0)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "kv_version")
+	})
+}
+
+func TestProbeWrite(t *testing.T) {
+	var requests []string
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/data/vault-dm-crypt/host/readonly":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"errors": ["cannot write to readonly storage"]}`))
+		case "/v1/secret/data/vault-dm-crypt/host/new":
+			_, _ = w.Write([]byte(`{"data": {"version": 1}}`))
+		case "/v1/secret/metadata/vault-dm-crypt/host/new":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	t.Run("writes and removes the probe", func(t *testing.T) {
+		requests = nil
+		require.NoError(t, client.ProbeWrite(context.Background(), "vault-dm-crypt/host/new"))
+		assert.Equal(t, []string{
+			"PUT /v1/secret/data/vault-dm-crypt/host/new",
+			"DELETE /v1/secret/metadata/vault-dm-crypt/host/new",
+		}, requests)
+	})
+
+	t.Run("read-only mount", func(t *testing.T) {
+		requests = nil
+		err := client.ProbeWrite(context.Background(), "vault-dm-crypt/host/readonly")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "readonly storage")
+		assert.Len(t, requests, 1, "nothing is deleted when the write fails")
+	})
+}
+
+func TestSecretBackendOverride(t *testing.T) {
+	var requested []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/cold-secret/data/vault-dm-crypt/host/cold-uuid":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "cold-key"}}}`))
+		case "/v1/legacy/data/vault-dm-crypt/host/pending":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "legacy-key"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	newClient := func(t *testing.T) *Client {
+		requested = nil
+		client := newKVv2TestClient(t, handler)
+		client.config.FallbackBackend = "legacy"
+		return client
+	}
+
+	t.Run("write goes to the given backend", func(t *testing.T) {
+		client := newClient(t)
+		require.NoError(t, client.WriteSecretTo(context.Background(), "cold-secret", "vault-dm-crypt/host/new", map[string]interface{}{"dmcrypt_key": "k"}))
+		require.NoError(t, client.WriteSecretCASTo(context.Background(), "cold-secret", "vault-dm-crypt/host/cas", map[string]interface{}{"dmcrypt_key": "k"}, 0))
+		assert.Equal(t, []string{
+			"PUT /v1/cold-secret/data/vault-dm-crypt/host/new",
+			"PUT /v1/cold-secret/data/vault-dm-crypt/host/cas",
+		}, requested)
+	})
+
+	t.Run("read comes from the given backend", func(t *testing.T) {
+		client := newClient(t)
+		data, err := client.ReadSecretFrom(context.Background(), "cold-secret", "vault-dm-crypt/host/cold-uuid")
+		require.NoError(t, err)
+		assert.Equal(t, "cold-key", data["dmcrypt_key"])
+
+		// The same path on the configured backend holds nothing
+		_, err = client.ReadSecret(context.Background(), "vault-dm-crypt/host/cold-uuid")
+		assert.True(t, errors.Is(err, ErrSecretNotFound))
+	})
+
+	t.Run("fallback backend only applies to the configured backend", func(t *testing.T) {
+		client := newClient(t)
+		_, err := client.ReadSecretFrom(context.Background(), "cold-secret", "vault-dm-crypt/host/pending")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrSecretNotFound))
+		assert.Equal(t, []string{"GET /v1/cold-secret/data/vault-dm-crypt/host/pending"}, requested)
+	})
+
+	t.Run("empty backend uses the configured one", func(t *testing.T) {
+		client := newClient(t)
+		require.NoError(t, client.WriteSecretTo(context.Background(), "", "vault-dm-crypt/host/new", map[string]interface{}{"dmcrypt_key": "k"}))
+		assert.Equal(t, []string{"PUT /v1/secret/data/vault-dm-crypt/host/new"}, requested)
+	})
+
+	t.Run("write probe uses the given backend", func(t *testing.T) {
+		client := newClient(t)
+		require.NoError(t, client.ProbeWriteTo(context.Background(), "cold-secret", "vault-dm-crypt/host/probe"))
+		assert.Equal(t, []string{
+			"PUT /v1/cold-secret/data/vault-dm-crypt/host/probe",
+			"DELETE /v1/cold-secret/metadata/vault-dm-crypt/host/probe",
+		}, requested)
+	})
+}
+
+func TestSecretSpans(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	ctx, root := tracing.Start(context.Background(), "vault-dm-crypt encrypt")
+	require.NoError(t, client.WriteSecret(ctx, "vault-dm-crypt/host/uuid-1", map[string]interface{}{"dmcrypt_key": "c2VjcmV0"}))
+	_, err := client.ReadSecret(ctx, "vault-dm-crypt/host/missing")
+	require.Error(t, err)
+	tracing.End(root, nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	write, read, command := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "vault.write", write.Name)
+	assert.Equal(t, "vault.read", read.Name)
+	for _, span := range []tracetest.SpanStub{write, read} {
+		assert.Equal(t, command.SpanContext.SpanID(), span.Parent.SpanID())
+		assert.Contains(t, span.Attributes, attribute.String("vault.backend", "secret"))
+		for _, attr := range span.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), "c2VjcmV0", "spans never carry key material")
+		}
+	}
+	assert.Equal(t, codes.Unset, write.Status.Code)
+	assert.Equal(t, codes.Error, read.Status.Code)
+}
+
+func TestReadSecretKVv1(t *testing.T) {
+	var requested []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/vaultlocker/legacy-uuid":
+			_, _ = w.Write([]byte(`{"data": {"dmcrypt_key": "legacy-key"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	client := newKVv2TestClient(t, handler)
+
+	data, err := client.ReadSecretKVv1(context.Background(), "vaultlocker/legacy-uuid")
+	require.NoError(t, err)
+	assert.Equal(t, "legacy-key", data["dmcrypt_key"])
+	assert.Equal(t, []string{"/v1/secret/vaultlocker/legacy-uuid"}, requested, "read without the KV v2 data prefix")
+
+	_, err = client.ReadSecretKVv1(context.Background(), "vaultlocker/missing")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+}
@@ -0,0 +1,209 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"digitalisio/vault-dm-crypt/internal/errors"
+)
+
+// SecretVersion describes one KV v2 version of a secret
+type SecretVersion struct {
+	Version      int
+	CreatedTime  time.Time
+	DeletionTime time.Time // Zero unless the version was soft-deleted
+	Destroyed    bool
+	Current      bool
+}
+
+// ListSecretVersions returns the KV v2 version metadata for a secret, oldest first
+func (c *Client) ListSecretVersions(ctx context.Context, path string) ([]SecretVersion, error) {
+	return c.ListSecretVersionsFrom(ctx, c.config.Backend, path)
+}
+
+// ListSecretVersionsFrom is ListSecretVersions on the given KV backend instead of the configured one
+func (c *Client) ListSecretVersionsFrom(ctx context.Context, backend, path string) ([]SecretVersion, error) {
+	if c.config.KVVersion != "2" {
+		return nil, errors.New("secret version history requires kv_version = \"2\"")
+	}
+
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	fullPath := fmt.Sprintf("%s/metadata/%s", c.backendOrDefault(backend), path)
+	c.logger.WithField("path", fullPath).Debug("Reading secret metadata from Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().ReadWithContext(ctx, fullPath)
+	if err != nil {
+		return nil, errors.NewVaultReadError(fullPath, err)
+	}
+
+	if resp == nil || resp.Data == nil {
+		return nil, errors.NewVaultReadError(fullPath, ErrSecretNotFound)
+	}
+
+	rawVersions, ok := resp.Data["versions"].(map[string]interface{})
+	if !ok {
+		return nil, errors.NewVaultReadError(fullPath, fmt.Errorf("invalid metadata format"))
+	}
+
+	var currentVersion int
+	if current, ok := resp.Data["current_version"].(json.Number); ok {
+		value, _ := current.Int64()
+		currentVersion = int(value)
+	}
+
+	versions := make([]SecretVersion, 0, len(rawVersions))
+	for key, raw := range rawVersions {
+		number, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+
+		meta, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		version := SecretVersion{
+			Version: number,
+			Current: number == currentVersion,
+		}
+		version.CreatedTime = parseVaultTime(meta["created_time"])
+		version.DeletionTime = parseVaultTime(meta["deletion_time"])
+		version.Destroyed, _ = meta["destroyed"].(bool)
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+
+	c.logger.WithFields(logrus.Fields{
+		"path":     fullPath,
+		"versions": len(versions),
+	}).Debug("Successfully read secret metadata from Vault")
+
+	return versions, nil
+}
+
+// parseVaultTime parses an RFC3339 timestamp from Vault, returning zero for empty values
+func parseVaultTime(value interface{}) time.Time {
+	str, _ := value.(string)
+	if str == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// CurrentSecretVersion returns the current KV v2 version of a secret, 0 if it has never been
+// written. An update written with WriteSecretCAS at this version fails if another writer got there first.
+func (c *Client) CurrentSecretVersion(ctx context.Context, path string) (int, error) {
+	return c.CurrentSecretVersionFrom(ctx, c.config.Backend, path)
+}
+
+// CurrentSecretVersionFrom is CurrentSecretVersion on the given KV backend instead of the configured one
+func (c *Client) CurrentSecretVersionFrom(ctx context.Context, backend, path string) (int, error) {
+	versions, err := c.ListSecretVersionsFrom(ctx, backend, path)
+	if err != nil {
+		if stderrors.Is(err, ErrSecretNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for _, version := range versions {
+		if version.Current {
+			return version.Version, nil
+		}
+	}
+	return 0, nil
+}
+
+// ReadCustomMetadata returns the KV v2 custom metadata of a secret
+func (c *Client) ReadCustomMetadata(ctx context.Context, path string) (map[string]string, error) {
+	if c.config.KVVersion != "2" {
+		return nil, errors.New("custom metadata requires kv_version = \"2\"")
+	}
+
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+
+	fullPath := fmt.Sprintf("%s/metadata/%s", c.config.Backend, path)
+	c.logger.WithField("path", fullPath).Debug("Reading secret metadata from Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Logical().ReadWithContext(ctx, fullPath)
+	if err != nil {
+		return nil, errors.NewVaultReadError(fullPath, err)
+	}
+
+	if resp == nil || resp.Data == nil {
+		return nil, errors.NewVaultReadError(fullPath, ErrSecretNotFound)
+	}
+
+	metadata := make(map[string]string)
+	raw, _ := resp.Data["custom_metadata"].(map[string]interface{})
+	for key, value := range raw {
+		if str, ok := value.(string); ok {
+			metadata[key] = str
+		}
+	}
+
+	return metadata, nil
+}
+
+// UpdateCustomMetadata merges values into the KV v2 custom metadata of a secret,
+// leaving other keys and the secret data untouched
+func (c *Client) UpdateCustomMetadata(ctx context.Context, path string, values map[string]string) error {
+	if c.config.KVVersion != "2" {
+		return errors.New("custom metadata requires kv_version = \"2\"")
+	}
+
+	if err := c.EnsureAuthenticated(ctx); err != nil {
+		return err
+	}
+
+	fullPath := fmt.Sprintf("%s/metadata/%s", c.config.Backend, path)
+	c.logger.WithField("path", fullPath).Debug("Updating secret metadata in Vault")
+
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return err
+	}
+
+	customMetadata := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		customMetadata[key] = value
+	}
+
+	_, err := c.client.Logical().JSONMergePatch(ctx, fullPath, map[string]interface{}{
+		"custom_metadata": customMetadata,
+	})
+	if err != nil {
+		return errors.NewVaultWriteError(fullPath, err)
+	}
+
+	return nil
+}
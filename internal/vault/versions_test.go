@@ -0,0 +1,161 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"digitalisio/vault-dm-crypt/internal/config"
+)
+
+func newKVv2TestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	apiClient := newTestVaultServer(t, handler)
+	apiClient.SetToken("test-token")
+
+	return &Client{
+		client: apiClient,
+		config: &config.VaultConfig{Backend: "secret", KVVersion: "2"},
+		logger: logger,
+		token:  "test-token",
+	}
+}
+
+func TestReadSecretVersion(t *testing.T) {
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/vault-dm-crypt/host/uuid-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("version") {
+		case "":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "current-key"}, "metadata": {"version": 3}}}`))
+		case "2":
+			_, _ = w.Write([]byte(`{"data": {"data": {"dmcrypt_key": "previous-key"}, "metadata": {"version": 2}}}`))
+		case "1":
+			_, _ = w.Write([]byte(`{"data": {"data": null, "metadata": {"version": 1, "destroyed": true}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	ctx := context.Background()
+
+	t.Run("latest version", func(t *testing.T) {
+		data, err := client.ReadSecret(ctx, "vault-dm-crypt/host/uuid-1")
+		require.NoError(t, err)
+		assert.Equal(t, "current-key", data["dmcrypt_key"])
+	})
+
+	t.Run("specific version", func(t *testing.T) {
+		data, err := client.ReadSecretVersion(ctx, "vault-dm-crypt/host/uuid-1", 2)
+		require.NoError(t, err)
+		assert.Equal(t, "previous-key", data["dmcrypt_key"])
+	})
+
+	t.Run("destroyed version", func(t *testing.T) {
+		_, err := client.ReadSecretVersion(ctx, "vault-dm-crypt/host/uuid-1", 1)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "deleted or destroyed")
+	})
+
+	t.Run("versions require KV v2", func(t *testing.T) {
+		v1Client := &Client{
+			client: client.client,
+			config: &config.VaultConfig{Backend: "secret", KVVersion: "1"},
+			logger: client.logger,
+			token:  "test-token",
+		}
+
+		_, err := v1Client.ReadSecretVersion(ctx, "vault-dm-crypt/host/uuid-1", 2)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "kv_version")
+	})
+}
+
+func TestListSecretVersions(t *testing.T) {
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/metadata/vault-dm-crypt/host/uuid-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data": {
+			"current_version": 3,
+			"versions": {
+				"1": {"created_time": "2025-01-01T10:00:00.000000Z", "deletion_time": "", "destroyed": true},
+				"2": {"created_time": "2025-02-01T10:00:00.000000Z", "deletion_time": "2025-03-01T10:00:00.000000Z", "destroyed": false},
+				"3": {"created_time": "2025-03-01T10:00:00.000000Z", "deletion_time": "", "destroyed": false}
+			}
+		}}`))
+	})
+
+	versions, err := client.ListSecretVersions(context.Background(), "vault-dm-crypt/host/uuid-1")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+
+	assert.Equal(t, 1, versions[0].Version)
+	assert.True(t, versions[0].Destroyed)
+	assert.False(t, versions[0].Current)
+
+	assert.Equal(t, 2, versions[1].Version)
+	assert.False(t, versions[1].DeletionTime.IsZero())
+
+	assert.Equal(t, 3, versions[2].Version)
+	assert.True(t, versions[2].Current)
+	assert.Equal(t, 2025, versions[2].CreatedTime.Year())
+	assert.True(t, versions[2].DeletionTime.IsZero())
+}
+
+func TestCustomMetadata(t *testing.T) {
+	var patched map[string]interface{}
+	client := newKVv2TestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/metadata/vault-dm-crypt/host/uuid-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"data": {"current_version": 1, "custom_metadata": {"attempts_log_seq": "7", "attempts_log_hash": "abc"}}}`))
+		case http.MethodPatch:
+			assert.Equal(t, "application/merge-patch+json", r.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&patched))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	ctx := context.Background()
+
+	metadata, err := client.ReadCustomMetadata(ctx, "vault-dm-crypt/host/uuid-1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"attempts_log_seq": "7", "attempts_log_hash": "abc"}, metadata)
+
+	err = client.UpdateCustomMetadata(ctx, "vault-dm-crypt/host/uuid-1", map[string]string{"attempts_log_seq": "8"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"custom_metadata": map[string]interface{}{"attempts_log_seq": "8"}}, patched)
+
+	v1Client := &Client{
+		client: client.client,
+		config: &config.VaultConfig{Backend: "secret", KVVersion: "1"},
+		logger: client.logger,
+		token:  "test-token",
+	}
+	_, err = v1Client.ReadCustomMetadata(ctx, "vault-dm-crypt/host/uuid-1")
+	assert.Error(t, err)
+}